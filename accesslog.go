@@ -0,0 +1,268 @@
+package flareproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Access log formats selected through ACCESS_LOG_FORMAT.
+const (
+	// AccessLogCommon is the Common Log Format of Apache and nginx.
+	AccessLogCommon = "common"
+	// AccessLogCombined is the Common Log Format with the Referer and
+	// User-Agent of the request.
+	AccessLogCombined = "combined"
+	// AccessLogJSON writes a JSON object per request.
+	AccessLogJSON = "json"
+)
+
+// accessLog is the access logger installed by setupLogging, or nil
+// without ACCESS_LOG.
+var accessLog atomic.Pointer[accessLogger]
+
+// accessLogger writes a line per request in a format log analysis tools
+// read, separate from the structured log.
+type accessLogger struct {
+	format string
+
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// accessEntry is what the access log records about a request.
+type accessEntry struct {
+	Time       time.Time
+	Mode       string
+	RequestID  string
+	RemoteAddr string
+	Method     string
+	URI        string
+	Proto      string
+	Status     int
+	Bytes      int64
+	Referer    string
+	UserAgent  string
+	Duration   time.Duration
+	Target     string
+	Cache      string
+}
+
+// newAccessLoggerFromEnv reads ACCESS_LOG, "stdout", "stderr" or the path
+// of a file, and ACCESS_LOG_FORMAT, combined by default. Files are rotated
+// once they reach ACCESS_LOG_MAX_BYTES, keeping ACCESS_LOG_MAX_BACKUPS old
+// files. It returns nil if ACCESS_LOG is not set.
+func newAccessLoggerFromEnv() *accessLogger {
+	target := os.Getenv("ACCESS_LOG")
+	if target == "" {
+		return nil
+	}
+	format := strings.ToLower(envString("ACCESS_LOG_FORMAT", AccessLogCombined))
+	switch format {
+	case AccessLogCommon, AccessLogCombined, AccessLogJSON:
+	default:
+		slog.Warn("unknown ACCESS_LOG_FORMAT, using combined", "format", format)
+		format = AccessLogCombined
+	}
+	var w io.Writer
+	switch target {
+	case "stdout":
+		w = os.Stdout
+	case "stderr":
+		w = os.Stderr
+	default:
+		file, err := openRotatingFile(target, int64(envInt("ACCESS_LOG_MAX_BYTES", 100<<20)), envInt("ACCESS_LOG_MAX_BACKUPS", 5))
+		if err != nil {
+			slog.Warn("access log disabled", "path", target, "error", err)
+			return nil
+		}
+		w = file
+	}
+	return &accessLogger{format: format, w: w}
+}
+
+// log writes the line of a request.
+func (l *accessLogger) log(e accessEntry) {
+	line := l.line(e)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := io.WriteString(l.w, line); err != nil {
+		slog.Warn("failed to write access log", "error", err)
+	}
+}
+
+// close closes the access log file, if it writes to one.
+func (l *accessLogger) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if file, ok := l.w.(*rotatingFile); ok {
+		file.Close()
+	}
+}
+
+// line formats e, with the trailing newline.
+func (l *accessLogger) line(e accessEntry) string {
+	host := e.RemoteAddr
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if l.format == AccessLogJSON {
+		data, _ := json.Marshal(map[string]any{
+			"time":        e.Time.UTC().Format(time.RFC3339Nano),
+			"remote_addr": host,
+			"method":      e.Method,
+			"uri":         e.URI,
+			"protocol":    e.Proto,
+			"status":      e.Status,
+			"bytes":       e.Bytes,
+			"referer":     e.Referer,
+			"user_agent":  e.UserAgent,
+			"duration_ms": e.Duration.Milliseconds(),
+			"request_id":  e.RequestID,
+			"mode":        e.Mode,
+			"target":      e.Target,
+			"cache":       e.Cache,
+		})
+		return string(data) + "\n"
+	}
+	bytes := "-"
+	if e.Bytes > 0 {
+		bytes = strconv.FormatInt(e.Bytes, 10)
+	}
+	line := fmt.Sprintf("%s - - [%s] \"%s %s %s\" %d %s", host, e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		clfEscape(e.Method), clfEscape(e.URI), clfEscape(e.Proto), e.Status, bytes)
+	if l.format == AccessLogCombined {
+		line += fmt.Sprintf(" \"%s\" \"%s\"", clfField(e.Referer), clfField(e.UserAgent))
+	}
+	return line + "\n"
+}
+
+// clfField returns a quoted field of a log line, "-" if it is empty.
+func clfField(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return clfEscape(s)
+}
+
+// clfEscape escapes quotes, backslashes and control characters like
+// nginx does, so that a request cannot forge log lines.
+func clfEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\' || c < 0x20 || c >= 0x7f:
+			fmt.Fprintf(&b, "\\x%02X", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// logAccess writes the access log line of a request handled by
+// withRequestLogging.
+func logAccess(r *http.Request, mode string, info *requestInfo, start time.Time, duration time.Duration, status int, bytes int64) {
+	l := accessLog.Load()
+	if l == nil {
+		return
+	}
+	uri := r.RequestURI
+	if uri == "" {
+		uri = r.URL.RequestURI()
+	}
+	l.log(accessEntry{
+		Time:       start,
+		Mode:       mode,
+		RequestID:  info.ID,
+		RemoteAddr: r.RemoteAddr,
+		Method:     r.Method,
+		URI:        uri,
+		Proto:      r.Proto,
+		Status:     status,
+		Bytes:      bytes,
+		Referer:    r.Referer(),
+		UserAgent:  r.UserAgent(),
+		Duration:   duration,
+		Target:     info.Target,
+		Cache:      info.Cache,
+	})
+}
+
+// rotatingFile is a log file that is renamed to path.1 once it reaches
+// maxBytes, shifting older files up to path.<backups>, which is removed.
+type rotatingFile struct {
+	path     string
+	maxBytes int64
+	backups  int
+
+	file *os.File
+	size int64
+}
+
+func openRotatingFile(path string, maxBytes int64, backups int) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, maxBytes: maxBytes, backups: backups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+// Write appends p, rotating the file first if p would take it past its
+// size limit. Callers serialize writes.
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	if f.maxBytes > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxBytes {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	if f.backups <= 0 {
+		os.Remove(f.path)
+	} else {
+		os.Remove(f.path + "." + strconv.Itoa(f.backups))
+		for i := f.backups - 1; i >= 1; i-- {
+			os.Rename(f.path+"."+strconv.Itoa(i), f.path+"."+strconv.Itoa(i+1))
+		}
+		if err := os.Rename(f.path, f.path+".1"); err != nil {
+			return err
+		}
+	}
+	return f.open()
+}
+
+// Close closes the current file.
+func (f *rotatingFile) Close() error {
+	return f.file.Close()
+}
@@ -0,0 +1,101 @@
+package flareproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessLogFormats(t *testing.T) {
+	entry := accessEntry{
+		Time:       time.Date(2026, 10, 16, 13, 55, 36, 0, time.FixedZone("", -7*3600)),
+		Mode:       "direct",
+		RequestID:  "abc",
+		RemoteAddr: "192.0.2.7:4321",
+		Method:     "GET",
+		URI:        "/example.com/a b\"c",
+		Proto:      "HTTP/1.1",
+		Status:     200,
+		Bytes:      2326,
+		UserAgent:  "curl/8.0",
+		Duration:   1500 * time.Millisecond,
+		Target:     "https://example.com/",
+		Cache:      "MISS",
+	}
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{AccessLogCommon, `192.0.2.7 - - [16/Oct/2026:13:55:36 -0700] "GET /example.com/a b\x22c HTTP/1.1" 200 2326` + "\n"},
+		{AccessLogCombined, `192.0.2.7 - - [16/Oct/2026:13:55:36 -0700] "GET /example.com/a b\x22c HTTP/1.1" 200 2326 "-" "curl/8.0"` + "\n"},
+	}
+	for _, tt := range tests {
+		if got := (&accessLogger{format: tt.format}).line(entry); got != tt.want {
+			t.Errorf("%s line = %q, want %q", tt.format, got, tt.want)
+		}
+	}
+
+	var fields map[string]any
+	if err := json.Unmarshal([]byte((&accessLogger{format: AccessLogJSON}).line(entry)), &fields); err != nil {
+		t.Fatal(err)
+	}
+	if fields["remote_addr"] != "192.0.2.7" || fields["status"] != 200.0 || fields["duration_ms"] != 1500.0 || fields["cache"] != "MISS" {
+		t.Errorf("json line = %v", fields)
+	}
+
+	entry.Bytes = 0
+	if got := (&accessLogger{format: AccessLogCommon}).line(entry); !strings.HasSuffix(got, "200 -\n") {
+		t.Errorf("line without body = %q, want - for the bytes", got)
+	}
+}
+
+func TestAccessLogMiddleware(t *testing.T) {
+	var buf bytes.Buffer
+	defer accessLog.Store(accessLog.Swap(&accessLogger{format: AccessLogCombined, w: &buf}))
+
+	handler := withRequestLogging("direct", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+		w.Write([]byte("short and stout"))
+	}))
+	req := httptest.NewRequest("GET", "/example.com/?q=1", nil)
+	req.Header.Set("Referer", "https://ref.example/")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	want := `"GET /example.com/?q=1 HTTP/1.1" 418 15 "https://ref.example/" "-"` + "\n"
+	if !strings.HasPrefix(buf.String(), "192.0.2.1 - - [") || !strings.HasSuffix(buf.String(), want) {
+		t.Errorf("access log = %q, want a line ending in %q", buf.String(), want)
+	}
+}
+
+func TestAccessLogRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	t.Setenv("ACCESS_LOG", path)
+	t.Setenv("ACCESS_LOG_FORMAT", AccessLogCommon)
+	t.Setenv("ACCESS_LOG_MAX_BYTES", "100")
+	t.Setenv("ACCESS_LOG_MAX_BACKUPS", "2")
+	l := newAccessLoggerFromEnv()
+	if l == nil {
+		t.Fatal("access log not enabled")
+	}
+	defer l.close()
+
+	// Each line is 67 bytes, so every line starts a new file
+	for i := range 4 {
+		l.log(accessEntry{Time: time.Unix(int64(i), 0).UTC(), RemoteAddr: "192.0.2.7", Method: "GET", URI: "/" + string(rune('a'+i)), Proto: "HTTP/1.1", Status: 200, Bytes: 1})
+	}
+	for suffix, want := range map[string]string{"": "/d ", ".1": "/c ", ".2": "/b "} {
+		data, err := os.ReadFile(path + suffix)
+		if err != nil || strings.Count(string(data), "\n") != 1 || !strings.Contains(string(data), want) {
+			t.Errorf("access.log%s = %q, %v; want the line of %s", suffix, data, err, want)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("access.log.3 exists beyond ACCESS_LOG_MAX_BACKUPS")
+	}
+}
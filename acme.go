@@ -0,0 +1,77 @@
+package flareproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"log/slog"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// LetsEncryptDirectory is the ACME directory of Let's Encrypt, used unless
+// TLS_ACME_DIRECTORY names another CA.
+const LetsEncryptDirectory = acme.LetsEncryptURL
+
+// newACMEManager returns an autocert manager obtaining certificates for
+// the domains from the ACME CA at directoryURL, such as Let's Encrypt. It
+// answers TLS-ALPN-01 challenges on the TLS listeners themselves, so one
+// of them must be reachable on port 443 under each of the domains, and
+// renews certificates 30 days before they expire. The account key and
+// certificates are kept in cacheDir.
+func newACMEManager(directoryURL string, domains []string, email, cacheDir string) *autocert.Manager {
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(cacheDir),
+		HostPolicy: autocert.HostWhitelist(domains...),
+		Email:      email,
+		Client:     &acme.Client{DirectoryURL: directoryURL},
+	}
+}
+
+// acmeHello is the ClientHello used to obtain certificates ahead of the
+// first handshake. It offers ECDSA, so that the manager obtains the same
+// certificate modern clients get.
+func acmeHello(domain string) *tls.ClientHelloInfo {
+	return &tls.ClientHelloInfo{
+		ServerName:       domain,
+		CipherSuites:     []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+		SupportedCurves:  []tls.CurveID{tls.CurveP256},
+	}
+}
+
+// runACME obtains the certificates of the domains, so that the first
+// clients do not wait for the CA, and passes them to observe, every 12
+// hours until ctx is done. The manager renews them itself; failed
+// attempts are retried with growing delays.
+func runACME(ctx context.Context, m *autocert.Manager, domains []string, observe func(domain string, cert *tls.Certificate)) {
+	backoff := time.Minute
+	for {
+		wait := 12 * time.Hour
+		for _, domain := range domains {
+			cert, err := m.GetCertificate(acmeHello(domain))
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				slog.Error("failed to obtain ACME certificate", "domain", domain,
+					"retry_in", backoff.String(), "error", err)
+				wait = min(wait, backoff)
+				continue
+			}
+			observe(domain, cert)
+		}
+		if wait < 12*time.Hour {
+			backoff = min(2*backoff, time.Hour)
+		} else {
+			backoff = time.Minute
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
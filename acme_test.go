@@ -0,0 +1,109 @@
+package flareproxy
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeACMECache stores a certificate for domain in dir the way the
+// autocert DirCache does, and returns it.
+func writeACMECache(t *testing.T, dir, domain string) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: domain},
+		DNSNames:     []string{domain},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	data := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	if err := os.WriteFile(filepath.Join(dir, domain), data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return leaf
+}
+
+func TestACMEManager(t *testing.T) {
+	dir := t.TempDir()
+	cached := writeACMECache(t, dir, "a.example")
+	t.Setenv("TLS_ACME_DOMAINS", "A.example, b.example")
+	t.Setenv("TLS_ACME_DIRECTORY", "http://127.0.0.1:1/directory")
+	t.Setenv("TLS_ACME_EMAIL", "ops@example.com")
+	t.Setenv("TLS_CACHE_DIR", dir)
+	monitor := newTimeMonitor(time.Minute, 400*24*time.Hour)
+	l, err := newListenerTLSFromEnv(monitor)
+	if err != nil || l.acme == nil {
+		t.Fatalf("newListenerTLSFromEnv() = %v, %v", l, err)
+	}
+	if l.acme.Client.DirectoryURL != "http://127.0.0.1:1/directory" || l.acme.Email != "ops@example.com" {
+		t.Errorf("manager uses directory %q and email %q", l.acme.Client.DirectoryURL, l.acme.Email)
+	}
+
+	tests := []struct {
+		name    string
+		domain  string
+		wantErr bool
+	}{
+		{name: "cached certificate", domain: "a.example"},
+		{name: "not obtained", domain: "b.example", wantErr: true},
+		{name: "other domain", domain: "other.example", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cert, err := l.getCertificate(acmeHello(tt.domain))
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("getCertificate(%s) succeeded", tt.domain)
+				}
+				return
+			}
+			if err != nil || !cert.Leaf.Equal(cached) {
+				t.Errorf("getCertificate(%s) = %v, %v, want the cached certificate", tt.domain, cert, err)
+			}
+		})
+	}
+
+	// run obtains the certificates ahead of the first client and reports
+	// their expiry
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	observed := make(chan string, 1)
+	done := make(chan struct{})
+	go func() {
+		runACME(ctx, l.acme, []string{"a.example"}, func(domain string, cert *tls.Certificate) {
+			l.observe(domain, cert)
+			observed <- domain
+		})
+		close(done)
+	}()
+	if domain := <-observed; domain != "a.example" {
+		t.Errorf("observed %s, want a.example", domain)
+	}
+	cancel()
+	<-done
+	if !monitor.warned["cert listener a.example "+cached.SerialNumber.String()] {
+		t.Error("certificate expiry not monitored")
+	}
+}
@@ -0,0 +1,379 @@
+package flareproxy
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// adminHandler serves the admin API on its own port (ADMIN_PORT), so it
+// can be kept off the network clients use. Every request must carry the
+// ADMIN_TOKEN as a bearer token.
+type adminHandler struct {
+	*solver
+	token  string
+	reload func() error
+	mux    *http.ServeMux
+}
+
+func newAdminHandler(s *solver, token string, reload func() error) *adminHandler {
+	a := &adminHandler{solver: s, token: token, reload: reload, mux: http.NewServeMux()}
+	a.mux.HandleFunc("GET /admin/backends", a.listBackends)
+	a.mux.HandleFunc("POST /admin/backends/drain", a.drainBackend(true))
+	a.mux.HandleFunc("POST /admin/backends/resume", a.drainBackend(false))
+	a.mux.HandleFunc("POST /admin/backends/settings", a.configureBackend)
+	a.mux.HandleFunc("GET /admin/proxies", a.listProxies)
+	a.mux.HandleFunc("POST /admin/proxies/ban", a.banProxy(true))
+	a.mux.HandleFunc("POST /admin/proxies/unban", a.banProxy(false))
+	a.mux.HandleFunc("GET /admin/sessions", a.listSessions)
+	a.mux.HandleFunc("POST /admin/sessions/destroy", a.serveDestroySession)
+	a.mux.HandleFunc("GET /admin/clearances", a.listClearances)
+	a.mux.HandleFunc("POST /admin/clearances/drop", a.dropClearance)
+	a.mux.HandleFunc("GET /admin/cache", a.cacheStats)
+	a.mux.HandleFunc("POST /admin/cache/flush", a.flushCache)
+	a.mux.HandleFunc("GET /admin/bandwidth", a.listBandwidth)
+	a.mux.HandleFunc("GET /admin/domains", a.listDomains)
+	a.mux.HandleFunc("POST /admin/domains/disable", a.disableDomain(true))
+	a.mux.HandleFunc("POST /admin/domains/enable", a.disableDomain(false))
+	a.mux.HandleFunc("GET /admin/state", a.serveExportState)
+	a.mux.HandleFunc("POST /admin/state", a.serveImportState)
+	a.mux.HandleFunc("POST /admin/reload", a.serveReload)
+	a.mux.HandleFunc("GET /admin/requests", a.listRequests)
+	a.mux.HandleFunc("GET /admin/logging", a.getLogging)
+	a.mux.HandleFunc("PUT /admin/logging", a.setLogging)
+	return a
+}
+
+func (a *adminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet && r.URL.Path == DashboardPath {
+		serveDashboard(w, r)
+		return
+	}
+	if !a.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="flareproxygo-admin"`)
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid or missing admin token"})
+		return
+	}
+	a.mux.ServeHTTP(w, r)
+}
+
+func (a *adminHandler) authorized(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && a.token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) == 1
+}
+
+// adminBackend describes a backend in the admin API.
+type adminBackend struct {
+	URL      string `json:"url"`
+	Region   string `json:"region,omitempty"`
+	Circuit  string `json:"circuit"`
+	Draining bool   `json:"draining"`
+	// Incompatible backends run an unsupported FlareSolverr version
+	Incompatible bool `json:"incompatible,omitempty"`
+	Weight       int  `json:"weight"`
+	// MaxConcurrency is zero for no limit
+	MaxConcurrency int   `json:"max_concurrency"`
+	InFlight       int64 `json:"in_flight"`
+	Waiting        int64 `json:"waiting"`
+}
+
+func (a *adminHandler) listBackends(w http.ResponseWriter, r *http.Request) {
+	pool := a.backends.all()
+	backends := make([]adminBackend, len(pool))
+	for i, b := range pool {
+		backends[i] = adminBackend{
+			URL:            b.url,
+			Region:         b.Region(),
+			Circuit:        b.State(),
+			Draining:       b.Draining(),
+			Incompatible:   b.incompatible.Load(),
+			Weight:         b.Weight(),
+			MaxConcurrency: b.MaxConcurrency(),
+			InFlight:       b.inFlight.Load(),
+			Waiting:        b.waiting.Load(),
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"backends": backends})
+}
+
+// drainBackend puts a backend into maintenance mode, or takes it out
+// again. A draining backend finishes its in-flight solves but receives no
+// new traffic; once in_flight drops to zero it can be upgraded safely.
+func (a *adminHandler) drainBackend(draining bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			URL string `json:"url"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&body); err != nil || body.URL == "" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": `body must be {"url": "<backend URL>"}`})
+			return
+		}
+		ok, err := a.backends.setDraining(body.URL, draining)
+		a.respondConfigured(w, r, body.URL, ok, err)
+	}
+}
+
+// configureBackend changes a backend's weight, concurrency cap or whether
+// it is enabled, e.g. to shift traffic away from a struggling instance
+// during an incident. Omitted fields are left unchanged.
+func (a *adminHandler) configureBackend(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		URL string `json:"url"`
+		backendSettings
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&body); err != nil || body.URL == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": `body must be {"url": "<backend URL>", "weight": 2, "max_concurrency": 4, "enabled": true}`})
+		return
+	}
+	if err := body.validate(); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	ok, err := a.backends.configure(body.URL, body.backendSettings)
+	a.respondConfigured(w, r, body.URL, ok, err)
+}
+
+// respondConfigured answers a change to the backend with the given URL
+// with the list of backends. Changes that could not be saved are in effect
+// until the next restart.
+func (a *adminHandler) respondConfigured(w http.ResponseWriter, r *http.Request, url string, ok bool, err error) {
+	switch {
+	case !ok:
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "unknown backend " + url})
+	case err != nil:
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	default:
+		a.listBackends(w, r)
+	}
+}
+
+func (a *adminHandler) listProxies(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{"proxies": a.upstreams.list()})
+}
+
+// banProxy rests a configured upstream proxy, e.g. one a site has blocked,
+// for the given duration (UPSTREAM_PROXY_COOLDOWN by default), or lifts
+// its ban.
+func (a *adminHandler) banProxy(banned bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			URL      string `json:"url"`
+			Duration string `json:"duration"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&body); err != nil || body.URL == "" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": `body must be {"url": "<proxy URL>"}`})
+			return
+		}
+		proxy, err := parseUpstreamProxy(body.URL)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		var d time.Duration
+		if banned {
+			a.upstreams.mu.Lock()
+			d = a.upstreams.cooldown
+			a.upstreams.mu.Unlock()
+			if body.Duration != "" {
+				if d, err = time.ParseDuration(body.Duration); err != nil || d <= 0 {
+					writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid duration " + body.Duration})
+					return
+				}
+			}
+		}
+		if !a.upstreams.ban(proxy.URL, d) {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "unknown upstream proxy " + proxy.URL})
+			return
+		}
+		slog.Info("upstream proxy ban changed", "proxy", proxy.URL, "banned", banned, "duration", d.String())
+		a.listProxies(w, r)
+	}
+}
+
+func (a *adminHandler) listSessions(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{"sessions": a.sessions.list()})
+}
+
+// serveDestroySession closes a session's browser on its backend, e.g. one
+// stuck on a challenge. Requests for its domains solve without a session
+// until it is warmed again.
+func (a *adminHandler) serveDestroySession(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Session string `json:"session"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&body); err != nil || body.Session == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": `body must be {"session": "<session ID>"}`})
+		return
+	}
+	if a.sessions.backendFor(body.Session) == "" {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "unknown session " + body.Session})
+		return
+	}
+	if err := a.destroySession(r.Context(), body.Session); err != nil {
+		writeJSON(w, http.StatusBadGateway, map[string]string{"error": err.Error()})
+		return
+	}
+	slog.Info("session destroyed", "session", body.Session)
+	a.listSessions(w, r)
+}
+
+func (a *adminHandler) listClearances(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{"clearances": a.clearances.list()})
+}
+
+// dropClearance forgets the cookies stored for a host, so that its next
+// request is solved again.
+func (a *adminHandler) dropClearance(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Host string `json:"host"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&body); err != nil || body.Host == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": `body must be {"host": "<host>"}`})
+		return
+	}
+	a.clearances.drop(strings.ToLower(body.Host))
+	a.listClearances(w, r)
+}
+
+// adminCache describes the response cache in the admin API. The counts
+// are of requests since the proxy started.
+type adminCache struct {
+	Enabled bool `json:"enabled"`
+	CacheStats
+	Hits   int64 `json:"hits"`
+	Misses int64 `json:"misses"`
+	Stale  int64 `json:"stale"`
+}
+
+func (a *adminHandler) cacheStats(w http.ResponseWriter, r *http.Request) {
+	stats := adminCache{
+		Enabled: a.cache != nil,
+		Hits:    a.cacheCounts.hits.Load(),
+		Misses:  a.cacheCounts.misses.Load(),
+		Stale:   a.cacheCounts.stale.Load(),
+	}
+	if cache, ok := a.cache.(flushableCache); ok {
+		var err error
+		if stats.CacheStats, err = cache.Stats(); err != nil {
+			writeJSON(w, http.StatusBadGateway, map[string]string{"error": err.Error()})
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// flushCache removes every cached response.
+func (a *adminHandler) flushCache(w http.ResponseWriter, r *http.Request) {
+	cache, ok := a.cache.(flushableCache)
+	if !ok {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "caching is not enabled, set CACHE_TTL"})
+		return
+	}
+	n, err := cache.Flush()
+	if err != nil {
+		writeJSON(w, http.StatusBadGateway, map[string]string{"error": err.Error()})
+		return
+	}
+	slog.Info("cache flushed", "entries", n)
+	writeJSON(w, http.StatusOK, map[string]int{"flushed": n})
+}
+
+func (a *adminHandler) listDomains(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{"domains": a.budget.list()})
+}
+
+// disableDomain stops solving a domain for the given duration
+// (FAILURE_BUDGET_COOLDOWN by default), or enables a disabled domain
+// again, resetting its failure budget.
+func (a *adminHandler) disableDomain(disabled bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if a.budget == nil {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": "failure budget is not enabled, set FAILURE_BUDGET"})
+			return
+		}
+		var body struct {
+			Domain   string `json:"domain"`
+			Duration string `json:"duration"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&body); err != nil || body.Domain == "" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": `body must be {"domain": "<domain>"}`})
+			return
+		}
+		var d time.Duration
+		if disabled {
+			d = a.budget.cooldown
+			if body.Duration != "" {
+				var err error
+				if d, err = time.ParseDuration(body.Duration); err != nil || d <= 0 {
+					writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid duration " + body.Duration})
+					return
+				}
+			}
+		}
+		a.budget.disable(body.Domain, d)
+		slog.Info("domain failure budget changed", "domain", body.Domain, "disabled", disabled, "duration", d.String())
+		a.listDomains(w, r)
+	}
+}
+
+// serveReload reloads the config file, like SIGHUP.
+func (a *adminHandler) serveReload(w http.ResponseWriter, r *http.Request) {
+	if err := a.reload(); err != nil {
+		writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"error": err.Error()})
+		return
+	}
+	a.listBackends(w, r)
+}
+
+// adminLogging describes the logging settings in the admin API.
+type adminLogging struct {
+	Level        string   `json:"level"`
+	DebugDomains []string `json:"debug_domains"`
+	DebugKeys    []string `json:"debug_keys"`
+}
+
+func (a *adminHandler) getLogging(w http.ResponseWriter, r *http.Request) {
+	domains, keys := debugLogging.list()
+	writeJSON(w, http.StatusOK, adminLogging{
+		Level:        strings.ToLower(logLevel.Level().String()),
+		DebugDomains: domains,
+		DebugKeys:    keys,
+	})
+}
+
+// setLogging changes the log level and the requests logged at debug level
+// regardless of it. Fields left out of the body keep their value.
+func (a *adminHandler) setLogging(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Level        *string   `json:"level"`
+		DebugDomains *[]string `json:"debug_domains"`
+		DebugKeys    *[]string `json:"debug_keys"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&body); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON body: " + err.Error()})
+		return
+	}
+	if body.Level != nil {
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(*body.Level)); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "unknown log level " + *body.Level})
+			return
+		}
+		logLevel.Set(level)
+	}
+	if body.DebugDomains != nil || body.DebugKeys != nil {
+		domains, keys := debugLogging.list()
+		if body.DebugDomains != nil {
+			domains = *body.DebugDomains
+		}
+		if body.DebugKeys != nil {
+			keys = *body.DebugKeys
+		}
+		debugLogging.set(domains, keys)
+	}
+	slog.Info("logging settings changed", "level", logLevel.Level().String())
+	a.getLogging(w, r)
+}
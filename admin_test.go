@@ -0,0 +1,411 @@
+package flareproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func adminRequest(t *testing.T, h http.Handler, method, path, token, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestAdminAuth(t *testing.T) {
+	t.Setenv("FLARESOLVERR_URL", "http://a/v1")
+	h := newAdminHandler(newSolver(), "s3cret", nil)
+
+	for _, token := range []string{"", "wrong"} {
+		if rr := adminRequest(t, h, "GET", "/admin/backends", token, ""); rr.Code != http.StatusUnauthorized {
+			t.Errorf("token %q: status = %d, want 401", token, rr.Code)
+		}
+	}
+	if rr := adminRequest(t, h, "GET", "/admin/backends", "s3cret", ""); rr.Code != http.StatusOK {
+		t.Errorf("status = %d, want 200", rr.Code)
+	}
+}
+
+func TestAdminDrainBackend(t *testing.T) {
+	var hits [2]int
+	var servers [2]*httptest.Server
+	for i := range servers {
+		i := i
+		servers[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hits[i]++
+			json.NewEncoder(w).Encode(testResponse("<html></html>"))
+		}))
+		defer servers[i].Close()
+	}
+	t.Setenv("FLARESOLVERR_URL", servers[0].URL+","+servers[1].URL)
+	s := newSolver()
+	h := newAdminHandler(s, "s3cret", nil)
+
+	rr := adminRequest(t, h, "POST", "/admin/backends/drain", "s3cret", `{"url":"`+servers[0].URL+`"}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("drain status = %d: %s", rr.Code, rr.Body.String())
+	}
+	var listed struct {
+		Backends []adminBackend `json:"backends"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &listed)
+	if len(listed.Backends) != 2 || !listed.Backends[0].Draining || listed.Backends[1].Draining {
+		t.Fatalf("backends = %+v", listed.Backends)
+	}
+
+	for i := 0; i < 4; i++ {
+		if _, _, err := s.fetch(context.Background(), "request.get", "https://example.com/"); err != nil {
+			t.Fatalf("fetch() error = %v", err)
+		}
+	}
+	if hits[0] != 0 || hits[1] != 4 {
+		t.Errorf("backend hits = %d/%d, want all on the backend in service", hits[0], hits[1])
+	}
+
+	// With every backend draining, requests fail fast
+	adminRequest(t, h, "POST", "/admin/backends/drain", "s3cret", `{"url":"`+servers[1].URL+`"}`)
+	if _, _, err := s.fetch(context.Background(), "request.get", "https://example.com/"); !errors.Is(err, errAllDraining) {
+		t.Errorf("fetch() error = %v, want errAllDraining", err)
+	}
+
+	adminRequest(t, h, "POST", "/admin/backends/resume", "s3cret", `{"url":"`+servers[0].URL+`"}`)
+	if _, _, err := s.fetch(context.Background(), "request.get", "https://example.com/"); err != nil || hits[0] != 1 {
+		t.Errorf("fetch() after resume error = %v, hits = %d, want the resumed backend", err, hits[0])
+	}
+
+	if rr := adminRequest(t, h, "POST", "/admin/backends/drain", "s3cret", `{"url":"http://unknown/v1"}`); rr.Code != http.StatusNotFound {
+		t.Errorf("drain unknown backend status = %d, want 404", rr.Code)
+	}
+	if rr := adminRequest(t, h, "POST", "/admin/backends/drain", "s3cret", `{}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("drain without url status = %d, want 400", rr.Code)
+	}
+}
+
+func TestAdminBackendSettings(t *testing.T) {
+	t.Setenv("FLARESOLVERR_URL", "http://a/v1,http://b/v1")
+	h := newAdminHandler(newSolver(), "s3cret", nil)
+
+	rr := adminRequest(t, h, "POST", "/admin/backends/settings", "s3cret",
+		`{"url": "http://a/v1", "weight": 4, "max_concurrency": 3, "enabled": false}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rr.Code, rr.Body.String())
+	}
+	var listed struct {
+		Backends []adminBackend `json:"backends"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &listed)
+	if got := listed.Backends[0]; got.Weight != 4 || got.MaxConcurrency != 3 || !got.Draining {
+		t.Errorf("backend = %+v", got)
+	}
+	if got := listed.Backends[1]; got.Weight != 1 || got.MaxConcurrency != 0 || got.Draining {
+		t.Errorf("unchanged backend = %+v", got)
+	}
+
+	// Omitted settings are left as they are
+	rr = adminRequest(t, h, "POST", "/admin/backends/settings", "s3cret", `{"url": "http://a/v1", "enabled": true}`)
+	json.Unmarshal(rr.Body.Bytes(), &listed)
+	if got := listed.Backends[0]; got.Weight != 4 || got.MaxConcurrency != 3 || got.Draining {
+		t.Errorf("backend = %+v", got)
+	}
+
+	tests := []struct {
+		body string
+		want int
+	}{
+		{`{"weight": 2}`, http.StatusBadRequest},
+		{`{"url": "http://a/v1", "weight": 0}`, http.StatusBadRequest},
+		{`{"url": "http://a/v1", "max_concurrency": -1}`, http.StatusBadRequest},
+		{`{"url": "http://unknown/v1", "weight": 2}`, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if rr := adminRequest(t, h, "POST", "/admin/backends/settings", "s3cret", tt.body); rr.Code != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.body, rr.Code, tt.want)
+		}
+	}
+}
+
+func TestAdminReload(t *testing.T) {
+	t.Setenv("FLARESOLVERR_URL", "http://a/v1")
+	reloadErr := errors.New("config.toml: line 3: expected key = value")
+	h := newAdminHandler(newSolver(), "s3cret", func() error { return reloadErr })
+
+	if rr := adminRequest(t, h, "POST", "/admin/reload", "s3cret", ""); rr.Code != http.StatusUnprocessableEntity || !strings.Contains(rr.Body.String(), "line 3") {
+		t.Errorf("failed reload: status = %d, body = %s", rr.Code, rr.Body.String())
+	}
+	reloadErr = nil
+	if rr := adminRequest(t, h, "POST", "/admin/reload", "s3cret", ""); rr.Code != http.StatusOK {
+		t.Errorf("reload status = %d, want 200", rr.Code)
+	}
+}
+
+func TestAdminLogging(t *testing.T) {
+	t.Setenv("FLARESOLVERR_URL", "http://a/v1")
+	h := newAdminHandler(newSolver(), "s3cret", nil)
+	defer logLevel.Set(logLevel.Level())
+	defer debugLogging.set(nil, nil)
+
+	rr := adminRequest(t, h, "PUT", "/admin/logging", "s3cret", `{"level":"debug","debug_domains":["Example.com"]}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rr.Code, rr.Body.String())
+	}
+	// Fields left out keep their value
+	rr = adminRequest(t, h, "PUT", "/admin/logging", "s3cret", `{"debug_keys":["key-1"]}`)
+	var got adminLogging
+	json.Unmarshal(rr.Body.Bytes(), &got)
+	want := adminLogging{Level: "debug", DebugDomains: []string{"example.com"}, DebugKeys: []string{"key-1"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("logging = %+v, want %+v", got, want)
+	}
+	if logLevel.Level() != slog.LevelDebug {
+		t.Errorf("log level = %s, want DEBUG", logLevel.Level())
+	}
+
+	if rr := adminRequest(t, h, "PUT", "/admin/logging", "s3cret", `{"level":"loud"}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("unknown level: status = %d, want 400", rr.Code)
+	}
+}
+
+func TestAdminProxies(t *testing.T) {
+	t.Setenv("FLARESOLVERR_URL", "http://a/v1")
+	t.Setenv("UPSTREAM_PROXIES", "http://user:pw@a.proxy:3128,http://b.proxy:3128")
+	s := newSolver()
+	h := newAdminHandler(s, "s3cret", nil)
+
+	tests := []struct {
+		name       string
+		path       string
+		body       string
+		wantStatus int
+		wantBanned []string
+	}{
+		{name: "ban", path: "/admin/proxies/ban", body: `{"url": "http://A.proxy:3128"}`, wantStatus: http.StatusOK, wantBanned: []string{"http://a.proxy:3128"}},
+		{name: "ban for a while", path: "/admin/proxies/ban", body: `{"url": "http://b.proxy:3128", "duration": "1h"}`, wantStatus: http.StatusOK, wantBanned: []string{"http://a.proxy:3128", "http://b.proxy:3128"}},
+		{name: "unban", path: "/admin/proxies/unban", body: `{"url": "http://a.proxy:3128"}`, wantStatus: http.StatusOK, wantBanned: []string{"http://b.proxy:3128"}},
+		{name: "unknown", path: "/admin/proxies/ban", body: `{"url": "http://c.proxy:3128"}`, wantStatus: http.StatusNotFound},
+		{name: "invalid duration", path: "/admin/proxies/ban", body: `{"url": "http://a.proxy:3128", "duration": "soon"}`, wantStatus: http.StatusBadRequest},
+		{name: "missing url", path: "/admin/proxies/ban", body: `{}`, wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := adminRequest(t, h, "POST", tt.path, "s3cret", tt.body)
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rr.Code, tt.wantStatus, rr.Body.String())
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var listed struct {
+				Proxies []adminProxy `json:"proxies"`
+			}
+			json.Unmarshal(rr.Body.Bytes(), &listed)
+			var banned []string
+			for _, proxy := range listed.Proxies {
+				if proxy.Banned {
+					banned = append(banned, proxy.URL)
+				}
+			}
+			if !reflect.DeepEqual(banned, tt.wantBanned) {
+				t.Errorf("banned = %v, want %v", banned, tt.wantBanned)
+			}
+		})
+	}
+
+	// With every proxy banned, requests are refused rather than sent
+	// without one
+	s.upstreams.ban("http://a.proxy:3128", time.Hour)
+	rr := httptest.NewRecorder()
+	newDirectHandler(s).ServeHTTP(rr, httptest.NewRequest("GET", "/example.com/", nil))
+	if rr.Code != http.StatusServiceUnavailable || rr.Header().Get("Retry-After") == "" {
+		t.Errorf("status = %d, Retry-After %q, want 503 with Retry-After", rr.Code, rr.Header().Get("Retry-After"))
+	}
+}
+
+func TestAdminDomains(t *testing.T) {
+	t.Setenv("FLARESOLVERR_URL", "http://a/v1")
+	t.Setenv("FAILURE_BUDGET", "0.5")
+	s := newSolver()
+	h := newAdminHandler(s, "s3cret", nil)
+
+	tests := []struct {
+		name         string
+		path         string
+		body         string
+		wantStatus   int
+		wantDisabled []string
+	}{
+		{name: "disable", path: "/admin/domains/disable", body: `{"domain": "Hopeless.example"}`, wantStatus: http.StatusOK, wantDisabled: []string{"hopeless.example"}},
+		{name: "disable for a while", path: "/admin/domains/disable", body: `{"domain": "slow.example", "duration": "1h"}`, wantStatus: http.StatusOK, wantDisabled: []string{"hopeless.example", "slow.example"}},
+		{name: "enable", path: "/admin/domains/enable", body: `{"domain": "hopeless.example"}`, wantStatus: http.StatusOK, wantDisabled: []string{"slow.example"}},
+		{name: "invalid duration", path: "/admin/domains/disable", body: `{"domain": "a.example", "duration": "soon"}`, wantStatus: http.StatusBadRequest},
+		{name: "missing domain", path: "/admin/domains/disable", body: `{}`, wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := adminRequest(t, h, "POST", tt.path, "s3cret", tt.body)
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rr.Code, tt.wantStatus, rr.Body.String())
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var listed struct {
+				Domains []adminDomain `json:"domains"`
+			}
+			json.Unmarshal(rr.Body.Bytes(), &listed)
+			var disabled []string
+			for _, domain := range listed.Domains {
+				if domain.Disabled {
+					disabled = append(disabled, domain.Domain)
+				}
+			}
+			if !reflect.DeepEqual(disabled, tt.wantDisabled) {
+				t.Errorf("disabled = %v, want %v", disabled, tt.wantDisabled)
+			}
+		})
+	}
+
+	t.Setenv("FAILURE_BUDGET", "")
+	rr := adminRequest(t, newAdminHandler(newSolver(), "s3cret", nil), "POST", "/admin/domains/disable", "s3cret", `{"domain": "a.example"}`)
+	if rr.Code != http.StatusConflict {
+		t.Errorf("status = %d without a failure budget, want 409", rr.Code)
+	}
+}
+
+func TestAdminSessions(t *testing.T) {
+	var destroyed []string
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req FlareSolverrRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Cmd == "sessions.destroy" {
+			destroyed = append(destroyed, req.Session)
+		}
+		json.NewEncoder(w).Encode(testResponse(""))
+	}))
+	defer mockServer.Close()
+	t.Setenv("FLARESOLVERR_URL", mockServer.URL)
+	s := newSolver()
+	s.sessions.add("example.com", sessionID("example.com"), mockServer.URL)
+	s.sessions.add("www.example.com", sessionID("example.com"), mockServer.URL)
+	s.sessions.add("example.org", sessionID("example.org"), mockServer.URL)
+	h := newAdminHandler(s, "s3cret", nil)
+
+	rr := adminRequest(t, h, "GET", "/admin/sessions", "s3cret", "")
+	var listed struct {
+		Sessions []adminSession `json:"sessions"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &listed)
+	want := []adminSession{
+		{ID: "flareproxygo-example.com", Backend: mockServer.URL, Domains: []string{"example.com", "www.example.com"}},
+		{ID: "flareproxygo-example.org", Backend: mockServer.URL, Domains: []string{"example.org"}},
+	}
+	if !reflect.DeepEqual(listed.Sessions, want) {
+		t.Errorf("sessions = %+v, want %+v", listed.Sessions, want)
+	}
+
+	rr = adminRequest(t, h, "POST", "/admin/sessions/destroy", "s3cret", `{"session": "flareproxygo-example.org"}`)
+	if rr.Code != http.StatusOK || !reflect.DeepEqual(destroyed, []string{"flareproxygo-example.org"}) {
+		t.Errorf("status = %d, destroyed %v", rr.Code, destroyed)
+	}
+	if s.sessions.sessionFor("https://example.org/") != "" {
+		t.Error("destroyed session still used")
+	}
+	if rr := adminRequest(t, h, "POST", "/admin/sessions/destroy", "s3cret", `{"session": "flareproxygo-example.org"}`); rr.Code != http.StatusNotFound {
+		t.Errorf("status = %d for an unknown session, want 404", rr.Code)
+	}
+}
+
+func TestAdminClearances(t *testing.T) {
+	t.Setenv("FLARESOLVERR_URL", "http://a/v1")
+	s := newSolver()
+	solved := testResponse("<html></html>")
+	solved.Solution.UserAgent = "Mozilla/5.0"
+	solved.Solution.Cookies = []Cookie{{Name: ClearanceCookie, Value: "secret", Domain: ".example.com", Expires: float64(time.Now().Add(time.Hour).Unix())}}
+	s.clearances.put("https://example.com/", solved)
+	h := newAdminHandler(s, "s3cret", nil)
+
+	rr := adminRequest(t, h, "GET", "/admin/clearances", "s3cret", "")
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"name":"cf_clearance"`) {
+		t.Fatalf("response = %d %s", rr.Code, rr.Body.String())
+	}
+	if strings.Contains(rr.Body.String(), "secret") {
+		t.Error("cookie values are listed")
+	}
+	rr = adminRequest(t, h, "POST", "/admin/clearances/drop", "s3cret", `{"host": "Example.com"}`)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"clearances":[]`) {
+		t.Errorf("response = %d %s, want the clearance dropped", rr.Code, rr.Body.String())
+	}
+}
+
+func TestAdminCache(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(testResponse("<html>solved</html>"))
+	}))
+	defer mockServer.Close()
+	t.Setenv("FLARESOLVERR_URL", mockServer.URL)
+	t.Setenv("CACHE_TTL", "1m")
+	s := newSolver()
+	h := newAdminHandler(s, "s3cret", nil)
+	direct := newDirectHandler(s)
+	for _, path := range []string{"/example.com/", "/example.com/", "/example.org/"} {
+		direct.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	var stats adminCache
+	rr := adminRequest(t, h, "GET", "/admin/cache", "s3cret", "")
+	json.Unmarshal(rr.Body.Bytes(), &stats)
+	want := adminCache{Enabled: true, CacheStats: CacheStats{Backend: CacheBackendMemory, Entries: 2, Bytes: 38}, Hits: 1, Misses: 2}
+	if stats != want {
+		t.Errorf("cache = %+v, want %+v", stats, want)
+	}
+	rr = adminRequest(t, h, "POST", "/admin/cache/flush", "s3cret", "")
+	if rr.Code != http.StatusOK || strings.TrimSpace(rr.Body.String()) != `{"flushed":2}` {
+		t.Errorf("flush = %d %s", rr.Code, rr.Body.String())
+	}
+
+	t.Setenv("CACHE_TTL", "")
+	h = newAdminHandler(newSolver(), "s3cret", nil)
+	if rr := adminRequest(t, h, "GET", "/admin/cache", "s3cret", ""); !strings.Contains(rr.Body.String(), `"enabled":false`) {
+		t.Errorf("cache = %s, want disabled", rr.Body.String())
+	}
+	if rr := adminRequest(t, h, "POST", "/admin/cache/flush", "s3cret", ""); rr.Code != http.StatusConflict {
+		t.Errorf("flush status = %d without a cache, want 409", rr.Code)
+	}
+}
+
+func TestAdminBandwidth(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(testResponse("<html>solved</html>"))
+	}))
+	defer mockServer.Close()
+	t.Setenv("FLARESOLVERR_URL", mockServer.URL)
+	h := newAdminHandler(newSolver(), "s3cret", nil)
+	if rr := adminRequest(t, h, "GET", "/admin/bandwidth", "s3cret", ""); strings.TrimSpace(rr.Body.String()) != "[]" {
+		t.Errorf("bandwidth without limits = %s, want []", rr.Body.String())
+	}
+
+	t.Setenv("BANDWIDTH_LIMIT", "1000000")
+	s := newSolver()
+	h = newAdminHandler(s, "s3cret", nil)
+	req := httptest.NewRequest("GET", "/example.com/", nil)
+	req.RemoteAddr = "192.0.2.7:4321"
+	newDirectHandler(s).ServeHTTP(httptest.NewRecorder(), req)
+
+	var tenants []tenantUsage
+	rr := adminRequest(t, h, "GET", "/admin/bandwidth", "s3cret", "")
+	json.Unmarshal(rr.Body.Bytes(), &tenants)
+	if len(tenants) != 1 || tenants[0].Tenant != "192.0.2.7" || tenants[0].Bytes == 0 || tenants[0].Limit != 1000000 {
+		t.Errorf("bandwidth = %s", rr.Body.String())
+	}
+}
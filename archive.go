@@ -0,0 +1,220 @@
+package flareproxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SnapshotsPath serves archived bodies by the hex SHA-256 of their
+// content: GET SnapshotsPath + "/" + hash.
+const SnapshotsPath = "/api/v1/snapshots"
+
+// SnapshotHeader carries the hash under which a solution's body is
+// archived, so that downstream systems can refer to this version of the
+// page later.
+const SnapshotHeader = "X-FlareProxy-Snapshot"
+
+// archiveStore keeps every fetched body under ARCHIVE_DIR, addressed by
+// its SHA-256. Entries are immutable: a body fetched again, from any URL,
+// keeps the provenance of its first fetch. Entries older than
+// ARCHIVE_MAX_AGE are removed, and then the oldest ones until the archive
+// is within ARCHIVE_MAX_BYTES.
+type archiveStore struct {
+	mu       sync.Mutex
+	dir      string
+	maxAge   time.Duration // 0 keeps entries forever
+	maxBytes int64         // 0 does not limit the size
+	now      func() time.Time
+}
+
+// archiveEntry is the stored form of a body.
+type archiveEntry struct {
+	URL         string    `json:"url"`
+	ContentType string    `json:"content_type"`
+	FetchedAt   time.Time `json:"fetched_at"`
+	Body        string    `json:"body"`
+}
+
+// newArchiveStoreFromEnv returns the archive in ARCHIVE_DIR, bounded by
+// ARCHIVE_MAX_AGE and ARCHIVE_MAX_BYTES, or nil if it is not set.
+func newArchiveStoreFromEnv() *archiveStore {
+	dir := os.Getenv("ARCHIVE_DIR")
+	if dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		slog.Warn("archive disabled", "dir", dir, "error", err)
+		return nil
+	}
+	a := &archiveStore{
+		dir:      dir,
+		maxAge:   envDuration("ARCHIVE_MAX_AGE", 0),
+		maxBytes: int64(envInt("ARCHIVE_MAX_BYTES", 1<<30)),
+		now:      time.Now,
+	}
+	a.prune()
+	return a
+}
+
+// contentHash returns the hex SHA-256 of body.
+func contentHash(body string) string {
+	sum := sha256.Sum256([]byte(body))
+	return hex.EncodeToString(sum[:])
+}
+
+// path returns the file of the entry with the given hash, spread over
+// subdirectories by its first two digits.
+func (a *archiveStore) path(hash string) string {
+	return filepath.Join(a.dir, hash[:2], hash+".json")
+}
+
+// put archives the body of a solution fetched from targetURL, unless it
+// is archived already. Responses served from the cache are not passed in:
+// their body was archived when it was fetched.
+func (a *archiveStore) put(targetURL string, flareResponse *FlareSolverrResponse) {
+	if a == nil {
+		return
+	}
+	path := a.path(contentHash(flareResponse.Solution.Response))
+	if _, err := os.Stat(path); err == nil {
+		return
+	}
+	data, err := json.Marshal(archiveEntry{
+		URL:         targetURL,
+		ContentType: solutionContentType(flareResponse),
+		FetchedAt:   flareResponse.EndTime(),
+		Body:        flareResponse.Solution.Response,
+	})
+	if err == nil && a.maxBytes > 0 && int64(len(data)) > a.maxBytes {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(path), 0o700)
+	}
+	if err == nil {
+		err = writeFileAtomic(path, data)
+	}
+	if err != nil {
+		slog.Warn("failed to archive body", "target", targetURL, "error", err)
+		return
+	}
+	a.pruneLocked()
+}
+
+// prune removes the entries over the archive's limits.
+func (a *archiveStore) prune() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.pruneLocked()
+}
+
+// pruneLocked removes the entries older than the maximum age, and then
+// the oldest ones until the archive is within its size. a.mu must be
+// held.
+func (a *archiveStore) pruneLocked() {
+	if a.maxAge <= 0 && a.maxBytes <= 0 {
+		return
+	}
+	type file struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	var files []file
+	var total int64
+	cutoff := a.now().Add(-a.maxAge)
+	filepath.WalkDir(a.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.HasSuffix(d.Name(), ".json") {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		if a.maxAge > 0 && info.ModTime().Before(cutoff) {
+			os.Remove(path)
+			return nil
+		}
+		files = append(files, file{path: path, size: info.Size(), modTime: info.ModTime()})
+		total += info.Size()
+		return nil
+	})
+	if a.maxBytes <= 0 {
+		return
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+	for len(files) > 0 && total > a.maxBytes {
+		os.Remove(files[0].path)
+		total -= files[0].size
+		files = files[1:]
+	}
+}
+
+// get returns the entry with the given hash.
+func (a *archiveStore) get(hash string) (archiveEntry, bool) {
+	var entry archiveEntry
+	data, err := os.ReadFile(a.path(hash))
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			slog.Warn("failed to read archived body", "hash", hash, "error", err)
+		}
+		return entry, false
+	}
+	if err := json.Unmarshal(data, &entry); err != nil {
+		slog.Warn("ignoring corrupt archived body", "hash", hash, "error", err)
+		return entry, false
+	}
+	return entry, true
+}
+
+// isContentHash reports whether s is a lowercase hex SHA-256.
+func isContentHash(s string) bool {
+	if len(s) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil && strings.ToLower(s) == s
+}
+
+// serveSnapshot answers GET SnapshotsPath/{sha256} with the archived body,
+// its original Content-Type and provenance. Snapshots never change, so
+// they may be cached forever.
+func (s *solver) serveSnapshot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.archive == nil {
+		sendErrorStatus(w, r, http.StatusNotFound, "the archive is not enabled, set ARCHIVE_DIR")
+		return
+	}
+	hash := strings.ToLower(strings.TrimPrefix(r.URL.Path, SnapshotsPath+"/"))
+	if !isContentHash(hash) {
+		sendErrorStatus(w, r, http.StatusBadRequest, "snapshots are addressed by the hex SHA-256 of their body")
+		return
+	}
+	entry, ok := s.archive.get(hash)
+	if !ok {
+		sendErrorStatus(w, r, http.StatusNotFound, "no snapshot "+hash)
+		return
+	}
+	setProvenanceHeaders(w, responseMeta{URL: entry.URL, FetchedAt: entry.FetchedAt})
+	w.Header().Set("Content-Type", entry.ContentType)
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Header().Set("ETag", `"`+hash+`"`)
+	w.Header().Set(SnapshotHeader, hash)
+	http.ServeContent(w, r, "", entry.FetchedAt, strings.NewReader(entry.Body))
+}
@@ -0,0 +1,147 @@
+package flareproxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSnapshots(t *testing.T) {
+	solves := 0
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		solves++
+		resp := testResponse(`{"version": 1}`)
+		resp.EndTimestamp = time.Date(2025, 6, 1, 9, 0, 0, 0, time.UTC).UnixMilli()
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer mockServer.Close()
+	t.Setenv("FLARESOLVERR_URL", mockServer.URL)
+	t.Setenv("ARCHIVE_DIR", t.TempDir())
+	handler := NewDirectHandler()
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/example.com/api", nil))
+	hash := rr.Header().Get(SnapshotHeader)
+	if hash != contentHash(`{"version": 1}`) {
+		t.Fatalf("%s = %q, want the body's SHA-256", SnapshotHeader, hash)
+	}
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", SnapshotsPath+"/"+hash, nil))
+	if rr.Code != http.StatusOK || rr.Body.String() != `{"version": 1}` {
+		t.Fatalf("snapshot = %d %q", rr.Code, rr.Body.String())
+	}
+	if got := rr.Header().Get("Content-Type"); got != contentTypeJSON {
+		t.Errorf("Content-Type = %q, want the original one", got)
+	}
+	if rr.Header().Get(OriginHeader) != "https://example.com/api" || rr.Header().Get(FetchedAtHeader) != "2025-06-01T09:00:00Z" {
+		t.Errorf("provenance = %s at %s", rr.Header().Get(OriginHeader), rr.Header().Get(FetchedAtHeader))
+	}
+	if !strings.Contains(rr.Header().Get("Cache-Control"), "immutable") {
+		t.Errorf("Cache-Control = %q, want immutable", rr.Header().Get("Cache-Control"))
+	}
+
+	// The same body from another URL keeps the first provenance
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/example.org/", nil))
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", SnapshotsPath+"/"+strings.ToUpper(hash), nil))
+	if rr.Header().Get(OriginHeader) != "https://example.com/api" {
+		t.Errorf("origin = %q, want the first fetch", rr.Header().Get(OriginHeader))
+	}
+
+	tests := []struct {
+		path string
+		want int
+	}{
+		{SnapshotsPath + "/" + contentHash("never fetched"), http.StatusNotFound},
+		{SnapshotsPath + "/abc", http.StatusBadRequest},
+		{SnapshotsPath + "/../../etc/passwd", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("GET", tt.path, nil))
+		if rr.Code != tt.want {
+			t.Errorf("GET %s status = %d, want %d", tt.path, rr.Code, tt.want)
+		}
+	}
+	if solves != 2 {
+		t.Errorf("FlareSolverr solved %d pages, want 2", solves)
+	}
+}
+
+func TestSnapshotsDisabled(t *testing.T) {
+	t.Setenv("ARCHIVE_DIR", "")
+	handler := NewDirectHandler()
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", SnapshotsPath+"/"+contentHash("x"), nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want 404 without an archive", rr.Code)
+	}
+}
+
+func TestArchivePrune(t *testing.T) {
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		maxAge   time.Duration
+		maxBytes int64
+		want     []string
+	}{
+		{name: "unbounded", want: []string{"old", "older", "new"}},
+		{name: "max age", maxAge: 36 * time.Hour, want: []string{"old", "new"}},
+		{name: "max bytes", maxBytes: 1, want: []string{}},
+		{name: "max bytes keeps the newest", maxBytes: 200, want: []string{"new"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &archiveStore{dir: t.TempDir(), now: func() time.Time { return now }}
+			for age, body := range map[time.Duration]string{48 * time.Hour: "older", 24 * time.Hour: "old", 0: "new"} {
+				a.put("https://example.com/"+body, testResponse(body))
+				path := a.path(contentHash(body))
+				if err := os.Chtimes(path, now.Add(-age), now.Add(-age)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			a.maxAge, a.maxBytes = tt.maxAge, tt.maxBytes
+			a.prune()
+			var got []string
+			for _, body := range []string{"old", "older", "new"} {
+				if _, ok := a.get(contentHash(body)); ok {
+					got = append(got, body)
+				}
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("archived = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestArchiveSkipsCacheHits(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(testResponse("<html>page</html>"))
+	}))
+	defer mockServer.Close()
+	t.Setenv("FLARESOLVERR_URL", mockServer.URL)
+	t.Setenv("CACHE_TTL", "1h")
+	t.Setenv("ARCHIVE_DIR", t.TempDir())
+	s := newSolver()
+	if _, meta, err := s.fetch(context.Background(), "request.get", "https://example.com/"); err != nil || meta.Cache != "MISS" {
+		t.Fatalf("fetch() = %+v, %v", meta, err)
+	}
+	path := s.archive.path(contentHash("<html>page</html>"))
+	if err := os.Remove(path); err != nil {
+		t.Fatalf("body not archived: %v", err)
+	}
+	if _, meta, err := s.fetch(context.Background(), "request.get", "https://example.com/"); err != nil || meta.Cache != "HIT" {
+		t.Fatalf("fetch() = %+v, %v", meta, err)
+	}
+	if _, err := os.Stat(path); err == nil {
+		t.Error("cache hit archived again")
+	}
+}
@@ -0,0 +1,130 @@
+package flareproxy
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// apiKeySet holds the API keys clients must present when API_KEYS is set.
+type apiKeySet struct {
+	keys []string
+}
+
+// apiKeysFromEnv reads API_KEYS, a comma separated list of keys. It
+// returns nil, disabling authentication, if none are set.
+func apiKeysFromEnv() *apiKeySet {
+	keys := splitList(os.Getenv("API_KEYS"))
+	if len(keys) == 0 {
+		return nil
+	}
+	return &apiKeySet{keys: keys}
+}
+
+// valid reports whether key is one of the keys, in constant time.
+func (a *apiKeySet) valid(key string) bool {
+	ok := false
+	for _, k := range a.keys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(k)) == 1 {
+			ok = true
+		}
+	}
+	return ok && key != ""
+}
+
+// find returns the first valid key among the candidates.
+func (a *apiKeySet) find(candidates ...string) (string, bool) {
+	for _, key := range candidates {
+		if a.valid(key) {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// basicCredentials returns the user name and password of a Basic
+// Authorization or Proxy-Authorization header value.
+func basicCredentials(header string) (username, password string) {
+	scheme, encoded, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return "", ""
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return "", ""
+	}
+	username, password, _ = strings.Cut(string(decoded), ":")
+	return username, password
+}
+
+// authorize checks the credentials of a request against AUTH_RULES or,
+// if no rule applies, against API_KEYS when it is set. A key is accepted
+// in the APIKeyHeader or as the password, or user name, of Basic
+// credentials, which proxy requests may also send in Proxy-Authorization.
+// Requests without a required key are answered with 401, or 407 for proxy
+// requests, and requests without a required client certificate with 403;
+// false is then returned. The key identifies the client for fair queueing
+// and debug logging, on open routes too. The request returned carries
+// the credentials, for the pipeline to check the targets of batches, jobs
+// and schedules against AUTH_RULES domain rules.
+func (s *solver) authorize(w http.ResponseWriter, r *http.Request, proxy bool) (*http.Request, bool) {
+	info, ok := r.Context().Value(requestInfoKey).(*requestInfo)
+	if !ok {
+		// Handlers used without withRequestLogging
+		info = &requestInfo{APIKey: r.Header.Get(APIKeyHeader)}
+		r = r.WithContext(context.WithValue(r.Context(), requestInfoKey, info))
+	}
+	info.Remote, info.ClientCert = true, clientCertificateVerified(r)
+	var candidates []string
+	if key, ok := r.Context().Value(tunnelKey).(string); ok {
+		candidates = []string{key}
+	} else {
+		username, password := basicCredentials(r.Header.Get("Authorization"))
+		candidates = []string{r.Header.Get(APIKeyHeader), password, username}
+		if proxy {
+			username, password := basicCredentials(r.Header.Get("Proxy-Authorization"))
+			candidates = append(candidates, password, username)
+		}
+	}
+	reqs, ok := s.authRules.requirements(r, proxy)
+	if !ok && s.apiKeys != nil {
+		reqs = []authRequirement{{keys: s.apiKeys}}
+	}
+	var key string
+	for _, req := range reqs {
+		if req.mtls && !info.ClientCert {
+			sendErrorStatus(w, r, http.StatusForbidden, "a valid client certificate is required")
+			return r, false
+		}
+		if req.keys == nil {
+			continue
+		}
+		if key, ok = req.keys.find(candidates...); !ok {
+			if proxy {
+				w.Header().Set("Proxy-Authenticate", `Basic realm="flareproxygo"`)
+				sendErrorStatus(w, r, http.StatusProxyAuthRequired, "a valid API key is required")
+				return r, false
+			}
+			w.Header().Set("WWW-Authenticate", `Basic realm="flareproxygo"`)
+			sendErrorStatus(w, r, http.StatusUnauthorized, "a valid API key is required")
+			return r, false
+		}
+	}
+	if key == "" && s.apiKeys == nil {
+		// Without API_KEYS, clients name themselves in the APIKeyHeader
+		return r, true
+	}
+	if key == "" {
+		key, _ = s.apiKeys.find(candidates...)
+	}
+	info.APIKey = key
+	return r, true
+}
+
+// withTunnelKey marks ctx as belonging to a tunnel opened with key.
+func withTunnelKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, tunnelKey, key)
+}
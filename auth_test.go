@@ -0,0 +1,163 @@
+package flareproxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func basicAuth(username, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+}
+
+func TestAPIKeyAuth(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(testResponse("<html>solved</html>"))
+	}))
+	defer mockServer.Close()
+	t.Setenv("FLARESOLVERR_URL", mockServer.URL)
+	t.Setenv("API_KEYS", "key-a, key-b")
+	s := newSolver()
+	direct := newDirectHandler(s)
+	proxy := newProxyHandler(s)
+
+	tests := []struct {
+		name       string
+		handler    http.Handler
+		url        string
+		headers    map[string]string
+		wantStatus int
+		wantHeader string
+	}{
+		{name: "direct without key", handler: direct, url: "/example.com/", wantStatus: http.StatusUnauthorized, wantHeader: "WWW-Authenticate"},
+		{name: "direct with wrong key", handler: direct, url: "/example.com/", headers: map[string]string{APIKeyHeader: "key-c"}, wantStatus: http.StatusUnauthorized},
+		{name: "direct with header", handler: direct, url: "/example.com/", headers: map[string]string{APIKeyHeader: "key-b"}, wantStatus: http.StatusOK},
+		{name: "direct with basic password", handler: direct, url: "/example.com/", headers: map[string]string{"Authorization": basicAuth("me", "key-a")}, wantStatus: http.StatusOK},
+		{name: "direct with basic user name", handler: direct, url: "/example.com/", headers: map[string]string{"Authorization": basicAuth("key-a", "")}, wantStatus: http.StatusOK},
+		{name: "direct ignores proxy credentials", handler: direct, url: "/example.com/", headers: map[string]string{"Proxy-Authorization": basicAuth("me", "key-a")}, wantStatus: http.StatusUnauthorized},
+		{name: "health stays open", handler: direct, url: "/healthz", wantStatus: http.StatusOK},
+		{name: "metrics need a key", handler: direct, url: MetricsPath, wantStatus: http.StatusUnauthorized},
+		{name: "proxy without key", handler: proxy, url: "http://example.com/", wantStatus: http.StatusProxyAuthRequired, wantHeader: "Proxy-Authenticate"},
+		{name: "proxy with proxy credentials", handler: proxy, url: "http://example.com/", headers: map[string]string{"Proxy-Authorization": basicAuth("me", "key-a")}, wantStatus: http.StatusOK},
+		{name: "proxy with header", handler: proxy, url: "http://example.com/", headers: map[string]string{APIKeyHeader: "key-a"}, wantStatus: http.StatusOK},
+		{name: "proxy with wrong credentials", handler: proxy, url: "http://example.com/", headers: map[string]string{"Proxy-Authorization": basicAuth("me", "nope")}, wantStatus: http.StatusProxyAuthRequired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.url, nil)
+			for name, value := range tt.headers {
+				req.Header.Set(name, value)
+			}
+			rr := httptest.NewRecorder()
+			tt.handler.ServeHTTP(rr, req)
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rr.Code, tt.wantStatus, rr.Body.String())
+			}
+			if tt.wantHeader != "" && rr.Header().Get(tt.wantHeader) != `Basic realm="flareproxygo"` {
+				t.Errorf("%s = %q", tt.wantHeader, rr.Header().Get(tt.wantHeader))
+			}
+		})
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		t.Setenv("API_KEYS", "")
+		rr := httptest.NewRecorder()
+		NewDirectHandler().ServeHTTP(rr, httptest.NewRequest("GET", "/example.com/", nil))
+		if rr.Code != http.StatusOK {
+			t.Errorf("status = %d, want 200 without API_KEYS", rr.Code)
+		}
+	})
+}
+
+func TestSOCKSAuth(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(testResponse("<html>solved</html>"))
+	}))
+	defer mockServer.Close()
+	t.Setenv("FLARESOLVERR_URL", mockServer.URL)
+	t.Setenv("API_KEYS", "key-a")
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newSOCKSServer("", newProxyHandler(newSolver()))
+	go srv.Serve(ln)
+	defer srv.Shutdown(context.Background())
+
+	tests := []struct {
+		name     string
+		username string
+		password string
+		wantOK   bool
+	}{
+		{name: "password", username: "me", password: "key-a", wantOK: true},
+		{name: "user name", username: "key-a", wantOK: true},
+		{name: "wrong key", username: "me", password: "key-b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.Write([]byte{socksVersion, 2, socksNoAuth, socksUserPass})
+			method := make([]byte, 2)
+			if _, err := io.ReadFull(conn, method); err != nil || method[1] != socksUserPass {
+				t.Fatalf("method selection = %v, %v", method, err)
+			}
+			auth := []byte{socksUserPassVersion, byte(len(tt.username))}
+			auth = append(auth, tt.username...)
+			auth = append(auth, byte(len(tt.password)))
+			auth = append(auth, tt.password...)
+			conn.Write(auth)
+			status := make([]byte, 2)
+			if _, err := io.ReadFull(conn, status); err != nil {
+				t.Fatalf("reading authentication status: %v", err)
+			}
+			if ok := status[1] == socksUserPassOK; ok != tt.wantOK {
+				t.Fatalf("authentication status = %d, want ok %v", status[1], tt.wantOK)
+			}
+			if !tt.wantOK {
+				return
+			}
+
+			// Requests through the tunnel need no credentials of their own
+			conn.Write([]byte{socksVersion, socksConnect, 0, socksAddrDomain, 11, 'e', 'x', 'a', 'm', 'p', 'l', 'e', '.', 'c', 'o', 'm', 0, 80})
+			reply := make([]byte, 10)
+			if _, err := io.ReadFull(conn, reply); err != nil || reply[1] != socksSucceeded {
+				t.Fatalf("reply = %v, %v", reply, err)
+			}
+			req, _ := http.NewRequest("GET", "/", nil)
+			req.Host = "example.com"
+			req.Write(conn)
+			resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+			if err != nil {
+				t.Fatalf("reading response: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("status = %d, want 200", resp.StatusCode)
+			}
+		})
+	}
+
+	t.Run("no authentication offered", func(t *testing.T) {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.Write([]byte{socksVersion, 1, socksNoAuth})
+		method := make([]byte, 2)
+		if _, err := io.ReadFull(conn, method); err != nil || method[1] != socksNoAcceptable {
+			t.Errorf("method selection = %v, %v, want no acceptable method", method, err)
+		}
+	})
+}
@@ -0,0 +1,229 @@
+package flareproxy
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// TargetAuthError is returned for fetches of a target whose AUTH_RULES
+// domain rule the client does not satisfy.
+type TargetAuthError struct {
+	Host string
+	// Missing is what the client did not present.
+	Missing string
+}
+
+func (e *TargetAuthError) Error() string {
+	return fmt.Sprintf("target %s requires %s", e.Host, e.Missing)
+}
+
+// authRequirement is what a client must present to use a route or reach a
+// domain. The zero value leaves it open.
+type authRequirement struct {
+	keys *apiKeySet // nil: no key required
+	mtls bool       // a client certificate verified against TLS_CLIENT_CA
+}
+
+// authRules override the API_KEYS default for some routes and domains,
+// so that e.g. sensitive sites need specific keys or a client certificate
+// while the rest stays open on a trusted network.
+type authRules struct {
+	paths    map[string]authRequirement // by path prefix of the direct listener
+	domains  map[string]authRequirement // by target domain, with subdomains
+	fallback *authRequirement           // "*", for requests no rule matches
+}
+
+// newAuthRulesFromEnv reads AUTH_RULES, a comma separated list of
+// selector=requirement rules like
+// "/metrics=open,/api/v1/jobs=key,bank.example=mtls+key:ops|ci,*=open".
+// A selector is a path prefix of the direct listener, a target domain or
+// "*". A requirement is "open" or any of "key" (any of API_KEYS), "key:"
+// followed by specific keys separated by "|", and "mtls", joined by "+".
+// It returns nil, leaving API_KEYS alone in charge, if no rule is set.
+func newAuthRulesFromEnv(apiKeys *apiKeySet) *authRules {
+	rules := &authRules{
+		paths:   make(map[string]authRequirement),
+		domains: make(map[string]authRequirement),
+	}
+	for _, rule := range splitList(os.Getenv("AUTH_RULES")) {
+		selector, spec, ok := strings.Cut(rule, "=")
+		req, err := parseAuthRequirement(spec, apiKeys)
+		if !ok || err != nil {
+			slog.Warn("ignoring invalid AUTH_RULES rule", "rule", rule, "error", err)
+			continue
+		}
+		switch selector = strings.TrimSpace(selector); {
+		case selector == "*":
+			rules.fallback = &req
+		case strings.HasPrefix(selector, "/"):
+			rules.paths[strings.TrimSuffix(selector, "/")] = req
+		default:
+			rules.domains[strings.ToLower(selector)] = req
+		}
+	}
+	if len(rules.paths) == 0 && len(rules.domains) == 0 && rules.fallback == nil {
+		return nil
+	}
+	if os.Getenv("TLS_CLIENT_CA") == "" && rules.needsClientCertificates() {
+		slog.Warn("AUTH_RULES require client certificates, but TLS_CLIENT_CA is not set; those routes are unreachable")
+	}
+	return rules
+}
+
+func parseAuthRequirement(spec string, apiKeys *apiKeySet) (authRequirement, error) {
+	var req authRequirement
+	spec = strings.TrimSpace(spec)
+	if spec == "open" {
+		return req, nil
+	}
+	for _, part := range strings.Split(spec, "+") {
+		name, keys, hasKeys := strings.Cut(strings.TrimSpace(part), ":")
+		switch {
+		case name == "mtls" && !hasKeys:
+			req.mtls = true
+		case name == "key" && !hasKeys:
+			if apiKeys == nil {
+				return req, fmt.Errorf("%q needs API_KEYS", part)
+			}
+			req.keys = apiKeys
+		case name == "key":
+			set := &apiKeySet{}
+			for _, key := range strings.Split(keys, "|") {
+				if key = strings.TrimSpace(key); key != "" {
+					set.keys = append(set.keys, key)
+				}
+			}
+			if len(set.keys) == 0 {
+				return req, fmt.Errorf("%q names no keys", part)
+			}
+			req.keys = set
+		default:
+			return req, fmt.Errorf("unknown requirement %q", part)
+		}
+	}
+	return req, nil
+}
+
+func (a *authRules) needsClientCertificates() bool {
+	if a.fallback != nil && a.fallback.mtls {
+		return true
+	}
+	for _, rules := range []map[string]authRequirement{a.paths, a.domains} {
+		for _, req := range rules {
+			if req.mtls {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// requirements returns what a request must satisfy: the most specific
+// path rule and the most specific rule for its target domain, both if
+// both match, so that an open route does not open a protected domain.
+// If none matches, it is the "*" rule. It returns false if no rule
+// applies, leaving the default to the caller.
+func (a *authRules) requirements(r *http.Request, proxy bool) ([]authRequirement, bool) {
+	if a == nil {
+		return nil, false
+	}
+	var reqs []authRequirement
+	if !proxy {
+		if req, ok := a.forPath(r.URL.Path); ok {
+			reqs = append(reqs, req)
+		}
+	}
+	if req, ok := a.forHost(authTargetHost(r, proxy)); ok {
+		reqs = append(reqs, req)
+	}
+	if len(reqs) == 0 && a.fallback != nil {
+		reqs = append(reqs, *a.fallback)
+	}
+	return reqs, len(reqs) > 0
+}
+
+// forPath returns the rule of the longest path prefix matching path at a
+// segment boundary.
+func (a *authRules) forPath(path string) (authRequirement, bool) {
+	best, found := "", false
+	for prefix := range a.paths {
+		if (path == prefix || strings.HasPrefix(path, prefix+"/")) && (!found || len(prefix) > len(best)) {
+			best, found = prefix, true
+		}
+	}
+	return a.paths[best], found
+}
+
+// forHost returns the rule of host or, failing that, of its closest
+// parent domain.
+func (a *authRules) forHost(host string) (authRequirement, bool) {
+	for domain := host; domain != ""; {
+		if req, ok := a.domains[domain]; ok {
+			return req, true
+		}
+		_, domain, _ = strings.Cut(domain, ".")
+	}
+	return authRequirement{}, false
+}
+
+// checkTarget returns a *TargetAuthError if the client a fetch is made
+// for does not satisfy the domain rule of its target. authorize checks
+// the targets it can see in the request; batches, jobs and schedules name
+// theirs in the body, so the pipeline checks every fetch again. Fetches
+// the proxy makes on its own, such as prefetches, are not checked.
+func (a *authRules) checkTarget(ctx context.Context, req FetchRequest) error {
+	info := requestInfoFrom(ctx)
+	if a == nil || !info.Remote {
+		return nil
+	}
+	host := requestHost(req.URL)
+	rule, ok := a.forHost(host)
+	if !ok {
+		return nil
+	}
+	if rule.mtls && !info.ClientCert {
+		return &TargetAuthError{Host: host, Missing: "a valid client certificate"}
+	}
+	key := req.APIKey
+	if key == "" {
+		key = info.APIKey
+	}
+	if rule.keys != nil && !rule.keys.valid(key) {
+		return &TargetAuthError{Host: host, Missing: "a valid API key"}
+	}
+	return nil
+}
+
+// authTargetHost returns the host a request is about to fetch, or "" for
+// requests to the direct listener's own endpoints. Batches, jobs and
+// schedules name their targets in the body, which checkTarget covers.
+func authTargetHost(r *http.Request, proxy bool) string {
+	if proxy {
+		return strings.ToLower(r.URL.Hostname())
+	}
+	var targetURL string
+	switch path := r.URL.Path; {
+	case path == FetchPath, path == ExplainPath:
+		targetURL = r.URL.Query().Get("url")
+	case path == MetricsPath, strings.HasPrefix(path, "/api/"):
+		return ""
+	default:
+		targetURL, _ = directTarget(path, "")
+	}
+	u, err := url.Parse(targetURL)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+// clientCertificateVerified reports whether r came with a client
+// certificate signed by one of TLS_CLIENT_CA.
+func clientCertificateVerified(r *http.Request) bool {
+	return r.TLS != nil && len(r.TLS.VerifiedChains) > 0
+}
@@ -0,0 +1,110 @@
+package flareproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAuthRules(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(testResponse("<html>solved</html>"))
+	}))
+	defer mockServer.Close()
+	t.Setenv("FLARESOLVERR_URL", mockServer.URL)
+	t.Setenv("API_KEYS", "key-a,ops")
+	t.Setenv("AUTH_RULES", "/metrics=open, /api/v1/jobs=key:ops, bank.example=mtls+key:ops, open.example=open, internal.example=key:ops|ci, bogus=magic")
+	s := newSolver()
+	direct := newDirectHandler(s)
+	proxy := newProxyHandler(s)
+	verified := &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{}}}
+
+	tests := []struct {
+		name       string
+		handler    http.Handler
+		url        string
+		key        string
+		tls        *tls.ConnectionState
+		wantStatus int
+	}{
+		{name: "default needs a key", handler: direct, url: "/example.com/", wantStatus: http.StatusUnauthorized},
+		{name: "default accepts any key", handler: direct, url: "/example.com/", key: "key-a", wantStatus: http.StatusOK},
+		{name: "open route", handler: direct, url: MetricsPath, wantStatus: http.StatusOK},
+		{name: "route with specific key", handler: direct, url: JobsPath + "/123", key: "key-a", wantStatus: http.StatusUnauthorized},
+		{name: "route prefix ends at segments", handler: direct, url: JobsPath + "x", key: "key-a", wantStatus: http.StatusOK},
+		{name: "open domain", handler: direct, url: "/open.example/", wantStatus: http.StatusOK},
+		{name: "open domain in proxy mode", handler: proxy, url: "http://www.open.example/", wantStatus: http.StatusOK},
+		{name: "domain with specific keys", handler: direct, url: "/internal.example/", key: "key-a", wantStatus: http.StatusUnauthorized},
+		{name: "domain with one of its keys", handler: direct, url: "/https/api.internal.example/", key: "ci", wantStatus: http.StatusOK},
+		{name: "domain through fetch endpoint", handler: direct, url: FetchPath + "?url=https://internal.example/", key: "key-a", wantStatus: http.StatusUnauthorized},
+		{name: "domain without client certificate", handler: direct, url: "/bank.example/", key: "ops", wantStatus: http.StatusForbidden},
+		{name: "domain with client certificate and no key", handler: direct, url: "/bank.example/", tls: verified, wantStatus: http.StatusUnauthorized},
+		{name: "domain with client certificate and key", handler: direct, url: "/bank.example/", key: "ops", tls: verified, wantStatus: http.StatusOK},
+		{name: "proxy domain with client certificate", handler: proxy, url: "http://bank.example/", key: "ops", tls: verified, wantStatus: http.StatusOK},
+		{name: "proxy domain without key", handler: proxy, url: "http://internal.example/", wantStatus: http.StatusProxyAuthRequired},
+		{name: "invalid rules are ignored", handler: direct, url: "/bogus/", wantStatus: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.url, nil)
+			if tt.key != "" {
+				req.Header.Set(APIKeyHeader, tt.key)
+			}
+			req.TLS = tt.tls
+			rr := httptest.NewRecorder()
+			tt.handler.ServeHTTP(rr, req)
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rr.Code, tt.wantStatus, rr.Body.String())
+			}
+		})
+	}
+
+	t.Run("open routes identify clients", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/open.example/", nil)
+		req.Header.Set(APIKeyHeader, "key-a")
+		info := &requestInfo{}
+		req = req.WithContext(context.WithValue(req.Context(), requestInfoKey, info))
+		if _, ok := s.authorize(httptest.NewRecorder(), req, false); !ok || info.APIKey != "key-a" {
+			t.Errorf("APIKey = %q, want key-a", info.APIKey)
+		}
+	})
+
+	t.Run("targets named in bodies", func(t *testing.T) {
+		body := `{"urls":["https://internal.example/","https://bank.example/","https://open.example/"]}`
+		req := httptest.NewRequest("POST", BatchPath, strings.NewReader(body))
+		req.Header.Set(APIKeyHeader, "key-a")
+		rr := httptest.NewRecorder()
+		direct.ServeHTTP(rr, req)
+		var results []BatchResult
+		if err := json.Unmarshal(rr.Body.Bytes(), &results); err != nil || len(results) != 3 {
+			t.Fatalf("batch = %s, %v", rr.Body.String(), err)
+		}
+		for i, want := range []string{"target internal.example requires a valid API key", "target bank.example requires a valid client certificate", ""} {
+			if results[i].Error != want {
+				t.Errorf("%s: error = %q, want %q", results[i].URL, results[i].Error, want)
+			}
+		}
+		// Fetches the proxy makes on its own are not checked
+		if _, err := s.process(backgroundContext(context.Background(), "prefetch"), FetchRequest{URL: "https://bank.example/"}); err != nil {
+			t.Errorf("prefetch: %v", err)
+		}
+	})
+
+	t.Run("fallback", func(t *testing.T) {
+		t.Setenv("API_KEYS", "")
+		t.Setenv("AUTH_RULES", "*=key:secret,public.example=open")
+		s := newSolver()
+		for url, want := range map[string]int{"/example.com/": http.StatusUnauthorized, "/public.example/": http.StatusOK} {
+			rr := httptest.NewRecorder()
+			newDirectHandler(s).ServeHTTP(rr, httptest.NewRequest("GET", url, nil))
+			if rr.Code != want {
+				t.Errorf("%s: status = %d, want %d", url, rr.Code, want)
+			}
+		}
+	})
+}
@@ -0,0 +1,562 @@
+package flareproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Load balancing strategies accepted by FLARESOLVERR_STRATEGY.
+const (
+	StrategyRoundRobin    = "round-robin"
+	StrategyLeastInFlight = "least-in-flight"
+)
+
+// Circuit breaker states of a backend.
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half-open"
+)
+
+// CircuitOpenError is returned when every backend's circuit is open, so
+// that clients fail fast instead of waiting for FlareSolverr to time out.
+type CircuitOpenError struct {
+	RetryAfter time.Duration
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("FlareSolverr unavailable: circuit open, retry in %s", e.RetryAfter.Round(time.Second))
+}
+
+// errAllDraining is returned when every backend is draining for
+// maintenance.
+var errAllDraining = errors.New("FlareSolverr unavailable: all backends are draining")
+
+// QueueFullError is returned when a backend is busy and its wait queue is
+// full, or a request waited in the queue for longer than allowed.
+type QueueFullError struct {
+	Timeout    bool
+	RetryAfter time.Duration
+}
+
+func (e *QueueFullError) Error() string {
+	if e.Timeout {
+		return "FlareSolverr busy: timed out waiting in queue"
+	}
+	return "FlareSolverr busy: request queue is full"
+}
+
+// backend is a single FlareSolverr instance. FlareSolverr drives one
+// browser per request, so spreading load across instances is the main way
+// to scale.
+type backend struct {
+	url      string
+	inFlight atomic.Int64
+	waiting  atomic.Int64
+	draining atomic.Bool
+	// incompatible is set while the backend runs an unsupported
+	// FlareSolverr version and is out of rotation.
+	incompatible atomic.Bool
+
+	mu        sync.Mutex
+	slots     *fairSemaphore // nil when concurrency is unlimited
+	state     string
+	failures  int
+	openUntil time.Time
+	lastError string
+	version   string // last reported, if pinned
+	region    string // exit region, from BACKEND_REGIONS
+
+	// weight is the backend's share of new requests, 1 unless changed
+	// through the admin API.
+	weight atomic.Int32
+	// solveTime is a moving average of the backend's solves in
+	// nanoseconds, to estimate queueing delays.
+	solveTime atomic.Int64
+}
+
+// backendPool balances requests across backends and guards each one with
+// a circuit breaker. After several consecutive failures or timeouts a
+// backend's circuit opens and it receives no traffic for a cooldown
+// period. After the cooldown a single trial request is let through
+// (half-open); its outcome closes or re-opens the circuit.
+type backendPool struct {
+	mu          sync.Mutex
+	backends    []*backend
+	strategy    string
+	maxFailures int
+	cooldown    time.Duration
+	next        int
+	now         func() time.Time
+
+	maxQueue     int
+	queueTimeout time.Duration
+	weights      tenantWeights
+
+	// settings are those changed through the admin API, by backend URL,
+	// saved to settingsPath if not empty.
+	settings     map[string]backendSettings
+	settingsPath string
+}
+
+// newBackendPoolFromEnv creates the pool for the comma separated list of
+// URLs, configured through FLARESOLVERR_STRATEGY, BACKEND_MAX_FAILURES,
+// BACKEND_COOLDOWN, BACKEND_MAX_CONCURRENCY, QUEUE_MAX_SIZE, QUEUE_TIMEOUT,
+// TENANT_WEIGHTS and BACKEND_REGIONS. Settings saved to
+// BACKEND_SETTINGS_FILE through the admin API take precedence.
+func newBackendPoolFromEnv(urls string) *backendPool {
+	pool := newBackendPool(urls, os.Getenv("FLARESOLVERR_STRATEGY"),
+		envInt("BACKEND_MAX_FAILURES", 3), envDuration("BACKEND_COOLDOWN", 30*time.Second))
+	regions := backendRegionsFromEnv()
+	for _, b := range pool.backends {
+		b.region = regions[b.url]
+	}
+	pool.limit(envInt("BACKEND_MAX_CONCURRENCY", 0), envInt("QUEUE_MAX_SIZE", 100),
+		envDuration("QUEUE_TIMEOUT", 30*time.Second))
+	pool.weights = tenantWeightsFromEnv()
+	pool.settingsPath = os.Getenv("BACKEND_SETTINGS_FILE")
+	settings, err := loadBackendSettings(pool.settingsPath)
+	if err != nil {
+		slog.Warn("ignoring saved backend settings", "error", err)
+	}
+	pool.settings = settings
+	for _, b := range pool.backends {
+		pool.applySettings(b, settings[b.url])
+	}
+	return pool
+}
+
+// newBackendPool creates a pool from a comma separated list of URLs.
+func newBackendPool(urls, strategy string, maxFailures int, cooldown time.Duration) *backendPool {
+	pool := &backendPool{
+		strategy:    strategy,
+		maxFailures: maxFailures,
+		cooldown:    cooldown,
+		now:         time.Now,
+		settings:    make(map[string]backendSettings),
+	}
+	for _, u := range splitList(urls) {
+		b := &backend{url: u, state: CircuitClosed}
+		b.weight.Store(1)
+		pool.backends = append(pool.backends, b)
+	}
+	switch strategy {
+	case StrategyRoundRobin, StrategyLeastInFlight:
+	default:
+		if strategy != "" {
+			slog.Warn("unknown FLARESOLVERR_STRATEGY", "strategy", strategy, "using", StrategyRoundRobin)
+		}
+		pool.strategy = StrategyRoundRobin
+	}
+	return pool
+}
+
+// pick returns the backend for the next request, or a *CircuitOpenError
+// when every backend's circuit is open.
+func (p *backendPool) pick() (*backend, error) {
+	return p.pickIn("")
+}
+
+// pickIn returns the backend for the next request, preferring backends
+// in region. If none of them is available, any backend is picked.
+func (p *backendPool) pickIn(region string) (*backend, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	b, err := p.choose(region)
+	if err != nil {
+		return nil, err
+	}
+	p.next++
+	b.claim(p.now())
+	return b, nil
+}
+
+// peek returns the backend pickIn would return, without picking it.
+func (p *backendPool) peek(region string) (*backend, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.choose(region)
+}
+
+// choose returns the backend for the next request. The caller must hold
+// p.mu.
+func (p *backendPool) choose(region string) (*backend, error) {
+	now := p.now()
+	var candidates, inRegion []*backend
+	for _, b := range p.backends {
+		if b.available(now) {
+			candidates = append(candidates, b)
+			if region != "" && b.Region() == region {
+				inRegion = append(inRegion, b)
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, p.unavailableError(now)
+	}
+	if len(inRegion) > 0 {
+		candidates = inRegion
+	}
+
+	if p.strategy == StrategyLeastInFlight {
+		// Start at a rotating offset so ties are spread evenly
+		offset := p.next % len(candidates)
+		chosen := candidates[offset]
+		for i := 1; i < len(candidates); i++ {
+			b := candidates[(offset+i)%len(candidates)]
+			if b.load()*int64(chosen.weight.Load()) < chosen.load()*int64(b.weight.Load()) {
+				chosen = b
+			}
+		}
+		return chosen, nil
+	}
+	// Each backend takes as many turns of the rotation as its weight
+	turns := 0
+	for _, b := range candidates {
+		turns += int(b.weight.Load())
+	}
+	if turns <= 0 {
+		return candidates[p.next%len(candidates)], nil
+	}
+	turn := p.next % turns
+	for _, b := range candidates {
+		if turn -= int(b.weight.Load()); turn < 0 {
+			return b, nil
+		}
+	}
+	return candidates[len(candidates)-1], nil
+}
+
+// limit caps the number of concurrent requests per backend. Further
+// requests wait in a queue of at most maxQueue requests for up to
+// queueTimeout. A maxConcurrency of zero or less means no limit.
+func (p *backendPool) limit(maxConcurrency, maxQueue int, queueTimeout time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.maxQueue = maxQueue
+	p.queueTimeout = queueTimeout
+	for _, b := range p.backends {
+		b.mu.Lock()
+		b.slots = nil
+		if maxConcurrency > 0 {
+			b.slots = newFairSemaphore(maxConcurrency)
+		}
+		b.mu.Unlock()
+	}
+}
+
+// replace adopts the backends and settings of fresh, e.g. after the
+// configuration was reloaded. Backends in both pools keep their circuit
+// state, maintenance mode and in-flight requests; requests already running
+// on removed backends are left to finish. Settings changed through the
+// admin API still take precedence.
+func (p *backendPool) replace(fresh *backendPool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	existing := make(map[string]*backend, len(p.backends))
+	for _, b := range p.backends {
+		existing[b.url] = b
+	}
+	backends := make([]*backend, len(fresh.backends))
+	for i, b := range fresh.backends {
+		if old, ok := existing[b.url]; ok {
+			// Requests holding a slot release it to the semaphore they took it from
+			old.mu.Lock()
+			old.slots = b.slots
+			old.region = b.region
+			old.mu.Unlock()
+			b = old
+		}
+		p.applySettings(b, p.settings[b.url])
+		backends[i] = b
+	}
+	p.backends = backends
+	p.strategy = fresh.strategy
+	p.maxFailures = fresh.maxFailures
+	p.cooldown = fresh.cooldown
+	p.maxQueue = fresh.maxQueue
+	p.queueTimeout = fresh.queueTimeout
+	p.weights = fresh.weights
+}
+
+// all returns the current backends.
+func (p *backendPool) all() []*backend {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.backends
+}
+
+// acquireSlot waits for b to have capacity for another request. While b
+// is saturated, waiting requests are served fairly across API keys. The
+// returned function must be called once the request has finished.
+func (p *backendPool) acquireSlot(ctx context.Context, b *backend) (release func(), err error) {
+	b.mu.Lock()
+	slots := b.slots
+	b.mu.Unlock()
+	if slots == nil {
+		return func() {}, nil
+	}
+	if slots.tryAcquire() {
+		return slots.release, nil
+	}
+
+	p.mu.Lock()
+	maxQueue, queueTimeout, weights := p.maxQueue, p.queueTimeout, p.weights
+	p.mu.Unlock()
+	retryAfter := queueTimeout
+	if retryAfter < time.Second {
+		retryAfter = time.Second
+	}
+	if b.waiting.Add(1) > int64(maxQueue) {
+		b.waiting.Add(-1)
+		p.abandon(b)
+		return nil, &QueueFullError{RetryAfter: retryAfter}
+	}
+	defer b.waiting.Add(-1)
+
+	tenant := requestInfoFrom(ctx).APIKey
+	queueTicketFrom(ctx).estimateWith(b.SolveTime())
+	if err := slots.acquire(ctx, tenant, weights.of(tenant), queueTimeout); err != nil {
+		p.abandon(b)
+		if errors.Is(err, errQueueTimeout) {
+			return nil, &QueueFullError{Timeout: true, RetryAfter: retryAfter}
+		}
+		return nil, err
+	}
+	return slots.release, nil
+}
+
+// abandon is called when a request picked for b is never sent. If it was
+// to be the trial request of a half-open circuit, the circuit returns to
+// open so that the next request can be the trial instead.
+func (p *backendPool) abandon(b *backend) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == CircuitHalfOpen {
+		b.state = CircuitOpen
+	}
+}
+
+// load returns the number of requests running on or waiting for b.
+func (b *backend) load() int64 {
+	return b.inFlight.Load() + b.waiting.Load()
+}
+
+// acquire checks that b may receive a request, e.g. one bound to a
+// session held by b.
+func (p *backendPool) acquire(b *backend) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := p.now()
+	if !b.available(now) {
+		return p.unavailableError(now)
+	}
+	b.claim(now)
+	return nil
+}
+
+// unavailableError returns the error for when no backend can take a
+// request.
+func (p *backendPool) unavailableError(now time.Time) error {
+	draining := true
+	for _, b := range p.backends {
+		if !b.Draining() {
+			draining = false
+			if !b.incompatible.Load() {
+				return p.openError(now)
+			}
+		}
+	}
+	if draining {
+		return errAllDraining
+	}
+	return errIncompatibleBackends
+}
+
+// openError returns the error for when no backend is available, with the
+// time until the first circuit is due to be tried again.
+func (p *backendPool) openError(now time.Time) *CircuitOpenError {
+	retryAfter := p.cooldown
+	for _, b := range p.backends {
+		b.mu.Lock()
+		if wait := b.openUntil.Sub(now); wait > 0 && wait < retryAfter {
+			retryAfter = wait
+		}
+		b.mu.Unlock()
+	}
+	if retryAfter < time.Second {
+		retryAfter = time.Second
+	}
+	return &CircuitOpenError{RetryAfter: retryAfter}
+}
+
+// available reports whether b can take a request: it is not draining,
+// runs a supported version and its circuit is closed, or it is open but
+// the cooldown passed and no trial request is running.
+func (b *backend) available(now time.Time) bool {
+	if b.Draining() || b.incompatible.Load() {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case CircuitOpen:
+		return !now.Before(b.openUntil)
+	case CircuitHalfOpen:
+		return false
+	default:
+		return true
+	}
+}
+
+// claim moves an open circuit whose cooldown passed to half-open, making
+// the request about to be sent its trial request.
+func (b *backend) claim(now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == CircuitOpen && !now.Before(b.openUntil) {
+		b.state = CircuitHalfOpen
+	}
+}
+
+// get returns the backend with the given URL, or nil.
+func (p *backendPool) get(url string) *backend {
+	for _, b := range p.all() {
+		if b.url == url {
+			return b
+		}
+	}
+	return nil
+}
+
+// record updates the backend's circuit after a request finished. Errors
+// reported by FlareSolverr itself (e.g. an unsolvable challenge) say
+// nothing about the backend's health and are not counted, except for
+// timeouts which tie up clients just the same. Neither are requests
+// canceled by their client, which are treated as never sent.
+func (p *backendPool) record(b *backend, err error) {
+	if errors.Is(err, context.Canceled) {
+		p.abandon(b)
+		return
+	}
+	p.mu.Lock()
+	maxFailures, cooldown := p.maxFailures, p.cooldown
+	p.mu.Unlock()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !isBackendFailure(err) {
+		if b.state != CircuitClosed {
+			slog.Info("backend circuit closed", "backend", b.url)
+		}
+		b.state = CircuitClosed
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	b.lastError = err.Error()
+	if b.state == CircuitHalfOpen || (maxFailures > 0 && b.failures >= maxFailures && b.state == CircuitClosed) {
+		b.state = CircuitOpen
+		b.openUntil = p.now().Add(cooldown)
+		slog.Warn("backend circuit opened", "backend", b.url, "failures", b.failures,
+			"cooldown", cooldown.String(), "error", b.lastError)
+	}
+}
+
+func isBackendFailure(err error) bool {
+	if err == nil || errors.Is(err, errBodyTooLarge) {
+		return false
+	}
+	var solverErr *SolverError
+	if errors.As(err, &solverErr) {
+		return strings.Contains(strings.ToLower(solverErr.Message), "timeout")
+	}
+	return true
+}
+
+// Draining reports whether b is in maintenance mode: it finishes the
+// requests it is working on but receives no new ones.
+func (b *backend) Draining() bool {
+	return b.draining.Load()
+}
+
+// setDraining puts the backend with the given URL into or out of
+// maintenance mode. It returns false if there is no such backend.
+func (p *backendPool) setDraining(url string, draining bool) (bool, error) {
+	enabled := !draining
+	return p.configure(url, backendSettings{Enabled: &enabled})
+}
+
+// Weight returns the backend's share of new requests.
+func (b *backend) Weight() int {
+	return int(b.weight.Load())
+}
+
+// observeSolve folds the duration of a solve into the backend's average
+// solve time, weighting recent solves most.
+func (b *backend) observeSolve(d time.Duration) {
+	for {
+		old := b.solveTime.Load()
+		average := int64(d)
+		if old > 0 {
+			average = old + (int64(d)-old)/5
+		}
+		if b.solveTime.CompareAndSwap(old, average) {
+			return
+		}
+	}
+}
+
+// SolveTime returns the backend's average solve time, or zero before its
+// first solve.
+func (b *backend) SolveTime() time.Duration {
+	return time.Duration(b.solveTime.Load())
+}
+
+// MaxConcurrency returns the backend's cap on concurrent requests, or
+// zero if there is none.
+func (b *backend) MaxConcurrency() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.slots == nil {
+		return 0
+	}
+	return b.slots.capacity
+}
+
+// State returns the backend's circuit state.
+func (b *backend) State() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// Region returns the backend's exit region, or "" if it has none.
+func (b *backend) Region() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.region
+}
+
+// URLs returns the URLs of all backends.
+func (p *backendPool) URLs() []string {
+	backends := p.all()
+	urls := make([]string, len(backends))
+	for i, b := range backends {
+		urls[i] = b.url
+	}
+	return urls
+}
+
+// String returns the backends as a comma separated list.
+func (p *backendPool) String() string {
+	return strings.Join(p.URLs(), ",")
+}
@@ -0,0 +1,264 @@
+package flareproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func mustPick(t *testing.T, pool *backendPool) *backend {
+	t.Helper()
+	b, err := pool.pick()
+	if err != nil {
+		t.Fatalf("pick() error = %v", err)
+	}
+	return b
+}
+
+func TestBackendPoolRoundRobin(t *testing.T) {
+	pool := newBackendPool("http://a/v1, http://b/v1,http://c/v1", StrategyRoundRobin, 3, time.Minute)
+	counts := make(map[string]int)
+	for i := 0; i < 9; i++ {
+		counts[mustPick(t, pool).url]++
+	}
+	for _, u := range pool.URLs() {
+		if counts[u] != 3 {
+			t.Errorf("backend %s picked %d times, want 3", u, counts[u])
+		}
+	}
+}
+
+func TestBackendPoolLeastInFlight(t *testing.T) {
+	pool := newBackendPool("http://a/v1,http://b/v1", StrategyLeastInFlight, 3, time.Minute)
+	pool.backends[0].inFlight.Store(2)
+	for i := 0; i < 4; i++ {
+		if got := mustPick(t, pool); got.url != "http://b/v1" {
+			t.Fatalf("pick() = %s, want the idle backend", got.url)
+		}
+	}
+	pool.backends[1].inFlight.Store(5)
+	if got := mustPick(t, pool); got.url != "http://a/v1" {
+		t.Errorf("pick() = %s, want the less busy backend", got.url)
+	}
+}
+
+func TestBackendPoolCircuitBreaker(t *testing.T) {
+	now := time.Now()
+	pool := newBackendPool("http://a/v1,http://b/v1", StrategyRoundRobin, 2, time.Minute)
+	pool.now = func() time.Time { return now }
+	a, b := pool.backends[0], pool.backends[1]
+
+	// Errors reported by FlareSolverr itself do not count, unless they are timeouts
+	for i := 0; i < 5; i++ {
+		pool.record(a, &SolverError{Message: "Challenge not solved"})
+	}
+	if a.State() != CircuitClosed {
+		t.Fatal("solver errors should not open the circuit")
+	}
+
+	pool.record(a, errors.New("connection refused"))
+	pool.record(a, errors.New("connection refused"))
+	if a.State() != CircuitOpen {
+		t.Fatalf("state = %s after repeated failures, want open", a.State())
+	}
+	for i := 0; i < 4; i++ {
+		if got := mustPick(t, pool); got != b {
+			t.Fatalf("pick() = %s, want the backend with a closed circuit", got.url)
+		}
+	}
+
+	// With every circuit open, requests fail fast
+	now = now.Add(20 * time.Second)
+	pool.record(b, &SolverError{Message: "Error solving the challenge. Timeout after 60.0 seconds."})
+	pool.record(b, &SolverError{Message: "Error solving the challenge. Timeout after 60.0 seconds."})
+	_, err := pool.pick()
+	var circuitErr *CircuitOpenError
+	if !errors.As(err, &circuitErr) {
+		t.Fatalf("pick() error = %v, want *CircuitOpenError", err)
+	}
+	if circuitErr.RetryAfter != 40*time.Second {
+		t.Errorf("RetryAfter = %s, want the time until the first circuit half-opens", circuitErr.RetryAfter)
+	}
+
+	// After the cooldown a single trial request is let through
+	now = now.Add(40 * time.Second)
+	if got := mustPick(t, pool); got != a {
+		t.Fatalf("pick() = %s, want the backend whose cooldown passed", got.url)
+	}
+	if a.State() != CircuitHalfOpen {
+		t.Fatalf("state = %s, want half-open", a.State())
+	}
+	if _, err := pool.pick(); err == nil {
+		t.Fatal("pick() should not allow a second trial request")
+	}
+
+	// A failed trial re-opens the circuit, a successful one closes it
+	pool.record(a, errors.New("connection refused"))
+	if a.State() != CircuitOpen {
+		t.Fatalf("state = %s after failed trial, want open", a.State())
+	}
+	now = now.Add(2 * time.Minute)
+	mustPick(t, pool)
+	mustPick(t, pool)
+	pool.record(a, nil)
+	pool.record(b, nil)
+	if a.State() != CircuitClosed || b.State() != CircuitClosed {
+		t.Errorf("states = %s/%s after successful trials, want closed", a.State(), b.State())
+	}
+}
+
+func TestCircuitOpenResponse(t *testing.T) {
+	var hits atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+	t.Setenv("FLARESOLVERR_URL", server.URL)
+	t.Setenv("BACKEND_MAX_FAILURES", "2")
+	t.Setenv("BACKEND_COOLDOWN", "45s")
+
+	handler := NewDirectHandler()
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/example.com/", nil))
+	}
+	calls := hits.Load()
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/example.com/", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want 503", rec.Code)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "45" {
+		t.Errorf("Retry-After = %q, want 45", got)
+	}
+	if hits.Load() != calls {
+		t.Error("request reached FlareSolverr while the circuit was open")
+	}
+}
+
+func TestSolverMultipleBackends(t *testing.T) {
+	var hits [2]atomic.Int32
+	var servers [2]*httptest.Server
+	for i := range servers {
+		i := i
+		servers[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hits[i].Add(1)
+			json.NewEncoder(w).Encode(testResponse("<html></html>"))
+		}))
+		defer servers[i].Close()
+	}
+	t.Setenv("FLARESOLVERR_URL", servers[0].URL+","+servers[1].URL)
+
+	s := newSolver()
+	seen := make(map[string]bool)
+	for i := 0; i < 4; i++ {
+		_, meta, err := s.fetch(context.Background(), "request.get", "https://example.com/")
+		if err != nil {
+			t.Fatalf("fetch() error = %v", err)
+		}
+		seen[meta.Backend] = true
+	}
+	if hits[0].Load() != 2 || hits[1].Load() != 2 {
+		t.Errorf("backend hits = %d/%d, want 2/2", hits[0].Load(), hits[1].Load())
+	}
+	if len(seen) != 2 {
+		t.Errorf("meta reported backends %v, want both", seen)
+	}
+}
+
+func TestBackendConcurrencyLimit(t *testing.T) {
+	pool := newBackendPool("http://a/v1", StrategyRoundRobin, 3, time.Minute)
+	pool.limit(1, 1, 50*time.Millisecond)
+	b := pool.backends[0]
+
+	release, err := pool.acquireSlot(context.Background(), b)
+	if err != nil {
+		t.Fatalf("acquireSlot() error = %v", err)
+	}
+
+	// The second request waits in the queue, the third finds it full
+	queued := make(chan error, 1)
+	go func() {
+		release, err := pool.acquireSlot(context.Background(), b)
+		if err == nil {
+			release()
+		}
+		queued <- err
+	}()
+	for b.waiting.Load() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	var queueErr *QueueFullError
+	if _, err := pool.acquireSlot(context.Background(), b); !errors.As(err, &queueErr) || queueErr.Timeout {
+		t.Fatalf("acquireSlot() with full queue error = %v, want queue full", err)
+	}
+
+	release()
+	if err := <-queued; err != nil {
+		t.Fatalf("queued request error = %v, want a slot", err)
+	}
+
+	// A request that waits longer than the queue timeout gives up
+	release, _ = pool.acquireSlot(context.Background(), b)
+	defer release()
+	if _, err := pool.acquireSlot(context.Background(), b); !errors.As(err, &queueErr) || !queueErr.Timeout {
+		t.Fatalf("acquireSlot() error = %v, want queue timeout", err)
+	}
+}
+
+func TestQueueFullResponse(t *testing.T) {
+	rec := httptest.NewRecorder()
+	sendFetchError(rec, httptest.NewRequest(http.MethodGet, "/example.com/", nil), &QueueFullError{RetryAfter: 30 * time.Second})
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("status = %d, want 429", rec.Code)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "30" {
+		t.Errorf("Retry-After = %q, want 30", got)
+	}
+}
+
+func TestBackendPoolRegions(t *testing.T) {
+	t.Setenv("BACKEND_REGIONS", "http://eu1/v1=EU,http://eu2/v1=eu,http://us/v1=us,broken")
+	pool := newBackendPoolFromEnv("http://eu1/v1,http://eu2/v1,http://us/v1,http://any/v1")
+	for i := 0; i < 4; i++ {
+		b, err := pool.pickIn("eu")
+		if err != nil || b.Region() != "eu" {
+			t.Fatalf("pickIn(eu) = %v, %v, want an eu backend", b, err)
+		}
+	}
+
+	// Without an available backend in the region, any backend is picked
+	pool.setDraining("http://us/v1", true)
+	if b, err := pool.pickIn("us"); err != nil || b.url == "http://us/v1" {
+		t.Errorf("pickIn(us) = %v, %v, want another backend", b, err)
+	}
+	if b, err := pool.pickIn("apac"); err != nil || b == nil {
+		t.Errorf("pickIn(apac) error = %v, want any backend", err)
+	}
+
+	// Reloading updates the regions of existing backends
+	t.Setenv("BACKEND_REGIONS", "http://eu1/v1=us")
+	pool.replace(newBackendPoolFromEnv("http://eu1/v1,http://us/v1"))
+	if got := pool.get("http://eu1/v1").Region(); got != "us" {
+		t.Errorf("region after reload = %q, want us", got)
+	}
+}
+
+func TestBackendSolveTime(t *testing.T) {
+	b := &backend{}
+	if b.SolveTime() != 0 {
+		t.Errorf("SolveTime() = %v before any solve", b.SolveTime())
+	}
+	b.observeSolve(10 * time.Second)
+	b.observeSolve(20 * time.Second)
+	if got := b.SolveTime(); got != 12*time.Second {
+		t.Errorf("SolveTime() = %v, want 12s", got)
+	}
+}
@@ -0,0 +1,136 @@
+package flareproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+// backendSettings are the settings of a backend changed through the admin
+// API, overriding the environment. Nil fields are left as configured.
+type backendSettings struct {
+	// Weight is the backend's share of new requests relative to the
+	// others, 1 by default.
+	Weight *int `json:"weight,omitempty"`
+	// MaxConcurrency caps the backend's concurrent requests, overriding
+	// BACKEND_MAX_CONCURRENCY; zero means no limit.
+	MaxConcurrency *int `json:"max_concurrency,omitempty"`
+	// Enabled false drains the backend, like POST /admin/backends/drain.
+	Enabled *bool `json:"enabled,omitempty"`
+}
+
+// merge returns s with the fields set in change replaced.
+func (s backendSettings) merge(change backendSettings) backendSettings {
+	if change.Weight != nil {
+		s.Weight = change.Weight
+	}
+	if change.MaxConcurrency != nil {
+		s.MaxConcurrency = change.MaxConcurrency
+	}
+	if change.Enabled != nil {
+		s.Enabled = change.Enabled
+	}
+	return s
+}
+
+// maxBackendWeight bounds backend weights, whose sum must fit the
+// rotation.
+const maxBackendWeight = 1000
+
+func (s backendSettings) validate() error {
+	if s.Weight != nil && *s.Weight < 1 {
+		return errors.New("weight must be at least 1; disable the backend instead")
+	}
+	if s.Weight != nil && *s.Weight > maxBackendWeight {
+		return fmt.Errorf("weight must be at most %d", maxBackendWeight)
+	}
+	if s.MaxConcurrency != nil && *s.MaxConcurrency < 0 {
+		return errors.New("max_concurrency must not be negative")
+	}
+	return nil
+}
+
+// configure changes the settings of the backend with the given URL and
+// saves them to BACKEND_SETTINGS_FILE, if set, so that they survive
+// reloads and restarts. It returns false if there is no such backend.
+func (p *backendPool) configure(url string, change backendSettings) (bool, error) {
+	if err := change.validate(); err != nil {
+		return true, err
+	}
+	b := p.get(url)
+	if b == nil {
+		return false, nil
+	}
+	p.mu.Lock()
+	settings := p.settings[url].merge(change)
+	p.settings[url] = settings
+	p.applySettings(b, settings)
+	data, err := json.Marshal(p.settings)
+	path := p.settingsPath
+	p.mu.Unlock()
+
+	changed, _ := json.Marshal(settings)
+	slog.Info("backend settings changed", "backend", url, "settings", string(changed))
+	if path == "" || err != nil {
+		return true, err
+	}
+	if err := writeFileAtomic(path, data); err != nil {
+		return true, fmt.Errorf("saving backend settings: %v", err)
+	}
+	return true, nil
+}
+
+// applySettings applies settings over the environment's configuration of
+// b. The caller must hold p.mu.
+func (p *backendPool) applySettings(b *backend, settings backendSettings) {
+	weight := 1
+	if settings.Weight != nil {
+		weight = *settings.Weight
+	}
+	b.weight.Store(int32(weight))
+	if settings.MaxConcurrency != nil && *settings.MaxConcurrency != b.MaxConcurrency() {
+		// Requests holding a slot release it to the semaphore they took it from
+		b.mu.Lock()
+		b.slots = nil
+		if *settings.MaxConcurrency > 0 {
+			b.slots = newFairSemaphore(*settings.MaxConcurrency)
+		}
+		b.mu.Unlock()
+	}
+	if settings.Enabled != nil {
+		draining := !*settings.Enabled
+		if b.draining.Swap(draining) != draining {
+			slog.Info("backend maintenance mode changed", "backend", b.url, "draining", draining)
+		}
+	}
+}
+
+// loadBackendSettings reads the settings saved by configure. A missing
+// file is not an error. Invalid settings, e.g. from a hand-edited file,
+// are left out and reported in the error.
+func loadBackendSettings(path string) (map[string]backendSettings, error) {
+	settings := make(map[string]backendSettings)
+	if path == "" {
+		return settings, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return settings, nil
+	}
+	if err != nil {
+		return settings, err
+	}
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return make(map[string]backendSettings), fmt.Errorf("%s: %v", path, err)
+	}
+	var invalid error
+	for url, backendSettings := range settings {
+		if err := backendSettings.validate(); err != nil {
+			delete(settings, url)
+			invalid = fmt.Errorf("%s: %s: %v", path, url, err)
+		}
+	}
+	return settings, invalid
+}
@@ -0,0 +1,105 @@
+package flareproxy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBackendWeights(t *testing.T) {
+	pool := newBackendPool("http://a/v1,http://b/v1", StrategyRoundRobin, 3, time.Minute)
+	three := 3
+	if _, err := pool.configure("http://a/v1", backendSettings{Weight: &three}); err != nil {
+		t.Fatalf("configure() error = %v", err)
+	}
+	counts := map[string]int{}
+	for i := 0; i < 8; i++ {
+		b, err := pool.pick()
+		if err != nil {
+			t.Fatalf("pick() error = %v", err)
+		}
+		counts[b.url]++
+	}
+	if counts["http://a/v1"] != 6 || counts["http://b/v1"] != 2 {
+		t.Errorf("picks = %v, want 3:1", counts)
+	}
+
+	// Least in flight compares load relative to weight
+	pool = newBackendPool("http://a/v1,http://b/v1", StrategyLeastInFlight, 3, time.Minute)
+	pool.configure("http://a/v1", backendSettings{Weight: &three})
+	a, b := pool.get("http://a/v1"), pool.get("http://b/v1")
+	a.inFlight.Store(2)
+	b.inFlight.Store(1)
+	if got, _ := pool.pick(); got != a {
+		t.Errorf("pick() = %s, want the heavier weighted backend", got.url)
+	}
+	a.inFlight.Store(4)
+	if got, _ := pool.pick(); got != b {
+		t.Errorf("pick() = %s, want the less loaded backend", got.url)
+	}
+
+	for _, weight := range []int{0, maxBackendWeight + 1, 1 << 32} {
+		if _, err := pool.configure("http://a/v1", backendSettings{Weight: &weight}); err == nil {
+			t.Errorf("configure() accepted a weight of %d", weight)
+		}
+	}
+
+	// A rotation without turns still picks a backend
+	pool = newBackendPool("http://a/v1,http://b/v1", StrategyRoundRobin, 3, time.Minute)
+	pool.get("http://a/v1").weight.Store(0)
+	pool.get("http://b/v1").weight.Store(0)
+	if _, err := pool.pick(); err != nil {
+		t.Errorf("pick() with zero weights error = %v", err)
+	}
+	if ok, _ := pool.configure("http://unknown/v1", backendSettings{Weight: &three}); ok {
+		t.Error("configure() of an unknown backend succeeded")
+	}
+}
+
+func TestBackendSettingsPersisted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "backends.json")
+	t.Setenv("BACKEND_SETTINGS_FILE", path)
+	t.Setenv("BACKEND_MAX_CONCURRENCY", "2")
+	pool := newBackendPoolFromEnv("http://a/v1,http://b/v1")
+	if got := pool.get("http://a/v1").MaxConcurrency(); got != 2 {
+		t.Fatalf("MaxConcurrency() = %d, want 2 from the environment", got)
+	}
+
+	weight, limit, enabled := 2, 5, false
+	pool.configure("http://a/v1", backendSettings{Weight: &weight, MaxConcurrency: &limit})
+	pool.configure("http://b/v1", backendSettings{Enabled: &enabled})
+	check := func(pool *backendPool, when string) {
+		t.Helper()
+		a, b := pool.get("http://a/v1"), pool.get("http://b/v1")
+		if a.Weight() != 2 || a.MaxConcurrency() != 5 || a.Draining() {
+			t.Errorf("%s: a has weight %d, concurrency %d, draining %v", when, a.Weight(), a.MaxConcurrency(), a.Draining())
+		}
+		if b.Weight() != 1 || b.MaxConcurrency() != 2 || !b.Draining() {
+			t.Errorf("%s: b has weight %d, concurrency %d, draining %v", when, b.Weight(), b.MaxConcurrency(), b.Draining())
+		}
+	}
+	check(pool, "after configure")
+
+	// Settings survive reloads and restarts
+	pool.replace(newBackendPoolFromEnv("http://a/v1,http://b/v1"))
+	check(pool, "after reload")
+	check(newBackendPoolFromEnv("http://a/v1,http://b/v1"), "after restart")
+
+	// Invalid saved settings are left out
+	if err := os.WriteFile(path, []byte(`{"http://a/v1":{"weight":4294967296},"http://b/v1":{"weight":3}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	pool = newBackendPoolFromEnv("http://a/v1,http://b/v1")
+	if a, b := pool.get("http://a/v1"), pool.get("http://b/v1"); a.Weight() != 1 || b.Weight() != 3 {
+		t.Errorf("weights from a hand-edited file = %d, %d; want 1, 3", a.Weight(), b.Weight())
+	}
+	pool.configure("http://b/v1", backendSettings{Enabled: &enabled})
+
+	// Resuming a disabled backend enables it again
+	restarted := newBackendPoolFromEnv("http://a/v1,http://b/v1")
+	restarted.setDraining("http://b/v1", false)
+	if newBackendPoolFromEnv("http://a/v1,http://b/v1").get("http://b/v1").Draining() {
+		t.Error("resumed backend still disabled after a restart")
+	}
+}
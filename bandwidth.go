@@ -0,0 +1,222 @@
+package flareproxy
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Headers describing a tenant's bandwidth quota, sent with every response
+// while bandwidth limits are configured. The reset time is in Unix
+// seconds.
+const (
+	BandwidthLimitHeader     = "X-Bandwidth-Limit"
+	BandwidthRemainingHeader = "X-Bandwidth-Remaining"
+	BandwidthResetHeader     = "X-Bandwidth-Reset"
+)
+
+// bandwidthUsage counts the bytes served to a tenant in its current
+// window.
+type bandwidthUsage struct {
+	start time.Time
+	bytes int64
+}
+
+// bandwidthLimiter caps the response bytes served to each tenant per
+// fixed window, since on shared instances body sizes rather than request
+// counts dominate the cost. A tenant is an API key, or the client address
+// when API keys are not used. Usage is counted as responses are written,
+// so a response may overshoot the cap; the tenant's following requests
+// are refused with 429 until its window resets.
+type bandwidthLimiter struct {
+	defaultLimit int64
+	tenants      map[string]int64
+	window       time.Duration
+	now          func() time.Time
+
+	mu    sync.Mutex
+	usage map[string]*bandwidthUsage
+	swept time.Time
+}
+
+// newBandwidthLimiterFromEnv reads BANDWIDTH_LIMIT, the bytes a tenant
+// may receive per BANDWIDTH_WINDOW, and BANDWIDTH_LIMITS, per tenant
+// overrides such as "key-a=1073741824,key-b=0", where 0 is unlimited. It
+// returns nil if no limit is set.
+func newBandwidthLimiterFromEnv() *bandwidthLimiter {
+	tenants := make(map[string]int64)
+	for _, rule := range splitList(os.Getenv("BANDWIDTH_LIMITS")) {
+		tenant, spec, ok := strings.Cut(rule, "=")
+		limit, err := strconv.ParseInt(strings.TrimSpace(spec), 10, 64)
+		if !ok || err != nil || limit < 0 {
+			slog.Warn("ignoring invalid BANDWIDTH_LIMITS rule", "rule", rule)
+			continue
+		}
+		tenants[strings.TrimSpace(tenant)] = limit
+	}
+	defaultLimit := int64(envInt("BANDWIDTH_LIMIT", 0))
+	if defaultLimit <= 0 && len(tenants) == 0 {
+		return nil
+	}
+	return newBandwidthLimiter(defaultLimit, tenants, envDuration("BANDWIDTH_WINDOW", 24*time.Hour))
+}
+
+func newBandwidthLimiter(defaultLimit int64, tenants map[string]int64, window time.Duration) *bandwidthLimiter {
+	return &bandwidthLimiter{
+		defaultLimit: defaultLimit,
+		tenants:      tenants,
+		window:       window,
+		now:          time.Now,
+		usage:        make(map[string]*bandwidthUsage),
+	}
+}
+
+// limitOf returns the cap of tenant, 0 meaning unlimited.
+func (l *bandwidthLimiter) limitOf(tenant string) int64 {
+	if limit, ok := l.tenants[tenant]; ok {
+		return limit
+	}
+	return l.defaultLimit
+}
+
+// current returns the usage of tenant in its current window, starting a
+// new window once the last one is over. The caller must hold l.mu.
+func (l *bandwidthLimiter) current(tenant string) *bandwidthUsage {
+	now := l.now()
+	u, ok := l.usage[tenant]
+	if ok && now.Sub(u.start) < l.window {
+		return u
+	}
+	if now.Sub(l.swept) >= l.window {
+		l.swept = now
+		for t, u := range l.usage {
+			if now.Sub(u.start) >= l.window {
+				delete(l.usage, t)
+			}
+		}
+	}
+	u = &bandwidthUsage{start: now}
+	l.usage[tenant] = u
+	return u
+}
+
+// status returns the bytes served to tenant in its current window, its
+// cap and when the window resets.
+func (l *bandwidthLimiter) status(tenant string) (used, limit int64, reset time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	u := l.current(tenant)
+	return u.bytes, l.limitOf(tenant), u.start.Add(l.window)
+}
+
+// add counts n bytes served to tenant.
+func (l *bandwidthLimiter) add(tenant string, n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.current(tenant).bytes += int64(n)
+}
+
+// tenantUsage is a tenant's bandwidth as listed by the admin API.
+type tenantUsage struct {
+	Tenant string    `json:"tenant"`
+	Bytes  int64     `json:"bytes"`
+	Limit  int64     `json:"limit"`
+	Reset  time.Time `json:"reset"`
+}
+
+// list returns the usage of the tenants served in their current window,
+// the heaviest first.
+func (l *bandwidthLimiter) list() []tenantUsage {
+	tenants := []tenantUsage{}
+	if l == nil {
+		return tenants
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	for tenant, u := range l.usage {
+		if now.Sub(u.start) >= l.window {
+			continue
+		}
+		tenants = append(tenants, tenantUsage{Tenant: tenant, Bytes: u.bytes, Limit: l.limitOf(tenant), Reset: u.start.Add(l.window)})
+	}
+	sort.Slice(tenants, func(i, j int) bool {
+		if tenants[i].Bytes != tenants[j].Bytes {
+			return tenants[i].Bytes > tenants[j].Bytes
+		}
+		return tenants[i].Tenant < tenants[j].Tenant
+	})
+	return tenants
+}
+
+// tenantOf returns the tenant a request is billed to: its API key, or the
+// client address without API keys.
+func tenantOf(r *http.Request) string {
+	if key := requestInfoFrom(r.Context()).APIKey; key != "" {
+		return key
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// meterBandwidth answers requests of tenants that used up their bandwidth
+// with 429 and returns false. Otherwise it returns a writer counting the
+// response bytes against the tenant's quota, and sets the quota headers.
+func (s *solver) meterBandwidth(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, bool) {
+	if s.bandwidth == nil {
+		return w, true
+	}
+	tenant := tenantOf(r)
+	used, limit, reset := s.bandwidth.status(tenant)
+	if limit <= 0 {
+		return w, true
+	}
+	w.Header().Set(BandwidthLimitHeader, strconv.FormatInt(limit, 10))
+	w.Header().Set(BandwidthRemainingHeader, strconv.FormatInt(max(0, limit-used), 10))
+	w.Header().Set(BandwidthResetHeader, strconv.FormatInt(reset.Unix(), 10))
+	if used >= limit {
+		w.Header().Set("Retry-After", retryAfterSeconds(max(time.Second, reset.Sub(s.bandwidth.now()))))
+		sendErrorStatus(w, r, http.StatusTooManyRequests,
+			fmt.Sprintf("bandwidth limit of %d bytes per %s exceeded", limit, s.bandwidth.window))
+		return w, false
+	}
+	return &bandwidthWriter{ResponseWriter: w, limiter: s.bandwidth, tenant: tenant}, true
+}
+
+// bandwidthWriter counts the bytes written to a tenant.
+type bandwidthWriter struct {
+	http.ResponseWriter
+	limiter *bandwidthLimiter
+	tenant  string
+}
+
+func (w *bandwidthWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.limiter.add(w.tenant, n)
+	return n, err
+}
+
+func (w *bandwidthWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap allows http.ResponseController to reach the underlying writer.
+func (w *bandwidthWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (a *adminHandler) listBandwidth(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.bandwidth.list())
+}
@@ -0,0 +1,114 @@
+package flareproxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBandwidthLimit(t *testing.T) {
+	page := "<html>" + strings.Repeat("x", 600) + "</html>"
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(testResponse(page))
+	}))
+	defer mockServer.Close()
+	t.Setenv("FLARESOLVERR_URL", mockServer.URL)
+	t.Setenv("API_KEYS", "small,big,free")
+	t.Setenv("BANDWIDTH_LIMIT", "1000")
+	t.Setenv("BANDWIDTH_LIMITS", "big=100000,free=0")
+	t.Setenv("BANDWIDTH_WINDOW", "1h")
+
+	handler := NewDirectHandler()
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	handler.bandwidth.now = func() time.Time { return now }
+	get := func(key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/example.com/", nil)
+		req.Header.Set(APIKeyHeader, key)
+		rr := httptest.NewRecorder()
+		withRequestLogging("direct", handler).ServeHTTP(rr, req)
+		return rr
+	}
+
+	// The second response overshoots the cap, the third is refused
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		rr := get("small")
+		if rr.Code != want {
+			t.Fatalf("request %d status = %d, want %d", i+1, rr.Code, want)
+		}
+		if got := rr.Header().Get(BandwidthLimitHeader); got != "1000" {
+			t.Errorf("request %d %s = %q, want 1000", i+1, BandwidthLimitHeader, got)
+		}
+		if got, want := rr.Header().Get(BandwidthResetHeader), strconv.FormatInt(now.Add(time.Hour).Unix(), 10); got != want {
+			t.Errorf("request %d %s = %q, want %q", i+1, BandwidthResetHeader, got, want)
+		}
+	}
+	rr := get("small")
+	if got := rr.Header().Get("Retry-After"); got != "3600" {
+		t.Errorf("Retry-After = %q, want 3600", got)
+	}
+	if got := rr.Header().Get(BandwidthRemainingHeader); got != "0" {
+		t.Errorf("%s = %q, want 0", BandwidthRemainingHeader, got)
+	}
+
+	// Other tenants have their own quota
+	for _, key := range []string{"big", "free"} {
+		if rr := get(key); rr.Code != http.StatusOK {
+			t.Errorf("%s status = %d, want 200", key, rr.Code)
+		}
+	}
+	if rr := get("free"); rr.Header().Get(BandwidthLimitHeader) != "" {
+		t.Errorf("unlimited tenant got %s = %q", BandwidthLimitHeader, rr.Header().Get(BandwidthLimitHeader))
+	}
+
+	// The quota resets with the window
+	now = now.Add(time.Hour)
+	if rr := get("small"); rr.Code != http.StatusOK {
+		t.Errorf("status after the window = %d, want 200", rr.Code)
+	}
+}
+
+func TestBandwidthTenants(t *testing.T) {
+	l := newBandwidthLimiter(100, map[string]int64{"big": 1000}, time.Minute)
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	l.now = func() time.Time { return now }
+	l.add("a", 10)
+	l.add("big", 500)
+	l.add("a", 20)
+
+	got := l.list()
+	if len(got) != 2 || got[0].Tenant != "big" || got[0].Bytes != 500 || got[0].Limit != 1000 ||
+		got[1].Tenant != "a" || got[1].Bytes != 30 || got[1].Limit != 100 {
+		t.Fatalf("list() = %+v", got)
+	}
+
+	now = now.Add(time.Minute)
+	if got := l.list(); len(got) != 0 {
+		t.Errorf("list() after the window = %+v, want none", got)
+	}
+	l.add("b", 1)
+	if len(l.usage) != 1 {
+		t.Errorf("%d usage entries after the window, want expired ones swept", len(l.usage))
+	}
+
+	var disabled *bandwidthLimiter
+	if got := disabled.list(); got == nil || len(got) != 0 {
+		t.Errorf("nil limiter list() = %v, want an empty list", got)
+	}
+}
+
+func TestTenantOf(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "192.0.2.7:4321"
+	if got := tenantOf(req); got != "192.0.2.7" {
+		t.Errorf("tenantOf() = %q, want the client address", got)
+	}
+	req = req.WithContext(context.WithValue(req.Context(), requestInfoKey, &requestInfo{APIKey: "key"}))
+	if got := tenantOf(req); got != "key" {
+		t.Errorf("tenantOf() = %q, want the API key", got)
+	}
+}
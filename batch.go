@@ -0,0 +1,140 @@
+package flareproxy
+
+import (
+	"context"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// BatchPath is the batch fetch endpoint on the direct server.
+const BatchPath = "/api/v1/batch"
+
+// NDJSONContentType is the media type of newline delimited JSON.
+const NDJSONContentType = "application/x-ndjson"
+
+// BatchResult is the outcome of one URL of a batch.
+type BatchResult struct {
+	Index  int        `json:"index"`
+	URL    string     `json:"url"`
+	Error  string     `json:"error,omitempty"`
+	Result *JobResult `json:"result,omitempty"`
+}
+
+// serveBatch fetches several URLs concurrently. By default the response
+// is a JSON array in request order, sent once every URL has completed.
+// Clients that accept application/x-ndjson instead receive one result per
+// line as soon as each URL completes, in completion order.
+func (d *DirectHandler) serveBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var body struct {
+		URLs     []string `json:"urls"`
+		Cmd      string   `json:"cmd"`
+		PostData string   `json:"post_data"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&body); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON body: " + err.Error()})
+		return
+	}
+	if body.Cmd == "" {
+		body.Cmd = "request.get"
+	}
+	if body.Cmd != "request.get" && body.Cmd != "request.post" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "cmd must be request.get or request.post"})
+		return
+	}
+	if (body.Cmd == "request.post") != (body.PostData != "") {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "post_data is required with request.post, and only allowed with it"})
+		return
+	}
+	maxURLs := envInt("BATCH_MAX_URLS", 100)
+	if len(body.URLs) == 0 || len(body.URLs) > maxURLs {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "urls must contain between 1 and " + strconv.Itoa(maxURLs) + " URLs"})
+		return
+	}
+	for _, raw := range body.URLs {
+		if !isAbsoluteHTTPURL(raw) {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "not an absolute http or https URL: " + raw})
+			return
+		}
+	}
+
+	results := d.runBatch(r.Context(), FetchRequest{Cmd: body.Cmd, PostData: body.PostData}, body.URLs, envInt("BATCH_CONCURRENCY", 4))
+
+	if !acceptsNDJSON(r) {
+		all := make([]BatchResult, len(body.URLs))
+		for result := range results {
+			all[result.Index] = result
+		}
+		writeJSON(w, http.StatusOK, all)
+		return
+	}
+
+	w.Header().Set("Content-Type", NDJSONContentType)
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	for result := range results {
+		enc.Encode(result)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+// runBatch fetches urls, each as req with its URL set, with at most
+// concurrency requests in flight and sends each result on the returned
+// channel as it completes. The channel is closed once all URLs are done.
+func (d *DirectHandler) runBatch(ctx context.Context, req FetchRequest, urls []string, concurrency int) <-chan BatchResult {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	results := make(chan BatchResult, len(urls))
+	sem := make(chan struct{}, concurrency)
+	parent := requestInfoFrom(ctx)
+
+	var wg sync.WaitGroup
+	for i, u := range urls {
+		wg.Add(1)
+		go func(i int, u string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			item := BatchResult{Index: i, URL: u}
+			// Each fetch records its own target and backend
+			itemReq := req
+			itemReq.URL, itemReq.APIKey = u, parent.APIKey
+			result, err := d.process(backgroundContext(ctx, parent.ID), itemReq)
+			if err != nil {
+				item.Error = err.Error()
+			} else {
+				item.Result = newJobResult(result)
+			}
+			results <- item
+		}(i, u)
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+	return results
+}
+
+// acceptsNDJSON reports whether the client asked for newline delimited
+// JSON in its Accept header.
+func acceptsNDJSON(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err == nil && mediaType == NDJSONContentType {
+			return true
+		}
+	}
+	return false
+}
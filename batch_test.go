@@ -0,0 +1,110 @@
+package flareproxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBatch(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req FlareSolverrRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Cmd == "request.post" && req.PostData != "q=1" {
+			w.Write([]byte(`{"status":"error","message":"missing post data"}`))
+			return
+		}
+		if strings.Contains(req.URL, "broken") {
+			w.Write([]byte(`{"status":"error","message":"Challenge not solved"}`))
+			return
+		}
+		json.NewEncoder(w).Encode(testResponse("<html>" + req.URL + "</html>"))
+	}))
+	defer mockServer.Close()
+	t.Setenv("FLARESOLVERR_URL", mockServer.URL)
+	handler := NewDirectHandler()
+	body := `{"urls":["https://a.test/","https://broken.test/","https://c.test/"]}`
+
+	t.Run("json array", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("POST", BatchPath, strings.NewReader(body)))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("status = %d, want 200: %s", rr.Code, rr.Body.String())
+		}
+		var results []BatchResult
+		if err := json.Unmarshal(rr.Body.Bytes(), &results); err != nil {
+			t.Fatalf("invalid JSON: %v", err)
+		}
+		if len(results) != 3 {
+			t.Fatalf("got %d results, want 3", len(results))
+		}
+		for i, result := range results {
+			if result.Index != i {
+				t.Errorf("results[%d].Index = %d, want request order", i, result.Index)
+			}
+		}
+		if results[0].Result == nil || results[0].Result.Body != "<html>https://a.test/</html>" {
+			t.Errorf("results[0] = %+v", results[0])
+		}
+		if results[1].Error == "" || results[1].Result != nil {
+			t.Errorf("results[1] = %+v, want an error", results[1])
+		}
+	})
+
+	t.Run("ndjson", func(t *testing.T) {
+		req := httptest.NewRequest("POST", BatchPath, strings.NewReader(body))
+		req.Header.Set("Accept", "application/x-ndjson")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if got := rr.Header().Get("Content-Type"); got != NDJSONContentType {
+			t.Errorf("Content-Type = %q, want %q", got, NDJSONContentType)
+		}
+		seen := make(map[int]bool)
+		scanner := bufio.NewScanner(rr.Body)
+		for scanner.Scan() {
+			var result BatchResult
+			if err := json.Unmarshal(scanner.Bytes(), &result); err != nil {
+				t.Fatalf("invalid line %q: %v", scanner.Text(), err)
+			}
+			seen[result.Index] = true
+		}
+		if len(seen) != 3 {
+			t.Errorf("got results for %v, want all three URLs", seen)
+		}
+	})
+
+	t.Run("post", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		post := `{"urls":["https://a.test/","https://c.test/"],"cmd":"request.post","post_data":"q=1"}`
+		handler.ServeHTTP(rr, httptest.NewRequest("POST", BatchPath, strings.NewReader(post)))
+		var results []BatchResult
+		if err := json.Unmarshal(rr.Body.Bytes(), &results); err != nil {
+			t.Fatalf("invalid JSON: %v", err)
+		}
+		if len(results) != 2 {
+			t.Fatalf("got %d results, want 2", len(results))
+		}
+		for _, result := range results {
+			if result.Error != "" {
+				t.Errorf("results[%d] = %+v, want the post data sent for every URL", result.Index, result)
+			}
+		}
+	})
+
+	for _, bad := range []string{
+		`{"urls":[]}`,
+		`{"urls":["a.test"]}`,
+		`{"urls":["https://a.test/"],"cmd":"sessions.create"}`,
+		`{"urls":["https://a.test/"],"cmd":"request.post"}`,
+		`{"urls":["https://a.test/"],"post_data":"q=1"}`,
+	} {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("POST", BatchPath, strings.NewReader(bad)))
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("batch %s: status = %d, want 400", bad, rr.Code)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package flareproxy
+
+import (
+	"io"
+
+	"github.com/kljensen/flareproxygo/flaresolverr"
+)
+
+// defaultMaxBodyBytes bounds the responses held in memory or streamed
+// unless MAX_BODY_BYTES says otherwise.
+const defaultMaxBodyBytes = 64 << 20
+
+// errBodyTooLarge fails fetches whose response exceeds MAX_BODY_BYTES;
+// clients receive 502.
+var errBodyTooLarge = flaresolverr.ErrResponseTooLarge
+
+// maxBodyBytesFromEnv reads MAX_BODY_BYTES, the size of the largest page
+// or download passed on. Zero disables the limit.
+func maxBodyBytesFromEnv() int64 {
+	return int64(envInt("MAX_BODY_BYTES", defaultMaxBodyBytes))
+}
+
+// readBody reads r into memory, failing with errBodyTooLarge once it
+// exceeds limit bytes. A limit of zero reads everything.
+func readBody(r io.Reader, limit int64) ([]byte, error) {
+	if limit <= 0 {
+		return io.ReadAll(r)
+	}
+	body, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err == nil && int64(len(body)) > limit {
+		err = errBodyTooLarge
+	}
+	return body, err
+}
+
+// copyBody streams r to w, failing with errBodyTooLarge once more than
+// limit bytes have been copied. A limit of zero copies everything.
+func copyBody(w io.Writer, r io.Reader, limit int64) error {
+	if limit <= 0 {
+		_, err := io.Copy(w, r)
+		return err
+	}
+	if _, err := io.CopyN(w, r, limit); err != nil {
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	}
+	if n, _ := io.ReadFull(r, make([]byte, 1)); n > 0 {
+		return errBodyTooLarge
+	}
+	return nil
+}
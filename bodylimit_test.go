@@ -0,0 +1,95 @@
+package flareproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBodyLimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		limit   int64
+		wantErr error
+	}{
+		{name: "under the limit", body: "12345", limit: 8},
+		{name: "at the limit", body: "12345678", limit: 8},
+		{name: "over the limit", body: "123456789", limit: 8, wantErr: errBodyTooLarge},
+		{name: "no limit", body: strings.Repeat("x", 1000), limit: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, err := readBody(strings.NewReader(tt.body), tt.limit)
+			if !errors.Is(err, tt.wantErr) || (err == nil && string(body) != tt.body) {
+				t.Errorf("readBody() = %q, %v, want %v", body, err, tt.wantErr)
+			}
+			var buf bytes.Buffer
+			err = copyBody(&buf, strings.NewReader(tt.body), tt.limit)
+			if !errors.Is(err, tt.wantErr) || (err == nil && buf.String() != tt.body) {
+				t.Errorf("copyBody() = %q, %v, want %v", buf.String(), err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMaxBodyBytes(t *testing.T) {
+	large := strings.Repeat("x", 100)
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/stream.png" {
+			// Chunked, without a Content-Length to check up front
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte(large[:20]))
+			w.(http.Flusher).Flush()
+			w.Write([]byte(large[20:]))
+			return
+		}
+		w.Write([]byte(large))
+	}))
+	defer origin.Close()
+	var solved int
+	flareSolverr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		solved++
+		json.NewEncoder(w).Encode(testResponse("<html>" + large + "</html>"))
+	}))
+	defer flareSolverr.Close()
+	t.Setenv("FLARESOLVERR_URL", flareSolverr.URL)
+	t.Setenv("MAX_BODY_BYTES", "64")
+	host := strings.TrimPrefix(origin.URL, "https://")
+
+	for _, mode := range []string{FetchModeSolver, FetchModeSmart} {
+		t.Setenv("FETCH_MODE", mode)
+		handler := NewDirectHandler()
+		handler.direct = origin.Client()
+		handler.downloads = origin.Client()
+		for _, path := range []string{"/page.html", "/big.png"} {
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, httptest.NewRequest("GET", "/"+host+path, nil))
+			if rr.Code != http.StatusBadGateway {
+				t.Errorf("%s %s: status = %d, want 502", mode, path, rr.Code)
+			}
+		}
+	}
+	if solved != 1 {
+		t.Errorf("FlareSolverr solved %d pages, want 1: pages too large to fetch directly are not solved", solved)
+	}
+
+	// Streams exceeding the limit are cut off
+	server := httptest.NewServer(NewDirectHandler())
+	defer server.Close()
+	handler := server.Config.Handler.(*DirectHandler)
+	handler.downloads = origin.Client()
+	resp, err := http.Get(server.URL + "/" + host + "/stream.png")
+	if err != nil {
+		return // aborted before the response was flushed
+	}
+	defer resp.Body.Close()
+	if body, err := io.ReadAll(resp.Body); err == nil {
+		t.Errorf("truncated stream of %d bytes read without error", len(body))
+	}
+}
@@ -0,0 +1,260 @@
+package flareproxy
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// budgetBuckets is the number of buckets the rolling window of a domain's
+// solves is divided into.
+const budgetBuckets = 10
+
+// DomainDisabledError is returned for domains that exceeded the failure
+// budget, until their cool-down is over.
+type DomainDisabledError struct {
+	Domain     string
+	Reason     string
+	RetryAfter time.Duration
+}
+
+func (e *DomainDisabledError) Error() string {
+	return fmt.Sprintf("domain %s is disabled (%s), retry in %s", e.Domain, e.Reason, e.RetryAfter.Round(time.Second))
+}
+
+// budgetBucket counts the solves of a domain that started in a slice of
+// the window.
+type budgetBucket struct {
+	start     time.Time
+	successes int
+	failures  int
+}
+
+// domainBudget tracks the recent solves of a domain.
+type domainBudget struct {
+	buckets       []budgetBucket
+	lastError     string
+	disabledUntil time.Time
+	disabledBy    string
+	reason        string
+}
+
+// failureBudget stops solving domains that keep failing, so that hopeless
+// targets do not tie up the FlareSolverr instances: once a domain's
+// failure rate over the rolling window exceeds the budget, it is disabled
+// for the cool-down and its requests fail fast with a
+// *DomainDisabledError.
+type failureBudget struct {
+	mu        sync.Mutex
+	maxRate   float64
+	minSolves int
+	window    time.Duration
+	cooldown  time.Duration
+	domains   map[string]*domainBudget
+	swept     time.Time
+	now       func() time.Time
+}
+
+// newFailureBudgetFromEnv reads FAILURE_BUDGET, the highest tolerated
+// failure rate between 0 and 1, with FAILURE_BUDGET_WINDOW,
+// FAILURE_BUDGET_MIN_SOLVES and FAILURE_BUDGET_COOLDOWN. It returns nil,
+// never disabling domains, if FAILURE_BUDGET is not set.
+func newFailureBudgetFromEnv() *failureBudget {
+	if os.Getenv("FAILURE_BUDGET") == "" {
+		return nil
+	}
+	maxRate := envFloat("FAILURE_BUDGET", 0.5)
+	if maxRate < 0 || maxRate >= 1 {
+		slog.Warn("FAILURE_BUDGET must be between 0 and 1", "value", maxRate, "using", 0.5)
+		maxRate = 0.5
+	}
+	return &failureBudget{
+		maxRate:   maxRate,
+		minSolves: envInt("FAILURE_BUDGET_MIN_SOLVES", 10),
+		window:    envDuration("FAILURE_BUDGET_WINDOW", 10*time.Minute),
+		cooldown:  envDuration("FAILURE_BUDGET_COOLDOWN", 30*time.Minute),
+		domains:   make(map[string]*domainBudget),
+		now:       time.Now,
+	}
+}
+
+// budgetDomain returns the domain targetURL counts against.
+func budgetDomain(targetURL string) string {
+	u, err := url.Parse(targetURL)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+// check returns a *DomainDisabledError if targetURL's domain is disabled.
+func (b *failureBudget) check(targetURL string) error {
+	if b == nil {
+		return nil
+	}
+	domain := budgetDomain(targetURL)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	state, ok := b.domains[domain]
+	if !ok {
+		return nil
+	}
+	if now := b.now(); now.Before(state.disabledUntil) {
+		return &DomainDisabledError{Domain: domain, Reason: state.reason, RetryAfter: state.disabledUntil.Sub(now)}
+	}
+	return nil
+}
+
+// record notes the outcome of a solve for targetURL. Solver errors and
+// pages that still look broken count as failures; other errors say
+// nothing about the domain and are ignored.
+func (b *failureBudget) record(targetURL string, err error, poor bool) {
+	if b == nil {
+		return
+	}
+	var solverErr *SolverError
+	reason := ""
+	switch {
+	case errors.As(err, &solverErr):
+		reason = solverErr.Error()
+	case err != nil:
+		return
+	case poor:
+		reason = "solved page looks broken"
+	}
+
+	domain := budgetDomain(targetURL)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	b.sweep(now)
+	state, ok := b.domains[domain]
+	if !ok {
+		state = &domainBudget{}
+		b.domains[domain] = state
+	}
+	state.prune(now, b.window)
+	if n := len(state.buckets); n == 0 || now.Sub(state.buckets[n-1].start) >= b.window/budgetBuckets {
+		state.buckets = append(state.buckets, budgetBucket{start: now})
+	}
+	bucket := &state.buckets[len(state.buckets)-1]
+	if reason == "" {
+		bucket.successes++
+		return
+	}
+	bucket.failures++
+	state.lastError = reason
+
+	successes, failures := state.totals()
+	rate := float64(failures) / float64(successes+failures)
+	if successes+failures >= b.minSolves && rate > b.maxRate {
+		state.buckets = nil
+		state.disabledUntil = now.Add(b.cooldown)
+		state.disabledBy = "failures"
+		state.reason = fmt.Sprintf("%d of %d recent solves failed", failures, successes+failures)
+		slog.Warn("domain exceeded its failure budget, disabling", "domain", domain,
+			"failure_rate", rate, "cooldown", b.cooldown.String(), "error", reason)
+	}
+}
+
+// sweep forgets domains without recent solves that are not disabled, at
+// most once per window.
+func (b *failureBudget) sweep(now time.Time) {
+	if now.Sub(b.swept) < b.window {
+		return
+	}
+	b.swept = now
+	for domain, state := range b.domains {
+		state.prune(now, b.window)
+		if len(state.buckets) == 0 && !now.Before(state.disabledUntil) {
+			delete(b.domains, domain)
+		}
+	}
+}
+
+// prune drops the buckets that fell out of the window.
+func (d *domainBudget) prune(now time.Time, window time.Duration) {
+	i := 0
+	for i < len(d.buckets) && now.Sub(d.buckets[i].start) >= window {
+		i++
+	}
+	d.buckets = d.buckets[i:]
+}
+
+func (d *domainBudget) totals() (successes, failures int) {
+	for _, bucket := range d.buckets {
+		successes += bucket.successes
+		failures += bucket.failures
+	}
+	return successes, failures
+}
+
+// disable disables domain for d, or enables it again if d is zero.
+func (b *failureBudget) disable(domain string, d time.Duration) {
+	domain = strings.ToLower(domain)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	state, ok := b.domains[domain]
+	if !ok {
+		state = &domainBudget{}
+		b.domains[domain] = state
+	}
+	state.buckets = nil
+	state.disabledUntil = time.Time{}
+	state.disabledBy = ""
+	state.reason = ""
+	if d > 0 {
+		state.disabledUntil = b.now().Add(d)
+		state.disabledBy = "admin"
+		state.reason = "disabled by an operator"
+	}
+}
+
+// adminDomain describes a domain's failure budget in the admin API.
+type adminDomain struct {
+	Domain        string     `json:"domain"`
+	Disabled      bool       `json:"disabled"`
+	DisabledUntil *time.Time `json:"disabled_until,omitempty"`
+	DisabledBy    string     `json:"disabled_by,omitempty"`
+	Successes     int        `json:"successes"`
+	Failures      int        `json:"failures"`
+	FailureRate   float64    `json:"failure_rate"`
+	LastError     string     `json:"last_error,omitempty"`
+}
+
+// list describes the domains solved within the window or disabled,
+// sorted by domain.
+func (b *failureBudget) list() []adminDomain {
+	domains := []adminDomain{}
+	if b == nil {
+		return domains
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	for name, state := range b.domains {
+		state.prune(now, b.window)
+		successes, failures := state.totals()
+		disabled := now.Before(state.disabledUntil)
+		if successes+failures == 0 && !disabled {
+			continue
+		}
+		domain := adminDomain{Domain: name, Successes: successes, Failures: failures, LastError: state.lastError}
+		if successes+failures > 0 {
+			domain.FailureRate = float64(failures) / float64(successes+failures)
+		}
+		if disabled {
+			until := state.disabledUntil
+			domain.Disabled, domain.DisabledUntil, domain.DisabledBy = true, &until, state.disabledBy
+		}
+		domains = append(domains, domain)
+	}
+	sort.Slice(domains, func(i, j int) bool { return domains[i].Domain < domains[j].Domain })
+	return domains
+}
@@ -0,0 +1,110 @@
+package flareproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFailureBudget(t *testing.T) {
+	t.Setenv("FAILURE_BUDGET", "0.5")
+	t.Setenv("FAILURE_BUDGET_MIN_SOLVES", "4")
+	t.Setenv("FAILURE_BUDGET_WINDOW", "10m")
+	t.Setenv("FAILURE_BUDGET_COOLDOWN", "30m")
+	b := newFailureBudgetFromEnv()
+	now := time.Now()
+	b.now = func() time.Time { return now }
+	failed := &SolverError{Message: "Error solving the challenge"}
+	const target = "https://Hopeless.example/page"
+
+	// Too few solves to judge
+	for i := 0; i < 3; i++ {
+		b.record(target, failed, false)
+	}
+	if err := b.check(target); err != nil {
+		t.Fatalf("check() = %v before the minimum number of solves", err)
+	}
+
+	// Errors that say nothing about the domain are ignored
+	b.record(target, &CircuitOpenError{RetryAfter: time.Second}, false)
+	if err := b.check(target); err != nil {
+		t.Fatalf("check() = %v after an unrelated error", err)
+	}
+
+	// Old solves fall out of the window
+	now = now.Add(11 * time.Minute)
+	b.record(target, nil, false)
+	b.record(target, failed, false)
+	b.record(target, nil, false)
+	b.record(target, nil, true)
+	if err := b.check(target); err != nil {
+		t.Fatalf("check() = %v with half the recent solves failing", err)
+	}
+	b.record(target, failed, false)
+	var disabledErr *DomainDisabledError
+	if err := b.check(target); !errors.As(err, &disabledErr) || disabledErr.Domain != "hopeless.example" {
+		t.Fatalf("check() = %v, want *DomainDisabledError", err)
+	}
+	if disabledErr.RetryAfter != 30*time.Minute || !strings.Contains(disabledErr.Error(), "3 of 5 recent solves failed") {
+		t.Errorf("error = %v, retry after %s", disabledErr, disabledErr.RetryAfter)
+	}
+	if err := b.check("https://example.com/"); err != nil {
+		t.Errorf("check() = %v for another domain", err)
+	}
+
+	// The cool-down starts the domain over
+	now = now.Add(30 * time.Minute)
+	if err := b.check(target); err != nil {
+		t.Errorf("check() = %v after the cool-down", err)
+	}
+	if domains := b.list(); len(domains) != 0 {
+		t.Errorf("list() = %+v, want the domain forgotten", domains)
+	}
+}
+
+func TestFailureBudgetFetch(t *testing.T) {
+	var solves atomic.Int32
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		solves.Add(1)
+		var req FlareSolverrRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		response := testResponse("<html>solved</html>")
+		if strings.Contains(req.URL, "hopeless") {
+			response.Status = "error"
+			response.Message = "Error: Error solving the challenge."
+		}
+		json.NewEncoder(w).Encode(response)
+	}))
+	defer mockServer.Close()
+	t.Setenv("FLARESOLVERR_URL", mockServer.URL)
+	t.Setenv("FAILURE_BUDGET", "0.5")
+	t.Setenv("FAILURE_BUDGET_MIN_SOLVES", "2")
+	handler := NewDirectHandler()
+
+	for i := 0; i < 2; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/hopeless.example/", nil))
+	}
+	solves.Store(0)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/hopeless.example/", nil))
+	if rr.Code != http.StatusServiceUnavailable || rr.Header().Get("Retry-After") != "1800" {
+		t.Errorf("status = %d, Retry-After %q, want 503 with Retry-After", rr.Code, rr.Header().Get("Retry-After"))
+	}
+	if !strings.Contains(rr.Body.String(), "hopeless.example is disabled") {
+		t.Errorf("body = %s, want the domain named", rr.Body.String())
+	}
+	if got := solves.Load(); got != 0 {
+		t.Errorf("solved %d times while disabled", got)
+	}
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/example.com/", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("status = %d for another domain, want 200", rr.Code)
+	}
+}
@@ -0,0 +1,313 @@
+package flareproxy
+
+import (
+	"container/list"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Cache stores solved responses. Implementations treat storage failures
+// as misses, since the cache is only an optimisation.
+type Cache interface {
+	// Get returns the response stored under key if it has not expired.
+	Get(key string) (*FlareSolverrResponse, bool)
+	// Set stores response under key for the cache's TTL.
+	Set(key string, response *FlareSolverrResponse)
+}
+
+// CacheStats describes the contents of a cache in the admin API.
+type CacheStats struct {
+	Backend string `json:"backend"`
+	Entries int    `json:"entries"`
+	Bytes   int64  `json:"bytes,omitempty"`
+}
+
+// flushableCache is implemented by caches that can describe their
+// contents and be emptied through the admin API.
+type flushableCache interface {
+	Stats() (CacheStats, error)
+	// Flush removes every entry and returns how many there were.
+	Flush() (int, error)
+}
+
+// cacheCounters counts how requests were served from the cache.
+type cacheCounters struct {
+	hits   atomic.Int64
+	misses atomic.Int64
+	stale  atomic.Int64
+}
+
+// count records a request by its X-Cache status.
+func (c *cacheCounters) count(status string) {
+	switch status {
+	case "HIT":
+		c.hits.Add(1)
+	case "MISS":
+		c.misses.Add(1)
+	case "STALE":
+		c.stale.Add(1)
+	}
+}
+
+// Cache backends accepted by CACHE_BACKEND.
+const (
+	CacheBackendMemory = "memory"
+	CacheBackendDisk   = "disk"
+	CacheBackendRedis  = "redis"
+)
+
+// CacheOptions configures the response cache of a Server.
+type CacheOptions struct {
+	// TTL is how long responses are cached; zero disables the cache.
+	TTL time.Duration
+	// Backend is CacheBackendMemory, the default, CacheBackendDisk or
+	// CacheBackendRedis.
+	Backend string
+	// MaxEntries and MaxBytes bound the memory and disk caches.
+	MaxEntries int
+	MaxBytes   int64
+	// Dir is the directory of the disk cache, by default
+	// flareproxygo-cache in the temp directory.
+	Dir string
+	// RedisURL is the server of the Redis cache.
+	RedisURL string
+	// Compress gzips the entries of the disk and Redis caches.
+	Compress bool
+	// StaleMaxAge is how long expired entries are kept, to be served
+	// while FlareSolverr is down; zero keeps none.
+	StaleMaxAge time.Duration
+}
+
+// CacheOptionsFromEnv reads the CacheOptions from CACHE_TTL,
+// CACHE_BACKEND, CACHE_MAX_ENTRIES, CACHE_MAX_BYTES, CACHE_DIR, REDIS_URL,
+// CACHE_COMPRESSION, SERVE_STALE and SERVE_STALE_MAX_AGE.
+func CacheOptionsFromEnv() CacheOptions {
+	return CacheOptions{
+		TTL:         envDuration("CACHE_TTL", 0),
+		Backend:     os.Getenv("CACHE_BACKEND"),
+		MaxEntries:  envInt("CACHE_MAX_ENTRIES", 1000),
+		MaxBytes:    int64(envInt("CACHE_MAX_BYTES", 64<<20)),
+		Dir:         os.Getenv("CACHE_DIR"),
+		RedisURL:    os.Getenv("REDIS_URL"),
+		Compress:    cacheCompressionFromEnv(),
+		StaleMaxAge: staleMaxAgeFromEnv(),
+	}
+}
+
+// newCacheFromEnv returns the cache configured through the environment,
+// see CacheOptionsFromEnv, or nil when caching is disabled.
+func newCacheFromEnv() Cache {
+	return newCache(CacheOptionsFromEnv())
+}
+
+// newCache returns the cache configured by opts, or nil when caching is
+// disabled or the cache cannot be set up.
+func newCache(opts CacheOptions) Cache {
+	if opts.TTL <= 0 {
+		return nil
+	}
+	switch backend := opts.Backend; backend {
+	case "", CacheBackendMemory:
+		cache := newMemoryCache(opts.TTL, opts.MaxEntries, opts.MaxBytes)
+		cache.stale = opts.StaleMaxAge
+		return cache
+	case CacheBackendDisk:
+		dir := opts.Dir
+		if dir == "" {
+			dir = filepath.Join(os.TempDir(), "flareproxygo-cache")
+		}
+		cache, err := newDiskCache(dir, opts.TTL, opts.MaxEntries, opts.MaxBytes)
+		if err != nil {
+			slog.Warn("disk cache disabled", "error", err)
+			return nil
+		}
+		cache.compress = opts.Compress
+		cache.stale = opts.StaleMaxAge
+		return cache
+	case CacheBackendRedis:
+		client, err := newRedisClient(opts.RedisURL)
+		if err != nil {
+			slog.Warn("redis cache disabled", "error", err)
+			return nil
+		}
+		cache := newRedisCache(client, opts.TTL)
+		cache.compress = opts.Compress
+		cache.stale = opts.StaleMaxAge
+		return cache
+	default:
+		slog.Warn("unknown CACHE_BACKEND, caching disabled", "backend", backend)
+		return nil
+	}
+}
+
+// memoryCache is an in-memory LRU cache of solved responses. Entries
+// expire after a fixed TTL but are kept for the stale period after that.
+// The least recently used entries are evicted once either the entry or
+// the byte limit is exceeded.
+type memoryCache struct {
+	mu         sync.Mutex
+	ttl        time.Duration
+	maxEntries int
+	maxBytes   int64
+	bytes      int64
+	ll         *list.List
+	items      map[string]*list.Element
+	now        func() time.Time
+	stale      time.Duration
+}
+
+type cacheEntry struct {
+	key      string
+	response *FlareSolverrResponse
+	size     int64
+	expires  time.Time
+}
+
+func newMemoryCache(ttl time.Duration, maxEntries int, maxBytes int64) *memoryCache {
+	return &memoryCache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		ll:         list.New(),
+		items:      make(map[string]*list.Element),
+		now:        time.Now,
+	}
+}
+
+// Get returns the cached response for key if it exists and has not expired.
+func (c *memoryCache) Get(key string) (*FlareSolverrResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if c.now().After(entry.expires) {
+		if c.now().After(entry.expires.Add(c.stale)) {
+			c.remove(elem)
+		}
+		return nil, false
+	}
+	c.ll.MoveToFront(elem)
+	return entry.response, true
+}
+
+// GetStale returns the response for key even if it has expired, unless it
+// expired more than the stale period ago.
+func (c *memoryCache) GetStale(key string) (*FlareSolverrResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if c.now().After(entry.expires.Add(c.stale)) {
+		c.remove(elem)
+		return nil, false
+	}
+	return entry.response, true
+}
+
+// Set stores response under key, evicting old entries as needed. Responses
+// larger than the byte limit are not cached.
+func (c *memoryCache) Set(key string, response *FlareSolverrResponse) {
+	c.set(key, response, c.now().Add(c.ttl))
+}
+
+// SetTTL stores response under key for ttl instead of the cache's TTL.
+func (c *memoryCache) SetTTL(key string, response *FlareSolverrResponse, ttl time.Duration) {
+	c.set(key, response, c.now().Add(ttl))
+}
+
+// set stores response under key until expires.
+func (c *memoryCache) set(key string, response *FlareSolverrResponse, expires time.Time) {
+	size := int64(len(response.Solution.Response))
+	if c.maxBytes > 0 && size > c.maxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.items[key]; ok {
+		c.remove(elem)
+	}
+	entry := &cacheEntry{
+		key:      key,
+		response: response,
+		size:     size,
+		expires:  expires,
+	}
+	c.items[key] = c.ll.PushFront(entry)
+	c.bytes += size
+
+	for c.ll.Len() > 0 && ((c.maxEntries > 0 && c.ll.Len() > c.maxEntries) || (c.maxBytes > 0 && c.bytes > c.maxBytes)) {
+		c.remove(c.ll.Back())
+	}
+}
+
+// Len returns the number of entries in the cache, including expired
+// entries that have not been evicted yet.
+func (c *memoryCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ll.Len()
+}
+
+func (c *memoryCache) Stats() (CacheStats, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{Backend: CacheBackendMemory, Entries: c.ll.Len(), Bytes: c.bytes}, nil
+}
+
+func (c *memoryCache) Flush() (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := c.ll.Len()
+	c.ll.Init()
+	c.items = make(map[string]*list.Element)
+	c.bytes = 0
+	return n, nil
+}
+
+func (c *memoryCache) remove(elem *list.Element) {
+	entry := c.ll.Remove(elem).(*cacheEntry)
+	delete(c.items, entry.key)
+	c.bytes -= entry.size
+}
+
+// cacheKey returns the cache key for a request, normalizing the URL so
+// that trivially different spellings of the same URL share an entry.
+func cacheKey(method, rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return method + " " + rawURL
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	if port := u.Port(); (u.Scheme == "https" && port == "443") || (u.Scheme == "http" && port == "80") {
+		u.Host = strings.TrimSuffix(u.Host, ":"+port)
+	}
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	u.Fragment = ""
+	return method + " " + u.String()
+}
+
+// isCacheable reports whether a solution may be cached. Only successful
+// responses are cached so that transient errors are retried.
+func isCacheable(flareResponse *FlareSolverrResponse) bool {
+	status := flareResponse.Solution.Status
+	return status == 0 || (status >= 200 && status < 300)
+}
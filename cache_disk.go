@@ -0,0 +1,234 @@
+package flareproxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// diskCache stores solved responses as JSON files in a directory so that
+// they survive restarts. Expired files are kept for the stale period. The
+// oldest files are removed once the entry or byte limit is exceeded. Entries are gzip compressed unless compression
+// is disabled.
+type diskCache struct {
+	mu         sync.Mutex
+	dir        string
+	ttl        time.Duration
+	maxEntries int
+	maxBytes   int64
+	compress   bool
+	now        func() time.Time
+	stale      time.Duration
+}
+
+type diskCacheEntry struct {
+	Key      string                `json:"key"`
+	Expires  time.Time             `json:"expires"`
+	Response *FlareSolverrResponse `json:"response"`
+}
+
+func newDiskCache(dir string, ttl time.Duration, maxEntries int, maxBytes int64) (*diskCache, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &diskCache{
+		dir:        dir,
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		compress:   true,
+		now:        time.Now,
+	}, nil
+}
+
+func (c *diskCache) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:])+".json")
+}
+
+func (c *diskCache) Get(key string) (*FlareSolverrResponse, bool) {
+	entry, ok := c.read(key)
+	if !ok || c.now().After(entry.Expires) {
+		return nil, false
+	}
+	return entry.Response, true
+}
+
+// GetStale returns the response for key even if it has expired, unless it
+// expired more than the stale period ago.
+func (c *diskCache) GetStale(key string) (*FlareSolverrResponse, bool) {
+	entry, ok := c.read(key)
+	if !ok {
+		return nil, false
+	}
+	return entry.Response, true
+}
+
+// read returns the entry for key, removing it if it expired more than the
+// stale period ago.
+func (c *diskCache) read(key string) (diskCacheEntry, bool) {
+	data, err := os.ReadFile(c.path(key))
+	if err == nil {
+		data, err = decompressEntry(data)
+	}
+	if err != nil {
+		return diskCacheEntry{}, false
+	}
+	var entry diskCacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil || entry.Key != key || entry.Response == nil {
+		return diskCacheEntry{}, false
+	}
+	if c.now().After(entry.Expires.Add(c.stale)) {
+		os.Remove(c.path(key))
+		return diskCacheEntry{}, false
+	}
+	return entry, true
+}
+
+func (c *diskCache) Set(key string, response *FlareSolverrResponse) {
+	c.set(key, response, c.now().Add(c.ttl))
+}
+
+// SetTTL stores response under key for ttl instead of the cache's TTL.
+func (c *diskCache) SetTTL(key string, response *FlareSolverrResponse, ttl time.Duration) {
+	c.set(key, response, c.now().Add(ttl))
+}
+
+// set stores response under key until expires.
+func (c *diskCache) set(key string, response *FlareSolverrResponse, expires time.Time) {
+	data, err := json.Marshal(diskCacheEntry{
+		Key:      key,
+		Expires:  expires,
+		Response: response,
+	})
+	if err != nil {
+		return
+	}
+	data = compressEntry(data, c.compress)
+	if c.maxBytes > 0 && int64(len(data)) > c.maxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := writeFileAtomic(c.path(key), data); err != nil {
+		slog.Warn("disk cache write failed", "error", err)
+		return
+	}
+	c.evict()
+}
+
+// writeFileAtomic writes to a temporary file in the same directory first
+// and renames it into place, so readers never see a partial file.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// files returns the paths and sizes of the cache's files.
+func (c *diskCache) files() (map[string]int64, error) {
+	dirEntries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]int64, len(dirEntries))
+	for _, dirEntry := range dirEntries {
+		if dirEntry.IsDir() || !strings.HasSuffix(dirEntry.Name(), ".json") {
+			continue
+		}
+		if info, err := dirEntry.Info(); err == nil {
+			files[filepath.Join(c.dir, dirEntry.Name())] = info.Size()
+		}
+	}
+	return files, nil
+}
+
+func (c *diskCache) Stats() (CacheStats, error) {
+	files, err := c.files()
+	if err != nil {
+		return CacheStats{}, err
+	}
+	stats := CacheStats{Backend: CacheBackendDisk, Entries: len(files)}
+	for _, size := range files {
+		stats.Bytes += size
+	}
+	return stats, nil
+}
+
+func (c *diskCache) Flush() (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	files, err := c.files()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for path := range files {
+		if err := os.Remove(path); err == nil {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// evict removes expired entries and then the least recently written ones
+// until the cache is within its limits.
+func (c *diskCache) evict() {
+	dirEntries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return
+	}
+
+	type file struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	var files []file
+	var total int64
+	cutoff := c.now().Add(-c.ttl - c.stale)
+	for _, dirEntry := range dirEntries {
+		if dirEntry.IsDir() || !strings.HasSuffix(dirEntry.Name(), ".json") {
+			continue
+		}
+		info, err := dirEntry.Info()
+		if err != nil {
+			continue
+		}
+		path := filepath.Join(c.dir, dirEntry.Name())
+		if info.ModTime().Before(cutoff) {
+			os.Remove(path)
+			continue
+		}
+		files = append(files, file{path: path, size: info.Size(), modTime: info.ModTime()})
+		total += info.Size()
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+	for len(files) > 0 && ((c.maxEntries > 0 && len(files) > c.maxEntries) || (c.maxBytes > 0 && total > c.maxBytes)) {
+		os.Remove(files[0].path)
+		total -= files[0].size
+		files = files[1:]
+	}
+}
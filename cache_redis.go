@@ -0,0 +1,142 @@
+package flareproxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strconv"
+	"time"
+)
+
+// redisCache stores solved responses in Redis so that several replicas
+// can share one cache. Expiry is left to Redis, which keeps entries for
+// the stale period after their TTL; size limits should be enforced with
+// Redis' own maxmemory policy. Entries are gzip compressed
+// unless compression is disabled.
+type redisCache struct {
+	client   *redisClient
+	ttl      time.Duration
+	prefix   string
+	compress bool
+	stale    time.Duration
+}
+
+func newRedisCache(client *redisClient, ttl time.Duration) *redisCache {
+	return &redisCache{
+		client:   client,
+		ttl:      ttl,
+		prefix:   "flareproxygo:cache:",
+		compress: true,
+	}
+}
+
+func (c *redisCache) key(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return c.prefix + hex.EncodeToString(sum[:])
+}
+
+func (c *redisCache) Get(key string) (*FlareSolverrResponse, bool) {
+	response, ok := c.GetStale(key)
+	if !ok {
+		return nil, false
+	}
+	// Entries kept for the stale period expire by their fetch time
+	if fetched := response.EndTime(); c.stale > 0 && !fetched.IsZero() && time.Since(fetched) > c.ttl {
+		return nil, false
+	}
+	return response, true
+}
+
+// GetStale returns the response for key even if its TTL has passed, as
+// long as Redis still keeps it.
+func (c *redisCache) GetStale(key string) (*FlareSolverrResponse, bool) {
+	reply, err := c.client.Do("GET", c.key(key))
+	if err != nil {
+		if !errors.Is(err, errRedisNil) {
+			slog.Warn("redis cache read failed", "error", err)
+		}
+		return nil, false
+	}
+	data, ok := reply.(string)
+	if !ok {
+		return nil, false
+	}
+	decoded, err := decompressEntry([]byte(data))
+	if err != nil {
+		return nil, false
+	}
+	var response FlareSolverrResponse
+	if err := json.Unmarshal(decoded, &response); err != nil {
+		return nil, false
+	}
+	return &response, true
+}
+
+func (c *redisCache) Set(key string, response *FlareSolverrResponse) {
+	data, err := json.Marshal(response)
+	if err != nil {
+		return
+	}
+	data = compressEntry(data, c.compress)
+	ttl := strconv.FormatInt((c.ttl + c.stale).Milliseconds(), 10)
+	if _, err := c.client.Do("SET", c.key(key), string(data), "PX", ttl); err != nil {
+		slog.Warn("redis cache write failed", "error", err)
+	}
+}
+
+// scan calls fn with the Redis keys of the cache's entries, a batch at a
+// time.
+func (c *redisCache) scan(fn func(keys []string) error) error {
+	cursor := "0"
+	for {
+		reply, err := c.client.Do("SCAN", cursor, "MATCH", c.prefix+"*", "COUNT", "500")
+		if err != nil {
+			return err
+		}
+		parts, ok := reply.([]interface{})
+		if !ok || len(parts) != 2 {
+			return errors.New("redis: unexpected SCAN reply")
+		}
+		cursor, _ = parts[0].(string)
+		items, _ := parts[1].([]interface{})
+		keys := make([]string, 0, len(items))
+		for _, item := range items {
+			if key, ok := item.(string); ok {
+				keys = append(keys, key)
+			}
+		}
+		if len(keys) > 0 {
+			if err := fn(keys); err != nil {
+				return err
+			}
+		}
+		if cursor == "0" || cursor == "" {
+			return nil
+		}
+	}
+}
+
+// Stats counts the entries; their size is left to Redis' own statistics.
+func (c *redisCache) Stats() (CacheStats, error) {
+	stats := CacheStats{Backend: CacheBackendRedis}
+	err := c.scan(func(keys []string) error {
+		stats.Entries += len(keys)
+		return nil
+	})
+	return stats, err
+}
+
+// Flush deletes the entries of this cache, leaving other keys alone.
+func (c *redisCache) Flush() (int, error) {
+	n := 0
+	err := c.scan(func(keys []string) error {
+		reply, err := c.client.Do(append([]string{"DEL"}, keys...)...)
+		if deleted, ok := reply.(int64); ok {
+			n += int(deleted)
+		}
+		return err
+	})
+	return n, err
+}
@@ -0,0 +1,364 @@
+package flareproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testResponse(body string) *FlareSolverrResponse {
+	response := &FlareSolverrResponse{Status: "ok"}
+	response.Solution.Response = body
+	response.Solution.Status = 200
+	return response
+}
+
+func TestMemoryCache(t *testing.T) {
+	now := time.Now()
+	cache := newMemoryCache(time.Minute, 2, 10)
+	cache.now = func() time.Time { return now }
+
+	cache.Set("a", testResponse("aaa"))
+	cache.Set("b", testResponse("bbb"))
+	if _, ok := cache.Get("a"); !ok {
+		t.Fatal("expected a to be cached")
+	}
+
+	// b is now the least recently used entry
+	cache.Set("c", testResponse("ccc"))
+	if _, ok := cache.Get("b"); ok {
+		t.Error("expected b to be evicted by entry limit")
+	}
+
+	// a and c hold 6 bytes, adding 6 more exceeds the 10 byte limit
+	cache.Set("d", testResponse("dddddd"))
+	if _, ok := cache.Get("a"); ok {
+		t.Error("expected a to be evicted by byte limit")
+	}
+	if cache.Len() != 2 {
+		t.Errorf("Len() = %d, want 2", cache.Len())
+	}
+
+	cache.Set("big", testResponse("this body is too large"))
+	if _, ok := cache.Get("big"); ok {
+		t.Error("expected oversized response not to be cached")
+	}
+
+	now = now.Add(2 * time.Minute)
+	if _, ok := cache.Get("d"); ok {
+		t.Error("expected d to have expired")
+	}
+}
+
+func TestCacheKey(t *testing.T) {
+	tests := []struct {
+		a, b string
+		same bool
+	}{
+		{"https://Example.COM/path", "https://example.com/path", true},
+		{"https://example.com:443/path", "https://example.com/path", true},
+		{"https://example.com", "https://example.com/", true},
+		{"https://example.com/path#frag", "https://example.com/path", true},
+		{"https://example.com/path?q=1", "https://example.com/path?q=2", false},
+		{"http://example.com/path", "https://example.com/path", false},
+		{"https://[::1]:443/", "https://[::1]/", true},
+	}
+
+	for _, tt := range tests {
+		if got := cacheKey("GET", tt.a) == cacheKey("GET", tt.b); got != tt.same {
+			t.Errorf("cacheKey(%q) == cacheKey(%q) is %v, want %v", tt.a, tt.b, got, tt.same)
+		}
+	}
+}
+
+func TestDirectHandler_Cache(t *testing.T) {
+	var calls atomic.Int32
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		var req FlareSolverrRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		response := testResponse("<html>cached</html>")
+		if strings.Contains(req.URL, "missing") {
+			response.Solution.Status = 404
+		}
+		json.NewEncoder(w).Encode(response)
+	}))
+	defer mockServer.Close()
+
+	os.Setenv("FLARESOLVERR_URL", mockServer.URL)
+	os.Setenv("CACHE_TTL", "1m")
+	defer os.Unsetenv("FLARESOLVERR_URL")
+	defer os.Unsetenv("CACHE_TTL")
+	handler := NewDirectHandler()
+
+	tests := []struct {
+		name      string
+		method    string
+		path      string
+		wantCache string
+		wantCalls int32
+	}{
+		{"first GET misses", "GET", "/example.com/page", "MISS", 1},
+		{"second GET hits", "GET", "/example.com/page", "HIT", 1},
+		{"POST bypasses cache", "POST", "/example.com/page", "BYPASS", 2},
+		{"error status is not cached", "GET", "/example.com/missing", "MISS", 3},
+		{"error status is fetched again", "GET", "/example.com/missing", "MISS", 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			if got := rr.Result().Trailer.Get(TrailerCache); got != tt.wantCache {
+				t.Errorf("cache trailer = %q, want %q", got, tt.wantCache)
+			}
+			if got := calls.Load(); got != tt.wantCalls {
+				t.Errorf("FlareSolverr calls = %d, want %d", got, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestDiskCache(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := newDiskCache(dir, time.Minute, 2, 0)
+	if err != nil {
+		t.Fatalf("newDiskCache() error = %v", err)
+	}
+
+	cache.Set("a", testResponse("aaa"))
+	got, ok := cache.Get("a")
+	if !ok || got.Solution.Response != "aaa" {
+		t.Fatalf("Get(a) = %v, %v", got, ok)
+	}
+
+	// A new cache over the same directory sees the stored entry
+	reopened, _ := newDiskCache(dir, time.Minute, 2, 0)
+	if _, ok := reopened.Get("a"); !ok {
+		t.Error("expected entry to survive reopening the cache")
+	}
+
+	cache.Set("b", testResponse("bbb"))
+	cache.Set("c", testResponse("ccc"))
+	files, _ := os.ReadDir(dir)
+	if len(files) != 2 {
+		t.Errorf("cache holds %d files, want 2", len(files))
+	}
+
+	cache.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	if _, ok := cache.Get("c"); ok {
+		t.Error("expected c to have expired")
+	}
+}
+
+func TestRedisCache(t *testing.T) {
+	server := newFakeRedis(t, "")
+	client, _ := newRedisClient(server.URL())
+	cache := newRedisCache(client, 90*time.Second)
+
+	if _, ok := cache.Get("a"); ok {
+		t.Fatal("expected miss on empty cache")
+	}
+	cache.Set("a", testResponse("aaa"))
+	got, ok := cache.Get("a")
+	if !ok || got.Solution.Response != "aaa" {
+		t.Fatalf("Get(a) = %v, %v", got, ok)
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	for _, ttl := range server.expiry {
+		if ttl != "90000" {
+			t.Errorf("PX = %s, want 90000", ttl)
+		}
+	}
+}
+
+func TestCacheCompression(t *testing.T) {
+	body := strings.Repeat("<p>compressible</p>", 500)
+	server := newFakeRedis(t, "")
+	client, _ := newRedisClient(server.URL())
+
+	for _, compress := range []bool{true, false} {
+		disk, _ := newDiskCache(t.TempDir(), time.Minute, 10, 0)
+		redis := newRedisCache(client, time.Minute)
+		disk.compress, redis.compress = compress, compress
+
+		for name, cache := range map[string]Cache{"disk": disk, "redis": redis} {
+			cache.Set("a", testResponse(body))
+			got, ok := cache.Get("a")
+			if !ok || got.Solution.Response != body {
+				t.Errorf("%s (compress=%v): Get(a) = %v, %v", name, compress, got, ok)
+			}
+		}
+
+		data, _ := os.ReadFile(disk.path("a"))
+		if gzipped := len(data) > 2 && data[0] == 0x1f && data[1] == 0x8b; gzipped != compress {
+			t.Errorf("disk entry gzipped = %v, want %v", gzipped, compress)
+		}
+		if compress && len(data) > len(body)/5 {
+			t.Errorf("compressed entry is %d bytes for a %d byte body", len(data), len(body))
+		}
+	}
+
+	// Entries written without compression stay readable once it is enabled
+	dir := t.TempDir()
+	plain, _ := newDiskCache(dir, time.Minute, 10, 0)
+	plain.compress = false
+	plain.Set("a", testResponse("aaa"))
+	compressed, _ := newDiskCache(dir, time.Minute, 10, 0)
+	if got, ok := compressed.Get("a"); !ok || got.Solution.Response != "aaa" {
+		t.Errorf("Get(a) of uncompressed entry = %v, %v", got, ok)
+	}
+}
+
+func TestNewCacheFromEnv(t *testing.T) {
+	server := newFakeRedis(t, "")
+	tests := []struct {
+		name    string
+		env     map[string]string
+		wantNil bool
+		want    string
+	}{
+		{name: "disabled without TTL", env: map[string]string{}, wantNil: true},
+		{name: "memory by default", env: map[string]string{"CACHE_TTL": "1m"}, want: "*flareproxy.memoryCache"},
+		{name: "disk", env: map[string]string{"CACHE_TTL": "1m", "CACHE_BACKEND": "disk", "CACHE_DIR": t.TempDir()}, want: "*flareproxy.diskCache"},
+		{name: "redis", env: map[string]string{"CACHE_TTL": "1m", "CACHE_BACKEND": "redis", "REDIS_URL": server.URL()}, want: "*flareproxy.redisCache"},
+		{name: "unknown backend", env: map[string]string{"CACHE_TTL": "1m", "CACHE_BACKEND": "memcached"}, wantNil: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			cache := newCacheFromEnv()
+			if tt.wantNil {
+				if cache != nil {
+					t.Errorf("newCacheFromEnv() = %T, want nil", cache)
+				}
+				return
+			}
+			if got := fmt.Sprintf("%T", cache); got != tt.want {
+				t.Errorf("newCacheFromEnv() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStaleCacheEntries(t *testing.T) {
+	memory := newMemoryCache(time.Minute, 10, 0)
+	memory.stale = time.Hour
+	disk, err := newDiskCache(t.TempDir(), time.Minute, 10, 0)
+	if err != nil {
+		t.Fatalf("newDiskCache() error = %v", err)
+	}
+	disk.stale = time.Hour
+
+	for name, cache := range map[string]struct {
+		staleCache
+		setNow func(time.Time)
+	}{
+		"memory": {memory, func(now time.Time) { memory.now = func() time.Time { return now } }},
+		"disk":   {disk, func(now time.Time) { disk.now = func() time.Time { return now } }},
+	} {
+		t.Run(name, func(t *testing.T) {
+			start := time.Now()
+			cache.setNow(start)
+			cache.Set("a", testResponse("aaa"))
+
+			cache.setNow(start.Add(30 * time.Minute))
+			if _, ok := cache.Get("a"); ok {
+				t.Error("Get() returned an expired entry")
+			}
+			if got, ok := cache.GetStale("a"); !ok || got.Solution.Response != "aaa" {
+				t.Errorf("GetStale() = %v, %v, want the expired entry", got, ok)
+			}
+
+			cache.setNow(start.Add(2 * time.Hour))
+			if _, ok := cache.GetStale("a"); ok {
+				t.Error("GetStale() returned an entry past the stale period")
+			}
+		})
+	}
+
+	t.Run("redis", func(t *testing.T) {
+		server := newFakeRedis(t, "")
+		client, _ := newRedisClient(server.URL())
+		cache := newRedisCache(client, time.Minute)
+		cache.stale = time.Hour
+		fresh := testResponse("fresh")
+		stampFetched(fresh)
+		old := testResponse("old")
+		old.EndTimestamp = time.Now().Add(-30 * time.Minute).UnixMilli()
+		cache.Set("fresh", fresh)
+		cache.Set("old", old)
+
+		if _, ok := cache.Get("fresh"); !ok {
+			t.Error("Get(fresh) missed")
+		}
+		if _, ok := cache.Get("old"); ok {
+			t.Error("Get(old) returned an expired entry")
+		}
+		if _, ok := cache.GetStale("old"); !ok {
+			t.Error("GetStale(old) missed")
+		}
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		for _, ttl := range server.expiry {
+			if ttl != "3660000" {
+				t.Errorf("PX = %s, want the TTL plus the stale period", ttl)
+			}
+		}
+	})
+}
+
+func TestCacheFlush(t *testing.T) {
+	disk, err := newDiskCache(t.TempDir(), time.Minute, 10, 0)
+	if err != nil {
+		t.Fatalf("newDiskCache() error = %v", err)
+	}
+	server := newFakeRedis(t, "")
+	client, _ := newRedisClient(server.URL())
+	server.data["other:key"] = "not ours"
+
+	for name, cache := range map[string]interface {
+		Cache
+		flushableCache
+	}{
+		"memory": newMemoryCache(time.Minute, 10, 0),
+		"disk":   disk,
+		"redis":  newRedisCache(client, time.Minute),
+	} {
+		t.Run(name, func(t *testing.T) {
+			cache.Set("a", testResponse("aaa"))
+			cache.Set("b", testResponse("bbbb"))
+			stats, err := cache.Stats()
+			if err != nil || stats.Backend != name || stats.Entries != 2 {
+				t.Errorf("Stats() = %+v, %v, want 2 %s entries", stats, err, name)
+			}
+			if name == "memory" && stats.Bytes != 7 {
+				t.Errorf("Stats().Bytes = %d, want 7", stats.Bytes)
+			}
+			if n, err := cache.Flush(); n != 2 || err != nil {
+				t.Errorf("Flush() = %d, %v, want 2", n, err)
+			}
+			if _, ok := cache.Get("a"); ok {
+				t.Error("Get() returned a flushed entry")
+			}
+			if stats, _ := cache.Stats(); stats.Entries != 0 {
+				t.Errorf("%d entries left after Flush()", stats.Entries)
+			}
+		})
+	}
+	if server.data["other:key"] != "not ours" {
+		t.Error("redis Flush() deleted keys of others")
+	}
+}
@@ -0,0 +1,178 @@
+package flareproxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// CacheKeyFunc computes the cache key of a GET of req.URL, for pages that
+// come in variants the URL alone does not tell apart. key is the key the
+// proxy would use, from the canonical URL, the upstream proxy and
+// CACHE_KEY_VARY; returning it unchanged keeps it. Requests with equal
+// keys share a cache entry. See Server.SetCacheKeyFunc.
+type CacheKeyFunc func(key string, req FetchRequest) string
+
+// cacheKeyRule is one CACHE_KEY_VARY rule: a request header, cookie or
+// the client's API key that tells variants apart, or a query parameter
+// that does not.
+type cacheKeyRule struct {
+	domain string // "" for all domains, with subdomains otherwise
+	header string // canonical header name
+	cookie string
+	apiKey bool
+	ignore string // query parameter left out of the key
+}
+
+// cacheKeyPolicy adds what CACHE_KEY_VARY names to the cache keys of the
+// domains it applies to.
+type cacheKeyPolicy struct {
+	rules []cacheKeyRule
+}
+
+// newCacheKeyPolicyFromEnv reads CACHE_KEY_VARY, a comma separated list
+// of "header:Name", "cookie:name", "apikey" and "ignore:param", each
+// optionally prefixed with "domain=" to apply to that domain and its
+// subdomains only, like
+// "header:Accept-Language,shop.example=cookie:currency,shop.example=ignore:sid".
+// It returns nil if none is set.
+func newCacheKeyPolicyFromEnv() *cacheKeyPolicy {
+	p := &cacheKeyPolicy{}
+	for _, spec := range splitList(os.Getenv("CACHE_KEY_VARY")) {
+		rule, err := parseCacheKeyRule(spec)
+		if err != nil {
+			slog.Warn("ignoring invalid CACHE_KEY_VARY rule", "rule", spec, "error", err)
+			continue
+		}
+		p.rules = append(p.rules, rule)
+	}
+	if len(p.rules) == 0 {
+		return nil
+	}
+	return p
+}
+
+func parseCacheKeyRule(spec string) (cacheKeyRule, error) {
+	var rule cacheKeyRule
+	if domain, rest, ok := strings.Cut(spec, "="); ok {
+		rule.domain = strings.ToLower(strings.TrimSpace(domain))
+		spec = strings.TrimSpace(rest)
+	}
+	kind, name, _ := strings.Cut(spec, ":")
+	name = strings.TrimSpace(name)
+	switch kind = strings.ToLower(strings.TrimSpace(kind)); {
+	case kind == "apikey" && name == "":
+		rule.apiKey = true
+	case name == "":
+		return rule, fmt.Errorf("%q needs a name", kind)
+	case kind == "header":
+		rule.header = http.CanonicalHeaderKey(name)
+	case kind == "cookie":
+		rule.cookie = name
+	case kind == "ignore":
+		rule.ignore = name
+	default:
+		return rule, fmt.Errorf("unknown component %q", kind)
+	}
+	return rule, nil
+}
+
+// appliesTo reports whether the rule covers requests to host.
+func (r cacheKeyRule) appliesTo(host string) bool {
+	return r.domain == "" || host == r.domain || strings.HasSuffix(host, "."+r.domain)
+}
+
+// ignored returns targetURL without the query parameters the rules for
+// its domain ignore.
+func (p *cacheKeyPolicy) ignored(targetURL string) string {
+	if p == nil {
+		return targetURL
+	}
+	u, err := url.Parse(targetURL)
+	if err != nil || u.RawQuery == "" {
+		return targetURL
+	}
+	host := strings.ToLower(u.Hostname())
+	var pairs []string
+	for _, pair := range strings.Split(u.RawQuery, "&") {
+		name, _, _ := strings.Cut(pair, "=")
+		if unescaped, err := url.QueryUnescape(name); err == nil {
+			name = unescaped
+		}
+		if pair != "" && !p.ignores(host, name) {
+			pairs = append(pairs, pair)
+		}
+	}
+	u.RawQuery = strings.Join(pairs, "&")
+	return u.String()
+}
+
+func (p *cacheKeyPolicy) ignores(host, param string) bool {
+	for _, rule := range p.rules {
+		if rule.ignore != "" && rule.appliesTo(host) && strings.EqualFold(rule.ignore, param) {
+			return true
+		}
+	}
+	return false
+}
+
+// variant returns what tells the variant of a request to host apart, to
+// append to its cache key, or "" if the rules for host name nothing. API
+// keys are hashed, as cache keys are shown by /api/v1/explain and stored
+// by the Redis backend.
+func (p *cacheKeyPolicy) variant(host string, req FetchRequest) string {
+	if p == nil {
+		return ""
+	}
+	var parts []string
+	for _, rule := range p.rules {
+		if !rule.appliesTo(host) {
+			continue
+		}
+		switch {
+		case rule.header != "":
+			value := strings.Join(req.Header.Values(rule.header), ",")
+			parts = append(parts, strings.ToLower(rule.header)+"="+url.QueryEscape(value))
+		case rule.cookie != "":
+			var value string
+			if cookie, err := (&http.Request{Header: req.Header}).Cookie(rule.cookie); err == nil {
+				value = cookie.Value
+			}
+			parts = append(parts, "cookie:"+url.QueryEscape(rule.cookie)+"="+url.QueryEscape(value))
+		case rule.apiKey:
+			var value string
+			if req.APIKey != "" {
+				sum := sha256.Sum256([]byte(req.APIKey))
+				value = hex.EncodeToString(sum[:8])
+			}
+			parts = append(parts, "apikey="+value)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// cacheKeyFor returns the cache key of a GET of targetURL. Pages fetched
+// through another exit proxy may differ, e.g. by country, and are cached
+// separately, as are the variants CACHE_KEY_VARY or the CacheKeyFunc tell
+// apart by the request in ctx.
+func (s *solver) cacheKeyFor(ctx context.Context, targetURL string, proxy *FlareSolverrProxy) string {
+	key := cacheKey(http.MethodGet, s.canonical.canonicalize(s.cacheKeys.ignored(targetURL)))
+	if proxy != nil {
+		key += " via " + proxy.URL
+	}
+	req, _ := fetchRequestFrom(ctx)
+	req.URL = targetURL
+	if variant := s.cacheKeys.variant(requestHost(targetURL), req); variant != "" {
+		key += " vary " + variant
+	}
+	if s.cacheKeyFunc != nil {
+		key = s.cacheKeyFunc(key, req)
+	}
+	return key
+}
@@ -0,0 +1,81 @@
+package flareproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCacheKeyVary(t *testing.T) {
+	var solves int
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		solves++
+		json.NewEncoder(w).Encode(testResponse("<html></html>"))
+	}))
+	defer mockServer.Close()
+	t.Setenv("FLARESOLVERR_URL", mockServer.URL)
+	t.Setenv("CACHE_TTL", "1m")
+	t.Setenv("API_KEYS", "alpha,beta")
+	t.Setenv("CACHE_KEY_VARY", "header:Accept-Language,shop.example=cookie:currency,shop.example=ignore:sid,shop.example=apikey,bogus:x")
+	// The logging middleware holds the request info authorize fills in
+	handler := withRequestLogging("direct", NewDirectHandler())
+
+	get := func(path, key, language, cookie string) {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set(APIKeyHeader, key)
+		if language != "" {
+			req.Header.Set("Accept-Language", language)
+		}
+		if cookie != "" {
+			req.Header.Set("Cookie", cookie)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET %s = %d", path, w.Code)
+		}
+	}
+	tests := []struct {
+		name                    string
+		path, key, lang, cookie string
+		solved                  bool
+	}{
+		{name: "first", path: "/example.com/", key: "alpha", lang: "en", solved: true},
+		{name: "same language", path: "/example.com/", key: "beta", lang: "en"},
+		{name: "other language", path: "/example.com/", key: "alpha", lang: "de", solved: true},
+		{name: "shop", path: "/shop.example/?sid=1", key: "alpha", cookie: "currency=eur", solved: true},
+		{name: "ignored param", path: "/shop.example/?sid=2", key: "alpha", cookie: "currency=eur; other=x"},
+		{name: "other cookie", path: "/shop.example/?sid=2", key: "alpha", cookie: "currency=usd", solved: true},
+		{name: "other API key", path: "/shop.example/", key: "beta", cookie: "currency=eur", solved: true},
+		{name: "sid kept elsewhere", path: "/example.com/?sid=1", key: "alpha", lang: "en", solved: true},
+	}
+	for _, tt := range tests {
+		before := solves
+		get(tt.path, tt.key, tt.lang, tt.cookie)
+		if solved := solves > before; solved != tt.solved {
+			t.Errorf("%s: solved = %v, want %v", tt.name, solved, tt.solved)
+		}
+	}
+}
+
+func TestCacheKeyFunc(t *testing.T) {
+	t.Setenv("CACHE_TTL", "1m")
+	t.Setenv("CACHE_KEY_VARY", "header:Accept-Language")
+	srv := NewServer(Config{FlareSolverrURL: "http://localhost:1/v1"})
+	srv.SetCacheKeyFunc(func(key string, req FetchRequest) string {
+		return key + " device=" + req.Header.Get("X-Device")
+	})
+	req := httptest.NewRequest("GET", "/explain", nil)
+	req.Header.Set("Accept-Language", "fr")
+	req.Header.Set("X-Device", "mobile")
+	ctx := withFetchRequest(req.Context(), clientFetchRequest(req, FetchRequest{}))
+	key := srv.solver.cacheKeyFor(ctx, "https://example.com/?utm_source=x", nil)
+	if want := "GET https://example.com/ vary accept-language=fr device=mobile"; key != want {
+		t.Errorf("cacheKeyFor() = %q, want %q", key, want)
+	}
+	if key := srv.solver.cacheKeyFor(req.Context(), "https://example.com/", nil); !strings.HasSuffix(key, "accept-language= device=") {
+		t.Errorf("cacheKeyFor() without a request = %q", key)
+	}
+}
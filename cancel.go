@@ -0,0 +1,65 @@
+package flareproxy
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// StatusClientClosedRequest is logged for requests whose client went away
+// before the response was ready, as nginx does.
+const StatusClientClosedRequest = 499
+
+// sessionAbortTimeout bounds destroying a session after its client went
+// away.
+const sessionAbortTimeout = 10 * time.Second
+
+// maxTimeoutFor returns the maxTimeout, in milliseconds, to give
+// FlareSolverr for a request: at most maxTimeout, and no longer than ctx
+// has left, so that the browser stops when the client's deadline passes.
+func maxTimeoutFor(ctx context.Context, maxTimeout int) int {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return maxTimeout
+	}
+	left := int(time.Until(deadline).Milliseconds())
+	if maxTimeout > 0 && left >= maxTimeout {
+		return maxTimeout
+	}
+	return max(left, 1000)
+}
+
+// canceled reports whether err is due to ctx being canceled, i.e. the
+// client went away, rather than to a timeout or a failure.
+func canceled(ctx context.Context, err error) bool {
+	return errors.Is(err, context.Canceled) && errors.Is(ctx.Err(), context.Canceled)
+}
+
+// abortSession destroys a session whose request was canceled, when
+// SESSION_DESTROY_ON_CANCEL is set. FlareSolverr has no way to cancel a
+// request, so its browser keeps solving the page for nobody; destroying
+// the session stops it. Warm sessions are created again by the next
+// pre-warm round.
+func (s *solver) abortSession(session string) {
+	if !s.destroyOnCancel || session == "" {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), sessionAbortTimeout)
+		defer cancel()
+		if err := s.destroySession(ctx, session); err != nil {
+			slog.Warn("failed to destroy the session of a canceled request", "session", session, "error", err)
+			return
+		}
+		slog.Info("session of a canceled request destroyed", "session", session)
+	}()
+}
+
+// sendCanceled records that the client of r went away. Nobody reads the
+// response, but the status shows up in the access log and metrics.
+func sendCanceled(w http.ResponseWriter, r *http.Request) {
+	loggerFrom(r.Context()).Info("client went away, request canceled")
+	w.WriteHeader(StatusClientClosedRequest)
+}
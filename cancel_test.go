@@ -0,0 +1,96 @@
+package flareproxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestClientCancellation(t *testing.T) {
+	aborted := make(chan struct{}, 10)
+	destroyed := make(chan string, 10)
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req FlareSolverrRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Cmd == "sessions.destroy" {
+			destroyed <- req.Session
+			json.NewEncoder(w).Encode(FlareSolverrResponse{Status: "ok"})
+			return
+		}
+		// Solving takes until the proxy gives up
+		<-r.Context().Done()
+		aborted <- struct{}{}
+	}))
+	defer mockServer.Close()
+	t.Setenv("FLARESOLVERR_URL", mockServer.URL)
+	t.Setenv("BACKEND_MAX_FAILURES", "1")
+	t.Setenv("SESSION_DESTROY_ON_CANCEL", "true")
+
+	handler := NewDirectHandler()
+	handler.sessions.add("example.com", "warm-session", mockServer.URL)
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		req := httptest.NewRequest("GET", "/example.com/", nil).WithContext(ctx)
+		rr := httptest.NewRecorder()
+		done := make(chan struct{})
+		go func() {
+			handler.ServeHTTP(rr, req)
+			close(done)
+		}()
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("handler still waiting for FlareSolverr after the client went away")
+		}
+		select {
+		case <-aborted:
+		case <-time.After(5 * time.Second):
+			t.Fatal("FlareSolverr call was not aborted")
+		}
+		if rr.Code != StatusClientClosedRequest {
+			t.Errorf("status = %d, want %d", rr.Code, StatusClientClosedRequest)
+		}
+		if i == 0 {
+			select {
+			case session := <-destroyed:
+				if session != "warm-session" {
+					t.Errorf("destroyed session %q, want warm-session", session)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("session of the canceled request was not destroyed")
+			}
+		}
+	}
+
+	// Canceled requests say nothing about the backend's health
+	if state := handler.backends.get(mockServer.URL).State(); state != CircuitClosed {
+		t.Errorf("circuit = %s after canceled requests, want closed", state)
+	}
+	if session := handler.sessions.sessionFor("https://example.com/"); session != "" {
+		t.Errorf("destroyed session %q is still used", session)
+	}
+}
+
+func TestMaxTimeoutFor(t *testing.T) {
+	if got := maxTimeoutFor(context.Background(), 60000); got != 60000 {
+		t.Errorf("maxTimeoutFor() without deadline = %d, want 60000", got)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if got := maxTimeoutFor(ctx, 60000); got > 10000 || got < 9000 {
+		t.Errorf("maxTimeoutFor() with 10s left = %d, want about 10000", got)
+	}
+	if got := maxTimeoutFor(ctx, 5000); got != 5000 {
+		t.Errorf("maxTimeoutFor() = %d, want the shorter maxTimeout", got)
+	}
+	short, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	if got := maxTimeoutFor(short, 60000); got != 1000 {
+		t.Errorf("maxTimeoutFor() past the deadline = %d, want 1000", got)
+	}
+}
@@ -0,0 +1,86 @@
+package flareproxy
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// defaultStripParams are the tracking parameters left out of cache keys.
+// They are appended by newsletters, ads and social networks and do not
+// change the page.
+const defaultStripParams = "utm_*,fbclid,gclid,dclid,msclkid,mc_cid,mc_eid,_ga,_gl,yclid,igshid"
+
+// urlCanonicalizer rewrites URLs before they are turned into cache keys,
+// so that URLs differing only in tracking parameters or parameter order
+// share one entry and one solve. The URL sent to FlareSolverr is left as
+// requested.
+type urlCanonicalizer struct {
+	strip     map[string]bool
+	prefixes  []string // from patterns ending in *
+	sortQuery bool
+}
+
+// newURLCanonicalizerFromEnv reads CACHE_KEY_STRIP_PARAMS, a comma
+// separated list of parameter names where a trailing * matches any suffix
+// ("none" keeps all parameters), and CACHE_KEY_SORT_QUERY.
+func newURLCanonicalizerFromEnv() *urlCanonicalizer {
+	c := &urlCanonicalizer{strip: make(map[string]bool), sortQuery: envBool("CACHE_KEY_SORT_QUERY", true)}
+	params := envString("CACHE_KEY_STRIP_PARAMS", defaultStripParams)
+	if params == "none" {
+		return c
+	}
+	for _, param := range splitList(params) {
+		param = strings.ToLower(param)
+		if prefix, ok := strings.CutSuffix(param, "*"); ok {
+			c.prefixes = append(c.prefixes, prefix)
+		} else {
+			c.strip[param] = true
+		}
+	}
+	return c
+}
+
+// canonicalize returns rawURL with tracking parameters removed and, if
+// enabled, the query parameters sorted by name. Repeated parameters keep
+// their relative order, as it can matter to the origin.
+func (c *urlCanonicalizer) canonicalize(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.RawQuery == "" {
+		return rawURL
+	}
+	var pairs []string
+	for _, pair := range strings.Split(u.RawQuery, "&") {
+		if pair == "" {
+			continue
+		}
+		name, _, _ := strings.Cut(pair, "=")
+		if unescaped, err := url.QueryUnescape(name); err == nil {
+			name = unescaped
+		}
+		if !c.stripped(strings.ToLower(name)) {
+			pairs = append(pairs, pair)
+		}
+	}
+	if c.sortQuery {
+		sort.SliceStable(pairs, func(i, j int) bool {
+			a, _, _ := strings.Cut(pairs[i], "=")
+			b, _, _ := strings.Cut(pairs[j], "=")
+			return a < b
+		})
+	}
+	u.RawQuery = strings.Join(pairs, "&")
+	return u.String()
+}
+
+func (c *urlCanonicalizer) stripped(name string) bool {
+	if c.strip[name] {
+		return true
+	}
+	for _, prefix := range c.prefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
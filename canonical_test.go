@@ -0,0 +1,68 @@
+package flareproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCanonicalize(t *testing.T) {
+	tests := []struct {
+		name      string
+		strip     string
+		sortQuery string
+		url       string
+		want      string
+	}{
+		{name: "tracking parameters", url: "https://example.com/a?id=1&utm_source=x&UTM_Medium=y&fbclid=z", want: "https://example.com/a?id=1"},
+		{name: "only tracking parameters", url: "https://example.com/a?utm_source=x", want: "https://example.com/a"},
+		{name: "sorted", url: "https://example.com/a?b=2&a=1&c=3", want: "https://example.com/a?a=1&b=2&c=3"},
+		{name: "repeated keep order", url: "https://example.com/a?t=2&a=1&t=1", want: "https://example.com/a?a=1&t=2&t=1"},
+		{name: "encoding kept", url: "https://example.com/a?q=a%20b&p=%2F", want: "https://example.com/a?p=%2F&q=a%20b"},
+		{name: "no query", url: "https://example.com/a", want: "https://example.com/a"},
+		{name: "sorting disabled", sortQuery: "false", url: "https://example.com/a?b=2&a=1", want: "https://example.com/a?b=2&a=1"},
+		{name: "custom list", strip: "session, ref*", url: "https://example.com/a?session=1&referrer=x&utm_source=y", want: "https://example.com/a?utm_source=y"},
+		{name: "stripping disabled", strip: "none", url: "https://example.com/a?utm_source=y", want: "https://example.com/a?utm_source=y"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.strip != "" {
+				t.Setenv("CACHE_KEY_STRIP_PARAMS", tt.strip)
+			}
+			if tt.sortQuery != "" {
+				t.Setenv("CACHE_KEY_SORT_QUERY", tt.sortQuery)
+			}
+			if got := newURLCanonicalizerFromEnv().canonicalize(tt.url); got != tt.want {
+				t.Errorf("canonicalize(%q) = %q, want %q", tt.url, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCanonicalCacheKeys(t *testing.T) {
+	var requested []string
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req FlareSolverrRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		requested = append(requested, req.URL)
+		json.NewEncoder(w).Encode(testResponse("<html></html>"))
+	}))
+	defer mockServer.Close()
+	t.Setenv("FLARESOLVERR_URL", mockServer.URL)
+	t.Setenv("CACHE_TTL", "1m")
+	handler := NewDirectHandler()
+
+	for _, path := range []string{
+		"/Example.com/list?page=2&sort=new&utm_campaign=mail",
+		"/example.com/list?sort=new&page=2",
+		"/example.com/list?fbclid=abc&page=2&sort=new",
+	} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	// FlareSolverr gets the URL as requested, solved once
+	want := "https://Example.com/list?page=2&sort=new&utm_campaign=mail"
+	if len(requested) != 1 || requested[0] != want {
+		t.Errorf("FlareSolverr requested %v, want only %s", requested, want)
+	}
+}
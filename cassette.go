@@ -0,0 +1,191 @@
+package flareproxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CassetteBackend is the backend reported for responses replayed from
+// CASSETTE_FILE.
+const CassetteBackend = "cassette"
+
+// Cassette modes selected through CASSETTE_MODE.
+const (
+	// CassetteModeRecord fetches every request and records the response,
+	// replacing an earlier recording of the same request.
+	CassetteModeRecord = "record"
+	// CassetteModeReplay serves recorded responses only and fails
+	// requests that were not recorded, without contacting FlareSolverr.
+	CassetteModeReplay = "replay"
+	// CassetteModeAuto replays recorded responses and fetches and records
+	// the others.
+	CassetteModeAuto = "auto"
+)
+
+// errNotRecorded is returned in replay mode for requests missing from the
+// cassette.
+var errNotRecorded = errors.New("no response recorded in CASSETTE_FILE")
+
+// cassette records solved responses in a JSON file and replays them, so
+// that the integration tests of a scraper can run deterministically and
+// offline against the proxy.
+type cassette struct {
+	path string
+	mode string
+
+	mu           sync.Mutex
+	interactions map[string]cassetteInteraction // by cassetteKey
+}
+
+// cassetteInteraction is a recorded request and its response.
+type cassetteInteraction struct {
+	Cmd        string                `json:"cmd"`
+	URL        string                `json:"url"`
+	PostData   string                `json:"post_data,omitempty"`
+	RecordedAt time.Time             `json:"recorded_at"`
+	Response   *FlareSolverrResponse `json:"response"`
+}
+
+// cassetteFile is the stored form of a cassette, with the interactions
+// sorted so that recordings diff well.
+type cassetteFile struct {
+	Interactions []cassetteInteraction `json:"interactions"`
+}
+
+// newCassetteFromEnv returns the cassette in CASSETTE_FILE in
+// CASSETTE_MODE, by default auto, or nil if it is not set.
+func newCassetteFromEnv() *cassette {
+	path := os.Getenv("CASSETTE_FILE")
+	if path == "" {
+		return nil
+	}
+	mode := envString("CASSETTE_MODE", CassetteModeAuto)
+	switch mode {
+	case CassetteModeRecord, CassetteModeReplay, CassetteModeAuto:
+	default:
+		slog.Warn("unknown CASSETTE_MODE, cassette disabled", "mode", mode)
+		return nil
+	}
+	c, err := newCassette(path, mode)
+	if err != nil {
+		slog.Warn("cassette disabled", "path", path, "error", err)
+		return nil
+	}
+	return c
+}
+
+func newCassette(path, mode string) (*cassette, error) {
+	c := &cassette{path: path, mode: mode, interactions: make(map[string]cassetteInteraction)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) && mode != CassetteModeReplay {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var file cassetteFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	for _, interaction := range file.Interactions {
+		if interaction.Response != nil {
+			c.interactions[cassetteKey(interaction.Cmd, interaction.URL, interaction.PostData)] = interaction
+		}
+	}
+	return c, nil
+}
+
+// cassetteKey identifies a request in a cassette by its command, its URL,
+// normalized like cache keys, and the form body of a POST.
+func cassetteKey(cmd, targetURL, postData string) string {
+	key := cacheKey(cmd, targetURL)
+	if postData != "" {
+		sum := sha256.Sum256([]byte(postData))
+		key += " body " + hex.EncodeToString(sum[:8])
+	}
+	return key
+}
+
+// replay returns the recorded response for a request, unless the cassette
+// is recording.
+func (c *cassette) replay(cmd, targetURL, postData string) (*FlareSolverrResponse, bool) {
+	if c == nil || c.mode == CassetteModeRecord {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	interaction, ok := c.interactions[cassetteKey(cmd, targetURL, postData)]
+	return interaction.Response, ok
+}
+
+// replayOnly reports whether requests missing from the cassette fail.
+func (c *cassette) replayOnly() bool {
+	return c != nil && c.mode == CassetteModeReplay
+}
+
+// record stores the response to a request and saves the cassette.
+func (c *cassette) record(cmd, targetURL, postData string, flareResponse *FlareSolverrResponse) {
+	if c == nil || c.mode == CassetteModeReplay {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.interactions[cassetteKey(cmd, targetURL, postData)] = cassetteInteraction{
+		Cmd:        cmd,
+		URL:        targetURL,
+		PostData:   postData,
+		RecordedAt: time.Now().UTC(),
+		Response:   flareResponse,
+	}
+	keys := make([]string, 0, len(c.interactions))
+	for key := range c.interactions {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	file := cassetteFile{Interactions: make([]cassetteInteraction, 0, len(keys))}
+	for _, key := range keys {
+		file.Interactions = append(file.Interactions, c.interactions[key])
+	}
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(c.path, data)
+	}
+	if err != nil {
+		slog.Warn("failed to save cassette", "path", c.path, "error", err)
+	}
+}
+
+// fetchRecorded fetches req like fetch, but with CASSETTE_FILE set replays
+// its recorded response or records the fetched one.
+func (s *solver) fetchRecorded(ctx context.Context, req FetchRequest) (*FlareSolverrResponse, responseMeta, error) {
+	if flareResponse, ok := s.cassette.replay(req.Cmd, req.URL, req.PostData); ok {
+		info := requestInfoFrom(ctx)
+		info.Target, info.Backend = req.URL, CassetteBackend
+		meta := responseMeta{
+			Backend:   CassetteBackend,
+			URL:       req.URL,
+			Status:    solutionStatus(flareResponse, s.propagateStatus),
+			FetchedAt: flareResponse.EndTime(),
+		}
+		return flareResponse, meta, nil
+	}
+	if s.cassette.replayOnly() {
+		requestInfoFrom(ctx).Target = req.URL
+		return nil, responseMeta{}, fmt.Errorf("%w for %s %s", errNotRecorded, strings.TrimPrefix(req.Cmd, "request."), req.URL)
+	}
+	flareResponse, meta, err := s.fetch(withFetchRequest(ctx, req), req.Cmd, req.URL)
+	if err == nil {
+		s.cassette.record(req.Cmd, req.URL, req.PostData, flareResponse)
+	}
+	return flareResponse, meta, err
+}
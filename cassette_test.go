@@ -0,0 +1,74 @@
+package flareproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCassette(t *testing.T) {
+	var solves int
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req FlareSolverrRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		solves++
+		json.NewEncoder(w).Encode(testResponse("<html>" + req.URL + "</html>"))
+	}))
+	defer mockServer.Close()
+	path := filepath.Join(t.TempDir(), "cassette.json")
+	t.Setenv("CASSETTE_FILE", path)
+
+	get := func(handler http.Handler, target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/"+target, nil))
+		return w
+	}
+
+	// Recording fetches every request
+	t.Setenv("FLARESOLVERR_URL", mockServer.URL)
+	t.Setenv("CASSETTE_MODE", CassetteModeRecord)
+	recorder := NewDirectHandler()
+	for range 2 {
+		if w := get(recorder, "example.com/a"); w.Code != http.StatusOK {
+			t.Fatalf("recording: status %d", w.Code)
+		}
+	}
+	if solves != 2 {
+		t.Errorf("recording solved %d times, want 2", solves)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil || !strings.Contains(string(data), `"url": "https://example.com/a"`) {
+		t.Fatalf("cassette = %s, %v", data, err)
+	}
+
+	// Replaying does not contact FlareSolverr
+	t.Setenv("FLARESOLVERR_URL", "http://127.0.0.1:1/v1")
+	t.Setenv("CASSETTE_MODE", CassetteModeReplay)
+	player := NewDirectHandler()
+	w := get(player, "example.com/a")
+	if w.Code != http.StatusOK || w.Body.String() != "<html>https://example.com/a</html>" || w.Header().Get(TrailerBackend) != CassetteBackend {
+		t.Errorf("replay = %d %q from %q", w.Code, w.Body.String(), w.Header().Get(TrailerBackend))
+	}
+	if w := get(player, "example.com/b"); w.Code != http.StatusBadGateway || !strings.Contains(w.Body.String(), "no response recorded") {
+		t.Errorf("replay of an unrecorded page = %d %s, want 502", w.Code, w.Body.String())
+	}
+
+	// Auto mode records what it has not seen
+	t.Setenv("FLARESOLVERR_URL", mockServer.URL)
+	t.Setenv("CASSETTE_MODE", CassetteModeAuto)
+	auto := NewDirectHandler()
+	get(auto, "example.com/a")
+	get(auto, "example.com/b")
+	get(auto, "example.com/b")
+	if solves != 3 {
+		t.Errorf("auto mode solved %d times, want 3", solves)
+	}
+	cassette, err := newCassette(path, CassetteModeReplay)
+	if err != nil || len(cassette.interactions) != 2 {
+		t.Errorf("cassette holds %d interactions, %v; want 2", len(cassette.interactions), err)
+	}
+}
@@ -0,0 +1,399 @@
+package flareproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ClearanceCookie is the cookie Cloudflare sets once a challenge is passed.
+const ClearanceCookie = "cf_clearance"
+
+// Clearance store backends selected through CLEARANCE_STORE.
+const (
+	ClearanceStoreMemory = "memory"
+	ClearanceStoreFile   = "file"
+	ClearanceStoreRedis  = "redis"
+)
+
+// clearance is what a solve yields for reuse: the cookies, including
+// cf_clearance, and the User-Agent they are bound to.
+type clearance struct {
+	Cookies   []Cookie  `json:"cookies"`
+	UserAgent string    `json:"user_agent"`
+	Expires   time.Time `json:"expires"`
+}
+
+// clearanceBackend persists clearances so they survive restarts and, for
+// Redis, are shared between replicas.
+type clearanceBackend interface {
+	load(host string) (clearance, bool)
+	store(host string, c clearance)
+	remove(host string)
+}
+
+// clearanceStore keeps the clearance per host for FETCH_MODE=reuse. It is
+// backed by an optional clearanceBackend; hosts missing in memory are
+// looked up there, so clearances solved by another replica are used too.
+type clearanceStore struct {
+	ttl     time.Duration
+	now     func() time.Time
+	backend clearanceBackend
+	// sync keeps the cookies origins set on direct fetches, see merge.
+	sync bool
+
+	mu     sync.Mutex
+	byHost map[string]clearance
+	// synced are the cookies set on direct fetches since the host was
+	// last solved, for the next solve to hand to the browser.
+	synced map[string][]Cookie
+}
+
+// newClearanceStoreFromEnv reads CLEARANCE_TTL, the lifetime assumed for
+// clearance cookies without an expiry of their own, CLEARANCE_STORE and
+// COOKIE_SYNC.
+func newClearanceStoreFromEnv() *clearanceStore {
+	c := newClearanceStore(envDuration("CLEARANCE_TTL", 30*time.Minute))
+	c.sync = envBool("COOKIE_SYNC", true)
+	switch store := envString("CLEARANCE_STORE", ClearanceStoreMemory); store {
+	case ClearanceStoreMemory:
+	case ClearanceStoreFile:
+		path := os.Getenv("CLEARANCE_FILE")
+		if path == "" {
+			path = filepath.Join(os.TempDir(), "flareproxygo-clearances.json")
+		}
+		backend, err := newClearanceFile(path)
+		if err != nil {
+			slog.Warn("clearance file disabled, keeping clearances in memory", "path", path, "error", err)
+			break
+		}
+		c.backend = backend
+	case ClearanceStoreRedis:
+		client, err := newRedisClient(os.Getenv("REDIS_URL"))
+		if err != nil {
+			slog.Warn("redis clearance store disabled, keeping clearances in memory", "error", err)
+			break
+		}
+		c.backend = newClearanceRedis(client)
+	default:
+		slog.Warn("unknown CLEARANCE_STORE, keeping clearances in memory", "store", store)
+	}
+	return c
+}
+
+func newClearanceStore(ttl time.Duration) *clearanceStore {
+	return &clearanceStore{
+		ttl:    ttl,
+		now:    time.Now,
+		byHost: make(map[string]clearance),
+		synced: make(map[string][]Cookie),
+	}
+}
+
+// get returns the unexpired clearance for host.
+func (c *clearanceStore) get(host string) (clearance, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cl, ok := c.byHost[host]
+	if !ok && c.backend != nil {
+		cl, ok = c.backend.load(host)
+	}
+	if ok && !c.now().Before(cl.Expires) {
+		delete(c.byHost, host)
+		return clearance{}, false
+	}
+	if ok {
+		c.byHost[host] = cl
+	}
+	return cl, ok
+}
+
+// put stores the clearance from a solve of targetURL. Solutions without a
+// cf_clearance cookie are not stored, as the domain needs no clearance or
+// the challenge was not passed.
+func (c *clearanceStore) put(targetURL string, flareResponse *FlareSolverrResponse) {
+	u, err := url.Parse(targetURL)
+	if err != nil {
+		return
+	}
+	var expires time.Time
+	found := false
+	for _, cookie := range flareResponse.Solution.Cookies {
+		if cookie.Name != ClearanceCookie {
+			continue
+		}
+		found = true
+		expires = c.now().Add(c.ttl)
+		if !cookie.Session && cookie.Expires > 0 {
+			expires = time.Unix(int64(cookie.Expires), 0)
+		}
+	}
+
+	host := strings.ToLower(u.Hostname())
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// The browser that solved the host was handed the synced cookies
+	delete(c.synced, host)
+	if !found || flareResponse.Solution.UserAgent == "" {
+		return
+	}
+	cl := clearance{
+		Cookies:   flareResponse.Solution.Cookies,
+		UserAgent: flareResponse.Solution.UserAgent,
+		Expires:   expires,
+	}
+	c.byHost[host] = cl
+	if c.backend != nil {
+		c.backend.store(host, cl)
+	}
+	slog.Info("clearance stored for reuse", "host", host, "expires", expires.UTC().Format(time.RFC3339))
+}
+
+// merge adds the cookies an origin set on a direct fetch or download from
+// host with its clearance to the clearance, replacing and deleting
+// cookies of the same name and path, so that e.g. a login made on the
+// direct path is kept on later fetches. They are also kept for the next
+// solve of the host, which passes them to FlareSolverr's browser, so that
+// the login survives a new challenge. It does nothing unless COOKIE_SYNC
+// is enabled.
+func (c *clearanceStore) merge(host string, cookies []Cookie) {
+	if !c.sync || len(cookies) == 0 {
+		return
+	}
+	cookies = append([]Cookie(nil), cookies...)
+	for i := range cookies {
+		if cookies[i].Domain == "" {
+			cookies[i].Domain = host
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	c.synced[host] = mergeCookies(c.synced[host], cookies, now)
+	if cl, ok := c.byHost[host]; ok {
+		cl.Cookies = mergeCookies(cl.Cookies, cookies, now)
+		c.byHost[host] = cl
+		if c.backend != nil {
+			c.backend.store(host, cl)
+		}
+	}
+}
+
+// syncedCookies returns the cookies set on direct fetches from host since
+// it was last solved.
+func (c *clearanceStore) syncedCookies(host string) []Cookie {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.synced[host]
+}
+
+// mergeCookies returns jar with cookies set in it. Cookies that expired,
+// which is how origins delete them, are removed instead.
+func mergeCookies(jar, cookies []Cookie, now time.Time) []Cookie {
+	merged := make([]Cookie, 0, len(jar)+len(cookies))
+	for _, kept := range jar {
+		replaced := false
+		for _, cookie := range cookies {
+			replaced = replaced || sameCookie(kept, cookie)
+		}
+		if !replaced {
+			merged = append(merged, kept)
+		}
+	}
+	for _, cookie := range cookies {
+		if cookie.Session || cookie.Expires > float64(now.Unix()) {
+			merged = append(merged, cookie)
+		}
+	}
+	return merged
+}
+
+// sameCookie reports whether a and b are the same cookie. Domains are
+// not compared, as a cookie the solver saw for ".example.com" comes back
+// from the origin without one.
+func sameCookie(a, b Cookie) bool {
+	pathA, pathB := a.Path, b.Path
+	if pathA == "" {
+		pathA = "/"
+	}
+	if pathB == "" {
+		pathB = "/"
+	}
+	return a.Name == b.Name && pathA == pathB
+}
+
+// drop forgets the clearance for host, e.g. when a challenge reappears.
+func (c *clearanceStore) drop(host string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.byHost[host]; ok {
+		delete(c.byHost, host)
+		slog.Info("clearance no longer accepted, solving again", "host", host)
+	}
+	if c.backend != nil {
+		c.backend.remove(host)
+	}
+}
+
+// adminClearance describes a stored clearance in the admin API. Cookie
+// values are left out, as they grant access to the site.
+type adminClearance struct {
+	Host      string        `json:"host"`
+	UserAgent string        `json:"user_agent"`
+	Expires   time.Time     `json:"expires"`
+	Cookies   []adminCookie `json:"cookies"`
+}
+
+type adminCookie struct {
+	Name    string     `json:"name"`
+	Domain  string     `json:"domain"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// list describes the unexpired clearances held in memory, sorted by host.
+// Clearances only in the backend are loaded on first use and not listed.
+func (c *clearanceStore) list() []adminClearance {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	clearances := make([]adminClearance, 0, len(c.byHost))
+	for host, cl := range c.byHost {
+		if !now.Before(cl.Expires) {
+			continue
+		}
+		entry := adminClearance{Host: host, UserAgent: cl.UserAgent, Expires: cl.Expires, Cookies: []adminCookie{}}
+		for _, cookie := range cl.Cookies {
+			described := adminCookie{Name: cookie.Name, Domain: cookie.Domain}
+			if !cookie.Session && cookie.Expires > 0 {
+				expires := time.Unix(int64(cookie.Expires), 0).UTC()
+				described.Expires = &expires
+			}
+			entry.Cookies = append(entry.Cookies, described)
+		}
+		clearances = append(clearances, entry)
+	}
+	sort.Slice(clearances, func(i, j int) bool { return clearances[i].Host < clearances[j].Host })
+	return clearances
+}
+
+// clearanceFile keeps clearances in a JSON file, which is rewritten
+// atomically on every change. Clearances change rarely, at most once per
+// solve, so this is cheap.
+type clearanceFile struct {
+	path string
+
+	mu      sync.Mutex
+	entries map[string]clearance
+}
+
+func newClearanceFile(path string) (*clearanceFile, error) {
+	f := &clearanceFile{path: path, entries: make(map[string]clearance)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &f.entries); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *clearanceFile) load(host string) (clearance, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	cl, ok := f.entries[host]
+	return cl, ok
+}
+
+func (f *clearanceFile) store(host string, c clearance) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.entries[host] = c
+	f.save()
+}
+
+func (f *clearanceFile) remove(host string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.entries[host]; ok {
+		delete(f.entries, host)
+		f.save()
+	}
+}
+
+// save writes the file, dropping expired clearances. f.mu must be held.
+func (f *clearanceFile) save() {
+	now := time.Now()
+	for host, c := range f.entries {
+		if !now.Before(c.Expires) {
+			delete(f.entries, host)
+		}
+	}
+	data, err := json.Marshal(f.entries)
+	if err == nil {
+		err = writeFileAtomic(f.path, data)
+	}
+	if err != nil {
+		slog.Warn("failed to save clearances", "path", f.path, "error", err)
+	}
+}
+
+// clearanceRedis keeps clearances in Redis, expiring with their cookie.
+type clearanceRedis struct {
+	client *redisClient
+	prefix string
+}
+
+func newClearanceRedis(client *redisClient) *clearanceRedis {
+	return &clearanceRedis{client: client, prefix: "flareproxygo:clearance:"}
+}
+
+func (r *clearanceRedis) load(host string) (clearance, bool) {
+	reply, err := r.client.Do("GET", r.prefix+host)
+	if err != nil {
+		if !errors.Is(err, errRedisNil) {
+			slog.Warn("redis clearance read failed", "error", err)
+		}
+		return clearance{}, false
+	}
+	data, ok := reply.(string)
+	if !ok {
+		return clearance{}, false
+	}
+	var c clearance
+	if err := json.Unmarshal([]byte(data), &c); err != nil {
+		return clearance{}, false
+	}
+	return c, true
+}
+
+func (r *clearanceRedis) store(host string, c clearance) {
+	ttl := time.Until(c.Expires)
+	if ttl <= 0 {
+		return
+	}
+	data, err := json.Marshal(c)
+	if err != nil {
+		return
+	}
+	if _, err := r.client.Do("SET", r.prefix+host, string(data), "PX", strconv.FormatInt(ttl.Milliseconds(), 10)); err != nil {
+		slog.Warn("redis clearance write failed", "error", err)
+	}
+}
+
+func (r *clearanceRedis) remove(host string) {
+	if _, err := r.client.Do("DEL", r.prefix+host); err != nil {
+		slog.Warn("redis clearance delete failed", "error", err)
+	}
+}
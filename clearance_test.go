@@ -0,0 +1,237 @@
+package flareproxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestClearanceStore(t *testing.T) {
+	now := time.Now()
+	c := newClearanceStore(time.Minute)
+	c.now = func() time.Time { return now }
+
+	solved := func(cookies ...Cookie) *FlareSolverrResponse {
+		r := testResponse("<html></html>")
+		r.Solution.Cookies = cookies
+		r.Solution.UserAgent = "TestUA/1.0"
+		return r
+	}
+	c.put("https://plain.example/", solved(Cookie{Name: "other", Value: "1"}))
+	if _, ok := c.get("plain.example"); ok {
+		t.Error("solution without cf_clearance stored")
+	}
+
+	c.put("https://Session.example/", solved(Cookie{Name: ClearanceCookie, Value: "a", Session: true, Expires: -1}))
+	c.put("https://expiring.example/", solved(Cookie{Name: ClearanceCookie, Value: "b", Expires: float64(now.Add(time.Hour).Unix())}))
+	now = now.Add(2 * time.Minute)
+	if _, ok := c.get("session.example"); ok {
+		t.Error("session clearance outlived CLEARANCE_TTL")
+	}
+	cl, ok := c.get("expiring.example")
+	if !ok || cl.UserAgent != "TestUA/1.0" || len(cl.Cookies) != 1 {
+		t.Errorf("get(expiring.example) = %+v, %v", cl, ok)
+	}
+	now = now.Add(time.Hour)
+	if _, ok := c.get("expiring.example"); ok {
+		t.Error("clearance used past the cookie's expiry")
+	}
+}
+
+func TestCookieReuseMode(t *testing.T) {
+	var mu sync.Mutex
+	accepted := "first"
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		cookie, err := r.Cookie(ClearanceCookie)
+		if err != nil || cookie.Value != accepted || r.UserAgent() != "TestUA/1.0" {
+			w.Header().Set("cf-mitigated", "challenge")
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte("<html>direct</html>"))
+	}))
+	defer origin.Close()
+
+	var solves int
+	flareSolverr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		solves++
+		response := testResponse("<html>solved</html>")
+		response.Solution.Cookies = []Cookie{{Name: ClearanceCookie, Value: accepted, Session: true}}
+		response.Solution.UserAgent = "TestUA/1.0"
+		json.NewEncoder(w).Encode(response)
+	}))
+	defer flareSolverr.Close()
+	t.Setenv("FLARESOLVERR_URL", flareSolverr.URL)
+	t.Setenv("FETCH_MODE", "reuse")
+
+	s := newSolver()
+	fetch := func(wantBody string, wantSolves int) {
+		t.Helper()
+		flareResponse, _, err := s.fetch(context.Background(), "request.get", origin.URL+"/page")
+		if err != nil {
+			t.Fatalf("fetch() error = %v", err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if flareResponse.Solution.Response != wantBody || solves != wantSolves {
+			t.Errorf("fetch() = %q after %d solves, want %q after %d",
+				flareResponse.Solution.Response, solves, wantBody, wantSolves)
+		}
+	}
+
+	// The first request is solved, the following reuse the clearance
+	fetch("<html>solved</html>", 1)
+	fetch("<html>direct</html>", 1)
+	fetch("<html>direct</html>", 1)
+
+	// Once the origin challenges again, the page is solved anew
+	mu.Lock()
+	accepted = "second"
+	mu.Unlock()
+	fetch("<html>solved</html>", 2)
+	fetch("<html>direct</html>", 2)
+}
+
+func TestCookieSync(t *testing.T) {
+	var mu sync.Mutex
+	accepted := "first"
+	var originCookies []string
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if cookie, err := r.Cookie(ClearanceCookie); err != nil || cookie.Value != accepted {
+			w.Header().Set("cf-mitigated", "challenge")
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		originCookies = nil
+		for _, c := range r.Cookies() {
+			originCookies = append(originCookies, c.Name+"="+c.Value)
+		}
+		switch r.URL.Path {
+		case "/login":
+			http.SetCookie(w, &http.Cookie{Name: "login", Value: "alice"})
+			http.SetCookie(w, &http.Cookie{Name: "tracking", MaxAge: -1})
+		case "/logout":
+			http.SetCookie(w, &http.Cookie{Name: "login", MaxAge: -1})
+		}
+		w.Write([]byte("<html>direct</html>"))
+	}))
+	defer origin.Close()
+
+	var solved []FlareSolverrRequest
+	flareSolverr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		var req FlareSolverrRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		solved = append(solved, req)
+		response := testResponse("<html>solved</html>")
+		response.Solution.Cookies = append(req.Cookies,
+			Cookie{Name: ClearanceCookie, Value: accepted, Session: true},
+			Cookie{Name: "tracking", Value: "1", Session: true})
+		response.Solution.UserAgent = "TestUA/1.0"
+		json.NewEncoder(w).Encode(response)
+	}))
+	defer flareSolverr.Close()
+	t.Setenv("FLARESOLVERR_URL", flareSolverr.URL)
+	t.Setenv("FETCH_MODE", "reuse")
+
+	s := newSolver()
+	fetch := func(path string) []string {
+		t.Helper()
+		if _, _, err := s.fetch(context.Background(), "request.get", origin.URL+path); err != nil {
+			t.Fatalf("fetch(%s) error = %v", path, err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		return originCookies
+	}
+
+	fetch("/")
+	fetch("/login")
+	if got := fetch("/page"); strings.Join(got, ";") != ClearanceCookie+"=first;login=alice" {
+		t.Errorf("direct fetch after login sent %v, want the clearance and login", got)
+	}
+
+	// A new challenge is solved with the login in the browser
+	mu.Lock()
+	accepted = "second"
+	mu.Unlock()
+	fetch("/page")
+	if len(solved) != 2 || len(solved[1].Cookies) != 1 || solved[1].Cookies[0].Name != "login" {
+		t.Fatalf("second solve got cookies %+v, want the login", solved[len(solved)-1].Cookies)
+	}
+	fetch("/logout")
+	if got := fetch("/page"); strings.Join(got, ";") != ClearanceCookie+"=second;tracking=1" {
+		t.Errorf("direct fetch after logout sent %v", got)
+	}
+}
+
+func TestClearancePersistence(t *testing.T) {
+	solved := testResponse("<html></html>")
+	solved.Solution.Cookies = []Cookie{{Name: ClearanceCookie, Value: "abc", Expires: float64(time.Now().Add(time.Hour).Unix())}}
+	solved.Solution.UserAgent = "TestUA/1.0"
+
+	tests := []struct {
+		name    string
+		backend func(t *testing.T) func() clearanceBackend
+	}{
+		{
+			name: "file",
+			backend: func(t *testing.T) func() clearanceBackend {
+				path := filepath.Join(t.TempDir(), "clearances.json")
+				return func() clearanceBackend {
+					f, err := newClearanceFile(path)
+					if err != nil {
+						t.Fatalf("newClearanceFile() error = %v", err)
+					}
+					return f
+				}
+			},
+		},
+		{
+			name: "redis",
+			backend: func(t *testing.T) func() clearanceBackend {
+				client, err := newRedisClient(newFakeRedis(t, "").URL())
+				if err != nil {
+					t.Fatal(err)
+				}
+				return func() clearanceBackend { return newClearanceRedis(client) }
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newBackend := tt.backend(t)
+			first := newClearanceStore(time.Minute)
+			first.backend = newBackend()
+			first.put("https://example.com/", solved)
+
+			// A restarted process or another replica finds the clearance
+			second := newClearanceStore(time.Minute)
+			second.backend = newBackend()
+			cl, ok := second.get("example.com")
+			if !ok || cl.UserAgent != "TestUA/1.0" || len(cl.Cookies) != 1 || cl.Cookies[0].Value != "abc" {
+				t.Fatalf("get() = %+v, %v, want the stored clearance", cl, ok)
+			}
+
+			second.drop("example.com")
+			third := newClearanceStore(time.Minute)
+			third.backend = newBackend()
+			if _, ok := third.get("example.com"); ok {
+				t.Error("dropped clearance still stored")
+			}
+		})
+	}
+}
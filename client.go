@@ -0,0 +1,112 @@
+package flareproxy
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Client fetches pages through FlareSolverr with the proxy's caching,
+// sessions, retries, rate limits and fetch mode, for Go programs that
+// embed the proxy instead of running it.
+type Client struct {
+	solver *solver
+}
+
+// NewClient creates a client for the FlareSolverr instances at
+// flareSolverrURL, a comma separated list, configured from the
+// environment otherwise. An empty URL uses FLARESOLVERR_URL.
+func NewClient(flareSolverrURL string) *Client {
+	if flareSolverrURL == "" {
+		return &Client{solver: newSolver()}
+	}
+	return &Client{solver: newSolverFor(Config{FlareSolverrURL: flareSolverrURL})}
+}
+
+// Get fetches targetURL and returns the solution, with the page, its
+// status, cookies and the User-Agent they are bound to.
+func (c *Client) Get(ctx context.Context, targetURL string) (*FlareSolverrResponse, error) {
+	result, err := c.solver.process(ctx, FetchRequest{Cmd: "request.get", URL: targetURL})
+	if err != nil {
+		return nil, err
+	}
+	return result.Response, nil
+}
+
+// Close destroys the FlareSolverr sessions the client created.
+func (c *Client) Close(ctx context.Context) {
+	c.solver.destroySessions(ctx)
+}
+
+// FetchCommand implements the fetch command, which solves a single page
+// through FLARESOLVERR_URL without running the server:
+//
+//	flareproxy fetch [-data form] [-timeout 90s] [-cookies-only] <url>
+//
+// It prints the page, or with -cookies-only its cookies as a Cookie
+// header value, to stdout. Pages the origin answered with an error status
+// are printed as well, but fail the command.
+func FetchCommand(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("fetch", flag.ContinueOnError)
+	flareSolverrURL := flags.String("flaresolverr", envString("FLARESOLVERR_URL", DefaultFlareSolverrURL), "FlareSolverr endpoint, or a comma separated list")
+	data := flags.String("data", "", "application/x-www-form-urlencoded body to POST instead of a GET")
+	timeout := flags.Duration("timeout", 0, "time FlareSolverr is given to solve the page")
+	cookiesOnly := flags.Bool("cookies-only", false, "print the cookies instead of the page")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	// Flags may also follow the URL
+	target := flags.Arg(0)
+	if err := flags.Parse(flags.Args()[min(1, flags.NArg()):]); err != nil {
+		return err
+	}
+	if target == "" || flags.NArg() > 0 {
+		return errors.New("usage: fetch [flags] <url>")
+	}
+	if !strings.Contains(target, "://") {
+		target = "https://" + target
+	}
+	if u, err := url.Parse(target); err == nil && u.Path == "" {
+		u.Path = "/"
+		target = u.String()
+	}
+
+	s := newSolverFor(Config{FlareSolverrURL: *flareSolverrURL})
+	defer s.destroySessions(context.Background())
+	ctx := backgroundContext(context.Background(), "fetch")
+	if *timeout > 0 {
+		ctx = context.WithValue(ctx, requestOptionsKey, requestOptions{Timeout: *timeout})
+	}
+	req := FetchRequest{Cmd: "request.get", URL: target}
+	if *data != "" {
+		req.Cmd, req.PostData = "request.post", *data
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Minute)
+	defer cancel()
+	result, err := s.process(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	solution := result.Response.Solution
+	output := solution.Response
+	if *cookiesOnly {
+		cookies := make([]string, len(solution.Cookies))
+		for i, c := range solution.Cookies {
+			cookies[i] = c.Name + "=" + c.Value
+		}
+		output = strings.Join(cookies, "; ") + "\n"
+	}
+	if _, err := io.WriteString(stdout, output); err != nil {
+		return err
+	}
+	if solution.Status >= 400 {
+		return fmt.Errorf("%s answered %d", target, solution.Status)
+	}
+	return nil
+}
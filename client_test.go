@@ -0,0 +1,54 @@
+package flareproxy
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kljensen/flareproxygo/flaresolverr"
+	"github.com/kljensen/flareproxygo/flaresolverr/flaresolverrtest"
+)
+
+func TestFetchCommand(t *testing.T) {
+	fs := flaresolverrtest.NewServer()
+	defer fs.Close()
+	fs.SetPage("https://example.com/", flaresolverrtest.Page{Body: "<html>hello</html>", Challenge: true})
+	fs.SetPage("https://example.com/gone", flaresolverrtest.Page{Status: 404, Body: "<html>gone</html>"})
+	fs.SetPage("https://example.com/login", flaresolverrtest.Page{Cookies: []flaresolverr.Cookie{{Name: "session", Value: "s1"}}})
+	t.Setenv("FLARESOLVERR_URL", fs.Endpoint())
+
+	tests := []struct {
+		name    string
+		args    []string
+		want    string
+		wantErr string
+	}{
+		{name: "page", args: []string{"example.com"}, want: "<html>hello</html>"},
+		{name: "cookies", args: []string{"https://example.com/login", "-cookies-only"}, want: "session=s1\n"},
+		{name: "error status", args: []string{"https://example.com/gone"}, want: "<html>gone</html>", wantErr: "answered 404"},
+		{name: "no url", args: []string{"-cookies-only"}, wantErr: "usage"},
+		{name: "two urls", args: []string{"https://a.example/", "https://b.example/"}, wantErr: "usage"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			err := FetchCommand(tt.args, &out)
+			if (err == nil) != (tt.wantErr == "") || (err != nil && !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("FetchCommand() error = %v, want %q", err, tt.wantErr)
+			}
+			if out.String() != tt.want {
+				t.Errorf("output = %q, want %q", out.String(), tt.want)
+			}
+		})
+	}
+
+	var out bytes.Buffer
+	if err := FetchCommand([]string{"-data", "user=me", "-timeout", "90s", "https://example.com/login"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	requests := fs.Requests()
+	if got := requests[len(requests)-1]; got.Cmd != flaresolverr.CmdRequestPost || got.PostData != "user=me" || got.MaxTimeout != int((90*time.Second).Milliseconds()) {
+		t.Errorf("request = %+v, want a POST of the form with a 90s limit", got)
+	}
+}
@@ -0,0 +1,104 @@
+// Command flareproxygo runs the FlareSolverr adapter: a direct routing
+// server, and optionally an HTTP proxy, a SOCKS5 front-end and an admin
+// API, configured through environment variables or a config file.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	flareproxy "github.com/kljensen/flareproxygo"
+)
+
+func main() {
+	selfTestOnly := flag.Bool("selftest", false, "run the startup self-test, print a JSON report and exit")
+	configPath := flag.String("config", os.Getenv("CONFIG_FILE"), "TOML or JSON config file; environment variables take precedence")
+	applyFlags := flareproxy.ConfigFlags(flag.CommandLine)
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags]\n       %s self-update [--check] [--version vX.Y.Z] [--insecure]\n       %s state export|import [flags] [file]\n       %s fetch [-cookies-only] [-data form] [-timeout 90s] <url>\n", os.Args[0], os.Args[0], os.Args[0], os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	// Flags override the environment, which overrides the config file
+	if err := applyFlags(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	// Replace the binary with the latest release and exit
+	if flag.Arg(0) == "self-update" {
+		flareproxy.SetupLogging()
+		if err := flareproxy.SelfUpdate(flag.Args()[1:], os.Stdout); err != nil {
+			slog.Error("self-update failed", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Copy the state of a running proxy from or to an archive and exit
+	if flag.Arg(0) == "state" {
+		flareproxy.SetupLogging()
+		if err := flareproxy.StateCommand(flag.Args()[1:], os.Stdin, os.Stdout); err != nil {
+			slog.Error("state "+flag.Arg(1)+" failed", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Load the config file first, as it may configure logging
+	configErr := flareproxy.LoadConfigFile(*configPath)
+	flareproxy.SetupLogging()
+	if configErr != nil {
+		slog.Error("failed to load config file", "error", configErr)
+		os.Exit(1)
+	}
+
+	// Solve a single page, print it and exit
+	if flag.Arg(0) == "fetch" {
+		if err := flareproxy.FetchCommand(flag.Args()[1:], os.Stdout); err != nil {
+			slog.Error("fetch failed", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	cfg := flareproxy.ConfigFromEnv()
+	cfg.ConfigFile = *configPath
+	slog.Info("FlareSolverr configured", "url", cfg.FlareSolverrURL)
+	server := flareproxy.NewServer(cfg)
+
+	if *selfTestOnly || cfg.SelfTest {
+		if !server.SelfTest(context.Background(), os.Stdout) {
+			slog.Error("self-test failed")
+			os.Exit(1)
+		}
+		if *selfTestOnly {
+			return
+		}
+	}
+
+	// Reload the config file on SIGHUP
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := server.Reload(); err != nil {
+				slog.Error("config reload failed", "error", err)
+			}
+		}
+	}()
+
+	// Run until SIGINT or SIGTERM, then shut down gracefully
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := server.Run(ctx); err != nil {
+		slog.Error("server failed", "error", err)
+		os.Exit(1)
+	}
+	slog.Info("shutdown complete")
+}
@@ -0,0 +1,57 @@
+package flareproxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"log/slog"
+	"os"
+)
+
+// Compression codecs accepted by CACHE_COMPRESSION.
+const (
+	CompressionGzip = "gzip"
+	CompressionNone = "none"
+)
+
+// cacheCompressionFromEnv reports whether cached entries written to disk
+// or Redis should be compressed. HTML compresses five to ten times, so
+// this is on by default.
+func cacheCompressionFromEnv() bool {
+	switch codec := os.Getenv("CACHE_COMPRESSION"); codec {
+	case "", CompressionGzip:
+		return true
+	case CompressionNone:
+		return false
+	default:
+		slog.Warn("unsupported CACHE_COMPRESSION", "codec", codec, "using", CompressionGzip)
+		return true
+	}
+}
+
+// compressEntry gzips a serialized cache entry if compress is set.
+func compressEntry(data []byte, compress bool) []byte {
+	if !compress {
+		return data
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(data)
+	zw.Close()
+	return buf.Bytes()
+}
+
+// decompressEntry returns a serialized cache entry. Compressed entries are
+// recognized by the gzip magic number, so entries written before
+// compression was enabled or disabled stay readable.
+func decompressEntry(data []byte) ([]byte, error) {
+	if len(data) < 2 || data[0] != 0x1f || data[1] != 0x8b {
+		return data, nil
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return io.ReadAll(zr)
+}
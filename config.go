@@ -0,0 +1,77 @@
+package flareproxy
+
+import (
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+)
+
+// envBool returns the boolean value of the environment variable name, or
+// def when it is unset or cannot be parsed.
+func envBool(name string, def bool) bool {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		slog.Warn("ignoring invalid boolean", "name", name, "value", value)
+		return def
+	}
+	return b
+}
+
+// envDuration returns the duration value (e.g. "250ms") of the environment
+// variable name, or def when it is unset or cannot be parsed.
+func envDuration(name string, def time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		slog.Warn("ignoring invalid duration", "name", name, "value", value)
+		return def
+	}
+	return d
+}
+
+// envInt returns the integer value of the environment variable name, or
+// def when it is unset or cannot be parsed.
+func envInt(name string, def int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		slog.Warn("ignoring invalid integer", "name", name, "value", value)
+		return def
+	}
+	return i
+}
+
+// envString returns the value of the environment variable name, or def
+// when it is unset.
+func envString(name, def string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return def
+}
+
+// envFloat returns the floating point value of the environment variable
+// name, or def when it is unset or cannot be parsed.
+func envFloat(name string, def float64) float64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		slog.Warn("ignoring invalid number", "name", name, "value", value)
+		return def
+	}
+	return f
+}
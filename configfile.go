@@ -0,0 +1,276 @@
+package flareproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The proxy is configured through environment variables. A config file
+// (TOML, or JSON when the name ends in .json) is an alternative way to set
+// the same variables: every key maps to the variable of the same name, so
+//
+//	port = 8080
+//	[cache]
+//	ttl = "10m"
+//
+// sets PORT and CACHE_TTL. Variables already set in the environment take
+// precedence over the file, which suits container deployments where a few
+// settings are overridden per instance.
+
+// configAliases maps keys whose variable name differs from the key path.
+var configAliases = map[string]string{
+	"flaresolverr.urls": "FLARESOLVERR_URL",
+	"rate_limit.rate":   "RATE_LIMIT",
+}
+
+// configSections maps tables whose variables use a shorter prefix.
+var configSections = map[string]string{
+	"user_agent": "UA",
+}
+
+// configRuleTables maps tables of per-domain rules to the variable holding
+// them as a "domain=value,..." list.
+var configRuleTables = map[string]string{
+	"rate_limit.domains": "RATE_LIMIT_DOMAINS",
+	"user_agent.domains": "UA_DOMAIN_STRATEGIES",
+}
+
+// configRuleSets maps tables of per-domain tables of options to the
+// variable holding them as "domain key=value ...; ..." rules.
+var configRuleSets = map[string]string{
+	"rules": "DOMAIN_RULES",
+}
+
+// configListSeparators overrides the "," used to join array values.
+var configListSeparators = map[string]string{
+	"UA_LIST": "|",
+}
+
+// readConfigFile reads a config file and returns the environment
+// variables it sets.
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var tree map[string]interface{}
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		err = json.Unmarshal(data, &tree)
+	} else {
+		tree, err = parseTOML(string(data))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	settings := make(map[string]string)
+	if err := flattenConfig(nil, tree, settings); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return settings, nil
+}
+
+func flattenConfig(path []string, value interface{}, settings map[string]string) error {
+	key := strings.Join(path, ".")
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if name, ok := configRuleSets[key]; ok {
+			return flattenRuleSet(key, name, v, settings)
+		}
+		if name, ok := configRuleTables[key]; ok {
+			rules := make([]string, 0, len(v))
+			for domain, rule := range v {
+				s, err := configScalar(rule)
+				if err != nil {
+					return fmt.Errorf("%s.%s: %v", key, domain, err)
+				}
+				rules = append(rules, domain+"="+s)
+			}
+			sort.Strings(rules)
+			settings[name] = strings.Join(rules, ",")
+			return nil
+		}
+		for k, child := range v {
+			if err := flattenConfig(append(path[:len(path):len(path)], k), child, settings); err != nil {
+				return err
+			}
+		}
+		return nil
+	case []interface{}:
+		name := configVariable(path)
+		sep, ok := configListSeparators[name]
+		if !ok {
+			sep = ","
+		}
+		items := make([]string, len(v))
+		for i, item := range v {
+			s, err := configScalar(item)
+			if err != nil {
+				return fmt.Errorf("%s: %v", key, err)
+			}
+			items[i] = s
+		}
+		settings[name] = strings.Join(items, sep)
+		return nil
+	default:
+		s, err := configScalar(v)
+		if err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+		settings[configVariable(path)] = s
+		return nil
+	}
+}
+
+// flattenRuleSet joins the per-domain tables of key into the rules of the
+// variable name. Arrays become "|" separated lists.
+func flattenRuleSet(key, name string, domains map[string]interface{}, settings map[string]string) error {
+	rules := make([]string, 0, len(domains))
+	for domain, value := range domains {
+		table, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s.%s: want a table", key, domain)
+		}
+		options := make([]string, 0, len(table))
+		for option, value := range table {
+			var s string
+			var err error
+			if items, ok := value.([]interface{}); ok {
+				parts := make([]string, len(items))
+				for i, item := range items {
+					if parts[i], err = configScalar(item); err != nil {
+						break
+					}
+				}
+				s = strings.Join(parts, "|")
+			} else {
+				s, err = configScalar(value)
+			}
+			if err != nil {
+				return fmt.Errorf("%s.%s.%s: %v", key, domain, option, err)
+			}
+			options = append(options, option+"="+s)
+		}
+		sort.Strings(options)
+		rules = append(rules, strings.Join(append([]string{domain}, options...), " "))
+	}
+	sort.Strings(rules)
+	settings[name] = strings.Join(rules, "; ")
+	return nil
+}
+
+// configVariable returns the environment variable for a key path.
+func configVariable(path []string) string {
+	if name, ok := configAliases[strings.Join(path, ".")]; ok {
+		return name
+	}
+	parts := append([]string(nil), path...)
+	if prefix, ok := configSections[parts[0]]; ok && len(parts) > 1 {
+		parts[0] = prefix
+	}
+	return strings.ToUpper(strings.Join(parts, "_"))
+}
+
+func configScalar(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	default:
+		return "", fmt.Errorf("unsupported value %v", value)
+	}
+}
+
+// configOwned records the variables that were set from the config file,
+// as opposed to the real environment, so that a reload may change them.
+var (
+	configMu    sync.Mutex
+	configOwned = make(map[string]bool)
+)
+
+// applyConfig sets the environment variables from a config file, except
+// those already set in the environment. Variables set by a previous load
+// that are no longer in the file are unset.
+func applyConfig(settings map[string]string) {
+	configMu.Lock()
+	defer configMu.Unlock()
+	for name := range configOwned {
+		if _, ok := settings[name]; !ok {
+			os.Unsetenv(name)
+			delete(configOwned, name)
+		}
+	}
+	for name, value := range settings {
+		if _, set := os.LookupEnv(name); set && !configOwned[name] {
+			slog.Debug("config file setting overridden by environment", "name", name)
+			continue
+		}
+		os.Setenv(name, value)
+		configOwned[name] = true
+	}
+}
+
+// reload re-reads the config file and applies the settings that can be
+// changed at runtime: the FlareSolverr backends and how requests are
+// balanced across them, rate limits, User-Agent rules, upstream proxies
+// and target restrictions. Requests in flight are not interrupted. Other
+// settings need a restart.
+func (s *solver) reload(path string) error {
+	if path == "" {
+		return errors.New("no config file to reload, start with --config or CONFIG_FILE")
+	}
+	settings, err := readConfigFile(path)
+	if err != nil {
+		return err
+	}
+	applyConfig(settings)
+	s.backends.replace(newBackendPoolFromEnv(s.reloadedFlareSolverrURL()))
+	s.rateLimits.replace(newDomainLimiterFor(s.cfg.rateLimitOptions()))
+	s.userAgents.replace(newUserAgentPolicyFromEnv())
+	upstreams := newUpstreamPolicy(s.cfg.upstreamOptions())
+	s.loadRules(upstreams)
+	s.upstreams.replace(upstreams)
+	s.targets.replace(newTargetPolicyFromEnv())
+	slog.Info("configuration reloaded", "path", path, "backends", s.backends.String())
+	return nil
+}
+
+// reloadedFlareSolverrURL returns the backends to use after a reload:
+// flaresolverr.urls if the config file sets them, or else the URL the
+// solver was created for, which a Config may have given instead of
+// FLARESOLVERR_URL.
+func (s *solver) reloadedFlareSolverrURL() string {
+	configMu.Lock()
+	owned := configOwned["FLARESOLVERR_URL"]
+	configMu.Unlock()
+	if owned {
+		return envString("FLARESOLVERR_URL", DefaultFlareSolverrURL)
+	}
+	return s.flareSolverrURL
+}
+
+// loadConfigFile applies the config file at path, if any.
+func loadConfigFile(path string) error {
+	if path == "" {
+		return nil
+	}
+	settings, err := readConfigFile(path)
+	if err != nil {
+		return err
+	}
+	applyConfig(settings)
+	return nil
+}
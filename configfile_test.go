@@ -0,0 +1,240 @@
+package flareproxy
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseTOML(t *testing.T) {
+	got, err := parseTOML(`
+# FlareProxy config
+port = 8080
+name = "flare # proxy" # trailing comment
+ratio = 0.5
+enabled = true
+literal = 'C:\path'
+
+[cache]
+ttl = "10m"
+max_entries = 1_000
+
+[flaresolverr]
+urls = [
+  "http://a:8191/v1", # first
+  "http://b:8191/v1",
+]
+
+[rate_limit.domains]
+"example.com" = "0.5:2"
+`)
+	if err != nil {
+		t.Fatalf("parseTOML() error = %v", err)
+	}
+	want := map[string]interface{}{
+		"port":    int64(8080),
+		"name":    "flare # proxy",
+		"ratio":   0.5,
+		"enabled": true,
+		"literal": `C:\path`,
+		"cache":   map[string]interface{}{"ttl": "10m", "max_entries": int64(1000)},
+		"flaresolverr": map[string]interface{}{
+			"urls": []interface{}{"http://a:8191/v1", "http://b:8191/v1"},
+		},
+		"rate_limit": map[string]interface{}{
+			"domains": map[string]interface{}{"example.com": "0.5:2"},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseTOML() = %#v\nwant %#v", got, want)
+	}
+
+	for _, bad := range []string{"port", "port = ", "[cache", "a = 1\na = 2", "x = {a = 1}", "[[jobs]]", `s = "open`} {
+		if _, err := parseTOML(bad); err == nil {
+			t.Errorf("parseTOML(%q) succeeded, want error", bad)
+		}
+	}
+}
+
+func TestParseTOMLNumbers(t *testing.T) {
+	tests := []struct {
+		value string
+		want  interface{}
+	}{
+		{value: "10", want: int64(10)},
+		{value: "-7", want: int64(-7)},
+		{value: "0", want: int64(0)},
+		{value: "0x1F", want: int64(31)},
+		{value: "0o10", want: int64(8)},
+		{value: "0b101", want: int64(5)},
+		{value: "0.25", want: 0.25},
+		{value: "010"},
+		{value: "-01"},
+		{value: "00.5"},
+		{value: "0x"},
+		{value: "0x-1"},
+		{value: "0o9"},
+	}
+	for _, tt := range tests {
+		got, err := parseTOMLValue(tt.value)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("parseTOMLValue(%q) = %#v, want error", tt.value, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parseTOMLValue(%q) = %#v, %v; want %#v", tt.value, got, err, tt.want)
+		}
+	}
+}
+
+func TestReadConfigFile(t *testing.T) {
+	want := map[string]string{
+		"PORT":                 "8080",
+		"FLARESOLVERR_URL":     "http://a:8191/v1,http://b:8191/v1",
+		"CACHE_TTL":            "10m",
+		"RATE_LIMIT":           "1.5",
+		"RATE_LIMIT_DOMAINS":   "example.com=0.5:2,other.org=2",
+		"UA_STRATEGY":          "rotate",
+		"UA_LIST":              "Mozilla/5.0 (A)|Mozilla/5.0 (B)",
+		"UA_DOMAIN_STRATEGIES": "example.com=pinned",
+		"DOMAIN_RULES":         "cdn.example bypass=true; example.com proxy=http://a:3128|http://b:3128 timeout=90s",
+	}
+	files := map[string]string{
+		"config.toml": `
+port = 8080
+[flaresolverr]
+urls = ["http://a:8191/v1", "http://b:8191/v1"]
+[cache]
+ttl = "10m"
+[rate_limit]
+rate = 1.5
+[rate_limit.domains]
+"example.com" = "0.5:2"
+"other.org" = 2
+[user_agent]
+strategy = "rotate"
+list = ["Mozilla/5.0 (A)", "Mozilla/5.0 (B)"]
+[user_agent.domains]
+"example.com" = "pinned"
+[rules."example.com"]
+timeout = "90s"
+proxy = ["http://a:3128", "http://b:3128"]
+[rules."cdn.example"]
+bypass = true
+`,
+		"config.json": `{
+  "port": 8080,
+  "flaresolverr": {"urls": ["http://a:8191/v1", "http://b:8191/v1"]},
+  "cache": {"ttl": "10m"},
+  "rate_limit": {"rate": 1.5, "domains": {"example.com": "0.5:2", "other.org": 2}},
+  "user_agent": {"strategy": "rotate", "list": ["Mozilla/5.0 (A)", "Mozilla/5.0 (B)"], "domains": {"example.com": "pinned"}},
+  "rules": {"example.com": {"timeout": "90s", "proxy": ["http://a:3128", "http://b:3128"]}, "cdn.example": {"bypass": true}}
+}`,
+	}
+	for name, content := range files {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), name)
+			os.WriteFile(path, []byte(content), 0o600)
+			got, err := readConfigFile(path)
+			if err != nil {
+				t.Fatalf("readConfigFile() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("readConfigFile() = %v\nwant %v", got, want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigFileEnvPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	os.WriteFile(path, []byte("port = 9000\nproxy_port = 9001\n"), 0o600)
+	t.Setenv("PORT", "7000")
+	t.Setenv("PROXY_PORT", "")
+	os.Unsetenv("PROXY_PORT")
+	t.Cleanup(func() { configOwned = make(map[string]bool) })
+
+	if err := loadConfigFile(path); err != nil {
+		t.Fatalf("loadConfigFile() error = %v", err)
+	}
+	if got := os.Getenv("PORT"); got != "7000" {
+		t.Errorf("PORT = %s, want the environment to win", got)
+	}
+	if got := os.Getenv("PROXY_PORT"); got != "9001" {
+		t.Errorf("PROXY_PORT = %s, want the value from the file", got)
+	}
+
+	if err := loadConfigFile(filepath.Join(t.TempDir(), "missing.toml")); err == nil {
+		t.Error("loadConfigFile() of a missing file succeeded")
+	}
+}
+
+func TestSolverReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	for _, name := range []string{"FLARESOLVERR_URL", "RATE_LIMIT_DOMAINS"} {
+		t.Setenv(name, "")
+		os.Unsetenv(name)
+	}
+	t.Setenv("RATE_LIMIT_MAX_WAIT", "1s")
+	t.Cleanup(func() { configOwned = make(map[string]bool) })
+
+	os.WriteFile(path, []byte(`
+[flaresolverr]
+urls = ["http://a/v1"]
+[rate_limit]
+max_wait = "1h"
+[rate_limit.domains]
+"example.com" = "0.01"
+`), 0o600)
+	if err := loadConfigFile(path); err != nil {
+		t.Fatalf("loadConfigFile() error = %v", err)
+	}
+	s := newSolver()
+	s.backends.setDraining("http://a/v1", true)
+	s.rateLimits.reserve("example.com")
+	if _, ok := s.rateLimits.reserve("example.com"); ok {
+		t.Fatal("rate limit from the config file not applied")
+	}
+
+	os.WriteFile(path, []byte(`
+[flaresolverr]
+urls = ["http://a/v1", "http://b/v1"]
+`), 0o600)
+	if err := s.reload(path); err != nil {
+		t.Fatalf("reload() error = %v", err)
+	}
+	if got := s.backends.String(); got != "http://a/v1,http://b/v1" {
+		t.Errorf("backends = %s after reload", got)
+	}
+	if b := s.backends.get("http://a/v1"); b == nil || !b.Draining() {
+		t.Error("existing backend lost its state on reload")
+	}
+	if _, ok := s.rateLimits.reserve("example.com"); !ok {
+		t.Error("rate limit removed from the config file still applies")
+	}
+	// The environment still wins over the file
+	if got := os.Getenv("RATE_LIMIT_MAX_WAIT"); got != "1s" {
+		t.Errorf("RATE_LIMIT_MAX_WAIT = %s, want the environment value", got)
+	}
+
+	// Without flaresolverr.urls in the file, the URL the solver was
+	// created for, as from a Config, stays
+	os.WriteFile(path, []byte(`
+[rate_limit]
+max_wait = "1h"
+`), 0o600)
+	s = newSolverFor(Config{FlareSolverrURL: "http://config/v1"})
+	if err := s.reload(path); err != nil {
+		t.Fatalf("reload() error = %v", err)
+	}
+	if got := s.backends.String(); got != "http://config/v1" {
+		t.Errorf("backends = %s after reload, want the solver's URL", got)
+	}
+
+	if err := s.reload(""); err == nil {
+		t.Error("reload() without a config file succeeded")
+	}
+}
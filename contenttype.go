@@ -0,0 +1,93 @@
+package flareproxy
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"mime"
+	"strings"
+	"unicode/utf8"
+)
+
+// Content types detected for solution bodies.
+const (
+	contentTypeHTML = "text/html; charset=utf-8"
+	contentTypeJSON = "application/json"
+	contentTypeXML  = "application/xml; charset=utf-8"
+	contentTypeRSS  = "application/rss+xml; charset=utf-8"
+	contentTypeAtom = "application/atom+xml; charset=utf-8"
+	contentTypeText = "text/plain; charset=utf-8"
+)
+
+// solutionContentType returns the Content-Type to send for a solution.
+// The origin's Content-Type is used when the solution includes it;
+// FlareSolverr only reports the rendered page, so otherwise the body is
+// sniffed. Indexers reject RSS feeds labelled as HTML.
+func solutionContentType(flareResponse *FlareSolverrResponse) string {
+	for name, value := range flareResponse.Solution.Headers {
+		if strings.EqualFold(name, "Content-Type") {
+			if _, _, err := mime.ParseMediaType(value); err == nil {
+				return value
+			}
+		}
+	}
+	return sniffContentType(flareResponse.Solution.Response)
+}
+
+// sniffContentType detects HTML, JSON, RSS, Atom, other XML and plain text
+// bodies. Anything unrecognized is assumed to be HTML.
+func sniffContentType(body string) string {
+	trimmed := strings.TrimLeft(strings.TrimPrefix(body, "\ufeff"), " \t\r\n")
+	switch {
+	case trimmed == "":
+		return contentTypeHTML
+	case trimmed[0] == '{' || trimmed[0] == '[':
+		if json.Valid([]byte(trimmed)) {
+			return contentTypeJSON
+		}
+	case trimmed[0] == '<':
+		return sniffMarkup(trimmed)
+	}
+	if !strings.Contains(body, "<") && utf8.ValidString(body) {
+		return contentTypeText
+	}
+	return contentTypeHTML
+}
+
+// sniffMarkup tells feeds and other XML documents from HTML by their root
+// element.
+func sniffMarkup(body string) string {
+	d := xml.NewDecoder(strings.NewReader(body))
+	d.Strict = false
+	d.AutoClose = xml.HTMLAutoClose
+	d.Entity = xml.HTMLEntity
+	declared := strings.HasPrefix(body, "<?xml")
+	for range 32 {
+		token, err := d.Token()
+		if err != nil {
+			break
+		}
+		switch t := token.(type) {
+		case xml.Directive:
+			if strings.HasPrefix(strings.ToLower(string(t)), "doctype html") {
+				return contentTypeHTML
+			}
+		case xml.StartElement:
+			switch strings.ToLower(t.Name.Local) {
+			case "html":
+				return contentTypeHTML
+			case "rss", "rdf":
+				return contentTypeRSS
+			case "feed":
+				return contentTypeAtom
+			}
+			if declared {
+				return contentTypeXML
+			}
+			return contentTypeHTML
+		}
+	}
+	if declared {
+		return contentTypeXML
+	}
+	return contentTypeHTML
+}
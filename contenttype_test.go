@@ -0,0 +1,68 @@
+package flareproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSniffContentType(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{name: "html", body: "<html><body>hi</body></html>", want: contentTypeHTML},
+		{name: "html doctype", body: "\n<!DOCTYPE html>\n<html lang=\"en\"></html>", want: contentTypeHTML},
+		{name: "html fragment", body: "<div>hi</div>", want: contentTypeHTML},
+		{name: "empty", body: "", want: contentTypeHTML},
+		{name: "json object", body: ` {"items": [1, 2]}`, want: contentTypeJSON},
+		{name: "json array", body: `[{"a": 1}]`, want: contentTypeJSON},
+		{name: "invalid json", body: `{not json`, want: contentTypeText},
+		{name: "rss", body: `<?xml version="1.0" encoding="UTF-8"?><rss version="2.0"><channel></channel></rss>`, want: contentTypeRSS},
+		{name: "rss with bom and stylesheet", body: "\ufeff<?xml version=\"1.0\"?>\n<?xml-stylesheet href=\"feed.xsl\"?>\n<!-- feed -->\n<rss></rss>", want: contentTypeRSS},
+		{name: "rdf", body: `<?xml version="1.0"?><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#"></rdf:RDF>`, want: contentTypeRSS},
+		{name: "atom", body: `<feed xmlns="http://www.w3.org/2005/Atom"><title>t</title></feed>`, want: contentTypeAtom},
+		{name: "torznab caps", body: `<?xml version="1.0"?><caps><server title="x"/></caps>`, want: contentTypeXML},
+		{name: "xhtml", body: `<?xml version="1.0"?><html xmlns="http://www.w3.org/1999/xhtml"></html>`, want: contentTypeHTML},
+		{name: "plain text", body: "User-agent: *\nDisallow: /admin\n", want: contentTypeText},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sniffContentType(tt.body); got != tt.want {
+				t.Errorf("sniffContentType(%q) = %q, want %q", tt.body, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSolutionContentType(t *testing.T) {
+	feed := `<?xml version="1.0"?><rss version="2.0"></rss>`
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    string
+	}{
+		{name: "sniffed without headers", want: contentTypeRSS},
+		{name: "origin header wins", headers: map[string]string{"content-type": "text/xml; charset=ISO-8859-1"}, want: "text/xml; charset=ISO-8859-1"},
+		{name: "invalid header is ignored", headers: map[string]string{"Content-Type": ";;"}, want: contentTypeRSS},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				response := testResponse(feed)
+				response.Solution.Headers = tt.headers
+				json.NewEncoder(w).Encode(response)
+			}))
+			defer mockServer.Close()
+			t.Setenv("FLARESOLVERR_URL", mockServer.URL)
+
+			rr := httptest.NewRecorder()
+			NewDirectHandler().ServeHTTP(rr, httptest.NewRequest("GET", "/example.com/feed", nil))
+			if got := rr.Header().Get("Content-Type"); got != tt.want {
+				t.Errorf("Content-Type = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package flareproxy
+
+import (
+	_ "embed"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DashboardPath serves the admin dashboard. The page itself holds no data
+// and is served without the admin token; it asks the operator for the
+// token and uses it to poll the admin API.
+const DashboardPath = "/admin/ui"
+
+//go:embed dashboard.html
+var dashboardHTML []byte
+
+// historySize is the number of recent requests the dashboard shows and
+// computes latency percentiles and error counts over.
+const historySize = 500
+
+// history keeps the most recent requests of all listeners.
+var history = newRequestHistory(historySize)
+
+// historyEntry is a handled request as shown on the dashboard.
+type historyEntry struct {
+	Time       time.Time `json:"time"`
+	Mode       string    `json:"mode"`
+	Method     string    `json:"method"`
+	Target     string    `json:"target"`
+	Status     int       `json:"status"`
+	DurationMS int64     `json:"duration_ms"`
+	Cache      string    `json:"cache,omitempty"`
+	Backend    string    `json:"backend,omitempty"`
+}
+
+// requestHistory is a ring buffer of the most recent requests.
+type requestHistory struct {
+	mu      sync.Mutex
+	entries []historyEntry
+	next    int
+	full    bool
+}
+
+func newRequestHistory(size int) *requestHistory {
+	return &requestHistory{entries: make([]historyEntry, size)}
+}
+
+// record adds e, replacing the oldest entry once the history is full.
+func (h *requestHistory) record(e historyEntry) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.entries[h.next] = e
+	h.next = (h.next + 1) % len(h.entries)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// recent returns the recorded requests, newest first.
+func (h *requestHistory) recent() []historyEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	n := h.next
+	if h.full {
+		n = len(h.entries)
+	}
+	entries := make([]historyEntry, 0, n)
+	for i := 1; i <= n; i++ {
+		entries = append(entries, h.entries[(h.next-i+len(h.entries))%len(h.entries)])
+	}
+	return entries
+}
+
+// historySummary is the dashboard's view of the request history.
+type historySummary struct {
+	Requests []historyEntry `json:"requests"`
+	// Latency percentiles in milliseconds, by "p50", "p90" and "p99"
+	Latency map[string]int64 `json:"latency_ms"`
+	// Errors counts failed requests by status code
+	Errors map[string]int `json:"errors"`
+}
+
+// summarize computes latency percentiles and error counts over entries.
+func summarize(entries []historyEntry) historySummary {
+	summary := historySummary{Requests: entries, Latency: make(map[string]int64), Errors: make(map[string]int)}
+	durations := make([]int64, len(entries))
+	for i, e := range entries {
+		durations[i] = e.DurationMS
+		if e.Status >= 400 {
+			summary.Errors[strconv.Itoa(e.Status)]++
+		}
+	}
+	if len(durations) == 0 {
+		return summary
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	for name, q := range map[string]float64{"p50": 0.5, "p90": 0.9, "p99": 0.99} {
+		// Nearest rank
+		rank := int(math.Ceil(q*float64(len(durations)))) - 1
+		summary.Latency[name] = durations[rank]
+	}
+	return summary
+}
+
+func (a *adminHandler) listRequests(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, summarize(history.recent()))
+}
+
+func serveDashboard(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'self'; script-src 'unsafe-inline'; style-src 'unsafe-inline'; frame-ancestors 'none'")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(dashboardHTML)
+}
@@ -0,0 +1,85 @@
+package flareproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRequestHistory(t *testing.T) {
+	h := newRequestHistory(3)
+	if got := h.recent(); len(got) != 0 {
+		t.Errorf("recent() = %v, want empty", got)
+	}
+	for status := 200; status < 205; status++ {
+		h.record(historyEntry{Status: status})
+	}
+	var statuses []int
+	for _, e := range h.recent() {
+		statuses = append(statuses, e.Status)
+	}
+	if want := []int{204, 203, 202}; !reflect.DeepEqual(statuses, want) {
+		t.Errorf("recent() statuses = %v, want newest first %v", statuses, want)
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	var entries []historyEntry
+	for i := 1; i <= 100; i++ {
+		status := http.StatusOK
+		switch {
+		case i%10 == 0:
+			status = http.StatusBadGateway
+		case i%25 == 0:
+			status = http.StatusTooManyRequests
+		}
+		entries = append(entries, historyEntry{Status: status, DurationMS: int64(i)})
+	}
+	summary := summarize(entries)
+	if want := map[string]int64{"p50": 50, "p90": 90, "p99": 99}; !reflect.DeepEqual(summary.Latency, want) {
+		t.Errorf("latency = %v, want %v", summary.Latency, want)
+	}
+	if want := map[string]int{"502": 10, "429": 2}; !reflect.DeepEqual(summary.Errors, want) {
+		t.Errorf("errors = %v, want %v", summary.Errors, want)
+	}
+	if summary := summarize(nil); len(summary.Latency) != 0 {
+		t.Errorf("latency = %v without requests", summary.Latency)
+	}
+}
+
+func TestAdminDashboard(t *testing.T) {
+	defer func(h *requestHistory) { history = h }(history)
+	history = newRequestHistory(historySize)
+	t.Setenv("FLARESOLVERR_URL", "http://a/v1")
+	s := newSolver()
+	h := newAdminHandler(s, "s3cret", nil)
+
+	// The page needs no token, the data it shows does
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest("GET", DashboardPath, nil))
+	if rr.Code != http.StatusOK || !strings.HasPrefix(rr.Header().Get("Content-Type"), "text/html") {
+		t.Fatalf("dashboard = %d %s", rr.Code, rr.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(rr.Body.String(), "/admin/requests") {
+		t.Error("dashboard does not poll /admin/requests")
+	}
+	if rr := adminRequest(t, h, "GET", "/admin/requests", "", ""); rr.Code != http.StatusUnauthorized {
+		t.Errorf("status = %d without a token, want 401", rr.Code)
+	}
+
+	failing := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "bad gateway", http.StatusBadGateway)
+	})
+	withRequestLogging("direct", failing).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/example.com/", nil))
+	withRequestLogging("admin", h).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/admin/requests", nil))
+
+	var summary historySummary
+	rr = adminRequest(t, h, "GET", "/admin/requests", "s3cret", "")
+	json.Unmarshal(rr.Body.Bytes(), &summary)
+	if len(summary.Requests) != 1 || summary.Requests[0].Target != "/example.com/" || summary.Errors["502"] != 1 {
+		t.Errorf("summary = %+v, want the direct request only", summary)
+	}
+}
@@ -0,0 +1,175 @@
+package flareproxy
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// minCompressBytes is the size below which responses of a known length
+// are not worth compressing.
+const minCompressBytes = 1024
+
+// brotliLevel is the brotli quality responses are compressed at. Higher
+// levels shrink pages a little more for several times the CPU, which
+// matters for bodies compressed on every request.
+const brotliLevel = 5
+
+// compressResponse returns a writer compressing the response with brotli,
+// gzip or deflate, whichever the client prefers in Accept-Encoding, when
+// RESPONSE_COMPRESSION is enabled. Only text, JSON, XML and JavaScript
+// are compressed; partial and already encoded responses are left alone.
+// The returned function finishes the compressed stream and must be called
+// once the handler is done.
+func (s *solver) compressResponse(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, func()) {
+	encoding := acceptedEncoding(r.Header.Get("Accept-Encoding"))
+	if !s.compressResponses || encoding == "" || r.Method == http.MethodHead {
+		return w, func() {}
+	}
+	cw := &compressWriter{ResponseWriter: w, encoding: encoding}
+	return cw, cw.close
+}
+
+// acceptedEncoding returns the encoding to use for an Accept-Encoding
+// header value: br, gzip or deflate, preferring the higher quality and
+// that order on ties, or "" for none. A wildcard only stands for the encodings
+// the header does not name, so "gzip;q=0, *" picks deflate.
+func acceptedEncoding(header string) string {
+	qualities := make(map[string]float64)
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		quality := 1.0
+		if key, value, ok := strings.Cut(strings.TrimSpace(params), "="); ok && strings.TrimSpace(key) == "q" {
+			if q, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+				quality = q
+			}
+		}
+		if name == "x-gzip" {
+			name = "gzip"
+		}
+		if name != "" {
+			qualities[name] = quality
+		}
+	}
+	best, bestQuality := "", 0.0
+	for _, name := range []string{"br", "gzip", "deflate"} {
+		quality, ok := qualities[name]
+		if !ok {
+			quality = qualities["*"]
+		}
+		if quality > bestQuality {
+			best, bestQuality = name, quality
+		}
+	}
+	return best
+}
+
+// compressible reports whether responses of contentType shrink when
+// compressed.
+func compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	switch {
+	case strings.HasPrefix(mediaType, "text/"),
+		strings.HasSuffix(mediaType, "+json"), strings.HasSuffix(mediaType, "+xml"):
+		return true
+	}
+	switch mediaType {
+	case "application/json", "application/javascript", "application/xml", "application/xhtml+xml":
+		return true
+	}
+	return false
+}
+
+// compressWriter decides whether to compress when the status is written,
+// from the response headers set by then.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding    string
+	wroteHeader bool
+	zw          interface {
+		io.WriteCloser
+		Flush() error
+	} // nil unless compressing
+}
+
+func (w *compressWriter) WriteHeader(status int) {
+	if w.wroteHeader || status < 200 {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	w.wroteHeader = true
+	h := w.Header()
+	if !compressible(h.Get("Content-Type")) {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	h.Add("Vary", "Accept-Encoding")
+	length, err := strconv.Atoi(h.Get("Content-Length"))
+	if status == http.StatusNoContent || status == http.StatusNotModified || status == http.StatusPartialContent ||
+		h.Get("Content-Encoding") != "" || h.Get("Content-Range") != "" || (err == nil && length < minCompressBytes) {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	h.Set("Content-Encoding", w.encoding)
+	h.Del("Content-Length")
+	if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		// The compressed bytes differ from those the tag was made for
+		h.Set("ETag", "W/"+etag)
+	}
+	switch w.encoding {
+	case "br":
+		w.zw = brotli.NewWriterLevel(w.ResponseWriter, brotliLevel)
+	case "gzip":
+		w.zw = gzip.NewWriter(w.ResponseWriter)
+	default:
+		w.zw = zlib.NewWriter(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.zw == nil {
+		return w.ResponseWriter.Write(b)
+	}
+	return w.zw.Write(b)
+}
+
+func (w *compressWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.zw != nil {
+		w.zw.Flush()
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// close writes the end of the compressed stream.
+func (w *compressWriter) close() {
+	if w.zw != nil {
+		w.zw.Close()
+	}
+}
+
+// Unwrap allows http.ResponseController to reach the underlying writer.
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
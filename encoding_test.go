@@ -0,0 +1,143 @@
+package flareproxy
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+func TestAcceptedEncoding(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{header: "", want: ""},
+		{header: "gzip, deflate, br", want: "br"},
+		{header: "gzip, deflate", want: "gzip"},
+		{header: "deflate", want: "deflate"},
+		{header: "br;q=0.5, gzip", want: "gzip"},
+		{header: "gzip;q=0.5, deflate", want: "deflate"},
+		{header: "gzip;q=0, deflate;q=0", want: ""},
+		{header: "deflate, gzip", want: "gzip"},
+		{header: "*", want: "br"},
+		{header: "identity", want: ""},
+		{header: "gzip;q=0, *", want: "br"},
+		{header: "gzip;q=0, br;q=0, *", want: "deflate"},
+		{header: "br;q=0, *;q=0.5", want: "gzip"},
+		{header: "x-gzip;q=0.4, deflate;q=0.3", want: "gzip"},
+	}
+	for _, tt := range tests {
+		if got := acceptedEncoding(tt.header); got != tt.want {
+			t.Errorf("acceptedEncoding(%q) = %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestResponseCompression(t *testing.T) {
+	page := "<html>" + strings.Repeat("solved ", 1000) + "</html>"
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(testResponse(page))
+	}))
+	defer mockServer.Close()
+	t.Setenv("FLARESOLVERR_URL", mockServer.URL)
+	handler := NewDirectHandler()
+
+	tests := []struct {
+		name         string
+		path         string
+		headers      map[string]string
+		wantEncoding string
+	}{
+		{name: "br", path: "/example.com/", headers: map[string]string{"Accept-Encoding": "gzip, br"}, wantEncoding: "br"},
+		{name: "gzip", path: "/example.com/", headers: map[string]string{"Accept-Encoding": "gzip"}, wantEncoding: "gzip"},
+		{name: "deflate", path: "/example.com/", headers: map[string]string{"Accept-Encoding": "deflate"}, wantEncoding: "deflate"},
+		{name: "not accepted", path: "/example.com/"},
+		{name: "range requests stay uncompressed", path: "/example.com/", headers: map[string]string{"Accept-Encoding": "gzip", "Range": "bytes=0-99"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.path, nil)
+			for name, value := range tt.headers {
+				req.Header.Set(name, value)
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			if got := rr.Header().Get("Content-Encoding"); got != tt.wantEncoding {
+				t.Fatalf("Content-Encoding = %q, want %q", got, tt.wantEncoding)
+			}
+			body := io.Reader(rr.Body)
+			switch tt.wantEncoding {
+			case "br":
+				body = brotli.NewReader(rr.Body)
+			case "gzip":
+				body, _ = gzip.NewReader(rr.Body)
+			case "deflate":
+				body, _ = zlib.NewReader(rr.Body)
+			default:
+				return
+			}
+			if rr.Body.Len() >= len(page) {
+				t.Errorf("compressed body has %d bytes, page %d", rr.Body.Len(), len(page))
+			}
+			decoded, err := io.ReadAll(body)
+			if err != nil || string(decoded) != page {
+				t.Errorf("decoded body = %.40q, %v", decoded, err)
+			}
+			if etag := rr.Header().Get("ETag"); !strings.HasPrefix(etag, `W/"`) {
+				t.Errorf("ETag = %q, want a weak tag", etag)
+			}
+			if rr.Header().Get("Vary") != "Accept-Encoding" {
+				t.Errorf("Vary = %q", rr.Header().Get("Vary"))
+			}
+		})
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		t.Setenv("RESPONSE_COMPRESSION", "false")
+		req := httptest.NewRequest("GET", "/example.com/", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		rr := httptest.NewRecorder()
+		NewDirectHandler().ServeHTTP(rr, req)
+		if rr.Header().Get("Content-Encoding") != "" || rr.Body.String() != page {
+			t.Errorf("Content-Encoding = %q with RESPONSE_COMPRESSION=false", rr.Header().Get("Content-Encoding"))
+		}
+	})
+}
+
+func TestCompressWriterSkips(t *testing.T) {
+	s := &solver{compressResponses: true}
+	tests := []struct {
+		name        string
+		contentType string
+		length      string
+		status      int
+	}{
+		{name: "images", contentType: "image/png", status: http.StatusOK},
+		{name: "small bodies", contentType: "text/plain", length: "10", status: http.StatusOK},
+		{name: "not modified", contentType: "text/html", status: http.StatusNotModified},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+			rr := httptest.NewRecorder()
+			w, done := s.compressResponse(rr, req)
+			w.Header().Set("Content-Type", tt.contentType)
+			if tt.length != "" {
+				w.Header().Set("Content-Length", tt.length)
+			}
+			w.WriteHeader(tt.status)
+			done()
+			if rr.Header().Get("Content-Encoding") != "" {
+				t.Errorf("compressed %s", tt.name)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package flareproxy
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// EnvelopeContentType is the media type of Envelope responses, which
+// clients ask for in their Accept header, or on FetchPath with
+// format=json.
+const EnvelopeContentType = "application/vnd.flareproxy+json"
+
+// Envelope is a solved page with everything known about it, for clients
+// that want the metadata along with the body.
+type Envelope struct {
+	// URL is the URL fetched, which is the request's unless it fell back
+	// to HTTP, and FinalURL the page's after redirects, if known.
+	URL      string `json:"url"`
+	FinalURL string `json:"final_url,omitempty"`
+	// Status is the status the origin returned to the solving browser.
+	Status      int               `json:"status"`
+	ContentType string            `json:"content_type"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	Cookies     []Cookie          `json:"cookies,omitempty"`
+	UserAgent   string            `json:"user_agent,omitempty"`
+	// SolveTimeMS is how long the fetch took, in milliseconds, and Cache
+	// and Backend are as in the trailers.
+	SolveTimeMS int64      `json:"solve_time_ms"`
+	Cache       string     `json:"cache"`
+	Backend     string     `json:"backend,omitempty"`
+	FetchedAt   *time.Time `json:"fetched_at,omitempty"`
+	Stale       bool       `json:"stale,omitempty"`
+	Quality     float64    `json:"quality"`
+	Body        string     `json:"body"`
+}
+
+// wantsEnvelope reports whether the client asked for an Envelope instead
+// of the page itself. The format query parameter is only read on
+// FetchPath, since on "/domain.com/path" the query is the target's.
+func wantsEnvelope(r *http.Request) bool {
+	if r.URL.Path == FetchPath && r.URL.Query().Get("format") == "json" {
+		return true
+	}
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err == nil && mediaType == EnvelopeContentType {
+			return true
+		}
+	}
+	return false
+}
+
+// writeEnvelope writes the Envelope of result with status 200, whatever
+// the origin's status was.
+func writeEnvelope(w http.ResponseWriter, result *FetchResult) {
+	solution, meta := result.Response.Solution, result.meta
+	envelope := &Envelope{
+		URL:         result.URL,
+		FinalURL:    solution.URL,
+		Status:      meta.Status,
+		ContentType: solutionContentType(result.Response),
+		Headers:     solution.Headers,
+		Cookies:     solution.Cookies,
+		UserAgent:   solution.UserAgent,
+		SolveTimeMS: meta.SolveTime.Milliseconds(),
+		Cache:       meta.Cache,
+		Backend:     meta.Backend,
+		Stale:       meta.Stale,
+		Quality:     meta.Quality,
+		Body:        solution.Response,
+	}
+	if !meta.FetchedAt.IsZero() {
+		envelope.FetchedAt = &meta.FetchedAt
+	}
+	w.Header().Set("Content-Type", EnvelopeContentType)
+	w.Header().Set("Vary", "Accept")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(envelope)
+}
@@ -0,0 +1,76 @@
+package flareproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/kljensen/flareproxygo/flaresolverr"
+	"github.com/kljensen/flareproxygo/flaresolverr/flaresolverrtest"
+)
+
+func TestEnvelope(t *testing.T) {
+	fs := flaresolverrtest.NewServer()
+	defer fs.Close()
+	fs.SetPage("https://example.com/missing?format=json", flaresolverrtest.Page{
+		Status:  http.StatusNotFound,
+		Body:    "<html>gone</html>",
+		Headers: map[string]string{"Content-Type": "text/html; charset=utf-8"},
+		Cookies: []flaresolverr.Cookie{{Name: "sid", Value: "1", Domain: "example.com"}},
+	})
+	fs.SetPage("https://example.com/data.json", flaresolverrtest.Page{
+		Status:  http.StatusNotFound,
+		Body:    "<html>gone</html>",
+		Headers: map[string]string{"Content-Type": "text/html; charset=utf-8"},
+		Cookies: []flaresolverr.Cookie{{Name: "sid", Value: "1", Domain: "example.com"}},
+	})
+	t.Setenv("FLARESOLVERR_URL", fs.Endpoint())
+	handler := NewDirectHandler()
+
+	tests := []struct {
+		name    string
+		path    string
+		accept  string
+		want    bool
+		wantURL string
+	}{
+		{name: "accept header", path: "/example.com/missing?format=json", accept: "text/html, " + EnvelopeContentType + ";q=0.9", want: true, wantURL: "https://example.com/missing?format=json"},
+		{name: "fetch format parameter", path: FetchPath + "?format=json&url=https%3A%2F%2Fexample.com%2Fmissing%3Fformat%3Djson", want: true, wantURL: "https://example.com/missing?format=json"},
+		{name: "pass-through resource", path: "/example.com/data.json", accept: EnvelopeContentType, want: true, wantURL: "https://example.com/data.json"},
+		{name: "format parameter of the target", path: "/example.com/missing?format=json"},
+		{name: "page", path: "/example.com/missing?format=json", accept: "application/json"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.path, nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			if !tt.want {
+				if rr.Code != http.StatusNotFound || rr.Body.String() != "<html>gone</html>" {
+					t.Errorf("response = %d %q, want the page", rr.Code, rr.Body.String())
+				}
+				return
+			}
+			if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != EnvelopeContentType {
+				t.Fatalf("response = %d %s, want 200 %s", rr.Code, rr.Header().Get("Content-Type"), EnvelopeContentType)
+			}
+			var envelope Envelope
+			if err := json.Unmarshal(rr.Body.Bytes(), &envelope); err != nil {
+				t.Fatal(err)
+			}
+			if envelope.URL != tt.wantURL || envelope.Status != http.StatusNotFound || envelope.Body != "<html>gone</html>" {
+				t.Errorf("envelope = %+v", envelope)
+			}
+			if envelope.Headers["Content-Type"] != "text/html; charset=utf-8" || len(envelope.Cookies) != 1 || envelope.UserAgent == "" {
+				t.Errorf("envelope metadata = %+v", envelope)
+			}
+			if envelope.Cache == "" || envelope.FetchedAt == nil {
+				t.Errorf("envelope = %+v, want the cache state and fetch time", envelope)
+			}
+		})
+	}
+}
@@ -0,0 +1,245 @@
+package flareproxy
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ExplainPath is the endpoint on the direct server describing how a
+// request would be handled, without handling it.
+const ExplainPath = "/api/v1/explain"
+
+// Scheme strategies reported by the explain endpoint.
+const (
+	// SchemeHTTPSFallback is used for direct mode paths like
+	// "/domain.com/path": HTTPS first, then HTTP if FlareSolverr fails.
+	SchemeHTTPSFallback = "https-then-http"
+	// SchemeAsGiven is used for full URLs, fetched with their own scheme.
+	SchemeAsGiven = "as-given"
+)
+
+// Handlings reported by the explain endpoint.
+const (
+	HandlingDenied      = "denied"
+	HandlingDisabled    = "disabled"
+	HandlingMaintenance = "maintenance"
+	HandlingCache       = "cache"
+	HandlingPassThrough = "passthrough"
+	HandlingDirect      = "direct"
+	HandlingBypass      = "bypass"
+	HandlingUnsolvable  = "unsolvable"
+	HandlingSolver      = "flaresolverr"
+)
+
+// Explanation describes how a GET of a URL would be handled.
+type Explanation struct {
+	URL            string `json:"url"`
+	SchemeStrategy string `json:"scheme_strategy"`
+	// Handling is how the page would be served. With HandlingDirect the
+	// page is fetched directly first and only solved when the origin
+	// answers with a challenge; with HandlingBypass it is only ever
+	// fetched directly, as the domain's rule says.
+	Handling string       `json:"handling"`
+	Reason   string       `json:"reason,omitempty"`
+	Mode     string       `json:"mode"`
+	Rule     *explainRule `json:"rule,omitempty"`
+
+	CacheKey      string           `json:"cache_key,omitempty"`
+	Cached        bool             `json:"cached"`
+	RateLimit     explainRateLimit `json:"rate_limit"`
+	UpstreamProxy *explainUpstream `json:"upstream_proxy,omitempty"`
+	Region        string           `json:"region,omitempty"`
+	Session       string           `json:"session,omitempty"`
+	Backend       string           `json:"backend,omitempty"`
+	BackendError  string           `json:"backend_error,omitempty"`
+}
+
+type explainRateLimit struct {
+	Bucket string  `json:"bucket"`
+	Rate   float64 `json:"rate"`
+	Burst  int     `json:"burst"`
+}
+
+// explainRule is the DOMAIN_RULES rule matching the request. Its proxies
+// are reported in the upstream proxy.
+type explainRule struct {
+	Domain   string `json:"domain"`
+	Backend  string `json:"backend,omitempty"`
+	Sessions string `json:"sessions,omitempty"`
+	Timeout  string `json:"timeout,omitempty"`
+	CacheTTL string `json:"cache_ttl,omitempty"`
+	Bypass   bool   `json:"bypass,omitempty"`
+}
+
+func newExplainRule(rule *DomainRule) *explainRule {
+	if rule == nil {
+		return nil
+	}
+	e := &explainRule{Domain: rule.Domain, Backend: rule.Backend, Sessions: rule.Sessions, Bypass: rule.Bypass}
+	if rule.Timeout > 0 {
+		e.Timeout = rule.Timeout.String()
+	}
+	if rule.CacheTTL > 0 {
+		e.CacheTTL = rule.CacheTTL.String()
+	}
+	return e
+}
+
+// explainUpstream is the upstream proxy a request would go through: the
+// one the client asked for, or those of the matching rule, which take
+// turns.
+type explainUpstream struct {
+	Requested string   `json:"requested,omitempty"`
+	Rule      string   `json:"rule,omitempty"`
+	Proxies   []string `json:"proxies,omitempty"`
+}
+
+// serveExplain answers GET ExplainPath?url=... with an Explanation. The
+// url is either a full URL or a direct mode path like "domain.com/path"
+// or "http/domain.com:8080/path".
+func (d *DirectHandler) serveExplain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	target := r.URL.Query().Get("url")
+	if target == "" {
+		sendErrorStatus(w, r, http.StatusBadRequest, "url is required")
+		return
+	}
+	otherScheme := strings.Contains(target, "://")
+	target, explicit := directTarget(target, "")
+	strategy := SchemeAsGiven
+	if !explicit {
+		strategy = SchemeHTTPSFallback
+	}
+	u, err := url.Parse(target)
+	if err != nil || (otherScheme && !explicit) || u.Hostname() == "" {
+		sendErrorStatus(w, r, http.StatusBadRequest, "url must be an http or https URL")
+		return
+	}
+	e := d.explain(r, target)
+	e.SchemeStrategy = strategy
+	writeJSON(w, http.StatusOK, e)
+}
+
+// explain follows the decisions of the direct handler and fetch for a GET
+// of targetURL, without taking tokens, proxies or backends.
+func (s *solver) explain(r *http.Request, targetURL string) *Explanation {
+	ctx := r.Context()
+	host := requestHost(targetURL)
+	rule := s.ruleFor(targetURL)
+	e := &Explanation{URL: targetURL, Mode: s.mode, Rule: newExplainRule(rule)}
+	limit, bucket := s.rateLimits.bucketFor(host)
+	e.RateLimit = explainRateLimit{Bucket: bucket, Rate: limit.Rate, Burst: limit.Burst}
+
+	proxy := upstreamProxyFrom(ctx)
+	if proxy != nil {
+		e.UpstreamProxy = &explainUpstream{Requested: proxy.URL}
+	} else if name, proxies := s.upstreams.ruleFor(targetURL); len(proxies) > 0 && !rule.bypass() {
+		e.UpstreamProxy = &explainUpstream{Rule: name}
+		for _, p := range proxies {
+			e.UpstreamProxy.Proxies = append(e.UpstreamProxy.Proxies, p.URL)
+		}
+	}
+	e.Region = s.regions.regionFor(ctx, targetURL)
+
+	if err := s.targets.check(targetURL); err != nil {
+		e.Handling, e.Reason = HandlingDenied, err.Error()
+		return e
+	}
+	if s.isPassThrough(ctx, targetURL) {
+		e.Handling = HandlingPassThrough
+		return e
+	}
+	opts := requestOptionsFrom(ctx)
+	if s.cache != nil {
+		e.CacheKey = s.cacheKeyFor(withFetchRequest(ctx, clientFetchRequest(r, FetchRequest{URL: targetURL})), targetURL, proxy)
+		_, e.Cached = s.cache.Get(e.CacheKey)
+		if e.Cached && !opts.NoCache {
+			e.Handling = HandlingCache
+			return e
+		}
+	}
+	if _, err := s.maintenance.check(targetURL); err != nil {
+		e.Handling, e.Reason = HandlingMaintenance, err.Error()
+		return e
+	}
+	if err := s.budget.check(targetURL); err != nil {
+		e.Handling, e.Reason = HandlingDisabled, err.Error()
+		return e
+	}
+	if rule.bypass() {
+		e.Handling = HandlingBypass
+		return e
+	}
+
+	e.Handling = HandlingSolver
+	if e.UpstreamProxy == nil && opts.Session == "" {
+		switch s.mode {
+		case FetchModeSmart:
+			e.Handling = HandlingDirect
+		case FetchModeReuse:
+			if _, ok := s.clearances.get(host); ok {
+				e.Handling = HandlingDirect
+			}
+		}
+	}
+	if e.Handling == HandlingSolver && !opts.NoCache {
+		if err := s.unsolvable(targetURL, e.UpstreamProxy); err != nil {
+			e.Handling, e.Reason = HandlingUnsolvable, err.Error()
+			return e
+		}
+	}
+
+	// Sessions are not used through upstream proxies, whichever of the
+	// rule's proxies is chosen when the request is made
+	switch {
+	case opts.Session != "":
+		e.Session = opts.Session
+	case e.UpstreamProxy == nil:
+		e.Session = s.sessionFor(ctx, targetURL, nil)
+	}
+	if b := s.pinnedBackend(FlareSolverrRequest{URL: targetURL, Session: e.Session}); b != nil {
+		e.Backend = b.url
+		return e
+	}
+	b, err := s.backends.peek(e.Region)
+	if err != nil {
+		e.BackendError = err.Error()
+		return e
+	}
+	e.Backend = b.url
+	return e
+}
+
+// unsolvable returns the negative cache's error for a GET of targetURL
+// through upstream, or nil. Through a rule's proxies, which take turns,
+// the page only fails fast once it failed through all of them.
+func (s *solver) unsolvable(targetURL string, upstream *explainUpstream) error {
+	solveKey := "request.get " + targetURL
+	switch {
+	case upstream == nil:
+		return s.negative.check(solveKey)
+	case upstream.Requested != "":
+		return s.negative.check(solveKey + " via " + upstream.Requested)
+	}
+	var err error
+	for _, proxyURL := range upstream.Proxies {
+		if err = s.negative.check(solveKey + " via " + proxyURL); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// requestHost returns the lowercased host name of targetURL, or "" if it
+// cannot be parsed.
+func requestHost(targetURL string) string {
+	u, err := url.Parse(targetURL)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
@@ -0,0 +1,153 @@
+package flareproxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestExplain(t *testing.T) {
+	var requests atomic.Int32
+	newBackend := func() *httptest.Server {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests.Add(1)
+		}))
+		t.Cleanup(server.Close)
+		return server
+	}
+	eu, us := newBackend(), newBackend()
+	t.Setenv("FLARESOLVERR_URL", eu.URL+","+us.URL)
+	t.Setenv("BACKEND_REGIONS", us.URL+"=us,"+eu.URL+"=eu")
+	t.Setenv("REGION_ROUTES", "example.com=us,pinned.test=us")
+	t.Setenv("CACHE_TTL", "1m")
+	t.Setenv("RATE_LIMIT_DOMAINS", "example.com=0.5:2")
+	t.Setenv("UPSTREAM_PROXY_DOMAINS", "proxied.test=http://a:3128|http://b:3128")
+	t.Setenv("TARGET_DENYLIST", "denied.test")
+	t.Setenv("DOMAIN_RULES", "bypass.test bypass=true; pinned.test backend="+eu.URL+" timeout=90s; cold.test sessions=none")
+	t.Setenv("NEGATIVE_CACHE_TTL", "1m")
+
+	handler := NewDirectHandler()
+	handler.cache.Set(handler.cacheKeyFor(context.Background(), "https://cached.test/", nil), testResponse("<html>cached</html>"))
+	handler.sessions.add("warm.test", "warm-session", eu.URL)
+	handler.sessions.add("cold.test", "cold-session", eu.URL)
+	handler.negative.record("request.get https://unsolvable.test/", "https://unsolvable.test/", &SolverError{Message: "Captcha detected"})
+
+	tests := []struct {
+		url   string
+		check func(t *testing.T, e Explanation)
+	}{
+		{"example.com/page?q=1", func(t *testing.T, e Explanation) {
+			if e.URL != "https://example.com/page?q=1" || e.SchemeStrategy != SchemeHTTPSFallback {
+				t.Errorf("url = %s, strategy = %s", e.URL, e.SchemeStrategy)
+			}
+			if e.Handling != HandlingSolver || e.Mode != FetchModeSolver {
+				t.Errorf("handling = %s in mode %s", e.Handling, e.Mode)
+			}
+			if e.Region != "us" || e.Backend != us.URL {
+				t.Errorf("region = %q, backend = %q, want the us backend", e.Region, e.Backend)
+			}
+			if e.CacheKey != handler.cacheKeyFor(context.Background(), e.URL, nil) || e.Cached {
+				t.Errorf("cache key = %q, cached = %v", e.CacheKey, e.Cached)
+			}
+		}},
+		{"http://www.example.com/", func(t *testing.T, e Explanation) {
+			if e.URL != "http://www.example.com/" || e.SchemeStrategy != SchemeAsGiven {
+				t.Errorf("url = %s, strategy = %s", e.URL, e.SchemeStrategy)
+			}
+			if e.RateLimit != (explainRateLimit{Bucket: "example.com", Rate: 0.5, Burst: 2}) {
+				t.Errorf("rate limit = %+v, want the example.com bucket", e.RateLimit)
+			}
+		}},
+		{"cached.test/", func(t *testing.T, e Explanation) {
+			if e.Handling != HandlingCache || !e.Cached {
+				t.Errorf("handling = %s, cached = %v", e.Handling, e.Cached)
+			}
+		}},
+		{"warm.test/", func(t *testing.T, e Explanation) {
+			if e.Session != "warm-session" || e.Backend != eu.URL {
+				t.Errorf("session = %q on %q, want the warm session", e.Session, e.Backend)
+			}
+		}},
+		{"proxied.test/", func(t *testing.T, e Explanation) {
+			if e.UpstreamProxy == nil || e.UpstreamProxy.Rule != "proxied.test" || len(e.UpstreamProxy.Proxies) != 2 {
+				t.Errorf("upstream proxy = %+v", e.UpstreamProxy)
+			}
+		}},
+		{"denied.test/", func(t *testing.T, e Explanation) {
+			if e.Handling != HandlingDenied || e.Reason == "" {
+				t.Errorf("handling = %s (%s), want denied", e.Handling, e.Reason)
+			}
+		}},
+		{"www.bypass.test/", func(t *testing.T, e Explanation) {
+			if e.Handling != HandlingBypass || e.Rule == nil || !e.Rule.Bypass || e.Backend != "" {
+				t.Errorf("handling = %s with rule %+v on %q, want the rule's bypass", e.Handling, e.Rule, e.Backend)
+			}
+		}},
+		{"pinned.test/", func(t *testing.T, e Explanation) {
+			if e.Backend != eu.URL || e.Rule == nil || e.Rule.Backend != eu.URL || e.Rule.Timeout != "1m30s" {
+				t.Errorf("backend = %q with rule %+v, want the rule's backend", e.Backend, e.Rule)
+			}
+		}},
+		{"cold.test/", func(t *testing.T, e Explanation) {
+			if e.Session != "" || e.Rule == nil || e.Rule.Sessions != "none" {
+				t.Errorf("session = %q with rule %+v, want no session", e.Session, e.Rule)
+			}
+		}},
+		{"unsolvable.test/", func(t *testing.T, e Explanation) {
+			if e.Handling != HandlingUnsolvable || e.Reason == "" {
+				t.Errorf("handling = %s (%s), want unsolvable", e.Handling, e.Reason)
+			}
+		}},
+		{"example.org/logo.jpg", func(t *testing.T, e Explanation) {
+			if e.Handling != HandlingPassThrough {
+				t.Errorf("handling = %s, want passthrough", e.Handling)
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, httptest.NewRequest("GET", ExplainPath+"?url="+url.QueryEscape(tt.url), nil))
+			if rr.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", rr.Code, rr.Body.String())
+			}
+			var e Explanation
+			if err := json.NewDecoder(rr.Body).Decode(&e); err != nil {
+				t.Fatalf("decoding explanation: %v", err)
+			}
+			tt.check(t, e)
+		})
+	}
+	if n := requests.Load(); n != 0 {
+		t.Errorf("explaining sent %d requests to FlareSolverr", n)
+	}
+
+	// Backends are not claimed: the round robin stays where it was
+	for i := 0; i < 2; i++ {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("GET", ExplainPath+"?url=example.org/", nil))
+		var e Explanation
+		json.NewDecoder(rr.Body).Decode(&e)
+		if e.Backend != eu.URL {
+			t.Errorf("backend = %q, want the first backend every time", e.Backend)
+		}
+	}
+
+	for _, target := range []string{"", "ftp://example.com/", "https:///path"} {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("GET", ExplainPath+"?url="+url.QueryEscape(target), nil))
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("explain %q status = %d, want 400", target, rr.Code)
+		}
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("POST", ExplainPath, strings.NewReader("")))
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST status = %d, want 405", rr.Code)
+	}
+}
@@ -0,0 +1,258 @@
+package flareproxy
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errQueueTimeout is returned by fairSemaphore.acquire when no slot became
+// free in time.
+var errQueueTimeout = errors.New("timed out waiting in queue")
+
+// fairSemaphore limits how many requests a backend solves at once. When
+// it is saturated, freed slots go to the waiting tenants (API keys) in
+// weighted fair order rather than first come, first served, so a bulk
+// consumer queueing hundreds of requests cannot starve everyone else.
+//
+// It implements start-time fair queueing: each waiter is stamped with a
+// virtual finish time that advances by 1/weight per request of its tenant,
+// and the waiter with the earliest finish time is served next. A tenant
+// with weight 2 thus gets twice the slots of one with weight 1 while both
+// have requests waiting.
+type fairSemaphore struct {
+	mu       sync.Mutex
+	capacity int
+	inUse    int
+	vtime    float64
+	tenants  map[string]*fairTenant
+	waiting  int
+}
+
+type fairTenant struct {
+	finish float64 // virtual finish time of the tenant's last waiter
+	queue  []*fairWaiter
+}
+
+type fairWaiter struct {
+	tenant string
+	start  float64
+	finish float64
+	ready  chan struct{}
+}
+
+func newFairSemaphore(capacity int) *fairSemaphore {
+	return &fairSemaphore{capacity: capacity, tenants: make(map[string]*fairTenant)}
+}
+
+// tryAcquire takes a slot if one is free and nobody is waiting for it.
+func (s *fairSemaphore) tryAcquire() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.inUse < s.capacity && s.waiting == 0 {
+		s.inUse++
+		return true
+	}
+	return false
+}
+
+// acquire waits for a slot until timeout or ctx is done.
+func (s *fairSemaphore) acquire(ctx context.Context, tenant string, weight float64, timeout time.Duration) error {
+	s.mu.Lock()
+	if s.inUse < s.capacity && s.waiting == 0 {
+		s.inUse++
+		s.mu.Unlock()
+		return nil
+	}
+	t, ok := s.tenants[tenant]
+	if !ok {
+		t = &fairTenant{}
+		s.tenants[tenant] = t
+	}
+	w := &fairWaiter{tenant: tenant, start: max(s.vtime, t.finish), ready: make(chan struct{})}
+	w.finish = w.start + 1/weight
+	t.finish = w.finish
+	t.queue = append(t.queue, w)
+	s.waiting++
+	s.mu.Unlock()
+	ticket := queueTicketFrom(ctx)
+	ticket.enter(s, w)
+	defer ticket.enter(nil, nil)
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	var err error
+	select {
+	case <-w.ready:
+		return nil
+	case <-timer.C:
+		err = errQueueTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-w.ready:
+		// Granted just as we gave up; pass the slot on
+		s.releaseLocked()
+	default:
+		s.removeLocked(w)
+	}
+	return err
+}
+
+// release frees a slot, handing it to the next waiter if there is one.
+func (s *fairSemaphore) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.releaseLocked()
+}
+
+func (s *fairSemaphore) releaseLocked() {
+	var next *fairWaiter
+	for _, t := range s.tenants {
+		if len(t.queue) > 0 && (next == nil || t.queue[0].finish < next.finish) {
+			next = t.queue[0]
+		}
+	}
+	if next == nil {
+		s.inUse--
+		return
+	}
+	s.removeLocked(next)
+	s.vtime = next.start
+	close(next.ready)
+}
+
+func (s *fairSemaphore) removeLocked(w *fairWaiter) {
+	t := s.tenants[w.tenant]
+	for i, queued := range t.queue {
+		if queued == w {
+			t.queue = append(t.queue[:i], t.queue[i+1:]...)
+			s.waiting--
+			break
+		}
+	}
+	if len(t.queue) == 0 && t.finish <= s.vtime {
+		delete(s.tenants, w.tenant)
+	}
+}
+
+// positionLocked returns the 1-based place of w among the waiters, in the
+// order slots are handed out. The caller must hold s.mu.
+func (s *fairSemaphore) positionLocked(w *fairWaiter) int {
+	position := 1
+	for _, t := range s.tenants {
+		for _, queued := range t.queue {
+			if queued.finish < w.finish {
+				position++
+			}
+		}
+	}
+	return position
+}
+
+// QueueStatus is where a request waits for a free FlareSolverr slot.
+type QueueStatus struct {
+	// Position is 1 for the request served next.
+	Position int `json:"position"`
+	// EstimatedWaitMs is the expected wait from the backend's recent solve
+	// times, omitted before it has solved anything.
+	EstimatedWaitMs int64 `json:"estimated_wait_ms,omitempty"`
+}
+
+// queueTicket follows a request through the queues it waits in, so that
+// clients polling the job API can tell a queued job from a hung one.
+type queueTicket struct {
+	mu        sync.Mutex
+	slots     *fairSemaphore // nil while not waiting
+	waiter    *fairWaiter
+	solveTime time.Duration
+}
+
+// withQueueTicket returns ctx with a new ticket for the request.
+func withQueueTicket(ctx context.Context) (context.Context, *queueTicket) {
+	t := &queueTicket{}
+	return context.WithValue(ctx, queueTicketKey, t), t
+}
+
+// queueTicketFrom returns the ticket of ctx, or nil.
+func queueTicketFrom(ctx context.Context) *queueTicket {
+	t, _ := ctx.Value(queueTicketKey).(*queueTicket)
+	return t
+}
+
+// estimateWith sets the solve time wait estimates are based on.
+func (t *queueTicket) estimateWith(solveTime time.Duration) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.solveTime = solveTime
+	t.mu.Unlock()
+}
+
+// enter records that the request waits as w for a slot of s, or that it
+// stopped waiting if s is nil.
+func (t *queueTicket) enter(s *fairSemaphore, w *fairWaiter) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.slots, t.waiter = s, w
+	t.mu.Unlock()
+}
+
+// status returns where the request waits, or nil if it does not.
+func (t *queueTicket) status() *QueueStatus {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	slots, w, solveTime := t.slots, t.waiter, t.solveTime
+	t.mu.Unlock()
+	if slots == nil {
+		return nil
+	}
+	slots.mu.Lock()
+	position, capacity := slots.positionLocked(w), slots.capacity
+	slots.mu.Unlock()
+	status := &QueueStatus{Position: position}
+	// Every round of solves frees capacity slots
+	rounds := (position + capacity - 1) / capacity
+	status.EstimatedWaitMs = (time.Duration(rounds) * solveTime).Milliseconds()
+	return status
+}
+
+// tenantWeights are the relative shares of API keys in fair queueing.
+// Keys without a weight, including requests without a key, weigh 1.
+type tenantWeights map[string]float64
+
+// tenantWeightsFromEnv reads TENANT_WEIGHTS, e.g. "key-a=3,key-b=0.5".
+func tenantWeightsFromEnv() tenantWeights {
+	weights := make(tenantWeights)
+	for _, rule := range splitList(os.Getenv("TENANT_WEIGHTS")) {
+		key, value, ok := strings.Cut(rule, "=")
+		weight, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if !ok || err != nil || weight <= 0 {
+			slog.Warn("ignoring invalid TENANT_WEIGHTS rule", "rule", rule)
+			continue
+		}
+		weights[strings.TrimSpace(key)] = weight
+	}
+	return weights
+}
+
+func (w tenantWeights) of(tenant string) float64 {
+	if weight, ok := w[tenant]; ok {
+		return weight
+	}
+	return 1
+}
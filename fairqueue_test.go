@@ -0,0 +1,159 @@
+package flareproxy
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestFairSemaphore(t *testing.T) {
+	tests := []struct {
+		name    string
+		queued  []string // tenants in the order they start waiting
+		weights tenantWeights
+		grants  int
+		want    map[string]int // slots per tenant among the first grants
+	}{
+		{
+			name:   "bulk consumer cannot starve others",
+			queued: []string{"bulk", "bulk", "bulk", "bulk", "bulk", "bulk", "bulk", "bulk", "other", "other"},
+			grants: 4,
+			want:   map[string]int{"bulk": 2, "other": 2},
+		},
+		{
+			name:    "weights set the shares",
+			queued:  []string{"heavy", "heavy", "heavy", "heavy", "heavy", "heavy", "light", "light", "light", "light", "light", "light"},
+			weights: tenantWeights{"heavy": 2},
+			grants:  6,
+			want:    map[string]int{"heavy": 4, "light": 2},
+		},
+		{
+			name:   "a single tenant is served in order",
+			queued: []string{"only", "only", "only"},
+			grants: 3,
+			want:   map[string]int{"only": 3},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newFairSemaphore(1)
+			if !s.tryAcquire() {
+				t.Fatal("tryAcquire() on an idle semaphore failed")
+			}
+			granted := make(chan string, len(tt.queued))
+			for i, tenant := range tt.queued {
+				go func() {
+					if err := s.acquire(context.Background(), tenant, tt.weights.of(tenant), time.Minute); err == nil {
+						granted <- tenant
+					}
+				}()
+				waitForQueue(t, s, i+1)
+			}
+
+			got := make(map[string]int)
+			for range tt.grants {
+				s.release()
+				got[<-granted]++
+			}
+			for tenant, n := range tt.want {
+				if got[tenant] != n {
+					t.Errorf("first %d grants = %v, want %v", tt.grants, got, tt.want)
+					break
+				}
+			}
+			// Let the remaining waiters through
+			for range len(tt.queued) - tt.grants {
+				s.release()
+				<-granted
+			}
+		})
+	}
+}
+
+func TestFairSemaphoreGivingUp(t *testing.T) {
+	s := newFairSemaphore(1)
+	s.tryAcquire()
+
+	if err := s.acquire(context.Background(), "a", 1, 10*time.Millisecond); !errors.Is(err, errQueueTimeout) {
+		t.Errorf("acquire() error = %v, want queue timeout", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := s.acquire(ctx, "a", 1, time.Minute); !errors.Is(err, context.Canceled) {
+		t.Errorf("acquire() error = %v, want context canceled", err)
+	}
+
+	// Waiters that gave up leave the queue and do not hold slots
+	s.release()
+	if !s.tryAcquire() {
+		t.Error("slot not free after the waiters gave up")
+	}
+	if s.tryAcquire() {
+		t.Error("tryAcquire() exceeded the capacity")
+	}
+}
+
+func TestTenantWeightsFromEnv(t *testing.T) {
+	t.Setenv("TENANT_WEIGHTS", "premium=4, batch=0.5,broken,negative=-1")
+	weights := tenantWeightsFromEnv()
+	if len(weights) != 2 || weights.of("premium") != 4 || weights.of("batch") != 0.5 || weights.of("unknown") != 1 {
+		t.Errorf("weights = %v", weights)
+	}
+}
+
+func TestQueueTicket(t *testing.T) {
+	s := newFairSemaphore(1)
+	s.tryAcquire()
+	tickets := make([]*queueTicket, 2)
+	granted := make(chan int, len(tickets))
+	for i := range tickets {
+		ctx, ticket := withQueueTicket(context.Background())
+		ticket.estimateWith(10 * time.Second)
+		tickets[i] = ticket
+		go func() {
+			if err := s.acquire(ctx, "tenant", 1, time.Minute); err == nil {
+				granted <- i
+			}
+		}()
+		waitForQueue(t, s, i+1)
+	}
+	for i, ticket := range tickets {
+		want := QueueStatus{Position: i + 1, EstimatedWaitMs: int64(i+1) * 10000}
+		if got := ticket.status(); got == nil || *got != want {
+			t.Errorf("ticket %d status = %+v, want %+v", i, got, want)
+		}
+	}
+
+	s.release()
+	<-granted
+	waitForQueue(t, s, 1)
+	if got := tickets[1].status(); got == nil || got.Position != 1 {
+		t.Errorf("status after a release = %+v, want position 1", got)
+	}
+	s.release()
+	<-granted
+	if got := tickets[1].status(); got != nil {
+		t.Errorf("status after the grant = %+v, want nil", got)
+	}
+	if got := (*queueTicket)(nil).status(); got != nil {
+		t.Errorf("nil ticket status = %+v", got)
+	}
+}
+
+func waitForQueue(t *testing.T, s *fairSemaphore, n int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		s.mu.Lock()
+		waiting := s.waiting
+		s.mu.Unlock()
+		if waiting == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d requests waiting, want %d", waiting, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
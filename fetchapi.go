@@ -0,0 +1,52 @@
+package flareproxy
+
+import (
+	"net/http"
+	"net/url"
+)
+
+// FetchPath is the direct server's alternative to "/domain.com/path":
+// the target is passed whole in the url query parameter, so that ports,
+// userinfo and encoded slashes survive.
+const FetchPath = "/fetch"
+
+// queryOptionParams maps the query parameters of FetchPath to the headers
+// setting the same options.
+var queryOptionParams = map[string]string{
+	"session":  SessionHeader,
+	"timeout":  TimeoutHeader,
+	"proxy":    ProxyHeader,
+	"no_cache": NoCacheHeader,
+}
+
+// queryOptions copies the options given as query parameters of r into
+// the headers setting them, taking precedence over headers the client
+// sent.
+func queryOptions(r *http.Request) {
+	query := r.URL.Query()
+	for param, header := range queryOptionParams {
+		if query.Has(param) {
+			if param == "proxy" {
+				r.Header.Del(UpstreamProxyHeader)
+			}
+			r.Header.Set(header, query.Get(param))
+		}
+	}
+}
+
+// serveFetch serves FetchPath?url=... like the path based syntax,
+// except that the target's scheme is used as given, without falling back
+// from HTTPS to HTTP.
+func (d *DirectHandler) serveFetch(w http.ResponseWriter, r *http.Request) {
+	target := r.URL.Query().Get("url")
+	u, err := url.Parse(target)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		sendErrorStatus(w, r, http.StatusBadRequest, "url must be an absolute http or https URL, e.g. /fetch?url=https://example.com/")
+		return
+	}
+	req, ok := d.requestForMethod(w, r, FetchRequest{URL: target, RewriteLinks: d.rewriteLinks})
+	if !ok {
+		return
+	}
+	d.serve(w, r, req)
+}
@@ -0,0 +1,15 @@
+//go:build unix
+
+package flareproxy
+
+import (
+	"os"
+	"syscall"
+)
+
+// ownedByProcessUser reports whether the file described by info belongs
+// to the user running the proxy.
+func ownedByProcessUser(info os.FileInfo) bool {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	return ok && int(stat.Uid) == os.Getuid()
+}
@@ -0,0 +1,69 @@
+package flareproxy
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// configFlags are the command-line flags for the most common settings.
+// Each sets the environment variable of the same meaning, so flags take
+// precedence over the environment, which takes precedence over the
+// config file.
+var configFlags = []struct {
+	name     string
+	variable string
+	usage    string
+}{
+	{"flaresolverr-url", "FLARESOLVERR_URL", "FlareSolverr endpoint, or a comma separated list"},
+	{"port", "PORT", "port of the direct routing mode"},
+	{"proxy-port", "PROXY_PORT", "port of the HTTP proxy mode"},
+	{"socks-port", "SOCKS_PORT", "port of the SOCKS5 front-end"},
+	{"admin-port", "ADMIN_PORT", "port of the admin API"},
+	{"max-timeout", "FLARESOLVERR_MAX_TIMEOUT", "time FlareSolverr is given to solve a page"},
+	{"outbound-timeout", "OUTBOUND_TIMEOUT", "time limit for a call to FlareSolverr"},
+	{"shutdown-timeout", "SHUTDOWN_TIMEOUT", "time in-flight requests get to finish on shutdown"},
+	{"cache-ttl", "CACHE_TTL", "how long solved pages are cached"},
+	{"log-level", "LOG_LEVEL", "debug, info, warn or error"},
+	{"log-format", "LOG_FORMAT", "json or text"},
+}
+
+// ConfigFlags defines flags on fs for the common settings, and -set
+// NAME=value, repeatable, for any environment variable. The returned
+// function, called once fs is parsed, sets the variables of the flags
+// given, overriding the environment.
+func ConfigFlags(fs *flag.FlagSet) func() error {
+	values := make(map[string]*string, len(configFlags))
+	for _, f := range configFlags {
+		values[f.name] = fs.String(f.name, "", f.usage+" (overrides "+f.variable+")")
+	}
+	var sets []string
+	fs.Func("set", "set an environment variable, as NAME=value; repeatable", func(s string) error {
+		name, _, ok := strings.Cut(s, "=")
+		if !ok || name == "" || strings.ToUpper(name) != name {
+			return fmt.Errorf("want NAME=value, got %q", s)
+		}
+		sets = append(sets, s)
+		return nil
+	})
+
+	return func() error {
+		given := make(map[string]bool)
+		fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+		for _, f := range configFlags {
+			if given[f.name] {
+				if err := os.Setenv(f.variable, *values[f.name]); err != nil {
+					return err
+				}
+			}
+		}
+		for _, s := range sets {
+			name, value, _ := strings.Cut(s, "=")
+			if err := os.Setenv(name, value); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
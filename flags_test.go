@@ -0,0 +1,56 @@
+package flareproxy
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConfigFlags(t *testing.T) {
+	t.Setenv("PORT", "8000")
+	t.Setenv("PROXY_PORT", "8001")
+	for _, name := range []string{"SOCKS_PORT", "CACHE_TTL", "LOG_LEVEL"} {
+		t.Setenv(name, "")
+		os.Unsetenv(name)
+	}
+	t.Cleanup(func() { configOwned = make(map[string]bool) })
+	path := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(path, []byte("port = 7000\nproxy_port = 7001\nsocks_port = 7002\nlog_level = \"warn\"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	fs := flag.NewFlagSet("flareproxy", flag.ContinueOnError)
+	apply := ConfigFlags(fs)
+	if err := fs.Parse([]string{"-port", "9000", "-set", "CACHE_TTL=1h", "-set", "LOG_LEVEL=debug"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := apply(); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfigFile(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// Flags beat the environment, which beats the file
+	cfg := ConfigFromEnv()
+	if cfg.Port != "9000" || cfg.ProxyPort != "8001" || cfg.SOCKSPort != "7002" {
+		t.Errorf("ports = %q, %q, %q; want 9000, 8001, 7002", cfg.Port, cfg.ProxyPort, cfg.SOCKSPort)
+	}
+	if got := os.Getenv("CACHE_TTL"); got != "1h" {
+		t.Errorf("CACHE_TTL = %q, want 1h", got)
+	}
+	if got := os.Getenv("LOG_LEVEL"); got != "debug" {
+		t.Errorf("LOG_LEVEL = %q, want debug", got)
+	}
+
+	for _, bad := range []string{"CACHE_TTL", "cache_ttl=1h", "=1h"} {
+		fs := flag.NewFlagSet("flareproxy", flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		ConfigFlags(fs)
+		if err := fs.Parse([]string{"-set", bad}); err == nil {
+			t.Errorf("-set %s accepted", bad)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+// Package flaresolverr is a client for the FlareSolverr v1 API, which
+// solves Cloudflare challenges in a real browser.
+//
+//	client := flaresolverr.NewClient("http://localhost:8191/v1")
+//	resp, err := client.Get(ctx, "https://example.com/", flaresolverr.Options{})
+package flaresolverr
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// DefaultMaxTimeout is the time FlareSolverr is given to solve a page
+// unless Options.MaxTimeout says otherwise.
+const DefaultMaxTimeout = 60 * time.Second
+
+// ErrResponseTooLarge is returned for responses over MaxResponseBytes.
+var ErrResponseTooLarge = errors.New("response exceeds the size limit")
+
+// Client sends commands to a FlareSolverr instance.
+type Client struct {
+	// URL is the instance's API endpoint, e.g.
+	// "http://localhost:8191/v1".
+	URL string
+	// HTTPClient sends the commands; http.DefaultClient if nil. Solving
+	// takes a while, so its timeout must exceed the commands' MaxTimeout.
+	HTTPClient *http.Client
+	// Prepare, if set, is called with each HTTP request and its JSON body
+	// before it is sent, e.g. to add authentication headers.
+	Prepare func(req *http.Request, body []byte)
+	// Inspect, if set, is called with each HTTP response and its body
+	// before the body is decoded. An error fails the command, e.g. for a
+	// body not matching the expected schema.
+	Inspect func(resp *http.Response, body []byte) error
+	// MaxResponseBytes bounds the size of the JSON responses read, which
+	// are held in memory; zero means no limit.
+	MaxResponseBytes int64
+	// Dialect is the schema of the solver at URL; FlareSolverr if nil.
+	Dialect Dialect
+}
+
+// NewClient returns a client for the FlareSolverr API at url.
+func NewClient(url string) *Client {
+	return &Client{URL: url}
+}
+
+// Options are the optional parameters of request commands.
+type Options struct {
+	// Session runs the request in a session created with CreateSession,
+	// reusing its browser and cookies.
+	Session string
+	// Proxy is the proxy the browser connects through, for requests
+	// outside of a session.
+	Proxy *Proxy
+	// MaxTimeout bounds the solve; DefaultMaxTimeout if zero.
+	MaxTimeout time.Duration
+	// Cookies are set in the browser before the page is loaded.
+	Cookies []Cookie
+}
+
+func (o Options) request(cmd, url string) Request {
+	timeout := o.MaxTimeout
+	if timeout <= 0 {
+		timeout = DefaultMaxTimeout
+	}
+	return Request{
+		Cmd:        cmd,
+		URL:        url,
+		MaxTimeout: int(timeout.Milliseconds()),
+		Session:    o.Session,
+		Proxy:      o.Proxy,
+		Cookies:    o.Cookies,
+	}
+}
+
+// Get loads url in the browser and returns the solution.
+func (c *Client) Get(ctx context.Context, url string, opts Options) (*Response, error) {
+	return c.Do(ctx, opts.request(CmdRequestGet, url))
+}
+
+// Post submits postData, an application/x-www-form-urlencoded body, to
+// url in the browser and returns the solution.
+func (c *Client) Post(ctx context.Context, url, postData string, opts Options) (*Response, error) {
+	req := opts.request(CmdRequestPost, url)
+	req.PostData = postData
+	return c.Do(ctx, req)
+}
+
+// CreateSession starts a browser that keeps its cookies across requests,
+// connecting through proxy if not nil. An empty id lets FlareSolverr
+// choose one. It returns the session's ID.
+func (c *Client) CreateSession(ctx context.Context, id string, proxy *Proxy) (string, error) {
+	resp, err := c.Do(ctx, Request{Cmd: CmdSessionsCreate, Session: id, Proxy: proxy})
+	if err != nil {
+		return "", err
+	}
+	if resp.Session != "" {
+		return resp.Session, nil
+	}
+	return id, nil
+}
+
+// ListSessions returns the IDs of the instance's sessions.
+func (c *Client) ListSessions(ctx context.Context) ([]string, error) {
+	resp, err := c.Do(ctx, Request{Cmd: CmdSessionsList})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Sessions, nil
+}
+
+// DestroySession closes the browser of a session.
+func (c *Client) DestroySession(ctx context.Context, id string) error {
+	_, err := c.Do(ctx, Request{Cmd: CmdSessionsDestroy, Session: id})
+	return err
+}
+
+// Do sends a command in the schema of the Dialect. The solver answering
+// with a status other than "ok" is reported as an *Error, as are commands
+// the solver does not support.
+func (c *Client) Do(ctx context.Context, request Request) (*Response, error) {
+	dialect := c.Dialect
+	if dialect == nil {
+		dialect = FlareSolverr
+	}
+	if !dialect.Supports(request.Cmd) {
+		return nil, unsupported(dialect, request.Cmd)
+	}
+	jsonData, err := dialect.EncodeRequest(request)
+	var solverErr *Error
+	if errors.As(err, &solverErr) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to marshal request: %v", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.URL, bytes.NewReader(jsonData))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.Prepare != nil {
+		c.Prepare(req, jsonData)
+	}
+
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to connect to FlareSolverr: %w", err)
+	}
+	defer resp.Body.Close()
+	reader := io.Reader(resp.Body)
+	if c.MaxResponseBytes > 0 {
+		reader = io.LimitReader(resp.Body, c.MaxResponseBytes+1)
+	}
+	body, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read response: %v", err)
+	}
+	if c.MaxResponseBytes > 0 && int64(len(body)) > c.MaxResponseBytes {
+		return nil, fmt.Errorf("Failed to read response: %w", ErrResponseTooLarge)
+	}
+	if c.Inspect != nil {
+		if err := c.Inspect(resp, body); err != nil {
+			return nil, err
+		}
+	}
+
+	response, err := dialect.DecodeResponse(body)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse response: %v", err)
+	}
+	if response.Status != "ok" {
+		return response, &Error{Message: response.Message}
+	}
+	return response, nil
+}
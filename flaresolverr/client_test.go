@@ -0,0 +1,215 @@
+package flaresolverr
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeFlareSolverr answers commands like FlareSolverr, recording them.
+func fakeFlareSolverr(t *testing.T, requests *[]Request) *httptest.Server {
+	t.Helper()
+	sessions := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req Request
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decoding request: %v", err)
+		}
+		*requests = append(*requests, req)
+		resp := Response{Status: "ok", Message: "", Version: "3.3.21"}
+		switch req.Cmd {
+		case CmdRequestGet, CmdRequestPost:
+			if strings.Contains(req.URL, "unsolvable") {
+				resp = Response{Status: "error", Message: "Error solving the challenge. Timeout after 60.0 seconds."}
+				break
+			}
+			resp.Solution = Solution{
+				URL:       req.URL,
+				Status:    200,
+				Response:  "<html>" + req.Cmd + " " + req.PostData + "</html>",
+				Cookies:   []Cookie{{Name: "cf_clearance", Value: "abc", Domain: ".example.com", Path: "/", Expires: 1900000000, SameSite: "Lax"}},
+				UserAgent: "Mozilla/5.0",
+			}
+		case CmdSessionsCreate:
+			resp.Session = req.Session
+			if resp.Session == "" {
+				resp.Session = "generated"
+			}
+			sessions = append(sessions, resp.Session)
+		case CmdSessionsList:
+			resp.Sessions = sessions
+		case CmdSessionsDestroy:
+			if len(sessions) == 0 || sessions[0] != req.Session {
+				resp = Response{Status: "error", Message: "The session doesn't exist."}
+				break
+			}
+			sessions = sessions[1:]
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestClientRequests(t *testing.T) {
+	var requests []Request
+	client := NewClient(fakeFlareSolverr(t, &requests).URL)
+	ctx := context.Background()
+
+	resp, err := client.Get(ctx, "https://example.com/", Options{Session: "s1", MaxTimeout: 30 * time.Second})
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if resp.Solution.Response != "<html>request.get </html>" || resp.Solution.UserAgent != "Mozilla/5.0" || resp.Version != "3.3.21" {
+		t.Errorf("Get() = %+v", resp)
+	}
+	if got := requests[0]; got.Cmd != CmdRequestGet || got.URL != "https://example.com/" || got.Session != "s1" || got.MaxTimeout != 30000 {
+		t.Errorf("request = %+v", got)
+	}
+
+	if _, err := client.Post(ctx, "https://example.com/login", "a=b", Options{Proxy: &Proxy{URL: "http://proxy:3128"}}); err != nil {
+		t.Fatalf("Post() error = %v", err)
+	}
+	if got := requests[1]; got.Cmd != CmdRequestPost || got.PostData != "a=b" || got.Proxy == nil || got.MaxTimeout != int(DefaultMaxTimeout.Milliseconds()) {
+		t.Errorf("request = %+v", got)
+	}
+
+	cookie := resp.Solution.Cookies[0].HTTPCookie()
+	if cookie.Name != "cf_clearance" || cookie.SameSite != http.SameSiteLaxMode || cookie.Expires.Unix() != 1900000000 {
+		t.Errorf("HTTPCookie() = %+v", cookie)
+	}
+
+	_, err = client.Get(ctx, "https://unsolvable.example/", Options{})
+	var solverErr *Error
+	if !errors.As(err, &solverErr) || !strings.Contains(solverErr.Message, "Timeout") {
+		t.Errorf("Get() error = %v, want an *Error", err)
+	}
+}
+
+func TestClientSessions(t *testing.T) {
+	var requests []Request
+	client := NewClient(fakeFlareSolverr(t, &requests).URL)
+	ctx := context.Background()
+
+	if id, err := client.CreateSession(ctx, "", nil); err != nil || id != "generated" {
+		t.Fatalf("CreateSession() = %q, %v", id, err)
+	}
+	if id, err := client.CreateSession(ctx, "mine", &Proxy{URL: "http://proxy:3128"}); err != nil || id != "mine" {
+		t.Fatalf("CreateSession() = %q, %v", id, err)
+	}
+	sessions, err := client.ListSessions(ctx)
+	if err != nil || strings.Join(sessions, ",") != "generated,mine" {
+		t.Errorf("ListSessions() = %v, %v", sessions, err)
+	}
+	if err := client.DestroySession(ctx, "generated"); err != nil {
+		t.Errorf("DestroySession() error = %v", err)
+	}
+	if err := client.DestroySession(ctx, "unknown"); err == nil {
+		t.Error("DestroySession() of an unknown session succeeded")
+	}
+}
+
+func TestClientHooks(t *testing.T) {
+	var requests []Request
+	server := fakeFlareSolverr(t, &requests)
+	var signed []byte
+	client := &Client{
+		URL: server.URL,
+		Prepare: func(req *http.Request, body []byte) {
+			req.Header.Set("X-Secret", "s3cret")
+			signed = body
+		},
+		Inspect: func(resp *http.Response, body []byte) error {
+			if !strings.Contains(string(body), `"version"`) {
+				return errors.New("no version")
+			}
+			return nil
+		},
+	}
+	if _, err := client.ListSessions(context.Background()); err != nil {
+		t.Fatalf("ListSessions() error = %v", err)
+	}
+	if string(signed) != `{"cmd":"sessions.list"}` {
+		t.Errorf("Prepare() body = %s", signed)
+	}
+
+	client.Inspect = func(*http.Response, []byte) error { return errors.New("rejected") }
+	if _, err := client.ListSessions(context.Background()); err == nil || err.Error() != "rejected" {
+		t.Errorf("ListSessions() error = %v, want the Inspect error", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := client.Get(ctx, "https://example.com/", Options{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Get() with a canceled context error = %v", err)
+	}
+}
+
+func TestClientMaxResponseBytes(t *testing.T) {
+	var requests []Request
+	server := fakeFlareSolverr(t, &requests)
+	client := &Client{URL: server.URL, MaxResponseBytes: 64}
+	if _, err := client.Get(context.Background(), "https://example.com/", Options{}); !errors.Is(err, ErrResponseTooLarge) {
+		t.Errorf("Get() error = %v, want ErrResponseTooLarge", err)
+	}
+	client.MaxResponseBytes = 1 << 20
+	if _, err := client.Get(context.Background(), "https://example.com/", Options{}); err != nil {
+		t.Errorf("Get() error = %v under the limit", err)
+	}
+}
+
+func TestByparrDialect(t *testing.T) {
+	var bodies []map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		json.NewDecoder(r.Body).Decode(&body)
+		bodies = append(bodies, body)
+		w.Write([]byte(`{"status":"ok","message":"","solution":{"url":"https://example.com/","status":200,"cookies":[],"userAgent":"Mozilla/5.0","headers":{},"response":"<html></html>"},"startTimestamp":1790000000,"endTimestamp":1790000004,"version":"1.2.0"}`))
+	}))
+	defer server.Close()
+	dialect, err := DialectFor("Byparr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &Client{URL: server.URL, Dialect: dialect}
+	ctx := context.Background()
+
+	resp, err := client.Get(ctx, "https://example.com/", Options{MaxTimeout: 1500 * time.Millisecond, Cookies: []Cookie{{Name: "a", Value: "b"}}})
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if resp.Solution.Response != "<html></html>" || !resp.EndTime().Equal(time.Unix(1790000004, 0)) {
+		t.Errorf("Get() = %+v", resp)
+	}
+	if len(bodies) != 1 || len(bodies[0]) != 3 || bodies[0]["cmd"] != CmdRequestGet || bodies[0]["maxTimeout"] != 2.0 {
+		t.Errorf("request bodies = %v, want cmd, url and maxTimeout in seconds", bodies)
+	}
+
+	unsupported := []func() error{
+		func() error { _, err := client.Post(ctx, "https://example.com/", "a=b", Options{}); return err },
+		func() error { _, err := client.Get(ctx, "https://example.com/", Options{Session: "s1"}); return err },
+		func() error {
+			_, err := client.Get(ctx, "https://example.com/", Options{Proxy: &Proxy{URL: "http://proxy:3128"}})
+			return err
+		},
+		func() error { _, err := client.ListSessions(ctx); return err },
+	}
+	for i, call := range unsupported {
+		var solverErr *Error
+		if err := call(); !errors.As(err, &solverErr) || !strings.Contains(solverErr.Message, "not supported by byparr") {
+			t.Errorf("unsupported call %d error = %v", i, err)
+		}
+	}
+	if len(bodies) != 1 {
+		t.Errorf("unsupported commands were sent: %v", bodies[1:])
+	}
+
+	if _, err := DialectFor("cloudscraper"); err == nil {
+		t.Error("DialectFor() of an unknown solver succeeded")
+	}
+}
@@ -0,0 +1,110 @@
+package flaresolverr
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Dialect maps commands and responses between the FlareSolverr API and
+// the JSON schema of a solver, so that drop-in replacements for
+// FlareSolverr whose schema differs slightly work through Client.
+type Dialect interface {
+	// Name identifies the solver, e.g. "flaresolverr".
+	Name() string
+	// Supports reports whether the solver implements cmd. Client fails
+	// other commands with an *Error without sending them.
+	Supports(cmd string) bool
+	// EncodeRequest returns the JSON body of request. Requests the solver
+	// cannot carry out as asked fail with an *Error.
+	EncodeRequest(request Request) ([]byte, error)
+	// DecodeResponse parses the JSON body of an answer.
+	DecodeResponse(body []byte) (*Response, error)
+}
+
+// The dialects of the solvers this package knows.
+var (
+	// FlareSolverr speaks the FlareSolverr v1 API, the default.
+	FlareSolverr Dialect = flareSolverrDialect{}
+	// Byparr speaks the API of Byparr, which takes FlareSolverr's
+	// request.get with the time limit in seconds, and has neither
+	// sessions, request.post nor per-request proxies. Cookies to set in
+	// the browser are left out.
+	Byparr Dialect = byparrDialect{}
+)
+
+// DialectFor returns the dialect of the solver with the given name, as
+// returned by Dialect.Name.
+func DialectFor(name string) (Dialect, error) {
+	for _, d := range []Dialect{FlareSolverr, Byparr} {
+		if strings.EqualFold(name, d.Name()) {
+			return d, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown solver %q, want flaresolverr or byparr", name)
+}
+
+// unsupported returns the error of a request a solver cannot carry out.
+// Its message reads as a definitive failure, not worth retrying.
+func unsupported(d Dialect, what string) error {
+	return &Error{Message: fmt.Sprintf("%s is not supported by %s", what, d.Name())}
+}
+
+type flareSolverrDialect struct{}
+
+func (flareSolverrDialect) Name() string { return "flaresolverr" }
+
+func (flareSolverrDialect) Supports(cmd string) bool { return true }
+
+func (flareSolverrDialect) EncodeRequest(request Request) ([]byte, error) {
+	return json.Marshal(request)
+}
+
+func (flareSolverrDialect) DecodeResponse(body []byte) (*Response, error) {
+	response := &Response{}
+	if err := json.Unmarshal(body, response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+type byparrDialect struct{}
+
+// byparrRequest is a command as Byparr reads it.
+type byparrRequest struct {
+	Cmd string `json:"cmd"`
+	URL string `json:"url"`
+	// MaxTimeout is in seconds.
+	MaxTimeout int `json:"maxTimeout,omitempty"`
+}
+
+func (byparrDialect) Name() string { return "byparr" }
+
+func (byparrDialect) Supports(cmd string) bool { return cmd == CmdRequestGet }
+
+func (d byparrDialect) EncodeRequest(request Request) ([]byte, error) {
+	switch {
+	case request.Session != "":
+		return nil, unsupported(d, "running requests in a session")
+	case request.Proxy != nil:
+		return nil, unsupported(d, "a proxy per request")
+	}
+	// Round up, so that a limit below a second does not become none
+	return json.Marshal(byparrRequest{
+		Cmd:        request.Cmd,
+		URL:        request.URL,
+		MaxTimeout: (request.MaxTimeout + 999) / 1000,
+	})
+}
+
+func (byparrDialect) DecodeResponse(body []byte) (*Response, error) {
+	response := &Response{}
+	if err := json.Unmarshal(body, response); err != nil {
+		return nil, err
+	}
+	// Timestamps in seconds are taken to milliseconds, like FlareSolverr's
+	if response.EndTimestamp > 0 && response.EndTimestamp < 1e11 {
+		response.EndTimestamp *= 1000
+	}
+	return response, nil
+}
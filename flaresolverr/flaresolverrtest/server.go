@@ -0,0 +1,301 @@
+// Package flaresolverrtest provides a fake FlareSolverr for tests of
+// FlareSolverr clients and of programs fetching through flareproxygo. It
+// answers the commands of the v1 API with configurable pages, and can
+// inject latency, errors and Cloudflare challenges.
+//
+//	fs := flaresolverrtest.NewServer()
+//	defer fs.Close()
+//	fs.SetPage("https://example.com/", flaresolverrtest.Page{Body: "<html>hi</html>"})
+//	client := flaresolverr.NewClient(fs.Endpoint())
+package flaresolverrtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/kljensen/flareproxygo/flaresolverr"
+)
+
+// DefaultUserAgent is the User-Agent a Server reports unless told
+// otherwise.
+const DefaultUserAgent = "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36"
+
+// DefaultVersion is the FlareSolverr version a Server reports unless told
+// otherwise.
+const DefaultVersion = "3.3.21"
+
+// Page is what the fake browser finds at a URL.
+type Page struct {
+	// Status is the origin's status code; 200 if zero.
+	Status int
+	// Body is the page; a small HTML page naming the URL if empty.
+	Body string
+	// Headers are the origin's response headers.
+	Headers map[string]string
+	// Cookies are set by the page.
+	Cookies []flaresolverr.Cookie
+	// Challenge puts the page behind a Cloudflare challenge, which the
+	// solve passes, adding a cf_clearance cookie to the solution.
+	Challenge bool
+	// Error fails solves of the page with this FlareSolverr error
+	// message, as for a challenge that cannot be solved.
+	Error string
+	// Latency is added to the server's latency for solves of the page.
+	Latency time.Duration
+}
+
+// Server is a fake FlareSolverr instance. Its methods are safe for
+// concurrent use, so the fake can be reconfigured while serving.
+type Server struct {
+	*httptest.Server
+
+	mu          sync.Mutex
+	userAgent   string
+	version     string
+	latency     time.Duration
+	pages       map[string]Page
+	sessions    map[string]bool
+	failures    []failure
+	requests    []flaresolverr.Request
+	nextSession int
+}
+
+// failure is an injected failure of the next request command.
+type failure struct {
+	status  int    // HTTP status, or 0 for a FlareSolverr error
+	message string // FlareSolverr error message
+}
+
+// NewServer starts a fake FlareSolverr. Close it when done.
+func NewServer() *Server {
+	s := &Server{
+		userAgent: DefaultUserAgent,
+		version:   DefaultVersion,
+		pages:     make(map[string]Page),
+		sessions:  make(map[string]bool),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// Endpoint returns the API endpoint to configure clients with, the
+// server's URL followed by /v1.
+func (s *Server) Endpoint() string {
+	return s.URL + "/v1"
+}
+
+// SetPage sets the page found at url. Pages are looked up by the exact
+// URL of the request command.
+func (s *Server) SetPage(url string, page Page) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pages[url] = page
+}
+
+// SetLatency makes every request command take at least d, or until the
+// client gives up.
+func (s *Server) SetLatency(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latency = d
+}
+
+// SetUserAgent sets the User-Agent reported in solutions.
+func (s *Server) SetUserAgent(userAgent string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.userAgent = userAgent
+}
+
+// SetVersion sets the FlareSolverr version reported in responses.
+func (s *Server) SetVersion(version string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.version = version
+}
+
+// FailNext fails the next n request commands with a FlareSolverr error
+// carrying message.
+func (s *Server) FailNext(n int, message string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for range n {
+		s.failures = append(s.failures, failure{message: message})
+	}
+}
+
+// FailNextHTTP answers the next n request commands with the HTTP status
+// and no body, as a crashing or overloaded instance would.
+func (s *Server) FailNextHTTP(n, status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for range n {
+		s.failures = append(s.failures, failure{status: status})
+	}
+}
+
+// Requests returns the commands received so far.
+func (s *Server) Requests() []flaresolverr.Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]flaresolverr.Request(nil), s.requests...)
+}
+
+// Sessions returns the IDs of the open sessions, sorted.
+func (s *Server) Sessions() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sessionIDs()
+}
+
+func (s *Server) sessionIDs() []string {
+	ids := make([]string, 0, len(s.sessions))
+	for id := range s.sessions {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		s.mu.Lock()
+		ready := map[string]string{"msg": "FlareSolverr is ready!", "version": s.version, "userAgent": s.userAgent}
+		s.mu.Unlock()
+		writeJSON(w, http.StatusOK, ready)
+		return
+	}
+	var req flaresolverr.Request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusInternalServerError, errorResponse("Request parameter 'cmd' is mandatory."))
+		return
+	}
+	start := time.Now()
+	status, resp, latency := s.handle(req)
+	if latency > 0 {
+		select {
+		case <-time.After(latency):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	if status != http.StatusOK && resp == nil {
+		w.WriteHeader(status)
+		return
+	}
+	resp.StartTimestamp = start.UnixMilli()
+	resp.EndTimestamp = time.Now().UnixMilli()
+	writeJSON(w, status, resp)
+}
+
+// handle answers a command, returning the HTTP status, the response and
+// the time the command is to take.
+func (s *Server) handle(req flaresolverr.Request) (int, *response, time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = append(s.requests, req)
+	resp := &response{Response: flaresolverr.Response{Status: "ok", Version: s.version}}
+	switch req.Cmd {
+	case flaresolverr.CmdSessionsCreate:
+		id := req.Session
+		if id == "" {
+			s.nextSession++
+			id = fmt.Sprintf("session-%d", s.nextSession)
+		}
+		if s.sessions[id] {
+			resp.Message = "Session already exists."
+		} else {
+			resp.Message = "Session created successfully."
+		}
+		s.sessions[id] = true
+		resp.Session = id
+	case flaresolverr.CmdSessionsList:
+		resp.Sessions = s.sessionIDs()
+	case flaresolverr.CmdSessionsDestroy:
+		if !s.sessions[req.Session] {
+			return http.StatusInternalServerError, errorResponse("The session doesn't exist."), 0
+		}
+		delete(s.sessions, req.Session)
+		resp.Message = "The session has been removed."
+	case flaresolverr.CmdRequestGet, flaresolverr.CmdRequestPost:
+		return s.solve(req, resp)
+	default:
+		return http.StatusInternalServerError, errorResponse(fmt.Sprintf("Request parameter 'cmd' = '%s' is invalid.", req.Cmd)), 0
+	}
+	return http.StatusOK, resp, 0
+}
+
+// solve answers a request command. s.mu must be held.
+func (s *Server) solve(req flaresolverr.Request, resp *response) (int, *response, time.Duration) {
+	latency := s.latency
+	if len(s.failures) > 0 {
+		f := s.failures[0]
+		s.failures = s.failures[1:]
+		if f.status != 0 {
+			return f.status, nil, latency
+		}
+		return http.StatusInternalServerError, errorResponse(f.message), latency
+	}
+	if req.URL == "" {
+		return http.StatusInternalServerError, errorResponse("Request parameter 'url' is mandatory in 'request.get' command."), 0
+	}
+	if req.Session != "" && !s.sessions[req.Session] {
+		return http.StatusInternalServerError, errorResponse("Error: The session doesn't exist."), latency
+	}
+	page := s.pages[req.URL]
+	latency += page.Latency
+	if page.Error != "" {
+		return http.StatusInternalServerError, errorResponse(page.Error), latency
+	}
+	resp.Message = "Challenge not detected!"
+	solution := flaresolverr.Solution{
+		URL:       req.URL,
+		Status:    page.Status,
+		Response:  page.Body,
+		Headers:   page.Headers,
+		Cookies:   append(append([]flaresolverr.Cookie{}, req.Cookies...), page.Cookies...),
+		UserAgent: s.userAgent,
+	}
+	if solution.Status == 0 {
+		solution.Status = http.StatusOK
+	}
+	if solution.Response == "" {
+		solution.Response = "<html><head><title>" + req.URL + "</title></head><body>" + req.URL + "</body></html>"
+	}
+	if page.Challenge {
+		resp.Message = "Challenge solved!"
+		solution.Cookies = append(solution.Cookies, flaresolverr.Cookie{
+			Name:     "cf_clearance",
+			Value:    fmt.Sprintf("fake-clearance-%d", len(s.requests)),
+			Path:     "/",
+			Expires:  float64(time.Now().Add(time.Hour).Unix()),
+			HTTPOnly: true,
+			Secure:   true,
+			SameSite: "None",
+		})
+	}
+	resp.Solution = solution
+	return http.StatusOK, resp, latency
+}
+
+// response adds the fields FlareSolverr reports that flaresolverr.Response
+// does not decode.
+type response struct {
+	flaresolverr.Response
+	StartTimestamp int64 `json:"startTimestamp,omitempty"`
+}
+
+func errorResponse(message string) *response {
+	return &response{Response: flaresolverr.Response{Status: "error", Message: message}}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,111 @@
+package flaresolverrtest
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kljensen/flareproxygo/flaresolverr"
+)
+
+func TestServer(t *testing.T) {
+	fs := NewServer()
+	defer fs.Close()
+	fs.SetPage("https://example.com/", Page{Body: "<html>hi</html>", Status: http.StatusNotFound})
+	fs.SetPage("https://protected.example/", Page{Challenge: true})
+	fs.SetPage("https://broken.example/", Page{Error: "Error solving the challenge. Timeout after 60.0 seconds."})
+	client := flaresolverr.NewClient(fs.Endpoint())
+	ctx := context.Background()
+
+	tests := []struct {
+		url         string
+		wantBody    string
+		wantStatus  int
+		wantMessage string
+		wantCookie  bool
+		wantErr     bool
+	}{
+		{url: "https://example.com/", wantBody: "<html>hi</html>", wantStatus: 404, wantMessage: "Challenge not detected!"},
+		{url: "https://other.example/", wantBody: "https://other.example/", wantStatus: 200},
+		{url: "https://protected.example/", wantStatus: 200, wantMessage: "Challenge solved!", wantCookie: true},
+		{url: "https://broken.example/", wantErr: true},
+	}
+	for _, tt := range tests {
+		resp, err := client.Get(ctx, tt.url, flaresolverr.Options{})
+		var solverErr *flaresolverr.Error
+		if tt.wantErr {
+			if !errors.As(err, &solverErr) {
+				t.Errorf("Get(%s) error = %v, want a FlareSolverr error", tt.url, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Get(%s) error = %v", tt.url, err)
+		}
+		if !strings.Contains(resp.Solution.Response, tt.wantBody) || resp.Solution.Status != tt.wantStatus ||
+			(tt.wantMessage != "" && resp.Message != tt.wantMessage) {
+			t.Errorf("Get(%s) = %d %q %q", tt.url, resp.Solution.Status, resp.Message, resp.Solution.Response)
+		}
+		hasCookie := len(resp.Solution.Cookies) == 1 && resp.Solution.Cookies[0].Name == "cf_clearance"
+		if hasCookie != tt.wantCookie || resp.Solution.UserAgent != DefaultUserAgent || resp.Version != DefaultVersion {
+			t.Errorf("Get(%s) cookies %+v from %q, version %q", tt.url, resp.Solution.Cookies, resp.Solution.UserAgent, resp.Version)
+		}
+	}
+	if got := len(fs.Requests()); got != len(tests) {
+		t.Errorf("Requests() has %d commands, want %d", got, len(tests))
+	}
+}
+
+func TestServerFailures(t *testing.T) {
+	fs := NewServer()
+	defer fs.Close()
+	client := flaresolverr.NewClient(fs.Endpoint())
+	ctx := context.Background()
+
+	fs.FailNext(1, "Error: boom")
+	fs.FailNextHTTP(1, http.StatusServiceUnavailable)
+	var solverErr *flaresolverr.Error
+	if _, err := client.Get(ctx, "https://example.com/", flaresolverr.Options{}); !errors.As(err, &solverErr) || solverErr.Message != "Error: boom" {
+		t.Errorf("first Get() error = %v, want the injected error", err)
+	}
+	if _, err := client.Get(ctx, "https://example.com/", flaresolverr.Options{}); err == nil || errors.As(err, &solverErr) {
+		t.Errorf("second Get() error = %v, want a failed response", err)
+	}
+	if _, err := client.Get(ctx, "https://example.com/", flaresolverr.Options{}); err != nil {
+		t.Errorf("third Get() error = %v", err)
+	}
+
+	fs.SetLatency(time.Second)
+	timeout, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := client.Get(timeout, "https://example.com/", flaresolverr.Options{}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Get() with latency error = %v, want the deadline", err)
+	}
+}
+
+func TestServerSessions(t *testing.T) {
+	fs := NewServer()
+	defer fs.Close()
+	client := flaresolverr.NewClient(fs.Endpoint())
+	ctx := context.Background()
+
+	id, err := client.CreateSession(ctx, "", nil)
+	if err != nil || id == "" {
+		t.Fatalf("CreateSession() = %q, %v", id, err)
+	}
+	if _, err := client.Get(ctx, "https://example.com/", flaresolverr.Options{Session: id}); err != nil {
+		t.Errorf("Get() in session error = %v", err)
+	}
+	if _, err := client.Get(ctx, "https://example.com/", flaresolverr.Options{Session: "gone"}); err == nil {
+		t.Error("Get() in an unknown session succeeded")
+	}
+	if ids, err := client.ListSessions(ctx); err != nil || len(ids) != 1 || ids[0] != id {
+		t.Errorf("ListSessions() = %v, %v", ids, err)
+	}
+	if err := client.DestroySession(ctx, id); err != nil || len(fs.Sessions()) != 0 {
+		t.Errorf("DestroySession() error = %v, sessions %v", err, fs.Sessions())
+	}
+}
@@ -0,0 +1,131 @@
+package flaresolverr
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Commands of the FlareSolverr v1 API.
+const (
+	CmdRequestGet      = "request.get"
+	CmdRequestPost     = "request.post"
+	CmdSessionsCreate  = "sessions.create"
+	CmdSessionsList    = "sessions.list"
+	CmdSessionsDestroy = "sessions.destroy"
+)
+
+// Request is a command sent to FlareSolverr.
+type Request struct {
+	Cmd        string `json:"cmd"`
+	URL        string `json:"url,omitempty"`
+	MaxTimeout int    `json:"maxTimeout,omitempty"`
+	Session    string `json:"session,omitempty"`
+	Proxy      *Proxy `json:"proxy,omitempty"`
+	// PostData is the application/x-www-form-urlencoded body of
+	// request.post commands.
+	PostData string `json:"postData,omitempty"`
+	// Cookies are set in the browser before the page is loaded.
+	Cookies []Cookie `json:"cookies,omitempty"`
+	// SessionTTLMinutes rotates the session's browser after the given
+	// age; only used with request commands naming a session.
+	SessionTTLMinutes int `json:"session_ttl_minutes,omitempty"`
+}
+
+// Proxy is the proxy FlareSolverr's browser connects through.
+// Credentials are passed separately from the URL.
+type Proxy struct {
+	URL      string `json:"url"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+// Cookie is a cookie returned by FlareSolverr in a solution. Most notably
+// this includes cf_clearance, which can be reused against the origin as
+// long as the same User-Agent is sent.
+type Cookie struct {
+	Name     string  `json:"name"`
+	Value    string  `json:"value"`
+	Domain   string  `json:"domain"`
+	Path     string  `json:"path"`
+	Expires  float64 `json:"expires"`
+	Size     int     `json:"size"`
+	HTTPOnly bool    `json:"httpOnly"`
+	Secure   bool    `json:"secure"`
+	Session  bool    `json:"session"`
+	SameSite string  `json:"sameSite"`
+}
+
+// HTTPCookie converts a FlareSolverr cookie into an http.Cookie suitable
+// for a Set-Cookie header.
+func (c Cookie) HTTPCookie() *http.Cookie {
+	cookie := &http.Cookie{
+		Name:     c.Name,
+		Value:    c.Value,
+		Domain:   c.Domain,
+		Path:     c.Path,
+		HttpOnly: c.HTTPOnly,
+		Secure:   c.Secure,
+	}
+	// Session cookies are reported with an expiry of -1
+	if !c.Session && c.Expires > 0 {
+		cookie.Expires = time.Unix(int64(c.Expires), 0).UTC()
+	}
+	switch strings.ToLower(c.SameSite) {
+	case "strict":
+		cookie.SameSite = http.SameSiteStrictMode
+	case "lax":
+		cookie.SameSite = http.SameSiteLaxMode
+	case "none":
+		cookie.SameSite = http.SameSiteNoneMode
+	}
+	return cookie
+}
+
+// Solution is the page FlareSolverr's browser ended up on.
+type Solution struct {
+	// URL is the page's final URL, after redirects.
+	URL       string   `json:"url,omitempty"`
+	Response  string   `json:"response"`
+	Status    int      `json:"status"`
+	Cookies   []Cookie `json:"cookies"`
+	UserAgent string   `json:"userAgent"`
+	// Headers are the origin's response headers. Recent FlareSolverr
+	// versions leave them empty.
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// Response is FlareSolverr's answer to a command.
+type Response struct {
+	Solution Solution `json:"solution"`
+	Status   string   `json:"status"`
+	Message  string   `json:"message"`
+	Version  string   `json:"version,omitempty"`
+	// Session is the ID of the session created by sessions.create.
+	Session string `json:"session,omitempty"`
+	// Sessions are the IDs listed by sessions.list.
+	Sessions []string `json:"sessions,omitempty"`
+	// EndTimestamp is when the solve finished, in milliseconds since the
+	// epoch.
+	EndTimestamp int64 `json:"endTimestamp,omitempty"`
+}
+
+// EndTime returns when the solve finished, or the zero time if
+// FlareSolverr did not report it.
+func (r *Response) EndTime() time.Time {
+	if r.EndTimestamp == 0 {
+		return time.Time{}
+	}
+	return time.UnixMilli(r.EndTimestamp).UTC()
+}
+
+// Error is returned when FlareSolverr answers with a status other than
+// "ok", e.g. because the challenge could not be solved.
+type Error struct {
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("FlareSolverr error: %s", e.Message)
+}
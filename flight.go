@@ -0,0 +1,85 @@
+package flareproxy
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"slices"
+	"sync"
+)
+
+// flightGroup collapses identical solves running at the same time into
+// one, so that clients asking for the same page at once, as indexers do
+// on refresh, share a single browser solve instead of queueing one each.
+// It is a hand-written singleflight, to keep the binary free of
+// dependencies.
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+// flight is a solve in progress; its result is set before done is closed.
+type flight struct {
+	done     chan struct{}
+	response *FlareSolverrResponse
+	meta     responseMeta
+	err      error
+}
+
+// newFlightGroupFromEnv returns the flight group, or nil if
+// DEDUPLICATE_SOLVES is false.
+func newFlightGroupFromEnv() *flightGroup {
+	if !envBool("DEDUPLICATE_SOLVES", true) {
+		return nil
+	}
+	return &flightGroup{flights: make(map[string]*flight)}
+}
+
+// do runs solve, unless a solve with the same key is in flight, in which
+// case it waits for that one and returns a copy of its result, reporting
+// it as shared. A shared solve that failed because its own client went
+// away is run again for the callers still waiting.
+func (g *flightGroup) do(ctx context.Context, key string, solve func() (*FlareSolverrResponse, responseMeta, error)) (response *FlareSolverrResponse, meta responseMeta, shared bool, err error) {
+	if g == nil || key == "" {
+		response, meta, err = solve()
+		return response, meta, false, err
+	}
+	g.mu.Lock()
+	if f, ok := g.flights[key]; ok {
+		g.mu.Unlock()
+		select {
+		case <-f.done:
+		case <-ctx.Done():
+			return nil, responseMeta{}, true, ctx.Err()
+		}
+		if errors.Is(f.err, context.Canceled) && ctx.Err() == nil {
+			return g.do(ctx, key, solve)
+		}
+		return copyResponse(f.response), f.meta, true, f.err
+	}
+	f := &flight{done: make(chan struct{})}
+	g.flights[key] = f
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.flights, key)
+		g.mu.Unlock()
+		close(f.done)
+	}()
+	f.response, f.meta, f.err = solve()
+	return f.response, f.meta, false, f.err
+}
+
+// copyResponse returns a copy of r that can be changed without affecting
+// r, or nil.
+func copyResponse(r *FlareSolverrResponse) *FlareSolverrResponse {
+	if r == nil {
+		return nil
+	}
+	c := *r
+	c.Solution.Cookies = slices.Clone(r.Solution.Cookies)
+	c.Solution.Headers = maps.Clone(r.Solution.Headers)
+	c.Sessions = slices.Clone(r.Sessions)
+	return &c
+}
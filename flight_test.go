@@ -0,0 +1,121 @@
+package flareproxy
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kljensen/flareproxygo/flaresolverr/flaresolverrtest"
+)
+
+func TestDeduplicateSolves(t *testing.T) {
+	tests := []struct {
+		name  string
+		dedup string
+		// timeouts gives each request its own X-FlareProxy-Timeout
+		timeouts   bool
+		wantSolves int
+	}{
+		{name: "collapsed", dedup: "true", wantSolves: 1},
+		{name: "different options", dedup: "true", timeouts: true, wantSolves: 5},
+		{name: "disabled", dedup: "false", wantSolves: 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := flaresolverrtest.NewServer()
+			defer fs.Close()
+			fs.SetLatency(200 * time.Millisecond)
+			t.Setenv("FLARESOLVERR_URL", fs.Endpoint())
+			t.Setenv("DEDUPLICATE_SOLVES", tt.dedup)
+			t.Setenv("CACHE_TTL", "1h")
+			s := newSolver()
+			cache := &countingCache{Cache: s.cache}
+			s.cache = cache
+
+			var wg sync.WaitGroup
+			var mu sync.Mutex
+			responses := make(map[*FlareSolverrResponse]bool)
+			for i := range 5 {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					ctx := context.Background()
+					if tt.timeouts {
+						ctx = context.WithValue(ctx, requestOptionsKey, requestOptions{Timeout: time.Duration(30+i) * time.Second})
+					}
+					resp, meta, err := s.fetch(ctx, "request.get", "https://example.com/feed")
+					if err != nil || resp.Solution.Response == "" || meta.Backend != fs.Endpoint() || meta.FetchedAt.IsZero() {
+						t.Errorf("fetch = %+v, %+v, %v", resp, meta, err)
+						return
+					}
+					mu.Lock()
+					responses[resp] = true
+					mu.Unlock()
+				}()
+			}
+			wg.Wait()
+			if got := len(fs.Requests()); got != tt.wantSolves {
+				t.Errorf("solves = %d, want %d", got, tt.wantSolves)
+			}
+			if got := cache.sets.Load(); got != int64(tt.wantSolves) {
+				t.Errorf("cache stores = %d, want one per solve", got)
+			}
+			if len(responses) != 5 {
+				t.Errorf("requests got %d distinct responses, want a copy each", len(responses))
+			}
+		})
+	}
+}
+
+// countingCache counts the entries stored in a Cache.
+type countingCache struct {
+	Cache
+	sets atomic.Int64
+}
+
+func (c *countingCache) Set(key string, response *FlareSolverrResponse) {
+	c.sets.Add(1)
+	c.Cache.Set(key, response)
+}
+
+func TestFlightGroupCanceledLeader(t *testing.T) {
+	g := &flightGroup{flights: make(map[string]*flight)}
+	started, release := make(chan struct{}), make(chan struct{})
+	leader := func() (*FlareSolverrResponse, responseMeta, error) {
+		close(started)
+		<-release
+		return nil, responseMeta{}, context.Canceled
+	}
+	go g.do(context.Background(), "key", leader)
+	<-started
+
+	result := make(chan error)
+	go func() {
+		response, _, shared, err := g.do(context.Background(), "key", func() (*FlareSolverrResponse, responseMeta, error) {
+			return testResponse("<html>mine</html>"), responseMeta{}, nil
+		})
+		if err == nil && (shared || response.Solution.Response != "<html>mine</html>") {
+			err = errors.New("got the leader's result")
+		}
+		result <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	if err := <-result; err != nil {
+		t.Errorf("waiting caller: %v, want its own solve after the leader was canceled", err)
+	}
+
+	// Callers that go away stop waiting
+	started, release = make(chan struct{}), make(chan struct{})
+	go g.do(context.Background(), "key", leader)
+	<-started
+	defer close(release)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, _, shared, err := g.do(ctx, "key", leader); !shared || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("do = %v, %v; want the caller's deadline", shared, err)
+	}
+}
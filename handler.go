@@ -0,0 +1,284 @@
+package flareproxy
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+type ProxyHandler struct {
+	*solver
+	mitm *mitmCA // nil unless CONNECT requests are intercepted
+}
+
+func NewProxyHandler() *ProxyHandler {
+	return newProxyHandler(newSolver())
+}
+
+// newProxyHandler creates the proxy handler. With PROXY_MITM set, it
+// accepts CONNECT requests and decrypts them with its own CA.
+func newProxyHandler(s *solver) *ProxyHandler {
+	p := &ProxyHandler{solver: s}
+	if envBool("PROXY_MITM", false) {
+		ca, err := newMITMCAFromEnv()
+		if err != nil {
+			slog.Error("failed to set up the MITM CA, CONNECT disabled", "error", err)
+			return p
+		}
+		p.mitm = ca
+	}
+	return p
+}
+
+type DirectHandler struct {
+	*solver
+	jobs            *jobStore
+	schedule        *scheduler
+	metricsEnabled  bool
+	securityHeaders http.Header // added to HTML responses; nil when disabled
+	// rewriteLinks points the links of HTML pages back through the proxy.
+	rewriteLinks bool
+}
+
+func NewDirectHandler() *DirectHandler {
+	return newDirectHandler(newSolver())
+}
+
+func newDirectHandler(s *solver) *DirectHandler {
+	return &DirectHandler{
+		solver:          s,
+		jobs:            newJobStore(s),
+		schedule:        newSchedulerFromEnv(s),
+		metricsEnabled:  envBool("METRICS_ENABLED", true),
+		securityHeaders: securityHeadersFromEnv(),
+		rewriteLinks:    envBool("REWRITE_LINKS", false),
+	}
+}
+
+func (p *ProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !p.admit(w, r) {
+		return
+	}
+	if p.mitm != nil && r.URL.Host == "" && r.URL.Path == MITMCAPath {
+		p.serveCA(w)
+		return
+	}
+	r, ok := p.authorize(w, r, true)
+	if !ok {
+		return
+	}
+	w, ok = p.meterBandwidth(w, r)
+	if !ok {
+		return
+	}
+	r, ok = p.withUpstreamProxy(w, r)
+	if !ok {
+		return
+	}
+	r, ok = withRequestOptions(w, r)
+	if !ok {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		w, done := p.compressResponse(w, r)
+		defer done()
+		p.handleRequest(w, r)
+	case http.MethodConnect:
+		if p.mitm != nil {
+			p.serveConnect(w, r)
+			return
+		}
+		// Without PROXY_MITM, clients should use HTTP URLs even for HTTPS
+		// sites
+		p.sendConnectError(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (p *ProxyHandler) handleRequest(w http.ResponseWriter, r *http.Request) {
+	url := r.URL.String()
+	// Convert HTTP to HTTPS for FlareSolverr
+	url = strings.Replace(url, "http://", "https://", 1)
+
+	p.serve(w, r, FetchRequest{Cmd: "request.get", URL: url})
+}
+
+func (p *ProxyHandler) sendConnectError(w http.ResponseWriter, r *http.Request) {
+	message := "CONNECT method is not supported. This is an HTTP-only proxy adapter for FlareSolverr. " +
+		"Please use HTTP URLs (e.g., http://example.com) even for HTTPS sites. " +
+		"The proxy will automatically handle HTTPS conversion when communicating with FlareSolverr."
+
+	loggerFrom(r.Context()).Warn("CONNECT rejected", "host", r.Host)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusMethodNotAllowed)
+	w.Write([]byte(message))
+}
+
+func (d *DirectHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if d.securityHeaders != nil {
+		w = &securityHeaderWriter{ResponseWriter: w, headers: d.securityHeaders}
+	}
+	// Parse the URL from the path
+	// Format: /domain.com/path/to/resource
+	path := r.URL.Path
+	switch path {
+	case "/healthz":
+		serveHealth(w, r)
+		return
+	case "/readyz":
+		d.serveReady(w, r)
+		return
+	}
+	if !d.admit(w, r) {
+		return
+	}
+	r, ok := d.authorize(w, r, false)
+	if !ok {
+		return
+	}
+	w, ok = d.meterBandwidth(w, r)
+	if !ok {
+		return
+	}
+	w, done := d.compressResponse(w, r)
+	defer done()
+	if path == MetricsPath && d.metricsEnabled {
+		metrics.ServeHTTP(w, r)
+		return
+	}
+	if path == FetchPath {
+		queryOptions(r)
+	}
+	r, ok = d.withUpstreamProxy(w, r)
+	if !ok {
+		return
+	}
+	r, ok = withRequestOptions(w, r)
+	if !ok {
+		return
+	}
+	if path == BatchPath {
+		d.serveBatch(w, r)
+		return
+	}
+	if path == FetchPath {
+		d.serveFetch(w, r)
+		return
+	}
+	if strings.HasPrefix(path, SnapshotsPath+"/") {
+		d.serveSnapshot(w, r)
+		return
+	}
+	if path == ExplainPath {
+		d.serveExplain(w, r)
+		return
+	}
+	if path == JobsPath || strings.HasPrefix(path, JobsPath+"/") {
+		d.jobs.ServeHTTP(w, r)
+		return
+	}
+	if path == SchedulePath || strings.HasPrefix(path, SchedulePath+"/") {
+		d.schedule.ServeHTTP(w, r)
+		return
+	}
+	targetURL, explicit := directTarget(path, r.URL.RawQuery)
+	if targetURL == "" {
+		http.Error(w, "Invalid URL format. Use: http://localhost:PORT/domain.com/path", http.StatusBadRequest)
+		return
+	}
+	req, ok := d.requestForMethod(w, r, FetchRequest{URL: targetURL, Fallback: !explicit, RewriteLinks: d.rewriteLinks})
+	if !ok {
+		return
+	}
+	d.serve(w, r, req)
+}
+
+// directTarget returns the target URL of a direct mode path like
+// "/domain.com/path", and whether its scheme was given explicitly, as in
+// "/http/domain.com:8080/path" or "/https://domain.com/path". Without a
+// scheme, HTTPS is tried first. It returns "" if the path names no
+// domain.
+func directTarget(path, rawQuery string) (targetURL string, explicit bool) {
+	path = strings.TrimPrefix(path, "/")
+	scheme := "https"
+	if first, rest, ok := strings.Cut(path, "/"); ok {
+		// Some clients collapse the "//" of "/https://domain.com"
+		switch s := strings.ToLower(strings.TrimSuffix(first, ":")); s {
+		case "http", "https":
+			scheme, explicit, path = s, true, strings.TrimPrefix(rest, "/")
+		}
+	}
+	domain, remainingPath, hasPath := strings.Cut(path, "/")
+	if domain == "" {
+		return "", false
+	}
+	targetURL = scheme + "://" + domain
+	if hasPath {
+		targetURL += "/" + remainingPath
+	}
+	if rawQuery != "" {
+		targetURL += "?" + rawQuery
+	}
+	return targetURL, explicit
+}
+
+// maxPostDataBytes bounds the form bodies passed on to FlareSolverr.
+const maxPostDataBytes = 1 << 20
+
+// requestForMethod returns req with the FlareSolverr command and form
+// body for the method of r. GET and HEAD are fetched with request.get,
+// HEAD responses leaving out the body, and POST with request.post. As
+// FlareSolverr's browser submits forms, bodies must be form encoded. PUT,
+// PATCH and DELETE are answered with 405 unless METHOD_OVERRIDE_PARAM is
+// set, in which case they are emulated with a POST carrying the method in
+// that form field, as Rails, Laravel and others accept. Otherwise it
+// writes an error and returns false.
+func (s *solver) requestForMethod(w http.ResponseWriter, r *http.Request, req FetchRequest) (FetchRequest, bool) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		req.Cmd = "request.get"
+		return req, true
+	case http.MethodPost:
+	case http.MethodPut, http.MethodPatch, http.MethodDelete:
+		if s.methodOverride == "" {
+			w.Header().Set("Allow", "GET, HEAD, POST")
+			sendErrorStatus(w, r, http.StatusMethodNotAllowed,
+				r.Method+" is not supported by FlareSolverr; set METHOD_OVERRIDE_PARAM to emulate it with a POST")
+			return req, false
+		}
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		sendErrorStatus(w, r, http.StatusMethodNotAllowed, r.Method+" is not supported by FlareSolverr")
+		return req, false
+	}
+	if mediaType, _, _ := strings.Cut(r.Header.Get("Content-Type"), ";"); mediaType != "" &&
+		!strings.EqualFold(strings.TrimSpace(mediaType), "application/x-www-form-urlencoded") {
+		sendErrorStatus(w, r, http.StatusUnsupportedMediaType, "FlareSolverr can only send application/x-www-form-urlencoded bodies")
+		return req, false
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxPostDataBytes))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		sendErrorStatus(w, r, http.StatusRequestEntityTooLarge, "request body too large")
+		return req, false
+	}
+	if err != nil {
+		sendErrorStatus(w, r, http.StatusBadRequest, "failed to read request body: "+err.Error())
+		return req, false
+	}
+	req.Cmd = "request.post"
+	req.PostData = string(body)
+	if r.Method != http.MethodPost {
+		override := url.QueryEscape(s.methodOverride) + "=" + r.Method
+		if req.PostData != "" {
+			override = "&" + override
+		}
+		req.PostData += override
+	}
+	return req, true
+}
@@ -0,0 +1,685 @@
+package flareproxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/kljensen/flareproxygo/flaresolverr/flaresolverrtest"
+)
+
+func TestNewProxyHandler(t *testing.T) {
+	tests := []struct {
+		name    string
+		envURL  string
+		wantURL string
+	}{
+		{
+			name:    "default URL when env not set",
+			envURL:  "",
+			wantURL: "http://flaresolverr:8191/v1",
+		},
+		{
+			name:    "custom URL from environment",
+			envURL:  "http://custom:9999/api",
+			wantURL: "http://custom:9999/api",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.envURL != "" {
+				os.Setenv("FLARESOLVERR_URL", tt.envURL)
+				defer os.Unsetenv("FLARESOLVERR_URL")
+			}
+
+			handler := NewProxyHandler()
+			if handler.flareSolverrURL != tt.wantURL {
+				t.Errorf("NewProxyHandler() URL = %v, want %v", handler.flareSolverrURL, tt.wantURL)
+			}
+		})
+	}
+}
+
+func TestProxyHandler_ServeHTTP(t *testing.T) {
+	// Create a mock FlareSolverr server
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Verify the request is correct
+		if r.Method != "POST" {
+			t.Errorf("Expected POST request, got %s", r.Method)
+		}
+		if r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("Expected Content-Type application/json, got %s", r.Header.Get("Content-Type"))
+		}
+
+		// Decode the request to verify it's correct
+		var req FlareSolverrRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("Failed to decode request: %v", err)
+		}
+
+		// Check for special test cases based on URL
+		if strings.Contains(req.URL, "error-test") {
+			// Return an error response
+			response := FlareSolverrResponse{
+				Status:  "error",
+				Message: "Test error message",
+			}
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+
+		// Return a successful response
+		response := FlareSolverrResponse{
+			Status: "ok",
+		}
+		response.Solution.Response = "<html><body>Test HTML Response</body></html>"
+		response.Solution.Status = 200
+		json.NewEncoder(w).Encode(response)
+	}))
+	defer mockServer.Close()
+
+	// Create handler with mock server URL
+	os.Setenv("FLARESOLVERR_URL", mockServer.URL)
+	defer os.Unsetenv("FLARESOLVERR_URL")
+	handler := NewProxyHandler()
+
+	tests := []struct {
+		name        string
+		method      string
+		url         string
+		wantStatus  int
+		wantContent string
+		wantError   bool
+	}{
+		{
+			name:        "successful GET request",
+			method:      "GET",
+			url:         "http://example.com",
+			wantStatus:  http.StatusOK,
+			wantContent: "<html><body>Test HTML Response</body></html>",
+			wantError:   false,
+		},
+		{
+			name:        "CONNECT request rejected",
+			method:      "CONNECT",
+			url:         "example.com:443",
+			wantStatus:  http.StatusMethodNotAllowed,
+			wantContent: "CONNECT method is not supported",
+			wantError:   true,
+		},
+		{
+			name:        "unsupported method POST",
+			method:      "POST",
+			url:         "http://example.com",
+			wantStatus:  http.StatusMethodNotAllowed,
+			wantContent: "Method not allowed",
+			wantError:   true,
+		},
+		{
+			name:        "FlareSolverr error response",
+			method:      "GET",
+			url:         "http://error-test.com",
+			wantStatus:  http.StatusInternalServerError,
+			wantContent: "Test error message",
+			wantError:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Create request
+			req := httptest.NewRequest(tt.method, tt.url, nil)
+			if tt.method == "CONNECT" {
+				req.Host = "example.com:443"
+			}
+
+			// Create response recorder
+			rr := httptest.NewRecorder()
+
+			// Handle request
+			handler.ServeHTTP(rr, req)
+
+			// Check status code
+			if rr.Code != tt.wantStatus {
+				t.Errorf("ServeHTTP() status = %v, want %v", rr.Code, tt.wantStatus)
+			}
+
+			// Check response content
+			responseBody := rr.Body.String()
+			if !strings.Contains(responseBody, tt.wantContent) {
+				t.Errorf("ServeHTTP() body = %v, want to contain %v", responseBody, tt.wantContent)
+			}
+
+			// Check Content-Type header
+			if tt.wantError {
+				if tt.method != "POST" && !strings.Contains(rr.Header().Get("Content-Type"), "text/plain") &&
+					!strings.Contains(rr.Header().Get("Content-Type"), "application/json") {
+					// Error responses should be either text/plain or application/json
+					t.Errorf("ServeHTTP() error Content-Type = %v", rr.Header().Get("Content-Type"))
+				}
+			} else if rr.Header().Get("Content-Type") != "text/html; charset=utf-8" {
+				t.Errorf("ServeHTTP() Content-Type = %v, want text/html; charset=utf-8", rr.Header().Get("Content-Type"))
+			}
+		})
+	}
+}
+
+func TestProxyHandler_ConnectionError(t *testing.T) {
+	// Create handler with invalid FlareSolverr URL
+	os.Setenv("FLARESOLVERR_URL", "http://invalid-host-that-does-not-exist:12345/v1")
+	defer os.Unsetenv("FLARESOLVERR_URL")
+	handler := NewProxyHandler()
+
+	// Create request
+	req := httptest.NewRequest("GET", "http://example.com", nil)
+	rr := httptest.NewRecorder()
+
+	// Handle request
+	handler.ServeHTTP(rr, req)
+
+	// Should return 500 error
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("Expected status 500 for connection error, got %v", rr.Code)
+	}
+
+	// Should contain error message
+	responseBody := rr.Body.String()
+	if !strings.Contains(responseBody, "error") {
+		t.Errorf("Expected error message in response, got %v", responseBody)
+	}
+
+	// Should be JSON error response
+	if !strings.Contains(rr.Header().Get("Content-Type"), "application/json") {
+		t.Errorf("Expected application/json Content-Type, got %v", rr.Header().Get("Content-Type"))
+	}
+}
+
+func TestDirectHandler_ServeHTTP(t *testing.T) {
+	// Create a mock FlareSolverr server
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Verify the request is correct
+		if r.Method != "POST" {
+			t.Errorf("Expected POST request, got %s", r.Method)
+		}
+
+		// Decode the request to verify it's correct
+		var req FlareSolverrRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("Failed to decode request: %v", err)
+		}
+
+		// Check for special test cases
+		if strings.Contains(req.URL, "error-test") {
+			response := FlareSolverrResponse{
+				Status:  "error",
+				Message: "Test error message",
+			}
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+
+		// Return a successful response
+		response := FlareSolverrResponse{
+			Status: "ok",
+		}
+		response.Solution.Response = "<html><body>Direct mode response</body></html>"
+		response.Solution.Status = 200
+		json.NewEncoder(w).Encode(response)
+	}))
+	defer mockServer.Close()
+
+	// Create handler with mock server URL
+	os.Setenv("FLARESOLVERR_URL", mockServer.URL)
+	defer os.Unsetenv("FLARESOLVERR_URL")
+	handler := NewDirectHandler()
+
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		wantStatus  int
+		wantContent string
+		wantError   bool
+	}{
+		{
+			name:        "successful direct GET request",
+			method:      "GET",
+			path:        "/example.com/test/path",
+			wantStatus:  http.StatusOK,
+			wantContent: "Direct mode response",
+			wantError:   false,
+		},
+		{
+			name:        "direct request with query params",
+			method:      "GET",
+			path:        "/example.com/search?q=test&page=1",
+			wantStatus:  http.StatusOK,
+			wantContent: "Direct mode response",
+			wantError:   false,
+		},
+		{
+			name:        "direct request domain only",
+			method:      "GET",
+			path:        "/example.com",
+			wantStatus:  http.StatusOK,
+			wantContent: "Direct mode response",
+			wantError:   false,
+		},
+		{
+			name:        "direct POST request",
+			method:      "POST",
+			path:        "/example.com/api/endpoint",
+			wantStatus:  http.StatusOK,
+			wantContent: "Direct mode response",
+			wantError:   false,
+		},
+		{
+			name:        "invalid format - no domain",
+			method:      "GET",
+			path:        "/",
+			wantStatus:  http.StatusBadRequest,
+			wantContent: "Invalid URL format",
+			wantError:   true,
+		},
+		{
+			name:        "error from FlareSolverr",
+			method:      "GET",
+			path:        "/error-test.com/page",
+			wantStatus:  http.StatusInternalServerError,
+			wantContent: "Test error message",
+			wantError:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Create request
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			rr := httptest.NewRecorder()
+
+			// Handle request
+			handler.ServeHTTP(rr, req)
+
+			// Check status code
+			if rr.Code != tt.wantStatus {
+				t.Errorf("ServeHTTP() status = %v, want %v", rr.Code, tt.wantStatus)
+			}
+
+			// Check response content
+			responseBody := rr.Body.String()
+			if !strings.Contains(responseBody, tt.wantContent) {
+				t.Errorf("ServeHTTP() body = %v, want to contain %v", responseBody, tt.wantContent)
+			}
+		})
+	}
+}
+
+func TestDirectTarget(t *testing.T) {
+	tests := []struct {
+		path         string
+		query        string
+		want         string
+		wantExplicit bool
+	}{
+		{path: "/example.com/test/path", want: "https://example.com/test/path"},
+		{path: "/example.com", want: "https://example.com"},
+		{path: "/example.com/search", query: "q=1", want: "https://example.com/search?q=1"},
+		{path: "/example.com:8443/path", want: "https://example.com:8443/path"},
+		{path: "/http/example.com:8080/path", want: "http://example.com:8080/path", wantExplicit: true},
+		{path: "/https/example.com/", want: "https://example.com/", wantExplicit: true},
+		{path: "/https://example.com:8443/path", want: "https://example.com:8443/path", wantExplicit: true},
+		{path: "/http:/example.com/path", query: "a=b", want: "http://example.com/path?a=b", wantExplicit: true},
+		{path: "/HTTP/example.com", want: "http://example.com", wantExplicit: true},
+		{path: "/", want: ""},
+		{path: "/https/", want: ""},
+	}
+	for _, tt := range tests {
+		got, explicit := directTarget(tt.path, tt.query)
+		if got != tt.want || explicit != tt.wantExplicit {
+			t.Errorf("directTarget(%q, %q) = %q, %v, want %q, %v", tt.path, tt.query, got, explicit, tt.want, tt.wantExplicit)
+		}
+	}
+}
+
+func TestDirectExplicitScheme(t *testing.T) {
+	var urls []string
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req FlareSolverrRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		urls = append(urls, req.URL)
+		json.NewEncoder(w).Encode(FlareSolverrResponse{Status: "error", Message: "Test error message"})
+	}))
+	defer mockServer.Close()
+	t.Setenv("FLARESOLVERR_URL", mockServer.URL)
+	handler := NewDirectHandler()
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/example.com/page", nil))
+	if strings.Join(urls, " ") != "https://example.com/page http://example.com/page" {
+		t.Errorf("solved %v, want HTTPS then the HTTP fallback", urls)
+	}
+
+	// Explicit schemes are used as given
+	urls = nil
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/https/example.com:8443/page", nil))
+	if strings.Join(urls, " ") != "https://example.com:8443/page" {
+		t.Errorf("solved %v, want only the explicit URL", urls)
+	}
+}
+
+func TestSolutionCookiesForwarded(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		response := FlareSolverrResponse{
+			Status: "ok",
+		}
+		response.Solution.Response = "<html></html>"
+		response.Solution.Status = 200
+		response.Solution.Cookies = []Cookie{
+			{Name: "cf_clearance", Value: "abc123", Domain: ".example.com", Path: "/", Expires: 1893456000, HTTPOnly: true, Secure: true, SameSite: "None"},
+			{Name: "session", Value: "xyz", Domain: "example.com", Path: "/", Expires: -1, Session: true},
+		}
+		json.NewEncoder(w).Encode(response)
+	}))
+	defer mockServer.Close()
+
+	os.Setenv("FLARESOLVERR_URL", mockServer.URL)
+	defer os.Unsetenv("FLARESOLVERR_URL")
+
+	handlers := map[string]http.Handler{
+		"proxy":  NewProxyHandler(),
+		"direct": NewDirectHandler(),
+	}
+	targets := map[string]string{
+		"proxy":  "http://example.com/",
+		"direct": "/example.com/",
+	}
+
+	for name, handler := range handlers {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", targets[name], nil)
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			cookies := rr.Result().Cookies()
+			if len(cookies) != 2 {
+				t.Fatalf("got %d cookies, want 2", len(cookies))
+			}
+			if cookies[0].Name != "cf_clearance" || cookies[0].Value != "abc123" {
+				t.Errorf("first cookie = %s=%s, want cf_clearance=abc123", cookies[0].Name, cookies[0].Value)
+			}
+			if !cookies[0].HttpOnly || !cookies[0].Secure || cookies[0].SameSite != http.SameSiteNoneMode {
+				t.Errorf("cf_clearance attributes not preserved: %+v", cookies[0])
+			}
+			if cookies[0].Expires.IsZero() {
+				t.Errorf("cf_clearance expiry not preserved")
+			}
+			if !cookies[1].Expires.IsZero() {
+				t.Errorf("session cookie should not carry an expiry, got %v", cookies[1].Expires)
+			}
+		})
+	}
+}
+
+func TestResponseTrailers(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		response := FlareSolverrResponse{
+			Status: "ok",
+		}
+		response.Solution.Response = strings.Repeat("<p>large body</p>", 10000)
+		response.Solution.Status = 200
+		json.NewEncoder(w).Encode(response)
+	}))
+	defer mockServer.Close()
+
+	os.Setenv("FLARESOLVERR_URL", mockServer.URL)
+	defer os.Unsetenv("FLARESOLVERR_URL")
+
+	server := httptest.NewServer(NewDirectHandler())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/example.com/")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		t.Fatalf("failed to read body: %v", err)
+	}
+
+	if got := resp.Trailer.Get(TrailerCache); got != "BYPASS" {
+		t.Errorf("%s trailer = %q, want BYPASS", TrailerCache, got)
+	}
+	if got := resp.Trailer.Get(TrailerBackend); got != mockServer.URL {
+		t.Errorf("%s trailer = %q, want %q", TrailerBackend, got, mockServer.URL)
+	}
+	if got := resp.Trailer.Get(TrailerSolveTime); got == "" {
+		t.Errorf("%s trailer missing", TrailerSolveTime)
+	}
+}
+
+func TestRangeRequests(t *testing.T) {
+	body := "0123456789abcdefghij"
+	var solves int
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		solves++
+		json.NewEncoder(w).Encode(testResponse(body))
+	}))
+	defer mockServer.Close()
+	t.Setenv("FLARESOLVERR_URL", mockServer.URL)
+	t.Setenv("CACHE_TTL", "1m")
+	handler := NewDirectHandler()
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/example.com/file", nil))
+	etag := rr.Header().Get("ETag")
+	if rr.Code != http.StatusOK || etag == "" || rr.Header().Get("Accept-Ranges") != "bytes" {
+		t.Fatalf("full response: status %d, ETag %q, Accept-Ranges %q", rr.Code, etag, rr.Header().Get("Accept-Ranges"))
+	}
+
+	tests := []struct {
+		name       string
+		rangeValue string
+		ifRange    string
+		wantStatus int
+		wantBody   string
+		wantRange  string
+	}{
+		{name: "resume", rangeValue: "bytes=10-", wantStatus: http.StatusPartialContent, wantBody: "abcdefghij", wantRange: "bytes 10-19/20"},
+		{name: "slice", rangeValue: "bytes=2-4", wantStatus: http.StatusPartialContent, wantBody: "234", wantRange: "bytes 2-4/20"},
+		{name: "matching If-Range", rangeValue: "bytes=15-", ifRange: etag, wantStatus: http.StatusPartialContent, wantBody: "fghij", wantRange: "bytes 15-19/20"},
+		{name: "changed body", rangeValue: "bytes=15-", ifRange: `"stale"`, wantStatus: http.StatusOK, wantBody: body},
+		{name: "unsatisfiable", rangeValue: "bytes=50-", wantStatus: http.StatusRequestedRangeNotSatisfiable, wantRange: "bytes */20"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/example.com/file", nil)
+			req.Header.Set("Range", tt.rangeValue)
+			if tt.ifRange != "" {
+				req.Header.Set("If-Range", tt.ifRange)
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rr.Code, tt.wantStatus)
+			}
+			if tt.wantBody != "" && rr.Body.String() != tt.wantBody {
+				t.Errorf("body = %q, want %q", rr.Body.String(), tt.wantBody)
+			}
+			if got := rr.Header().Get("Content-Range"); got != tt.wantRange {
+				t.Errorf("Content-Range = %q, want %q", got, tt.wantRange)
+			}
+			if got := rr.Header().Get(TrailerCache); got != "HIT" {
+				t.Errorf("%s = %q, want HIT", TrailerCache, got)
+			}
+		})
+	}
+	if solves != 1 {
+		t.Errorf("FlareSolverr solved %d times, want 1", solves)
+	}
+}
+
+func TestIfHashDiffers(t *testing.T) {
+	body := "<html>watched page</html>"
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(testResponse(body))
+	}))
+	defer mockServer.Close()
+	t.Setenv("FLARESOLVERR_URL", mockServer.URL)
+	sum := sha256.Sum256([]byte(body))
+	hash := hex.EncodeToString(sum[:])
+
+	tests := []struct {
+		name       string
+		hash       string
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "no header", wantStatus: http.StatusOK, wantBody: body},
+		{name: "unchanged", hash: hash, wantStatus: http.StatusNotModified},
+		{name: "unchanged, upper case", hash: strings.ToUpper(hash), wantStatus: http.StatusNotModified},
+		{name: "changed", hash: strings.Repeat("0", 64), wantStatus: http.StatusOK, wantBody: body},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/example.com/", nil)
+			if tt.hash != "" {
+				req.Header.Set(IfHashDiffersHeader, tt.hash)
+			}
+			rr := httptest.NewRecorder()
+			NewDirectHandler().ServeHTTP(rr, req)
+			if rr.Code != tt.wantStatus || rr.Body.String() != tt.wantBody {
+				t.Errorf("response = %d %q, want %d %q", rr.Code, rr.Body.String(), tt.wantStatus, tt.wantBody)
+			}
+			if rr.Header().Get(TrailerBackend) != mockServer.URL {
+				t.Errorf("%s = %q, want %q", TrailerBackend, rr.Header().Get(TrailerBackend), mockServer.URL)
+			}
+		})
+	}
+}
+
+func TestUpstreamStatusPropagation(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		response := FlareSolverrResponse{
+			Status: "ok",
+		}
+		response.Solution.Response = "<html><body>Not Found</body></html>"
+		response.Solution.Status = 404
+		json.NewEncoder(w).Encode(response)
+	}))
+	defer mockServer.Close()
+
+	os.Setenv("FLARESOLVERR_URL", mockServer.URL)
+	defer os.Unsetenv("FLARESOLVERR_URL")
+
+	tests := []struct {
+		name       string
+		envValue   string
+		wantStatus int
+	}{
+		{
+			name:       "propagated by default",
+			envValue:   "",
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "disabled via environment",
+			envValue:   "false",
+			wantStatus: http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.envValue != "" {
+				os.Setenv("PROPAGATE_STATUS", tt.envValue)
+				defer os.Unsetenv("PROPAGATE_STATUS")
+			}
+
+			for _, handler := range []http.Handler{NewProxyHandler(), NewDirectHandler()} {
+				target := "/example.com/missing"
+				if _, ok := handler.(*ProxyHandler); ok {
+					target = "http://example.com/missing"
+				}
+				req := httptest.NewRequest("GET", target, nil)
+				rr := httptest.NewRecorder()
+				handler.ServeHTTP(rr, req)
+
+				if rr.Code != tt.wantStatus {
+					t.Errorf("%T status = %v, want %v", handler, rr.Code, tt.wantStatus)
+				}
+				if !strings.Contains(rr.Body.String(), "Not Found") {
+					t.Errorf("%T body = %v, want origin body", handler, rr.Body.String())
+				}
+			}
+		})
+	}
+}
+
+func TestDirectMethods(t *testing.T) {
+	fs := flaresolverrtest.NewServer()
+	defer fs.Close()
+	fs.SetPage("https://example.com/form", flaresolverrtest.Page{Body: "<html>form</html>"})
+	t.Setenv("FLARESOLVERR_URL", fs.Endpoint())
+
+	tests := []struct {
+		name         string
+		override     string
+		method       string
+		contentType  string
+		body         string
+		wantStatus   int
+		wantCmd      string
+		wantPostData string
+	}{
+		{name: "GET", method: "GET", wantStatus: http.StatusOK, wantCmd: "request.get"},
+		{name: "HEAD", method: "HEAD", wantStatus: http.StatusOK, wantCmd: "request.get"},
+		{name: "POST form", method: "POST", contentType: "application/x-www-form-urlencoded", body: "a=b", wantStatus: http.StatusOK, wantCmd: "request.post", wantPostData: "a=b"},
+		{name: "POST JSON", method: "POST", contentType: "application/json", body: `{"a":"b"}`, wantStatus: http.StatusUnsupportedMediaType},
+		{name: "PUT refused", method: "PUT", body: "a=b", wantStatus: http.StatusMethodNotAllowed},
+		{name: "PUT emulated", override: "_method", method: "PUT", body: "a=b", wantStatus: http.StatusOK, wantCmd: "request.post", wantPostData: "a=b&_method=PUT"},
+		{name: "DELETE emulated", override: "_method", method: "DELETE", wantStatus: http.StatusOK, wantCmd: "request.post", wantPostData: "_method=DELETE"},
+		{name: "OPTIONS", override: "_method", method: "OPTIONS", wantStatus: http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("METHOD_OVERRIDE_PARAM", tt.override)
+			handler := NewDirectHandler()
+			sent := len(fs.Requests())
+			req := httptest.NewRequest(tt.method, "/https/example.com/form", strings.NewReader(tt.body))
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rr.Code, tt.wantStatus, rr.Body.String())
+			}
+			if tt.wantStatus == http.StatusMethodNotAllowed && rr.Header().Get("Allow") != "GET, HEAD, POST" {
+				t.Errorf("Allow = %q", rr.Header().Get("Allow"))
+			}
+			requests := fs.Requests()[sent:]
+			if tt.wantCmd == "" {
+				if len(requests) != 0 {
+					t.Errorf("refused request reached FlareSolverr: %+v", requests)
+				}
+				return
+			}
+			if len(requests) != 1 || requests[0].Cmd != tt.wantCmd || requests[0].PostData != tt.wantPostData {
+				t.Fatalf("FlareSolverr got %+v, want %s with %q", requests, tt.wantCmd, tt.wantPostData)
+			}
+			if tt.method == "HEAD" {
+				if rr.Body.Len() != 0 || rr.Header().Get("Content-Length") != "17" || rr.Header().Get(TrailerCache) == "" {
+					t.Errorf("HEAD response: body %q, Content-Length %q, %s %q", rr.Body.String(),
+						rr.Header().Get("Content-Length"), TrailerCache, rr.Header().Get(TrailerCache))
+				}
+			}
+		})
+	}
+}
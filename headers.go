@@ -0,0 +1,41 @@
+package flareproxy
+
+import (
+	"net/http"
+)
+
+// defaultMaxForwardHeaderBytes caps the headers of requests that may reach
+// FlareSolverr or an origin. Browsers send a few KiB; 32 KiB leaves room
+// for large cookies.
+const defaultMaxForwardHeaderBytes = 32 << 10
+
+// maxHeaderBytesFromEnv returns the limit on the request headers the
+// listeners read, MAX_HEADER_BYTES, defaulting to Go's 1 MiB. Larger
+// requests are answered with 431 before they reach a handler.
+func maxHeaderBytesFromEnv() int {
+	return envInt("MAX_HEADER_BYTES", http.DefaultMaxHeaderBytes)
+}
+
+// headerSize returns the size of h as sent on the wire in HTTP/1.1.
+func headerSize(h http.Header) int {
+	size := 0
+	for name, values := range h {
+		for _, value := range values {
+			size += len(name) + len(value) + len(": \r\n")
+		}
+	}
+	return size
+}
+
+// admitHeaders answers requests whose headers exceed
+// MAX_FORWARD_HEADER_BYTES with 431 and returns false, so that clients
+// cannot make the solver hold and forward huge headers. 0 disables the
+// cap.
+func (s *solver) admitHeaders(w http.ResponseWriter, r *http.Request) bool {
+	if s.maxForwardHeaderBytes <= 0 || headerSize(r.Header)+len(r.Host) <= s.maxForwardHeaderBytes {
+		return true
+	}
+	w.Header().Set("Connection", "close")
+	sendErrorStatus(w, r, http.StatusRequestHeaderFieldsTooLarge, "request headers too large")
+	return false
+}
@@ -0,0 +1,66 @@
+package flareproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAdmitHeaders(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(testResponse("<html>solved</html>"))
+	}))
+	defer mockServer.Close()
+	t.Setenv("FLARESOLVERR_URL", mockServer.URL)
+	t.Setenv("MAX_FORWARD_HEADER_BYTES", "1024")
+
+	tests := []struct {
+		name   string
+		cookie string
+		want   int
+	}{
+		{"small headers", "a=b", http.StatusOK},
+		{"huge cookie", "a=" + strings.Repeat("x", 2048), http.StatusRequestHeaderFieldsTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for mode, handler := range map[string]http.Handler{
+				"direct": NewDirectHandler(),
+				"proxy":  NewProxyHandler(),
+			} {
+				path := "/example.com/"
+				if mode == "proxy" {
+					path = "http://example.com/"
+				}
+				req := httptest.NewRequest("GET", path, nil)
+				req.Header.Set("Cookie", tt.cookie)
+				rr := httptest.NewRecorder()
+				handler.ServeHTTP(rr, req)
+				if rr.Code != tt.want {
+					t.Errorf("%s status = %d, want %d", mode, rr.Code, tt.want)
+				}
+				if tt.want == http.StatusRequestHeaderFieldsTooLarge && !strings.Contains(rr.Body.String(), "request headers too large") {
+					t.Errorf("%s body = %s, want a JSON error", mode, rr.Body.String())
+				}
+			}
+		})
+	}
+
+	t.Setenv("MAX_FORWARD_HEADER_BYTES", "0")
+	req := httptest.NewRequest("GET", "/example.com/", nil)
+	req.Header.Set("Cookie", strings.Repeat("x", 64<<10))
+	rr := httptest.NewRecorder()
+	NewDirectHandler().ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("status = %d with the cap disabled, want 200", rr.Code)
+	}
+}
+
+func TestHeaderSize(t *testing.T) {
+	h := http.Header{"Accept": {"text/html"}, "Cookie": {"a=b", "c=d"}}
+	if got, want := headerSize(h), len("Accept: text/html\r\nCookie: a=b\r\nCookie: c=d\r\n"); got != want {
+		t.Errorf("headerSize() = %d, want %d", got, want)
+	}
+}
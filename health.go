@@ -0,0 +1,112 @@
+package flareproxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/kljensen/flareproxygo/flaresolverr"
+)
+
+// backendStatus describes the reachability of a FlareSolverr backend.
+type backendStatus struct {
+	URL       string `json:"url"`
+	Reachable bool   `json:"reachable"`
+	Version   string `json:"version,omitempty"`
+	LatencyMs int64  `json:"latency_ms"`
+	Circuit   string `json:"circuit"`
+	Draining  bool   `json:"draining"`
+	// Incompatible is set while the backend is out of rotation for
+	// running a FlareSolverr version outside FLARESOLVERR_VERSION.
+	Incompatible bool   `json:"incompatible,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
+
+// serveHealth answers liveness probes. The process is alive as long as it
+// can answer HTTP requests.
+func serveHealth(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// serveReady answers readiness probes by actively probing every
+// FlareSolverr backend, returning 503 while none of them is reachable and
+// in service.
+func (s *solver) serveReady(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), envDuration("READINESS_TIMEOUT", 5*time.Second))
+	defer cancel()
+
+	pool := s.backends.all()
+	backends := make([]backendStatus, len(pool))
+	var wg sync.WaitGroup
+	for i, b := range pool {
+		wg.Add(1)
+		go func(i int, b *backend) {
+			defer wg.Done()
+			backends[i] = s.probe(ctx, b)
+		}(i, b)
+	}
+	wg.Wait()
+
+	status, code := "unavailable", http.StatusServiceUnavailable
+	for _, backend := range backends {
+		if backend.Reachable && !backend.Draining && !backend.Incompatible {
+			status, code = "ready", http.StatusOK
+			break
+		}
+	}
+	writeJSON(w, code, map[string]interface{}{
+		"status":   status,
+		"backends": backends,
+	})
+}
+
+// probe checks that a backend answers a sessions.list command, which is
+// cheap and does not start a browser. Solvers without sessions only have
+// to answer HTTP at all.
+func (s *solver) probe(ctx context.Context, b *backend) backendStatus {
+	start := time.Now()
+	var flareResponse *FlareSolverrResponse
+	var err error
+	if s.dialect != nil && !s.dialect.Supports(flaresolverr.CmdSessionsList) {
+		flareResponse, err = s.ping(ctx, b)
+	} else {
+		flareResponse, err = s.solveOn(ctx, b, FlareSolverrRequest{Cmd: flaresolverr.CmdSessionsList})
+	}
+	backend := backendStatus{
+		URL:       b.url,
+		LatencyMs: time.Since(start).Milliseconds(),
+		Circuit:   b.State(),
+		Draining:  b.Draining(),
+	}
+	if err != nil {
+		backend.Error = err.Error()
+		return backend
+	}
+	backend.Reachable = true
+	backend.Version = flareResponse.Version
+	backend.Incompatible = b.incompatible.Load()
+	return backend
+}
+
+// ping sends a GET to a backend, which any HTTP response answers.
+func (s *solver) ping(ctx context.Context, b *backend) (*FlareSolverrResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, b.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	s.authenticate(req, nil)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return &FlareSolverrResponse{Status: "ok"}, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,71 @@
+package flareproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHealthEndpoints(t *testing.T) {
+	var solves int
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req FlareSolverrRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		if r.Method == http.MethodPost && req.Cmd != "sessions.list" {
+			solves++
+		}
+		w.Write([]byte(`{"status":"ok","message":"","sessions":[],"version":"3.3.21"}`))
+	}))
+	defer mockServer.Close()
+
+	tests := []struct {
+		name        string
+		path        string
+		backendURL  string
+		solverType  string
+		wantStatus  int
+		wantReady   string
+		wantVersion string
+	}{
+		{name: "liveness", path: "/healthz", backendURL: "http://127.0.0.1:1/v1", wantStatus: http.StatusOK},
+		{name: "ready", path: "/readyz", backendURL: mockServer.URL, wantStatus: http.StatusOK, wantReady: "ready", wantVersion: "3.3.21"},
+		{name: "byparr ready", path: "/readyz", backendURL: mockServer.URL, solverType: "byparr", wantStatus: http.StatusOK, wantReady: "ready"},
+		{name: "backend down", path: "/readyz", backendURL: "http://127.0.0.1:1/v1", wantStatus: http.StatusServiceUnavailable, wantReady: "unavailable"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("FLARESOLVERR_URL", tt.backendURL)
+			t.Setenv("SOLVER_TYPE", tt.solverType)
+			handler := NewDirectHandler()
+
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, httptest.NewRequest("GET", tt.path, nil))
+
+			if rr.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rr.Code, tt.wantStatus)
+			}
+			if tt.wantReady == "" {
+				return
+			}
+			var body struct {
+				Status   string          `json:"status"`
+				Backends []backendStatus `json:"backends"`
+			}
+			if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+				t.Fatalf("invalid JSON: %v", err)
+			}
+			if body.Status != tt.wantReady || len(body.Backends) != 1 || body.Backends[0].Version != tt.wantVersion {
+				t.Fatalf("readiness = %+v", body)
+			}
+			if !body.Backends[0].Reachable && body.Backends[0].Error == "" {
+				t.Error("unreachable backend should report an error")
+			}
+		})
+	}
+
+	if solves != 0 {
+		t.Errorf("probes triggered %d solves, want 0", solves)
+	}
+}
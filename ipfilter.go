@@ -0,0 +1,104 @@
+package flareproxy
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// ipFilter decides which client addresses may use the proxy, so that it
+// can be exposed on a LAN or VPN without opening it to everyone. Denied
+// networks take precedence; with an allowlist, only its networks are let
+// in.
+type ipFilter struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+	// restricted is set when an allowlist is configured, even if none of
+	// its entries were valid, so that a typo does not open the proxy.
+	restricted bool
+}
+
+// ipFilterFromEnv reads IP_ALLOWLIST and IP_DENYLIST, comma separated
+// CIDRs or single addresses. It returns nil, letting everyone in, if both
+// are empty. Invalid entries are skipped with a warning.
+func ipFilterFromEnv() *ipFilter {
+	f := &ipFilter{
+		allow:      parseNetworks("IP_ALLOWLIST"),
+		deny:       parseNetworks("IP_DENYLIST"),
+		restricted: os.Getenv("IP_ALLOWLIST") != "",
+	}
+	if !f.restricted && len(f.deny) == 0 {
+		return nil
+	}
+	if f.restricted && len(f.allow) == 0 {
+		slog.Warn("IP_ALLOWLIST has no valid entries, denying all clients")
+	}
+	return f
+}
+
+// parseNetworks parses the networks listed in the environment variable
+// name.
+func parseNetworks(name string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, entry := range splitList(os.Getenv(name)) {
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil {
+				bits := 8 * net.IPv6len
+				if ip.To4() != nil {
+					ip, bits = ip.To4(), 32
+				}
+				networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+				continue
+			}
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			slog.Warn("ignoring invalid "+name+" entry", "entry", entry)
+			continue
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// allows reports whether a client at addr, a host and port as in
+// http.Request.RemoteAddr, may connect.
+func (f *ipFilter) allows(addr string) bool {
+	if f == nil {
+		return true
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range f.deny {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	if !f.restricted {
+		return true
+	}
+	for _, network := range f.allow {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// admit answers requests from clients the IP filter does not allow with
+// 403, and requests with oversized headers with 431, and returns false.
+func (s *solver) admit(w http.ResponseWriter, r *http.Request) bool {
+	if !s.ipFilter.allows(r.RemoteAddr) {
+		sendErrorStatus(w, r, http.StatusForbidden, "client address not allowed")
+		return false
+	}
+	return s.admitHeaders(w, r)
+}
@@ -0,0 +1,96 @@
+package flareproxy
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestIPFilter(t *testing.T) {
+	tests := []struct {
+		name  string
+		allow string
+		deny  string
+		addr  string
+		want  bool
+	}{
+		{name: "no lists", addr: "203.0.113.7:5000", want: true},
+		{name: "allowed network", allow: "10.0.0.0/8, 192.168.1.0/24", addr: "192.168.1.20:5000", want: true},
+		{name: "outside allowlist", allow: "10.0.0.0/8", addr: "203.0.113.7:5000"},
+		{name: "single address", allow: "203.0.113.7", addr: "203.0.113.7:5000", want: true},
+		{name: "IPv6", allow: "fd00::/8", addr: "[fd12::1]:5000", want: true},
+		{name: "IPv4-mapped IPv6", allow: "127.0.0.1", addr: "[::ffff:127.0.0.1]:5000", want: true},
+		{name: "denied", deny: "203.0.113.0/24", addr: "203.0.113.7:5000"},
+		{name: "deny wins", allow: "10.0.0.0/8", deny: "10.6.6.0/24", addr: "10.6.6.6:5000"},
+		{name: "outside denylist", deny: "203.0.113.0/24", addr: "198.51.100.1:5000", want: true},
+		{name: "invalid allowlist denies all", allow: "10.0.0.0/33", addr: "10.0.0.1:5000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("IP_ALLOWLIST", tt.allow)
+			t.Setenv("IP_DENYLIST", tt.deny)
+			if got := ipFilterFromEnv().allows(tt.addr); got != tt.want {
+				t.Errorf("allows(%s) = %v, want %v", tt.addr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIPFilterListeners(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(testResponse("<html>solved</html>"))
+	}))
+	defer mockServer.Close()
+	t.Setenv("FLARESOLVERR_URL", mockServer.URL)
+	t.Setenv("IP_ALLOWLIST", "192.168.0.0/16")
+	s := newSolver()
+
+	tests := []struct {
+		name    string
+		handler http.Handler
+		url     string
+		addr    string
+		want    int
+	}{
+		{name: "direct allowed", handler: newDirectHandler(s), url: "/example.com/", addr: "192.168.1.2:1234", want: http.StatusOK},
+		{name: "direct denied", handler: newDirectHandler(s), url: "/example.com/", addr: "10.1.2.3:1234", want: http.StatusForbidden},
+		{name: "health stays open", handler: newDirectHandler(s), url: "/healthz", addr: "10.1.2.3:1234", want: http.StatusOK},
+		{name: "proxy allowed", handler: newProxyHandler(s), url: "http://example.com/", addr: "192.168.1.2:1234", want: http.StatusOK},
+		{name: "proxy denied", handler: newProxyHandler(s), url: "http://example.com/", addr: "10.1.2.3:1234", want: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.url, nil)
+			req.RemoteAddr = tt.addr
+			rr := httptest.NewRecorder()
+			tt.handler.ServeHTTP(rr, req)
+			if rr.Code != tt.want {
+				t.Errorf("status = %d, want %d", rr.Code, tt.want)
+			}
+		})
+	}
+
+	t.Run("SOCKS closes denied connections", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv := newSOCKSServer("", newProxyHandler(s))
+		go srv.Serve(ln)
+		defer srv.Shutdown(context.Background())
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.Write([]byte{socksVersion, 1, socksNoAuth})
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if n, err := conn.Read(make([]byte, 2)); err == nil {
+			t.Errorf("read %d bytes from a denied connection, want it closed", n)
+		}
+	})
+}
@@ -0,0 +1,394 @@
+package flareproxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Job states.
+const (
+	JobQueued  = "queued"
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+)
+
+// JobsPath is the prefix of the asynchronous job API on the direct server.
+const JobsPath = "/api/v1/jobs"
+
+// Job is a fetch submitted through the job API. Solving a challenge can
+// take close to a minute, so clients may prefer to submit a URL and poll
+// for the result instead of holding a connection open.
+type Job struct {
+	ID          string     `json:"id"`
+	Status      string     `json:"status"`
+	Cmd         string     `json:"cmd"`
+	URL         string     `json:"url"`
+	CreatedAt   time.Time  `json:"created_at"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+	Error       string     `json:"error,omitempty"`
+	ResultBytes int        `json:"result_bytes"`
+	Result      *JobResult `json:"result,omitempty"`
+	// Queue is set while the job waits for a free FlareSolverr slot.
+	Queue *QueueStatus `json:"queue,omitempty"`
+
+	// postData is the form body of a request.post.
+	postData string
+	seq      int64
+	cancel   context.CancelFunc
+	ticket   *queueTicket
+}
+
+// JobResult is the solution of a completed job.
+type JobResult struct {
+	Status    int      `json:"status"`
+	Body      string   `json:"body"`
+	Cookies   []Cookie `json:"cookies,omitempty"`
+	UserAgent string   `json:"user_agent,omitempty"`
+	// Quality is the page's quality score, from 0 for a challenge or empty
+	// page to 1.
+	Quality float64 `json:"quality"`
+}
+
+func newJobResult(result *FetchResult) *JobResult {
+	return &JobResult{
+		Status:    result.meta.Status,
+		Body:      result.Response.Solution.Response,
+		Cookies:   result.Response.Solution.Cookies,
+		UserAgent: result.Response.Solution.UserAgent,
+		Quality:   result.meta.Quality,
+	}
+}
+
+// jobStore runs jobs and keeps their results. At most maxPending jobs
+// may be queued or running at once. Completed jobs are retained until
+// they exceed the configured age, or until the number or total size of
+// retained results exceeds its limit, in which case the oldest are
+// dropped first.
+type jobStore struct {
+	fetch      func(ctx context.Context, req FetchRequest) (*FetchResult, error)
+	maxPending int
+	maxCount   int
+	maxBytes   int
+	ttl        time.Duration
+	now        func() time.Time
+
+	mu    sync.Mutex
+	jobs  map[string]*Job
+	order []*Job // by creation, oldest first
+	seq   int64
+}
+
+func newJobStore(s *solver) *jobStore {
+	return &jobStore{
+		fetch:      s.process,
+		maxPending: envInt("JOB_MAX_PENDING", 1000),
+		maxCount:   envInt("JOB_RETENTION_COUNT", 1000),
+		maxBytes:   envInt("JOB_RETENTION_BYTES", 64<<20),
+		ttl:        envDuration("JOB_RETENTION_TTL", time.Hour),
+		now:        time.Now,
+		jobs:       make(map[string]*Job),
+	}
+}
+
+// submit registers a job and starts it in the background. The job keeps
+// the values of parent, such as the upstream proxy, but not its deadline.
+// It fails if the store already holds maxPending unfinished jobs.
+func (js *jobStore) submit(parent context.Context, cmd, targetURL, postData string) (Job, error) {
+	js.mu.Lock()
+	if js.maxPending > 0 && js.pendingLocked() >= js.maxPending {
+		js.mu.Unlock()
+		return Job{}, fmt.Errorf("too many jobs, at most %d may be queued or running", js.maxPending)
+	}
+	ctx, cancel := context.WithCancel(context.WithoutCancel(parent))
+	ctx, ticket := withQueueTicket(ctx)
+	js.seq++
+	job := &Job{
+		ID:        requestID(""),
+		Status:    JobQueued,
+		Cmd:       cmd,
+		URL:       targetURL,
+		CreatedAt: js.now().UTC(),
+		postData:  postData,
+		seq:       js.seq,
+		cancel:    cancel,
+		ticket:    ticket,
+	}
+	js.jobs[job.ID] = job
+	js.order = append(js.order, job)
+	snapshot := *job
+	js.mu.Unlock()
+
+	go js.run(ctx, job)
+	return snapshot, nil
+}
+
+// pendingLocked returns the number of jobs that have not completed yet.
+// js.mu must be held.
+func (js *jobStore) pendingLocked() int {
+	n := 0
+	for _, job := range js.order {
+		if job.CompletedAt == nil {
+			n++
+		}
+	}
+	return n
+}
+
+func (js *jobStore) run(ctx context.Context, job *Job) {
+	defer job.cancel()
+	js.mu.Lock()
+	job.Status = JobRunning
+	js.mu.Unlock()
+
+	// Log entries for the job carry its ID as the request ID
+	ctx = backgroundContext(ctx, job.ID)
+	result, err := js.fetch(ctx, FetchRequest{Cmd: job.Cmd, URL: job.URL, PostData: job.postData, Defer: true, APIKey: requestInfoFrom(ctx).APIKey})
+
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	completed := js.now().UTC()
+	job.CompletedAt = &completed
+	if err != nil {
+		job.Status = JobFailed
+		job.Error = err.Error()
+		slog.Warn("job failed", "job", job.ID, "url", job.URL, "error", err)
+	} else {
+		job.Status = JobDone
+		job.Result = newJobResult(result)
+		job.ResultBytes = len(job.Result.Body)
+	}
+	js.pruneLocked()
+}
+
+// get returns a copy of the job with the given ID.
+func (js *jobStore) get(id string) (Job, bool) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	js.pruneLocked()
+	job, ok := js.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return job.snapshot(), true
+}
+
+// snapshot returns a copy of the job with its current queue position.
+// The caller must hold the store's lock.
+func (job *Job) snapshot() Job {
+	snapshot := *job
+	if job.CompletedAt == nil {
+		snapshot.Queue = job.ticket.status()
+	}
+	return snapshot
+}
+
+// delete removes a job, cancelling it if it has not completed yet.
+func (js *jobStore) delete(id string) bool {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	job, ok := js.jobs[id]
+	if !ok {
+		return false
+	}
+	job.cancel()
+	js.removeLocked(job)
+	return true
+}
+
+// jobFilter selects jobs when listing.
+type jobFilter struct {
+	Status string
+	Domain string
+	Limit  int
+	Cursor string
+}
+
+// list returns a page of jobs matching f, newest first, without their
+// results. The returned cursor fetches the next page and is empty on the
+// last one.
+func (js *jobStore) list(f jobFilter) ([]Job, string) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	js.pruneLocked()
+
+	before := int64(-1)
+	if f.Cursor != "" {
+		before, _ = strconv.ParseInt(f.Cursor, 10, 64)
+	}
+	var page []Job
+	for i := len(js.order) - 1; i >= 0; i-- {
+		job := js.order[i]
+		if before >= 0 && job.seq >= before {
+			continue
+		}
+		if f.Status != "" && job.Status != f.Status {
+			continue
+		}
+		if f.Domain != "" && !jobMatchesDomain(job, f.Domain) {
+			continue
+		}
+		if len(page) == f.Limit {
+			return page, strconv.FormatInt(page[len(page)-1].seq, 10)
+		}
+		summary := job.snapshot()
+		summary.Result = nil
+		page = append(page, summary)
+	}
+	return page, ""
+}
+
+func jobMatchesDomain(job *Job, domain string) bool {
+	u, err := url.Parse(job.URL)
+	if err != nil {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	domain = strings.ToLower(domain)
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+// pruneLocked applies the retention limits to completed jobs. Jobs that
+// are still queued or running are never dropped.
+func (js *jobStore) pruneLocked() {
+	now := js.now()
+	count, size := 0, 0
+	for _, job := range js.order {
+		if job.CompletedAt != nil {
+			count++
+			size += job.ResultBytes
+		}
+	}
+	for _, job := range append([]*Job(nil), js.order...) {
+		if job.CompletedAt == nil {
+			continue
+		}
+		expired := js.ttl > 0 && now.Sub(*job.CompletedAt) > js.ttl
+		overCount := js.maxCount > 0 && count > js.maxCount
+		overBytes := js.maxBytes > 0 && size > js.maxBytes
+		if !expired && !overCount && !overBytes {
+			continue
+		}
+		js.removeLocked(job)
+		count--
+		size -= job.ResultBytes
+	}
+}
+
+func (js *jobStore) removeLocked(job *Job) {
+	delete(js.jobs, job.ID)
+	for i, j := range js.order {
+		if j == job {
+			js.order = append(js.order[:i], js.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// ServeHTTP implements the job API:
+//
+//	POST   /api/v1/jobs       submit {"url": "...", "cmd": "request.get"},
+//	                          or "request.post" with "post_data"
+//	GET    /api/v1/jobs       list, filtered by ?status= and ?domain=,
+//	                          paginated with ?limit= and ?cursor=
+//	GET    /api/v1/jobs/{id}  fetch a job and its result
+//	DELETE /api/v1/jobs/{id}  cancel and delete a job
+func (js *jobStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, JobsPath), "/")
+	switch {
+	case id == "" && r.Method == http.MethodPost:
+		js.serveSubmit(w, r)
+	case id == "" && r.Method == http.MethodGet:
+		js.serveList(w, r)
+	case id != "" && r.Method == http.MethodGet:
+		job, ok := js.get(id)
+		if !ok {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "job not found"})
+			return
+		}
+		writeJSON(w, http.StatusOK, job)
+	case id != "" && r.Method == http.MethodDelete:
+		if !js.delete(id) {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "job not found"})
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (js *jobStore) serveSubmit(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		URL      string `json:"url"`
+		Cmd      string `json:"cmd"`
+		PostData string `json:"post_data"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&body); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON body: " + err.Error()})
+		return
+	}
+	if body.Cmd == "" {
+		body.Cmd = "request.get"
+	}
+	if body.Cmd != "request.get" && body.Cmd != "request.post" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "cmd must be request.get or request.post"})
+		return
+	}
+	if (body.Cmd == "request.post") != (body.PostData != "") {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "post_data is required with request.post, and only allowed with it"})
+		return
+	}
+	if !isAbsoluteHTTPURL(body.URL) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "url must be an absolute http or https URL"})
+		return
+	}
+
+	job, err := js.submit(r.Context(), body.Cmd, body.URL, body.PostData)
+	if err != nil {
+		writeJSON(w, http.StatusTooManyRequests, map[string]string{"error": err.Error()})
+		return
+	}
+	w.Header().Set("Location", JobsPath+"/"+job.ID)
+	writeJSON(w, http.StatusAccepted, job)
+}
+
+func isAbsoluteHTTPURL(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+func (js *jobStore) serveList(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	f := jobFilter{
+		Status: query.Get("status"),
+		Domain: query.Get("domain"),
+		Limit:  50,
+		Cursor: query.Get("cursor"),
+	}
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > 1000 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "limit must be between 1 and 1000"})
+			return
+		}
+		f.Limit = n
+	}
+
+	jobs, next := js.list(f)
+	if jobs == nil {
+		jobs = []Job{}
+	}
+	writeJSON(w, http.StatusOK, struct {
+		Jobs       []Job  `json:"jobs"`
+		NextCursor string `json:"next_cursor,omitempty"`
+	}{jobs, next})
+}
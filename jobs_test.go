@@ -0,0 +1,257 @@
+package flareproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitForJob polls the store until the job has completed.
+func waitForJob(t *testing.T, js *jobStore, id string) Job {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		job, ok := js.get(id)
+		if !ok {
+			t.Fatalf("job %s disappeared", id)
+		}
+		if job.CompletedAt != nil {
+			return job
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("job %s did not complete", id)
+	return Job{}
+}
+
+func newTestJobStore(fetch func(ctx context.Context, req FetchRequest) (*FetchResult, error)) *jobStore {
+	return &jobStore{
+		fetch:      fetch,
+		maxPending: 1000,
+		maxCount:   1000,
+		maxBytes:   64 << 20,
+		ttl:        time.Hour,
+		now:        time.Now,
+		jobs:       make(map[string]*Job),
+	}
+}
+
+func TestJobAPI(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(testResponse("<html>job</html>"))
+	}))
+	defer mockServer.Close()
+	t.Setenv("FLARESOLVERR_URL", mockServer.URL)
+	handler := NewDirectHandler()
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("POST", JobsPath, strings.NewReader(`{"url":"https://example.com/"}`)))
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("submit status = %d, want 202: %s", rr.Code, rr.Body.String())
+	}
+	var submitted Job
+	json.Unmarshal(rr.Body.Bytes(), &submitted)
+	if rr.Header().Get("Location") != JobsPath+"/"+submitted.ID {
+		t.Errorf("Location = %q", rr.Header().Get("Location"))
+	}
+	waitForJob(t, handler.jobs, submitted.ID)
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", JobsPath+"/"+submitted.ID, nil))
+	var job Job
+	json.Unmarshal(rr.Body.Bytes(), &job)
+	if job.Status != JobDone || job.Result == nil || job.Result.Body != "<html>job</html>" {
+		t.Fatalf("job = %+v", job)
+	}
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("DELETE", JobsPath+"/"+submitted.ID, nil))
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("delete status = %d, want 204", rr.Code)
+	}
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", JobsPath+"/"+submitted.ID, nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("status after delete = %d, want 404", rr.Code)
+	}
+
+	for _, body := range []string{
+		`{"url":"example.com"}`,
+		`{"url":"https://example.com/","cmd":"sessions.list"}`,
+		`{"url":"https://example.com/","cmd":"request.post"}`,
+		`{"url":"https://example.com/","post_data":"a=1"}`,
+		`not json`,
+	} {
+		rr = httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("POST", JobsPath, strings.NewReader(body)))
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("submit %s: status = %d, want 400", body, rr.Code)
+		}
+	}
+}
+
+func TestJobQueuePosition(t *testing.T) {
+	unblock := make(chan struct{})
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+		json.NewEncoder(w).Encode(testResponse("<html>job</html>"))
+	}))
+	defer mockServer.Close()
+	t.Setenv("FLARESOLVERR_URL", mockServer.URL)
+	t.Setenv("BACKEND_MAX_CONCURRENCY", "1")
+	handler := NewDirectHandler()
+
+	running, _ := handler.jobs.submit(context.Background(), "request.get", "https://one.example/", "")
+	waiting, _ := handler.jobs.submit(context.Background(), "request.get", "https://two.example/", "")
+	deadline := time.Now().Add(5 * time.Second)
+	var queued Job
+	for {
+		first, _ := handler.jobs.get(running.ID)
+		second, _ := handler.jobs.get(waiting.ID)
+		if first.Queue == nil && second.Queue != nil {
+			queued = second
+			break
+		}
+		if first.Queue != nil {
+			queued = first
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no job reported a queue position")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if queued.Queue.Position != 1 || queued.Status != JobRunning {
+		t.Errorf("queued job = %+v, queue %+v", queued, queued.Queue)
+	}
+
+	close(unblock)
+	for _, id := range []string{running.ID, waiting.ID} {
+		if job := waitForJob(t, handler.jobs, id); job.Queue != nil {
+			t.Errorf("completed job has queue %+v", job.Queue)
+		}
+	}
+}
+
+func TestJobListing(t *testing.T) {
+	js := newTestJobStore(func(ctx context.Context, req FetchRequest) (*FetchResult, error) {
+		if strings.Contains(req.URL, "fail") {
+			return nil, errors.New("boom")
+		}
+		return &FetchResult{Response: testResponse("ok"), meta: responseMeta{Status: 200}}, nil
+	})
+	var ids []string
+	for _, u := range []string{"https://a.example.com/1", "https://fail.test/", "https://example.com/2", "https://other.test/"} {
+		job, _ := js.submit(context.Background(), "request.get", u, "")
+		waitForJob(t, js, job.ID)
+		ids = append(ids, job.ID)
+	}
+
+	tests := []struct {
+		name   string
+		filter jobFilter
+		want   []string
+	}{
+		{name: "all newest first", filter: jobFilter{Limit: 10}, want: []string{ids[3], ids[2], ids[1], ids[0]}},
+		{name: "by status", filter: jobFilter{Status: JobFailed, Limit: 10}, want: []string{ids[1]}},
+		{name: "by domain", filter: jobFilter{Domain: "example.com", Limit: 10}, want: []string{ids[2], ids[0]}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jobs, _ := js.list(tt.filter)
+			if len(jobs) != len(tt.want) {
+				t.Fatalf("got %d jobs, want %d", len(jobs), len(tt.want))
+			}
+			for i, job := range jobs {
+				if job.ID != tt.want[i] {
+					t.Errorf("jobs[%d] = %s, want %s", i, job.ID, tt.want[i])
+				}
+				if job.Result != nil {
+					t.Error("listing should not include results")
+				}
+			}
+		})
+	}
+
+	// Paginate two at a time
+	var seen []string
+	cursor := ""
+	for page := 0; page < 3; page++ {
+		jobs, next := js.list(jobFilter{Limit: 2, Cursor: cursor})
+		for _, job := range jobs {
+			seen = append(seen, job.ID)
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	if strings.Join(seen, ",") != strings.Join([]string{ids[3], ids[2], ids[1], ids[0]}, ",") {
+		t.Errorf("paginated jobs = %v", seen)
+	}
+}
+
+func TestJobRetention(t *testing.T) {
+	now := time.Now()
+	js := newTestJobStore(func(ctx context.Context, req FetchRequest) (*FetchResult, error) {
+		return &FetchResult{Response: testResponse(strings.Repeat("x", 10)), meta: responseMeta{Status: 200}}, nil
+	})
+	js.now = func() time.Time { return now }
+	js.maxCount = 3
+	js.maxBytes = 25
+
+	var ids []string
+	for i := 0; i < 3; i++ {
+		job, _ := js.submit(context.Background(), "request.get", "https://example.com/", "")
+		waitForJob(t, js, job.ID)
+		ids = append(ids, job.ID)
+	}
+	// 30 bytes exceed the 25 byte limit, so the oldest result is dropped
+	if _, ok := js.get(ids[0]); ok {
+		t.Error("oldest job should have been dropped by the size limit")
+	}
+	if _, ok := js.get(ids[2]); !ok {
+		t.Error("newest job should be retained")
+	}
+
+	now = now.Add(2 * time.Hour)
+	if jobs, _ := js.list(jobFilter{Limit: 10}); len(jobs) != 0 {
+		t.Errorf("got %d jobs after the TTL, want 0", len(jobs))
+	}
+}
+
+func TestJobPostAndPendingLimit(t *testing.T) {
+	unblock := make(chan struct{})
+	js := newTestJobStore(func(ctx context.Context, req FetchRequest) (*FetchResult, error) {
+		<-unblock
+		return &FetchResult{Response: testResponse(req.Cmd + " " + req.PostData), meta: responseMeta{Status: 200}}, nil
+	})
+	js.maxPending = 1
+
+	rr := httptest.NewRecorder()
+	js.ServeHTTP(rr, httptest.NewRequest("POST", JobsPath, strings.NewReader(`{"url":"https://example.com/login","cmd":"request.post","post_data":"user=a"}`)))
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("submit status = %d, want 202: %s", rr.Code, rr.Body.String())
+	}
+	var submitted Job
+	json.Unmarshal(rr.Body.Bytes(), &submitted)
+
+	rr = httptest.NewRecorder()
+	js.ServeHTTP(rr, httptest.NewRequest("POST", JobsPath, strings.NewReader(`{"url":"https://example.com/"}`)))
+	if rr.Code != http.StatusTooManyRequests {
+		t.Errorf("submit over the pending limit: status = %d, want 429", rr.Code)
+	}
+
+	close(unblock)
+	if job := waitForJob(t, js, submitted.ID); job.Result == nil || job.Result.Body != "request.post user=a" {
+		t.Errorf("job = %+v, want the form posted", job)
+	}
+	if _, err := js.submit(context.Background(), "request.get", "https://example.com/", ""); err != nil {
+		t.Errorf("submit after the job completed: %v", err)
+	}
+}
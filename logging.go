@@ -0,0 +1,333 @@
+package flareproxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RequestIDHeader carries the request ID. An incoming value is reused,
+// otherwise one is generated; either way it is returned to the client and
+// forwarded to FlareSolverr so that calls can be correlated across logs.
+const RequestIDHeader = "X-Request-ID"
+
+// APIKeyHeader carries the client's API key, which identifies the client
+// for targeted debug logging.
+const APIKeyHeader = "X-Api-Key"
+
+// contextKey is the type of the package's context keys, all declared
+// here so that they cannot collide.
+type contextKey int
+
+const (
+	// requestInfoKey is the context key of a request's *requestInfo.
+	requestInfoKey contextKey = iota
+	// upstreamProxyKey is the context key of a request's upstream proxy.
+	upstreamProxyKey
+	// socksTargetKey is the context key of the target of a SOCKS
+	// connection.
+	socksTargetKey
+	// tunnelKey is the context key of the API key a CONNECT or SOCKS
+	// tunnel was opened with. Requests sent through the tunnel are
+	// authenticated by it rather than by credentials of their own.
+	tunnelKey
+	// requestOptionsKey is the context key of a request's options.
+	requestOptionsKey
+	// queueTicketKey is the context key of a request's queueTicket.
+	queueTicketKey
+	// fetchRequestKey is the context key of the FetchRequest being
+	// processed.
+	fetchRequestKey
+)
+
+// requestInfo collects what is known about a request while it is handled
+// so that it can be included in the access log entry.
+type requestInfo struct {
+	ID          string
+	Target      string
+	FlareStatus string
+	Cache       string
+	Backend     string
+	TraceID     string
+	APIKey      string
+	// Remote is set for requests from clients of the listeners, whose
+	// fetches AUTH_RULES domain rules apply to, and ClientCert if they
+	// came with a verified client certificate.
+	Remote     bool
+	ClientCert bool
+}
+
+// logLevel is the level of the default logger. The admin API can change
+// it at runtime.
+var logLevel = new(slog.LevelVar)
+
+// setupLogging installs the default structured logger configured through
+// LOG_FORMAT ("json" or "text") and LOG_LEVEL ("debug", "info", "warn" or
+// "error"), and the access log configured through ACCESS_LOG.
+func setupLogging() {
+	logLevel.Set(parseLogLevel(os.Getenv("LOG_LEVEL")))
+	slog.SetDefault(slog.New(newLogHandler(os.Stderr, os.Getenv("LOG_FORMAT"), logLevel)))
+	if old := accessLog.Swap(newAccessLoggerFromEnv()); old != nil {
+		old.close()
+	}
+}
+
+func newLogger(w io.Writer, format, level string) *slog.Logger {
+	lvl := new(slog.LevelVar)
+	lvl.Set(parseLogLevel(level))
+	return slog.New(newLogHandler(w, format, lvl))
+}
+
+func parseLogLevel(level string) slog.Level {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return slog.LevelInfo
+	}
+	return lvl
+}
+
+// logHandler filters records by a level that may change at runtime. The
+// debug variant lets every record through; it is used for requests
+// selected for debug logging.
+type logHandler struct {
+	slog.Handler
+	level slog.Leveler
+	debug bool
+}
+
+func newLogHandler(w io.Writer, format string, level slog.Leveler) *logHandler {
+	// The wrapped handler sees everything, filtering happens in Enabled
+	opts := &slog.HandlerOptions{Level: slog.LevelDebug}
+	if strings.EqualFold(format, "text") {
+		return &logHandler{Handler: slog.NewTextHandler(w, opts), level: level}
+	}
+	return &logHandler{Handler: slog.NewJSONHandler(w, opts), level: level}
+}
+
+func (h *logHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return h.debug || level >= h.level.Level()
+}
+
+func (h *logHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &logHandler{Handler: h.Handler.WithAttrs(attrs), level: h.level, debug: h.debug}
+}
+
+func (h *logHandler) WithGroup(name string) slog.Handler {
+	return &logHandler{Handler: h.Handler.WithGroup(name), level: h.level, debug: h.debug}
+}
+
+// debugTargets selects requests that log at debug level regardless of the
+// log level, by target domain (including subdomains) or by API key.
+type debugTargets struct {
+	mu      sync.Mutex
+	domains map[string]bool
+	keys    map[string]bool
+}
+
+// debugLogging holds the debug targets set through the admin API.
+var debugLogging = &debugTargets{}
+
+// set replaces the targets.
+func (d *debugTargets) set(domains, keys []string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.domains = make(map[string]bool)
+	for _, domain := range domains {
+		d.domains[strings.ToLower(domain)] = true
+	}
+	d.keys = make(map[string]bool)
+	for _, key := range keys {
+		d.keys[key] = true
+	}
+}
+
+// list returns the targets in sorted order.
+func (d *debugTargets) list() (domains, keys []string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	domains, keys = []string{}, []string{}
+	for domain := range d.domains {
+		domains = append(domains, domain)
+	}
+	for key := range d.keys {
+		keys = append(keys, key)
+	}
+	sort.Strings(domains)
+	sort.Strings(keys)
+	return domains, keys
+}
+
+// match reports whether a request is selected for debug logging.
+func (d *debugTargets) match(info *requestInfo) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if info.APIKey != "" && d.keys[info.APIKey] {
+		return true
+	}
+	if len(d.domains) == 0 {
+		return false
+	}
+	u, err := url.Parse(info.Target)
+	if err != nil {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	for host != "" {
+		if d.domains[host] {
+			return true
+		}
+		_, host, _ = strings.Cut(host, ".")
+	}
+	return false
+}
+
+// withRequestLogging assigns each request an ID and logs one structured
+// entry per request once it has been handled, and a line in the access
+// log if there is one. The request is also
+// recorded in the metrics, and with TRACING_ENABLED it joins the client's
+// W3C trace or starts a new one.
+func withRequestLogging(mode string, next http.Handler) http.Handler {
+	tracing := envBool("TRACING_ENABLED", false)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		info := &requestInfo{
+			ID:     requestID(r.Header.Get(RequestIDHeader)),
+			APIKey: r.Header.Get(APIKeyHeader),
+		}
+		w.Header().Set(RequestIDHeader, info.ID)
+		if tracing {
+			info.TraceID = traceFromRequest(r)
+		}
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), requestInfoKey, info)))
+
+		target := info.Target
+		if target == "" {
+			target = r.URL.String()
+		}
+		status := rec.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		duration := time.Since(start)
+		if mode != "direct" || r.URL.Path != MetricsPath {
+			metrics.observeRequest(mode, status, duration, info.TraceID)
+		}
+		// The dashboard's own polling would crowd out client requests
+		if mode != "admin" {
+			history.record(historyEntry{
+				Time:       start,
+				Mode:       mode,
+				Method:     r.Method,
+				Target:     target,
+				Status:     status,
+				DurationMS: duration.Milliseconds(),
+				Cache:      info.Cache,
+				Backend:    info.Backend,
+			})
+		}
+		slog.Info("request",
+			"request_id", info.ID,
+			"mode", mode,
+			"method", r.Method,
+			"target", target,
+			"status", status,
+			"duration_ms", duration.Milliseconds(),
+			"bytes", rec.bytes,
+			"flaresolverr_status", info.FlareStatus,
+			"cache", info.Cache,
+			"backend", info.Backend,
+			"remote_addr", r.RemoteAddr,
+			"trace_id", info.TraceID,
+		)
+		logAccess(r, mode, info, start, duration, status, rec.bytes)
+	})
+}
+
+// requestInfoFrom returns the request information stored in ctx. It never
+// returns nil so callers need not care whether logging is enabled.
+func requestInfoFrom(ctx context.Context) *requestInfo {
+	if info, ok := ctx.Value(requestInfoKey).(*requestInfo); ok {
+		return info
+	}
+	return &requestInfo{}
+}
+
+// loggerFrom returns the default logger annotated with the request ID
+// stored in ctx, if any. For requests selected for debug logging the
+// logger logs at every level.
+func loggerFrom(ctx context.Context) *slog.Logger {
+	info, ok := ctx.Value(requestInfoKey).(*requestInfo)
+	if !ok {
+		return slog.Default()
+	}
+	logger := slog.Default()
+	if h, ok := logger.Handler().(*logHandler); ok && debugLogging.match(info) {
+		logger = slog.New(&logHandler{Handler: h.Handler, level: h.level, debug: true})
+	}
+	return logger.With("request_id", info.ID)
+}
+
+// requestID returns the client supplied ID if it is reasonable, or a new
+// random one.
+func requestID(incoming string) string {
+	if incoming != "" && len(incoming) <= 128 && isPrintableASCII(incoming) {
+		return incoming
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func isPrintableASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < 0x21 || s[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// statusRecorder records the status code and number of bytes written.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 && status >= 200 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap allows http.ResponseController to reach the underlying writer.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
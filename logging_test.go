@@ -0,0 +1,128 @@
+package flareproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWithRequestLogging(t *testing.T) {
+	var forwardedID string
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwardedID = r.Header.Get(RequestIDHeader)
+		json.NewEncoder(w).Encode(testResponse("<html>logged</html>"))
+	}))
+	defer mockServer.Close()
+	t.Setenv("FLARESOLVERR_URL", mockServer.URL)
+
+	var logs bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(newLogger(&logs, "json", "info"))
+
+	handler := withRequestLogging("direct", NewDirectHandler())
+
+	tests := []struct {
+		name     string
+		incoming string
+		wantID   string
+	}{
+		{name: "incoming ID is reused", incoming: "abc-123", wantID: "abc-123"},
+		{name: "ID is generated", incoming: ""},
+		{name: "unreasonable ID is replaced", incoming: "bad id\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs.Reset()
+			req := httptest.NewRequest("GET", "/example.com/page", nil)
+			if tt.incoming != "" {
+				req.Header.Set(RequestIDHeader, tt.incoming)
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			id := rr.Header().Get(RequestIDHeader)
+			if id == "" || (tt.wantID != "" && id != tt.wantID) || (tt.wantID == "" && id == tt.incoming) {
+				t.Errorf("response request ID = %q, want %q", id, tt.wantID)
+			}
+			if forwardedID != id {
+				t.Errorf("forwarded request ID = %q, want %q", forwardedID, id)
+			}
+
+			var entry map[string]interface{}
+			if err := json.Unmarshal(logs.Bytes(), &entry); err != nil {
+				t.Fatalf("log entry is not JSON: %v: %s", err, logs.String())
+			}
+			want := map[string]interface{}{
+				"request_id":          id,
+				"mode":                "direct",
+				"method":              "GET",
+				"target":              "https://example.com/page",
+				"status":              float64(200),
+				"bytes":               float64(len("<html>logged</html>")),
+				"flaresolverr_status": "ok",
+				"cache":               "BYPASS",
+				"backend":             mockServer.URL,
+			}
+			for key, value := range want {
+				if entry[key] != value {
+					t.Errorf("log %s = %v, want %v", key, entry[key], value)
+				}
+			}
+			if _, ok := entry["duration_ms"]; !ok {
+				t.Error("log entry has no duration_ms")
+			}
+		})
+	}
+}
+
+func TestNewLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := newLogger(&buf, "text", "warn")
+	logger.Info("hidden")
+	logger.Warn("shown")
+	if bytes.Contains(buf.Bytes(), []byte("hidden")) || !bytes.Contains(buf.Bytes(), []byte("level=WARN msg=shown")) {
+		t.Errorf("unexpected log output %q", buf.String())
+	}
+}
+
+func TestTargetedDebugLogging(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(testResponse("<html></html>"))
+	}))
+	defer mockServer.Close()
+	t.Setenv("FLARESOLVERR_URL", mockServer.URL)
+
+	var logs bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(newLogger(&logs, "json", "info"))
+	defer debugLogging.set(nil, nil)
+	debugLogging.set([]string{"debug.example"}, []string{"key-1"})
+
+	handler := withRequestLogging("direct", NewDirectHandler())
+	tests := []struct {
+		path      string
+		apiKey    string
+		wantDebug bool
+	}{
+		{path: "/other.example/", wantDebug: false},
+		{path: "/debug.example/", wantDebug: true},
+		{path: "/www.debug.example/page", wantDebug: true},
+		{path: "/other.example/", apiKey: "key-1", wantDebug: true},
+		{path: "/other.example/", apiKey: "key-2", wantDebug: false},
+	}
+	for _, tt := range tests {
+		logs.Reset()
+		req := httptest.NewRequest("GET", tt.path, nil)
+		if tt.apiKey != "" {
+			req.Header.Set(APIKeyHeader, tt.apiKey)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		if got := bytes.Contains(logs.Bytes(), []byte(`"level":"DEBUG"`)); got != tt.wantDebug {
+			t.Errorf("%s (key %q): debug logged = %v, want %v", tt.path, tt.apiKey, got, tt.wantDebug)
+		}
+	}
+}
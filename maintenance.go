@@ -0,0 +1,292 @@
+package flareproxy
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// What happens to requests for a domain during its maintenance window.
+const (
+	// MaintenanceDefer fails requests with 503 and a Retry-After header
+	// until the window ends. Jobs and scheduled fetches wait it out.
+	MaintenanceDefer = "defer"
+	// MaintenanceCache serves cached copies, even expired ones, and
+	// defers requests for pages not in the cache.
+	MaintenanceCache = "cache"
+)
+
+// MaintenanceError is returned for requests deferred by a maintenance
+// window, until it ends.
+type MaintenanceError struct {
+	Domain     string
+	RetryAfter time.Duration
+}
+
+func (e *MaintenanceError) Error() string {
+	return fmt.Sprintf("domain %s is in a maintenance window, retry in %s", e.Domain, e.RetryAfter.Round(time.Second))
+}
+
+// maintenanceWindow is a recurring window, starting at the times its cron
+// schedule matches and lasting for duration.
+type maintenanceWindow struct {
+	domain   string // with subdomains
+	schedule *cronSchedule
+	duration time.Duration
+	action   string
+}
+
+// maintenancePolicy holds the maintenance windows of MAINTENANCE_WINDOWS.
+type maintenancePolicy struct {
+	windows  []maintenanceWindow
+	location *time.Location
+	now      func() time.Time
+}
+
+// newMaintenancePolicyFromEnv reads MAINTENANCE_WINDOWS, a ";" separated
+// list of windows like "example.com=0 2 * * *|90m|cache", a domain and a
+// cron schedule of the window's starts, its duration and optionally the
+// action, defer by default. The cron times are in MAINTENANCE_TIMEZONE,
+// UTC by default. It returns nil if no window is set.
+func newMaintenancePolicyFromEnv() *maintenancePolicy {
+	p := &maintenancePolicy{location: time.UTC, now: time.Now}
+	if name := os.Getenv("MAINTENANCE_TIMEZONE"); name != "" {
+		location, err := time.LoadLocation(name)
+		if err != nil {
+			slog.Warn("invalid MAINTENANCE_TIMEZONE, using UTC", "timezone", name, "error", err)
+		} else {
+			p.location = location
+		}
+	}
+	for _, spec := range strings.Split(os.Getenv("MAINTENANCE_WINDOWS"), ";") {
+		if spec = strings.TrimSpace(spec); spec == "" {
+			continue
+		}
+		window, err := parseMaintenanceWindow(spec)
+		if err != nil {
+			slog.Warn("ignoring invalid MAINTENANCE_WINDOWS window", "window", spec, "error", err)
+			continue
+		}
+		p.windows = append(p.windows, window)
+	}
+	if len(p.windows) == 0 {
+		return nil
+	}
+	return p
+}
+
+func parseMaintenanceWindow(spec string) (maintenanceWindow, error) {
+	var window maintenanceWindow
+	domain, rest, ok := strings.Cut(spec, "=")
+	if !ok {
+		return window, errors.New("missing domain=")
+	}
+	window.domain = strings.ToLower(strings.TrimSpace(domain))
+	parts := strings.Split(rest, "|")
+	if len(parts) < 2 || len(parts) > 3 {
+		return window, errors.New("want schedule|duration[|action]")
+	}
+	schedule, err := parseCron(parts[0])
+	if err != nil {
+		return window, err
+	}
+	window.schedule = schedule
+	if window.duration, err = time.ParseDuration(strings.TrimSpace(parts[1])); err != nil || window.duration <= 0 {
+		return window, fmt.Errorf("invalid duration %q", parts[1])
+	}
+	if window.duration > 7*24*time.Hour {
+		return window, errors.New("windows last at most a week")
+	}
+	window.action = MaintenanceDefer
+	if len(parts) == 3 {
+		window.action = strings.TrimSpace(parts[2])
+	}
+	if window.action != MaintenanceDefer && window.action != MaintenanceCache {
+		return window, fmt.Errorf("unknown action %q", window.action)
+	}
+	return window, nil
+}
+
+// active returns the action of the window targetURL's domain is in, if
+// any, and when it ends. Of overlapping windows, cache wins over defer
+// and the later end counts.
+func (p *maintenancePolicy) active(targetURL string) (string, time.Time, bool) {
+	if p == nil {
+		return "", time.Time{}, false
+	}
+	host := requestHost(targetURL)
+	now := p.now().In(p.location)
+	var action string
+	var end time.Time
+	for _, window := range p.windows {
+		if host != window.domain && !strings.HasSuffix(host, "."+window.domain) {
+			continue
+		}
+		windowEnd, ok := window.endAfter(now)
+		if !ok {
+			continue
+		}
+		if action != MaintenanceCache {
+			action = window.action
+		}
+		if windowEnd.After(end) {
+			end = windowEnd
+		}
+	}
+	return action, end, action != ""
+}
+
+// endAfter returns the end of the latest start of the window before now,
+// if the window is still open.
+func (w maintenanceWindow) endAfter(now time.Time) (time.Time, bool) {
+	minute := now.Truncate(time.Minute)
+	for start := minute; now.Sub(start) < w.duration; start = start.Add(-time.Minute) {
+		if w.schedule.matches(start) {
+			return start.Add(w.duration), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// check returns a *MaintenanceError if the domain of targetURL is in a
+// maintenance window, and whether cached copies may be served instead.
+func (p *maintenancePolicy) check(targetURL string) (cacheOnly bool, err error) {
+	action, end, ok := p.active(targetURL)
+	if !ok {
+		return false, nil
+	}
+	return action == MaintenanceCache, &MaintenanceError{Domain: requestHost(targetURL), RetryAfter: end.Sub(p.now())}
+}
+
+// cachedCopy returns the cached copy of key, even an expired one, for
+// requests in a maintenance window, and whether it is fresh.
+func (s *solver) cachedCopy(key string) (cached *FlareSolverrResponse, fresh, ok bool) {
+	if key == "" {
+		return nil, false, false
+	}
+	if cached, ok := s.cache.Get(key); ok {
+		return cached, true, true
+	}
+	if cache, isStale := s.cache.(staleCache); isStale {
+		cached, ok = cache.GetStale(key)
+	}
+	return cached, false, ok
+}
+
+// cronSchedule is a standard five field cron expression: minute, hour,
+// day of month, month and day of week.
+type cronSchedule struct {
+	minutes, hours, days, months, weekdays map[int]bool
+	// Like cron, a time matches either day field if both are restricted
+	anyDay, anyWeekday bool
+}
+
+var (
+	cronMonths   = []string{"", "jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+	cronWeekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+)
+
+// parseCron parses a cron expression. Fields accept *, values, ranges
+// like 1-5, steps like */15 or 0-30/10, and lists of these separated by
+// commas; months and days of the week may be named (jan, mon), and
+// Sunday is 0 or 7.
+func parseCron(expr string) (*cronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron schedule %q must have 5 fields", expr)
+	}
+	var c cronSchedule
+	var err error
+	if c.minutes, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return nil, err
+	}
+	if c.hours, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return nil, err
+	}
+	if c.days, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return nil, err
+	}
+	if c.months, err = parseCronField(fields[3], 1, 12, cronMonths); err != nil {
+		return nil, err
+	}
+	if c.weekdays, err = parseCronField(fields[4], 0, 7, cronWeekdays); err != nil {
+		return nil, err
+	}
+	if c.weekdays[7] {
+		c.weekdays[0] = true
+	}
+	c.anyDay = strings.HasPrefix(fields[2], "*")
+	c.anyWeekday = strings.HasPrefix(fields[4], "*")
+	return &c, nil
+}
+
+func parseCronField(field string, min, max int, names []string) (map[int]bool, error) {
+	values := make(map[int]bool)
+	for _, part := range strings.Split(field, ",") {
+		span, stepText, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepText); err != nil || step <= 0 {
+				return nil, fmt.Errorf("invalid step in %q", part)
+			}
+		}
+		lo, hi := min, max
+		if span != "*" {
+			from, to, isRange := strings.Cut(span, "-")
+			var err error
+			if lo, err = cronValue(from, min, max, names); err != nil {
+				return nil, err
+			}
+			hi = lo
+			if isRange {
+				if hi, err = cronValue(to, min, max, names); err != nil {
+					return nil, err
+				}
+			} else if hasStep {
+				hi = max
+			}
+			if hi < lo {
+				return nil, fmt.Errorf("invalid range %q", span)
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			values[v] = true
+		}
+	}
+	return values, nil
+}
+
+func cronValue(s string, min, max int, names []string) (int, error) {
+	for i, name := range names {
+		if name != "" && strings.EqualFold(s, name) {
+			return i, nil
+		}
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < min || v > max {
+		return 0, fmt.Errorf("invalid cron value %q", s)
+	}
+	return v, nil
+}
+
+// matches reports whether the schedule fires in the minute of t.
+func (c *cronSchedule) matches(t time.Time) bool {
+	if !c.minutes[t.Minute()] || !c.hours[t.Hour()] || !c.months[int(t.Month())] {
+		return false
+	}
+	day, weekday := c.days[t.Day()], c.weekdays[int(t.Weekday())]
+	switch {
+	case c.anyDay && c.anyWeekday:
+		return true
+	case c.anyDay:
+		return weekday
+	case c.anyWeekday:
+		return day
+	}
+	return day || weekday
+}
@@ -0,0 +1,131 @@
+package flareproxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/kljensen/flareproxygo/flaresolverr/flaresolverrtest"
+)
+
+func TestParseCron(t *testing.T) {
+	at := func(s string) time.Time {
+		tm, err := time.Parse("2006-01-02 15:04", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+	tests := []struct {
+		expr    string
+		match   []string
+		noMatch []string
+		wantErr bool
+	}{
+		{expr: "0 2 * * *", match: []string{"2026-10-16 02:00"}, noMatch: []string{"2026-10-16 02:01", "2026-10-16 03:00"}},
+		{expr: "*/15 9-17 * * mon-fri", match: []string{"2026-10-16 09:45"}, noMatch: []string{"2026-10-17 09:45", "2026-10-16 09:50"}},
+		{expr: "30 1 1,15 * 7", match: []string{"2026-10-15 01:30", "2026-10-18 01:30"}, noMatch: []string{"2026-10-16 01:30"}},
+		{expr: "0 0 * dec *", match: []string{"2026-12-03 00:00"}, noMatch: []string{"2026-11-03 00:00"}},
+		{expr: "0 2 * *", wantErr: true},
+		{expr: "61 * * * *", wantErr: true},
+		{expr: "5-1 * * * *", wantErr: true},
+		{expr: "*/0 * * * *", wantErr: true},
+	}
+	for _, tt := range tests {
+		c, err := parseCron(tt.expr)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseCron(%q) error = %v", tt.expr, err)
+			continue
+		}
+		for _, s := range tt.match {
+			if !c.matches(at(s)) {
+				t.Errorf("%q does not match %s", tt.expr, s)
+			}
+		}
+		for _, s := range tt.noMatch {
+			if c.matches(at(s)) {
+				t.Errorf("%q matches %s", tt.expr, s)
+			}
+		}
+	}
+}
+
+func TestMaintenanceWindows(t *testing.T) {
+	t.Setenv("MAINTENANCE_WINDOWS", "example.com=0 2 * * *|90m; shop.example=0 3 * * *|1h|cache; shop.example=30 3 * * *|1h; bad=0 2 * *|1h")
+	p := newMaintenancePolicyFromEnv()
+	if len(p.windows) != 3 {
+		t.Fatalf("parsed %d windows, want 3", len(p.windows))
+	}
+	tests := []struct {
+		url        string
+		at         string
+		wantAction string
+		wantEnd    string
+	}{
+		{url: "https://example.com/", at: "01:59"},
+		{url: "https://www.example.com/", at: "02:00", wantAction: MaintenanceDefer, wantEnd: "03:30"},
+		{url: "https://example.com/", at: "03:29", wantAction: MaintenanceDefer, wantEnd: "03:30"},
+		{url: "https://example.com/", at: "03:30"},
+		{url: "https://notexample.com/", at: "02:30"},
+		{url: "https://shop.example/", at: "03:45", wantAction: MaintenanceCache, wantEnd: "04:30"},
+	}
+	for _, tt := range tests {
+		now, _ := time.Parse("2006-01-02 15:04", "2026-10-16 "+tt.at)
+		p.now = func() time.Time { return now }
+		action, end, ok := p.active(tt.url)
+		if action != tt.wantAction || ok != (tt.wantAction != "") || (ok && end.Format("15:04") != tt.wantEnd) {
+			t.Errorf("active(%s) at %s = %q until %s, want %q until %s", tt.url, tt.at, action, end.Format("15:04"), tt.wantAction, tt.wantEnd)
+		}
+	}
+}
+
+func TestMaintenanceFetch(t *testing.T) {
+	fs := flaresolverrtest.NewServer()
+	defer fs.Close()
+	t.Setenv("FLARESOLVERR_URL", fs.Endpoint())
+	t.Setenv("CACHE_TTL", "1m")
+	t.Setenv("MAINTENANCE_WINDOWS", "closed.example=0 2 * * *|1m; cached.example=0 2 * * *|1m|cache")
+	handler := NewDirectHandler()
+	policy := handler.maintenance
+	handler.maintenance = nil
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+	get("/cached.example/page")
+	handler.maintenance = policy
+	policy.now = func() time.Time { return time.Date(2026, 10, 16, 2, 0, 30, 0, time.UTC) }
+
+	if w := get("/closed.example/"); w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Errorf("GET in a defer window = %d, Retry-After %q; want 503", w.Code, w.Header().Get("Retry-After"))
+	}
+	if w := get("/cached.example/page"); w.Code != http.StatusOK || w.Header().Get(TrailerCache) != "HIT" {
+		t.Errorf("cached page in a cache window = %d from %q", w.Code, w.Header().Get(TrailerCache))
+	}
+	if w := get("/cached.example/other"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("uncached page in a cache window = %d, want 503", w.Code)
+	}
+	if got := len(fs.Requests()); got != 1 {
+		t.Errorf("FlareSolverr got %d requests, want 1", got)
+	}
+
+	// Background fetches wait for the window to end
+	start := time.Now()
+	policy.now = func() time.Time {
+		return time.Date(2026, 10, 16, 2, 0, 59, int(950*time.Millisecond), time.UTC).Add(time.Since(start))
+	}
+	result, err := handler.process(context.Background(), FetchRequest{URL: "https://closed.example/", Defer: true})
+	if err != nil || result.Response.Solution.Status != http.StatusOK || time.Since(start) < 40*time.Millisecond {
+		t.Errorf("deferred fetch = %v after %s", err, time.Since(start))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	policy.now = func() time.Time { return time.Date(2026, 10, 16, 2, 0, 30, 0, time.UTC) }
+	if _, err := handler.process(ctx, FetchRequest{URL: "https://closed.example/other", Defer: true}); !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled deferred fetch error = %v", err)
+	}
+}
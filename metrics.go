@@ -0,0 +1,313 @@
+package flareproxy
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MetricsPath serves Prometheus metrics on the direct server.
+const MetricsPath = "/metrics"
+
+// Content types of the two exposition formats. Exemplars are only part of
+// OpenMetrics, which Prometheus requests when exemplar storage is enabled.
+const (
+	prometheusContentType  = "text/plain; version=0.0.4; charset=utf-8"
+	openMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+)
+
+// latencyBuckets are the histogram bucket bounds in seconds. Solves take
+// anywhere from a second to FlareSolverr's 60 second timeout.
+var latencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 20, 30, 60}
+
+// qualityBuckets are the histogram bucket bounds of solve quality scores,
+// which range from 0 to 1.
+var qualityBuckets = []float64{0.1, 0.25, 0.5, 0.75, 0.9, 1}
+
+// exemplar links an observation to the trace it was recorded in.
+type exemplar struct {
+	traceID string
+	value   float64
+	at      time.Time
+}
+
+// histogram is a Prometheus histogram for one label set. Each bucket keeps
+// the most recent traced observation that fell into it as an exemplar, so
+// a slow bucket in a dashboard leads straight to a slow trace.
+type histogram struct {
+	buckets   []float64
+	counts    []uint64 // per bucket, the last one being +Inf
+	exemplars []*exemplar
+	sum       float64
+	count     uint64
+}
+
+func (h *histogram) observe(value float64, traceID string, now time.Time) {
+	i := sort.SearchFloat64s(h.buckets, value)
+	h.counts[i]++
+	h.sum += value
+	h.count++
+	if traceID != "" {
+		h.exemplars[i] = &exemplar{traceID: traceID, value: value, at: now}
+	}
+}
+
+// histogramVec is a histogram partitioned by label values.
+type histogramVec struct {
+	name    string
+	help    string
+	buckets []float64
+	labels  []string
+	series  map[string]*histogram // keyed by the joined label values
+	values  map[string][]string
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{
+		name:    name,
+		help:    help,
+		buckets: buckets,
+		labels:  labels,
+		series:  make(map[string]*histogram),
+		values:  make(map[string][]string),
+	}
+}
+
+func (v *histogramVec) with(values ...string) *histogram {
+	key := strings.Join(values, "\xff")
+	h, ok := v.series[key]
+	if !ok {
+		h = &histogram{
+			buckets:   v.buckets,
+			counts:    make([]uint64, len(v.buckets)+1),
+			exemplars: make([]*exemplar, len(v.buckets)+1),
+		}
+		v.series[key] = h
+		v.values[key] = values
+	}
+	return h
+}
+
+// counterVec is a counter partitioned by label values.
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+	series map[string]float64
+	values map[string][]string
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		series: make(map[string]float64),
+		values: make(map[string][]string),
+	}
+}
+
+func (v *counterVec) inc(values ...string) {
+	key := strings.Join(values, "\xff")
+	v.series[key]++
+	v.values[key] = values
+}
+
+// gaugeVec is a gauge partitioned by label values.
+type gaugeVec struct {
+	name   string
+	help   string
+	labels []string
+	series map[string]float64
+	values map[string][]string
+}
+
+func newGaugeVec(name, help string, labels ...string) *gaugeVec {
+	return &gaugeVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		series: make(map[string]float64),
+		values: make(map[string][]string),
+	}
+}
+
+func (v *gaugeVec) set(value float64, values ...string) {
+	key := strings.Join(values, "\xff")
+	v.series[key] = value
+	v.values[key] = values
+}
+
+// metricsRegistry holds the proxy's metrics. It is hand-written rather
+// than using the Prometheus client library to keep the binary free of
+// dependencies.
+type metricsRegistry struct {
+	mu              sync.Mutex
+	requests        *counterVec
+	requestDuration *histogramVec
+	solveDuration   *histogramVec
+	solveQuality    *histogramVec
+	clockSkew       *gaugeVec
+	certExpiry      *gaugeVec
+	now             func() time.Time
+}
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{
+		requests: newCounterVec("flareproxygo_requests",
+			"Requests handled, by server mode and status code.", "mode", "code"),
+		requestDuration: newHistogramVec("flareproxygo_request_duration_seconds",
+			"Time to handle a request, by server mode.", latencyBuckets, "mode"),
+		solveDuration: newHistogramVec("flareproxygo_solve_duration_seconds",
+			"Time FlareSolverr took to solve a request, by backend.", latencyBuckets, "backend"),
+		solveQuality: newHistogramVec("flareproxygo_solve_quality",
+			"Quality score of solved pages, from 0 for a challenge or empty page to 1.", qualityBuckets),
+		clockSkew: newGaugeVec("flareproxygo_backend_clock_skew_seconds",
+			"How far a backend's clock is ahead of the proxy's, from its last response.", "backend"),
+		certExpiry: newGaugeVec("flareproxygo_certificate_expiry_timestamp_seconds",
+			"When a monitored TLS certificate expires, as a Unix timestamp.", "name"),
+		now: time.Now,
+	}
+}
+
+// metrics is the registry served on /metrics.
+var metrics = newMetricsRegistry()
+
+// observeRequest records a handled request. traceID may be empty when
+// tracing is disabled.
+func (m *metricsRegistry) observeRequest(mode string, status int, d time.Duration, traceID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests.inc(mode, strconv.Itoa(status))
+	m.requestDuration.with(mode).observe(d.Seconds(), traceID, m.now())
+}
+
+// observeSolve records the duration of a FlareSolverr solve.
+func (m *metricsRegistry) observeSolve(backend string, d time.Duration, traceID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.solveDuration.with(backend).observe(d.Seconds(), traceID, m.now())
+}
+
+// observeQuality records the quality score of a solved page.
+func (m *metricsRegistry) observeQuality(score float64, traceID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.solveQuality.with().observe(score, traceID, m.now())
+}
+
+// setClockSkew records the clock skew last seen for a backend.
+func (m *metricsRegistry) setClockSkew(backend string, skew time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.clockSkew.set(skew.Seconds(), backend)
+}
+
+// setCertExpiry records when a monitored certificate expires.
+func (m *metricsRegistry) setCertExpiry(name string, notAfter time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.certExpiry.set(float64(notAfter.Unix()), name)
+}
+
+// ServeHTTP writes the metrics in the OpenMetrics format, including
+// exemplars, when the scraper accepts it, and in the classic Prometheus
+// text format otherwise.
+func (m *metricsRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	openMetrics := strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text")
+	if openMetrics {
+		w.Header().Set("Content-Type", openMetricsContentType)
+	} else {
+		w.Header().Set("Content-Type", prometheusContentType)
+	}
+	m.write(w, openMetrics)
+}
+
+func (m *metricsRegistry) write(w io.Writer, openMetrics bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// OpenMetrics names counters without the _total suffix of their samples
+	counterName := m.requests.name
+	if !openMetrics {
+		counterName += "_total"
+	}
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", counterName, m.requests.help, counterName)
+	for _, key := range sortedKeys(m.requests.values) {
+		fmt.Fprintf(w, "%s_total%s %s\n", m.requests.name,
+			formatLabels(m.requests.labels, m.requests.values[key], "", ""), formatFloat(m.requests.series[key]))
+	}
+
+	for _, v := range []*histogramVec{m.requestDuration, m.solveDuration, m.solveQuality} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", v.name, v.help, v.name)
+		for _, key := range sortedKeys(v.values) {
+			h, values := v.series[key], v.values[key]
+			var cumulative uint64
+			for i, count := range h.counts {
+				cumulative += count
+				le := "+Inf"
+				if i < len(v.buckets) {
+					le = formatFloat(v.buckets[i])
+				}
+				fmt.Fprintf(w, "%s_bucket%s %d", v.name, formatLabels(v.labels, values, "le", le), cumulative)
+				if e := h.exemplars[i]; openMetrics && e != nil {
+					fmt.Fprintf(w, " # {trace_id=\"%s\"} %s %s", e.traceID, formatFloat(e.value),
+						strconv.FormatFloat(float64(e.at.UnixMilli())/1000, 'f', 3, 64))
+				}
+				fmt.Fprintln(w)
+			}
+			fmt.Fprintf(w, "%s_sum%s %s\n", v.name, formatLabels(v.labels, values, "", ""), formatFloat(h.sum))
+			fmt.Fprintf(w, "%s_count%s %d\n", v.name, formatLabels(v.labels, values, "", ""), h.count)
+		}
+	}
+	for _, v := range []*gaugeVec{m.clockSkew, m.certExpiry} {
+		if len(v.values) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", v.name, v.help, v.name)
+		for _, key := range sortedKeys(v.values) {
+			fmt.Fprintf(w, "%s%s %s\n", v.name, formatLabels(v.labels, v.values[key], "", ""), formatFloat(v.series[key]))
+		}
+	}
+	if openMetrics {
+		fmt.Fprintln(w, "# EOF")
+	}
+}
+
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// formatLabels renders a label set, with an optional extra label such as
+// a histogram bucket's "le".
+func formatLabels(names, values []string, extraName, extraValue string) string {
+	var pairs []string
+	for i, name := range names {
+		pairs = append(pairs, name+"="+strconv.Quote(values[i]))
+	}
+	if extraName != "" {
+		pairs = append(pairs, extraName+"="+strconv.Quote(extraValue))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,108 @@
+package flareproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsExposition(t *testing.T) {
+	m := newMetricsRegistry()
+	m.now = func() time.Time { return time.UnixMilli(1700000000123) }
+	m.observeRequest("direct", 200, 700*time.Millisecond, "4bf92f3577b34da6a3ce929d0e0e4736")
+	m.observeRequest("direct", 502, 3*time.Second, "")
+
+	tests := []struct {
+		name     string
+		accept   string
+		want     []string
+		dontWant []string
+	}{
+		{
+			name:   "prometheus text",
+			accept: "text/plain",
+			want: []string{
+				"# TYPE flareproxygo_requests_total counter\n",
+				`flareproxygo_requests_total{mode="direct",code="200"} 1` + "\n",
+				`flareproxygo_request_duration_seconds_bucket{mode="direct",le="0.5"} 0` + "\n",
+				`flareproxygo_request_duration_seconds_bucket{mode="direct",le="1"} 1` + "\n",
+				`flareproxygo_request_duration_seconds_bucket{mode="direct",le="+Inf"} 2` + "\n",
+				`flareproxygo_request_duration_seconds_count{mode="direct"} 2` + "\n",
+			},
+			dontWant: []string{"trace_id", "# EOF"},
+		},
+		{
+			name:   "openmetrics with exemplars",
+			accept: "application/openmetrics-text; version=1.0.0",
+			want: []string{
+				"# TYPE flareproxygo_requests counter\n",
+				`flareproxygo_request_duration_seconds_bucket{mode="direct",le="1"} 1 # {trace_id="4bf92f3577b34da6a3ce929d0e0e4736"} 0.7 1700000000.123` + "\n",
+				`flareproxygo_request_duration_seconds_bucket{mode="direct",le="5"} 2` + "\n",
+				"# EOF\n",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", MetricsPath, nil)
+			req.Header.Set("Accept", tt.accept)
+			rr := httptest.NewRecorder()
+			m.ServeHTTP(rr, req)
+			body := rr.Body.String()
+			for _, want := range tt.want {
+				if !strings.Contains(body, want) {
+					t.Errorf("metrics missing %q:\n%s", want, body)
+				}
+			}
+			for _, dontWant := range tt.dontWant {
+				if strings.Contains(body, dontWant) {
+					t.Errorf("metrics unexpectedly contain %q", dontWant)
+				}
+			}
+		})
+	}
+}
+
+func TestTraceExemplars(t *testing.T) {
+	var forwarded string
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r.Header.Get(TraceparentHeader)
+		json.NewEncoder(w).Encode(testResponse("<html></html>"))
+	}))
+	defer mockServer.Close()
+	t.Setenv("FLARESOLVERR_URL", mockServer.URL)
+	t.Setenv("TRACING_ENABLED", "true")
+
+	saved := metrics
+	metrics = newMetricsRegistry()
+	defer func() { metrics = saved }()
+
+	handler := withRequestLogging("direct", NewDirectHandler())
+	req := httptest.NewRequest("GET", "/example.com/", nil)
+	req.Header.Set(TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if traceID, _, _ := parseTraceparent(forwarded); traceID != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("traceparent sent to FlareSolverr = %q, want the client's trace", forwarded)
+	}
+
+	req = httptest.NewRequest("GET", MetricsPath, nil)
+	req.Header.Set("Accept", "application/openmetrics-text")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	body := rr.Body.String()
+	for _, name := range []string{"flareproxygo_request_duration_seconds_bucket", "flareproxygo_solve_duration_seconds_bucket"} {
+		found := false
+		for _, line := range strings.Split(body, "\n") {
+			if strings.HasPrefix(line, name) && strings.Contains(line, `# {trace_id="4bf92f3577b34da6a3ce929d0e0e4736"}`) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("no exemplar for %s:\n%s", name, body)
+		}
+	}
+}
@@ -0,0 +1,370 @@
+package flareproxy
+
+import (
+	"bufio"
+	"container/list"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MITMCAPath serves the CA certificate on the proxy port, so that clients
+// can fetch it to trust intercepted connections.
+const MITMCAPath = "/flareproxygo-ca.pem"
+
+// mitmCertCacheSize is the number of issued certificates kept for reuse,
+// the least recently used being dropped beyond it.
+const mitmCertCacheSize = 1024
+
+// mitmCA issues certificates for the hosts clients CONNECT to, so that the
+// proxy can terminate their TLS connections and answer the decrypted
+// requests through FlareSolverr. Clients have to trust its certificate.
+type mitmCA struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+
+	mu sync.Mutex
+	// hosts maps host names to their element of ll, which holds the
+	// issued certificates from the most to the least recently used.
+	hosts map[string]*list.Element
+	ll    *list.List
+}
+
+// mitmCert is an issued certificate in the cache of a mitmCA.
+type mitmCert struct {
+	host string
+	cert *tls.Certificate
+}
+
+func newMITMCA(cert *x509.Certificate, key *ecdsa.PrivateKey, certPEM []byte) *mitmCA {
+	return &mitmCA{cert: cert, key: key, certPEM: certPEM, hosts: make(map[string]*list.Element), ll: list.New()}
+}
+
+// newMITMCAFromEnv loads the CA from MITM_CA_CERT and MITM_CA_KEY, or
+// generates one and saves it there if the files do not exist yet. Both
+// must be set: anyone able to plant a CA in a shared default location,
+// such as the temp directory, could read the intercepted traffic.
+func newMITMCAFromEnv() (*mitmCA, error) {
+	certPath, keyPath := os.Getenv("MITM_CA_CERT"), os.Getenv("MITM_CA_KEY")
+	if certPath == "" || keyPath == "" {
+		return nil, errors.New("PROXY_MITM needs MITM_CA_CERT and MITM_CA_KEY, paths in a directory only this user can write to")
+	}
+	ca, err := loadMITMCA(certPath, keyPath)
+	if errors.Is(err, os.ErrNotExist) {
+		if ca, err = generateMITMCA(); err != nil {
+			return nil, err
+		}
+		keyDER, err := x509.MarshalECPrivateKey(ca.key)
+		if err != nil {
+			return nil, err
+		}
+		// The key stays readable by the owner only
+		if err := writeFileAtomic(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})); err != nil {
+			return nil, err
+		}
+		if err := writeFileAtomic(certPath, ca.certPEM); err != nil {
+			return nil, err
+		}
+		if err := os.Chmod(certPath, 0o644); err != nil {
+			return nil, err
+		}
+		slog.Info("generated MITM CA certificate", "path", certPath)
+	}
+	return ca, err
+}
+
+// loadMITMCA reads a PEM encoded CA certificate and its key. Files owned
+// by another user, a key others may read or a certificate others may
+// write are refused.
+func loadMITMCA(certPath, keyPath string) (*mitmCA, error) {
+	certPEM, err := readPrivateFile(certPath, 0o022)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := readPrivateFile(keyPath, 0o077)
+	if err != nil {
+		return nil, err
+	}
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("MITM CA: %w", err)
+	}
+	key, ok := pair.PrivateKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("MITM CA: key is not an ECDSA key")
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("MITM CA: %w", err)
+	}
+	if !cert.IsCA {
+		return nil, errors.New("MITM CA: certificate is not a CA")
+	}
+	return newMITMCA(cert, key, certPEM), nil
+}
+
+// readPrivateFile reads the file at path, failing if it is not owned by
+// the user running the proxy or has any of the permission bits in deny.
+func readPrivateFile(path string, deny os.FileMode) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !ownedByProcessUser(info) {
+		return nil, fmt.Errorf("MITM CA: %s is not owned by the user running the proxy", path)
+	}
+	if perm := info.Mode().Perm(); perm&deny != 0 {
+		return nil, fmt.Errorf("MITM CA: %s has mode %s, remove the group and other permissions %s", path, perm, perm&deny)
+	}
+	return io.ReadAll(f)
+}
+
+// generateMITMCA creates a CA valid for ten years.
+func generateMITMCA() (*mitmCA, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          randomSerial(),
+		Subject:               pkix.Name{CommonName: "FlareProxy Go CA", Organization: []string{"FlareProxy Go"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return newMITMCA(cert, key, certPEM), nil
+}
+
+// certificate returns a certificate for host signed by the CA, issuing it
+// on first use. Issued certificates are cached up to mitmCertCacheSize;
+// they are issued without holding the lock, so that handshakes for other
+// hosts are not held up.
+func (ca *mitmCA) certificate(host string) (*tls.Certificate, error) {
+	ca.mu.Lock()
+	if elem, ok := ca.hosts[host]; ok {
+		if cert := elem.Value.(*mitmCert).cert; time.Now().Before(cert.Leaf.NotAfter) {
+			ca.ll.MoveToFront(elem)
+			ca.mu.Unlock()
+			return cert, nil
+		}
+	}
+	ca.mu.Unlock()
+
+	cert, err := ca.issue(host)
+	if err != nil {
+		return nil, err
+	}
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	if elem, ok := ca.hosts[host]; ok {
+		ca.ll.Remove(elem)
+	}
+	ca.hosts[host] = ca.ll.PushFront(&mitmCert{host: host, cert: cert})
+	for ca.ll.Len() > mitmCertCacheSize {
+		oldest := ca.ll.Back()
+		ca.ll.Remove(oldest)
+		delete(ca.hosts, oldest.Value.(*mitmCert).host)
+	}
+	return cert, nil
+}
+
+// issue creates a certificate for host signed by the CA.
+func (ca *mitmCA) issue(host string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: randomSerial(),
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.AddDate(0, 0, 90),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der, ca.cert.Raw}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+func randomSerial() *big.Int {
+	serial, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	return serial
+}
+
+// serveConnect accepts a CONNECT request, terminates the client's TLS
+// connection with a certificate for the requested host and serves the
+// requests sent through the tunnel like plain proxy requests.
+func (p *ProxyHandler) serveConnect(w http.ResponseWriter, r *http.Request) {
+	host, port, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host, port = r.Host, "443"
+	}
+	authority := tunnelAuthority("https", host, port)
+
+	conn, buffered, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		loggerFrom(r.Context()).Error("CONNECT hijack failed", "error", err)
+		http.Error(w, "CONNECT not supported by this server", http.StatusInternalServerError)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		return
+	}
+
+	proxy := upstreamProxyFrom(r.Context())
+	key := requestInfoFrom(r.Context()).APIKey
+	tunnel := http.HandlerFunc(func(w http.ResponseWriter, inner *http.Request) {
+		p.serveTunneled(w, inner, "https", authority, proxy)
+	})
+	listener := newConnListener(&bufferedConn{Conn: conn, r: buffered.Reader})
+	srv := &http.Server{
+		Handler:           withRequestLogging("proxy", tunnel),
+		ReadHeaderTimeout: 30 * time.Second,
+		MaxHeaderBytes:    maxHeaderBytesFromEnv(),
+		ErrorLog:          slog.NewLogLogger(slog.Default().Handler(), slog.LevelDebug),
+		ConnContext: func(ctx context.Context, _ net.Conn) context.Context {
+			return withTunnelKey(ctx, key)
+		},
+		ConnState: func(_ net.Conn, state http.ConnState) {
+			if state == http.StateClosed || state == http.StateHijacked {
+				listener.Close()
+			}
+		},
+	}
+	srv.Serve(tls.NewListener(listener, p.mitm.tlsConfig(host)))
+}
+
+// serveTunneled serves a request received through a tunnel to authority,
+// whose URL only holds the path, like a plain proxy request. The upstream
+// proxy chosen when the tunnel was opened applies unless the request
+// names its own.
+func (p *ProxyHandler) serveTunneled(w http.ResponseWriter, r *http.Request, scheme, authority string, proxy *FlareSolverrProxy) {
+	r.URL.Scheme = scheme
+	r.URL.Host = authority
+	if proxy != nil && requestedUpstreamProxy(r.Header) == "" {
+		r.Header.Set(UpstreamProxyHeader, proxy.URL)
+	}
+	p.ServeHTTP(w, r)
+}
+
+// tunnelAuthority returns the host and port of a tunnel's target as used
+// in URLs, leaving out the scheme's default port.
+func tunnelAuthority(scheme, host, port string) string {
+	if (scheme == "https" && port == "443") || (scheme == "http" && port == "80") {
+		if strings.Contains(host, ":") {
+			return "[" + host + "]"
+		}
+		return host
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// tlsConfig returns the configuration to terminate TLS connections to
+// host with. The certificate is issued for the host of the CONNECT
+// request, whatever server name the client sends, since requests through
+// the tunnel go to that host anyway.
+func (ca *mitmCA) tlsConfig(host string) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return ca.certificate(host)
+		},
+	}
+}
+
+// serveCA serves the MITM CA certificate.
+func (p *ProxyHandler) serveCA(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Write(p.mitm.certPEM)
+}
+
+// bufferedConn is a hijacked connection whose reads start with the bytes
+// the server had already buffered.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// connListener is a listener that accepts a single, existing connection.
+type connListener struct {
+	conn   net.Conn
+	once   sync.Once
+	closed chan struct{}
+	close  sync.Once
+}
+
+func newConnListener(conn net.Conn) *connListener {
+	return &connListener{conn: conn, closed: make(chan struct{})}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	var conn net.Conn
+	l.once.Do(func() { conn = l.conn })
+	if conn != nil {
+		return conn, nil
+	}
+	<-l.closed
+	return nil, net.ErrClosed
+}
+
+func (l *connListener) Close() error {
+	l.close.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
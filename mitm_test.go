@@ -0,0 +1,161 @@
+package flareproxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestConnectMITM(t *testing.T) {
+	var mu sync.Mutex
+	var solved []string
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req FlareSolverrRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		mu.Lock()
+		solved = append(solved, req.URL)
+		mu.Unlock()
+		json.NewEncoder(w).Encode(testResponse("<html>solved</html>"))
+	}))
+	defer mockServer.Close()
+	t.Setenv("FLARESOLVERR_URL", mockServer.URL)
+	t.Setenv("PROXY_MITM", "true")
+	dir := t.TempDir()
+	t.Setenv("MITM_CA_CERT", filepath.Join(dir, "ca.pem"))
+	t.Setenv("MITM_CA_KEY", filepath.Join(dir, "ca-key.pem"))
+
+	proxy := httptest.NewServer(NewProxyHandler())
+	defer proxy.Close()
+
+	// Clients fetch the CA from the proxy to trust it
+	resp, err := http.Get(proxy.URL + MITMCAPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caPEM, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caPEM) {
+		t.Fatalf("%s did not serve a certificate: %q", MITMCAPath, caPEM)
+	}
+	proxyURL, _ := url.Parse(proxy.URL)
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{RootCAs: roots},
+	}}
+
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{target: "https://example.com/page?q=1", want: "https://example.com/page?q=1"},
+		{target: "https://example.com:8443/other", want: "https://example.com:8443/other"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			mu.Lock()
+			solved = nil
+			mu.Unlock()
+			resp, err := client.Get(tt.target)
+			if err != nil {
+				t.Fatalf("GET through the proxy: %v", err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK || string(body) != "<html>solved</html>" {
+				t.Errorf("response = %d %q, want the solution", resp.StatusCode, body)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if len(solved) != 1 || solved[0] != tt.want {
+				t.Errorf("FlareSolverr solved %v, want %s", solved, tt.want)
+			}
+		})
+	}
+
+	// A restarted proxy keeps using the CA clients trust
+	reloaded, err := newMITMCAFromEnv()
+	if err != nil {
+		t.Fatalf("newMITMCAFromEnv() error = %v", err)
+	}
+	if !bytes.Equal(reloaded.certPEM, caPEM) {
+		t.Error("CA was regenerated instead of loaded")
+	}
+}
+
+func TestMITMCAFiles(t *testing.T) {
+	tests := []struct {
+		name     string
+		unset    bool
+		certMode os.FileMode
+		keyMode  os.FileMode
+		wantErr  string
+	}{
+		{name: "private files", certMode: 0o644, keyMode: 0o600},
+		{name: "no paths", unset: true, wantErr: "needs MITM_CA_CERT and MITM_CA_KEY"},
+		{name: "key readable by others", certMode: 0o644, keyMode: 0o644, wantErr: "ca-key.pem has mode"},
+		{name: "certificate writable by the group", certMode: 0o664, keyMode: 0o600, wantErr: "ca.pem has mode"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			certPath, keyPath := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem")
+			t.Setenv("MITM_CA_CERT", certPath)
+			t.Setenv("MITM_CA_KEY", keyPath)
+			if _, err := newMITMCAFromEnv(); err != nil {
+				t.Fatalf("generating the CA: %v", err)
+			}
+			if tt.unset {
+				t.Setenv("MITM_CA_CERT", "")
+			} else {
+				os.Chmod(certPath, tt.certMode)
+				os.Chmod(keyPath, tt.keyMode)
+			}
+			_, err := newMITMCAFromEnv()
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("newMITMCAFromEnv() error = %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("newMITMCAFromEnv() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMITMCertificateCache(t *testing.T) {
+	ca, err := generateMITMCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The certificate is for the CONNECT host, whatever the client asks for
+	cert, err := ca.tlsConfig("example.com").GetCertificate(&tls.ClientHelloInfo{ServerName: "other.example"})
+	if err != nil || cert.Leaf.VerifyHostname("example.com") != nil || cert.Leaf.VerifyHostname("other.example") == nil {
+		t.Fatalf("certificate = %v, %v; want one for example.com only", cert.Leaf.DNSNames, err)
+	}
+	if again, _ := ca.certificate("example.com"); again != cert {
+		t.Error("certificate issued again instead of reused")
+	}
+
+	for i := 0; i < mitmCertCacheSize+10; i++ {
+		if _, err := ca.certificate(fmt.Sprintf("host%d.example", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := ca.ll.Len(); n != mitmCertCacheSize || len(ca.hosts) != mitmCertCacheSize {
+		t.Errorf("cached %d certificates (%d hosts), want %d", n, len(ca.hosts), mitmCertCacheSize)
+	}
+	if _, ok := ca.hosts["example.com"]; ok {
+		t.Error("least recently used certificate kept")
+	}
+}
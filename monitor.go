@@ -0,0 +1,92 @@
+package flareproxy
+
+import (
+	"crypto/x509"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// timeMonitor watches for clock skew against the backends and for TLS
+// certificates nearing expiry, and warns well before either breaks
+// anything: a skewed clock makes FlareSolverr reject signed requests
+// (FLARESOLVERR_SIGNING_KEY) and cookie expiry times unreliable, while an
+// expired certificate stops all traffic.
+type timeMonitor struct {
+	maxSkew    time.Duration
+	expiryWarn time.Duration
+	now        func() time.Time
+
+	mu sync.Mutex
+	// warned records the problems already logged, so each is logged once
+	// rather than on every request
+	warned map[string]bool
+}
+
+// newTimeMonitorFromEnv reads CLOCK_SKEW_WARN and CERT_EXPIRY_WARN.
+func newTimeMonitorFromEnv() *timeMonitor {
+	return newTimeMonitor(envDuration("CLOCK_SKEW_WARN", 30*time.Second),
+		envDuration("CERT_EXPIRY_WARN", 14*24*time.Hour))
+}
+
+func newTimeMonitor(maxSkew, expiryWarn time.Duration) *timeMonitor {
+	return &timeMonitor{
+		maxSkew:    maxSkew,
+		expiryWarn: expiryWarn,
+		now:        time.Now,
+		warned:     make(map[string]bool),
+	}
+}
+
+// observeResponse checks the Date header and TLS certificate of a
+// response from a backend. sent is when the request was sent.
+func (m *timeMonitor) observeResponse(backendURL string, resp *http.Response, sent time.Time) {
+	if date, err := http.ParseTime(resp.Header.Get("Date")); err == nil {
+		// Compare against the middle of the round trip; the Date header
+		// only has a resolution of one second anyway
+		received := m.now()
+		skew := date.Sub(sent.Add(received.Sub(sent) / 2)).Round(time.Second)
+		metrics.setClockSkew(backendURL, skew)
+		skewed := skew > m.maxSkew || -skew > m.maxSkew
+		if m.transition("skew "+backendURL, skewed) {
+			if skewed {
+				slog.Warn("clock skew against backend", "backend", backendURL,
+					"skew", skew.String(), "limit", m.maxSkew.String())
+			} else {
+				slog.Info("clock skew against backend back within limit", "backend", backendURL, "skew", skew.String())
+			}
+		}
+	}
+	if resp.TLS != nil && len(resp.TLS.PeerCertificates) > 0 {
+		m.observeCertificate(backendURL, resp.TLS.PeerCertificates[0])
+	}
+}
+
+// observeCertificate records when a certificate expires, warning when that
+// is less than CERT_EXPIRY_WARN away. name identifies where it is used.
+func (m *timeMonitor) observeCertificate(name string, cert *x509.Certificate) {
+	metrics.setCertExpiry(name, cert.NotAfter)
+	remaining := cert.NotAfter.Sub(m.now())
+	expiring := remaining < m.expiryWarn
+	if m.transition("cert "+name+" "+cert.SerialNumber.String(), expiring) && expiring {
+		slog.Warn("TLS certificate expires soon", "name", name, "subject", cert.Subject.String(),
+			"not_after", cert.NotAfter.UTC().Format(time.RFC3339), "remaining", remaining.Round(time.Minute).String())
+	}
+}
+
+// transition records whether a problem is present and reports whether
+// that changed since it was last observed.
+func (m *timeMonitor) transition(problem string, present bool) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.warned[problem] == present {
+		return false
+	}
+	if present {
+		m.warned[problem] = true
+	} else {
+		delete(m.warned, problem)
+	}
+	return true
+}
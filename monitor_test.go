@@ -0,0 +1,81 @@
+package flareproxy
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClockSkewWarning(t *testing.T) {
+	var logs bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(newLogger(&logs, "text", "info"))
+
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	m := newTimeMonitor(30*time.Second, time.Hour)
+	m.now = func() time.Time { return now }
+	respond := func(date time.Time) {
+		resp := &http.Response{Header: http.Header{"Date": {date.Format(http.TimeFormat)}}}
+		m.observeResponse("http://skewed/v1", resp, now)
+	}
+
+	respond(now.Add(5 * time.Second))
+	if logs.Len() != 0 {
+		t.Errorf("small skew logged: %s", logs.String())
+	}
+	// A large skew is logged once, not on every response
+	respond(now.Add(-2 * time.Minute))
+	respond(now.Add(-2 * time.Minute))
+	if got := strings.Count(logs.String(), "clock skew against backend"); got != 1 {
+		t.Errorf("skew warned %d times, want once:\n%s", got, logs.String())
+	}
+	respond(now)
+	if !strings.Contains(logs.String(), "back within limit") {
+		t.Errorf("recovery not logged:\n%s", logs.String())
+	}
+
+	var out bytes.Buffer
+	metrics.write(&out, false)
+	if !strings.Contains(out.String(), `flareproxygo_backend_clock_skew_seconds{backend="http://skewed/v1"} 0`) {
+		t.Errorf("skew metric missing:\n%s", out.String())
+	}
+}
+
+func TestCertificateExpiryWarning(t *testing.T) {
+	var logs bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(newLogger(&logs, "text", "info"))
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	resp, err := server.Client().Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	cert := resp.TLS.PeerCertificates[0]
+
+	m := newTimeMonitor(time.Minute, 14*24*time.Hour)
+	m.now = func() time.Time { return cert.NotAfter.Add(-30 * 24 * time.Hour) }
+	m.observeResponse(server.URL, resp, m.now())
+	if strings.Contains(logs.String(), "expires soon") {
+		t.Errorf("certificate 30 days from expiry warned:\n%s", logs.String())
+	}
+
+	m.now = func() time.Time { return cert.NotAfter.Add(-24 * time.Hour) }
+	m.observeResponse(server.URL, resp, m.now())
+	m.observeResponse(server.URL, resp, m.now())
+	if got := strings.Count(logs.String(), "expires soon"); got != 1 {
+		t.Errorf("expiry warned %d times, want once:\n%s", got, logs.String())
+	}
+
+	var out bytes.Buffer
+	metrics.write(&out, false)
+	if !strings.Contains(out.String(), `flareproxygo_certificate_expiry_timestamp_seconds{name="`+server.URL+`"}`) {
+		t.Errorf("expiry metric missing:\n%s", out.String())
+	}
+}
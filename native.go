@@ -0,0 +1,40 @@
+package flareproxy
+
+import (
+	"context"
+	"time"
+)
+
+// NativeBackend is reported as the backend of pages solved by the
+// built-in headless Chrome while FlareSolverr is down.
+const NativeBackend = "native"
+
+// nativeSolver loads pages in a local headless Chrome, controlled over
+// the DevTools protocol, so that the proxy keeps working without
+// FlareSolverr. It is only built with the native build tag, which pulls
+// in chromedp; other builds ignore NATIVE_SOLVER.
+type nativeSolver struct {
+	chrome    string
+	wait      time.Duration
+	userAgent string
+	slots     chan struct{}
+}
+
+// covers reports whether n can carry out requestData: a plain GET, outside
+// of sessions and upstream proxies.
+func (n *nativeSolver) covers(requestData FlareSolverrRequest) bool {
+	return n != nil && requestData.Cmd == "request.get" && requestData.Session == "" && requestData.Proxy == nil
+}
+
+// solveWithFallback solves requestData on the FlareSolverr backends, or
+// in the built-in solver if none of them can be reached.
+func (s *solver) solveWithFallback(ctx context.Context, requestData FlareSolverrRequest, meta *responseMeta) (*FlareSolverrResponse, error) {
+	flareResponse, err := s.solveWithRetry(ctx, requestData, meta)
+	if err == nil || !s.native.covers(requestData) || !isSolverDown(ctx, err) {
+		return flareResponse, err
+	}
+	loggerFrom(ctx).Warn("FlareSolverr unavailable, solving in the built-in browser", "target", requestData.URL, "error", err)
+	meta.Backend = NativeBackend
+	requestInfoFrom(ctx).Backend = NativeBackend
+	return s.native.solve(ctx, requestData)
+}
@@ -0,0 +1,188 @@
+//go:build native
+
+package flareproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/chromedp/cdproto/network"
+	"github.com/chromedp/chromedp"
+
+	"github.com/kljensen/flareproxygo/flaresolverr"
+)
+
+// nativeBrowsers are the Chrome executables looked for on the PATH when
+// NATIVE_SOLVER_CHROME is not set.
+var nativeBrowsers = []string{"chromium", "chromium-browser", "google-chrome", "google-chrome-stable", "chrome"}
+
+// nativePollInterval is how often the page is checked for a challenge
+// while Chrome runs its scripts.
+const nativePollInterval = 500 * time.Millisecond
+
+// newNativeSolverFromEnv returns the built-in solver if NATIVE_SOLVER is
+// set, running NATIVE_SOLVER_CHROME or the first Chrome found on the
+// PATH, at most NATIVE_SOLVER_CONCURRENCY at a time. It returns nil
+// otherwise or if Chrome cannot be found.
+func newNativeSolverFromEnv() *nativeSolver {
+	if !envBool("NATIVE_SOLVER", false) {
+		return nil
+	}
+	chrome := os.Getenv("NATIVE_SOLVER_CHROME")
+	if chrome == "" {
+		for _, name := range nativeBrowsers {
+			if path, err := exec.LookPath(name); err == nil {
+				chrome = path
+				break
+			}
+		}
+	}
+	if chrome == "" {
+		slog.Warn("built-in solver disabled, no Chrome found; set NATIVE_SOLVER_CHROME")
+		return nil
+	}
+	concurrency := envInt("NATIVE_SOLVER_CONCURRENCY", 2)
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return &nativeSolver{
+		chrome:    chrome,
+		wait:      envDuration("NATIVE_SOLVER_WAIT", 15*time.Second),
+		userAgent: envString("NATIVE_SOLVER_USER_AGENT", defaultUserAgent),
+		slots:     make(chan struct{}, concurrency),
+	}
+}
+
+// solve loads the page of requestData in a fresh Chrome profile and waits
+// until it is no longer a challenge, for at most NATIVE_SOLVER_WAIT or the
+// request's maxTimeout. The solution carries the status and headers of
+// the last document Chrome received, its cookies and the rendered page.
+func (n *nativeSolver) solve(ctx context.Context, requestData FlareSolverrRequest) (*FlareSolverrResponse, error) {
+	select {
+	case n.slots <- struct{}{}:
+		defer func() { <-n.slots }()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	wait := n.wait
+	if limit := time.Duration(requestData.MaxTimeout) * time.Millisecond; limit > 0 && limit < wait {
+		wait = limit
+	}
+	// The deadline covers Chrome's startup on top of the wait
+	ctx, cancel := context.WithTimeout(ctx, wait+callTimeoutMargin)
+	defer cancel()
+	opts := append(chromedp.DefaultExecAllocatorOptions[:],
+		chromedp.ExecPath(n.chrome),
+		chromedp.UserAgent(n.userAgent),
+	)
+	if os.Geteuid() == 0 {
+		// Chrome refuses to sandbox itself as root, as in most containers
+		opts = append(opts, chromedp.NoSandbox)
+	}
+	allocCtx, cancelAlloc := chromedp.NewExecAllocator(ctx, opts...)
+	defer cancelAlloc()
+	browserCtx, cancelBrowser := chromedp.NewContext(allocCtx)
+	defer cancelBrowser()
+
+	var (
+		mu       sync.Mutex
+		document *network.Response
+	)
+	chromedp.ListenTarget(browserCtx, func(ev interface{}) {
+		// The main frame has the target's ID; challenges load iframes too
+		e, ok := ev.(*network.EventResponseReceived)
+		if ok && e.Type == network.ResourceTypeDocument &&
+			string(e.FrameID) == string(chromedp.FromContext(browserCtx).Target.TargetID) {
+			mu.Lock()
+			document = e.Response
+			mu.Unlock()
+		}
+	})
+	current := func() (int, http.Header, string) {
+		mu.Lock()
+		defer mu.Unlock()
+		if document == nil {
+			return 0, nil, ""
+		}
+		header := make(http.Header)
+		for name, value := range document.Headers {
+			header.Set(name, fmt.Sprint(value))
+		}
+		return int(document.Status), header, document.URL
+	}
+
+	var html string
+	var cookies []*network.Cookie
+	err := chromedp.Run(browserCtx,
+		network.Enable(),
+		chromedp.Navigate(requestData.URL),
+		chromedp.ActionFunc(func(ctx context.Context) error {
+			deadline := time.Now().Add(wait)
+			for {
+				if err := chromedp.OuterHTML("html", &html, chromedp.ByQuery).Do(ctx); err != nil {
+					return err
+				}
+				status, header, _ := current()
+				if !isChallenge(status, header, []byte(html)) || time.Now().After(deadline) {
+					return nil
+				}
+				if err := chromedp.Sleep(nativePollInterval).Do(ctx); err != nil {
+					return err
+				}
+			}
+		}),
+		chromedp.ActionFunc(func(ctx context.Context) error {
+			var err error
+			cookies, err = network.GetCookies().Do(ctx)
+			return err
+		}),
+	)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("Built-in solver failed: %v", err)
+	}
+	status, header, finalURL := current()
+	if status == 0 {
+		return nil, errors.New("Built-in solver failed: Chrome received no page")
+	}
+	solution := flaresolverr.Solution{
+		URL:       finalURL,
+		Status:    status,
+		Response:  html,
+		UserAgent: n.userAgent,
+		Headers:   make(map[string]string, len(header)),
+	}
+	for name := range header {
+		solution.Headers[name] = header.Get(name)
+	}
+	for _, c := range cookies {
+		solution.Cookies = append(solution.Cookies, flaresolverr.Cookie{
+			Name:     c.Name,
+			Value:    c.Value,
+			Domain:   c.Domain,
+			Path:     c.Path,
+			Expires:  c.Expires,
+			Size:     int(c.Size),
+			HTTPOnly: c.HTTPOnly,
+			Secure:   c.Secure,
+			Session:  c.Session,
+			SameSite: c.SameSite.String(),
+		})
+	}
+	return &FlareSolverrResponse{
+		Status:       "ok",
+		Version:      NativeBackend,
+		Solution:     solution,
+		EndTimestamp: time.Now().UnixMilli(),
+	}, nil
+}
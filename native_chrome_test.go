@@ -0,0 +1,72 @@
+//go:build native
+
+package flareproxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNativeFallback(t *testing.T) {
+	// A challenge that sets a clearance cookie and reloads the page
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := r.Cookie("cf_clearance"); err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			io.WriteString(w, `<html><head><title>Just a moment...</title></head><body><script>
+document.cookie = "cf_clearance=solved; path=/";
+setTimeout(function() { location.reload(); }, 200);
+</script></body></html>`)
+			return
+		}
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+		w.Header().Set("X-Origin", "yes")
+		io.WriteString(w, "<html><body>page "+r.URL.Path+"</body></html>")
+	}))
+	defer origin.Close()
+	t.Setenv("FLARESOLVERR_URL", "http://127.0.0.1:1/v1")
+	t.Setenv("NATIVE_SOLVER", "true")
+	t.Setenv("NATIVE_SOLVER_WAIT", "10s")
+	t.Setenv("BACKEND_MAX_FAILURES", "2")
+	if newNativeSolverFromEnv() == nil {
+		t.Skip("no Chrome found")
+	}
+	handler := NewDirectHandler()
+	target := "/" + strings.Replace(origin.URL, "://", "/", 1)
+
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		wantStatus  int
+		wantBackend string
+		wantBody    string
+		wantCookie  bool
+	}{
+		{name: "challenge solved", method: "GET", path: target + "/page", wantStatus: http.StatusOK, wantBackend: NativeBackend, wantBody: "page /page", wantCookie: true},
+		{name: "origin status", method: "GET", path: target + "/missing", wantStatus: http.StatusNotFound, wantBackend: NativeBackend, wantBody: "page /missing", wantCookie: true},
+		// The failures opened the backend's circuit
+		{name: "post not covered", method: "POST", path: target + "/page", wantStatus: http.StatusServiceUnavailable, wantBody: "circuit open"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader("a=b"))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			if rr.Code != tt.wantStatus || !strings.Contains(rr.Body.String(), tt.wantBody) {
+				t.Fatalf("response = %d %q, want %d containing %q", rr.Code, rr.Body.String(), tt.wantStatus, tt.wantBody)
+			}
+			if got := rr.Result().Trailer.Get("X-FlareProxy-Backend"); got != tt.wantBackend {
+				t.Errorf("backend = %q, want %q", got, tt.wantBackend)
+			}
+			if got := strings.Contains(rr.Header().Get("Set-Cookie"), "cf_clearance=solved"); got != tt.wantCookie {
+				t.Errorf("Set-Cookie = %q, want clearance cookie: %v", rr.Header().Get("Set-Cookie"), tt.wantCookie)
+			}
+		})
+	}
+}
@@ -0,0 +1,23 @@
+//go:build !native
+
+package flareproxy
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+)
+
+// newNativeSolverFromEnv returns nil: the built-in solver needs a build
+// with the native tag. It warns if NATIVE_SOLVER asks for it anyway.
+func newNativeSolverFromEnv() *nativeSolver {
+	if envBool("NATIVE_SOLVER", false) {
+		slog.Warn("built-in solver disabled, NATIVE_SOLVER needs a build with -tags native")
+	}
+	return nil
+}
+
+// solve is never called, as there is no built-in solver in this build.
+func (n *nativeSolver) solve(ctx context.Context, requestData FlareSolverrRequest) (*FlareSolverrResponse, error) {
+	return nil, errors.New("Built-in solver failed: not built with -tags native")
+}
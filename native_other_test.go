@@ -0,0 +1,23 @@
+//go:build !native
+
+package flareproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNativeSolverNotBuilt(t *testing.T) {
+	t.Setenv("FLARESOLVERR_URL", "http://127.0.0.1:1/v1")
+	t.Setenv("NATIVE_SOLVER", "true")
+	if n := newNativeSolverFromEnv(); n != nil {
+		t.Fatalf("newNativeSolverFromEnv() = %v without the native build tag", n)
+	}
+	rr := httptest.NewRecorder()
+	NewDirectHandler().ServeHTTP(rr, httptest.NewRequest("GET", "/https/example.com/", nil))
+	if rr.Code != http.StatusInternalServerError || !strings.Contains(rr.Body.String(), "Failed to connect") {
+		t.Errorf("response = %d %q, want the FlareSolverr error", rr.Code, rr.Body.String())
+	}
+}
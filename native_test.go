@@ -0,0 +1,30 @@
+package flareproxy
+
+import (
+	"testing"
+
+	"github.com/kljensen/flareproxygo/flaresolverr"
+)
+
+func TestNativeSolverCovers(t *testing.T) {
+	proxy := &flaresolverr.Proxy{URL: "http://proxy.example:3128"}
+	tests := []struct {
+		name        string
+		solver      *nativeSolver
+		requestData FlareSolverrRequest
+		want        bool
+	}{
+		{name: "plain get", solver: &nativeSolver{}, requestData: FlareSolverrRequest{Cmd: "request.get", URL: "https://example.com/"}, want: true},
+		{name: "no solver", requestData: FlareSolverrRequest{Cmd: "request.get", URL: "https://example.com/"}},
+		{name: "post", solver: &nativeSolver{}, requestData: FlareSolverrRequest{Cmd: "request.post", URL: "https://example.com/"}},
+		{name: "session", solver: &nativeSolver{}, requestData: FlareSolverrRequest{Cmd: "request.get", URL: "https://example.com/", Session: "s1"}},
+		{name: "upstream proxy", solver: &nativeSolver{}, requestData: FlareSolverrRequest{Cmd: "request.get", URL: "https://example.com/", Proxy: proxy}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.solver.covers(tt.requestData); got != tt.want {
+				t.Errorf("covers() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package flareproxy
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UnsolvableError is returned for pages FlareSolverr recently failed to
+// solve, without trying again until the failure expires from the
+// negative cache.
+type UnsolvableError struct {
+	URL        string
+	Message    string
+	RetryAfter time.Duration
+}
+
+func (e *UnsolvableError) Error() string {
+	return fmt.Sprintf("FlareSolverr could not solve %s recently (%s), retry in %s", e.URL, e.Message, e.RetryAfter.Round(time.Second))
+}
+
+// unsolvableMarkers are substrings of the FlareSolverr error messages of
+// challenges it cannot pass, such as Turnstile CAPTCHAs, as opposed to
+// navigation errors that may go away on their own.
+var unsolvableMarkers = []string{"challenge", "captcha", "turnstile"}
+
+// negativeCacheSweep is the number of entries above which expired ones
+// are removed when a failure is recorded.
+const negativeCacheSweep = 1024
+
+// negativeCache remembers the pages FlareSolverr could not solve, so that
+// clients retrying them get a 502 at once instead of waiting for the
+// browser to fail again.
+type negativeCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]negativeEntry
+	now     func() time.Time
+}
+
+type negativeEntry struct {
+	url     string
+	message string
+	expires time.Time
+}
+
+// newNegativeCacheFromEnv reads NEGATIVE_CACHE_TTL, how long a failure to
+// solve a page is remembered. It returns nil, solving every request, if
+// it is not set.
+func newNegativeCacheFromEnv() *negativeCache {
+	ttl := envDuration("NEGATIVE_CACHE_TTL", 0)
+	if ttl <= 0 {
+		return nil
+	}
+	return &negativeCache{ttl: ttl, entries: make(map[string]negativeEntry), now: time.Now}
+}
+
+// check returns an *UnsolvableError if the page under key recently
+// failed.
+func (c *negativeCache) check(key string) error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	now := c.now()
+	if !now.Before(entry.expires) {
+		delete(c.entries, key)
+		return nil
+	}
+	return &UnsolvableError{URL: entry.url, Message: entry.message, RetryAfter: entry.expires.Sub(now)}
+}
+
+// record remembers the outcome of solving the page of targetURL under
+// key: errors of challenges FlareSolverr could not pass are cached, and
+// success forgets earlier failures.
+func (c *negativeCache) record(key, targetURL string, err error) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err == nil {
+		delete(c.entries, key)
+		return
+	}
+	var solverErr *SolverError
+	if !errors.As(err, &solverErr) || !isUnsolvable(solverErr.Message) {
+		return
+	}
+	now := c.now()
+	if len(c.entries) >= negativeCacheSweep {
+		for k, entry := range c.entries {
+			if !now.Before(entry.expires) {
+				delete(c.entries, k)
+			}
+		}
+	}
+	c.entries[key] = negativeEntry{url: targetURL, message: solverErr.Message, expires: now.Add(c.ttl)}
+}
+
+func isUnsolvable(message string) bool {
+	message = strings.ToLower(message)
+	for _, marker := range unsolvableMarkers {
+		if strings.Contains(message, marker) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,71 @@
+package flareproxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/kljensen/flareproxygo/flaresolverr/flaresolverrtest"
+)
+
+func TestNegativeCache(t *testing.T) {
+	fs := flaresolverrtest.NewServer()
+	defer fs.Close()
+	fs.SetPage("https://turnstile.example/", flaresolverrtest.Page{Error: "Captcha detected but no automatic solver is configured."})
+	fs.SetPage("https://flaky.example/", flaresolverrtest.Page{Error: "net::ERR_CONNECTION_RESET"})
+	t.Setenv("FLARESOLVERR_URL", fs.Endpoint())
+	t.Setenv("NEGATIVE_CACHE_TTL", "5m")
+	s := newSolver()
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	s.negative.now = func() time.Time { return now }
+	ctx := context.Background()
+	noCache := context.WithValue(ctx, requestOptionsKey, requestOptions{NoCache: true})
+
+	fetch := func(ctx context.Context, targetURL string) error {
+		_, _, err := s.fetch(ctx, "request.get", targetURL)
+		return err
+	}
+	var solverErr *SolverError
+	if err := fetch(ctx, "https://turnstile.example/"); !errors.As(err, &solverErr) {
+		t.Fatalf("first fetch error = %v, want the solver's", err)
+	}
+	var unsolvableErr *UnsolvableError
+	if err := fetch(ctx, "https://turnstile.example/"); !errors.As(err, &unsolvableErr) || unsolvableErr.RetryAfter != 5*time.Minute {
+		t.Fatalf("second fetch error = %v, want an *UnsolvableError", err)
+	}
+	if got := len(fs.Requests()); got != 1 {
+		t.Errorf("solves = %d, want the failure cached", got)
+	}
+
+	rr := httptest.NewRecorder()
+	sendFetchError(rr, httptest.NewRequest("GET", "/turnstile.example/", nil), unsolvableErr)
+	if rr.Code != http.StatusBadGateway || rr.Header().Get("Retry-After") != "300" {
+		t.Errorf("response = %d with Retry-After %q, want 502 and 300", rr.Code, rr.Header().Get("Retry-After"))
+	}
+
+	// X-FlareProxy-No-Cache and expiry solve again
+	fetch(noCache, "https://turnstile.example/")
+	now = now.Add(5 * time.Minute)
+	fetch(ctx, "https://turnstile.example/")
+	if got := len(fs.Requests()); got != 3 {
+		t.Errorf("solves = %d, want 3", got)
+	}
+
+	// Errors that may go away on their own are not cached
+	fetch(ctx, "https://flaky.example/")
+	if err := fetch(ctx, "https://flaky.example/"); errors.As(err, &unsolvableErr) {
+		t.Errorf("navigation error cached: %v", err)
+	}
+
+	// Solving the page forgets the failure
+	fs.SetPage("https://turnstile.example/", flaresolverrtest.Page{})
+	if err := fetch(noCache, "https://turnstile.example/"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.negative.check("request.get https://turnstile.example/"); err != nil {
+		t.Errorf("failure kept after a successful solve: %v", err)
+	}
+}
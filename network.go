@@ -0,0 +1,431 @@
+package flareproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// newOutboundClient returns the HTTP client used for outbound
+// connections to FlareSolverr. It resolves hostnames with the
+// resolver configured through DNS_SERVERS or DNS_OVER_HTTPS_URL and dials
+// according to the IP_FAMILY preference. Its connection pool is tuned
+// through OUTBOUND_TLS_HANDSHAKE_TIMEOUT, OUTBOUND_MAX_IDLE_CONNS,
+// OUTBOUND_MAX_IDLE_CONNS_PER_HOST, OUTBOUND_IDLE_CONN_TIMEOUT and
+// OUTBOUND_KEEP_ALIVES. The client has no overall time limit, as solves
+// take as long as FlareSolverr is given; see solver.callTimeout.
+func newOutboundClient() *http.Client {
+	return &http.Client{Transport: newOutboundTransport(newDialer())}
+}
+
+// newTargetClient returns a client like newOutboundClient for fetching
+// target sites directly, in smart mode and for downloads. When policy
+// denies private targets, it refuses to connect to loopback, private and
+// link-local addresses, so that clients cannot reach the proxy's own
+// network through it. The address is checked once resolved, so that
+// names pointing there are refused too.
+func newTargetClient(policy *targetPolicy) *http.Client {
+	dialer := newDialer()
+	dialer.Control = policy.dialControl
+	return &http.Client{Transport: newOutboundTransport(dialer)}
+}
+
+// newOutboundTransport returns the transport of the outbound clients,
+// dialing with dialer.
+func newOutboundTransport(dialer *net.Dialer) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = newFamilyDialer(dialer, os.Getenv("IP_FAMILY")).DialContext
+	transport.TLSHandshakeTimeout = envDuration("OUTBOUND_TLS_HANDSHAKE_TIMEOUT", 10*time.Second)
+	transport.MaxIdleConns = envInt("OUTBOUND_MAX_IDLE_CONNS", 100)
+	// Solves run concurrently against few hosts, which the default of 2
+	// idle connections per host would keep redialing
+	transport.MaxIdleConnsPerHost = envInt("OUTBOUND_MAX_IDLE_CONNS_PER_HOST", 16)
+	transport.IdleConnTimeout = envDuration("OUTBOUND_IDLE_CONN_TIMEOUT", 90*time.Second)
+	transport.DisableKeepAlives = !envBool("OUTBOUND_KEEP_ALIVES", true)
+	return transport
+}
+
+// privateAddress reports whether ip is a loopback, private (RFC 1918 or
+// RFC 4193), link-local or unspecified address.
+func privateAddress(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsUnspecified()
+}
+
+// denyPrivateAddress is a net.Dialer Control function failing with a
+// *TargetDeniedError before connecting to a private address.
+func denyPrivateAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || privateAddress(ip) {
+		return &TargetDeniedError{Host: host}
+	}
+	return nil
+}
+
+// newDialer returns a dialer using the configured resolver, giving up
+// after OUTBOUND_DIAL_TIMEOUT, and, when OUTBOUND_SOURCE_IP or
+// OUTBOUND_INTERFACE is set, the configured local address.
+func newDialer() *net.Dialer {
+	dialer := &net.Dialer{
+		Timeout:       envDuration("OUTBOUND_DIAL_TIMEOUT", 30*time.Second),
+		KeepAlive:     30 * time.Second,
+		FallbackDelay: envDuration("HAPPY_EYEBALLS_DELAY", 300*time.Millisecond),
+		Resolver:      newResolver(),
+	}
+
+	sourceIP, err := outboundSourceIP(os.Getenv("OUTBOUND_SOURCE_IP"), os.Getenv("OUTBOUND_INTERFACE"))
+	if err != nil {
+		slog.Warn("using default outbound address", "error", err)
+	} else if sourceIP != nil {
+		dialer.LocalAddr = &net.TCPAddr{IP: sourceIP}
+	}
+	return dialer
+}
+
+// outboundSourceIP returns the local address outbound connections should
+// be bound to. An explicit source IP takes precedence over an interface,
+// in which case the interface's first IPv4 address (or else its first
+// IPv6 address) is used. It returns nil when neither is configured.
+func outboundSourceIP(sourceIP, ifaceName string) (net.IP, error) {
+	if sourceIP != "" {
+		ip := net.ParseIP(sourceIP)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid OUTBOUND_SOURCE_IP %q", sourceIP)
+		}
+		return ip, nil
+	}
+	if ifaceName == "" {
+		return nil, nil
+	}
+
+	iface, err := net.InterfaceByName(ifaceName)
+	if err != nil {
+		return nil, fmt.Errorf("OUTBOUND_INTERFACE %q: %v", ifaceName, err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("OUTBOUND_INTERFACE %q: %v", ifaceName, err)
+	}
+	var v6 net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if ipNet.IP.To4() != nil {
+			return ipNet.IP, nil
+		}
+		if v6 == nil {
+			v6 = ipNet.IP
+		}
+	}
+	if v6 == nil {
+		return nil, fmt.Errorf("OUTBOUND_INTERFACE %q has no usable addresses", ifaceName)
+	}
+	return v6, nil
+}
+
+// Address family preferences accepted by IP_FAMILY.
+const (
+	FamilyDual       = "dual"
+	FamilyIPv4       = "ipv4"
+	FamilyIPv6       = "ipv6"
+	FamilyPreferIPv4 = "prefer-ipv4"
+	FamilyPreferIPv6 = "prefer-ipv6"
+)
+
+// familyDialer dials TCP connections honouring an address family
+// preference. Dual-stack dialing races both families using Happy Eyeballs
+// (RFC 8305) so that hosts that are IPv6-only or have broken IPv4 (or vice
+// versa) are still reachable.
+type familyDialer struct {
+	dialer *net.Dialer
+	family string
+}
+
+func newFamilyDialer(dialer *net.Dialer, family string) *familyDialer {
+	family = strings.ToLower(strings.TrimSpace(family))
+	switch family {
+	case "", "auto":
+		family = FamilyDual
+	case FamilyDual, FamilyIPv4, FamilyIPv6, FamilyPreferIPv4, FamilyPreferIPv6:
+	default:
+		slog.Warn("unknown IP_FAMILY", "family", family, "using", FamilyDual)
+		family = FamilyDual
+	}
+	return &familyDialer{dialer: dialer, family: family}
+}
+
+func (d *familyDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch d.family {
+	case FamilyIPv4:
+		return d.dialer.DialContext(ctx, strings.TrimRight(network, "46")+"4", address)
+	case FamilyIPv6:
+		return d.dialer.DialContext(ctx, strings.TrimRight(network, "46")+"6", address)
+	case FamilyPreferIPv4, FamilyPreferIPv6:
+		return d.dialPreferred(ctx, network, address)
+	default:
+		// net.Dialer already races both families, preferring whichever
+		// the resolver returned first.
+		return d.dialer.DialContext(ctx, network, address)
+	}
+}
+
+// dialPreferred resolves address and races the preferred family against
+// the other one, giving the preferred family a head start of the dialer's
+// fallback delay.
+func (d *familyDialer) dialPreferred(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	resolver := d.dialer.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	addrs, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	var v4, v6 []string
+	for _, addr := range addrs {
+		hostPort := net.JoinHostPort(addr.IP.String(), port)
+		if addr.IP.To4() != nil {
+			v4 = append(v4, hostPort)
+		} else {
+			v6 = append(v6, hostPort)
+		}
+	}
+	primaries, fallbacks := v4, v6
+	if d.family == FamilyPreferIPv6 {
+		primaries, fallbacks = v6, v4
+	}
+	if len(primaries) == 0 {
+		primaries, fallbacks = fallbacks, nil
+	}
+	if len(primaries) == 0 {
+		return nil, fmt.Errorf("no addresses found for %s", host)
+	}
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan result, 2)
+	dialSerial := func(addrs []string) {
+		var err error
+		for _, addr := range addrs {
+			var conn net.Conn
+			if conn, err = d.dialer.DialContext(ctx, network, addr); err == nil {
+				results <- result{conn: conn}
+				return
+			}
+		}
+		results <- result{err: err}
+	}
+
+	go dialSerial(primaries)
+	pending := 1
+	var fallbackTimer <-chan time.Time
+	if len(fallbacks) > 0 {
+		timer := time.NewTimer(d.fallbackDelay())
+		defer timer.Stop()
+		fallbackTimer = timer.C
+	}
+
+	var firstErr error
+	startFallback := func() {
+		go dialSerial(fallbacks)
+		pending++
+		fallbackTimer = nil
+		fallbacks = nil
+	}
+	for {
+		select {
+		case <-fallbackTimer:
+			startFallback()
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				// Close any connection the losing family might still make
+				go func(pending int) {
+					for ; pending > 0; pending-- {
+						if late := <-results; late.conn != nil {
+							late.conn.Close()
+						}
+					}
+				}(pending)
+				return res.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			if len(fallbacks) > 0 {
+				// Primary family failed, don't wait for the timer
+				startFallback()
+			} else if pending == 0 {
+				return nil, firstErr
+			}
+		}
+	}
+}
+
+func (d *familyDialer) fallbackDelay() time.Duration {
+	if d.dialer.FallbackDelay > 0 {
+		return d.dialer.FallbackDelay
+	}
+	return 300 * time.Millisecond
+}
+
+// newResolver returns the resolver configured through the environment.
+// DNS_OVER_HTTPS_URL takes precedence over DNS_SERVERS. When neither is
+// set the system resolver is used.
+func newResolver() *net.Resolver {
+	if dohURL := os.Getenv("DNS_OVER_HTTPS_URL"); dohURL != "" {
+		return newDoHResolver(dohURL)
+	}
+	if servers := splitList(os.Getenv("DNS_SERVERS")); len(servers) > 0 {
+		return newDNSServerResolver(servers)
+	}
+	return net.DefaultResolver
+}
+
+// newDNSServerResolver returns a resolver that sends queries to the given
+// DNS servers in round-robin order instead of those in /etc/resolv.conf.
+func newDNSServerResolver(servers []string) *net.Resolver {
+	for i, server := range servers {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			servers[i] = net.JoinHostPort(server, "53")
+		}
+	}
+	var next atomic.Uint32
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			server := servers[int(next.Add(1)-1)%len(servers)]
+			return dialer.DialContext(ctx, network, server)
+		},
+	}
+}
+
+// newDoHResolver returns a resolver that sends queries to a DNS over HTTPS
+// (RFC 8484) endpoint such as https://cloudflare-dns.com/dns-query.
+func newDoHResolver(endpoint string) *net.Resolver {
+	// The DoH endpoint itself is resolved by the system resolver.
+	client := &http.Client{Timeout: 10 * time.Second}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return &dohConn{ctx: ctx, client: client, endpoint: endpoint}, nil
+		},
+	}
+}
+
+// dohConn adapts a DNS over HTTPS endpoint to the stream connection the Go
+// resolver expects. As it is not a net.PacketConn, the resolver writes each
+// query prefixed with its two byte length and reads the answer the same way.
+type dohConn struct {
+	ctx      context.Context
+	client   *http.Client
+	endpoint string
+	query    bytes.Buffer
+	answer   *bytes.Reader
+	deadline time.Time
+}
+
+func (c *dohConn) Write(b []byte) (int, error) {
+	c.answer = nil
+	return c.query.Write(b)
+}
+
+func (c *dohConn) Read(b []byte) (int, error) {
+	if c.answer == nil {
+		if err := c.roundTrip(); err != nil {
+			return 0, err
+		}
+	}
+	return c.answer.Read(b)
+}
+
+func (c *dohConn) roundTrip() error {
+	query := c.query.Bytes()
+	if len(query) < 2 {
+		return fmt.Errorf("doh: short query")
+	}
+	query = query[2:]
+	defer c.query.Reset()
+
+	ctx := c.ctx
+	if !c.deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, c.deadline)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint, bytes.NewReader(query))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("doh: %s returned status %d", c.endpoint, resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 65535))
+	if err != nil {
+		return err
+	}
+
+	answer := make([]byte, 2+len(body))
+	binary.BigEndian.PutUint16(answer, uint16(len(body)))
+	copy(answer[2:], body)
+	c.answer = bytes.NewReader(answer)
+	return nil
+}
+
+func (c *dohConn) Close() error                       { return nil }
+func (c *dohConn) LocalAddr() net.Addr                { return dohAddr{} }
+func (c *dohConn) RemoteAddr() net.Addr               { return dohAddr{} }
+func (c *dohConn) SetDeadline(t time.Time) error      { c.deadline = t; return nil }
+func (c *dohConn) SetReadDeadline(t time.Time) error  { c.deadline = t; return nil }
+func (c *dohConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type dohAddr struct{}
+
+func (dohAddr) Network() string { return "doh" }
+func (dohAddr) String() string  { return "doh" }
+
+// splitList splits a comma separated list, trimming whitespace and
+// dropping empty entries.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,237 @@
+package flareproxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// dnsAnswer builds a minimal DNS response to query answering A questions
+// with ip and leaving every other question type unanswered.
+func dnsAnswer(query []byte, ip net.IP) []byte {
+	// Skip the header and the question name to find the question type
+	end := 12
+	for query[end] != 0 {
+		end += int(query[end]) + 1
+	}
+	qtype := binary.BigEndian.Uint16(query[end+1:])
+	end += 5
+
+	resp := make([]byte, 12, 64)
+	copy(resp, query[:2])
+	binary.BigEndian.PutUint16(resp[2:], 0x8180)
+	binary.BigEndian.PutUint16(resp[4:], 1)
+	resp = append(resp, query[12:end]...)
+	if qtype == 1 {
+		binary.BigEndian.PutUint16(resp[6:], 1)
+		resp = append(resp, 0xc0, 0x0c, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4)
+		resp = append(resp, ip.To4()...)
+	}
+	return resp
+}
+
+func TestDoHResolver(t *testing.T) {
+	dohServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/dns-message" {
+			t.Errorf("Content-Type = %q, want application/dns-message", r.Header.Get("Content-Type"))
+		}
+		query, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(dnsAnswer(query, net.ParseIP("192.0.2.10")))
+	}))
+	defer dohServer.Close()
+
+	resolver := newDoHResolver(dohServer.URL)
+	addrs, err := resolver.LookupHost(context.Background(), "protected.example")
+	if err != nil {
+		t.Fatalf("LookupHost() error = %v", err)
+	}
+	if len(addrs) != 1 || addrs[0] != "192.0.2.10" {
+		t.Errorf("LookupHost() = %v, want [192.0.2.10]", addrs)
+	}
+}
+
+func TestDNSServerResolver(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer conn.Close()
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(dnsAnswer(buf[:n], net.ParseIP("192.0.2.20")), addr)
+		}
+	}()
+
+	resolver := newDNSServerResolver([]string{conn.LocalAddr().String()})
+	addrs, err := resolver.LookupHost(context.Background(), "protected.example")
+	if err != nil {
+		t.Fatalf("LookupHost() error = %v", err)
+	}
+	if len(addrs) != 1 || addrs[0] != "192.0.2.20" {
+		t.Errorf("LookupHost() = %v, want [192.0.2.20]", addrs)
+	}
+}
+
+func TestSplitList(t *testing.T) {
+	got := splitList(" 1.1.1.1, ,8.8.8.8:53,")
+	if len(got) != 2 || got[0] != "1.1.1.1" || got[1] != "8.8.8.8:53" {
+		t.Errorf("splitList() = %v", got)
+	}
+}
+
+func TestFamilyDialer(t *testing.T) {
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	tests := []struct {
+		name    string
+		family  string
+		network string
+		address string
+		wantErr bool
+	}{
+		{"dual stack", "", "tcp", net.JoinHostPort("localhost", port), false},
+		{"ipv4 only", FamilyIPv4, "tcp", net.JoinHostPort("127.0.0.1", port), false},
+		{"ipv4 only on tcp4", FamilyIPv4, "tcp4", net.JoinHostPort("127.0.0.1", port), false},
+		{"ipv6 only refuses ipv4 address", FamilyIPv6, "tcp", net.JoinHostPort("127.0.0.1", port), true},
+		{"prefer ipv6 falls back to ipv4", FamilyPreferIPv6, "tcp", net.JoinHostPort("localhost", port), false},
+		{"prefer ipv4", FamilyPreferIPv4, "tcp", net.JoinHostPort("localhost", port), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dialer := newFamilyDialer(&net.Dialer{}, tt.family)
+			conn, err := dialer.DialContext(context.Background(), tt.network, tt.address)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DialContext() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if conn != nil {
+				conn.Close()
+			}
+		})
+	}
+}
+
+func TestOutboundSourceIP(t *testing.T) {
+	loopback := ""
+	if ifaces, err := net.Interfaces(); err == nil {
+		for _, iface := range ifaces {
+			if iface.Flags&net.FlagLoopback != 0 {
+				loopback = iface.Name
+				break
+			}
+		}
+	}
+
+	tests := []struct {
+		name     string
+		sourceIP string
+		iface    string
+		want     string
+		wantErr  bool
+	}{
+		{name: "not configured", want: "<nil>"},
+		{name: "explicit source IP", sourceIP: "192.0.2.5", want: "192.0.2.5"},
+		{name: "source IP wins over interface", sourceIP: "192.0.2.5", iface: "does-not-exist0", want: "192.0.2.5"},
+		{name: "invalid source IP", sourceIP: "not-an-ip", wantErr: true},
+		{name: "unknown interface", iface: "does-not-exist0", wantErr: true},
+	}
+	if loopback != "" {
+		tests = append(tests, struct {
+			name     string
+			sourceIP string
+			iface    string
+			want     string
+			wantErr  bool
+		}{name: "loopback interface", iface: loopback, want: "127.0.0.1"})
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ip, err := outboundSourceIP(tt.sourceIP, tt.iface)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("outboundSourceIP() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && ip.String() != tt.want {
+				t.Errorf("outboundSourceIP() = %v, want %v", ip, tt.want)
+			}
+		})
+	}
+}
+
+func TestOutboundClientTuning(t *testing.T) {
+	transport := newOutboundClient().Transport.(*http.Transport)
+	if transport.MaxIdleConnsPerHost != 16 || transport.TLSHandshakeTimeout != 10*time.Second || transport.DisableKeepAlives {
+		t.Errorf("default transport: %d idle per host, TLS timeout %s, keep-alives disabled %v",
+			transport.MaxIdleConnsPerHost, transport.TLSHandshakeTimeout, transport.DisableKeepAlives)
+	}
+
+	t.Setenv("OUTBOUND_TLS_HANDSHAKE_TIMEOUT", "3s")
+	t.Setenv("OUTBOUND_MAX_IDLE_CONNS", "10")
+	t.Setenv("OUTBOUND_MAX_IDLE_CONNS_PER_HOST", "4")
+	t.Setenv("OUTBOUND_IDLE_CONN_TIMEOUT", "1m")
+	t.Setenv("OUTBOUND_KEEP_ALIVES", "false")
+	t.Setenv("OUTBOUND_DIAL_TIMEOUT", "2s")
+	transport = newOutboundClient().Transport.(*http.Transport)
+	if transport.TLSHandshakeTimeout != 3*time.Second || transport.MaxIdleConns != 10 || transport.MaxIdleConnsPerHost != 4 ||
+		transport.IdleConnTimeout != time.Minute || !transport.DisableKeepAlives {
+		t.Errorf("tuned transport = %+v", transport)
+	}
+	if dialer := newDialer(); dialer.Timeout != 2*time.Second {
+		t.Errorf("dial timeout = %s, want 2s", dialer.Timeout)
+	}
+}
+
+func TestTargetClientDeniesPrivateAddresses(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer origin.Close()
+	_, port, _ := net.SplitHostPort(origin.Listener.Addr().String())
+
+	policy := newTargetPolicyFromEnv()
+	client := newTargetClient(policy)
+	client.Transport.(*http.Transport).DisableKeepAlives = true
+	for _, deny := range []string{"false", "true", "false"} {
+		// The client follows reloads of the policy
+		t.Setenv("TARGET_DENY_PRIVATE", deny)
+		policy.replace(newTargetPolicyFromEnv())
+		// A name resolving to loopback is refused once resolved
+		resp, err := client.Get("http://localhost:" + port + "/")
+		if err == nil {
+			resp.Body.Close()
+		}
+		var deniedErr *TargetDeniedError
+		if got := errors.As(err, &deniedErr); got != (deny == "true") {
+			t.Errorf("TARGET_DENY_PRIVATE=%s: error = %v, want denied %v", deny, err, deny == "true")
+		}
+	}
+	for address, want := range map[string]bool{"127.0.0.1:80": true, "10.1.2.3:443": true, "[fe80::1]:80": true, "0.0.0.0:80": true, "93.184.215.14:443": false} {
+		if got := denyPrivateAddress("tcp", address, nil) != nil; got != want {
+			t.Errorf("denyPrivateAddress(%s) denied = %v, want %v", address, got, want)
+		}
+	}
+}
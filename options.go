@@ -0,0 +1,97 @@
+package flareproxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Headers through which clients control how a single request is solved.
+// They are stripped from the request once read.
+const (
+	// SessionHeader runs the request in the named FlareSolverr session
+	// instead of a warm session chosen by the proxy.
+	SessionHeader = "X-FlareProxy-Session"
+	// TimeoutHeader is the time FlareSolverr is given to solve the page,
+	// as a duration like "90s" or in milliseconds.
+	TimeoutHeader = "X-FlareProxy-Timeout"
+	// ProxyHeader is a shorter name for UpstreamProxyHeader.
+	ProxyHeader = "X-FlareProxy-Proxy"
+	// NoCacheHeader, set to anything but "false" or "0", solves the page
+	// even if it is cached. The fresh page still replaces the cached one.
+	NoCacheHeader = "X-FlareProxy-No-Cache"
+	// UserAgentHeader pins the fetches the proxy makes without
+	// FlareSolverr, in smart and reuse mode and for pass-through
+	// downloads, to a User-Agent. Responses report the User-Agent of the
+	// solution in it, which clients send back to keep using the
+	// cf_clearance cookies bound to it.
+	UserAgentHeader = "X-FlareProxy-User-Agent"
+)
+
+// requestOptions are the options a client set for a request through the
+// headers above.
+type requestOptions struct {
+	Session   string
+	Timeout   time.Duration
+	NoCache   bool
+	UserAgent string
+}
+
+// requestOptionsFrom returns the options set for ctx, if any.
+func requestOptionsFrom(ctx context.Context) requestOptions {
+	opts, _ := ctx.Value(requestOptionsKey).(requestOptions)
+	return opts
+}
+
+// requestedUpstreamProxy returns the upstream proxy a request names
+// through UpstreamProxyHeader or ProxyHeader.
+func requestedUpstreamProxy(h http.Header) string {
+	if proxy := h.Get(UpstreamProxyHeader); proxy != "" {
+		return proxy
+	}
+	return h.Get(ProxyHeader)
+}
+
+// withRequestOptions applies the option headers of a request and strips
+// them, together with the upstream proxy headers already applied by
+// withUpstreamProxy. It returns false after rejecting an invalid option.
+func withRequestOptions(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	opts, err := parseRequestOptions(r.Header)
+	if err != nil {
+		sendErrorStatus(w, r, http.StatusBadRequest, err.Error())
+		return r, false
+	}
+	for _, name := range []string{SessionHeader, TimeoutHeader, NoCacheHeader, UserAgentHeader, ProxyHeader, UpstreamProxyHeader} {
+		r.Header.Del(name)
+	}
+	if opts == (requestOptions{}) {
+		return r, true
+	}
+	return r.WithContext(context.WithValue(r.Context(), requestOptionsKey, opts)), true
+}
+
+func parseRequestOptions(h http.Header) (requestOptions, error) {
+	opts := requestOptions{
+		Session:   strings.TrimSpace(h.Get(SessionHeader)),
+		UserAgent: strings.TrimSpace(h.Get(UserAgentHeader)),
+	}
+	if value := strings.TrimSpace(h.Get(TimeoutHeader)); value != "" {
+		timeout, err := time.ParseDuration(value)
+		if err != nil {
+			ms, msErr := strconv.Atoi(value)
+			timeout, err = time.Duration(ms)*time.Millisecond, msErr
+		}
+		if err != nil || timeout < time.Second {
+			return opts, fmt.Errorf("%s must be a duration of at least 1s, e.g. 90s", TimeoutHeader)
+		}
+		opts.Timeout = timeout
+	}
+	if value := strings.TrimSpace(h.Get(NoCacheHeader)); value != "" {
+		noCache, err := strconv.ParseBool(value)
+		opts.NoCache = err != nil || noCache
+	}
+	return opts, nil
+}
@@ -0,0 +1,110 @@
+package flareproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseRequestOptions(t *testing.T) {
+	tests := []struct {
+		headers map[string]string
+		want    requestOptions
+		wantErr bool
+	}{
+		{headers: map[string]string{}, want: requestOptions{}},
+		{headers: map[string]string{SessionHeader: " mine "}, want: requestOptions{Session: "mine"}},
+		{headers: map[string]string{TimeoutHeader: "90s"}, want: requestOptions{Timeout: 90 * time.Second}},
+		{headers: map[string]string{TimeoutHeader: "45000"}, want: requestOptions{Timeout: 45 * time.Second}},
+		{headers: map[string]string{TimeoutHeader: "soon"}, wantErr: true},
+		{headers: map[string]string{TimeoutHeader: "10ms"}, wantErr: true},
+		{headers: map[string]string{NoCacheHeader: "1"}, want: requestOptions{NoCache: true}},
+		{headers: map[string]string{NoCacheHeader: "yes"}, want: requestOptions{NoCache: true}},
+		{headers: map[string]string{NoCacheHeader: "false"}, want: requestOptions{}},
+		{headers: map[string]string{UserAgentHeader: "Mozilla/5.0 Test"}, want: requestOptions{UserAgent: "Mozilla/5.0 Test"}},
+	}
+	for _, tt := range tests {
+		h := http.Header{}
+		for name, value := range tt.headers {
+			h.Set(name, value)
+		}
+		got, err := parseRequestOptions(h)
+		if (err != nil) != tt.wantErr || (!tt.wantErr && got != tt.want) {
+			t.Errorf("parseRequestOptions(%v) = %+v, %v, want %+v", tt.headers, got, err, tt.want)
+		}
+	}
+}
+
+func TestRequestOptionHeaders(t *testing.T) {
+	var requests []FlareSolverrRequest
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req FlareSolverrRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		requests = append(requests, req)
+		json.NewEncoder(w).Encode(testResponse("<html>solved</html>"))
+	}))
+	defer mockServer.Close()
+	t.Setenv("FLARESOLVERR_URL", mockServer.URL)
+	t.Setenv("CACHE_TTL", "1m")
+	t.Setenv("UPSTREAM_PROXY_ALLOWLIST", "http://exit:3128")
+
+	handler := NewDirectHandler()
+	handler.sessions.add("example.com", "warm-session", mockServer.URL)
+	get := func(headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/example.com/", nil)
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	get(map[string]string{SessionHeader: "mine", TimeoutHeader: "90s"})
+	if len(requests) != 1 || requests[0].Session != "mine" || requests[0].MaxTimeout != 90000 {
+		t.Fatalf("requests = %+v, want the client's session and timeout", requests)
+	}
+
+	// The page is cached now, unless the client asks for a fresh one
+	get(nil)
+	if len(requests) != 1 {
+		t.Errorf("cached page solved again")
+	}
+	get(map[string]string{NoCacheHeader: "true"})
+	if len(requests) != 2 || requests[1].Session != "warm-session" || requests[1].MaxTimeout != 60000 {
+		t.Errorf("requests = %+v, want a fresh solve with the defaults", requests)
+	}
+
+	get(map[string]string{ProxyHeader: "http://exit:3128"})
+	if len(requests) != 3 || requests[2].Proxy == nil || requests[2].Proxy.URL != "http://exit:3128" {
+		t.Errorf("requests = %+v, want the proxy from %s", requests, ProxyHeader)
+	}
+	if rr := get(map[string]string{ProxyHeader: "http://other:3128"}); rr.Code != http.StatusForbidden {
+		t.Errorf("status with a proxy not allowed = %d, want 403", rr.Code)
+	}
+	if rr := get(map[string]string{TimeoutHeader: "soon"}); rr.Code != http.StatusBadRequest {
+		t.Errorf("status with an invalid timeout = %d, want 400", rr.Code)
+	}
+}
+
+func TestRequestOptionHeadersStripped(t *testing.T) {
+	req := httptest.NewRequest("GET", "/example.com/", nil)
+	for _, name := range []string{SessionHeader, TimeoutHeader, NoCacheHeader, ProxyHeader, UpstreamProxyHeader} {
+		req.Header.Set(name, "1s")
+	}
+	req.Header.Set(IfHashDiffersHeader, "abc")
+	r, ok := withRequestOptions(httptest.NewRecorder(), req)
+	if !ok {
+		t.Fatal("withRequestOptions() rejected the request")
+	}
+	for name := range r.Header {
+		if name != http.CanonicalHeaderKey(IfHashDiffersHeader) {
+			t.Errorf("header %s not stripped", name)
+		}
+	}
+	if opts := requestOptionsFrom(r.Context()); opts.Session != "1s" || opts.Timeout != time.Second || !opts.NoCache {
+		t.Errorf("options = %+v", opts)
+	}
+}
@@ -0,0 +1,157 @@
+package flareproxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// defaultPassThroughExtensions are the file types fetched directly rather
+// than through FlareSolverr, whose browser can only return HTML.
+const defaultPassThroughExtensions = "avif,bmp,css,csv,gif,gz,ico,jpeg,jpg,js,json,mp3,mp4,pdf,png,svg,tar,torrent,txt,webm,webp,woff,woff2,xml,zip"
+
+// passThroughHeaders are the origin response headers passed on to clients.
+var passThroughHeaders = []string{
+	"Accept-Ranges", "Cache-Control", "Content-Disposition", "Content-Length",
+	"Content-Range", "Content-Type", "ETag", "Expires", "Last-Modified",
+}
+
+// passThroughExtensionsFromEnv reads PASSTHROUGH_EXTENSIONS. "none"
+// disables pass-through.
+func passThroughExtensionsFromEnv() map[string]bool {
+	extensions := make(map[string]bool)
+	list := envString("PASSTHROUGH_EXTENSIONS", defaultPassThroughExtensions)
+	if list == "none" {
+		return extensions
+	}
+	for _, ext := range splitList(list) {
+		extensions["."+strings.ToLower(strings.TrimPrefix(ext, "."))] = true
+	}
+	return extensions
+}
+
+// isPassThrough reports whether targetURL is a resource to download
+// directly. Requests through an upstream proxy are left to FlareSolverr,
+// which connects through it.
+func (s *solver) isPassThrough(ctx context.Context, targetURL string) bool {
+	u, err := url.Parse(targetURL)
+	if err != nil || upstreamProxyFrom(ctx) != nil || s.upstreams.applies(targetURL) {
+		return false
+	}
+	return s.passThrough[strings.ToLower(path.Ext(u.Path))]
+}
+
+// servePassThrough downloads a non-HTML resource directly from the origin
+// and streams it to the client with the origin's Content-Type and
+// Content-Length. It sends the cookies and User-Agent of an earlier solve
+// of the domain; if the origin challenges the download, the domain's front
+// page is solved to obtain fresh ones and the download is retried once.
+func (s *solver) servePassThrough(w http.ResponseWriter, r *http.Request, targetURL string) {
+	ctx := r.Context()
+	info := requestInfoFrom(ctx)
+	info.Target = targetURL
+	info.Backend = DirectBackend
+	u, err := url.Parse(targetURL)
+	if err != nil {
+		sendErrorStatus(w, r, http.StatusBadRequest, "invalid URL: "+err.Error())
+		return
+	}
+	if err := s.targets.check(targetURL); err != nil {
+		sendFetchError(w, r, err)
+		return
+	}
+	host := strings.ToLower(u.Hostname())
+	cl, _ := s.clearances.get(host)
+
+	for attempt := 1; ; attempt++ {
+		if err := s.rateLimits.wait(ctx, targetURL); err != nil {
+			sendFetchError(w, r, err)
+			return
+		}
+		resp, err := s.download(ctx, r, targetURL, cl)
+		if err != nil {
+			sendErrorStatus(w, r, http.StatusBadGateway, "download failed: "+err.Error())
+			return
+		}
+		defer resp.Body.Close()
+
+		// Challenges are HTML pages, read them to look for their markers
+		body := io.Reader(resp.Body)
+		var head []byte
+		if strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+			head, _ = io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+			body = io.MultiReader(bytes.NewReader(head), resp.Body)
+		}
+		if !isChallenge(resp.StatusCode, resp.Header, head) || attempt > 1 {
+			if len(cl.Cookies) > 0 {
+				var cookies []Cookie
+				for _, c := range resp.Cookies() {
+					cookies = append(cookies, fromHTTPCookie(c))
+				}
+				s.clearances.merge(host, cookies)
+			}
+			if s.maxBodyBytes > 0 && resp.ContentLength > s.maxBodyBytes {
+				sendErrorStatus(w, r, http.StatusBadGateway, "download exceeds MAX_BODY_BYTES")
+				return
+			}
+			for _, name := range passThroughHeaders {
+				if value := resp.Header.Get(name); value != "" {
+					w.Header().Set(name, value)
+				}
+			}
+			w.Header().Set(UserAgentHeader, resp.Request.Header.Get("User-Agent"))
+			w.WriteHeader(resp.StatusCode)
+			if err := copyBody(w, body, s.maxBodyBytes); errors.Is(err, errBodyTooLarge) {
+				// Too late for an error status, make sure the client does
+				// not take the truncated body for the whole
+				loggerFrom(ctx).Error("download exceeds MAX_BODY_BYTES, aborting", "target", targetURL)
+				panic(http.ErrAbortHandler)
+			}
+			return
+		}
+
+		loggerFrom(ctx).Info("download challenged, solving the domain", "host", host)
+		s.clearances.drop(host)
+		flareResponse, _, err := s.fetch(ctx, "request.get", u.Scheme+"://"+u.Host+"/")
+		if err != nil {
+			sendFetchError(w, r, err)
+			return
+		}
+		info.Target = targetURL
+		s.clearances.put(targetURL, flareResponse)
+		cl = clearance{Cookies: flareResponse.Solution.Cookies, UserAgent: flareResponse.Solution.UserAgent}
+	}
+}
+
+// download requests targetURL from the origin with the cookies and
+// User-Agent of cl, passing on the client's conditional and range headers.
+// HEAD requests are passed on as such.
+func (s *solver) download(ctx context.Context, r *http.Request, targetURL string, cl clearance) (*http.Response, error) {
+	method := http.MethodGet
+	if r.Method == http.MethodHead {
+		method = http.MethodHead
+	}
+	req, err := http.NewRequestWithContext(ctx, method, targetURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	userAgent := cl.UserAgent
+	if userAgent == "" {
+		userAgent = defaultUserAgent
+	}
+	req.Header.Set("User-Agent", s.userAgentFor(ctx, req.URL.Hostname(), userAgent))
+	for _, name := range []string{"Accept", "Range", "If-Range", "If-None-Match", "If-Modified-Since"} {
+		if value := r.Header.Get(name); value != "" {
+			req.Header.Set(name, value)
+		}
+	}
+	for _, c := range cl.Cookies {
+		req.AddCookie(&http.Cookie{Name: c.Name, Value: c.Value})
+	}
+	return s.downloads.Do(req)
+}
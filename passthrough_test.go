@@ -0,0 +1,91 @@
+package flareproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPassThrough(t *testing.T) {
+	image := []byte("\x89PNG\r\n\x1a\nbinary")
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/protected") {
+			if c, err := r.Cookie(ClearanceCookie); err != nil || c.Value != "ok" || r.UserAgent() != "TestUA/1.0" {
+				w.Header().Set("Content-Type", "text/html")
+				w.WriteHeader(http.StatusForbidden)
+				w.Write([]byte("<html><title>Just a moment...</title></html>"))
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Set-Cookie", "tracking=1")
+		w.Write(image)
+	}))
+	defer origin.Close()
+
+	var solved []string
+	flareSolverr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req FlareSolverrRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		solved = append(solved, req.URL)
+		response := testResponse("<html>front page</html>")
+		response.Solution.Cookies = []Cookie{{Name: ClearanceCookie, Value: "ok", Session: true}}
+		response.Solution.UserAgent = "TestUA/1.0"
+		json.NewEncoder(w).Encode(response)
+	}))
+	defer flareSolverr.Close()
+	t.Setenv("FLARESOLVERR_URL", flareSolverr.URL)
+
+	handler := NewDirectHandler()
+	handler.direct = origin.Client()
+	handler.downloads = origin.Client()
+	host := strings.TrimPrefix(origin.URL, "https://")
+
+	tests := []struct {
+		name       string
+		path       string
+		wantType   string
+		wantBody   string
+		wantSolved int
+	}{
+		{name: "unprotected download", path: "/open.png", wantType: "image/png", wantBody: string(image)},
+		{name: "challenged download is solved once", path: "/protected.png", wantType: "image/png", wantBody: string(image), wantSolved: 1},
+		{name: "clearance is reused", path: "/protected.png?size=2", wantType: "image/png", wantBody: string(image), wantSolved: 1},
+		{name: "pages still go through FlareSolverr", path: "/page.html", wantType: "text/html; charset=utf-8", wantBody: "<html>front page</html>", wantSolved: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, httptest.NewRequest("GET", "/"+host+tt.path, nil))
+			if rr.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", rr.Code, rr.Body.String())
+			}
+			if got := rr.Header().Get("Content-Type"); got != tt.wantType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.wantType)
+			}
+			if rr.Body.String() != tt.wantBody {
+				t.Errorf("body = %q, want %q", rr.Body.String(), tt.wantBody)
+			}
+			if len(solved) != tt.wantSolved {
+				t.Errorf("solved %v, want %d solves", solved, tt.wantSolved)
+			}
+		})
+	}
+	if solved[0] != origin.URL+"/" {
+		t.Errorf("solved %s, want the front page", solved[0])
+	}
+}
+
+func TestPassThroughExtensions(t *testing.T) {
+	t.Setenv("PASSTHROUGH_EXTENSIONS", "PNG, .pdf")
+	extensions := passThroughExtensionsFromEnv()
+	if len(extensions) != 2 || !extensions[".png"] || !extensions[".pdf"] {
+		t.Errorf("extensions = %v", extensions)
+	}
+	t.Setenv("PASSTHROUGH_EXTENSIONS", "none")
+	if extensions := passThroughExtensionsFromEnv(); len(extensions) != 0 {
+		t.Errorf("extensions = %v, want none", extensions)
+	}
+}
@@ -0,0 +1,145 @@
+package flareproxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// FetchRequest is a fetch as the frontends hand it to the pipeline. The
+// direct and proxy modes, /fetch, batches, jobs, schedules and the Go
+// client and transport all describe what to fetch this way, so that what
+// the pipeline learns is available on all of them. Options set through
+// request headers travel in the context.
+type FetchRequest struct {
+	// Cmd is the FlareSolverr command, "request.get" or "request.post";
+	// request.get if empty.
+	Cmd string
+	// URL is the absolute target URL.
+	URL string
+	// PostData is the application/x-www-form-urlencoded body of a
+	// request.post.
+	PostData string
+	// Fallback fetches the page over plain HTTP when solving it over HTTPS
+	// fails, for targets given without a scheme.
+	Fallback bool
+	// RewriteLinks points the links of an HTML page back through the
+	// direct mode.
+	RewriteLinks bool
+	// Defer waits for maintenance windows to end instead of failing, for
+	// fetches that run in the background.
+	Defer bool
+	// Header holds the headers of the client's request, if any, for
+	// CACHE_KEY_VARY and the CacheKeyFunc.
+	Header http.Header
+	// APIKey is the API key the client authenticated with, if any.
+	APIKey string
+}
+
+func withFetchRequest(ctx context.Context, req FetchRequest) context.Context {
+	return context.WithValue(ctx, fetchRequestKey, req)
+}
+
+// fetchRequestFrom returns the FetchRequest processed in ctx, if any.
+func fetchRequestFrom(ctx context.Context) (FetchRequest, bool) {
+	req, ok := ctx.Value(fetchRequestKey).(FetchRequest)
+	return req, ok
+}
+
+// clientFetchRequest returns req with the headers and API key of the
+// client request r.
+func clientFetchRequest(r *http.Request, req FetchRequest) FetchRequest {
+	if req.Header == nil {
+		req.Header = r.Header
+	}
+	if req.APIKey == "" {
+		req.APIKey = requestInfoFrom(r.Context()).APIKey
+	}
+	return req
+}
+
+// FetchResult is the outcome of a FetchRequest.
+type FetchResult struct {
+	// Response is the solution, from FlareSolverr, the origin or the cache.
+	Response *FlareSolverrResponse
+	// URL is the URL fetched, which is the request's unless it fell back
+	// to HTTP.
+	URL  string
+	meta responseMeta
+}
+
+// process runs req through the pipeline.
+func (s *solver) process(ctx context.Context, req FetchRequest) (*FetchResult, error) {
+	if req.Cmd == "" {
+		req.Cmd = "request.get"
+	}
+	if err := s.authRules.checkTarget(ctx, req); err != nil {
+		return nil, err
+	}
+	flareResponse, meta, err := s.fetchRecorded(ctx, req)
+	var maintenanceErr *MaintenanceError
+	for req.Defer && errors.As(err, &maintenanceErr) {
+		loggerFrom(ctx).Info("deferring fetch until the maintenance window ends", "target", req.URL,
+			"retry_after", maintenanceErr.RetryAfter.Round(time.Second).String())
+		select {
+		case <-time.After(maintenanceErr.RetryAfter):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		flareResponse, meta, err = s.fetchRecorded(ctx, req)
+	}
+	var solverErr *SolverError
+	if err != nil && req.Fallback && (errors.As(err, &solverErr) || errors.Is(err, errNotRecorded)) && strings.HasPrefix(req.URL, "https://") {
+		req.URL = "http://" + strings.TrimPrefix(req.URL, "https://")
+		req.Fallback = false
+		loggerFrom(ctx).Info("HTTPS failed, trying HTTP fallback", "target", req.URL)
+		return s.process(ctx, req)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if req.RewriteLinks {
+		flareResponse = withRewrittenLinks(flareResponse, req.URL)
+	}
+	return &FetchResult{Response: flareResponse, URL: req.URL, meta: meta}, nil
+}
+
+// serve runs req for an HTTP frontend and writes its result, or the
+// error, to w, as an Envelope if the client asked for one. Non-HTML
+// resources are downloaded directly instead, unless the client asked for
+// an Envelope or a cassette records or replays every fetch.
+func (s *solver) serve(w http.ResponseWriter, r *http.Request, req FetchRequest) {
+	req = clientFetchRequest(r, req)
+	envelope := wantsEnvelope(r)
+	if (req.Cmd == "" || req.Cmd == "request.get") && !envelope && s.cassette == nil && s.isPassThrough(r.Context(), req.URL) {
+		s.servePassThrough(w, r, req.URL)
+		return
+	}
+	result, err := s.process(r.Context(), req)
+	if err != nil {
+		sendFetchError(w, r, err)
+		return
+	}
+	if envelope {
+		writeEnvelope(w, result)
+		return
+	}
+	s.writeSolution(w, r, result)
+}
+
+// backgroundContext returns ctx for a fetch that outlives or runs without
+// a client request, such as a job, a scheduled fetch or a batch item. Its
+// log entries carry id as the request ID, and it queues under the API key
+// of the client request ctx carries, if any, and is held to the same
+// AUTH_RULES domain rules, like the request would.
+func backgroundContext(ctx context.Context, id string) context.Context {
+	parent := requestInfoFrom(ctx)
+	return context.WithValue(ctx, requestInfoKey, &requestInfo{
+		ID:         id,
+		APIKey:     parent.APIKey,
+		Remote:     parent.Remote,
+		ClientCert: parent.ClientCert,
+	})
+}
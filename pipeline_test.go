@@ -0,0 +1,61 @@
+package flareproxy
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/kljensen/flareproxygo/flaresolverr/flaresolverrtest"
+)
+
+func TestProcess(t *testing.T) {
+	fs := flaresolverrtest.NewServer()
+	defer fs.Close()
+	fs.SetPage("https://example.com/", flaresolverrtest.Page{Error: "Error solving the challenge."})
+	fs.SetPage("http://example.com/", flaresolverrtest.Page{Body: `<a href="/next">http://example.com/</a>`})
+	t.Setenv("FLARESOLVERR_URL", fs.Endpoint())
+	t.Setenv("RETRY_MAX_ATTEMPTS", "1")
+	s := newSolver()
+
+	tests := []struct {
+		name     string
+		req      FetchRequest
+		wantURL  string
+		wantBody string
+	}{
+		{name: "as given", req: FetchRequest{URL: "http://example.com/"}, wantURL: "http://example.com/", wantBody: `<a href="/next">http://example.com/</a>`},
+		{name: "no fallback", req: FetchRequest{URL: "https://example.com/"}},
+		{name: "fallback", req: FetchRequest{URL: "https://example.com/", Fallback: true}, wantURL: "http://example.com/", wantBody: `<a href="/next">http://example.com/</a>`},
+		{name: "rewritten links", req: FetchRequest{URL: "http://example.com/", RewriteLinks: true}, wantURL: "http://example.com/", wantBody: `<a href="/http/example.com/next">http://example.com/</a>`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := backgroundContext(context.Background(), "test")
+			result, err := s.process(ctx, tt.req)
+			if tt.wantURL == "" {
+				var solverErr *SolverError
+				if !errors.As(err, &solverErr) {
+					t.Errorf("process() error = %v, want the solver's", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("process() error = %v", err)
+			}
+			if result.URL != tt.wantURL || result.Response.Solution.Response != tt.wantBody {
+				t.Errorf("process() = %s %q, want %s %q", result.URL, result.Response.Solution.Response, tt.wantURL, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestBackgroundContext(t *testing.T) {
+	parent := context.WithValue(context.Background(), requestInfoKey, &requestInfo{ID: "req", APIKey: "tenant-key"})
+	info := requestInfoFrom(backgroundContext(parent, "job"))
+	if info.ID != "job" || info.APIKey != "tenant-key" {
+		t.Errorf("request info = %+v, want the job's ID and the client's API key", info)
+	}
+	if info := requestInfoFrom(backgroundContext(context.Background(), "job")); info.APIKey != "" {
+		t.Errorf("API key = %q without a client request", info.APIKey)
+	}
+}
@@ -0,0 +1,62 @@
+package flareproxy
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// prefetchURLs returns the URLs listed in PREFETCH_URLS. Entries without
+// a scheme are fetched over HTTPS, and invalid ones are skipped with a
+// warning.
+func prefetchURLs() []string {
+	var urls []string
+	for _, raw := range splitList(os.Getenv("PREFETCH_URLS")) {
+		if !strings.Contains(raw, "://") {
+			raw = "https://" + raw
+		}
+		if !isAbsoluteHTTPURL(raw) {
+			slog.Warn("ignoring invalid PREFETCH_URLS entry", "url", raw)
+			continue
+		}
+		urls = append(urls, raw)
+	}
+	return urls
+}
+
+// prefetch solves the PREFETCH_URLS at startup and again every interval,
+// so that the first real request for a popular page finds it cached, and
+// in reuse and smart mode its domain's clearance fresh. The list is read
+// again each round, so that config reloads apply. It returns when ctx is
+// done.
+func (s *solver) prefetch(ctx context.Context, interval time.Duration) {
+	for {
+		s.prefetchOnce(ctx, prefetchURLs())
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// prefetchOnce solves urls one after the other, bypassing the cache so
+// that entries are refreshed before they expire.
+func (s *solver) prefetchOnce(ctx context.Context, urls []string) {
+	for _, targetURL := range urls {
+		if ctx.Err() != nil {
+			return
+		}
+		start := time.Now()
+		fetchCtx := context.WithValue(backgroundContext(ctx, "prefetch"), requestOptionsKey, requestOptions{NoCache: true})
+		result, err := s.process(fetchCtx, FetchRequest{URL: targetURL})
+		if err != nil {
+			slog.Warn("failed to prefetch", "url", targetURL, "error", err)
+			continue
+		}
+		slog.Info("prefetched", "url", targetURL, "status", result.meta.Status, "backend", result.meta.Backend,
+			"duration_ms", time.Since(start).Milliseconds())
+	}
+}
@@ -0,0 +1,46 @@
+package flareproxy
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/kljensen/flareproxygo/flaresolverr/flaresolverrtest"
+)
+
+func TestPrefetch(t *testing.T) {
+	fs := flaresolverrtest.NewServer()
+	defer fs.Close()
+	t.Setenv("FLARESOLVERR_URL", fs.Endpoint())
+	t.Setenv("CACHE_TTL", "1h")
+	t.Setenv("PREFETCH_URLS", "example.com/popular, https://b.example/feed?page=1, ftp://c.example/")
+	want := []string{"https://example.com/popular", "https://b.example/feed?page=1"}
+	if got := prefetchURLs(); !slices.Equal(got, want) {
+		t.Fatalf("prefetchURLs() = %v, want %v", got, want)
+	}
+	s := newSolver()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.prefetch(ctx, time.Hour)
+		close(done)
+	}()
+	deadline := time.Now().Add(2 * time.Second)
+	for len(fs.Requests()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	// The first real request finds the page cached
+	if _, meta, err := s.fetch(context.Background(), "request.get", "https://example.com/popular"); err != nil || meta.Cache != "HIT" {
+		t.Errorf("fetch after prefetch = %+v, %v; want a cache hit", meta, err)
+	}
+	// Later rounds refresh cached pages
+	s.prefetchOnce(context.Background(), want)
+	if got := len(fs.Requests()); got != 4 {
+		t.Errorf("solves = %d, want each URL solved twice", got)
+	}
+}
@@ -0,0 +1,47 @@
+package flareproxy
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Provenance headers tell downstream consumers that content passed through
+// the proxy, where it came from and when it was fetched. Cached content
+// keeps the time it was originally fetched.
+const (
+	FetchedAtHeader = "X-FlareProxy-Fetched-At"
+	OriginHeader    = "X-FlareProxy-Origin"
+)
+
+// stampFetched records the fetch time on solutions that lack one, e.g.
+// those fetched directly or from FlareSolverr versions that do not report
+// it, before they are cached.
+func stampFetched(flareResponse *FlareSolverrResponse) {
+	if flareResponse.EndTimestamp == 0 {
+		flareResponse.EndTimestamp = time.Now().UnixMilli()
+	}
+}
+
+// setProvenanceHeaders sets the provenance headers for a response.
+func setProvenanceHeaders(w http.ResponseWriter, meta responseMeta) {
+	if meta.URL != "" {
+		w.Header().Set(OriginHeader, meta.URL)
+	}
+	if !meta.FetchedAt.IsZero() {
+		w.Header().Set(FetchedAtHeader, meta.FetchedAt.Format(time.RFC3339))
+	}
+}
+
+// provenanceComment returns the HTML comment appended to HTML pages when
+// PROVENANCE_COMMENT is set, so the provenance survives saving the page.
+func provenanceComment(meta responseMeta) string {
+	fetched := "an unknown time"
+	if !meta.FetchedAt.IsZero() {
+		fetched = meta.FetchedAt.Format(time.RFC3339)
+	}
+	// "--" may not appear inside a comment
+	origin := strings.ReplaceAll(meta.URL, "--", "-%2D")
+	return fmt.Sprintf("\n<!-- Fetched by flareproxygo from %s at %s -->\n", origin, fetched)
+}
@@ -0,0 +1,75 @@
+package flareproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProvenance(t *testing.T) {
+	fetched := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req FlareSolverrRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		response := testResponse("<html><body>hi</body></html>")
+		if strings.HasSuffix(req.URL, "/api") {
+			response = testResponse(`{"ok": true}`)
+		}
+		response.EndTimestamp = fetched.UnixMilli()
+		json.NewEncoder(w).Encode(response)
+	}))
+	defer mockServer.Close()
+	t.Setenv("FLARESOLVERR_URL", mockServer.URL)
+	t.Setenv("CACHE_TTL", "1m")
+
+	tests := []struct {
+		name        string
+		comment     string
+		path        string
+		wantOrigin  string
+		wantComment bool
+	}{
+		{name: "headers", path: "/example.com/page", wantOrigin: "https://example.com/page"},
+		{name: "comment", comment: "true", path: "/example.com/page", wantOrigin: "https://example.com/page", wantComment: true},
+		{name: "no comment outside html", comment: "true", path: "/example.com/api", wantOrigin: "https://example.com/api"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("PROVENANCE_COMMENT", tt.comment)
+			handler := NewDirectHandler()
+			// The second request is served from the cache
+			for _, wantCache := range []string{"MISS", "HIT"} {
+				rr := httptest.NewRecorder()
+				handler.ServeHTTP(rr, httptest.NewRequest("GET", tt.path, nil))
+				if got := rr.Result().Trailer.Get(TrailerCache); got != wantCache {
+					t.Fatalf("cache = %q, want %q", got, wantCache)
+				}
+				if got := rr.Header().Get(OriginHeader); got != tt.wantOrigin {
+					t.Errorf("%s = %q, want %q", OriginHeader, got, tt.wantOrigin)
+				}
+				if got := rr.Header().Get(FetchedAtHeader); got != "2024-05-01T12:00:00Z" {
+					t.Errorf("%s = %q, want the original fetch time", FetchedAtHeader, got)
+				}
+				comment := "<!-- Fetched by flareproxygo from https://example.com/page at 2024-05-01T12:00:00Z -->"
+				if got := strings.Contains(rr.Body.String(), comment); got != tt.wantComment {
+					t.Errorf("body = %q, want comment %v", rr.Body.String(), tt.wantComment)
+				}
+			}
+		})
+	}
+}
+
+func TestStampFetched(t *testing.T) {
+	response := testResponse("ok")
+	before := time.Now().Truncate(time.Millisecond)
+	stampFetched(response)
+	if got := response.EndTime(); got.Before(before) || got.After(time.Now()) {
+		t.Errorf("EndTime() = %v, want about now", got)
+	}
+	if got := provenanceComment(responseMeta{URL: "https://example.com/a--b"}); !strings.Contains(got, "a-%2Db at an unknown time -->") {
+		t.Errorf("provenanceComment() = %q", got)
+	}
+}
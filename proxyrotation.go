@@ -0,0 +1,276 @@
+package flareproxy
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Upstream proxy rotation strategies selected through
+// UPSTREAM_PROXY_STRATEGY.
+const (
+	// ProxyStrategyRoundRobin uses a domain's proxies in turn.
+	ProxyStrategyRoundRobin = "round-robin"
+	// ProxyStrategyRandom picks one of a domain's proxies at random.
+	ProxyStrategyRandom = "random"
+	// ProxyStrategySticky sends each host through the same proxy, so that
+	// sites see a consistent IP, as long as that proxy is not banned.
+	ProxyStrategySticky = "sticky"
+	// ProxyStrategyFailureAware prefers the proxies with the fewest recent
+	// failures, taking turns among equals.
+	ProxyStrategyFailureAware = "failure-aware"
+)
+
+// proxyStrategy returns strategy if it is known, and round robin
+// otherwise.
+func proxyStrategy(strategy string) string {
+	switch strategy {
+	case ProxyStrategyRoundRobin, ProxyStrategyRandom, ProxyStrategySticky, ProxyStrategyFailureAware:
+		return strategy
+	case "":
+		return ProxyStrategyRoundRobin
+	default:
+		slog.Warn("unknown upstream proxy strategy", "strategy", strategy, "using", ProxyStrategyRoundRobin)
+		return ProxyStrategyRoundRobin
+	}
+}
+
+// proxyState tracks how a configured upstream proxy has been doing.
+type proxyState struct {
+	failures    int // consecutive
+	successes   int64
+	errors      int64
+	lastError   string
+	bannedUntil time.Time
+	bannedBy    string
+}
+
+// ProxiesBannedError is returned when every upstream proxy for a domain is
+// banned, rather than solving without one.
+type ProxiesBannedError struct {
+	RetryAfter time.Duration
+}
+
+func (e *ProxiesBannedError) Error() string {
+	return fmt.Sprintf("all upstream proxies are banned, retry in %s", e.RetryAfter.Round(time.Second))
+}
+
+// replace adopts the configuration of fresh, e.g. after the configuration
+// was reloaded. Proxies in both keep their bans and statistics.
+func (p *upstreamPolicy) replace(fresh *upstreamPolicy) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for proxyURL := range fresh.state {
+		if state, ok := p.state[proxyURL]; ok {
+			fresh.state[proxyURL] = state
+		}
+	}
+	p.global = fresh.global
+	p.domains = fresh.domains
+	p.strategy = fresh.strategy
+	p.maxFailures = fresh.maxFailures
+	p.cooldown = fresh.cooldown
+	p.state = fresh.state
+}
+
+// rule returns the proxies for host and the rule they come from. Rules
+// match the domain itself and any of its subdomains, with the most
+// specific rule winning.
+func (p *upstreamPolicy) rule(host string) (string, []FlareSolverrProxy) {
+	domain := strings.ToLower(host)
+	for {
+		if proxies, ok := p.domains[domain]; ok {
+			return domain, proxies
+		}
+		_, parent, ok := strings.Cut(domain, ".")
+		if !ok {
+			return "", p.global
+		}
+		domain = parent
+	}
+}
+
+// applies reports whether requests for targetURL go through a proxy.
+func (p *upstreamPolicy) applies(targetURL string) bool {
+	_, proxies := p.ruleFor(targetURL)
+	return len(proxies) > 0
+}
+
+// ruleFor returns the proxies for targetURL and the rule they come from,
+// "" for UPSTREAM_PROXIES.
+func (p *upstreamPolicy) ruleFor(targetURL string) (string, []FlareSolverrProxy) {
+	u, err := url.Parse(targetURL)
+	if err != nil {
+		return "", nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.rule(u.Hostname())
+}
+
+// forURL returns the proxy for targetURL according to the strategy, or nil
+// to connect directly. It returns a *ProxiesBannedError when all of the
+// domain's proxies are banned.
+func (p *upstreamPolicy) forURL(targetURL string) (*FlareSolverrProxy, error) {
+	u, err := url.Parse(targetURL)
+	if err != nil {
+		return nil, nil
+	}
+	host := strings.ToLower(u.Hostname())
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key, proxies := p.rule(host)
+	if len(proxies) == 0 {
+		return nil, nil
+	}
+
+	now := p.now()
+	var available []FlareSolverrProxy
+	var retryAfter time.Duration
+	for _, proxy := range proxies {
+		until := p.state[proxy.URL].bannedUntil
+		if !now.Before(until) {
+			available = append(available, proxy)
+		} else if retryAfter == 0 || until.Sub(now) < retryAfter {
+			retryAfter = until.Sub(now)
+		}
+	}
+	if len(available) == 0 {
+		return nil, &ProxiesBannedError{RetryAfter: retryAfter}
+	}
+
+	var proxy FlareSolverrProxy
+	switch p.strategy {
+	case ProxyStrategyRandom:
+		proxy = available[rand.IntN(len(available))]
+	case ProxyStrategySticky:
+		// Hash over all proxies, so hosts only move while theirs is banned
+		h := fnv.New32a()
+		h.Write([]byte(host))
+		for i := range proxies {
+			candidate := proxies[(int(h.Sum32())+i)%len(proxies)]
+			if !now.Before(p.state[candidate.URL].bannedUntil) {
+				proxy = candidate
+				break
+			}
+		}
+	case ProxyStrategyFailureAware:
+		fewest := available[:0:0]
+		for _, candidate := range available {
+			failures := p.state[candidate.URL].failures
+			if len(fewest) > 0 && failures > p.state[fewest[0].URL].failures {
+				continue
+			}
+			if len(fewest) > 0 && failures < p.state[fewest[0].URL].failures {
+				fewest = fewest[:0]
+			}
+			fewest = append(fewest, candidate)
+		}
+		proxy = fewest[p.next[key]%len(fewest)]
+		p.next[key]++
+	default:
+		proxy = available[p.next[key]%len(available)]
+		p.next[key]++
+	}
+	return &proxy, nil
+}
+
+// record notes the outcome of a solve through proxy. Solver errors and
+// origins answering 403 or 429, as they do to banned IPs, count as
+// failures; after maxFailures in a row the proxy is banned for the
+// cooldown. Other errors say nothing about the proxy and are ignored.
+func (p *upstreamPolicy) record(proxy *FlareSolverrProxy, flareResponse *FlareSolverrResponse, err error) {
+	var solverErr *SolverError
+	reason := ""
+	switch {
+	case errors.As(err, &solverErr):
+		reason = solverErr.Error()
+	case err != nil:
+		return
+	case flareResponse.Solution.Status == http.StatusForbidden || flareResponse.Solution.Status == http.StatusTooManyRequests:
+		reason = fmt.Sprintf("origin answered %d", flareResponse.Solution.Status)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	state, ok := p.state[proxy.URL]
+	if !ok {
+		return
+	}
+	if reason == "" {
+		state.failures = 0
+		state.successes++
+		return
+	}
+	state.failures++
+	state.errors++
+	state.lastError = reason
+	if p.maxFailures > 0 && state.failures >= p.maxFailures {
+		state.failures = 0
+		state.bannedUntil = p.now().Add(p.cooldown)
+		state.bannedBy = "failures"
+		slog.Warn("upstream proxy failing, cooling down", "proxy", proxy.URL, "cooldown", p.cooldown.String(), "error", reason)
+	}
+}
+
+// ban rests the proxy with proxyURL for d, or lifts its ban if d is zero.
+// It returns false for proxies that are not configured.
+func (p *upstreamPolicy) ban(proxyURL string, d time.Duration) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	state, ok := p.state[proxyURL]
+	if !ok {
+		return false
+	}
+	state.bannedUntil = time.Time{}
+	state.bannedBy = ""
+	if d > 0 {
+		state.bannedUntil = p.now().Add(d)
+		state.bannedBy = "admin"
+	}
+	state.failures = 0
+	return true
+}
+
+// adminProxy describes an upstream proxy in the admin API.
+type adminProxy struct {
+	URL         string     `json:"url"`
+	Banned      bool       `json:"banned"`
+	BannedUntil *time.Time `json:"banned_until,omitempty"`
+	BannedBy    string     `json:"banned_by,omitempty"`
+	Failures    int        `json:"consecutive_failures"`
+	Successes   int64      `json:"successes"`
+	Errors      int64      `json:"errors"`
+	LastError   string     `json:"last_error,omitempty"`
+}
+
+// list describes the configured proxies, sorted by URL.
+func (p *upstreamPolicy) list() []adminProxy {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := p.now()
+	proxies := make([]adminProxy, 0, len(p.state))
+	for proxyURL, state := range p.state {
+		proxy := adminProxy{
+			URL:       proxyURL,
+			Failures:  state.failures,
+			Successes: state.successes,
+			Errors:    state.errors,
+			LastError: state.lastError,
+		}
+		if now.Before(state.bannedUntil) {
+			until := state.bannedUntil
+			proxy.Banned, proxy.BannedUntil, proxy.BannedBy = true, &until, state.bannedBy
+		}
+		proxies = append(proxies, proxy)
+	}
+	sort.Slice(proxies, func(i, j int) bool { return proxies[i].URL < proxies[j].URL })
+	return proxies
+}
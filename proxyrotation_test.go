@@ -0,0 +1,113 @@
+package flareproxy
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func newTestUpstreamPolicy(t *testing.T, strategy string) (*upstreamPolicy, *time.Time) {
+	t.Helper()
+	t.Setenv("UPSTREAM_PROXIES", "http://a.proxy:1,http://b.proxy:1,http://c.proxy:1")
+	t.Setenv("UPSTREAM_PROXY_STRATEGY", strategy)
+	t.Setenv("UPSTREAM_PROXY_MAX_FAILURES", "2")
+	t.Setenv("UPSTREAM_PROXY_COOLDOWN", "1m")
+	p := newUpstreamPolicyFromEnv()
+	now := time.Now()
+	p.now = func() time.Time { return now }
+	return p, &now
+}
+
+func pickProxies(t *testing.T, p *upstreamPolicy, urls ...string) []string {
+	t.Helper()
+	var picked []string
+	for _, u := range urls {
+		proxy, err := p.forURL(u)
+		if err != nil {
+			t.Fatalf("forURL(%q) error = %v", u, err)
+		}
+		picked = append(picked, proxy.URL)
+	}
+	return picked
+}
+
+func TestProxyStrategies(t *testing.T) {
+	t.Run("round-robin skips banned proxies", func(t *testing.T) {
+		p, _ := newTestUpstreamPolicy(t, ProxyStrategyRoundRobin)
+		p.ban("http://b.proxy:1", time.Minute)
+		got := pickProxies(t, p, "https://x.example/", "https://x.example/", "https://x.example/")
+		want := []string{"http://a.proxy:1", "http://c.proxy:1", "http://a.proxy:1"}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Fatalf("picked %v, want %v", got, want)
+			}
+		}
+	})
+
+	t.Run("sticky keeps hosts on one proxy", func(t *testing.T) {
+		p, _ := newTestUpstreamPolicy(t, ProxyStrategySticky)
+		first := pickProxies(t, p, "https://x.example/a")[0]
+		for _, got := range pickProxies(t, p, "https://x.example/b", "https://X.example/c") {
+			if got != first {
+				t.Fatalf("x.example moved from %s to %s", first, got)
+			}
+		}
+		p.ban(first, time.Minute)
+		moved := pickProxies(t, p, "https://x.example/d")[0]
+		if moved == first {
+			t.Fatalf("x.example stayed on banned %s", first)
+		}
+		p.ban(first, 0)
+		if back := pickProxies(t, p, "https://x.example/e")[0]; back != first {
+			t.Errorf("x.example on %s after the ban was lifted, want %s", back, first)
+		}
+	})
+
+	t.Run("random picks available proxies", func(t *testing.T) {
+		p, _ := newTestUpstreamPolicy(t, ProxyStrategyRandom)
+		p.ban("http://a.proxy:1", time.Minute)
+		for _, got := range pickProxies(t, p, "https://x.example/", "https://x.example/", "https://x.example/", "https://x.example/") {
+			if got == "http://a.proxy:1" {
+				t.Fatal("picked banned proxy")
+			}
+		}
+	})
+
+	t.Run("failure-aware prefers healthy proxies", func(t *testing.T) {
+		p, _ := newTestUpstreamPolicy(t, ProxyStrategyFailureAware)
+		p.record(&FlareSolverrProxy{URL: "http://a.proxy:1"}, nil, &SolverError{Message: "proxy refused"})
+		for _, got := range pickProxies(t, p, "https://x.example/", "https://x.example/", "https://x.example/") {
+			if got == "http://a.proxy:1" {
+				t.Fatal("picked the failing proxy over healthy ones")
+			}
+		}
+	})
+}
+
+func TestProxyCooldown(t *testing.T) {
+	p, now := newTestUpstreamPolicy(t, ProxyStrategyRoundRobin)
+	blocked := testResponse("<html>blocked</html>")
+	blocked.Solution.Status = 403
+	for _, proxyURL := range []string{"http://a.proxy:1", "http://b.proxy:1", "http://c.proxy:1"} {
+		proxy := &FlareSolverrProxy{URL: proxyURL}
+		p.record(proxy, blocked, nil)
+		// Errors unrelated to the proxy do not count
+		p.record(proxy, nil, errors.New("client went away"))
+		p.record(proxy, nil, &SolverError{Message: "timeout"})
+	}
+
+	var bannedErr *ProxiesBannedError
+	if _, err := p.forURL("https://x.example/"); !errors.As(err, &bannedErr) || bannedErr.RetryAfter != time.Minute {
+		t.Fatalf("forURL() error = %v, want all proxies banned for a minute", err)
+	}
+	for _, proxy := range p.list() {
+		if !proxy.Banned || proxy.BannedBy != "failures" || proxy.Errors != 2 || proxy.LastError == "" {
+			t.Errorf("proxy state = %+v", proxy)
+		}
+	}
+
+	*now = now.Add(time.Minute)
+	if proxy, err := p.forURL("https://x.example/"); err != nil || proxy == nil {
+		t.Errorf("forURL() after the cooldown = %v, %v", proxy, err)
+	}
+}
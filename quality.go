@@ -0,0 +1,229 @@
+package flareproxy
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// QualityHeader carries the quality score of a solved page, from 0 to 1.
+const QualityHeader = "X-FlareProxy-Quality"
+
+// qualityPolicy scores solved pages to catch solves that succeed on paper
+// but return a challenge or an empty shell page: a page that still shows
+// challenge markers, or lacks the selector expected for its domain, scores
+// 0; one with less visible text than the minimum scores in proportion.
+// Pages scoring below the threshold are solved again and not cached.
+type qualityPolicy struct {
+	threshold  float64
+	maxRetries int
+	minText    int
+	selectors  map[string]selector // by domain
+}
+
+// newQualityPolicyFromEnv reads QUALITY_THRESHOLD, QUALITY_MAX_RETRIES,
+// QUALITY_MIN_TEXT and QUALITY_SELECTORS.
+func newQualityPolicyFromEnv() *qualityPolicy {
+	p := &qualityPolicy{
+		threshold:  envFloat("QUALITY_THRESHOLD", 0),
+		maxRetries: envInt("QUALITY_MAX_RETRIES", 1),
+		minText:    envInt("QUALITY_MIN_TEXT", 200),
+		selectors:  make(map[string]selector),
+	}
+	for _, entry := range splitList(os.Getenv("QUALITY_SELECTORS")) {
+		domain, raw, ok := strings.Cut(entry, "=")
+		sel, err := parseSelector(strings.TrimSpace(raw))
+		if !ok || err != nil {
+			slog.Warn("ignoring invalid QUALITY_SELECTORS entry", "entry", entry)
+			continue
+		}
+		p.selectors[strings.ToLower(strings.TrimSpace(domain))] = sel
+	}
+	return p
+}
+
+// poor reports whether a score is below the threshold.
+func (p *qualityPolicy) poor(score float64) bool {
+	return score < p.threshold
+}
+
+// selectorFor returns the selector expected on pages of targetURL's host
+// or its parent domains.
+func (p *qualityPolicy) selectorFor(targetURL string) (selector, bool) {
+	u, err := url.Parse(targetURL)
+	if err != nil {
+		return selector{}, false
+	}
+	host := strings.ToLower(u.Hostname())
+	for host != "" {
+		if sel, ok := p.selectors[host]; ok {
+			return sel, true
+		}
+		_, host, _ = strings.Cut(host, ".")
+	}
+	return selector{}, false
+}
+
+// score rates a solution from 0 to 1. Only HTML pages are scored; other
+// content scores 1.
+func (p *qualityPolicy) score(targetURL string, flareResponse *FlareSolverrResponse) float64 {
+	if solutionContentType(flareResponse) != contentTypeHTML {
+		return 1
+	}
+	body := flareResponse.Solution.Response
+	for _, marker := range challengeMarkers {
+		if strings.Contains(body, string(marker)) {
+			return 0
+		}
+	}
+	sel, hasSelector := p.selectorFor(targetURL)
+	text, found := scanHTML(body, sel)
+	if hasSelector && !found {
+		return 0
+	}
+	if p.minText > 0 && text < p.minText {
+		return float64(text) / float64(p.minText)
+	}
+	return 1
+}
+
+// formatQuality formats a score for the QualityHeader.
+func formatQuality(score float64) string {
+	return strconv.FormatFloat(score, 'f', 2, 64)
+}
+
+// scanHTML returns the length of the visible text of an HTML page,
+// leaving out scripts, styles and whitespace, and whether an element
+// matching sel is present.
+func scanHTML(body string, sel selector) (text int, found bool) {
+	d := xml.NewDecoder(strings.NewReader(body))
+	d.Strict = false
+	d.AutoClose = xml.HTMLAutoClose
+	d.Entity = xml.HTMLEntity
+	hidden := 0
+	for {
+		token, err := d.Token()
+		if err != nil {
+			return text, found
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			name := strings.ToLower(t.Name.Local)
+			if name == "script" || name == "style" || name == "noscript" || name == "template" {
+				hidden++
+			}
+			if !found && !sel.empty() && sel.matches(name, t.Attr) {
+				found = true
+			}
+		case xml.EndElement:
+			switch strings.ToLower(t.Name.Local) {
+			case "script", "style", "noscript", "template":
+				if hidden > 0 {
+					hidden--
+				}
+			}
+		case xml.CharData:
+			if hidden == 0 {
+				text += len(strings.Join(strings.Fields(string(t)), " "))
+			}
+		}
+	}
+}
+
+// selector is a simple CSS selector: an optional tag name followed by any
+// number of #id, .class, [attribute] and [attribute=value] parts, e.g.
+// "div.product#main" or "[data-loaded=true]". Combinators are not
+// supported.
+type selector struct {
+	tag     string
+	id      string
+	classes []string
+	attrs   [][2]string // name and value; a "*" value matches any
+}
+
+// parseSelector parses a simple CSS selector.
+func parseSelector(s string) (selector, error) {
+	var sel selector
+	invalid := fmt.Errorf("invalid selector %q", s)
+	if s == "" {
+		return sel, invalid
+	}
+	i := strings.IndexAny(s, "#.[")
+	if i < 0 {
+		i = len(s)
+	}
+	sel.tag = strings.ToLower(s[:i])
+	s = s[i:]
+	for s != "" {
+		switch s[0] {
+		case '[':
+			end := strings.IndexByte(s, ']')
+			if end < 0 {
+				return sel, invalid
+			}
+			name, value, ok := strings.Cut(s[1:end], "=")
+			if !ok {
+				value = "*"
+			}
+			sel.attrs = append(sel.attrs, [2]string{strings.ToLower(strings.TrimSpace(name)), strings.Trim(strings.TrimSpace(value), `"'`)})
+			s = s[end+1:]
+		case '#', '.':
+			end := strings.IndexAny(s[1:], "#.[") + 1
+			if end == 0 {
+				end = len(s)
+			}
+			if end == 1 {
+				return sel, invalid
+			}
+			if s[0] == '#' {
+				sel.id = s[1:end]
+			} else {
+				sel.classes = append(sel.classes, s[1:end])
+			}
+			s = s[end:]
+		default:
+			return sel, invalid
+		}
+	}
+	if strings.ContainsAny(sel.tag, " >+~*") {
+		return sel, invalid
+	}
+	return sel, nil
+}
+
+func (sel selector) empty() bool {
+	return sel.tag == "" && sel.id == "" && len(sel.classes) == 0 && len(sel.attrs) == 0
+}
+
+// matches reports whether an element with the given name and attributes
+// matches sel.
+func (sel selector) matches(name string, attrs []xml.Attr) bool {
+	if sel.tag != "" && sel.tag != name {
+		return false
+	}
+	values := make(map[string]string, len(attrs))
+	for _, attr := range attrs {
+		values[strings.ToLower(attr.Name.Local)] = attr.Value
+	}
+	if sel.id != "" && values["id"] != sel.id {
+		return false
+	}
+	classes := strings.Fields(values["class"])
+	for _, class := range sel.classes {
+		if !slices.Contains(classes, class) {
+			return false
+		}
+	}
+	for _, attr := range sel.attrs {
+		value, ok := values[attr[0]]
+		if !ok || (attr[1] != "*" && value != attr[1]) {
+			return false
+		}
+	}
+	return true
+}
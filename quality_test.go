@@ -0,0 +1,114 @@
+package flareproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestQualityScore(t *testing.T) {
+	t.Setenv("QUALITY_MIN_TEXT", "100")
+	t.Setenv("QUALITY_SELECTORS", "shop.example=div.product[data-id], news.example=#story")
+	p := newQualityPolicyFromEnv()
+	text := strings.Repeat("word ", 30)
+
+	tests := []struct {
+		name string
+		url  string
+		body string
+		want float64
+	}{
+		{name: "full page", url: "https://example.com/", body: "<html><body><p>" + text + "</p></body></html>", want: 1},
+		{name: "empty shell", url: "https://example.com/", body: `<html><head><script src="/app.js"></script></head><body><div id="root"></div></body></html>`, want: 0},
+		{name: "short page", url: "https://example.com/", body: "<html><body>" + strings.Repeat("x", 50) + "</body></html>", want: 0.5},
+		{name: "scripts are not text", url: "https://example.com/", body: "<html><script>var x = '" + text + "';</script><style>" + text + "</style></html>", want: 0},
+		{name: "challenge", url: "https://example.com/", body: `<html><body>` + text + `<script src="/cdn-cgi/challenge-platform/h/b/orchestrate/jsch/v1"></script></body></html>`, want: 0},
+		{name: "selector present", url: "https://www.shop.example/item", body: `<html><body><div class="card product" data-id="7">` + text + `</div></body></html>`, want: 1},
+		{name: "selector missing", url: "https://shop.example/item", body: `<html><body><div class="product">` + text + `</div></body></html>`, want: 0},
+		{name: "id selector", url: "https://news.example/", body: `<html><body><article id="story">` + text + `</article></body></html>`, want: 1},
+		{name: "json is not scored", url: "https://example.com/api", body: `{}`, want: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := p.score(tt.url, testResponse(tt.body)); got != tt.want {
+				t.Errorf("score() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSelector(t *testing.T) {
+	tests := []struct {
+		in   string
+		want selector
+	}{
+		{in: "div", want: selector{tag: "div"}},
+		{in: "#main", want: selector{id: "main"}},
+		{in: "DIV.a.b#c", want: selector{tag: "div", id: "c", classes: []string{"a", "b"}}},
+		{in: `[data-ready="true"][hidden]`, want: selector{attrs: [][2]string{{"data-ready", "true"}, {"hidden", "*"}}}},
+	}
+	for _, tt := range tests {
+		got, err := parseSelector(tt.in)
+		if err != nil || got.tag != tt.want.tag || got.id != tt.want.id ||
+			strings.Join(got.classes, ",") != strings.Join(tt.want.classes, ",") || len(got.attrs) != len(tt.want.attrs) {
+			t.Errorf("parseSelector(%q) = %+v, %v, want %+v", tt.in, got, err, tt.want)
+		}
+	}
+	for _, invalid := range []string{"", "div p", "div > p", ".", "[x", "*"} {
+		if _, err := parseSelector(invalid); err == nil {
+			t.Errorf("parseSelector(%q) accepted", invalid)
+		}
+	}
+}
+
+func TestQualityRetry(t *testing.T) {
+	good := "<html><body><p>" + strings.Repeat("content ", 40) + "</p></body></html>"
+	var solves atomic.Int32
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req FlareSolverrRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		n := solves.Add(1)
+		body := `<html><body><div id="root"></div></body></html>`
+		if strings.Contains(req.URL, "flaky") && n > 1 {
+			body = good
+		}
+		json.NewEncoder(w).Encode(testResponse(body))
+	}))
+	defer mockServer.Close()
+	t.Setenv("FLARESOLVERR_URL", mockServer.URL)
+	t.Setenv("QUALITY_THRESHOLD", "0.5")
+	t.Setenv("QUALITY_MAX_RETRIES", "2")
+	t.Setenv("CACHE_TTL", "1m")
+
+	tests := []struct {
+		name        string
+		path        string
+		wantQuality string
+		wantSolves  int32
+	}{
+		{name: "solved again", path: "/flaky.example/", wantQuality: "1.00", wantSolves: 2},
+		{name: "gives up after the retries", path: "/shell.example/", wantQuality: "0.00", wantSolves: 3},
+		// Poor pages are not cached
+		{name: "not cached", path: "/shell.example/", wantQuality: "0.00", wantSolves: 3},
+	}
+	handler := NewDirectHandler()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			solves.Store(0)
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, httptest.NewRequest("GET", tt.path, nil))
+			if rr.Code != http.StatusOK {
+				t.Fatalf("status = %d", rr.Code)
+			}
+			if got := rr.Header().Get(QualityHeader); got != tt.wantQuality {
+				t.Errorf("%s = %q, want %q", QualityHeader, got, tt.wantQuality)
+			}
+			if got := solves.Load(); got != tt.wantSolves {
+				t.Errorf("solved %d times, want %d", got, tt.wantSolves)
+			}
+		})
+	}
+}
@@ -0,0 +1,325 @@
+package flareproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimitError is returned when a request to a domain would have to wait
+// longer than allowed for the domain's rate limit.
+type RateLimitError struct {
+	Domain     string
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("rate limit exceeded for %s, retry in %s", e.Domain, e.RetryAfter.Round(time.Second))
+}
+
+// RateLimit is a sustained request rate per second and the burst allowed
+// on top of it. A zero rate means no limit.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+type tokenBucket struct {
+	limit  RateLimit
+	tokens float64
+	last   time.Time
+}
+
+// domainLimiter is a token bucket rate limiter keyed by target domain, so
+// that origins are not hammered and sessions do not get banned. Requests
+// over the limit wait for a token, unless the wait would exceed maxWait.
+type domainLimiter struct {
+	defaultLimit RateLimit
+	domains      map[string]RateLimit
+	maxWait      time.Duration
+	now          func() time.Time
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// RateLimitOptions configures the per-domain rate limits of a Server.
+type RateLimitOptions struct {
+	// Default applies to every domain without its own limit.
+	Default RateLimit
+	// Domains are the limits of domains and their subdomains.
+	Domains map[string]RateLimit
+	// MaxWait is the longest a request waits for its turn before it is
+	// refused with a RateLimitError.
+	MaxWait time.Duration
+}
+
+// RateLimitOptionsFromEnv reads the RateLimitOptions from RATE_LIMIT,
+// RATE_LIMIT_BURST, RATE_LIMIT_MAX_WAIT and RATE_LIMIT_DOMAINS (e.g.
+// "example.com=0.5,other.org=2:5" for rate[:burst] per domain).
+func RateLimitOptionsFromEnv() RateLimitOptions {
+	domains := make(map[string]RateLimit)
+	for _, rule := range splitList(os.Getenv("RATE_LIMIT_DOMAINS")) {
+		domain, spec, ok := strings.Cut(rule, "=")
+		limit, err := parseRateLimit(spec)
+		if !ok || err != nil {
+			slog.Warn("ignoring invalid RATE_LIMIT_DOMAINS rule", "rule", rule)
+			continue
+		}
+		domains[strings.TrimSpace(domain)] = limit
+	}
+	return RateLimitOptions{
+		Default: RateLimit{Rate: envFloat("RATE_LIMIT", 0), Burst: envInt("RATE_LIMIT_BURST", 0)},
+		Domains: domains,
+		MaxWait: envDuration("RATE_LIMIT_MAX_WAIT", 30*time.Second),
+	}
+}
+
+// newDomainLimiterFromEnv builds the limiter from the environment, see
+// RateLimitOptionsFromEnv.
+func newDomainLimiterFromEnv() *domainLimiter {
+	return newDomainLimiterFor(RateLimitOptionsFromEnv())
+}
+
+// newDomainLimiterFor builds the limiter of opts.
+func newDomainLimiterFor(opts RateLimitOptions) *domainLimiter {
+	domains := make(map[string]RateLimit, len(opts.Domains))
+	for domain, limit := range opts.Domains {
+		domains[strings.ToLower(domain)] = limit
+	}
+	return newDomainLimiter(opts.Default, domains, opts.MaxWait)
+}
+
+// parseRateLimit parses "rate" or "rate:burst".
+func parseRateLimit(spec string) (RateLimit, error) {
+	rate, burst, hasBurst := strings.Cut(strings.TrimSpace(spec), ":")
+	var limit RateLimit
+	var err error
+	if limit.Rate, err = strconv.ParseFloat(rate, 64); err != nil || limit.Rate < 0 {
+		return limit, fmt.Errorf("invalid rate %q", rate)
+	}
+	if hasBurst {
+		if limit.Burst, err = strconv.Atoi(burst); err != nil || limit.Burst < 0 {
+			return limit, fmt.Errorf("invalid burst %q", burst)
+		}
+	}
+	return limit, nil
+}
+
+func newDomainLimiter(defaultLimit RateLimit, domains map[string]RateLimit, maxWait time.Duration) *domainLimiter {
+	return &domainLimiter{
+		defaultLimit: defaultLimit,
+		domains:      domains,
+		maxWait:      maxWait,
+		now:          time.Now,
+		buckets:      make(map[string]*tokenBucket),
+	}
+}
+
+// limitFor returns the limit for host and the key of the bucket it draws
+// from. Rules match the domain itself and any of its subdomains, with the
+// most specific rule winning; subdomains matched by a rule share its
+// bucket. The caller must hold l.mu.
+func (l *domainLimiter) limitFor(host string) (RateLimit, string) {
+	host = strings.ToLower(host)
+	for domain := host; ; {
+		if limit, ok := l.domains[domain]; ok {
+			return limit, domain
+		}
+		_, parent, ok := strings.Cut(domain, ".")
+		if !ok {
+			return l.defaultLimit, host
+		}
+		domain = parent
+	}
+}
+
+// bucketFor is limitFor for callers not holding l.mu.
+func (l *domainLimiter) bucketFor(host string) (RateLimit, string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limitFor(host)
+}
+
+// reserve takes a token for host. It returns how long the caller must
+// wait before the token is valid, and false if that exceeds maxWait, in
+// which case no token is taken.
+func (l *domainLimiter) reserve(host string) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	limit, key := l.limitFor(host)
+	if limit.Rate <= 0 {
+		return 0, true
+	}
+	burst := float64(limit.Burst)
+	if burst < 1 {
+		burst = math.Max(1, math.Ceil(limit.Rate))
+	}
+
+	now := l.now()
+	b, ok := l.buckets[key]
+	if !ok || b.limit != limit {
+		b = &tokenBucket{limit: limit, tokens: burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	b.last = now
+
+	// Tokens may go negative: each waiting request holds a reservation
+	b.tokens--
+	var wait time.Duration
+	if b.tokens < 0 {
+		wait = time.Duration(-b.tokens / limit.Rate * float64(time.Second))
+	}
+	if wait > l.maxWait {
+		b.tokens++
+		return wait, false
+	}
+	return wait, true
+}
+
+// cancel returns a reserved token for host that was not used.
+func (l *domainLimiter) cancel(host string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, key := l.limitFor(host)
+	if b, ok := l.buckets[key]; ok {
+		b.tokens++
+	}
+}
+
+// replace adopts the limits of fresh, e.g. after the configuration was
+// reloaded. Buckets are kept, so budgets already used up stay used up;
+// those whose limit changed start over on their next use.
+func (l *domainLimiter) replace(fresh *domainLimiter) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.defaultLimit = fresh.defaultLimit
+	l.domains = fresh.domains
+	l.maxWait = fresh.maxWait
+}
+
+// wait blocks until a request to targetURL is allowed.
+func (l *domainLimiter) wait(ctx context.Context, targetURL string) error {
+	u, err := url.Parse(targetURL)
+	if err != nil || u.Hostname() == "" {
+		return nil
+	}
+	host := u.Hostname()
+	delay, ok := l.reserve(host)
+	if !ok {
+		if delay < time.Second {
+			delay = time.Second
+		}
+		return &RateLimitError{Domain: host, RetryAfter: delay}
+	}
+	if delay <= 0 {
+		return nil
+	}
+	loggerFrom(ctx).Debug("rate limited, waiting", "domain", host, "delay_ms", delay.Milliseconds())
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		l.cancel(host)
+		return ctx.Err()
+	}
+}
+
+// rateLimitState is the persisted form of the limiter's buckets, so that
+// a restart does not hand every domain a fresh burst.
+type rateLimitState struct {
+	Buckets map[string]bucketState `json:"buckets"`
+}
+
+type bucketState struct {
+	Rate   float64   `json:"rate"`
+	Burst  int       `json:"burst"`
+	Tokens float64   `json:"tokens"`
+	Last   time.Time `json:"last"`
+}
+
+// save writes the state of all buckets to path.
+func (l *domainLimiter) save(path string) error {
+	data, err := json.Marshal(l.state())
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// load restores buckets saved by save. Buckets whose limit has changed
+// since are reset on their next use. A missing file is not an error.
+func (l *domainLimiter) load(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var state rateLimitState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	l.restore(state)
+	return nil
+}
+
+// state returns the state of all buckets.
+func (l *domainLimiter) state() rateLimitState {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	state := rateLimitState{Buckets: make(map[string]bucketState, len(l.buckets))}
+	for key, b := range l.buckets {
+		state.Buckets[key] = bucketState{Rate: b.limit.Rate, Burst: b.limit.Burst, Tokens: b.tokens, Last: b.last}
+	}
+	return state
+}
+
+// restore replaces the buckets in state.
+func (l *domainLimiter) restore(state rateLimitState) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, b := range state.Buckets {
+		l.buckets[key] = &tokenBucket{
+			limit:  RateLimit{Rate: b.Rate, Burst: b.Burst},
+			tokens: b.Tokens,
+			last:   b.Last,
+		}
+	}
+}
+
+// persist saves the limiter to path every interval until ctx is done,
+// saving one last time on the way out.
+func (l *domainLimiter) persist(ctx context.Context, path string, interval time.Duration) {
+	if path == "" || interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if err := l.save(path); err != nil {
+				slog.Warn("failed to save rate limiter state", "path", path, "error", err)
+			}
+			return
+		case <-ticker.C:
+			if err := l.save(path); err != nil {
+				slog.Warn("failed to save rate limiter state", "path", path, "error", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package flareproxy
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    RateLimit
+		wantErr bool
+	}{
+		{spec: "2", want: RateLimit{Rate: 2}},
+		{spec: "0.5:3", want: RateLimit{Rate: 0.5, Burst: 3}},
+		{spec: "fast", wantErr: true},
+		{spec: "1:x", wantErr: true},
+		{spec: "-1", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseRateLimit(tt.spec)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseRateLimit(%q) error = %v, wantErr %v", tt.spec, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && got != tt.want {
+			t.Errorf("parseRateLimit(%q) = %+v, want %+v", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestDomainLimiter(t *testing.T) {
+	now := time.Now()
+	l := newDomainLimiter(RateLimit{Rate: 1, Burst: 2}, map[string]RateLimit{
+		"slow.test": {Rate: 0.1},
+		"free.test": {},
+	}, 5*time.Second)
+	l.now = func() time.Time { return now }
+
+	// The burst is available immediately, then requests wait for tokens
+	for i, want := range []time.Duration{0, 0, time.Second, 2 * time.Second} {
+		if wait, ok := l.reserve("a.test"); !ok || wait != want {
+			t.Errorf("reserve #%d = %s, %v, want %s", i, wait, ok, want)
+		}
+	}
+	// Other domains have their own buckets
+	if wait, _ := l.reserve("b.test"); wait != 0 {
+		t.Errorf("reserve(b.test) = %s, want no wait", wait)
+	}
+	// Tokens refill over time
+	now = now.Add(10 * time.Second)
+	if wait, _ := l.reserve("a.test"); wait != 0 {
+		t.Errorf("reserve after refill = %s, want no wait", wait)
+	}
+
+	// Overrides apply to subdomains, which share the rule's bucket
+	if wait, ok := l.reserve("www.slow.test"); !ok || wait != 0 {
+		t.Errorf("first reserve(www.slow.test) = %s, %v", wait, ok)
+	}
+	if wait, ok := l.reserve("slow.test"); ok || wait != 10*time.Second {
+		t.Errorf("reserve(slow.test) = %s, %v, want a 10s wait to be refused", wait, ok)
+	}
+	for i := 0; i < 10; i++ {
+		if _, ok := l.reserve("free.test"); !ok {
+			t.Fatal("a zero rate should not limit")
+		}
+	}
+}
+
+func TestDomainLimiterWait(t *testing.T) {
+	l := newDomainLimiter(RateLimit{Rate: 0.01}, nil, time.Second)
+	ctx := context.Background()
+	if err := l.wait(ctx, "https://example.com/"); err != nil {
+		t.Fatalf("first wait() error = %v", err)
+	}
+	var rateErr *RateLimitError
+	if err := l.wait(ctx, "https://example.com/other"); !errors.As(err, &rateErr) || rateErr.Domain != "example.com" {
+		t.Fatalf("wait() error = %v, want *RateLimitError", err)
+	}
+
+	// A cancelled wait returns its token
+	l = newDomainLimiter(RateLimit{Rate: 1}, nil, time.Minute)
+	l.wait(ctx, "https://example.com/")
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := l.wait(cancelled, "https://example.com/"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("wait() error = %v, want context.Canceled", err)
+	}
+	if wait, _ := l.reserve("example.com"); wait > time.Second {
+		t.Errorf("reserve after cancelled wait = %s, want at most 1s", wait)
+	}
+}
+
+func TestDomainLimiterPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ratelimit.json")
+	now := time.Now()
+	limit := RateLimit{Rate: 0.1, Burst: 2}
+	l := newDomainLimiter(limit, nil, time.Minute)
+	l.now = func() time.Time { return now }
+	l.reserve("example.com")
+	l.reserve("example.com")
+	if err := l.save(path); err != nil {
+		t.Fatalf("save() error = %v", err)
+	}
+
+	// After a restart the burst is still used up
+	restored := newDomainLimiter(limit, nil, time.Minute)
+	restored.now = func() time.Time { return now }
+	if err := restored.load(path); err != nil {
+		t.Fatalf("load() error = %v", err)
+	}
+	if wait, _ := restored.reserve("example.com"); wait != 10*time.Second {
+		t.Errorf("reserve() after restore = %s, want 10s", wait)
+	}
+
+	// A changed limit starts from a full bucket
+	changed := newDomainLimiter(RateLimit{Rate: 1, Burst: 2}, nil, time.Minute)
+	changed.now = func() time.Time { return now }
+	changed.load(path)
+	if wait, _ := changed.reserve("example.com"); wait != 0 {
+		t.Errorf("reserve() with changed limit = %s, want no wait", wait)
+	}
+
+	if err := newDomainLimiter(limit, nil, time.Minute).load(filepath.Join(t.TempDir(), "missing.json")); err != nil {
+		t.Errorf("load() of missing file error = %v", err)
+	}
+}
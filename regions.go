@@ -0,0 +1,227 @@
+package flareproxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// regionGeoIP routes a domain to the region its servers are located in,
+// according to the GeoIP database.
+const regionGeoIP = "geoip"
+
+// geoIPCacheTTL is how long the region of a target host is remembered.
+const geoIPCacheTTL = 10 * time.Minute
+
+// backendRegionsFromEnv reads BACKEND_REGIONS, the exit regions of the
+// backends, e.g. "http://fs-eu:8191/v1=eu,http://fs-us:8191/v1=us".
+func backendRegionsFromEnv() map[string]string {
+	regions := make(map[string]string)
+	for _, rule := range splitList(os.Getenv("BACKEND_REGIONS")) {
+		i := strings.LastIndex(rule, "=")
+		if i <= 0 || strings.TrimSpace(rule[i+1:]) == "" {
+			slog.Warn("ignoring invalid BACKEND_REGIONS rule", "rule", rule)
+			continue
+		}
+		regions[strings.TrimSpace(rule[:i])] = strings.ToLower(strings.TrimSpace(rule[i+1:]))
+	}
+	return regions
+}
+
+// resolvedRegion is the cached region of a target host.
+type resolvedRegion struct {
+	region  string
+	expires time.Time
+}
+
+// regionRouter picks the exit region requests for configured domains are
+// sent from, since some Cloudflare configurations behave very differently
+// by region. A domain is routed to a fixed region, or with "geoip" to the
+// region its servers are in.
+type regionRouter struct {
+	domains map[string]string
+	geoIP   *geoIPDB // nil unless GEOIP_DB is set
+	lookup  func(ctx context.Context, host string) ([]netip.Addr, error)
+	now     func() time.Time
+
+	mu       sync.Mutex
+	resolved map[string]resolvedRegion
+}
+
+// newRegionRouterFromEnv reads REGION_ROUTES, e.g.
+// "example.com=eu,shop.example.org=geoip", and GEOIP_DB. It returns nil if
+// no domain is routed.
+func newRegionRouterFromEnv() *regionRouter {
+	domains := make(map[string]string)
+	for _, rule := range splitList(os.Getenv("REGION_ROUTES")) {
+		domain, region, ok := strings.Cut(rule, "=")
+		domain, region = strings.ToLower(strings.TrimSpace(domain)), strings.ToLower(strings.TrimSpace(region))
+		if !ok || domain == "" || region == "" {
+			slog.Warn("ignoring invalid REGION_ROUTES rule", "rule", rule)
+			continue
+		}
+		domains[domain] = region
+	}
+	if len(domains) == 0 {
+		return nil
+	}
+	resolver := newResolver()
+	r := &regionRouter{
+		domains: domains,
+		lookup: func(ctx context.Context, host string) ([]netip.Addr, error) {
+			return resolver.LookupNetIP(ctx, "ip", host)
+		},
+		now:      time.Now,
+		resolved: make(map[string]resolvedRegion),
+	}
+	if path := os.Getenv("GEOIP_DB"); path != "" {
+		db, err := loadGeoIPDB(path)
+		if err != nil {
+			slog.Error("failed to load GEOIP_DB, geoip routes disabled", "path", path, "error", err)
+		} else {
+			r.geoIP = db
+		}
+	}
+	return r
+}
+
+// regionFor returns the region requests for targetURL should exit from,
+// or "" if any backend will do.
+func (r *regionRouter) regionFor(ctx context.Context, targetURL string) string {
+	if r == nil {
+		return ""
+	}
+	u, err := url.Parse(targetURL)
+	if err != nil || u.Hostname() == "" {
+		return ""
+	}
+	host := strings.ToLower(u.Hostname())
+	for domain := host; ; {
+		if region, ok := r.domains[domain]; ok {
+			if region == regionGeoIP {
+				return r.locate(ctx, host)
+			}
+			return region
+		}
+		_, parent, ok := strings.Cut(domain, ".")
+		if !ok {
+			return ""
+		}
+		domain = parent
+	}
+}
+
+// locate returns the region of host's servers according to the GeoIP
+// database, or "" if they are not found in it.
+func (r *regionRouter) locate(ctx context.Context, host string) string {
+	if r.geoIP == nil {
+		return ""
+	}
+	now := r.now()
+	r.mu.Lock()
+	cached, ok := r.resolved[host]
+	r.mu.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.region
+	}
+
+	var addrs []netip.Addr
+	if addr, err := netip.ParseAddr(host); err == nil {
+		addrs = []netip.Addr{addr}
+	} else if addrs, err = r.lookup(ctx, host); err != nil {
+		loggerFrom(ctx).Debug("failed to resolve target for region routing", "host", host, "error", err)
+		return ""
+	}
+	region := ""
+	for _, addr := range addrs {
+		if region = r.geoIP.lookup(addr); region != "" {
+			break
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for h, c := range r.resolved {
+		if !now.Before(c.expires) {
+			delete(r.resolved, h)
+		}
+	}
+	r.resolved[host] = resolvedRegion{region: region, expires: now.Add(geoIPCacheTTL)}
+	return region
+}
+
+// geoIPRange is a block of addresses located in a region.
+type geoIPRange struct {
+	first, last netip.Addr
+	region      string
+}
+
+// geoIPDB maps addresses to regions.
+type geoIPDB struct {
+	ranges []geoIPRange // sorted by first address, not overlapping
+}
+
+// loadGeoIPDB reads a CSV file of "network,region" lines, such as
+// "203.0.113.0/24,eu", as exported from GeoIP databases. A header line and
+// further columns are ignored.
+func loadGeoIPDB(path string) (*geoIPDB, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	db := &geoIPDB{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Split(scanner.Text(), ",")
+		if len(fields) < 2 || strings.HasPrefix(strings.TrimSpace(fields[0]), "#") {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(fields[0]))
+		if err != nil {
+			if line == 1 {
+				continue // header
+			}
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		region := strings.ToLower(strings.TrimSpace(fields[1]))
+		if region == "" {
+			continue
+		}
+		db.ranges = append(db.ranges, geoIPRange{first: prefix.Masked().Addr(), last: lastAddr(prefix), region: region})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(db.ranges, func(i, j int) bool { return db.ranges[i].first.Less(db.ranges[j].first) })
+	return db, nil
+}
+
+// lastAddr returns the last address in prefix.
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	b := prefix.Masked().Addr().AsSlice()
+	for bit := prefix.Bits(); bit < len(b)*8; bit++ {
+		b[bit/8] |= 0x80 >> (bit % 8)
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
+}
+
+// lookup returns the region of addr, or "" if it is not in the database.
+func (db *geoIPDB) lookup(addr netip.Addr) string {
+	addr = addr.Unmap()
+	// The last range starting at or before addr is the only one that may
+	// contain it
+	i := sort.Search(len(db.ranges), func(i int) bool { return addr.Less(db.ranges[i].first) }) - 1
+	if i < 0 || db.ranges[i].last.Less(addr) || db.ranges[i].first.BitLen() != addr.BitLen() {
+		return ""
+	}
+	return db.ranges[i].region
+}
@@ -0,0 +1,145 @@
+package flareproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeGeoIPDB(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "geoip.csv")
+	db := "network,region\n" +
+		"203.0.113.0/24,EU\n" +
+		"198.51.100.128/25,us\n" +
+		"2001:db8::/32,apac\n" +
+		"# comment,ignored\n"
+	if err := os.WriteFile(path, []byte(db), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestGeoIPDB(t *testing.T) {
+	db, err := loadGeoIPDB(writeGeoIPDB(t))
+	if err != nil {
+		t.Fatalf("loadGeoIPDB() error = %v", err)
+	}
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{"203.0.113.0", "eu"},
+		{"203.0.113.255", "eu"},
+		{"203.0.114.0", ""},
+		{"198.51.100.127", ""},
+		{"198.51.100.200", "us"},
+		{"::ffff:198.51.100.200", "us"},
+		{"2001:db8:1::1", "apac"},
+		{"2001:db9::1", ""},
+		{"10.0.0.1", ""},
+	}
+	for _, tt := range tests {
+		if got := db.lookup(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("lookup(%s) = %q, want %q", tt.addr, got, tt.want)
+		}
+	}
+
+	bad := filepath.Join(t.TempDir(), "bad.csv")
+	os.WriteFile(bad, []byte("203.0.113.0/24,eu\nnot-a-network,us\n"), 0o600)
+	if _, err := loadGeoIPDB(bad); err == nil {
+		t.Error("loadGeoIPDB() accepted an invalid network")
+	}
+}
+
+func TestRegionRouter(t *testing.T) {
+	t.Setenv("REGION_ROUTES", "example.com=EU,geo.test=geoip,broken")
+	t.Setenv("GEOIP_DB", writeGeoIPDB(t))
+	r := newRegionRouterFromEnv()
+	lookups := 0
+	r.lookup = func(ctx context.Context, host string) ([]netip.Addr, error) {
+		lookups++
+		switch host {
+		case "us.geo.test":
+			return []netip.Addr{netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("198.51.100.200")}, nil
+		case "eu.geo.test":
+			return []netip.Addr{netip.MustParseAddr("203.0.113.7")}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+	now := time.Now()
+	r.now = func() time.Time { return now }
+
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"https://example.com/", "eu"},
+		{"https://www.example.com/page", "eu"},
+		{"https://example.org/", ""},
+		{"https://us.geo.test/", "us"},
+		{"https://eu.geo.test/", "eu"},
+		{"https://unknown.geo.test/", ""},
+		{"not a url", ""},
+	}
+	for _, tt := range tests {
+		if got := r.regionFor(context.Background(), tt.url); got != tt.want {
+			t.Errorf("regionFor(%s) = %q, want %q", tt.url, got, tt.want)
+		}
+	}
+
+	// Regions of resolved hosts are cached
+	before := lookups
+	r.regionFor(context.Background(), "https://us.geo.test/other")
+	if lookups != before {
+		t.Error("host was resolved again within the cache TTL")
+	}
+	now = now.Add(geoIPCacheTTL)
+	r.regionFor(context.Background(), "https://us.geo.test/other")
+	if lookups != before+1 {
+		t.Error("host was not resolved again after the cache TTL")
+	}
+
+	t.Setenv("REGION_ROUTES", "")
+	var disabled *regionRouter = newRegionRouterFromEnv()
+	if got := disabled.regionFor(context.Background(), "https://example.com/"); got != "" {
+		t.Errorf("regionFor() without routes = %q, want none", got)
+	}
+}
+
+func TestRegionRouting(t *testing.T) {
+	counts := make(map[string]int)
+	newBackend := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			counts[name]++
+			json.NewEncoder(w).Encode(testResponse("<html>" + name + "</html>"))
+		}))
+	}
+	eu, us := newBackend("eu"), newBackend("us")
+	defer eu.Close()
+	defer us.Close()
+	t.Setenv("FLARESOLVERR_URL", eu.URL+","+us.URL)
+	t.Setenv("BACKEND_REGIONS", us.URL+"=us,"+eu.URL+"=eu")
+	t.Setenv("REGION_ROUTES", "example.com=us")
+
+	handler := NewDirectHandler()
+	for i := 0; i < 3; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/example.com/", nil))
+	}
+	if counts["us"] != 3 || counts["eu"] != 0 {
+		t.Errorf("requests by backend = %v, want all on the us backend", counts)
+	}
+	for i := 0; i < 2; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/example.org/", nil))
+	}
+	if counts["eu"] != 1 {
+		t.Errorf("requests by backend = %v, want unrouted domains balanced", counts)
+	}
+}
@@ -0,0 +1,107 @@
+package flareproxy
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// retryPolicy decides whether and when a failed FlareSolverr request is
+// attempted again. Delays grow exponentially from baseDelay up to
+// maxDelay; with jitter enabled each delay is drawn at random from its
+// upper half so that clients retrying together do not stay in lockstep.
+type retryPolicy struct {
+	maxAttempts int
+	baseDelay   time.Duration
+	maxDelay    time.Duration
+	jitter      bool
+	random      func() float64
+}
+
+func newRetryPolicyFromEnv() *retryPolicy {
+	return &retryPolicy{
+		maxAttempts: envInt("RETRY_MAX_ATTEMPTS", 1),
+		baseDelay:   envDuration("RETRY_BASE_DELAY", 500*time.Millisecond),
+		maxDelay:    envDuration("RETRY_MAX_DELAY", 10*time.Second),
+		jitter:      envBool("RETRY_JITTER", true),
+		random:      rand.Float64,
+	}
+}
+
+// delay returns how long to wait before the given retry, counting from 1.
+func (p *retryPolicy) delay(retry int) time.Duration {
+	d := p.baseDelay
+	for i := 1; i < retry && d < p.maxDelay; i++ {
+		d *= 2
+	}
+	if d > p.maxDelay {
+		d = p.maxDelay
+	}
+	if p.jitter {
+		d = d/2 + time.Duration(p.random()*float64(d/2))
+	}
+	return d
+}
+
+// wait sleeps for the delay before the given retry. It returns false if
+// ctx is done first.
+func (p *retryPolicy) wait(ctx context.Context, retry int) bool {
+	timer := time.NewTimer(p.delay(retry))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Substrings of FlareSolverr error messages. Definitive failures such as
+// an invalid URL will fail again no matter how often they are retried,
+// while browser timeouts and navigation errors often succeed on a second
+// try.
+var (
+	definitiveSolverErrors = []string{"invalid", "not valid", "not supported", "unsupported", "missing"}
+	transientSolverErrors  = []string{"timeout", "timed out", "navigat", "net::err_", "connection", "browser", "chrome"}
+)
+
+// isTransient reports whether err is worth retrying.
+func isTransient(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, errAllDraining) || errors.Is(err, errIncompatibleBackends) || errors.Is(err, errBodyTooLarge) {
+		return false
+	}
+	var circuitErr *CircuitOpenError
+	var queueErr *QueueFullError
+	var rateErr *RateLimitError
+	if errors.As(err, &circuitErr) || errors.As(err, &queueErr) || errors.As(err, &rateErr) {
+		return false
+	}
+	var solverErr *SolverError
+	if errors.As(err, &solverErr) {
+		message := strings.ToLower(solverErr.Message)
+		for _, s := range definitiveSolverErrors {
+			if strings.Contains(message, s) {
+				return false
+			}
+		}
+		for _, s := range transientSolverErrors {
+			if strings.Contains(message, s) {
+				return true
+			}
+		}
+		return false
+	}
+	var schemaErr *SchemaError
+	if errors.As(err, &schemaErr) {
+		// A gateway in front of FlareSolverr that is restarting or overloaded
+		switch schemaErr.HTTPStatus {
+		case 502, 503, 504:
+			return true
+		}
+		return false
+	}
+	// Connection errors
+	return true
+}
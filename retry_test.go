@@ -0,0 +1,96 @@
+package flareproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryDelay(t *testing.T) {
+	p := &retryPolicy{baseDelay: 100 * time.Millisecond, maxDelay: time.Second}
+	want := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second}
+	for i, w := range want {
+		if got := p.delay(i + 1); got != w {
+			t.Errorf("delay(%d) = %s, want %s", i+1, got, w)
+		}
+	}
+
+	p.jitter = true
+	p.random = func() float64 { return 0 }
+	if got := p.delay(3); got != 200*time.Millisecond {
+		t.Errorf("delay with minimum jitter = %s, want 200ms", got)
+	}
+	p.random = func() float64 { return 0.999999 }
+	if got := p.delay(3); got < 399*time.Millisecond || got > 400*time.Millisecond {
+		t.Errorf("delay with maximum jitter = %s, want about 400ms", got)
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "connection refused", err: errors.New("Failed to connect to FlareSolverr: connection refused"), want: true},
+		{name: "browser timeout", err: &SolverError{Message: "Error: Error solving the challenge. Timeout after 60.0 seconds."}, want: true},
+		{name: "navigation failure", err: &SolverError{Message: "Error: net::ERR_CONNECTION_RESET"}, want: true},
+		{name: "invalid url", err: &SolverError{Message: "Request parameter 'url' is invalid"}, want: false},
+		{name: "unknown solver error", err: &SolverError{Message: "Captcha detected but no automatic solver is configured."}, want: false},
+		{name: "bad gateway", err: &SchemaError{HTTPStatus: 502, NotJSON: true}, want: true},
+		{name: "wrong endpoint", err: &SchemaError{HTTPStatus: 404, NotJSON: true}, want: false},
+		{name: "circuit open", err: &CircuitOpenError{RetryAfter: time.Second}, want: false},
+		{name: "canceled", err: context.Canceled, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isTransient(tt.err); got != tt.want {
+				t.Errorf("isTransient() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFetchRetries(t *testing.T) {
+	tests := []struct {
+		name      string
+		message   string
+		failures  int32
+		wantCalls int32
+		wantErr   bool
+	}{
+		{name: "transient error recovers", message: "Timeout after 60.0 seconds.", failures: 2, wantCalls: 3},
+		{name: "attempts exhausted", message: "Timeout after 60.0 seconds.", failures: 5, wantCalls: 3, wantErr: true},
+		{name: "definitive error", message: "Request parameter 'url' is invalid", failures: 1, wantCalls: 1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if calls.Add(1) <= tt.failures {
+					w.Write([]byte(`{"status":"error","message":"` + tt.message + `"}`))
+					return
+				}
+				json.NewEncoder(w).Encode(testResponse("<html></html>"))
+			}))
+			defer server.Close()
+			t.Setenv("FLARESOLVERR_URL", server.URL)
+			t.Setenv("RETRY_MAX_ATTEMPTS", "3")
+			t.Setenv("RETRY_BASE_DELAY", "1ms")
+			t.Setenv("BACKEND_MAX_FAILURES", "0")
+
+			_, _, err := newSolver().fetch(context.Background(), "request.get", "https://example.com/")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("fetch() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if calls.Load() != tt.wantCalls {
+				t.Errorf("FlareSolverr called %d times, want %d", calls.Load(), tt.wantCalls)
+			}
+		})
+	}
+}
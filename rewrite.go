@@ -0,0 +1,121 @@
+package flareproxy
+
+import (
+	"html"
+	"mime"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var (
+	// tagPattern matches start tags, whose attributes may hold links.
+	tagPattern = regexp.MustCompile(`<[a-zA-Z][^>]*>`)
+	// linkAttributePattern matches the link attributes of a tag and their
+	// quoted or unquoted values.
+	linkAttributePattern = regexp.MustCompile(`(?i)(\s(href|src|action|formaction|poster|srcset)\s*=\s*)("[^"]*"|'[^']*'|[^\s"'>]+)`)
+	// baseTagPattern matches <base>, which sets the URL relative links
+	// resolve against.
+	baseTagPattern = regexp.MustCompile(`(?i)<base\s[^>]*>`)
+)
+
+// withRewrittenLinks returns a copy of an HTML solution whose links, form
+// actions and embedded resources point back through the direct mode
+// ("/domain.com/path"), so that a plain browser can navigate a protected
+// site through the proxy. Other solutions are returned as they are.
+func withRewrittenLinks(flareResponse *FlareSolverrResponse, targetURL string) *FlareSolverrResponse {
+	mediaType, _, _ := mime.ParseMediaType(solutionContentType(flareResponse))
+	if mediaType != "text/html" {
+		return flareResponse
+	}
+	pageURL := flareResponse.Solution.URL
+	if pageURL == "" {
+		pageURL = targetURL
+	}
+	base, err := url.Parse(pageURL)
+	if err != nil {
+		return flareResponse
+	}
+	rewritten := *flareResponse
+	rewritten.Solution.Response = rewriteLinks(flareResponse.Solution.Response, base)
+	return &rewritten
+}
+
+// rewriteLinks rewrites the link attributes of the tags in body, resolving
+// relative links against base or the page's <base href>.
+func rewriteLinks(body string, base *url.URL) string {
+	if tag := baseTagPattern.FindString(body); tag != "" {
+		for _, m := range linkAttributePattern.FindAllStringSubmatch(tag, -1) {
+			if strings.EqualFold(m[2], "href") {
+				if ref, err := base.Parse(html.UnescapeString(unquote(m[3]))); err == nil {
+					base = ref
+				}
+			}
+		}
+	}
+	return tagPattern.ReplaceAllStringFunc(body, func(tag string) string {
+		return linkAttributePattern.ReplaceAllStringFunc(tag, func(attr string) string {
+			m := linkAttributePattern.FindStringSubmatch(attr)
+			value := html.UnescapeString(unquote(m[3]))
+			if strings.EqualFold(m[2], "srcset") {
+				value = rewriteSrcset(value, base)
+			} else {
+				value = proxiedLink(value, base)
+			}
+			quote := `"`
+			if strings.HasPrefix(m[3], "'") {
+				quote = "'"
+			}
+			return m[1] + quote + html.EscapeString(value) + quote
+		})
+	})
+}
+
+func unquote(value string) string {
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') {
+		return value[1 : len(value)-1]
+	}
+	return value
+}
+
+// proxiedLink returns the direct mode path of link, resolved against base.
+// Fragments within the page and links with schemes other than HTTP(S),
+// such as mailto: and javascript:, are left alone.
+func proxiedLink(link string, base *url.URL) string {
+	trimmed := strings.TrimSpace(link)
+	if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+		return link
+	}
+	u, err := base.Parse(trimmed)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return link
+	}
+	path := "/" + u.Host + u.EscapedPath()
+	if u.Path == "" {
+		path += "/"
+	}
+	if u.Scheme == "http" {
+		path = "/http" + path
+	}
+	if u.RawQuery != "" {
+		path += "?" + u.RawQuery
+	}
+	if u.Fragment != "" {
+		path += "#" + u.EscapedFragment()
+	}
+	return path
+}
+
+// rewriteSrcset rewrites the URLs of a srcset list of "URL [descriptor]"
+// candidates.
+func rewriteSrcset(srcset string, base *url.URL) string {
+	candidates := strings.Split(srcset, ",")
+	for i, candidate := range candidates {
+		link, descriptor, _ := strings.Cut(strings.TrimSpace(candidate), " ")
+		candidates[i] = proxiedLink(link, base)
+		if descriptor != "" {
+			candidates[i] += " " + strings.TrimSpace(descriptor)
+		}
+	}
+	return strings.Join(candidates, ", ")
+}
@@ -0,0 +1,77 @@
+package flareproxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestRewriteLinks(t *testing.T) {
+	base, _ := url.Parse("https://example.com/dir/page.html?x=1")
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{name: "absolute link", body: `<a href="https://other.org/a?b=c">`, want: `<a href="/other.org/a?b=c">`},
+		{name: "relative link", body: `<a href="next.html">`, want: `<a href="/example.com/dir/next.html">`},
+		{name: "root-relative link", body: `<a href='/top'>`, want: `<a href='/example.com/top'>`},
+		{name: "protocol-relative link", body: `<img src=//cdn.example.net/i.png>`, want: `<img src="/cdn.example.net/i.png">`},
+		{name: "plain HTTP keeps its scheme", body: `<a href="http://old.example:8080/">`, want: `<a href="/http/old.example:8080/">`},
+		{name: "host without path", body: `<a href="https://other.org">`, want: `<a href="/other.org/">`},
+		{name: "form action", body: `<form method="post" action="/login">`, want: `<form method="post" action="/example.com/login">`},
+		{name: "entities", body: `<a href="?a=1&amp;b=2">`, want: `<a href="/example.com/dir/page.html?a=1&amp;b=2">`},
+		{name: "fragment", body: `<a href="#top">`, want: `<a href="#top">`},
+		{name: "fragment of another page", body: `<a href="other.html#top">`, want: `<a href="/example.com/dir/other.html#top">`},
+		{name: "other schemes", body: `<a href="mailto:me@example.com"><a href="javascript:void(0)">`, want: `<a href="mailto:me@example.com"><a href="javascript:void(0)">`},
+		{name: "srcset", body: `<img srcset="a.png 1x, /b.png 2x">`, want: `<img srcset="/example.com/dir/a.png 1x, /example.com/b.png 2x">`},
+		{name: "other attributes", body: `<img data-src="a.png" alt="href=x">`, want: `<img data-src="a.png" alt="href=x">`},
+		{name: "text is left alone", body: `<p>see href="x.html"</p>`, want: `<p>see href="x.html"</p>`},
+		{name: "base tag", body: `<base href="https://cdn.example.net/assets/"><img src="i.png">`, want: `<base href="/cdn.example.net/assets/"><img src="/cdn.example.net/assets/i.png">`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rewriteLinks(tt.body, base); got != tt.want {
+				t.Errorf("rewriteLinks() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDirectRewriteLinks(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		response := testResponse(`<html><a href="/next">next</a></html>`)
+		response.Solution.URL = "https://example.com/start"
+		json.NewEncoder(w).Encode(response)
+	}))
+	defer mockServer.Close()
+	t.Setenv("FLARESOLVERR_URL", mockServer.URL)
+	t.Setenv("CACHE_TTL", "1m")
+
+	for _, enabled := range []bool{false, true} {
+		if enabled {
+			t.Setenv("REWRITE_LINKS", "true")
+		}
+		handler := NewDirectHandler()
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("GET", "/example.com/start", nil))
+		if got := strings.Contains(rr.Body.String(), `href="/example.com/next"`); got != enabled {
+			t.Errorf("REWRITE_LINKS=%v: body = %s", enabled, rr.Body.String())
+		}
+		// Cached copies keep the original links
+		if enabled {
+			key := handler.cacheKeyFor(context.Background(), "https://example.com/start", nil)
+			cached, ok := handler.cache.Get(key)
+			if !ok {
+				t.Fatal("page not cached")
+			}
+			if !strings.Contains(cached.Solution.Response, `href="/next"`) {
+				t.Errorf("cached body rewritten: %s", cached.Solution.Response)
+			}
+		}
+	}
+}
@@ -0,0 +1,300 @@
+package flareproxy
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errBypassFailed is returned for pages of a domain whose rule bypasses
+// FlareSolverr when the origin cannot be fetched directly.
+var errBypassFailed = errors.New("Direct fetch failed: the origin served a challenge or could not be reached, and the domain's rule bypasses FlareSolverr")
+
+// DomainRule is how a domain and its subdomains are handled, as given in
+// DOMAIN_RULES. Zero fields leave the global configuration in place.
+type DomainRule struct {
+	Domain string
+	// Backend is the FlareSolverr backend the domain's pages are solved
+	// on, as listed in FLARESOLVERR_URL.
+	Backend string
+	// Sessions is "none" to solve without warm sessions.
+	Sessions string
+	// Timeout is the time FlareSolverr is given to solve a page.
+	Timeout time.Duration
+	// Proxy is a "|" separated list of upstream proxies, or "none", as in
+	// UPSTREAM_PROXY_DOMAINS.
+	Proxy string
+	// CacheTTL is how long the domain's pages are cached.
+	CacheTTL time.Duration
+	// Bypass fetches the domain's pages directly, never solving them.
+	Bypass bool
+}
+
+// domainRules maps domains to their rule.
+type domainRules map[string]*DomainRule
+
+// RuleOptions configures how a Server handles particular domains.
+type RuleOptions struct {
+	// Rules apply to their domain and its subdomains, the most specific
+	// rule winning.
+	Rules []DomainRule
+}
+
+// RuleOptionsFromEnv reads the RuleOptions from DOMAIN_RULES, rules
+// separated by ";", each a domain followed by options, as in
+//
+//	example.com timeout=90s sessions=none; cdn.example bypass=true
+//
+// The options are backend, sessions (reuse or none), timeout, proxy,
+// cache_ttl and bypass. Invalid rules are skipped with a warning.
+func RuleOptionsFromEnv() RuleOptions {
+	rules, err := parseDomainRules(os.Getenv("DOMAIN_RULES"))
+	if err != nil {
+		slog.Warn("ignoring invalid DOMAIN_RULES", "error", err)
+	}
+	var opts RuleOptions
+	for _, rule := range rules.list() {
+		opts.Rules = append(opts.Rules, *rule)
+	}
+	return opts
+}
+
+// newDomainRules returns the rules of opts by domain, or nil if there are
+// none. Invalid rules are skipped with a warning.
+func newDomainRules(opts RuleOptions) domainRules {
+	rules := make(domainRules)
+	for _, rule := range opts.Rules {
+		rule := rule
+		rule.Domain = strings.ToLower(strings.TrimPrefix(rule.Domain, "*."))
+		if err := rule.validate(); err != nil {
+			slog.Warn("ignoring invalid domain rule", "domain", rule.Domain, "error", err)
+			continue
+		}
+		rules[rule.Domain] = &rule
+	}
+	if len(rules) == 0 {
+		return nil
+	}
+	return rules
+}
+
+// parseDomainRules parses a DOMAIN_RULES value, returning the valid rules
+// along with the error of the first invalid one.
+func parseDomainRules(s string) (domainRules, error) {
+	rules := make(domainRules)
+	var firstErr error
+	for _, part := range strings.Split(s, ";") {
+		fields := strings.Fields(part)
+		if len(fields) == 0 {
+			continue
+		}
+		rule, err := parseDomainRule(fields[0], fields[1:])
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		rules[rule.Domain] = rule
+	}
+	return rules, firstErr
+}
+
+func parseDomainRule(domain string, options []string) (*DomainRule, error) {
+	domain = strings.ToLower(strings.TrimPrefix(domain, "*."))
+	if strings.Contains(domain, "=") {
+		return nil, fmt.Errorf("rule %q does not start with a domain", domain)
+	}
+	rule := &DomainRule{Domain: domain}
+	for _, option := range options {
+		key, value, ok := strings.Cut(option, "=")
+		if !ok {
+			return nil, fmt.Errorf("%s: option %q is not key=value", domain, key)
+		}
+		var err error
+		switch key {
+		case "backend":
+			rule.Backend = value
+		case "sessions":
+			if value != "reuse" && value != "none" {
+				err = errors.New("want reuse or none")
+			}
+			rule.Sessions = value
+		case "timeout":
+			rule.Timeout, err = time.ParseDuration(value)
+		case "proxy":
+			if value != "none" {
+				for _, raw := range strings.Split(value, "|") {
+					if _, perr := parseUpstreamProxy(raw); perr != nil {
+						err = perr
+					}
+				}
+			}
+			rule.Proxy = value
+		case "cache_ttl":
+			rule.CacheTTL, err = time.ParseDuration(value)
+		case "bypass":
+			rule.Bypass, err = strconv.ParseBool(value)
+		default:
+			err = errors.New("unknown option")
+		}
+		if err != nil {
+			// Proxy URLs may hold credentials
+			if key == "proxy" {
+				return nil, fmt.Errorf("%s: proxy: %v", domain, err)
+			}
+			return nil, fmt.Errorf("%s: %s=%s: %v", domain, key, value, err)
+		}
+	}
+	return rule, nil
+}
+
+// validate checks a rule given in RuleOptions, as parseDomainRule does.
+func (r *DomainRule) validate() error {
+	if r.Domain == "" || strings.Contains(r.Domain, "=") {
+		return errors.New("not a domain")
+	}
+	if r.Sessions != "" && r.Sessions != "reuse" && r.Sessions != "none" {
+		return fmt.Errorf("sessions=%s: want reuse or none", r.Sessions)
+	}
+	if r.Proxy != "" && r.Proxy != "none" {
+		for _, raw := range strings.Split(r.Proxy, "|") {
+			if _, err := parseUpstreamProxy(raw); err != nil {
+				// Proxy URLs may hold credentials
+				return fmt.Errorf("proxy: %v", err)
+			}
+		}
+	}
+	return nil
+}
+
+// forURL returns the rule for the host of targetURL, or nil. Rules match
+// the domain itself and any of its subdomains, with the most specific rule
+// winning.
+func (r domainRules) forURL(targetURL string) *DomainRule {
+	if len(r) == 0 {
+		return nil
+	}
+	u, err := url.Parse(targetURL)
+	if err != nil {
+		return nil
+	}
+	host := strings.ToLower(u.Hostname())
+	for {
+		if rule, ok := r[host]; ok {
+			return rule
+		}
+		_, parent, ok := strings.Cut(host, ".")
+		if !ok {
+			return nil
+		}
+		host = parent
+	}
+}
+
+// list returns the rules sorted by domain.
+func (r domainRules) list() []*DomainRule {
+	rules := make([]*DomainRule, 0, len(r))
+	for _, rule := range r {
+		rules = append(rules, rule)
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Domain < rules[j].Domain })
+	return rules
+}
+
+// check warns about rules naming backends that are not configured, which
+// are solved on any backend instead.
+func (r domainRules) check(backends *backendPool) {
+	for _, rule := range r.list() {
+		if rule.Backend != "" && backends.get(rule.Backend) == nil {
+			slog.Warn("DOMAIN_RULES backend is not in FLARESOLVERR_URL, using any", "domain", rule.Domain, "backend", rule.Backend)
+		}
+	}
+}
+
+// applyProxies gives the upstream policy the proxies of the rules, which
+// take precedence over UPSTREAM_PROXY_DOMAINS.
+func (r domainRules) applyProxies(p *upstreamPolicy) {
+	for domain, rule := range r {
+		if rule.Proxy == "" {
+			continue
+		}
+		p.domains[domain] = nil
+		if rule.Proxy != "none" {
+			p.domains[domain] = parseUpstreamProxies(strings.Split(rule.Proxy, "|"), "DOMAIN_RULES")
+		}
+		for _, proxy := range p.domains[domain] {
+			p.state[proxy.URL] = &proxyState{}
+		}
+	}
+}
+
+func (r *DomainRule) bypass() bool {
+	return r != nil && r.Bypass
+}
+
+func (r *DomainRule) noSessions() bool {
+	return r != nil && r.Sessions == "none"
+}
+
+func (r *DomainRule) backend() string {
+	if r == nil {
+		return ""
+	}
+	return r.Backend
+}
+
+func (r *DomainRule) timeout() time.Duration {
+	if r == nil {
+		return 0
+	}
+	return r.Timeout
+}
+
+func (r *DomainRule) cacheTTL() time.Duration {
+	if r == nil {
+		return 0
+	}
+	return r.CacheTTL
+}
+
+// ruleFor returns the DOMAIN_RULES rule for targetURL, or nil.
+func (s *solver) ruleFor(targetURL string) *DomainRule {
+	if rules := s.rules.Load(); rules != nil {
+		return rules.forURL(targetURL)
+	}
+	return nil
+}
+
+// loadRules installs the domain rules and the upstream policy
+// with their proxies, at startup and when the config is reloaded.
+func (s *solver) loadRules(upstreams *upstreamPolicy) {
+	rules := newDomainRules(s.cfg.ruleOptions())
+	rules.check(s.backends)
+	rules.applyProxies(upstreams)
+	s.rules.Store(&rules)
+}
+
+// ttlCache is implemented by caches that can keep an entry for other
+// than their TTL.
+type ttlCache interface {
+	SetTTL(key string, response *FlareSolverrResponse, ttl time.Duration)
+}
+
+// cacheSet stores response under key, for the cache TTL of the rule of
+// targetURL if it has one and the cache supports it.
+func (s *solver) cacheSet(key, targetURL string, response *FlareSolverrResponse) {
+	if ttl := s.ruleFor(targetURL).cacheTTL(); ttl > 0 {
+		if cache, ok := s.cache.(ttlCache); ok {
+			cache.SetTTL(key, response, ttl)
+			return
+		}
+	}
+	s.cache.Set(key, response)
+}
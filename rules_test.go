@@ -0,0 +1,96 @@
+package flareproxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/kljensen/flareproxygo/flaresolverr/flaresolverrtest"
+)
+
+func TestParseDomainRules(t *testing.T) {
+	rules, err := parseDomainRules("Example.com timeout=90s sessions=none cache_ttl=1h; *.cdn.example bypass=true;; proxied.example proxy=http://a:3128|none.example:1")
+	if err == nil {
+		t.Error("invalid proxy accepted")
+	}
+	if got := rules.forURL("https://www.example.com/"); got == nil || got.Timeout != 90*time.Second || !got.noSessions() || got.cacheTTL() != time.Hour {
+		t.Errorf("rule for www.example.com = %+v", got)
+	}
+	if got := rules.forURL("https://img.cdn.example/a.png"); !got.bypass() {
+		t.Errorf("rule for img.cdn.example = %+v, want bypass", got)
+	}
+	if got := rules.forURL("https://proxied.example/"); got != nil {
+		t.Errorf("invalid rule kept: %+v", got)
+	}
+	if got := rules.forURL("https://other.org/"); got != nil || got.timeout() != 0 || got.bypass() {
+		t.Errorf("rule for other.org = %+v, want none", got)
+	}
+
+	for _, bad := range []string{"timeout=90s", "example.com timeout", "example.com timeout=soon", "example.com sessions=always", "example.com color=blue"} {
+		if _, err := parseDomainRules(bad); err == nil {
+			t.Errorf("parseDomainRules(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestDomainRules(t *testing.T) {
+	a := flaresolverrtest.NewServer()
+	defer a.Close()
+	b := flaresolverrtest.NewServer()
+	defer b.Close()
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/challenge" {
+			w.Header().Set("cf-mitigated", "challenge")
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte("<html>direct</html>"))
+	}))
+	defer origin.Close()
+
+	t.Setenv("FLARESOLVERR_URL", a.Endpoint()+","+b.Endpoint())
+	t.Setenv("CACHE_TTL", "1h")
+	t.Setenv("DOMAIN_RULES", "pinned.example backend="+b.Endpoint()+" timeout=90s sessions=none; short.example cache_ttl=1ns; 127.0.0.1 bypass=true")
+	s := newSolver()
+	s.sessions.add("pinned.example", "warm", b.Endpoint())
+	ctx := context.Background()
+
+	for _, path := range []string{"/1", "/2", "/3"} {
+		if _, _, err := s.fetch(ctx, "request.get", "https://pinned.example"+path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(a.Requests()) != 0 || len(b.Requests()) != 3 {
+		t.Errorf("solves on a, b = %d, %d; want all on the backend of the rule", len(a.Requests()), len(b.Requests()))
+	}
+	for _, req := range b.Requests() {
+		if req.MaxTimeout != 90000 || req.Session != "" {
+			t.Errorf("request = %+v, want the rule's timeout and no session", req)
+		}
+	}
+
+	// A short cache TTL makes the second fetch solve again
+	for range 2 {
+		if _, _, err := s.fetch(ctx, "request.get", "https://short.example/"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if solves := len(a.Requests()) + len(b.Requests()); solves != 5 {
+		t.Errorf("solves = %d, want short.example solved twice", solves)
+	}
+
+	// Bypassed domains are fetched directly, or fail
+	resp, meta, err := s.fetch(ctx, "request.get", origin.URL+"/page")
+	if err != nil || resp.Solution.Response != "<html>direct</html>" || meta.Backend != DirectBackend {
+		t.Errorf("bypassed fetch = %+v, %+v, %v", resp, meta, err)
+	}
+	if _, _, err := s.fetch(ctx, "request.get", origin.URL+"/challenge"); !errors.Is(err, errBypassFailed) {
+		t.Errorf("bypassed fetch of a challenge error = %v, want errBypassFailed", err)
+	}
+	if solves := len(a.Requests()) + len(b.Requests()); solves != 5 {
+		t.Errorf("bypassed fetches were solved, %d solves", solves)
+	}
+}
@@ -0,0 +1,438 @@
+package flareproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SchedulePath is the prefix of the scheduled fetch API on the direct
+// server.
+const SchedulePath = "/api/v1/schedule"
+
+// ScheduleWaiting is the state of a scheduled fetch before it is due.
+// Afterwards it moves through the job states.
+const ScheduleWaiting = "scheduled"
+
+// ScheduledFetch is a single fetch run at a set time, e.g. right when a
+// product drop goes live. Its result is posted to the webhook, if any,
+// and kept like a job's.
+type ScheduledFetch struct {
+	ID           string     `json:"id"`
+	Status       string     `json:"status"`
+	Cmd          string     `json:"cmd"`
+	URL          string     `json:"url"`
+	At           time.Time  `json:"at"`
+	Webhook      string     `json:"webhook,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+	CompletedAt  *time.Time `json:"completed_at,omitempty"`
+	Error        string     `json:"error,omitempty"`
+	WebhookError string     `json:"webhook_error,omitempty"`
+	Result       *JobResult `json:"result,omitempty"`
+
+	// apiKey is the API key the fetch was scheduled with, under which it
+	// queues, and clientCert whether it was scheduled with a verified
+	// client certificate; AUTH_RULES domain rules are checked against both
+	// when it runs.
+	apiKey     string
+	clientCert bool
+	// postData is the form body of a request.post.
+	postData string
+}
+
+// savedScheduledFetch is a ScheduledFetch as saved to the file, with the
+// credentials it was scheduled with.
+type savedScheduledFetch struct {
+	*ScheduledFetch
+	APIKey     string `json:"api_key,omitempty"`
+	ClientCert bool   `json:"client_cert,omitempty"`
+	PostData   string `json:"post_data,omitempty"`
+}
+
+// scheduler runs scheduled fetches when they are due. Fetches are saved
+// to a file on every change, so that they survive restarts; fetches that
+// fell due while the proxy was down run right after it starts.
+type scheduler struct {
+	fetch        func(ctx context.Context, req FetchRequest) (*FetchResult, error)
+	client       *http.Client
+	path         string // empty keeps fetches in memory only
+	maxPending   int
+	ttl          time.Duration
+	webhookDelay time.Duration
+	now          func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*ScheduledFetch
+	timers  map[string]*time.Timer
+}
+
+// newSchedulerFromEnv reads SCHEDULE_FILE and SCHEDULE_MAX_PENDING, and
+// arms the saved fetches. Completed fetches are kept for
+// JOB_RETENTION_TTL.
+func newSchedulerFromEnv(s *solver) *scheduler {
+	sc := &scheduler{
+		fetch:        s.process,
+		client:       &http.Client{Transport: s.client.Transport, Timeout: 30 * time.Second},
+		path:         envString("SCHEDULE_FILE", filepath.Join(os.TempDir(), "flareproxygo-schedule.json")),
+		maxPending:   envInt("SCHEDULE_MAX_PENDING", 1000),
+		ttl:          envDuration("JOB_RETENTION_TTL", time.Hour),
+		webhookDelay: time.Second,
+		now:          time.Now,
+		entries:      make(map[string]*ScheduledFetch),
+		timers:       make(map[string]*time.Timer),
+	}
+	if sc.path == "none" {
+		sc.path = ""
+	}
+	if err := sc.load(); err != nil {
+		slog.Warn("failed to restore scheduled fetches", "path", sc.path, "error", err)
+	}
+	return sc
+}
+
+// load reads the saved fetches and arms those that have not completed.
+// Fetches interrupted by a restart run again.
+func (sc *scheduler) load() error {
+	if sc.path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(sc.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var saved []savedScheduledFetch
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return err
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for _, s := range saved {
+		entry := s.ScheduledFetch
+		if entry == nil {
+			continue
+		}
+		entry.apiKey, entry.clientCert, entry.postData = s.APIKey, s.ClientCert, s.PostData
+		sc.entries[entry.ID] = entry
+		if entry.Status == ScheduleWaiting || entry.Status == JobRunning {
+			entry.Status = ScheduleWaiting
+			sc.armLocked(entry)
+		}
+	}
+	return nil
+}
+
+// add schedules req at at, for a client with the API key of req and,
+// if clientCert is set, a verified client certificate.
+func (sc *scheduler) add(req FetchRequest, at time.Time, webhook string, clientCert bool) (ScheduledFetch, error) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.pruneLocked()
+	if sc.maxPending > 0 && sc.pendingLocked() >= sc.maxPending {
+		return ScheduledFetch{}, fmt.Errorf("too many scheduled fetches, at most %d may be pending", sc.maxPending)
+	}
+	entry := &ScheduledFetch{
+		ID:         requestID(""),
+		Status:     ScheduleWaiting,
+		Cmd:        req.Cmd,
+		URL:        req.URL,
+		At:         at.UTC(),
+		Webhook:    webhook,
+		CreatedAt:  sc.now().UTC(),
+		apiKey:     req.APIKey,
+		clientCert: clientCert,
+		postData:   req.PostData,
+	}
+	sc.entries[entry.ID] = entry
+	sc.armLocked(entry)
+	sc.saveLocked()
+	return *entry, nil
+}
+
+// armLocked starts the timer running entry when it is due. sc.mu must be
+// held.
+func (sc *scheduler) armLocked(entry *ScheduledFetch) {
+	id := entry.ID
+	sc.timers[id] = time.AfterFunc(entry.At.Sub(sc.now()), func() { sc.run(id) })
+}
+
+func (sc *scheduler) pendingLocked() int {
+	n := 0
+	for _, entry := range sc.entries {
+		if entry.CompletedAt == nil {
+			n++
+		}
+	}
+	return n
+}
+
+// run fetches a due entry and delivers its result.
+func (sc *scheduler) run(id string) {
+	sc.mu.Lock()
+	entry, ok := sc.entries[id]
+	if !ok || entry.Status != ScheduleWaiting {
+		sc.mu.Unlock()
+		return
+	}
+	delete(sc.timers, id)
+	entry.Status = JobRunning
+	sc.saveLocked()
+	req := FetchRequest{Cmd: entry.Cmd, URL: entry.URL, PostData: entry.postData, Defer: true, APIKey: entry.apiKey}
+	clientCert, targetURL := entry.clientCert, entry.URL
+	sc.mu.Unlock()
+
+	// Log entries for the fetch carry its ID as the request ID
+	ctx := context.WithValue(context.Background(), requestInfoKey, &requestInfo{APIKey: req.APIKey, Remote: true, ClientCert: clientCert})
+	ctx = backgroundContext(ctx, id)
+	result, err := sc.fetch(ctx, req)
+
+	sc.mu.Lock()
+	completed := sc.now().UTC()
+	entry.CompletedAt = &completed
+	if err != nil {
+		entry.Status = JobFailed
+		entry.Error = err.Error()
+		slog.Warn("scheduled fetch failed", "id", id, "url", targetURL, "error", err)
+	} else {
+		entry.Status = JobDone
+		entry.Result = newJobResult(result)
+	}
+	snapshot := *entry
+	sc.saveLocked()
+	sc.mu.Unlock()
+
+	if snapshot.Webhook == "" {
+		return
+	}
+	if err := sc.notify(snapshot); err != nil {
+		slog.Warn("scheduled fetch webhook failed", "id", id, "webhook", snapshot.Webhook, "error", err)
+		sc.mu.Lock()
+		entry.WebhookError = err.Error()
+		sc.saveLocked()
+		sc.mu.Unlock()
+	}
+}
+
+// notify posts entry to its webhook, trying three times.
+func (sc *scheduler) notify(entry ScheduledFetch) error {
+	body, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	delay := sc.webhookDelay
+	for attempt := 1; ; attempt++ {
+		err = sc.post(entry.Webhook, body)
+		if err == nil || attempt == 3 {
+			return err
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func (sc *scheduler) post(webhook string, body []byte) error {
+	resp, err := sc.client.Post(webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+// get returns a copy of the entry with the given ID.
+func (sc *scheduler) get(id string) (ScheduledFetch, bool) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.pruneLocked()
+	entry, ok := sc.entries[id]
+	if !ok {
+		return ScheduledFetch{}, false
+	}
+	return *entry, true
+}
+
+// list returns the entries without their results, by due time.
+func (sc *scheduler) list() []ScheduledFetch {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.pruneLocked()
+	entries := make([]ScheduledFetch, 0, len(sc.entries))
+	for _, entry := range sc.entries {
+		summary := *entry
+		summary.Result = nil
+		entries = append(entries, summary)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if !entries[i].At.Equal(entries[j].At) {
+			return entries[i].At.Before(entries[j].At)
+		}
+		return entries[i].ID < entries[j].ID
+	})
+	return entries
+}
+
+// delete removes an entry, cancelling it if it is not due yet.
+func (sc *scheduler) delete(id string) bool {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if _, ok := sc.entries[id]; !ok {
+		return false
+	}
+	if timer, ok := sc.timers[id]; ok {
+		timer.Stop()
+		delete(sc.timers, id)
+	}
+	delete(sc.entries, id)
+	sc.saveLocked()
+	return true
+}
+
+// pruneLocked drops entries completed longer than the retention TTL ago.
+// sc.mu must be held.
+func (sc *scheduler) pruneLocked() {
+	if sc.ttl <= 0 {
+		return
+	}
+	now := sc.now()
+	for id, entry := range sc.entries {
+		if entry.CompletedAt != nil && now.Sub(*entry.CompletedAt) > sc.ttl {
+			delete(sc.entries, id)
+		}
+	}
+}
+
+// saveLocked writes the entries to the file, if any. sc.mu must be held.
+func (sc *scheduler) saveLocked() {
+	if sc.path == "" {
+		return
+	}
+	sc.pruneLocked()
+	entries := make([]savedScheduledFetch, 0, len(sc.entries))
+	for _, entry := range sc.entries {
+		entries = append(entries, savedScheduledFetch{
+			ScheduledFetch: entry,
+			APIKey:         entry.apiKey,
+			ClientCert:     entry.clientCert,
+			PostData:       entry.postData,
+		})
+	}
+	data, err := json.Marshal(entries)
+	if err == nil {
+		err = writeFileAtomic(sc.path, data)
+	}
+	if err != nil {
+		slog.Warn("failed to save scheduled fetches", "path", sc.path, "error", err)
+	}
+}
+
+// ServeHTTP implements the scheduled fetch API:
+//
+//	POST   /api/v1/schedule       schedule {"url": "...", "at": "<RFC 3339 time>"}
+//	                              or {"url": "...", "in": "90s"}, with an
+//	                              optional "cmd", "post_data" and "webhook"
+//	GET    /api/v1/schedule       list scheduled fetches
+//	GET    /api/v1/schedule/{id}  fetch one and its result
+//	DELETE /api/v1/schedule/{id}  cancel and delete one
+func (sc *scheduler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, SchedulePath), "/")
+	switch {
+	case id == "" && r.Method == http.MethodPost:
+		sc.serveAdd(w, r)
+	case id == "" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]interface{}{"scheduled": sc.list()})
+	case id != "" && r.Method == http.MethodGet:
+		entry, ok := sc.get(id)
+		if !ok {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "scheduled fetch not found"})
+			return
+		}
+		writeJSON(w, http.StatusOK, entry)
+	case id != "" && r.Method == http.MethodDelete:
+		if !sc.delete(id) {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "scheduled fetch not found"})
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (sc *scheduler) serveAdd(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		URL      string     `json:"url"`
+		Cmd      string     `json:"cmd"`
+		PostData string     `json:"post_data"`
+		At       *time.Time `json:"at"`
+		In       string     `json:"in"`
+		Webhook  string     `json:"webhook"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&body); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON body: " + err.Error()})
+		return
+	}
+	if body.Cmd == "" {
+		body.Cmd = "request.get"
+	}
+	if body.Cmd != "request.get" && body.Cmd != "request.post" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "cmd must be request.get or request.post"})
+		return
+	}
+	if (body.Cmd == "request.post") != (body.PostData != "") {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "post_data is required with request.post, and only allowed with it"})
+		return
+	}
+	if !isAbsoluteHTTPURL(body.URL) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "url must be an absolute http or https URL"})
+		return
+	}
+	if body.Webhook != "" && !isAbsoluteHTTPURL(body.Webhook) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "webhook must be an absolute http or https URL"})
+		return
+	}
+
+	var at time.Time
+	switch {
+	case body.At != nil && body.In == "":
+		at = *body.At
+		if at.Before(sc.now()) {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "at must not be in the past"})
+			return
+		}
+	case body.At == nil && body.In != "":
+		d, err := time.ParseDuration(body.In)
+		if err != nil || d < 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": `in must be a duration such as "90s" or "2h"`})
+			return
+		}
+		at = sc.now().Add(d)
+	default:
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "exactly one of at and in must be set"})
+		return
+	}
+
+	client := requestInfoFrom(r.Context())
+	req := FetchRequest{Cmd: body.Cmd, URL: body.URL, PostData: body.PostData, APIKey: client.APIKey}
+	entry, err := sc.add(req, at, body.Webhook, client.ClientCert)
+	if err != nil {
+		writeJSON(w, http.StatusTooManyRequests, map[string]string{"error": err.Error()})
+		return
+	}
+	w.Header().Set("Location", SchedulePath+"/"+entry.ID)
+	writeJSON(w, http.StatusAccepted, entry)
+}
@@ -0,0 +1,156 @@
+package flareproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// waitForScheduled polls the scheduler until the entry has completed.
+func waitForScheduled(t *testing.T, sc *scheduler, id string) ScheduledFetch {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		entry, ok := sc.get(id)
+		if !ok {
+			t.Fatalf("scheduled fetch %s disappeared", id)
+		}
+		if entry.CompletedAt != nil && (entry.Webhook == "" || entry.Result != nil || entry.Error != "") {
+			return entry
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("scheduled fetch %s did not complete", id)
+	return ScheduledFetch{}
+}
+
+func TestScheduleAPI(t *testing.T) {
+	var solves atomic.Int32
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		solves.Add(1)
+		json.NewEncoder(w).Encode(testResponse("<html>drop</html>"))
+	}))
+	defer mockServer.Close()
+	delivered := make(chan ScheduledFetch, 1)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var entry ScheduledFetch
+		json.NewDecoder(r.Body).Decode(&entry)
+		delivered <- entry
+	}))
+	defer webhook.Close()
+	t.Setenv("FLARESOLVERR_URL", mockServer.URL)
+	t.Setenv("SCHEDULE_FILE", filepath.Join(t.TempDir(), "schedule.json"))
+	handler := NewDirectHandler()
+
+	submit := func(body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("POST", SchedulePath, strings.NewReader(body)))
+		return rr
+	}
+	rr := submit(`{"url": "https://shop.example/drop", "in": "50ms", "webhook": "` + webhook.URL + `"}`)
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("schedule status = %d, want 202: %s", rr.Code, rr.Body.String())
+	}
+	var scheduled ScheduledFetch
+	json.Unmarshal(rr.Body.Bytes(), &scheduled)
+	if rr.Header().Get("Location") != SchedulePath+"/"+scheduled.ID || scheduled.Status != ScheduleWaiting {
+		t.Errorf("scheduled = %+v, Location %q", scheduled, rr.Header().Get("Location"))
+	}
+	if solves.Load() != 0 {
+		t.Error("fetched before it was due")
+	}
+
+	select {
+	case entry := <-delivered:
+		if entry.ID != scheduled.ID || entry.Status != JobDone || entry.Result.Body != "<html>drop</html>" {
+			t.Errorf("webhook got %+v", entry)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook not called")
+	}
+	if entry := waitForScheduled(t, handler.schedule, scheduled.ID); entry.Result == nil || entry.CompletedAt.Before(scheduled.At) {
+		t.Errorf("entry = %+v, want it completed after it was due", entry)
+	}
+
+	// Cancelled fetches do not run
+	rr = submit(`{"url": "https://shop.example/later", "at": "` + time.Now().Add(time.Hour).Format(time.RFC3339) + `"}`)
+	json.Unmarshal(rr.Body.Bytes(), &scheduled)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", SchedulePath, nil))
+	if !strings.Contains(rr.Body.String(), "/later") {
+		t.Errorf("list = %s", rr.Body.String())
+	}
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("DELETE", SchedulePath+"/"+scheduled.ID, nil))
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("delete status = %d, want 204", rr.Code)
+	}
+
+	for _, body := range []string{
+		`{"url": "https://shop.example/"}`,
+		`{"url": "https://shop.example/", "in": "1m", "at": "2030-01-01T00:00:00Z"}`,
+		`{"url": "https://shop.example/", "at": "2001-01-01T00:00:00Z"}`,
+		`{"url": "https://shop.example/", "in": "soon"}`,
+		`{"url": "https://shop.example/", "in": "1m", "webhook": "ftp://hooks.example/"}`,
+		`{"url": "shop.example", "in": "1m"}`,
+		`{"url": "https://shop.example/", "in": "1m", "cmd": "request.post"}`,
+		`{"url": "https://shop.example/", "in": "1m", "post_data": "a=1"}`,
+	} {
+		if rr := submit(body); rr.Code != http.StatusBadRequest {
+			t.Errorf("status = %d for %s, want 400", rr.Code, body)
+		}
+	}
+}
+
+func TestSchedulePersistence(t *testing.T) {
+	var solves atomic.Int32
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		solves.Add(1)
+		json.NewEncoder(w).Encode(testResponse("<html>drop</html>"))
+	}))
+	defer mockServer.Close()
+	t.Setenv("FLARESOLVERR_URL", mockServer.URL)
+	t.Setenv("SCHEDULE_MAX_PENDING", "2")
+
+	path := filepath.Join(t.TempDir(), "schedule.json")
+	t.Setenv("SCHEDULE_FILE", path)
+	sc := newSchedulerFromEnv(newSolver())
+	later, _ := sc.add(FetchRequest{Cmd: "request.post", URL: "https://shop.example/later", PostData: "sku=1", APIKey: "tenant-key"}, time.Now().Add(time.Hour), "", false)
+	sc.add(FetchRequest{Cmd: "request.get", URL: "https://shop.example/other"}, time.Now().Add(time.Hour), "", false)
+	if _, err := sc.add(FetchRequest{Cmd: "request.get", URL: "https://shop.example/"}, time.Now().Add(time.Hour), "", false); err == nil {
+		t.Error("add() accepted more than SCHEDULE_MAX_PENDING fetches")
+	}
+
+	// A fetch interrupted by a restart runs again
+	var saved []savedScheduledFetch
+	data, _ := os.ReadFile(path)
+	json.Unmarshal(data, &saved)
+	saved = append(saved, savedScheduledFetch{ScheduledFetch: &ScheduledFetch{ID: "interrupted", Status: JobRunning, Cmd: "request.get",
+		URL: "https://shop.example/soon", At: time.Now().Add(-time.Minute)}})
+	data, _ = json.Marshal(saved)
+	os.WriteFile(path, data, 0o600)
+
+	restarted := newSchedulerFromEnv(newSolver())
+	if entry := waitForScheduled(t, restarted, "interrupted"); entry.Status != JobDone {
+		t.Errorf("entry = %+v after restart, want done", entry)
+	}
+	if entry, ok := restarted.get(later.ID); !ok || entry.Status != ScheduleWaiting {
+		t.Errorf("entry = %+v, %v after restart, want still scheduled", entry, ok)
+	}
+	// The API key and form survive restarts, but the key is not shown
+	if entry, _ := restarted.get(later.ID); entry.apiKey != "tenant-key" || entry.postData != "sku=1" {
+		t.Errorf("API key = %q, post data = %q after restart", entry.apiKey, entry.postData)
+	}
+	if data, _ := json.Marshal(later); strings.Contains(string(data), "tenant-key") {
+		t.Errorf("scheduled fetch shows its API key: %s", data)
+	}
+	if got := solves.Load(); got != 1 {
+		t.Errorf("solved %d times, want once", got)
+	}
+}
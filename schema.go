@@ -0,0 +1,139 @@
+package flareproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// SchemaError describes a FlareSolverr response that does not match the
+// schema this proxy understands, e.g. after an incompatible solver upgrade
+// or when FLARESOLVERR_URL points at something that is not FlareSolverr.
+type SchemaError struct {
+	HTTPStatus int
+	Version    string
+	NotJSON    bool
+	Missing    []string
+	Invalid    []string
+	Unexpected []string
+}
+
+func (e *SchemaError) Error() string {
+	version := e.Version
+	if version == "" {
+		version = "unknown"
+	}
+	var problems []string
+	if e.NotJSON {
+		problems = append(problems, "body is not a JSON object; check that FLARESOLVERR_URL points at the /v1 endpoint")
+	}
+	if len(e.Missing) > 0 {
+		problems = append(problems, "missing fields: "+strings.Join(e.Missing, ", "))
+	}
+	if len(e.Invalid) > 0 {
+		problems = append(problems, "fields with unexpected types: "+strings.Join(e.Invalid, ", "))
+	}
+	if len(e.Unexpected) > 0 {
+		problems = append(problems, "unexpected fields: "+strings.Join(e.Unexpected, ", "))
+	}
+	return fmt.Sprintf("Unexpected FlareSolverr response (solver version %s, HTTP %d): %s",
+		version, e.HTTPStatus, strings.Join(problems, "; "))
+}
+
+// schemaField describes a field of the FlareSolverr response.
+type schemaField struct {
+	kind     string // "string", "number", "object" or "array"
+	required bool
+}
+
+var responseSchema = map[string]schemaField{
+	"status":         {kind: "string", required: true},
+	"message":        {kind: "string", required: true},
+	"solution":       {kind: "object"},
+	"startTimestamp": {kind: "number"},
+	"endTimestamp":   {kind: "number"},
+	"version":        {kind: "string"},
+	"session":        {kind: "string"},
+	"sessions":       {kind: "array"},
+}
+
+var solutionSchema = map[string]schemaField{
+	"url":       {kind: "string"},
+	"status":    {kind: "number", required: true},
+	"headers":   {kind: "object"},
+	"response":  {kind: "string", required: true},
+	"cookies":   {kind: "array"},
+	"userAgent": {kind: "string"},
+}
+
+// validateResponse checks a raw FlareSolverr response body against the
+// expected schema. Unknown fields are only reported alongside missing or
+// mistyped ones, so that newer solvers adding fields keep working.
+func validateResponse(body []byte, httpStatus int) error {
+	schemaErr := &SchemaError{HTTPStatus: httpStatus}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal(body, &fields); err != nil || fields == nil {
+		schemaErr.NotJSON = true
+		return schemaErr
+	}
+	if version, ok := fields["version"].(string); ok {
+		schemaErr.Version = version
+	}
+
+	checkFields(schemaErr, "", fields, responseSchema)
+	if fields["status"] == "ok" {
+		if solution, ok := fields["solution"].(map[string]interface{}); ok {
+			checkFields(schemaErr, "solution.", solution, solutionSchema)
+		} else if fields["solution"] == nil && fields["sessions"] == nil && fields["session"] == nil {
+			// Session commands answer without a solution
+			schemaErr.Missing = append(schemaErr.Missing, "solution")
+		}
+	}
+
+	if len(schemaErr.Missing) == 0 && len(schemaErr.Invalid) == 0 {
+		return nil
+	}
+	sort.Strings(schemaErr.Missing)
+	sort.Strings(schemaErr.Invalid)
+	sort.Strings(schemaErr.Unexpected)
+	return schemaErr
+}
+
+func checkFields(schemaErr *SchemaError, prefix string, fields map[string]interface{}, schema map[string]schemaField) {
+	for name, field := range schema {
+		value, ok := fields[name]
+		if !ok || value == nil {
+			if field.required {
+				schemaErr.Missing = append(schemaErr.Missing, prefix+name)
+			}
+			continue
+		}
+		if jsonKind(value) != field.kind {
+			schemaErr.Invalid = append(schemaErr.Invalid, fmt.Sprintf("%s%s (want %s, got %s)", prefix, name, field.kind, jsonKind(value)))
+		}
+	}
+	for name := range fields {
+		if _, ok := schema[name]; !ok {
+			schemaErr.Unexpected = append(schemaErr.Unexpected, prefix+name)
+		}
+	}
+}
+
+func jsonKind(value interface{}) string {
+	switch value.(type) {
+	case string:
+		return "string"
+	case float64:
+		return "number"
+	case bool:
+		return "boolean"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	default:
+		return "null"
+	}
+}
@@ -0,0 +1,89 @@
+package flareproxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestValidateResponse(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		wantErr  bool
+		contains []string
+	}{
+		{
+			name: "valid solution",
+			body: `{"status":"ok","message":"","version":"3.3.21","solution":{"url":"https://example.com","status":200,"headers":{},"response":"<html></html>","cookies":[],"userAgent":"Mozilla/5.0"}}`,
+		},
+		{
+			name: "valid error",
+			body: `{"status":"error","message":"Error solving the challenge","version":"3.3.21"}`,
+		},
+		{
+			name: "new fields alone are accepted",
+			body: `{"status":"ok","message":"","solution":{"status":200,"response":"","turnstile_token":"x"},"newField":1}`,
+		},
+		{
+			name:     "missing solution fields",
+			body:     `{"status":"ok","message":"","version":"4.0.0","solution":{"url":"https://example.com","html":"<html></html>"}}`,
+			wantErr:  true,
+			contains: []string{"solver version 4.0.0", "missing fields: solution.response, solution.status", "unexpected fields: solution.html"},
+		},
+		{
+			name:     "wrong types",
+			body:     `{"status":"ok","message":"","solution":{"status":"200","response":"<html></html>"}}`,
+			wantErr:  true,
+			contains: []string{"solution.status (want number, got string)", "solver version unknown"},
+		},
+		{
+			name:     "missing status",
+			body:     `{"msg":"FlareSolverr is ready!","version":"3.3.21"}`,
+			wantErr:  true,
+			contains: []string{"missing fields: message, status", "unexpected fields: msg"},
+		},
+		{
+			name:     "not JSON",
+			body:     `<html>404 Not Found</html>`,
+			wantErr:  true,
+			contains: []string{"not a JSON object", "FLARESOLVERR_URL"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateResponse([]byte(tt.body), http.StatusOK)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validateResponse() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			for _, want := range tt.contains {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q does not contain %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestSolverSchemaError(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("404 page not found"))
+	}))
+	defer mockServer.Close()
+
+	t.Setenv("FLARESOLVERR_URL", mockServer.URL)
+	_, err := newSolver().solve(context.Background(), FlareSolverrRequest{Cmd: "request.get", URL: "https://example.com"})
+
+	var schemaErr *SchemaError
+	if !errors.As(err, &schemaErr) {
+		t.Fatalf("solve() error = %v, want *SchemaError", err)
+	}
+	if schemaErr.HTTPStatus != http.StatusNotFound || !schemaErr.NotJSON {
+		t.Errorf("SchemaError = %+v", schemaErr)
+	}
+}
@@ -0,0 +1,76 @@
+package flareproxy
+
+import (
+	"net/http"
+	"strings"
+)
+
+// defaultContentSecurityPolicy sandboxes proxied pages: they get an
+// opaque origin and cannot run scripts, so they cannot read the operator's
+// cookies or call other endpoints on the operator's origin.
+const defaultContentSecurityPolicy = "sandbox allow-forms allow-popups; script-src 'none'; object-src 'none'; base-uri 'none'; frame-ancestors 'none'"
+
+// securityHeadersFromEnv returns the headers added to HTML responses of
+// the direct mode when SECURITY_HEADERS is set. SECURITY_CSP,
+// SECURITY_FRAME_OPTIONS and SECURITY_REFERRER_POLICY override the
+// defaults; "none" leaves a header out.
+func securityHeadersFromEnv() http.Header {
+	if !envBool("SECURITY_HEADERS", false) {
+		return nil
+	}
+	headers := make(http.Header)
+	for name, value := range map[string]string{
+		"Content-Security-Policy": envString("SECURITY_CSP", defaultContentSecurityPolicy),
+		"X-Frame-Options":         envString("SECURITY_FRAME_OPTIONS", "DENY"),
+		"Referrer-Policy":         envString("SECURITY_REFERRER_POLICY", "no-referrer"),
+	} {
+		if value != "none" {
+			headers.Set(name, value)
+		}
+	}
+	return headers
+}
+
+// securityHeaderWriter adds security headers to HTML responses, leaving
+// other content types, e.g. JSON API responses, alone.
+type securityHeaderWriter struct {
+	http.ResponseWriter
+	headers     http.Header
+	wroteHeader bool
+}
+
+func (w *securityHeaderWriter) WriteHeader(status int) {
+	if !w.wroteHeader && status >= 200 {
+		w.wroteHeader = true
+		if strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") {
+			for name, values := range w.headers {
+				w.Header()[name] = values
+			}
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *securityHeaderWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *securityHeaderWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap allows http.ResponseController to reach the underlying writer.
+func (w *securityHeaderWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,71 @@
+package flareproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSecurityHeaders(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req FlareSolverrRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		body := "<html><script>steal()</script></html>"
+		if req.URL == "https://example.com/api" {
+			body = `{"ok": true}`
+		}
+		json.NewEncoder(w).Encode(testResponse(body))
+	}))
+	defer mockServer.Close()
+	t.Setenv("FLARESOLVERR_URL", mockServer.URL)
+
+	tests := []struct {
+		name        string
+		env         map[string]string
+		path        string
+		wantCSP     string
+		wantFrame   string
+		wantReferer string
+	}{
+		{name: "disabled by default", path: "/example.com/"},
+		{
+			name:        "html",
+			env:         map[string]string{"SECURITY_HEADERS": "true"},
+			path:        "/example.com/",
+			wantCSP:     defaultContentSecurityPolicy,
+			wantFrame:   "DENY",
+			wantReferer: "no-referrer",
+		},
+		{name: "json is left alone", env: map[string]string{"SECURITY_HEADERS": "true"}, path: "/example.com/api"},
+		{name: "health is left alone", env: map[string]string{"SECURITY_HEADERS": "true"}, path: "/healthz"},
+		{
+			name:        "overridden",
+			env:         map[string]string{"SECURITY_HEADERS": "true", "SECURITY_CSP": "sandbox", "SECURITY_FRAME_OPTIONS": "none"},
+			path:        "/example.com/",
+			wantCSP:     "sandbox",
+			wantReferer: "no-referrer",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			rr := httptest.NewRecorder()
+			NewDirectHandler().ServeHTTP(rr, httptest.NewRequest("GET", tt.path, nil))
+			if rr.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", rr.Code, rr.Body.String())
+			}
+			for name, want := range map[string]string{
+				"Content-Security-Policy": tt.wantCSP,
+				"X-Frame-Options":         tt.wantFrame,
+				"Referrer-Policy":         tt.wantReferer,
+			} {
+				if got := rr.Header().Get(name); got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
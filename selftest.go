@@ -0,0 +1,144 @@
+package flareproxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Self-test check outcomes.
+const (
+	CheckPass = "pass"
+	CheckWarn = "warn"
+	CheckFail = "fail"
+	CheckSkip = "skip"
+)
+
+// selfTestCheck is the result of a single self-test check.
+type selfTestCheck struct {
+	Name       string `json:"name"`
+	Status     string `json:"status"`
+	Critical   bool   `json:"critical"`
+	Detail     string `json:"detail,omitempty"`
+	DurationMs int64  `json:"duration_ms"`
+}
+
+// selfTestReport is the machine-readable result of a self-test run.
+type selfTestReport struct {
+	OK     bool            `json:"ok"`
+	Checks []selfTestCheck `json:"checks"`
+}
+
+// selfTest is a named check. It returns a status and a human readable
+// detail.
+type selfTest struct {
+	name     string
+	critical bool
+	run      func(ctx context.Context) (string, string)
+}
+
+// runSelfTest runs every check and reports OK unless a critical check
+// failed.
+func runSelfTest(ctx context.Context, s *solver) selfTestReport {
+	checks := []selfTest{
+		{name: "config", critical: true, run: checkConfig},
+		{name: "backend", critical: true, run: func(ctx context.Context) (string, string) {
+			return checkBackend(ctx, s, envString("SELFTEST_CANARY_URL", "https://example.com/"))
+		}},
+		{name: "cache", critical: true, run: func(ctx context.Context) (string, string) {
+			return checkCache(s.cache)
+		}},
+		{name: "tls", critical: true, run: checkTLSMaterial},
+	}
+
+	report := selfTestReport{OK: true}
+	for _, check := range checks {
+		start := time.Now()
+		status, detail := check.run(ctx)
+		report.Checks = append(report.Checks, selfTestCheck{
+			Name:       check.name,
+			Status:     status,
+			Critical:   check.critical,
+			Detail:     detail,
+			DurationMs: time.Since(start).Milliseconds(),
+		})
+		if status == CheckFail && check.critical {
+			report.OK = false
+		}
+	}
+	return report
+}
+
+// write writes report as indented JSON.
+func (report selfTestReport) write(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(report)
+}
+
+func checkConfig(context.Context) (string, string) {
+	for _, backendURL := range splitList(envString("FLARESOLVERR_URL", DefaultFlareSolverrURL)) {
+		u, err := url.Parse(backendURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return CheckFail, fmt.Sprintf("FLARESOLVERR_URL entry %q must be an http(s) URL", backendURL)
+		}
+	}
+
+	port := envString("PORT", "8080")
+	if !validPort(port) {
+		return CheckFail, fmt.Sprintf("PORT %q is not a valid port", port)
+	}
+	if proxyPort := os.Getenv("PROXY_PORT"); proxyPort != "" {
+		if !validPort(proxyPort) {
+			return CheckFail, fmt.Sprintf("PROXY_PORT %q is not a valid port", proxyPort)
+		}
+		if proxyPort == port {
+			return CheckFail, "PORT and PROXY_PORT must differ"
+		}
+	}
+	return CheckPass, "configuration is valid"
+}
+
+func validPort(port string) bool {
+	n, err := strconv.Atoi(port)
+	return err == nil && n > 0 && n < 65536
+}
+
+// checkBackend solves canaryURL to verify FlareSolverr works end to end.
+func checkBackend(ctx context.Context, s *solver, canaryURL string) (string, string) {
+	flareResponse, err := s.solve(ctx, FlareSolverrRequest{Cmd: "request.get", URL: canaryURL, MaxTimeout: int(s.maxTimeout.Milliseconds())})
+	if err != nil {
+		return CheckFail, err.Error()
+	}
+	return CheckPass, fmt.Sprintf("solved %s (HTTP %d, %d bytes)", canaryURL,
+		flareResponse.Solution.Status, len(flareResponse.Solution.Response))
+}
+
+// checkCache verifies that the cache store accepts and returns entries.
+func checkCache(cache Cache) (string, string) {
+	if cache == nil {
+		if envDuration("CACHE_TTL", 0) > 0 {
+			return CheckFail, "CACHE_TTL is set but the cache backend could not be initialised"
+		}
+		return CheckSkip, "caching is disabled"
+	}
+	key := "selftest " + strconv.FormatInt(time.Now().UnixNano(), 10)
+	probe := &FlareSolverrResponse{Status: "ok"}
+	probe.Solution.Response = "selftest"
+	probe.Solution.Status = 200
+	cache.Set(key, probe)
+	if got, ok := cache.Get(key); !ok || got.Solution.Response != probe.Solution.Response {
+		return CheckFail, fmt.Sprintf("%T did not return a stored entry", cache)
+	}
+	return CheckPass, fmt.Sprintf("%T is writable", cache)
+}
+
+// checkTLSMaterial validates certificates and keys the proxy uses.
+func checkTLSMaterial(context.Context) (string, string) {
+	return CheckSkip, "no TLS material configured"
+}
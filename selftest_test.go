@@ -0,0 +1,90 @@
+package flareproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRunSelfTest(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req FlareSolverrRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.URL == "https://broken.example/" {
+			json.NewEncoder(w).Encode(FlareSolverrResponse{Status: "error", Message: "Timeout"})
+			return
+		}
+		json.NewEncoder(w).Encode(testResponse("<html>canary</html>"))
+	}))
+	defer mockServer.Close()
+
+	tests := []struct {
+		name       string
+		env        map[string]string
+		wantOK     bool
+		wantStatus map[string]string
+	}{
+		{
+			name:   "all checks pass",
+			env:    map[string]string{"CACHE_TTL": "1m"},
+			wantOK: true,
+			wantStatus: map[string]string{
+				"config": CheckPass, "backend": CheckPass, "cache": CheckPass, "tls": CheckSkip,
+			},
+		},
+		{
+			name:   "canary solve fails",
+			env:    map[string]string{"SELFTEST_CANARY_URL": "https://broken.example/"},
+			wantOK: false,
+			wantStatus: map[string]string{
+				"config": CheckPass, "backend": CheckFail, "cache": CheckSkip,
+			},
+		},
+		{
+			name:       "conflicting ports",
+			env:        map[string]string{"PORT": "8080", "PROXY_PORT": "8080"},
+			wantOK:     false,
+			wantStatus: map[string]string{"config": CheckFail},
+		},
+		{
+			name:       "unwritable disk cache",
+			env:        map[string]string{"CACHE_TTL": "1m", "CACHE_BACKEND": "disk", "CACHE_DIR": "/dev/null/cache"},
+			wantOK:     false,
+			wantStatus: map[string]string{"cache": CheckFail},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("FLARESOLVERR_URL", mockServer.URL)
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			report := runSelfTest(ctx, newSolver())
+			if report.OK != tt.wantOK {
+				t.Errorf("report.OK = %v, want %v: %+v", report.OK, tt.wantOK, report.Checks)
+			}
+			for _, check := range report.Checks {
+				if want, ok := tt.wantStatus[check.Name]; ok && check.Status != want {
+					t.Errorf("check %s = %s (%s), want %s", check.Name, check.Status, check.Detail, want)
+				}
+			}
+
+			var buf bytes.Buffer
+			if err := report.write(&buf); err != nil {
+				t.Fatalf("write() error = %v", err)
+			}
+			var decoded selfTestReport
+			if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil || len(decoded.Checks) != len(report.Checks) {
+				t.Errorf("report does not round-trip as JSON: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,311 @@
+package flareproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Version is the release the binary was built from, set with
+// -ldflags
+// "-X github.com/kljensen/flareproxygo.Version=v1.2.3" by release builds.
+var Version = "dev"
+
+// ReleaseSigningKey is the base64 Ed25519 public key release checksums are
+// signed with, set with -ldflags
+// "-X github.com/kljensen/flareproxygo.ReleaseSigningKey=..." by
+// release builds. SELF_UPDATE_PUBLIC_KEY overrides it.
+var ReleaseSigningKey = ""
+
+// DefaultReleasesURL is the GitHub API endpoint listing the project's
+// releases.
+const DefaultReleasesURL = "https://api.github.com/repos/kljensen/flareproxygo/releases"
+
+// Release assets besides the binaries, named flareproxygo-<os>-<arch>.
+// The checksums start with a "version: <tag>" line, so that the
+// signature binds them to their release.
+const (
+	checksumsAsset = "SHA256SUMS"
+	signatureAsset = "SHA256SUMS.sig"
+)
+
+// maxBinarySize bounds the download, so that a broken mirror cannot fill
+// the disk.
+const maxBinarySize = 256 << 20
+
+// release is a GitHub release with its downloadable assets.
+type release struct {
+	TagName string `json:"tag_name"`
+	Assets  []struct {
+		Name string `json:"name"`
+		URL  string `json:"browser_download_url"`
+	} `json:"assets"`
+}
+
+// assetURL returns the download URL of the asset called name.
+func (r *release) assetURL(name string) (string, error) {
+	for _, asset := range r.Assets {
+		if asset.Name == name {
+			return asset.URL, nil
+		}
+	}
+	return "", fmt.Errorf("release %s has no asset %s", r.TagName, name)
+}
+
+// selfUpdater replaces the running binary with the build of a release for
+// the same OS and architecture, once its checksum and the checksums'
+// signature are verified.
+type selfUpdater struct {
+	releasesURL string
+	client      *http.Client
+	publicKey   ed25519.PublicKey // nil refuses to install unless insecure
+	executable  string
+	current     string
+	goos        string
+	goarch      string
+	// insecure installs without a public key, checking the checksum only.
+	insecure bool
+}
+
+// newSelfUpdaterFromEnv reads SELF_UPDATE_URL, a releases API mirror, and
+// SELF_UPDATE_PUBLIC_KEY.
+func newSelfUpdaterFromEnv() (*selfUpdater, error) {
+	executable, err := os.Executable()
+	if err == nil {
+		executable, err = filepath.EvalSymlinks(executable)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("locating the binary: %w", err)
+	}
+	u := &selfUpdater{
+		releasesURL: strings.TrimSuffix(envString("SELF_UPDATE_URL", DefaultReleasesURL), "/"),
+		client:      &http.Client{Timeout: 5 * time.Minute},
+		executable:  executable,
+		current:     Version,
+		goos:        runtime.GOOS,
+		goarch:      runtime.GOARCH,
+	}
+	if key := envString("SELF_UPDATE_PUBLIC_KEY", ReleaseSigningKey); key != "" {
+		raw, err := base64.StdEncoding.DecodeString(key)
+		if err != nil || len(raw) != ed25519.PublicKeySize {
+			return nil, errors.New("SELF_UPDATE_PUBLIC_KEY is not a base64 Ed25519 public key")
+		}
+		u.publicKey = raw
+	}
+	return u, nil
+}
+
+// latest returns the release tagged version, or the latest release if
+// version is empty.
+func (u *selfUpdater) latest(ctx context.Context, version string) (*release, error) {
+	endpoint := u.releasesURL + "/latest"
+	if version != "" {
+		endpoint = u.releasesURL + "/tags/" + version
+	}
+	body, err := u.get(ctx, endpoint, 1<<20)
+	if err != nil {
+		return nil, err
+	}
+	var r release
+	if err := json.Unmarshal(body, &r); err != nil {
+		return nil, fmt.Errorf("decoding release: %w", err)
+	}
+	if r.TagName == "" {
+		return nil, errors.New("release without a tag")
+	}
+	return &r, nil
+}
+
+// newer reports whether r is newer than the running build. Development
+// builds are older than any release.
+func (u *selfUpdater) newer(r *release) bool {
+	current, err := parseVersion(u.current)
+	if err != nil {
+		return true
+	}
+	latest, err := parseVersion(r.TagName)
+	return err == nil && compareVersions(latest, current) > 0
+}
+
+// install downloads the binary of r, verifies it and atomically replaces
+// the running binary with it.
+func (u *selfUpdater) install(ctx context.Context, r *release) error {
+	name := fmt.Sprintf("flareproxygo-%s-%s", u.goos, u.goarch)
+	binaryURL, err := r.assetURL(name)
+	if err != nil {
+		return err
+	}
+	checksumsURL, err := r.assetURL(checksumsAsset)
+	if err != nil {
+		return err
+	}
+	checksums, err := u.get(ctx, checksumsURL, 1<<20)
+	if err != nil {
+		return err
+	}
+	if u.publicKey != nil {
+		signatureURL, err := r.assetURL(signatureAsset)
+		if err != nil {
+			return err
+		}
+		signature, err := u.get(ctx, signatureURL, 1<<10)
+		if err != nil {
+			return err
+		}
+		if !ed25519.Verify(u.publicKey, checksums, signature) {
+			return fmt.Errorf("invalid signature on the checksums of %s", r.TagName)
+		}
+		// A mirror could otherwise serve an older, vulnerable release
+		// under a newer tag
+		if version := checksumsVersion(checksums); version != r.TagName {
+			return fmt.Errorf("checksums signed for version %q, not %s", version, r.TagName)
+		}
+	} else if u.insecure {
+		slog.Warn("no release signing key configured, only checking the checksum")
+	} else {
+		return errors.New("no release signing key configured, set SELF_UPDATE_PUBLIC_KEY or pass --insecure to only check the checksum")
+	}
+	want, err := checksumFor(checksums, name)
+	if err != nil {
+		return err
+	}
+	binary, err := u.get(ctx, binaryURL, maxBinarySize)
+	if err != nil {
+		return err
+	}
+	if sum := sha256.Sum256(binary); hex.EncodeToString(sum[:]) != want {
+		return fmt.Errorf("checksum mismatch for %s", name)
+	}
+	return replaceExecutable(u.executable, binary)
+}
+
+// get downloads url, failing on responses larger than limit.
+func (u *selfUpdater) get(ctx context.Context, url string, limit int64) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "flareproxygo/"+Version)
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > limit {
+		return nil, fmt.Errorf("GET %s: response larger than %d bytes", url, limit)
+	}
+	return body, nil
+}
+
+// checksumFor returns the hex SHA-256 of name from a sha256sum listing.
+func checksumFor(checksums []byte, name string) (string, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(checksums))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == name {
+			return strings.ToLower(fields[0]), nil
+		}
+	}
+	return "", fmt.Errorf("no checksum for %s", name)
+}
+
+// checksumsVersion returns the release tag of the "version:" line of a
+// checksums file, or "" if it has none.
+func checksumsVersion(checksums []byte) string {
+	scanner := bufio.NewScanner(bytes.NewReader(checksums))
+	for scanner.Scan() {
+		if version, ok := strings.CutPrefix(scanner.Text(), "version:"); ok {
+			return strings.TrimSpace(version)
+		}
+	}
+	return ""
+}
+
+// replaceExecutable writes binary next to path and renames it over path,
+// keeping path's permissions, so that the binary is never half-written.
+func replaceExecutable(path string, binary []byte) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".flareproxygo-update-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(binary)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), info.Mode().Perm())
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// SelfUpdate implements the self-update command: it installs the
+// latest release, or the one given with --version, unless the running
+// build is already as recent. --check only reports whether an update is
+// available. Without a release signing key, it refuses to install unless
+// --insecure is given.
+func SelfUpdate(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("self-update", flag.ContinueOnError)
+	check := flags.Bool("check", false, "only report whether an update is available")
+	version := flags.String("version", "", "install this release, e.g. v1.2.3, even if older")
+	insecure := flags.Bool("insecure", false, "install without a release signing key, checking the checksum only")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	u, err := newSelfUpdaterFromEnv()
+	if err != nil {
+		return err
+	}
+	u.insecure = *insecure
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+	r, err := u.latest(ctx, *version)
+	if err != nil {
+		return err
+	}
+	if *version == "" && !u.newer(r) {
+		fmt.Fprintf(stdout, "flareproxygo %s is up to date\n", u.current)
+		return nil
+	}
+	if *check {
+		fmt.Fprintf(stdout, "flareproxygo %s is available, running %s\n", r.TagName, u.current)
+		return nil
+	}
+	if err := u.install(ctx, r); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "updated %s from %s to %s, restart to use it\n", u.executable, u.current, r.TagName)
+	return nil
+}
@@ -0,0 +1,176 @@
+package flareproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// mockReleases serves a GitHub releases API with one release, v1.2.0,
+// whose assets can be tampered with.
+type mockReleases struct {
+	server    *httptest.Server
+	key       ed25519.PrivateKey
+	binary    []byte
+	checksums []byte
+	signature []byte
+}
+
+func newMockReleases(t *testing.T) *mockReleases {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mockReleases{key: key, binary: []byte("#!/bin/sh\necho v1.2.0\n")}
+	sum := sha256.Sum256(m.binary)
+	m.checksums = []byte("version: v1.2.0\n0123abcd  flareproxygo-darwin-arm64\n" + hex.EncodeToString(sum[:]) + "  flareproxygo-linux-amd64\n")
+	m.signature = ed25519.Sign(key, m.checksums)
+	m.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/releases/latest", "/releases/tags/v1.2.0":
+			r := release{TagName: "v1.2.0"}
+			for _, name := range []string{"flareproxygo-linux-amd64", "flareproxygo-darwin-arm64", checksumsAsset, signatureAsset} {
+				r.Assets = append(r.Assets, struct {
+					Name string `json:"name"`
+					URL  string `json:"browser_download_url"`
+				}{name, m.server.URL + "/download/" + name})
+			}
+			json.NewEncoder(w).Encode(r)
+		case "/download/flareproxygo-linux-amd64":
+			w.Write(m.binary)
+		case "/download/" + checksumsAsset:
+			w.Write(m.checksums)
+		case "/download/" + signatureAsset:
+			w.Write(m.signature)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(m.server.Close)
+	return m
+}
+
+func (m *mockReleases) updater(t *testing.T) *selfUpdater {
+	executable := filepath.Join(t.TempDir(), "flareproxygo")
+	if err := os.WriteFile(executable, []byte("old"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return &selfUpdater{
+		releasesURL: m.server.URL + "/releases",
+		client:      m.server.Client(),
+		publicKey:   m.key.Public().(ed25519.PublicKey),
+		executable:  executable,
+		current:     "v1.1.3",
+		goos:        "linux",
+		goarch:      "amd64",
+	}
+}
+
+func TestSelfUpdate(t *testing.T) {
+	m := newMockReleases(t)
+	u := m.updater(t)
+	r, err := u.latest(context.Background(), "")
+	if err != nil || r.TagName != "v1.2.0" {
+		t.Fatalf("latest() = %+v, %v", r, err)
+	}
+	for current, want := range map[string]bool{"v1.1.3": true, "dev": true, "v1.2.0": false, "v2.0.0": false} {
+		u.current = current
+		if got := u.newer(r); got != want {
+			t.Errorf("newer() = %v running %s, want %v", got, current, want)
+		}
+	}
+
+	if err := u.install(context.Background(), r); err != nil {
+		t.Fatalf("install() error = %v", err)
+	}
+	installed, _ := os.ReadFile(u.executable)
+	info, _ := os.Stat(u.executable)
+	if !bytes.Equal(installed, m.binary) || info.Mode().Perm() != 0o755 {
+		t.Errorf("installed %q with mode %s", installed, info.Mode())
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(u.executable)); len(entries) != 1 {
+		t.Errorf("%d files left next to the binary, want only the binary", len(entries))
+	}
+	// --insecure installs without a public key, on the checksum alone
+	u.publicKey, u.insecure = nil, true
+	if err := u.install(context.Background(), r); err != nil {
+		t.Errorf("install() with insecure error = %v", err)
+	}
+}
+
+func TestSelfUpdateVerification(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(m *mockReleases, u *selfUpdater)
+		want   string
+	}{
+		{"tampered binary", func(m *mockReleases, u *selfUpdater) { m.binary = []byte("malware") }, "checksum mismatch"},
+		{"tampered checksums", func(m *mockReleases, u *selfUpdater) {
+			sum := sha256.Sum256([]byte("malware"))
+			m.binary = []byte("malware")
+			m.checksums = []byte(hex.EncodeToString(sum[:]) + "  flareproxygo-linux-amd64\n")
+		}, "invalid signature"},
+		{"release signed for another tag", func(m *mockReleases, u *selfUpdater) {
+			m.checksums = bytes.Replace(m.checksums, []byte("v1.2.0"), []byte("v1.0.0"), 1)
+			m.signature = ed25519.Sign(m.key, m.checksums)
+		}, `signed for version "v1.0.0"`},
+		{"checksums without a version", func(m *mockReleases, u *selfUpdater) {
+			m.checksums = bytes.Replace(m.checksums, []byte("version: v1.2.0\n"), nil, 1)
+			m.signature = ed25519.Sign(m.key, m.checksums)
+		}, `signed for version ""`},
+		{"unsupported platform", func(m *mockReleases, u *selfUpdater) { u.goos = "plan9" }, "no asset flareproxygo-plan9-amd64"},
+		{"platform without checksum", func(m *mockReleases, u *selfUpdater) { u.goos, u.goarch = "darwin", "arm64" }, "GET"},
+		{"no public key", func(m *mockReleases, u *selfUpdater) { u.publicKey = nil }, "no release signing key"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMockReleases(t)
+			u := m.updater(t)
+			tt.tamper(m, u)
+			r, err := u.latest(context.Background(), "v1.2.0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := u.install(context.Background(), r); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("install() error = %v, want %q", err, tt.want)
+			}
+			if installed, _ := os.ReadFile(u.executable); string(installed) != "old" {
+				t.Errorf("binary replaced with %q", installed)
+			}
+		})
+	}
+}
+
+func TestRunSelfUpdateCheck(t *testing.T) {
+	m := newMockReleases(t)
+	t.Setenv("SELF_UPDATE_URL", m.server.URL+"/releases/")
+	t.Setenv("SELF_UPDATE_PUBLIC_KEY", base64.StdEncoding.EncodeToString(m.key.Public().(ed25519.PublicKey)))
+	defer func(version string) { Version = version }(Version)
+
+	var out bytes.Buffer
+	Version = "v1.1.0"
+	if err := SelfUpdate([]string{"--check"}, &out); err != nil || !strings.Contains(out.String(), "v1.2.0 is available") {
+		t.Errorf("SelfUpdate(--check) = %v, printed %q", err, out.String())
+	}
+	out.Reset()
+	Version = "v1.2.0"
+	if err := SelfUpdate(nil, &out); err != nil || !strings.Contains(out.String(), "up to date") {
+		t.Errorf("SelfUpdate() = %v, printed %q", err, out.String())
+	}
+
+	t.Setenv("SELF_UPDATE_PUBLIC_KEY", "not a key")
+	if err := SelfUpdate([]string{"--check"}, &out); err == nil {
+		t.Error("SelfUpdate() accepted an invalid public key")
+	}
+}
@@ -0,0 +1,333 @@
+// Package flareproxy is the FlareSolverr adapter behind the flareproxygo
+// command, as a library: its handlers, server, client and transport. The
+// package is named flareproxy rather than after its import path,
+// github.com/kljensen/flareproxygo, so import it with that name:
+//
+//	import flareproxy "github.com/kljensen/flareproxygo"
+package flareproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultFlareSolverrURL is the FlareSolverr endpoint used when none is
+// configured, its name in Docker Compose setups.
+const DefaultFlareSolverrURL = "http://flaresolverr:8191/v1"
+
+// Config selects the FlareSolverr instances and the listeners a Server
+// runs, and optionally its cache, rate limits, domain rules and upstream
+// proxies. Options left nil, and everything else, are configured through
+// the environment variables documented in the README, which the config
+// file can set.
+type Config struct {
+	// FlareSolverrURL is the FlareSolverr endpoint, or a comma separated
+	// list of instances to balance across. Config reloads keep it unless
+	// the config file sets flaresolverr.urls.
+	FlareSolverrURL string
+	// Port serves the direct routing mode; empty disables it.
+	Port string
+	// ProxyPort serves the HTTP proxy mode; empty disables it.
+	ProxyPort string
+	// SOCKSPort serves the SOCKS5 front-end; empty disables it.
+	SOCKSPort string
+	// AdminPort serves the admin API, if AdminToken is set too.
+	AdminPort  string
+	AdminToken string
+	// ConfigFile is the TOML or JSON config file that was loaded, which
+	// the admin API and SIGHUP reload.
+	ConfigFile string
+	// ShutdownTimeout is how long in-flight requests may take to finish
+	// once Run's context is done.
+	ShutdownTimeout time.Duration
+	// SelfTest asks to run the self-test before serving.
+	SelfTest bool
+
+	// Cache configures the response cache; nil reads CacheOptionsFromEnv.
+	Cache *CacheOptions
+	// RateLimits configures the per-domain rate limits; nil reads
+	// RateLimitOptionsFromEnv, again on every reload.
+	RateLimits *RateLimitOptions
+	// Rules configures domain rules; nil reads RuleOptionsFromEnv, again
+	// on every reload.
+	Rules *RuleOptions
+	// Upstreams configures the upstream proxies; nil reads
+	// UpstreamOptionsFromEnv, again on every reload.
+	Upstreams *UpstreamOptions
+}
+
+// cacheOptions returns the cache options of c, from the environment
+// unless c sets them.
+func (c Config) cacheOptions() CacheOptions {
+	if c.Cache != nil {
+		return *c.Cache
+	}
+	return CacheOptionsFromEnv()
+}
+
+// rateLimitOptions returns the rate limit options of c, from the
+// environment unless c sets them.
+func (c Config) rateLimitOptions() RateLimitOptions {
+	if c.RateLimits != nil {
+		return *c.RateLimits
+	}
+	return RateLimitOptionsFromEnv()
+}
+
+// ruleOptions returns the domain rules of c, from the environment unless
+// c sets them.
+func (c Config) ruleOptions() RuleOptions {
+	if c.Rules != nil {
+		return *c.Rules
+	}
+	return RuleOptionsFromEnv()
+}
+
+// upstreamOptions returns the upstream proxy options of c, from the
+// environment unless c sets them.
+func (c Config) upstreamOptions() UpstreamOptions {
+	if c.Upstreams != nil {
+		return *c.Upstreams
+	}
+	return UpstreamOptionsFromEnv()
+}
+
+// ConfigFromEnv reads the Config from FLARESOLVERR_URL, PORT, PROXY_PORT,
+// SOCKS_PORT, ADMIN_PORT, ADMIN_TOKEN, CONFIG_FILE, SHUTDOWN_TIMEOUT and
+// SELFTEST. It leaves the options nil, so that they follow the
+// environment across reloads.
+func ConfigFromEnv() Config {
+	return Config{
+		FlareSolverrURL: envString("FLARESOLVERR_URL", DefaultFlareSolverrURL),
+		Port:            envString("PORT", "8080"),
+		ProxyPort:       os.Getenv("PROXY_PORT"),
+		SOCKSPort:       os.Getenv("SOCKS_PORT"),
+		AdminPort:       os.Getenv("ADMIN_PORT"),
+		AdminToken:      os.Getenv("ADMIN_TOKEN"),
+		ConfigFile:      os.Getenv("CONFIG_FILE"),
+		ShutdownTimeout: envDuration("SHUTDOWN_TIMEOUT", 30*time.Second),
+		SelfTest:        envBool("SELFTEST", false),
+	}
+}
+
+// LoadConfigFile sets the environment variables of the TOML or JSON
+// config file at path, except those already set. An empty path loads
+// nothing.
+func LoadConfigFile(path string) error {
+	return loadConfigFile(path)
+}
+
+// SetupLogging installs the default structured logger configured through
+// LOG_FORMAT and LOG_LEVEL.
+func SetupLogging() {
+	setupLogging()
+}
+
+// Server is the proxy: its handlers share one solver, and so its cache,
+// sessions, rate limits and backends. The handlers can be mounted in
+// another service's mux, or served on their own ports with Run.
+type Server struct {
+	cfg    Config
+	solver *solver
+	// Direct serves the direct routing mode, /domain.com/path, and the
+	// JSON APIs.
+	Direct *DirectHandler
+	// Proxy serves the HTTP proxy mode.
+	Proxy *ProxyHandler
+}
+
+// NewServer creates a server for cfg.
+func NewServer(cfg Config) *Server {
+	if cfg.FlareSolverrURL == "" {
+		cfg.FlareSolverrURL = DefaultFlareSolverrURL
+	}
+	s := newSolverFor(cfg)
+	return &Server{
+		cfg:    cfg,
+		solver: s,
+		Direct: newDirectHandler(s),
+		Proxy:  newProxyHandler(s),
+	}
+}
+
+// Admin returns the admin API handler, which requires token as a bearer
+// token.
+func (s *Server) Admin(token string) http.Handler {
+	return newAdminHandler(s.solver, token, s.Reload)
+}
+
+// Reload re-reads the config file and applies the settings that can be
+// changed at runtime.
+func (s *Server) Reload() error {
+	return s.solver.reload(s.cfg.ConfigFile)
+}
+
+// SetCacheKeyFunc makes f compute the cache keys of the server's
+// handlers, client and transport. It must be called before they are used.
+func (s *Server) SetCacheKeyFunc(f CacheKeyFunc) {
+	s.solver.cacheKeyFunc = f
+}
+
+// Client returns a client fetching pages through the server's solver.
+func (s *Server) Client() *Client {
+	return &Client{solver: s.solver}
+}
+
+// SelfTest checks the configuration, solves a canary URL, and checks the
+// cache store and TLS material, within SELFTEST_TIMEOUT. It writes a JSON
+// report to w and returns whether every critical check passed.
+func (s *Server) SelfTest(ctx context.Context, w io.Writer) bool {
+	ctx, cancel := context.WithTimeout(ctx, envDuration("SELFTEST_TIMEOUT", 90*time.Second))
+	defer cancel()
+	report := runSelfTest(ctx, s.solver)
+	report.write(w)
+	return report.OK
+}
+
+// Run serves the configured listeners until ctx is done, then lets
+// in-flight requests finish and tears down the FlareSolverr sessions the
+// server created.
+func (s *Server) Run(ctx context.Context) error {
+	solver := s.solver
+
+	// Check the backends run a FlareSolverr version within the pinned range
+	checkCtx, cancelCheck := context.WithTimeout(ctx, envDuration("READINESS_TIMEOUT", 5*time.Second))
+	err := solver.versions.check(checkCtx, solver)
+	cancelCheck()
+	if err != nil {
+		return fmt.Errorf("refusing to start: %w", err)
+	}
+
+	// Serve HTTPS if a certificate is configured
+	serverTLS, err := newListenerTLSFromEnv(solver.monitor)
+	if err != nil {
+		return fmt.Errorf("invalid TLS configuration: %w", err)
+	}
+
+	// Keep rate limits across restarts. The state is saved once more after
+	// the servers stopped, so it includes the requests drained on shutdown.
+	persistCtx, stopPersist := context.WithCancel(context.Background())
+	persisted := make(chan struct{})
+	if stateFile := os.Getenv("RATE_LIMIT_STATE_FILE"); stateFile != "" {
+		if err := solver.rateLimits.load(stateFile); err != nil {
+			slog.Warn("failed to restore rate limiter state", "path", stateFile, "error", err)
+		}
+		go func() {
+			defer close(persisted)
+			solver.rateLimits.persist(persistCtx, stateFile, envDuration("RATE_LIMIT_STATE_INTERVAL", 30*time.Second))
+		}()
+	} else {
+		close(persisted)
+	}
+
+	// Pre-warm sessions in the background so startup is not delayed
+	go solver.keepWarm(ctx, prewarmDomains(), envDuration("PREWARM_INTERVAL", 10*time.Minute))
+	go solver.collectSessions(ctx)
+	go solver.prefetch(ctx, envDuration("PREFETCH_INTERVAL", 30*time.Minute))
+	go solver.versions.watch(ctx, solver, envDuration("FLARESOLVERR_VERSION_CHECK_INTERVAL", 5*time.Minute))
+	go serverTLS.run(ctx)
+	scheme := serverTLS.scheme()
+	maxHeaderBytes := maxHeaderBytesFromEnv()
+
+	servers := make(map[string]server)
+	if s.cfg.Port != "" {
+		servers["direct"] = serverTLS.wrap(&http.Server{
+			Addr:           ":" + s.cfg.Port,
+			Handler:        withRequestLogging("direct", s.Direct),
+			MaxHeaderBytes: maxHeaderBytes,
+		})
+		slog.Info("FlareProxy adapter (direct mode) running", "port", s.cfg.Port,
+			"usage", scheme+"://localhost:"+s.cfg.Port+"/domain.com/path")
+	}
+	if s.cfg.ProxyPort != "" {
+		servers["proxy"] = serverTLS.wrap(&http.Server{
+			Addr:           ":" + s.cfg.ProxyPort,
+			Handler:        withRequestLogging("proxy", s.Proxy),
+			MaxHeaderBytes: maxHeaderBytes,
+		})
+		slog.Info("FlareProxy adapter (proxy mode) running", "port", s.cfg.ProxyPort,
+			"usage", "Set "+scheme+"://localhost:"+s.cfg.ProxyPort+" as HTTP proxy")
+	}
+	if s.cfg.SOCKSPort != "" {
+		servers["socks"] = newSOCKSServer(":"+s.cfg.SOCKSPort, s.Proxy)
+		slog.Info("FlareProxy adapter (SOCKS5 mode) running", "port", s.cfg.SOCKSPort,
+			"usage", "Set socks5h://localhost:"+s.cfg.SOCKSPort+" as proxy")
+	}
+
+	// Start admin server if ADMIN_PORT is configured
+	if s.cfg.AdminPort != "" {
+		if s.cfg.AdminToken == "" {
+			slog.Warn("ADMIN_PORT is set but ADMIN_TOKEN is not, admin API disabled")
+		} else {
+			servers["admin"] = serverTLS.wrap(&http.Server{
+				Addr:           ":" + s.cfg.AdminPort,
+				Handler:        withRequestLogging("admin", s.Admin(s.cfg.AdminToken)),
+				MaxHeaderBytes: maxHeaderBytes,
+			})
+			slog.Info("FlareProxy admin API running", "port", s.cfg.AdminPort)
+		}
+	}
+
+	// Serve until ctx is done, then let in-flight requests finish
+	err = serve(ctx, servers, s.cfg.ShutdownTimeout)
+
+	// Tear down the sessions this proxy created and save the rate limiter
+	// state one last time
+	teardownCtx, cancel := context.WithTimeout(context.Background(), s.cfg.ShutdownTimeout)
+	defer cancel()
+	solver.destroySessions(teardownCtx)
+	stopPersist()
+	<-persisted
+	return err
+}
+
+// server is a listener run by serve, e.g. an *http.Server.
+type server interface {
+	ListenAndServe() error
+	Shutdown(ctx context.Context) error
+}
+
+// serve runs the servers until ctx is done, then shuts them down, waiting
+// up to drainTimeout for in-flight requests to finish. It returns early
+// with an error if a server fails.
+func serve(ctx context.Context, servers map[string]server, drainTimeout time.Duration) error {
+	failed := make(chan error, len(servers))
+	for name, srv := range servers {
+		name, srv := name, srv
+		go func() {
+			if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				failed <- fmt.Errorf("%s server: %w", name, err)
+			}
+		}()
+	}
+
+	select {
+	case err := <-failed:
+		return err
+	case <-ctx.Done():
+	}
+
+	slog.Info("shutting down, draining connections", "timeout", drainTimeout.String())
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for name, srv := range servers {
+		name, srv := name, srv
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := srv.Shutdown(shutdownCtx); err != nil {
+				slog.Warn("server did not drain in time", "server", name, "error", err)
+			}
+		}()
+	}
+	wg.Wait()
+	return nil
+}
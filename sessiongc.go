@@ -0,0 +1,149 @@
+package flareproxy
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kljensen/flareproxygo/flaresolverr"
+)
+
+// sessionGC destroys the sessions this proxy created once they are too
+// old, idle for too long or too many, since every session keeps a browser
+// open on its backend and browsers grow over days. With SESSION_GC_ORPHANS,
+// sessions found on a backend with this proxy's prefix that it does not
+// know of, left by an earlier run, are destroyed too.
+type sessionGC struct {
+	interval time.Duration
+	maxAge   time.Duration
+	maxIdle  time.Duration
+	maxCount int
+	// collectOrphans is off by default: other replicas sharing the
+	// backends, and the instance sessions were handed off to, hold
+	// sessions with the same prefix.
+	collectOrphans bool
+	// orphans are the unknown sessions seen in the last round; they are
+	// only destroyed when seen twice, so that a session being warmed is
+	// left alone.
+	orphans map[string]bool
+}
+
+// newSessionGCFromEnv reads SESSION_MAX_AGE, SESSION_MAX_IDLE,
+// SESSION_MAX_COUNT and SESSION_GC_ORPHANS, checked every
+// SESSION_GC_INTERVAL. It returns nil, keeping sessions until shutdown, if
+// none is set.
+func newSessionGCFromEnv() *sessionGC {
+	gc := &sessionGC{
+		interval:       envDuration("SESSION_GC_INTERVAL", 5*time.Minute),
+		maxAge:         envDuration("SESSION_MAX_AGE", 0),
+		maxIdle:        envDuration("SESSION_MAX_IDLE", 0),
+		maxCount:       envInt("SESSION_MAX_COUNT", 0),
+		collectOrphans: envBool("SESSION_GC_ORPHANS", false),
+		orphans:        make(map[string]bool),
+	}
+	if gc.maxAge <= 0 && gc.maxIdle <= 0 && gc.maxCount <= 0 && !gc.collectOrphans {
+		return nil
+	}
+	if gc.interval <= 0 {
+		gc.interval = 5 * time.Minute
+	}
+	return gc
+}
+
+// full reports whether pool holds SESSION_MAX_COUNT sessions, so that no
+// more may be created.
+func (gc *sessionGC) full(pool *sessionPool) bool {
+	return gc != nil && gc.maxCount > 0 && pool.count() >= gc.maxCount
+}
+
+// expired returns the sessions of the pool to destroy, with the reason:
+// those over the age or idle limit, then the least recently used ones
+// beyond the count limit.
+func (gc *sessionGC) expired(p *sessionPool) map[string]string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := p.now()
+	expired := make(map[string]string)
+	var live []string
+	for session := range p.created {
+		switch {
+		case gc.maxAge > 0 && now.Sub(p.born[session]) >= gc.maxAge:
+			expired[session] = "max age"
+		case gc.maxIdle > 0 && now.Sub(p.used[session]) >= gc.maxIdle:
+			expired[session] = "max idle"
+		default:
+			live = append(live, session)
+		}
+	}
+	if gc.maxCount > 0 && len(live) > gc.maxCount {
+		sort.Slice(live, func(i, j int) bool { return p.used[live[i]].Before(p.used[live[j]]) })
+		for _, session := range live[:len(live)-gc.maxCount] {
+			expired[session] = "max count"
+		}
+	}
+	return expired
+}
+
+// collectSessions destroys the sessions over their limits every
+// SESSION_GC_INTERVAL until ctx is done.
+func (s *solver) collectSessions(ctx context.Context) {
+	if s.sessionGC == nil {
+		return
+	}
+	if s.dialect != nil && !s.dialect.Supports(flaresolverr.CmdSessionsDestroy) {
+		return
+	}
+	ticker := time.NewTicker(s.sessionGC.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.collectSessionsOnce(ctx)
+		}
+	}
+}
+
+// collectSessionsOnce runs one round of session garbage collection.
+func (s *solver) collectSessionsOnce(ctx context.Context) {
+	gc := s.sessionGC
+	for session, reason := range gc.expired(s.sessions) {
+		if err := s.destroySession(ctx, session); err != nil {
+			slog.Warn("failed to destroy session", "session", session, "reason", reason, "error", err)
+			continue
+		}
+		slog.Info("session collected", "session", session, "reason", reason)
+	}
+
+	if !gc.collectOrphans || (s.dialect != nil && !s.dialect.Supports(flaresolverr.CmdSessionsList)) {
+		return
+	}
+	orphans := make(map[string]bool)
+	for _, b := range s.backends.all() {
+		listed, err := s.solveOn(ctx, b, FlareSolverrRequest{Cmd: flaresolverr.CmdSessionsList})
+		if err != nil {
+			slog.Warn("failed to list sessions", "backend", b.url, "error", err)
+			continue
+		}
+		for _, session := range listed.Sessions {
+			if !strings.HasPrefix(session, sessionID("")) || s.sessions.backendFor(session) == b.url {
+				continue
+			}
+			key := b.url + " " + session
+			if !gc.orphans[key] {
+				orphans[key] = true
+				continue
+			}
+			_, err := s.solveOn(ctx, b, FlareSolverrRequest{Cmd: flaresolverr.CmdSessionsDestroy, Session: session})
+			if err != nil {
+				slog.Warn("failed to destroy session", "session", session, "backend", b.url, "reason", "orphaned", "error", err)
+				continue
+			}
+			slog.Info("session collected", "session", session, "backend", b.url, "reason", "orphaned")
+		}
+	}
+	gc.orphans = orphans
+}
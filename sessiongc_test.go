@@ -0,0 +1,116 @@
+package flareproxy
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/kljensen/flareproxygo/flaresolverr/flaresolverrtest"
+)
+
+func TestSessionGC(t *testing.T) {
+	fs := flaresolverrtest.NewServer()
+	defer fs.Close()
+	t.Setenv("FLARESOLVERR_URL", fs.Endpoint())
+	t.Setenv("SESSION_MAX_AGE", "1h")
+	t.Setenv("SESSION_MAX_IDLE", "10m")
+	t.Setenv("SESSION_MAX_COUNT", "2")
+	t.Setenv("SESSION_GC_ORPHANS", "true")
+	s := newSolver()
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	s.sessions.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	for _, domain := range []string{"a.example", "b.example", "c.example"} {
+		s.warm(ctx, domain)
+	}
+	b := s.backends.all()[0]
+	for _, session := range []string{"flareproxygo-old.example", "client-session"} {
+		if _, err := s.solveOn(ctx, b, FlareSolverrRequest{Cmd: "sessions.create", Session: session}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []string{"client-session", "flareproxygo-a.example", "flareproxygo-b.example", "flareproxygo-old.example"}
+	if got := fs.Sessions(); !slices.Equal(got, want) {
+		t.Fatalf("sessions = %v, want %v with c.example over the count", got, want)
+	}
+
+	// b.example goes idle; the orphan is only destroyed when seen again
+	now = now.Add(11 * time.Minute)
+	s.sessions.touch("flareproxygo-a.example")
+	s.collectSessionsOnce(ctx)
+	want = []string{"client-session", "flareproxygo-a.example", "flareproxygo-old.example"}
+	if got := fs.Sessions(); !slices.Equal(got, want) {
+		t.Errorf("sessions after the idle limit = %v, want %v", got, want)
+	}
+	s.collectSessionsOnce(ctx)
+	want = []string{"client-session", "flareproxygo-a.example"}
+	if got := fs.Sessions(); !slices.Equal(got, want) {
+		t.Errorf("sessions after the orphan was seen twice = %v, want %v", got, want)
+	}
+
+	// Refreshing a session keeps its age
+	now = now.Add(50 * time.Minute)
+	s.warm(ctx, "a.example")
+	s.collectSessionsOnce(ctx)
+	want = []string{"client-session"}
+	if got := fs.Sessions(); !slices.Equal(got, want) || s.sessions.count() != 0 {
+		t.Errorf("sessions after the age limit = %v, want %v", got, want)
+	}
+}
+
+func TestSessionGCHandedOff(t *testing.T) {
+	fs := flaresolverrtest.NewServer()
+	defer fs.Close()
+	t.Setenv("FLARESOLVERR_URL", fs.Endpoint())
+	t.Setenv("SESSION_MAX_AGE", "1h")
+	t.Setenv("SESSION_MAX_IDLE", "10m")
+	s := newSolver()
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	s.sessions.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	// Sessions of another instance are left alone, twice seen or not
+	b := s.backends.all()[0]
+	if _, err := s.solveOn(ctx, b, FlareSolverrRequest{Cmd: "sessions.create", Session: "flareproxygo-replica.example"}); err != nil {
+		t.Fatal(err)
+	}
+	s.collectSessionsOnce(ctx)
+	s.collectSessionsOnce(ctx)
+	if got := fs.Sessions(); !slices.Equal(got, []string{"flareproxygo-replica.example"}) {
+		t.Errorf("sessions = %v, want the other instance's session kept", got)
+	}
+
+	// A session handed off to this instance ages from its import
+	s.sessions.restore(adminSession{ID: "flareproxygo-replica.example", Backend: b.url, Domains: []string{"replica.example"}})
+	s.collectSessionsOnce(ctx)
+	if got := fs.Sessions(); !slices.Equal(got, []string{"flareproxygo-replica.example"}) {
+		t.Errorf("sessions = %v, want the imported session kept", got)
+	}
+	now = now.Add(11 * time.Minute)
+	s.collectSessionsOnce(ctx)
+	if got := fs.Sessions(); len(got) != 0 {
+		t.Errorf("sessions = %v, want the imported session collected once idle", got)
+	}
+}
+
+func TestSessionGCMaxCount(t *testing.T) {
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	pool := newSessionPool()
+	pool.now = func() time.Time { return now }
+	for _, domain := range []string{"a.example", "b.example", "c.example"} {
+		pool.add(domain, sessionID(domain), "http://flaresolverr:8191/v1")
+		now = now.Add(time.Minute)
+	}
+	pool.touch(sessionID("a.example"))
+
+	gc := &sessionGC{maxCount: 2}
+	got := gc.expired(pool)
+	if len(got) != 1 || got[sessionID("b.example")] != "max count" {
+		t.Errorf("expired = %v, want the least recently used session", got)
+	}
+	if !gc.full(pool) || (*sessionGC)(nil).full(pool) {
+		t.Error("full() wrong")
+	}
+}
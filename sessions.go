@@ -0,0 +1,252 @@
+package flareproxy
+
+import (
+	"context"
+	"log/slog"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kljensen/flareproxygo/flaresolverr"
+)
+
+// sessionPool tracks the FlareSolverr sessions this proxy created. Warm
+// sessions keep a browser with solved challenges for a domain, so requests
+// to it are answered without solving again.
+type sessionPool struct {
+	mu       sync.Mutex
+	byDomain map[string]string
+	// created maps each session to the URL of the backend holding it
+	created map[string]string
+	// born and used are when each session was created and last used
+	born map[string]time.Time
+	used map[string]time.Time
+	now  func() time.Time
+}
+
+func newSessionPool() *sessionPool {
+	return &sessionPool{
+		byDomain: make(map[string]string),
+		created:  make(map[string]string),
+		born:     make(map[string]time.Time),
+		used:     make(map[string]time.Time),
+		now:      time.Now,
+	}
+}
+
+// sessionFor returns the warm session for the host of targetURL, if any.
+// A session for a domain also serves its subdomains.
+func (p *sessionPool) sessionFor(targetURL string) string {
+	u, err := url.Parse(targetURL)
+	if err != nil {
+		return ""
+	}
+	host := strings.ToLower(u.Hostname())
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for {
+		if session, ok := p.byDomain[host]; ok {
+			return session
+		}
+		_, parent, ok := strings.Cut(host, ".")
+		if !ok {
+			return ""
+		}
+		host = parent
+	}
+}
+
+// add records session, holding domain's warm browser on the backend at
+// backendURL. Adding a session again, when it is refreshed, keeps its
+// age.
+func (p *sessionPool) add(domain, session, backendURL string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.byDomain[domain] = session
+	p.created[session] = backendURL
+	now := p.now()
+	if _, ok := p.born[session]; !ok {
+		p.born[session] = now
+	}
+	p.used[session] = now
+}
+
+// touch records that a request used session, if this proxy created it.
+func (p *sessionPool) touch(session string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.created[session]; ok {
+		p.used[session] = p.now()
+	}
+}
+
+// has reports whether this proxy created session.
+func (p *sessionPool) has(session string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, ok := p.created[session]
+	return ok
+}
+
+// count returns the number of sessions this proxy created.
+func (p *sessionPool) count() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.created)
+}
+
+// backendFor returns the URL of the backend holding session.
+func (p *sessionPool) backendFor(session string) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.created[session]
+}
+
+func (p *sessionPool) remove(session string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.created, session)
+	delete(p.born, session)
+	delete(p.used, session)
+	for domain, s := range p.byDomain {
+		if s == session {
+			delete(p.byDomain, domain)
+		}
+	}
+}
+
+// Created returns the IDs of the sessions this proxy created.
+func (p *sessionPool) Created() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	sessions := make([]string, 0, len(p.created))
+	for session := range p.created {
+		sessions = append(sessions, session)
+	}
+	return sessions
+}
+
+// adminSession describes a session in the admin API.
+type adminSession struct {
+	ID      string   `json:"id"`
+	Backend string   `json:"backend"`
+	Domains []string `json:"domains"`
+}
+
+// list describes the sessions this proxy created, sorted by ID.
+func (p *sessionPool) list() []adminSession {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	sessions := make([]adminSession, 0, len(p.created))
+	for id, backend := range p.created {
+		session := adminSession{ID: id, Backend: backend, Domains: []string{}}
+		for domain, s := range p.byDomain {
+			if s == id {
+				session.Domains = append(session.Domains, domain)
+			}
+		}
+		sort.Strings(session.Domains)
+		sessions = append(sessions, session)
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].ID < sessions[j].ID })
+	return sessions
+}
+
+// prewarmDomains returns the domains listed in PREWARM_DOMAINS.
+func prewarmDomains() []string {
+	var domains []string
+	for _, domain := range splitList(os.Getenv("PREWARM_DOMAINS")) {
+		domains = append(domains, strings.ToLower(domain))
+	}
+	return domains
+}
+
+// sessionID returns the session ID used for a pre-warmed domain.
+func sessionID(domain string) string {
+	return "flareproxygo-" + domain
+}
+
+// keepWarm creates a session per domain and solves the domain's front
+// page in it, then re-solves every interval so the clearance stays fresh.
+// It returns when ctx is done.
+func (s *solver) keepWarm(ctx context.Context, domains []string, interval time.Duration) {
+	if len(domains) == 0 {
+		return
+	}
+	if s.dialect != nil && !s.dialect.Supports(flaresolverr.CmdSessionsCreate) {
+		slog.Warn("ignoring PREWARM_DOMAINS, the solver has no sessions", "solver", s.dialect.Name())
+		return
+	}
+	for {
+		for _, domain := range domains {
+			s.warm(ctx, domain)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// warm makes sure the session for domain exists and has solved its
+// challenge. The session is only used for requests once this succeeded.
+func (s *solver) warm(ctx context.Context, domain string) {
+	session := sessionID(domain)
+	start := time.Now()
+	if !s.sessions.has(session) && s.sessionGC.full(s.sessions) {
+		slog.Warn("not warming session, SESSION_MAX_COUNT reached", "domain", domain, "session", session)
+		return
+	}
+
+	// Refresh on the backend already holding the session, if any
+	b, err := s.backendFor(ctx, FlareSolverrRequest{Session: session})
+	if err != nil {
+		slog.Warn("failed to warm session", "domain", domain, "session", session, "error", err)
+		return
+	}
+	_, err = s.solveOn(ctx, b, FlareSolverrRequest{Cmd: "sessions.create", Session: session})
+	if err == nil {
+		_, err = s.solveOn(ctx, b, FlareSolverrRequest{
+			Cmd:        "request.get",
+			URL:        "https://" + domain + "/",
+			MaxTimeout: int(s.maxTimeout.Milliseconds()),
+			Session:    session,
+		})
+	}
+	if err != nil {
+		slog.Warn("failed to warm session", "domain", domain, "session", session, "error", err)
+		return
+	}
+	s.sessions.add(domain, session, b.url)
+	slog.Info("session warmed", "domain", domain, "session", session, "backend", b.url,
+		"duration_ms", time.Since(start).Milliseconds())
+}
+
+// destroySession asks FlareSolverr to close a session's browser.
+func (s *solver) destroySession(ctx context.Context, session string) error {
+	requestData := FlareSolverrRequest{Cmd: "sessions.destroy", Session: session}
+	b, err := s.backendFor(ctx, requestData)
+	s.sessions.remove(session)
+	if err != nil {
+		return err
+	}
+	_, err = s.solveOn(ctx, b, requestData)
+	return err
+}
+
+// destroySessions destroys every session this proxy created, so their
+// browsers do not linger on the backends after shutdown.
+func (s *solver) destroySessions(ctx context.Context) {
+	for _, session := range s.sessions.Created() {
+		if err := s.destroySession(ctx, session); err != nil {
+			slog.Warn("failed to destroy session", "session", session, "error", err)
+			continue
+		}
+		slog.Info("session destroyed", "session", session)
+	}
+}
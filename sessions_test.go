@@ -0,0 +1,103 @@
+package flareproxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSessionPrewarming(t *testing.T) {
+	var mu sync.Mutex
+	var requests []FlareSolverrRequest
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req FlareSolverrRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		mu.Lock()
+		requests = append(requests, req)
+		mu.Unlock()
+
+		if req.URL == "https://down.example/" {
+			json.NewEncoder(w).Encode(FlareSolverrResponse{Status: "error", Message: "Timeout"})
+			return
+		}
+		switch req.Cmd {
+		case "sessions.create", "sessions.destroy":
+			w.Write([]byte(`{"status":"ok","message":"","session":"` + req.Session + `"}`))
+		default:
+			json.NewEncoder(w).Encode(testResponse("<html></html>"))
+		}
+	}))
+	defer mockServer.Close()
+	t.Setenv("FLARESOLVERR_URL", mockServer.URL)
+
+	s := newSolver()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.keepWarm(ctx, []string{"warm.example", "down.example"}, time.Hour)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for s.sessions.sessionFor("https://warm.example/") == "" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"https://warm.example/page", "flareproxygo-warm.example"},
+		{"https://www.warm.example/page", "flareproxygo-warm.example"},
+		{"https://down.example/", ""},
+		{"https://other.example/", ""},
+	}
+	for _, tt := range tests {
+		if got := s.sessions.sessionFor(tt.url); got != tt.want {
+			t.Errorf("sessionFor(%q) = %q, want %q", tt.url, got, tt.want)
+		}
+	}
+
+	// Requests to warm domains are sent in the warm session
+	mu.Lock()
+	requests = nil
+	mu.Unlock()
+	if _, _, err := s.fetch(context.Background(), "request.get", "https://warm.example/page"); err != nil {
+		t.Fatalf("fetch() error = %v", err)
+	}
+	mu.Lock()
+	if len(requests) != 1 || requests[0].Session != "flareproxygo-warm.example" {
+		t.Errorf("fetch sent %+v, want request in warm session", requests)
+	}
+	mu.Unlock()
+
+	if created := s.sessions.Created(); len(created) != 1 {
+		t.Errorf("Created() = %v, want one session", created)
+	}
+	if err := s.destroySession(context.Background(), "flareproxygo-warm.example"); err != nil {
+		t.Fatalf("destroySession() error = %v", err)
+	}
+	if got := s.sessions.sessionFor("https://warm.example/"); got != "" {
+		t.Errorf("destroyed session still used: %q", got)
+	}
+	// On shutdown every remaining session is destroyed
+	s.warm(context.Background(), "warm.example")
+	mu.Lock()
+	requests = nil
+	mu.Unlock()
+	s.destroySessions(context.Background())
+	if created := s.sessions.Created(); len(created) != 0 {
+		t.Errorf("Created() = %v after destroySessions()", created)
+	}
+	mu.Lock()
+	if len(requests) != 1 || requests[0].Cmd != "sessions.destroy" {
+		t.Errorf("destroySessions() sent %+v", requests)
+	}
+	mu.Unlock()
+}
@@ -0,0 +1,218 @@
+package flareproxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Fetch modes selected through FETCH_MODE.
+const (
+	// FetchModeSolver sends every request to FlareSolverr.
+	FetchModeSolver = "solver"
+	// FetchModeSmart fetches pages directly and only uses FlareSolverr when
+	// the origin answers with a challenge.
+	FetchModeSmart = "smart"
+	// FetchModeReuse solves a domain once, then fetches its pages directly
+	// with the clearance cookies and User-Agent of the solve until they
+	// expire or a challenge reappears.
+	FetchModeReuse = "reuse"
+)
+
+// DirectBackend is reported as the backend of pages fetched without
+// FlareSolverr.
+const DirectBackend = "direct"
+
+// defaultUserAgent is sent on direct fetches unless the User-Agent policy
+// says otherwise. Origins treat clients without a browser User-Agent with
+// suspicion, so this mimics a current desktop Chrome.
+const defaultUserAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36"
+
+// challengeMarkers are fragments of the interstitial pages served by
+// Cloudflare and DDoS-Guard instead of the requested page.
+var challengeMarkers = [][]byte{
+	[]byte("<title>Just a moment...</title>"),
+	[]byte("cf-browser-verification"),
+	[]byte("/cdn-cgi/challenge-platform/"),
+	[]byte("window._cf_chl_opt"),
+	[]byte("<title>DDoS-Guard</title>"),
+	[]byte("ddos-guard/js-challenge"),
+}
+
+// isChallenge reports whether an origin response is a bot challenge
+// rather than the page itself. Challenges come with a 403 or 503 and are
+// flagged by Cloudflare's cf-mitigated header or recognised by markers in
+// the page.
+func isChallenge(status int, header http.Header, body []byte) bool {
+	if status != http.StatusForbidden && status != http.StatusServiceUnavailable {
+		return false
+	}
+	if strings.EqualFold(header.Get("cf-mitigated"), "challenge") {
+		return true
+	}
+	for _, marker := range challengeMarkers {
+		if bytes.Contains(body, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// tryDirect fetches targetURL without FlareSolverr when the fetch mode
+// or the domain's rule allows it. It returns nil when the page has to be
+// solved, which a rule bypassing FlareSolverr turns into errBypassFailed.
+func (s *solver) tryDirect(ctx context.Context, targetURL string) (*FlareSolverrResponse, error) {
+	u, err := url.Parse(targetURL)
+	if err != nil {
+		return nil, nil
+	}
+	if s.ruleFor(targetURL).bypass() {
+		if err := s.rateLimits.wait(ctx, targetURL); err != nil {
+			return nil, err
+		}
+		flareResponse, err := s.fetchDirect(ctx, targetURL, defaultUserAgent, nil)
+		if flareResponse == nil && err == nil {
+			err = errBypassFailed
+		}
+		return flareResponse, err
+	}
+	host := strings.ToLower(u.Hostname())
+	userAgent := defaultUserAgent
+	var cookies []Cookie
+	switch s.mode {
+	case FetchModeSmart:
+	case FetchModeReuse:
+		c, ok := s.clearances.get(host)
+		if !ok {
+			return nil, nil
+		}
+		userAgent, cookies = c.UserAgent, c.Cookies
+	default:
+		return nil, nil
+	}
+
+	if err := s.rateLimits.wait(ctx, targetURL); err != nil {
+		return nil, err
+	}
+	flareResponse, err := s.fetchDirect(ctx, targetURL, userAgent, cookies)
+	if flareResponse == nil && err == nil && s.mode == FetchModeReuse {
+		// Solving again yields fresh cookies
+		s.clearances.drop(host)
+	}
+	if flareResponse != nil && s.mode == FetchModeReuse {
+		s.clearances.merge(host, flareResponse.Solution.Cookies)
+	}
+	return flareResponse, err
+}
+
+// fetchDirect fetches targetURL without FlareSolverr, sending cookies and
+// the User-Agent pinned by the client or chosen by the policy for
+// solverUA. It returns nil when
+// the page has to be solved instead: the origin served a challenge or
+// could not be reached directly. Pages over MAX_BODY_BYTES fail with
+// errBodyTooLarge, as they would from FlareSolverr.
+func (s *solver) fetchDirect(ctx context.Context, targetURL, solverUA string, cookies []Cookie) (*FlareSolverrResponse, error) {
+	logger := loggerFrom(ctx)
+	u, err := url.Parse(targetURL)
+	if err != nil {
+		return nil, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, targetURL, nil)
+	if err != nil {
+		return nil, nil
+	}
+	userAgent := s.userAgentFor(ctx, u.Hostname(), solverUA)
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("Accept", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8")
+	for _, c := range cookies {
+		req.AddCookie(&http.Cookie{Name: c.Name, Value: c.Value})
+	}
+
+	resp, err := s.direct.Do(req)
+	if err != nil {
+		logger.Debug("direct fetch failed, using FlareSolverr", "error", err)
+		return nil, nil
+	}
+	defer resp.Body.Close()
+	body, err := readBody(resp.Body, s.maxBodyBytes)
+	if errors.Is(err, errBodyTooLarge) {
+		return nil, err
+	}
+	if err != nil {
+		logger.Debug("direct fetch failed, using FlareSolverr", "error", err)
+		return nil, nil
+	}
+	if isChallenge(resp.StatusCode, resp.Header, body) {
+		logger.Info("challenge detected, using FlareSolverr", "status", resp.StatusCode)
+		return nil, nil
+	}
+
+	flareResponse := &FlareSolverrResponse{Status: "ok", Message: "fetched directly"}
+	flareResponse.Solution.Response = string(body)
+	flareResponse.Solution.Status = resp.StatusCode
+	flareResponse.Solution.UserAgent = userAgent
+	if contentType := resp.Header.Get("Content-Type"); contentType != "" {
+		flareResponse.Solution.Headers = map[string]string{"Content-Type": contentType}
+	}
+	for _, c := range resp.Cookies() {
+		flareResponse.Solution.Cookies = append(flareResponse.Solution.Cookies, fromHTTPCookie(c))
+	}
+	return flareResponse, nil
+}
+
+// fromHTTPCookie converts a cookie set by an origin into the form
+// FlareSolverr reports cookies in.
+func fromHTTPCookie(c *http.Cookie) Cookie {
+	cookie := Cookie{
+		Name:     c.Name,
+		Value:    c.Value,
+		Domain:   c.Domain,
+		Path:     c.Path,
+		HTTPOnly: c.HttpOnly,
+		Secure:   c.Secure,
+		Session:  c.Expires.IsZero() && c.MaxAge == 0,
+		Expires:  -1,
+	}
+	switch {
+	case c.MaxAge > 0:
+		cookie.Expires = float64(time.Now().Add(time.Duration(c.MaxAge) * time.Second).Unix())
+	case !c.Expires.IsZero():
+		cookie.Expires = float64(c.Expires.Unix())
+	}
+	switch c.SameSite {
+	case http.SameSiteStrictMode:
+		cookie.SameSite = "Strict"
+	case http.SameSiteLaxMode:
+		cookie.SameSite = "Lax"
+	case http.SameSiteNoneMode:
+		cookie.SameSite = "None"
+	}
+	return cookie
+}
+
+// newDirectClient returns the client for direct fetches of pages. It
+// shares the outbound transport, so the DNS and address family settings
+// apply to origins too. Pass-through downloads use the transport without
+// the time limit, which would cut off large files.
+func newDirectClient(outbound *http.Client) *http.Client {
+	return &http.Client{
+		Transport: outbound.Transport,
+		Timeout:   envDuration("SMART_TIMEOUT", 15*time.Second),
+	}
+}
+
+// fetchModeFromEnv returns the fetch mode selected by FETCH_MODE.
+func fetchModeFromEnv() string {
+	switch mode := envString("FETCH_MODE", FetchModeSolver); mode {
+	case FetchModeSolver, FetchModeSmart, FetchModeReuse:
+		return mode
+	default:
+		slog.Warn("unknown FETCH_MODE, using solver", "mode", mode)
+		return FetchModeSolver
+	}
+}
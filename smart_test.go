@@ -0,0 +1,81 @@
+package flareproxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIsChallenge(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		header http.Header
+		body   string
+		want   bool
+	}{
+		{name: "page", status: 200, body: "<html>hello</html>", want: false},
+		{name: "cf-mitigated header", status: 403, header: http.Header{"Cf-Mitigated": {"challenge"}}, want: true},
+		{name: "cloudflare interstitial", status: 503, body: "<html><title>Just a moment...</title></html>", want: true},
+		{name: "ddos-guard", status: 403, body: `<script src="/.well-known/ddos-guard/js-challenge/index.js"></script>`, want: true},
+		{name: "plain forbidden", status: 403, body: "<html>Forbidden</html>", want: false},
+		{name: "markers on a normal page", status: 200, body: "<title>Just a moment...</title>", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isChallenge(tt.status, tt.header, []byte(tt.body)); got != tt.want {
+				t.Errorf("isChallenge() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSmartMode(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/protected" {
+			w.Header().Set("cf-mitigated", "challenge")
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: "visited", Value: "1"})
+		w.Write([]byte("<html>direct</html>"))
+	}))
+	defer origin.Close()
+
+	var solves int
+	flareSolverr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		solves++
+		json.NewEncoder(w).Encode(testResponse("<html>solved</html>"))
+	}))
+	defer flareSolverr.Close()
+	t.Setenv("FLARESOLVERR_URL", flareSolverr.URL)
+	t.Setenv("FETCH_MODE", "smart")
+
+	s := newSolver()
+	tests := []struct {
+		path        string
+		wantBody    string
+		wantBackend string
+		wantSolves  int
+	}{
+		{path: "/page", wantBody: "<html>direct</html>", wantBackend: DirectBackend, wantSolves: 0},
+		{path: "/protected", wantBody: "<html>solved</html>", wantBackend: flareSolverr.URL, wantSolves: 1},
+	}
+	for _, tt := range tests {
+		flareResponse, meta, err := s.fetch(context.Background(), "request.get", origin.URL+tt.path)
+		if err != nil {
+			t.Fatalf("fetch(%s) error = %v", tt.path, err)
+		}
+		if flareResponse.Solution.Response != tt.wantBody || meta.Backend != tt.wantBackend || solves != tt.wantSolves {
+			t.Errorf("fetch(%s) = %q from %q after %d solves, want %q from %q after %d",
+				tt.path, flareResponse.Solution.Response, meta.Backend, solves, tt.wantBody, tt.wantBackend, tt.wantSolves)
+		}
+	}
+
+	flareResponse, _, _ := s.fetch(context.Background(), "request.get", origin.URL+"/page")
+	if cookies := flareResponse.Solution.Cookies; len(cookies) != 1 || cookies[0].Name != "visited" {
+		t.Errorf("cookies = %+v, want the origin's cookie", cookies)
+	}
+}
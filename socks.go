@@ -0,0 +1,323 @@
+package flareproxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// SOCKS5 protocol values (RFC 1928).
+const (
+	socksVersion             = 0x05
+	socksNoAuth              = 0x00
+	socksUserPass            = 0x02
+	socksNoAcceptable        = 0xff
+	socksConnect             = 0x01
+	socksAddrIPv4            = 0x01
+	socksAddrDomain          = 0x03
+	socksAddrIPv6            = 0x04
+	socksSucceeded           = 0x00
+	socksCommandNotSupported = 0x07
+	socksAddrNotSupported    = 0x08
+
+	// Username/password authentication (RFC 1929)
+	socksUserPassVersion = 0x01
+	socksUserPassOK      = 0x00
+	socksUserPassFailed  = 0x01
+)
+
+// socksTarget is where a SOCKS client asked to connect to.
+type socksTarget struct {
+	scheme    string
+	authority string
+}
+
+// socksServer accepts SOCKS5 connections and answers the HTTP requests
+// sent through them via FlareSolverr, for clients that only speak SOCKS.
+// Plain HTTP is read as is; TLS connections are decrypted with the MITM CA
+// and are refused without one. With API_KEYS set, clients authenticate
+// with an API key as their SOCKS password or user name.
+type socksServer struct {
+	addr  string
+	proxy *ProxyHandler
+	srv   *http.Server
+}
+
+func newSOCKSServer(addr string, proxy *ProxyHandler) *socksServer {
+	s := &socksServer{addr: addr, proxy: proxy}
+	s.srv = &http.Server{
+		Handler: withRequestLogging("socks", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			target := r.Context().Value(socksTargetKey).(socksTarget)
+			proxy.serveTunneled(w, r, target.scheme, target.authority, nil)
+		})),
+		ReadHeaderTimeout: 30 * time.Second,
+		MaxHeaderBytes:    maxHeaderBytesFromEnv(),
+		ErrorLog:          slog.NewLogLogger(slog.Default().Handler(), slog.LevelDebug),
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			conn := c.(*socksConn)
+			return withTunnelKey(context.WithValue(ctx, socksTargetKey, conn.target), conn.key)
+		},
+	}
+	return s
+}
+
+// ListenAndServe listens on the server's address and serves until Shutdown.
+func (s *socksServer) ListenAndServe() error {
+	ln, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ln)
+}
+
+// Serve accepts SOCKS connections on ln.
+func (s *socksServer) Serve(ln net.Listener) error {
+	return s.srv.Serve(newSOCKSListener(ln, s.proxy.mitm, s.proxy.apiKeys, s.proxy.ipFilter))
+}
+
+// Shutdown stops accepting connections and waits for the requests in
+// flight to finish.
+func (s *socksServer) Shutdown(ctx context.Context) error {
+	return s.srv.Shutdown(ctx)
+}
+
+// socksConn is a connection whose SOCKS handshake is done. Reads and
+// writes carry the tunneled HTTP stream.
+type socksConn struct {
+	net.Conn
+	r      io.Reader
+	target socksTarget
+	key    string // the API key the client authenticated with
+}
+
+func (c *socksConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// socksListener performs the SOCKS handshake of accepted connections in
+// the background and hands out those that completed it.
+type socksListener struct {
+	net.Listener
+	mitm   *mitmCA
+	keys   *apiKeySet
+	filter *ipFilter
+	ready  chan net.Conn
+	done   chan struct{}
+	close  sync.Once
+	failed chan error
+}
+
+// newSOCKSListener starts accepting connections on ln, admitting clients
+// that filter allows.
+func newSOCKSListener(ln net.Listener, mitm *mitmCA, keys *apiKeySet, filter *ipFilter) *socksListener {
+	l := &socksListener{
+		Listener: ln,
+		mitm:     mitm,
+		keys:     keys,
+		filter:   filter,
+		ready:    make(chan net.Conn),
+		done:     make(chan struct{}),
+		failed:   make(chan error, 1),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+func (l *socksListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			l.failed <- err
+			return
+		}
+		go func() {
+			if !l.filter.allows(conn.RemoteAddr().String()) {
+				slog.Debug("SOCKS client address not allowed", "remote_addr", conn.RemoteAddr().String())
+				conn.Close()
+				return
+			}
+			conn.SetDeadline(time.Now().Add(10 * time.Second))
+			ready, err := l.handshake(conn)
+			if err != nil {
+				slog.Debug("SOCKS handshake failed", "remote_addr", conn.RemoteAddr().String(), "error", err)
+				conn.Close()
+				return
+			}
+			conn.SetDeadline(time.Time{})
+			select {
+			case l.ready <- ready:
+			case <-l.done:
+				conn.Close()
+			}
+		}()
+	}
+}
+
+func (l *socksListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.ready:
+		return conn, nil
+	case err := <-l.failed:
+		return nil, err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *socksListener) Close() error {
+	l.close.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+// handshake negotiates a SOCKS5 CONNECT, authenticated by username and
+// password if API keys are required, and, if the client then starts a TLS
+// handshake, terminates TLS.
+func (l *socksListener) handshake(conn net.Conn) (net.Conn, error) {
+	r := bufio.NewReader(conn)
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[0] != socksVersion {
+		return nil, fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return nil, err
+	}
+	want := byte(socksNoAuth)
+	if l.keys != nil {
+		want = socksUserPass
+	}
+	method := byte(socksNoAcceptable)
+	for _, m := range methods {
+		if m == want {
+			method = want
+		}
+	}
+	if _, err := conn.Write([]byte{socksVersion, method}); err != nil {
+		return nil, err
+	}
+	if method == socksNoAcceptable {
+		return nil, errors.New("no acceptable authentication method")
+	}
+	var key string
+	if method == socksUserPass {
+		var err error
+		if key, err = l.authenticate(conn, r); err != nil {
+			return nil, err
+		}
+	}
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(r, request); err != nil {
+		return nil, err
+	}
+	host, err := readSOCKSAddr(r, request[3])
+	if err != nil {
+		socksReply(conn, socksAddrNotSupported)
+		return nil, err
+	}
+	portBytes := make([]byte, 2)
+	if _, err := io.ReadFull(r, portBytes); err != nil {
+		return nil, err
+	}
+	port := strconv.Itoa(int(portBytes[0])<<8 | int(portBytes[1]))
+	if request[1] != socksConnect {
+		socksReply(conn, socksCommandNotSupported)
+		return nil, fmt.Errorf("unsupported SOCKS command %d", request[1])
+	}
+	if err := socksReply(conn, socksSucceeded); err != nil {
+		return nil, err
+	}
+
+	// TLS records start with the handshake content type
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if first[0] != 0x16 {
+		return &socksConn{Conn: conn, r: r, key: key, target: socksTarget{scheme: "http", authority: tunnelAuthority("http", host, port)}}, nil
+	}
+	if l.mitm == nil {
+		return nil, errors.New("TLS connection without PROXY_MITM")
+	}
+	tlsConn := tls.Server(&bufferedConn{Conn: conn, r: r}, l.mitm.tlsConfig(host))
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+	return &socksConn{Conn: tlsConn, r: tlsConn, key: key, target: socksTarget{scheme: "https", authority: tunnelAuthority("https", host, port)}}, nil
+}
+
+// authenticate performs username/password authentication, accepting an
+// API key as either, and returns the key.
+func (l *socksListener) authenticate(conn net.Conn, r io.Reader) (string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", err
+	}
+	if header[0] != socksUserPassVersion {
+		return "", fmt.Errorf("unsupported SOCKS authentication version %d", header[0])
+	}
+	username := make([]byte, header[1])
+	if _, err := io.ReadFull(r, username); err != nil {
+		return "", err
+	}
+	length := make([]byte, 1)
+	if _, err := io.ReadFull(r, length); err != nil {
+		return "", err
+	}
+	password := make([]byte, length[0])
+	if _, err := io.ReadFull(r, password); err != nil {
+		return "", err
+	}
+	key, ok := l.keys.find(string(password), string(username))
+	if !ok {
+		conn.Write([]byte{socksUserPassVersion, socksUserPassFailed})
+		return "", errors.New("invalid API key")
+	}
+	_, err := conn.Write([]byte{socksUserPassVersion, socksUserPassOK})
+	return key, err
+}
+
+// readSOCKSAddr reads a destination address of type addrType.
+func readSOCKSAddr(r io.Reader, addrType byte) (string, error) {
+	var addr []byte
+	switch addrType {
+	case socksAddrIPv4:
+		addr = make([]byte, net.IPv4len)
+	case socksAddrIPv6:
+		addr = make([]byte, net.IPv6len)
+	case socksAddrDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(r, length); err != nil {
+			return "", err
+		}
+		addr = make([]byte, length[0])
+	default:
+		return "", fmt.Errorf("unsupported SOCKS address type %d", addrType)
+	}
+	if _, err := io.ReadFull(r, addr); err != nil {
+		return "", err
+	}
+	if addrType == socksAddrDomain {
+		return string(addr), nil
+	}
+	return net.IP(addr).String(), nil
+}
+
+// socksReply answers a SOCKS request. The bound address is not meaningful
+// as the proxy does not open a connection of its own.
+func socksReply(conn net.Conn, status byte) error {
+	_, err := conn.Write([]byte{socksVersion, status, 0x00, socksAddrIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
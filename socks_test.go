@@ -0,0 +1,118 @@
+package flareproxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// socksDial opens a SOCKS5 connection to host:port through the server at
+// addr and returns the server's reply code.
+func socksDial(t *testing.T, addr string, command byte, host string, port int) (net.Conn, byte) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.Write([]byte{socksVersion, 1, socksNoAuth})
+	method := make([]byte, 2)
+	if _, err := io.ReadFull(conn, method); err != nil || method[1] != socksNoAuth {
+		t.Fatalf("method selection = %v, %v", method, err)
+	}
+	request := []byte{socksVersion, command, 0, socksAddrDomain, byte(len(host))}
+	request = append(request, host...)
+	request = append(request, byte(port>>8), byte(port))
+	conn.Write(request)
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatalf("reading reply: %v", err)
+	}
+	return conn, reply[1]
+}
+
+func TestSOCKSServer(t *testing.T) {
+	var mu sync.Mutex
+	var solved []string
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req FlareSolverrRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		mu.Lock()
+		solved = append(solved, req.URL)
+		mu.Unlock()
+		json.NewEncoder(w).Encode(testResponse("<html>solved</html>"))
+	}))
+	defer mockServer.Close()
+	t.Setenv("FLARESOLVERR_URL", mockServer.URL)
+	t.Setenv("PROXY_MITM", "true")
+	dir := t.TempDir()
+	t.Setenv("MITM_CA_CERT", filepath.Join(dir, "ca.pem"))
+	t.Setenv("MITM_CA_KEY", filepath.Join(dir, "ca-key.pem"))
+
+	proxy := newProxyHandler(newSolver())
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newSOCKSServer("", proxy)
+	go srv.Serve(ln)
+	defer srv.Shutdown(context.Background())
+	roots := x509.NewCertPool()
+	roots.AddCert(proxy.mitm.cert)
+
+	tests := []struct {
+		name string
+		port int
+		tls  bool
+		want string
+	}{
+		{name: "plain HTTP", port: 80, want: "https://example.com/page"},
+		{name: "TLS", port: 443, tls: true, want: "https://example.com/page"},
+		{name: "TLS on another port", port: 8443, tls: true, want: "https://example.com:8443/page"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mu.Lock()
+			solved = nil
+			mu.Unlock()
+			conn, status := socksDial(t, ln.Addr().String(), socksConnect, "example.com", tt.port)
+			if status != socksSucceeded {
+				t.Fatalf("reply = %d, want success", status)
+			}
+			if tt.tls {
+				conn = tls.Client(conn, &tls.Config{ServerName: "example.com", RootCAs: roots})
+			}
+			req, _ := http.NewRequest("GET", "/page", nil)
+			req.Host = "example.com"
+			req.Write(conn)
+			resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+			if err != nil {
+				t.Fatalf("reading response: %v", err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != http.StatusOK || string(body) != "<html>solved</html>" {
+				t.Errorf("response = %d %q, want the solution", resp.StatusCode, body)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if len(solved) != 1 || solved[0] != tt.want {
+				t.Errorf("FlareSolverr solved %v, want %s", solved, tt.want)
+			}
+		})
+	}
+
+	t.Run("BIND is refused", func(t *testing.T) {
+		if _, status := socksDial(t, ln.Addr().String(), 0x02, "example.com", 80); status != socksCommandNotSupported {
+			t.Errorf("reply = %d, want %d", status, socksCommandNotSupported)
+		}
+	})
+}
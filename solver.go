@@ -0,0 +1,783 @@
+package flareproxy
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/kljensen/flareproxygo/flaresolverr"
+)
+
+// The FlareSolverr API types, see package flaresolverr.
+type (
+	FlareSolverrRequest  = flaresolverr.Request
+	FlareSolverrResponse = flaresolverr.Response
+	FlareSolverrProxy    = flaresolverr.Proxy
+	Cookie               = flaresolverr.Cookie
+	// SolverError is returned when FlareSolverr answers with a status
+	// other than "ok", e.g. because the challenge could not be solved.
+	SolverError = flaresolverr.Error
+)
+
+// solver sends requests to FlareSolverr. It holds the state shared by the
+// direct and proxy handlers.
+type solver struct {
+	// cfg is the Config the solver was created for; reloads keep the
+	// options it sets.
+	cfg             Config
+	flareSolverrURL string
+	backends        *backendPool
+	client          *http.Client
+	propagateStatus bool
+	cache           Cache
+	cacheCounts     cacheCounters
+	canonical       *urlCanonicalizer
+	authHeader      string
+	authSecret      string
+	signingKey      []byte
+	userAgents      *userAgentPolicy
+	sessions        *sessionPool
+	retry           *retryPolicy
+	rateLimits      *domainLimiter
+	monitor         *timeMonitor
+	mode            string
+	direct          *http.Client
+	downloads       *http.Client
+	clearances      *clearanceStore
+	upstreamProxies map[string]FlareSolverrProxy
+	upstreams       *upstreamPolicy
+	passThrough     map[string]bool
+	// provenanceComment appends an HTML comment naming the origin and
+	// fetch time to HTML pages.
+	provenanceComment bool
+	apiKeys           *apiKeySet // nil unless API_KEYS is set
+	authRules         *authRules // nil unless AUTH_RULES is set
+	staleDomains      staleDomains
+	versions          *versionGuard // nil unless FLARESOLVERR_VERSION is set
+	ipFilter          *ipFilter     // nil unless IP_ALLOWLIST or IP_DENYLIST is set
+	quality           *qualityPolicy
+	targets           *targetPolicy
+	budget            *failureBudget    // nil unless FAILURE_BUDGET is set
+	bandwidth         *bandwidthLimiter // nil unless BANDWIDTH_LIMIT(S) is set
+	regions           *regionRouter     // nil unless REGION_ROUTES is set
+	archive           *archiveStore     // nil unless ARCHIVE_DIR is set
+	// destroyOnCancel destroys the session of a request whose client
+	// went away, to stop its browser.
+	destroyOnCancel bool
+	// maxForwardHeaderBytes caps the request headers accepted for
+	// solving; 0 disables the cap.
+	maxForwardHeaderBytes int
+	// maxBodyBytes caps the pages and downloads passed on; 0 disables
+	// the cap.
+	maxBodyBytes int64
+	// compressResponses compresses responses for clients accepting it.
+	compressResponses bool
+	cacheKeys         *cacheKeyPolicy // nil unless CACHE_KEY_VARY is set
+	cacheKeyFunc      CacheKeyFunc    // nil unless set by Server.SetCacheKeyFunc
+	cassette          *cassette       // nil unless CASSETTE_FILE is set
+	// maintenance is nil unless MAINTENANCE_WINDOWS is set.
+	maintenance *maintenancePolicy
+	// maxTimeout is the time FlareSolverr is given to solve a page,
+	// unless the request sets its own.
+	maxTimeout time.Duration
+	// outboundTimeout bounds each call to FlareSolverr; 0 derives the
+	// bound from the call's maxTimeout, see callTimeout.
+	outboundTimeout time.Duration
+	// methodOverride is the form field PUT, PATCH and DELETE are sent
+	// in as a POST, or "" to refuse them.
+	methodOverride string
+	// dialect is the schema of the solver behind the backends.
+	dialect flaresolverr.Dialect
+	// native solves pages in a local headless Chrome while FlareSolverr
+	// is down, or is nil.
+	native *nativeSolver
+	// rules are the DOMAIN_RULES, replaced when the config is reloaded.
+	rules atomic.Pointer[domainRules]
+	// negative remembers pages FlareSolverr could not solve, or is nil.
+	negative *negativeCache
+	// flights collapses identical solves in flight, or is nil.
+	flights *flightGroup
+	// sessionGC bounds the sessions this proxy created, or is nil.
+	sessionGC *sessionGC
+}
+
+func newSolver() *solver {
+	return newSolverFor(Config{FlareSolverrURL: envString("FLARESOLVERR_URL", DefaultFlareSolverrURL)})
+}
+
+// newSolverFor creates a solver for the FlareSolverr instances at
+// cfg.FlareSolverrURL, a comma separated list, with the options of cfg,
+// configured from the environment otherwise.
+func newSolverFor(cfg Config) *solver {
+	flareSolverrURL := cfg.FlareSolverrURL
+	upstreams := cfg.upstreamOptions()
+	client := newOutboundClient()
+	targetPolicy := newTargetPolicyFromEnv()
+	targets := newTargetClient(targetPolicy)
+	s := &solver{
+		cfg:                   cfg,
+		flareSolverrURL:       flareSolverrURL,
+		backends:              newBackendPoolFromEnv(flareSolverrURL),
+		client:                client,
+		propagateStatus:       envBool("PROPAGATE_STATUS", true),
+		cache:                 newCache(cfg.cacheOptions()),
+		canonical:             newURLCanonicalizerFromEnv(),
+		authHeader:            envString("FLARESOLVERR_AUTH_HEADER", "X-FlareProxy-Secret"),
+		authSecret:            os.Getenv("FLARESOLVERR_AUTH_SECRET"),
+		signingKey:            []byte(os.Getenv("FLARESOLVERR_SIGNING_KEY")),
+		userAgents:            newUserAgentPolicyFromEnv(),
+		sessions:              newSessionPool(),
+		retry:                 newRetryPolicyFromEnv(),
+		rateLimits:            newDomainLimiterFor(cfg.rateLimitOptions()),
+		monitor:               newTimeMonitorFromEnv(),
+		mode:                  fetchModeFromEnv(),
+		direct:                newDirectClient(targets),
+		downloads:             &http.Client{Transport: targets.Transport},
+		clearances:            newClearanceStoreFromEnv(),
+		upstreamProxies:       upstreamProxyAllowlist(upstreams.Allowlist),
+		upstreams:             newUpstreamPolicy(upstreams),
+		passThrough:           passThroughExtensionsFromEnv(),
+		provenanceComment:     envBool("PROVENANCE_COMMENT", false),
+		apiKeys:               apiKeysFromEnv(),
+		staleDomains:          staleDomainsFromEnv(),
+		versions:              newVersionGuardFromEnv(),
+		ipFilter:              ipFilterFromEnv(),
+		quality:               newQualityPolicyFromEnv(),
+		targets:               targetPolicy,
+		budget:                newFailureBudgetFromEnv(),
+		bandwidth:             newBandwidthLimiterFromEnv(),
+		regions:               newRegionRouterFromEnv(),
+		archive:               newArchiveStoreFromEnv(),
+		destroyOnCancel:       envBool("SESSION_DESTROY_ON_CANCEL", false),
+		maxForwardHeaderBytes: envInt("MAX_FORWARD_HEADER_BYTES", defaultMaxForwardHeaderBytes),
+		maxBodyBytes:          maxBodyBytesFromEnv(),
+		compressResponses:     envBool("RESPONSE_COMPRESSION", true),
+		cacheKeys:             newCacheKeyPolicyFromEnv(),
+		cassette:              newCassetteFromEnv(),
+		maintenance:           newMaintenancePolicyFromEnv(),
+		maxTimeout:            envDuration("FLARESOLVERR_MAX_TIMEOUT", defaultMaxTimeout),
+		outboundTimeout:       envDuration("OUTBOUND_TIMEOUT", 0),
+		methodOverride:        os.Getenv("METHOD_OVERRIDE_PARAM"),
+		dialect:               solverDialectFromEnv(),
+		native:                newNativeSolverFromEnv(),
+		negative:              newNegativeCacheFromEnv(),
+		flights:               newFlightGroupFromEnv(),
+		sessionGC:             newSessionGCFromEnv(),
+	}
+	s.authRules = newAuthRulesFromEnv(s.apiKeys)
+	s.loadRules(s.upstreams)
+	s.direct.CheckRedirect = s.targets.checkRedirect
+	s.downloads.CheckRedirect = s.targets.checkRedirect
+	return s
+}
+
+// fetch returns the solution for targetURL, from the cache when possible.
+func (s *solver) fetch(ctx context.Context, cmd, targetURL string) (*FlareSolverrResponse, responseMeta, error) {
+	meta := responseMeta{
+		Cache: "BYPASS",
+		URL:   targetURL,
+	}
+	info := requestInfoFrom(ctx)
+	info.Target = targetURL
+	defer func() {
+		info.Cache = meta.Cache
+		s.cacheCounts.count(meta.Cache)
+	}()
+	if err := s.targets.check(targetURL); err != nil {
+		return nil, meta, err
+	}
+
+	// Pages fetched through another exit proxy may differ, e.g. by country
+	proxy := upstreamProxyFrom(ctx)
+	opts := requestOptionsFrom(ctx)
+	var key string
+	if s.cache != nil && cmd == "request.get" {
+		key = s.cacheKeyFor(ctx, targetURL, proxy)
+		if !opts.NoCache {
+			if cached, ok := s.cache.Get(key); ok {
+				meta.Cache = "HIT"
+				meta.Status = solutionStatus(cached, s.propagateStatus)
+				meta.FetchedAt = cached.EndTime()
+				meta.Quality = s.quality.score(targetURL, cached)
+				return cached, meta, nil
+			}
+			meta.Cache = "MISS"
+		}
+	}
+	if cacheOnly, err := s.maintenance.check(targetURL); err != nil {
+		cached, fresh, ok := s.cachedCopy(key)
+		if !cacheOnly || !ok {
+			return nil, meta, err
+		}
+		meta.Cache, meta.Stale = "HIT", !fresh
+		if meta.Stale {
+			meta.Cache = "STALE"
+		}
+		meta.Status = solutionStatus(cached, s.propagateStatus)
+		meta.FetchedAt = cached.EndTime()
+		meta.Quality = s.quality.score(targetURL, cached)
+		return cached, meta, nil
+	}
+	if err := s.budget.check(targetURL); err != nil {
+		return nil, meta, err
+	}
+
+	// Proxies configured for the domain take turns and share cache entries
+	rule := s.ruleFor(targetURL)
+	if proxy == nil && !rule.bypass() {
+		var err error
+		if proxy, err = s.upstreams.forURL(targetURL); err != nil {
+			return nil, meta, err
+		}
+	}
+
+	// Depending on the fetch mode, pages may not need solving, unless the
+	// client asked for a session; the domain's rule may bypass solving
+	if cmd == "request.get" && ((proxy == nil && opts.Session == "") || rule.bypass()) {
+		start := time.Now()
+		flareResponse, err := s.tryDirect(ctx, targetURL)
+		if err != nil {
+			return nil, meta, err
+		}
+		if flareResponse != nil {
+			meta.SolveTime = time.Since(start)
+			meta.Backend = DirectBackend
+			info.Backend = DirectBackend
+			stampFetched(flareResponse)
+			meta.Quality = s.quality.score(targetURL, flareResponse)
+			if key != "" && isCacheable(flareResponse) && !s.quality.poor(meta.Quality) {
+				s.cacheSet(key, targetURL, flareResponse)
+			}
+			s.archive.put(targetURL, flareResponse)
+			meta.Status = solutionStatus(flareResponse, s.propagateStatus)
+			meta.FetchedAt = flareResponse.EndTime()
+			return flareResponse, meta, nil
+		}
+	}
+
+	// Pages that just failed to solve fail fast, unless the client insists
+	solveKey := cmd + " " + targetURL
+	if proxy != nil {
+		solveKey += " via " + proxy.URL
+	}
+	if !opts.NoCache {
+		if err := s.negative.check(solveKey); err != nil {
+			return nil, meta, err
+		}
+	}
+
+	requestData := FlareSolverrRequest{
+		Cmd:        cmd,
+		URL:        targetURL,
+		MaxTimeout: int(s.maxTimeout.Milliseconds()),
+		Session:    s.sessionFor(ctx, targetURL, proxy),
+		Proxy:      proxy,
+		Cookies:    s.clearances.syncedCookies(requestHost(targetURL)),
+	}
+	if req, ok := fetchRequestFrom(ctx); ok && cmd == "request.post" {
+		requestData.PostData = req.PostData
+	}
+	if opts.Session != "" {
+		requestData.Session = opts.Session
+	}
+	s.sessions.touch(requestData.Session)
+	if timeout := rule.timeout(); timeout > 0 {
+		requestData.MaxTimeout = int(timeout.Milliseconds())
+	}
+	if opts.Timeout > 0 {
+		requestData.MaxTimeout = int(opts.Timeout.Milliseconds())
+	}
+	start := time.Now()
+	// Identical page solves running at the same time are made once; the
+	// cache key covers the client headers the page may vary by
+	var flightKey string
+	if cmd == "request.get" {
+		flightKey = strings.Join([]string{solveKey, requestData.Session, strconv.Itoa(requestData.MaxTimeout), key}, "\x00")
+	}
+	flareResponse, solved, shared, err := s.flights.do(ctx, flightKey, func() (*FlareSolverrResponse, responseMeta, error) {
+		var solved responseMeta
+		flareResponse, err := s.solveWithFallback(ctx, requestData, &solved)
+		// Pages that look like a challenge or an empty shell are solved again
+		for retries := 0; err == nil; retries++ {
+			solved.Quality = s.quality.score(targetURL, flareResponse)
+			metrics.observeQuality(solved.Quality, info.TraceID)
+			if !s.quality.poor(solved.Quality) || retries >= s.quality.maxRetries {
+				break
+			}
+			loggerFrom(ctx).Warn("solved page looks broken, solving again", "target", targetURL,
+				"quality", formatQuality(solved.Quality))
+			flareResponse, err = s.solveWithFallback(ctx, requestData, &solved)
+		}
+		if solved.Backend != "" {
+			metrics.observeSolve(solved.Backend, time.Since(start), info.TraceID)
+		}
+		if proxy != nil {
+			s.upstreams.record(proxy, flareResponse, err)
+		}
+		s.budget.record(targetURL, err, err == nil && s.quality.poor(solved.Quality))
+		s.negative.record(solveKey, targetURL, err)
+		if err != nil {
+			return nil, solved, err
+		}
+		// Requests sharing the solve get it stored once
+		stampFetched(flareResponse)
+		if s.mode == FetchModeReuse && cmd == "request.get" {
+			s.clearances.put(targetURL, flareResponse)
+		}
+		if key != "" && isCacheable(flareResponse) && !s.quality.poor(solved.Quality) {
+			s.cacheSet(key, targetURL, flareResponse)
+		}
+		s.archive.put(targetURL, flareResponse)
+		return flareResponse, solved, nil
+	})
+	meta.SolveTime = time.Since(start)
+	meta.Backend, meta.Quality = solved.Backend, solved.Quality
+	if shared {
+		info.Backend = solved.Backend
+		loggerFrom(ctx).Debug("shared an identical solve in flight", "target", targetURL, "backend", solved.Backend)
+	}
+	if err != nil {
+		var solverErr *SolverError
+		if errors.As(err, &solverErr) {
+			info.FlareStatus = "error"
+		}
+		if stale, ok := s.serveStale(ctx, key, targetURL, err); ok {
+			meta.Cache = "STALE"
+			meta.Stale = true
+			meta.Status = solutionStatus(stale, s.propagateStatus)
+			meta.FetchedAt = stale.EndTime()
+			meta.Quality = s.quality.score(targetURL, stale)
+			return stale, meta, nil
+		}
+		return nil, meta, err
+	}
+	info.FlareStatus = flareResponse.Status
+	meta.Status = solutionStatus(flareResponse, s.propagateStatus)
+	meta.FetchedAt = flareResponse.EndTime()
+	return flareResponse, meta, nil
+}
+
+// sessionFor returns the warm session a request for targetURL runs in, if
+// any. A draining backend takes no new requests, not even for its
+// sessions, nor does a backend outside the region the target is routed
+// to. Sessions have their proxy fixed when created, so a request through
+// an upstream proxy cannot use them either, and domains whose rule has
+// sessions=none do not use them at all.
+func (s *solver) sessionFor(ctx context.Context, targetURL string, proxy *FlareSolverrProxy) string {
+	if proxy != nil || s.ruleFor(targetURL).noSessions() {
+		return ""
+	}
+	session := s.sessions.sessionFor(targetURL)
+	if b := s.backends.get(s.sessions.backendFor(session)); b != nil {
+		if region := s.regions.regionFor(ctx, targetURL); b.Draining() || (region != "" && b.Region() != region) {
+			return ""
+		}
+	}
+	return session
+}
+
+// solveWithRetry sends a request, retrying transient failures according
+// to the retry policy. Each attempt picks a backend afresh, so a retry may
+// land on a different FlareSolverr instance.
+func (s *solver) solveWithRetry(ctx context.Context, requestData FlareSolverrRequest, meta *responseMeta) (*FlareSolverrResponse, error) {
+	for attempt := 1; ; attempt++ {
+		if err := s.rateLimits.wait(ctx, requestData.URL); err != nil {
+			return nil, err
+		}
+		b, err := s.backendFor(ctx, requestData)
+		if err != nil {
+			return nil, err
+		}
+		meta.Backend = b.url
+		requestInfoFrom(ctx).Backend = b.url
+
+		release, err := s.backends.acquireSlot(ctx, b)
+		if err != nil {
+			return nil, err
+		}
+		// Let the browser give up when the client would
+		if requestData.MaxTimeout > 0 {
+			requestData.MaxTimeout = maxTimeoutFor(ctx, requestData.MaxTimeout)
+		}
+		flareResponse, err := s.solveOn(ctx, b, requestData)
+		release()
+		if err == nil || attempt >= s.retry.maxAttempts || !isTransient(err) || ctx.Err() != nil {
+			return flareResponse, err
+		}
+		loggerFrom(ctx).Warn("retrying FlareSolverr request", "attempt", attempt,
+			"backend", b.url, "error", err)
+		if !s.retry.wait(ctx, attempt) {
+			return nil, err
+		}
+	}
+}
+
+// backendFor returns the backend a request should be sent to. Requests in
+// a session must go to the backend holding that session, and requests for
+// a domain whose rule names a backend to that backend; others prefer
+// backends in the region their target is routed to.
+func (s *solver) backendFor(ctx context.Context, requestData FlareSolverrRequest) (*backend, error) {
+	if b := s.pinnedBackend(requestData); b != nil {
+		return b, s.backends.acquire(b)
+	}
+	return s.backends.pickIn(s.regions.regionFor(ctx, requestData.URL))
+}
+
+// pinnedBackend returns the backend holding the request's session, or
+// else the one its domain's rule names, or nil if neither is configured.
+func (s *solver) pinnedBackend(requestData FlareSolverrRequest) *backend {
+	if requestData.Session != "" {
+		if b := s.backends.get(s.sessions.backendFor(requestData.Session)); b != nil {
+			return b
+		}
+	}
+	return s.backends.get(s.ruleFor(requestData.URL).backend())
+}
+
+// solve sends a single command to a FlareSolverr backend.
+func (s *solver) solve(ctx context.Context, requestData FlareSolverrRequest) (*FlareSolverrResponse, error) {
+	b, err := s.backendFor(ctx, requestData)
+	if err != nil {
+		return nil, err
+	}
+	return s.solveOn(ctx, b, requestData)
+}
+
+// defaultMaxTimeout is the time FlareSolverr is given to solve a page
+// unless FLARESOLVERR_MAX_TIMEOUT says otherwise.
+const defaultMaxTimeout = 60 * time.Second
+
+// solverDialectFromEnv returns the dialect of the solver named by
+// SOLVER_TYPE, FlareSolverr by default.
+func solverDialectFromEnv() flaresolverr.Dialect {
+	name := envString("SOLVER_TYPE", flaresolverr.FlareSolverr.Name())
+	dialect, err := flaresolverr.DialectFor(name)
+	if err != nil {
+		slog.Warn("ignoring SOLVER_TYPE", "error", err)
+		return flaresolverr.FlareSolverr
+	}
+	return dialect
+}
+
+// callTimeoutMargin is added to the time the browser is given, for
+// FlareSolverr to answer once it gives up.
+const callTimeoutMargin = 30 * time.Second
+
+// callTimeout returns how long a call to FlareSolverr may take:
+// OUTBOUND_TIMEOUT if set, and otherwise the time the browser is given
+// with a margin.
+func (s *solver) callTimeout(requestData FlareSolverrRequest) time.Duration {
+	if s.outboundTimeout > 0 {
+		return s.outboundTimeout
+	}
+	maxTimeout := time.Duration(requestData.MaxTimeout) * time.Millisecond
+	if maxTimeout <= 0 {
+		maxTimeout = s.maxTimeout
+	}
+	return maxTimeout + callTimeoutMargin
+}
+
+// solveOn sends a single command to the given backend and records the
+// outcome in its health.
+func (s *solver) solveOn(ctx context.Context, b *backend, requestData FlareSolverrRequest) (flareResponse *FlareSolverrResponse, err error) {
+	b.inFlight.Add(1)
+	defer func() {
+		b.inFlight.Add(-1)
+		s.backends.record(b, err)
+	}()
+
+	info := requestInfoFrom(ctx)
+	logger := loggerFrom(ctx)
+	logger.Debug("sending request to FlareSolverr", "backend", b.url, "cmd", requestData.Cmd,
+		"url", requestData.URL, "session", requestData.Session)
+	// Give up on a backend that hangs, beyond the time the browser has
+	ctx, cancel := context.WithTimeout(ctx, s.callTimeout(requestData))
+	defer cancel()
+	sent := s.monitor.now()
+	client := &flaresolverr.Client{
+		URL:              b.url,
+		HTTPClient:       s.client,
+		MaxResponseBytes: s.maxBodyBytes,
+		Dialect:          s.dialect,
+		Prepare: func(req *http.Request, body []byte) {
+			if info.ID != "" {
+				req.Header.Set(RequestIDHeader, info.ID)
+			}
+			if info.TraceID != "" {
+				req.Header.Set(TraceparentHeader, traceparent(info.TraceID))
+			}
+			s.authenticate(req, body)
+		},
+		Inspect: func(resp *http.Response, body []byte) error {
+			s.monitor.observeResponse(b.url, resp, sent)
+			logger.Debug("FlareSolverr responded", "backend", b.url, "status", resp.StatusCode)
+			return validateResponse(body, resp.StatusCode)
+		},
+	}
+
+	flareResponse, err = client.Do(ctx, requestData)
+	if err == nil && strings.HasPrefix(requestData.Cmd, "request.") {
+		b.observeSolve(s.monitor.now().Sub(sent))
+	}
+	if flareResponse != nil {
+		s.versions.observe(b, flareResponse.Version)
+		logger.Debug("FlareSolverr answered", "backend", b.url,
+			"flaresolverr_status", flareResponse.Status, "message", flareResponse.Message)
+	}
+	if err != nil {
+		if canceled(ctx, err) && strings.HasPrefix(requestData.Cmd, "request.") {
+			s.abortSession(requestData.Session)
+		}
+		return nil, err
+	}
+	return flareResponse, nil
+}
+
+// SignatureHeader carries the HMAC signature of requests to FlareSolverr
+// when FLARESOLVERR_SIGNING_KEY is set.
+const SignatureHeader = "X-FlareProxy-Signature"
+
+// authenticate attaches the configured shared secret and signature to a
+// request to FlareSolverr, so that a reverse proxy in front of the solver
+// can reject traffic that did not come from this proxy.
+//
+// The signature has the form "t=<unix time>,v1=<hex HMAC-SHA256>" where
+// the HMAC is computed over "<unix time>.<body>", allowing the verifier to
+// reject replayed requests.
+func (s *solver) authenticate(req *http.Request, body []byte) {
+	if s.authSecret != "" {
+		req.Header.Set(s.authHeader, s.authSecret)
+	}
+	if len(s.signingKey) > 0 {
+		req.Header.Set(SignatureHeader, signRequest(s.signingKey, time.Now(), body))
+	}
+}
+
+func signRequest(key []byte, now time.Time, body []byte) string {
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "t=" + timestamp + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Trailer names describing how a response was produced. These are sent as
+// HTTP trailers because the headers have already been flushed by the time
+// the body has been written.
+const (
+	TrailerSolveTime = "X-FlareProxy-Solve-Time-Ms"
+	TrailerCache     = "X-FlareProxy-Cache"
+	TrailerBackend   = "X-FlareProxy-Backend"
+)
+
+// IfHashDiffersHeader carries the hex SHA-256 of the body a client already
+// has. If the solution's body hashes the same, it is answered with 304 Not
+// Modified and no body.
+const IfHashDiffersHeader = "X-FlareProxy-If-Hash-Differs"
+
+// responseMeta records timing and outcome information for a response.
+type responseMeta struct {
+	Status    int
+	SolveTime time.Duration
+	Cache     string
+	Backend   string
+	// URL and FetchedAt say where the content came from and when.
+	URL       string
+	FetchedAt time.Time
+	// Stale is set when an expired cache entry is served because
+	// FlareSolverr is down.
+	Stale bool
+	// Quality is the page's quality score, from 0 to 1.
+	Quality float64
+}
+
+// writeSolution writes a successful FlareSolverr solution to the client,
+// followed by trailers describing the solve. Successful solutions carry an
+// ETag derived from the body and honour Range requests, so that download
+// tools can resume large files served from the cache, as well as
+// X-FlareProxy-If-Hash-Differs, so that monitors only download changes.
+// Provenance headers say where and when the content was fetched, and with
+// ARCHIVE_DIR set, SnapshotHeader where it is archived.
+func (s *solver) writeSolution(w http.ResponseWriter, r *http.Request, result *FetchResult) {
+	flareResponse, meta := result.Response, result.meta
+	body := flareResponse.Solution.Response
+	contentType := solutionContentType(flareResponse)
+	if s.provenanceComment && contentType == contentTypeHTML {
+		body += provenanceComment(meta)
+	}
+	setCookies(w, flareResponse.Solution.Cookies)
+	if userAgent := flareResponse.Solution.UserAgent; userAgent != "" {
+		w.Header().Set(UserAgentHeader, userAgent)
+	}
+	setProvenanceHeaders(w, meta)
+	w.Header().Set(QualityHeader, formatQuality(meta.Quality))
+	if s.archive != nil {
+		w.Header().Set(SnapshotHeader, contentHash(flareResponse.Solution.Response))
+	}
+	if meta.Stale {
+		w.Header().Set("Warning", staleWarning)
+		w.Header().Set(StaleHeader, "true")
+	}
+	w.Header().Set("Content-Type", contentType)
+	if meta.Status == http.StatusOK {
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.Header().Set("ETag", bodyETag(body))
+		if known := r.Header.Get(IfHashDiffersHeader); known != "" && hashMatches(body, known) {
+			// Responses without a body have no trailers
+			setMetaHeaders(w, meta)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		if r.Header.Get("Range") != "" {
+			// Partial responses have a Content-Length and thus no trailers
+			setMetaHeaders(w, meta)
+			http.ServeContent(w, r, "", time.Time{}, strings.NewReader(body))
+			return
+		}
+	}
+	if r.Method == http.MethodHead {
+		// Responses without a body have no trailers
+		setMetaHeaders(w, meta)
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.WriteHeader(meta.Status)
+		return
+	}
+	w.Header().Set("Trailer", strings.Join([]string{TrailerSolveTime, TrailerCache, TrailerBackend}, ", "))
+	w.WriteHeader(meta.Status)
+	w.Write([]byte(body))
+	setMetaHeaders(w, meta)
+}
+
+// setMetaHeaders sets the headers, or after the body the trailers,
+// describing how a response was produced.
+func setMetaHeaders(w http.ResponseWriter, meta responseMeta) {
+	w.Header().Set(TrailerSolveTime, strconv.FormatInt(meta.SolveTime.Milliseconds(), 10))
+	w.Header().Set(TrailerCache, meta.Cache)
+	w.Header().Set(TrailerBackend, meta.Backend)
+}
+
+// hashMatches reports whether body has the hex SHA-256 hash known.
+func hashMatches(body, known string) bool {
+	return strings.EqualFold(strings.TrimSpace(known), contentHash(body))
+}
+
+// bodyETag returns a strong entity tag for a response body.
+func bodyETag(body string) string {
+	sum := sha256.Sum256([]byte(body))
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// solutionStatus returns the status code to send for a solution. Unless
+// propagation is disabled, this is the status the origin returned to the
+// solving browser so that clients can tell real 404s from successes.
+func solutionStatus(flareResponse *FlareSolverrResponse, propagate bool) int {
+	status := flareResponse.Solution.Status
+	if !propagate || status < 200 || status > 599 {
+		return http.StatusOK
+	}
+	return status
+}
+
+// setCookies emits the cookies from a FlareSolverr solution as Set-Cookie
+// headers so clients can reuse them directly against the origin.
+func setCookies(w http.ResponseWriter, cookies []Cookie) {
+	for _, c := range cookies {
+		if c.Name == "" {
+			continue
+		}
+		http.SetCookie(w, c.HTTPCookie())
+	}
+}
+
+func sendError(w http.ResponseWriter, r *http.Request, message string) {
+	sendErrorStatus(w, r, http.StatusInternalServerError, message)
+}
+
+// sendFetchError reports a failed fetch, choosing the status code from
+// the kind of error.
+func sendFetchError(w http.ResponseWriter, r *http.Request, err error) {
+	if canceled(r.Context(), err) {
+		sendCanceled(w, r)
+		return
+	}
+	var deniedErr *TargetDeniedError
+	var targetAuthErr *TargetAuthError
+	if errors.As(err, &deniedErr) || errors.As(err, &targetAuthErr) {
+		sendErrorStatus(w, r, http.StatusForbidden, err.Error())
+		return
+	}
+	var circuitErr *CircuitOpenError
+	if errors.As(err, &circuitErr) {
+		w.Header().Set("Retry-After", retryAfterSeconds(circuitErr.RetryAfter))
+		sendErrorStatus(w, r, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	if errors.Is(err, errAllDraining) || errors.Is(err, errIncompatibleBackends) {
+		sendErrorStatus(w, r, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	if errors.Is(err, errBodyTooLarge) || errors.Is(err, errNotRecorded) || errors.Is(err, errBypassFailed) {
+		sendErrorStatus(w, r, http.StatusBadGateway, err.Error())
+		return
+	}
+	var queueErr *QueueFullError
+	if errors.As(err, &queueErr) {
+		w.Header().Set("Retry-After", retryAfterSeconds(queueErr.RetryAfter))
+		sendErrorStatus(w, r, http.StatusTooManyRequests, err.Error())
+		return
+	}
+	var unsolvableErr *UnsolvableError
+	if errors.As(err, &unsolvableErr) {
+		w.Header().Set("Retry-After", retryAfterSeconds(unsolvableErr.RetryAfter))
+		sendErrorStatus(w, r, http.StatusBadGateway, err.Error())
+		return
+	}
+	var disabledErr *DomainDisabledError
+	if errors.As(err, &disabledErr) {
+		w.Header().Set("Retry-After", retryAfterSeconds(disabledErr.RetryAfter))
+		sendErrorStatus(w, r, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	var maintenanceErr *MaintenanceError
+	if errors.As(err, &maintenanceErr) {
+		w.Header().Set("Retry-After", retryAfterSeconds(maintenanceErr.RetryAfter))
+		sendErrorStatus(w, r, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	var bannedErr *ProxiesBannedError
+	if errors.As(err, &bannedErr) {
+		w.Header().Set("Retry-After", retryAfterSeconds(bannedErr.RetryAfter))
+		sendErrorStatus(w, r, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	var rateErr *RateLimitError
+	if errors.As(err, &rateErr) {
+		w.Header().Set("Retry-After", retryAfterSeconds(rateErr.RetryAfter))
+		sendErrorStatus(w, r, http.StatusTooManyRequests, err.Error())
+		return
+	}
+	sendError(w, r, err.Error())
+}
+
+func retryAfterSeconds(d time.Duration) string {
+	return strconv.Itoa(int(d.Round(time.Second).Seconds()))
+}
+
+func sendErrorStatus(w http.ResponseWriter, r *http.Request, status int, message string) {
+	loggerFrom(r.Context()).Error("request failed", "error", message)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	errorResponse := map[string]string{"error": message}
+	json.NewEncoder(w).Encode(errorResponse)
+}
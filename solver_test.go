@@ -0,0 +1,107 @@
+package flareproxy
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSolverAuthentication(t *testing.T) {
+	var gotSecret, gotSignature string
+	var gotBody []byte
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotSecret = r.Header.Get("X-Solver-Token")
+		gotSignature = r.Header.Get(SignatureHeader)
+		gotBody, _ = io.ReadAll(r.Body)
+		json.NewEncoder(w).Encode(testResponse("<html></html>"))
+	}))
+	defer mockServer.Close()
+
+	t.Setenv("FLARESOLVERR_URL", mockServer.URL)
+	t.Setenv("FLARESOLVERR_AUTH_HEADER", "X-Solver-Token")
+	t.Setenv("FLARESOLVERR_AUTH_SECRET", "s3cret")
+	t.Setenv("FLARESOLVERR_SIGNING_KEY", "signing-key")
+
+	if _, err := newSolver().solve(context.Background(), FlareSolverrRequest{Cmd: "request.get", URL: "https://example.com"}); err != nil {
+		t.Fatalf("solve() error = %v", err)
+	}
+
+	if gotSecret != "s3cret" {
+		t.Errorf("secret header = %q, want s3cret", gotSecret)
+	}
+
+	// Verify the signature the way a reverse proxy would
+	parts := strings.Split(gotSignature, ",")
+	if len(parts) != 2 || !strings.HasPrefix(parts[0], "t=") || !strings.HasPrefix(parts[1], "v1=") {
+		t.Fatalf("malformed signature %q", gotSignature)
+	}
+	mac := hmac.New(sha256.New, []byte("signing-key"))
+	mac.Write([]byte(strings.TrimPrefix(parts[0], "t=") + "."))
+	mac.Write(gotBody)
+	if want := hex.EncodeToString(mac.Sum(nil)); strings.TrimPrefix(parts[1], "v1=") != want {
+		t.Errorf("signature = %s, want %s", parts[1], want)
+	}
+}
+
+func TestSolverWithoutAuthentication(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-FlareProxy-Secret") != "" || r.Header.Get(SignatureHeader) != "" {
+			t.Errorf("unexpected authentication headers: %v", r.Header)
+		}
+		json.NewEncoder(w).Encode(testResponse("<html></html>"))
+	}))
+	defer mockServer.Close()
+
+	t.Setenv("FLARESOLVERR_URL", mockServer.URL)
+	if _, err := newSolver().solve(context.Background(), FlareSolverrRequest{Cmd: "request.get", URL: "https://example.com"}); err != nil {
+		t.Fatalf("solve() error = %v", err)
+	}
+}
+
+func TestSignRequest(t *testing.T) {
+	got := signRequest([]byte("key"), time.Unix(1700000000, 0), []byte("{}"))
+	if !strings.HasPrefix(got, "t=1700000000,v1=") || len(got) != len("t=1700000000,v1=")+64 {
+		t.Errorf("signRequest() = %q", got)
+	}
+}
+
+func TestCallTimeout(t *testing.T) {
+	release := make(chan struct{})
+	hanging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer hanging.Close()
+	defer close(release)
+	t.Setenv("FLARESOLVERR_URL", hanging.URL)
+
+	s := newSolver()
+	if got := s.callTimeout(FlareSolverrRequest{}); got != 90*time.Second {
+		t.Errorf("default call timeout = %s, want 90s", got)
+	}
+	if got := s.callTimeout(FlareSolverrRequest{MaxTimeout: 120000}); got != 150*time.Second {
+		t.Errorf("call timeout for a 120s solve = %s, want 150s", got)
+	}
+
+	t.Setenv("FLARESOLVERR_MAX_TIMEOUT", "10s")
+	t.Setenv("OUTBOUND_TIMEOUT", "100ms")
+	s = newSolver()
+	if s.maxTimeout != 10*time.Second {
+		t.Errorf("max timeout = %s, want 10s", s.maxTimeout)
+	}
+	start := time.Now()
+	_, err := s.solveOn(context.Background(), s.backends.all()[0], FlareSolverrRequest{Cmd: "request.get", URL: "https://example.com/"})
+	if err == nil || time.Since(start) > 5*time.Second {
+		t.Errorf("call to a hanging FlareSolverr = %v after %s, want a timeout", err, time.Since(start))
+	}
+}
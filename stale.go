@@ -0,0 +1,100 @@
+package flareproxy
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// StaleHeader marks responses served from an expired cache entry because
+// FlareSolverr was unavailable. They also carry a "Warning: 110" header.
+const StaleHeader = "X-FlareProxy-Stale"
+
+// staleWarning is the Warning header value of stale responses (RFC 7234).
+const staleWarning = `110 - "Response is Stale"`
+
+// staleCache is a Cache that keeps entries past their TTL, so that they can
+// still be served while FlareSolverr is down.
+type staleCache interface {
+	Cache
+	// GetStale returns the response stored under key, fresh or expired,
+	// unless it expired more than the stale period ago.
+	GetStale(key string) (*FlareSolverrResponse, bool)
+}
+
+// staleMaxAgeFromEnv returns how long caches keep expired entries: for
+// SERVE_STALE_MAX_AGE when SERVE_STALE is set, otherwise not at all.
+func staleMaxAgeFromEnv() time.Duration {
+	if os.Getenv("SERVE_STALE") == "" {
+		return 0
+	}
+	return envDuration("SERVE_STALE_MAX_AGE", 24*time.Hour)
+}
+
+// staleDomains are the domains whose expired cache entries are served
+// while FlareSolverr is down. Domains match their subdomains too, and "*"
+// matches every domain.
+type staleDomains map[string]bool
+
+// staleDomainsFromEnv reads SERVE_STALE, a comma separated list of domains.
+func staleDomainsFromEnv() staleDomains {
+	domains := make(staleDomains)
+	for _, domain := range splitList(os.Getenv("SERVE_STALE")) {
+		domains[strings.ToLower(domain)] = true
+	}
+	return domains
+}
+
+// match reports whether stale copies of targetURL may be served.
+func (d staleDomains) match(targetURL string) bool {
+	if d["*"] {
+		return true
+	}
+	u, err := url.Parse(targetURL)
+	if err != nil {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	for host != "" {
+		if d[host] {
+			return true
+		}
+		_, host, _ = strings.Cut(host, ".")
+	}
+	return false
+}
+
+// isSolverDown reports whether err means that FlareSolverr could not be
+// reached at all, as opposed to failing to solve a page.
+func isSolverDown(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var circuitErr *CircuitOpenError
+	var urlErr *url.Error
+	var schemaErr *SchemaError
+	switch {
+	case errors.As(err, &circuitErr), errors.Is(err, errAllDraining), errors.Is(err, errIncompatibleBackends), errors.As(err, &urlErr):
+		return true
+	case errors.As(err, &schemaErr):
+		return schemaErr.HTTPStatus == 502 || schemaErr.HTTPStatus == 503 || schemaErr.HTTPStatus == 504
+	}
+	return false
+}
+
+// serveStale returns the expired cache entry for key if FlareSolverr is
+// down and stale copies of targetURL may be served.
+func (s *solver) serveStale(ctx context.Context, key, targetURL string, err error) (*FlareSolverrResponse, bool) {
+	cache, ok := s.cache.(staleCache)
+	if key == "" || !ok || !s.staleDomains.match(targetURL) || !isSolverDown(ctx, err) {
+		return nil, false
+	}
+	stale, ok := cache.GetStale(key)
+	if ok {
+		loggerFrom(ctx).Warn("FlareSolverr unavailable, serving stale copy", "target", targetURL, "error", err)
+	}
+	return stale, ok
+}
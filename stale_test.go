@@ -0,0 +1,93 @@
+package flareproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestServeStale(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(testResponse("<html>cached</html>"))
+	}))
+	t.Setenv("FLARESOLVERR_URL", mockServer.URL)
+	t.Setenv("CACHE_TTL", "1m")
+	t.Setenv("SERVE_STALE", "monitored.example")
+	t.Setenv("SERVE_STALE_MAX_AGE", "1h")
+	handler := NewDirectHandler()
+	cache := handler.cache.(*memoryCache)
+	for _, path := range []string{"/monitored.example/", "/www.monitored.example/", "/other.example/"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	mockServer.Close()
+
+	tests := []struct {
+		name      string
+		path      string
+		age       time.Duration
+		wantStale bool
+	}{
+		{name: "stale", path: "/monitored.example/", age: 10 * time.Minute, wantStale: true},
+		{name: "subdomain", path: "/www.monitored.example/", age: 10 * time.Minute, wantStale: true},
+		{name: "other domain", path: "/other.example/", age: 10 * time.Minute},
+		{name: "too old", path: "/monitored.example/", age: 2 * time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache.now = func() time.Time { return time.Now().Add(tt.age) }
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, httptest.NewRequest("GET", tt.path, nil))
+			if !tt.wantStale {
+				if rr.Code == http.StatusOK {
+					t.Errorf("status = 200, want an error")
+				}
+				return
+			}
+			if rr.Code != http.StatusOK || rr.Body.String() != "<html>cached</html>" {
+				t.Fatalf("response = %d %q, want the stale copy", rr.Code, rr.Body.String())
+			}
+			if rr.Header().Get("Warning") != staleWarning || rr.Header().Get(StaleHeader) != "true" {
+				t.Errorf("Warning = %q, %s = %q", rr.Header().Get("Warning"), StaleHeader, rr.Header().Get(StaleHeader))
+			}
+			if got := rr.Result().Trailer.Get(TrailerCache); got != "STALE" {
+				t.Errorf("cache = %q, want STALE", got)
+			}
+		})
+	}
+}
+
+func TestIsSolverDown(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	connErr := fmt.Errorf("Failed to connect to FlareSolverr: %w", &url.Error{Op: "Post", URL: "http://fs", Err: errors.New("connection refused")})
+	tests := []struct {
+		name string
+		ctx  context.Context
+		err  error
+		want bool
+	}{
+		{name: "connection refused", err: connErr, want: true},
+		{name: "circuit open", err: &CircuitOpenError{RetryAfter: time.Second}, want: true},
+		{name: "draining", err: errAllDraining, want: true},
+		{name: "gateway down", err: &SchemaError{HTTPStatus: 502}, want: true},
+		{name: "solve failed", err: &SolverError{Message: "Cloudflare challenge failed"}},
+		{name: "client went away", ctx: canceled, err: connErr},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := tt.ctx
+			if ctx == nil {
+				ctx = context.Background()
+			}
+			if got := isSolverDown(ctx, tt.err); got != tt.want {
+				t.Errorf("isSolverDown(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,615 @@
+package flareproxy
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// State components, each a JSON file in a state archive.
+const (
+	// StateClearances are the cookies and User-Agents kept per host.
+	StateClearances = "clearances"
+	// StateSessions are the FlareSolverr sessions the proxy created.
+	StateSessions = "sessions"
+	// StateDomains are the domains' failure budgets.
+	StateDomains = "domains"
+	// StateRateLimits are the per-domain rate limiter buckets.
+	StateRateLimits = "rate_limits"
+	// StateBandwidth is the tenants' bandwidth used in their windows.
+	StateBandwidth = "bandwidth"
+	// StateCache is the memory or disk cache, entries included. The Redis
+	// cache is shared between instances and not exported.
+	StateCache = "cache"
+)
+
+// stateComponents lists the components in the order they are archived.
+var stateComponents = []string{StateClearances, StateSessions, StateDomains, StateRateLimits, StateBandwidth, StateCache}
+
+// maxStateBytes bounds the state archives the admin API accepts.
+const maxStateBytes = 1 << 30
+
+// stateManifest is the first file of a state archive.
+type stateManifest struct {
+	Version    string    `json:"version"`
+	ExportedAt time.Time `json:"exported_at"`
+	Components []string  `json:"components"`
+}
+
+type clearanceState struct {
+	Clearances map[string]clearance `json:"clearances"`
+	// Synced are the cookies set on direct fetches since the last solve
+	Synced map[string][]Cookie `json:"synced,omitempty"`
+}
+
+type domainState struct {
+	Domain        string              `json:"domain"`
+	Buckets       []budgetBucketState `json:"buckets,omitempty"`
+	LastError     string              `json:"last_error,omitempty"`
+	DisabledUntil time.Time           `json:"disabled_until,omitempty"`
+	DisabledBy    string              `json:"disabled_by,omitempty"`
+	Reason        string              `json:"reason,omitempty"`
+}
+
+type budgetBucketState struct {
+	Start     time.Time `json:"start"`
+	Successes int       `json:"successes"`
+	Failures  int       `json:"failures"`
+}
+
+type bandwidthState struct {
+	Tenant string    `json:"tenant"`
+	Start  time.Time `json:"start"`
+	Bytes  int64     `json:"bytes"`
+}
+
+// cacheRecord is a cached response with its expiry.
+type cacheRecord struct {
+	Key      string                `json:"key"`
+	Expires  time.Time             `json:"expires"`
+	Response *FlareSolverrResponse `json:"response"`
+}
+
+// portableCache is implemented by caches whose entries can be exported
+// and imported with their expiry.
+type portableCache interface {
+	// records returns the entries that are fresh or may be served stale,
+	// the least recently used first.
+	records() []cacheRecord
+	// restore stores records, keeping their expiry.
+	restore(records []cacheRecord)
+}
+
+// parseStateComponents returns the components listed in spec, a comma
+// separated list, or all of them if it is empty.
+func parseStateComponents(spec string) ([]string, error) {
+	if strings.TrimSpace(spec) == "" {
+		return stateComponents, nil
+	}
+	var components []string
+	for _, component := range splitList(spec) {
+		if !slices.Contains(stateComponents, component) {
+			return nil, fmt.Errorf("unknown state component %q, want one of %s", component, strings.Join(stateComponents, ", "))
+		}
+		components = append(components, component)
+	}
+	return components, nil
+}
+
+// exportState writes the components of the proxy's state to w as a
+// gzipped tarball with a JSON file per component.
+func (s *solver) exportState(w io.Writer, components []string) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	now := time.Now()
+	add := func(name string, v any) error {
+		data, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return err
+		}
+		header := &tar.Header{Name: name + ".json", Mode: 0o600, Size: int64(len(data)), ModTime: now}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		_, err = tw.Write(data)
+		return err
+	}
+	manifest := stateManifest{Version: Version, ExportedAt: now.UTC(), Components: components}
+	if err := add("manifest", manifest); err != nil {
+		return err
+	}
+	for _, component := range components {
+		if err := add(component, s.stateOf(component)); err != nil {
+			return fmt.Errorf("%s: %w", component, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// stateOf returns the exported form of a component.
+func (s *solver) stateOf(component string) any {
+	switch component {
+	case StateClearances:
+		return s.clearances.state()
+	case StateSessions:
+		return s.sessions.list()
+	case StateDomains:
+		return s.budget.state()
+	case StateRateLimits:
+		return s.rateLimits.state()
+	case StateBandwidth:
+		return s.bandwidth.state()
+	case StateCache:
+		records := []cacheRecord{}
+		if cache, ok := s.cache.(portableCache); ok {
+			records = cache.records()
+		}
+		return records
+	}
+	return nil
+}
+
+// importState merges the components of a state archive read from r into
+// the proxy's state and returns how many items of each it imported.
+// Components that are not enabled on this instance are skipped, as are
+// files of components it does not know, from newer versions.
+func (s *solver) importState(r io.Reader, components []string) (map[string]int, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("not a state archive: %w", err)
+	}
+	tr := tar.NewReader(gz)
+	imported := make(map[string]int)
+	seenManifest := false
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return imported, fmt.Errorf("not a state archive: %w", err)
+		}
+		component := strings.TrimSuffix(path.Base(header.Name), ".json")
+		if component == "manifest" {
+			var manifest stateManifest
+			if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+				return imported, fmt.Errorf("manifest: %w", err)
+			}
+			seenManifest = true
+			continue
+		}
+		if !seenManifest {
+			return imported, errors.New("not a state archive: manifest.json must come first")
+		}
+		if !slices.Contains(components, component) {
+			continue
+		}
+		n, err := s.restoreState(component, tr)
+		if err != nil {
+			return imported, fmt.Errorf("%s: %w", component, err)
+		}
+		imported[component] = n
+	}
+	if !seenManifest {
+		return imported, errors.New("not a state archive: missing manifest.json")
+	}
+	return imported, nil
+}
+
+// restoreState decodes the file of a component from r and merges it.
+func (s *solver) restoreState(component string, r io.Reader) (int, error) {
+	dec := json.NewDecoder(r)
+	switch component {
+	case StateClearances:
+		var state clearanceState
+		if err := dec.Decode(&state); err != nil {
+			return 0, err
+		}
+		return s.clearances.restore(state), nil
+	case StateSessions:
+		var sessions []adminSession
+		if err := dec.Decode(&sessions); err != nil {
+			return 0, err
+		}
+		for _, session := range sessions {
+			s.sessions.restore(session)
+		}
+		return len(sessions), nil
+	case StateDomains:
+		var domains []domainState
+		if err := dec.Decode(&domains); err != nil {
+			return 0, err
+		}
+		return s.budget.restore(domains), nil
+	case StateRateLimits:
+		var state rateLimitState
+		if err := dec.Decode(&state); err != nil {
+			return 0, err
+		}
+		s.rateLimits.restore(state)
+		return len(state.Buckets), nil
+	case StateBandwidth:
+		var usage []bandwidthState
+		if err := dec.Decode(&usage); err != nil {
+			return 0, err
+		}
+		return s.bandwidth.restore(usage), nil
+	case StateCache:
+		var records []cacheRecord
+		if err := dec.Decode(&records); err != nil {
+			return 0, err
+		}
+		cache, ok := s.cache.(portableCache)
+		if !ok {
+			return 0, nil
+		}
+		cache.restore(records)
+		return len(records), nil
+	}
+	return 0, nil
+}
+
+// state returns the unexpired clearances and the synced cookies.
+func (c *clearanceStore) state() clearanceState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	state := clearanceState{Clearances: make(map[string]clearance), Synced: make(map[string][]Cookie)}
+	now := c.now()
+	for host, cl := range c.byHost {
+		if now.Before(cl.Expires) {
+			state.Clearances[host] = cl
+		}
+	}
+	for host, cookies := range c.synced {
+		state.Synced[host] = cookies
+	}
+	return state
+}
+
+// restore stores the unexpired clearances of state, also in the backend,
+// and returns how many there were.
+func (c *clearanceStore) restore(state clearanceState) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	now := c.now()
+	for host, cl := range state.Clearances {
+		if !now.Before(cl.Expires) {
+			continue
+		}
+		c.byHost[host] = cl
+		if c.backend != nil {
+			c.backend.store(host, cl)
+		}
+		n++
+	}
+	for host, cookies := range state.Synced {
+		c.synced[host] = mergeCookies(c.synced[host], cookies, now)
+	}
+	return n
+}
+
+// restore adds a session created by another instance, so that requests
+// for its domains use it and it is destroyed on shutdown. Its age and
+// idle time for session garbage collection start now.
+func (p *sessionPool) restore(session adminSession) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.created[session.ID] = session.Backend
+	now := p.now()
+	p.born[session.ID] = now
+	p.used[session.ID] = now
+	for _, domain := range session.Domains {
+		p.byDomain[domain] = session.ID
+	}
+}
+
+// handOff forgets the sessions this proxy created without destroying
+// them, for the instance they were exported to.
+func (p *sessionPool) handOff() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.created = make(map[string]string)
+	p.byDomain = make(map[string]string)
+	p.born = make(map[string]time.Time)
+	p.used = make(map[string]time.Time)
+}
+
+// state returns the tracked domains.
+func (b *failureBudget) state() []domainState {
+	domains := []domainState{}
+	if b == nil {
+		return domains
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for name, d := range b.domains {
+		state := domainState{
+			Domain:        name,
+			LastError:     d.lastError,
+			DisabledUntil: d.disabledUntil,
+			DisabledBy:    d.disabledBy,
+			Reason:        d.reason,
+		}
+		for _, bucket := range d.buckets {
+			state.Buckets = append(state.Buckets, budgetBucketState{Start: bucket.start, Successes: bucket.successes, Failures: bucket.failures})
+		}
+		domains = append(domains, state)
+	}
+	sort.Slice(domains, func(i, j int) bool { return domains[i].Domain < domains[j].Domain })
+	return domains
+}
+
+// restore replaces the budgets of domains and returns how many there were.
+func (b *failureBudget) restore(domains []domainState) int {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, state := range domains {
+		d := &domainBudget{
+			lastError:     state.LastError,
+			disabledUntil: state.DisabledUntil,
+			disabledBy:    state.DisabledBy,
+			reason:        state.Reason,
+		}
+		for _, bucket := range state.Buckets {
+			d.buckets = append(d.buckets, budgetBucket{start: bucket.Start, successes: bucket.Successes, failures: bucket.Failures})
+		}
+		b.domains[strings.ToLower(state.Domain)] = d
+	}
+	return len(domains)
+}
+
+// state returns the usage of the tenants in their current window.
+func (l *bandwidthLimiter) state() []bandwidthState {
+	usage := []bandwidthState{}
+	for _, tenant := range l.list() {
+		usage = append(usage, bandwidthState{Tenant: tenant.Tenant, Start: tenant.Reset.Add(-l.window), Bytes: tenant.Bytes})
+	}
+	return usage
+}
+
+// restore replaces the usage of the tenants whose window is not over and
+// returns how many there were.
+func (l *bandwidthLimiter) restore(usage []bandwidthState) int {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := 0
+	now := l.now()
+	for _, u := range usage {
+		if now.Sub(u.Start) >= l.window {
+			continue
+		}
+		l.usage[u.Tenant] = &bandwidthUsage{start: u.Start, bytes: u.Bytes}
+		n++
+	}
+	return n
+}
+
+func (c *memoryCache) records() []cacheRecord {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	records := []cacheRecord{}
+	now := c.now()
+	for elem := c.ll.Back(); elem != nil; elem = elem.Prev() {
+		entry := elem.Value.(*cacheEntry)
+		if !now.After(entry.expires.Add(c.stale)) {
+			records = append(records, cacheRecord{Key: entry.key, Expires: entry.expires, Response: entry.response})
+		}
+	}
+	return records
+}
+
+func (c *memoryCache) restore(records []cacheRecord) {
+	for _, record := range records {
+		if record.Response != nil {
+			c.set(record.Key, record.Response, record.Expires)
+		}
+	}
+}
+
+func (c *diskCache) records() []cacheRecord {
+	records := []cacheRecord{}
+	files, err := c.files()
+	if err != nil {
+		return records
+	}
+	now := c.now()
+	for path := range files {
+		data, err := os.ReadFile(path)
+		if err == nil {
+			data, err = decompressEntry(data)
+		}
+		var entry diskCacheEntry
+		if err != nil || json.Unmarshal(data, &entry) != nil || entry.Response == nil || now.After(entry.Expires.Add(c.stale)) {
+			continue
+		}
+		records = append(records, cacheRecord{Key: entry.Key, Expires: entry.Expires, Response: entry.Response})
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Expires.Before(records[j].Expires) })
+	return records
+}
+
+func (c *diskCache) restore(records []cacheRecord) {
+	for _, record := range records {
+		if record.Response != nil {
+			c.set(record.Key, record.Response, record.Expires)
+		}
+	}
+}
+
+// serveExportState answers with a state archive of the components in the
+// components query parameter, all by default. With handoff=true the
+// exported sessions are forgotten, so that they are not destroyed when
+// this instance shuts down and the importing instance can keep using them.
+func (a *adminHandler) serveExportState(w http.ResponseWriter, r *http.Request) {
+	components, err := parseStateComponents(r.URL.Query().Get("components"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	var buf bytes.Buffer
+	if err := a.exportState(&buf, components); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	if r.URL.Query().Get("handoff") == "true" && slices.Contains(components, StateSessions) {
+		a.sessions.handOff()
+	}
+	slog.Info("state exported", "components", strings.Join(components, ","), "bytes", buf.Len())
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", `attachment; filename="flareproxygo-state.tar.gz"`)
+	w.WriteHeader(http.StatusOK)
+	buf.WriteTo(w)
+}
+
+// serveImportState merges the state archive in the body into the proxy's
+// state, limited to the components in the components query parameter.
+func (a *adminHandler) serveImportState(w http.ResponseWriter, r *http.Request) {
+	components, err := parseStateComponents(r.URL.Query().Get("components"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	imported, err := a.importState(http.MaxBytesReader(w, r.Body, maxStateBytes), components)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]any{"error": err.Error(), "imported": imported})
+		return
+	}
+	slog.Info("state imported", "imported", imported)
+	writeJSON(w, http.StatusOK, map[string]any{"imported": imported})
+}
+
+// StateCommand runs "state export" and "state import", which copy the
+// state of a running proxy to another through their admin APIs:
+//
+//	flareproxy state export [-admin URL] [-components list] [-handoff] [-o file]
+//	flareproxy state import [-admin URL] [-components list] [file]
+//
+// The admin API is at http://localhost:$ADMIN_PORT unless ADMIN_URL or
+// -admin say otherwise, and ADMIN_TOKEN is its token. Archives are written
+// to and read from standard input and output unless a file is given.
+func StateCommand(args []string, stdin io.Reader, stdout io.Writer) error {
+	if len(args) == 0 || (args[0] != "export" && args[0] != "import") {
+		return errors.New("usage: state export|import [flags]")
+	}
+	command := args[0]
+	flags := flag.NewFlagSet("state "+command, flag.ContinueOnError)
+	admin := flags.String("admin", envString("ADMIN_URL", "http://localhost:"+envString("ADMIN_PORT", "9090")), "admin API of the proxy")
+	token := flags.String("token", os.Getenv("ADMIN_TOKEN"), "admin token")
+	components := flags.String("components", "", "comma separated components, all by default: "+strings.Join(stateComponents, ","))
+	handoff := flags.Bool("handoff", false, "export: hand the sessions over, so the exporting proxy does not destroy them on shutdown")
+	output := flags.String("o", "-", "export: file to write the archive to")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	if _, err := parseStateComponents(*components); err != nil {
+		return err
+	}
+	query := url.Values{}
+	if *components != "" {
+		query.Set("components", *components)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	if command == "export" {
+		if *handoff {
+			query.Set("handoff", "true")
+		}
+		resp, err := stateRequest(ctx, http.MethodGet, *admin, *token, query, nil)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if *output == "-" {
+			_, err = io.Copy(stdout, resp.Body)
+			return err
+		}
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		return writeFileAtomic(*output, data)
+	}
+
+	in := stdin
+	if file := flags.Arg(0); file != "" && file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	resp, err := stateRequest(ctx, http.MethodPost, *admin, *token, query, in)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		Imported map[string]int `json:"imported"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return err
+	}
+	for _, component := range stateComponents {
+		if n, ok := result.Imported[component]; ok {
+			fmt.Fprintf(stdout, "imported %d %s\n", n, component)
+		}
+	}
+	return nil
+}
+
+// stateRequest calls the state endpoint of the admin API at admin,
+// failing on error responses.
+func stateRequest(ctx context.Context, method, admin, token string, query url.Values, body io.Reader) (*http.Response, error) {
+	endpoint := strings.TrimSuffix(admin, "/") + "/admin/state"
+	if len(query) > 0 {
+		endpoint += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/gzip")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		var failure struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&failure)
+		return nil, fmt.Errorf("%s %s: %s %s", method, endpoint, resp.Status, failure.Error)
+	}
+	return resp, nil
+}
@@ -0,0 +1,109 @@
+package flareproxy
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStateExportImport(t *testing.T) {
+	t.Setenv("FLARESOLVERR_URL", "http://a/v1")
+	t.Setenv("CACHE_TTL", "1h")
+	t.Setenv("FAILURE_BUDGET", "0.5")
+	t.Setenv("BANDWIDTH_LIMIT", "1000000")
+	t.Setenv("RATE_LIMIT", "1")
+	t.Setenv("ADMIN_TOKEN", "s3cret")
+
+	// Give the old instance some state of every kind
+	old := newSolver()
+	solved := testResponse("<html>solved</html>")
+	solved.Solution.UserAgent = "test-agent"
+	solved.Solution.Cookies = []Cookie{{Name: ClearanceCookie, Value: "cleared", Expires: float64(time.Now().Add(time.Hour).Unix())}}
+	old.clearances.put("https://example.com/", solved)
+	old.clearances.sync = true
+	old.clearances.merge("example.com", []Cookie{{Name: "login", Value: "me", Session: true}})
+	old.sessions.add("example.com", "flareproxygo-example.com", "http://a/v1")
+	old.budget.disable("hopeless.example", time.Hour)
+	old.rateLimits.reserve("example.com")
+	old.bandwidth.add("tenant", 1234)
+	old.cache.Set("GET https://example.com/", solved)
+
+	oldAdmin := httptest.NewServer(newAdminHandler(old, "s3cret", nil))
+	defer oldAdmin.Close()
+	fresh := newSolver()
+	freshAdmin := httptest.NewServer(newAdminHandler(fresh, "s3cret", nil))
+	defer freshAdmin.Close()
+
+	var archive, out bytes.Buffer
+	if err := StateCommand([]string{"export", "-admin", oldAdmin.URL, "-handoff"}, nil, &archive); err != nil {
+		t.Fatalf("export: %v", err)
+	}
+	if err := StateCommand([]string{"import", "-admin", freshAdmin.URL}, &archive, &out); err != nil {
+		t.Fatalf("import: %v", err)
+	}
+	if !strings.Contains(out.String(), "imported 1 clearances") || !strings.Contains(out.String(), "imported 1 cache") {
+		t.Errorf("import output = %q", out.String())
+	}
+
+	if cl, ok := fresh.clearances.get("example.com"); !ok || cl.UserAgent != "test-agent" || len(cl.Cookies) != 2 {
+		t.Errorf("imported clearance = %+v, %v", cl, ok)
+	}
+	if got := fresh.clearances.syncedCookies("example.com"); len(got) != 1 || got[0].Value != "me" {
+		t.Errorf("imported synced cookies = %+v", got)
+	}
+	if got := fresh.sessions.sessionFor("https://www.example.com/"); got != "flareproxygo-example.com" {
+		t.Errorf("imported session = %q", got)
+	}
+	if got := old.sessions.Created(); len(got) != 0 || len(old.sessions.born) != 0 || len(old.sessions.used) != 0 {
+		t.Errorf("sessions still owned by the exporting instance after handoff: %v", got)
+	}
+	if err := fresh.budget.check("https://hopeless.example/"); err == nil {
+		t.Error("disabled domain enabled after import")
+	}
+	if got, want := fresh.rateLimits.state().Buckets["example.com"], old.rateLimits.state().Buckets["example.com"]; !got.Last.Equal(want.Last) || got.Tokens != want.Tokens {
+		t.Errorf("rate limit bucket = %+v, want %+v", got, want)
+	}
+	if used, _, _ := fresh.bandwidth.status("tenant"); used != 1234 {
+		t.Errorf("imported bandwidth = %d, want 1234", used)
+	}
+	if cached, ok := fresh.cache.Get("GET https://example.com/"); !ok || cached.Solution.Response != "<html>solved</html>" {
+		t.Errorf("imported cache entry = %v, %v", cached, ok)
+	}
+}
+
+func TestStateErrors(t *testing.T) {
+	t.Setenv("FLARESOLVERR_URL", "http://a/v1")
+	s := newSolver()
+	h := newAdminHandler(s, "s3cret", nil)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+	}{
+		{name: "unknown export component", method: "GET", path: "/admin/state?components=cache,secrets"},
+		{name: "unknown import component", method: "POST", path: "/admin/state?components=secrets"},
+		{name: "not gzipped", method: "POST", path: "/admin/state", body: "hello"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rr := adminRequest(t, h, tt.method, tt.path, "s3cret", tt.body); rr.Code != http.StatusBadRequest {
+				t.Errorf("status = %d, want 400: %s", rr.Code, rr.Body.String())
+			}
+		})
+	}
+
+	// Components disabled on the importing instance are skipped
+	var archive bytes.Buffer
+	if err := s.exportState(&archive, []string{StateDomains, StateCache}); err != nil {
+		t.Fatal(err)
+	}
+	imported, err := s.importState(&archive, stateComponents)
+	if err != nil || imported[StateDomains] != 0 || imported[StateCache] != 0 {
+		t.Errorf("import into an instance without budget and cache = %v, %v", imported, err)
+	}
+}
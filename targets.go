@@ -0,0 +1,174 @@
+package flareproxy
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// TargetDeniedError is returned for target hosts the target policy does
+// not allow.
+type TargetDeniedError struct {
+	Host string
+}
+
+func (e *TargetDeniedError) Error() string {
+	return fmt.Sprintf("target %s is not allowed", e.Host)
+}
+
+// targetPattern matches target hosts: exactly, by a glob such as
+// "*.example.com", or by a regular expression written as "/.../".
+type targetPattern struct {
+	exact string
+	glob  string
+	re    *regexp.Regexp
+}
+
+func (p targetPattern) matches(host string) bool {
+	switch {
+	case p.re != nil:
+		return p.re.MatchString(host)
+	case p.glob != "":
+		ok, _ := path.Match(p.glob, host)
+		return ok
+	default:
+		return host == p.exact
+	}
+}
+
+// targetPolicy restricts the hosts the proxy fetches, so that a shared
+// instance does not become an open proxy. Denied hosts take precedence;
+// with an allowlist, only its hosts are fetched. With denyPrivate,
+// targets naming a private address or localhost are denied too, and names
+// resolving to one are refused when dialing, see dialControl.
+type targetPolicy struct {
+	mu    sync.RWMutex
+	allow []targetPattern
+	deny  []targetPattern
+	// restricted is set when an allowlist is configured, even if none of
+	// its entries were valid.
+	restricted  bool
+	denyPrivate bool
+}
+
+// newTargetPolicyFromEnv reads TARGET_ALLOWLIST and TARGET_DENYLIST, comma
+// separated host patterns, and TARGET_DENY_PRIVATE. Invalid entries are
+// skipped with a warning.
+func newTargetPolicyFromEnv() *targetPolicy {
+	p := &targetPolicy{
+		allow:       parseTargetPatterns("TARGET_ALLOWLIST"),
+		deny:        parseTargetPatterns("TARGET_DENYLIST"),
+		restricted:  os.Getenv("TARGET_ALLOWLIST") != "",
+		denyPrivate: envBool("TARGET_DENY_PRIVATE", false),
+	}
+	if p.restricted && len(p.allow) == 0 {
+		slog.Warn("TARGET_ALLOWLIST has no valid entries, denying all targets")
+	}
+	return p
+}
+
+// parseTargetPatterns parses the patterns listed in the environment
+// variable name.
+func parseTargetPatterns(name string) []targetPattern {
+	var patterns []targetPattern
+	for _, entry := range splitList(os.Getenv(name)) {
+		if len(entry) > 2 && strings.HasPrefix(entry, "/") && strings.HasSuffix(entry, "/") {
+			re, err := regexp.Compile("(?i)" + entry[1:len(entry)-1])
+			if err != nil {
+				slog.Warn("ignoring invalid "+name+" entry", "entry", entry, "error", err)
+				continue
+			}
+			patterns = append(patterns, targetPattern{re: re})
+			continue
+		}
+		entry = strings.ToLower(entry)
+		if strings.ContainsAny(entry, "*?[") {
+			if _, err := path.Match(entry, ""); err != nil {
+				slog.Warn("ignoring invalid "+name+" entry", "entry", entry, "error", err)
+				continue
+			}
+			patterns = append(patterns, targetPattern{glob: entry})
+			continue
+		}
+		patterns = append(patterns, targetPattern{exact: entry})
+	}
+	return patterns
+}
+
+// replace adopts the patterns of fresh, e.g. after the configuration was
+// reloaded.
+func (p *targetPolicy) replace(fresh *targetPolicy) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.allow, p.deny, p.restricted, p.denyPrivate = fresh.allow, fresh.deny, fresh.restricted, fresh.denyPrivate
+}
+
+// check returns a *TargetDeniedError if targetURL may not be fetched.
+func (p *targetPolicy) check(targetURL string) error {
+	u, err := url.Parse(targetURL)
+	if err != nil {
+		return err
+	}
+	host := strings.ToLower(u.Hostname())
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, pattern := range p.deny {
+		if pattern.matches(host) {
+			return &TargetDeniedError{Host: host}
+		}
+	}
+	if p.denyPrivate && privateHost(host) {
+		return &TargetDeniedError{Host: host}
+	}
+	if !p.restricted {
+		return nil
+	}
+	for _, pattern := range p.allow {
+		if pattern.matches(host) {
+			return nil
+		}
+	}
+	return &TargetDeniedError{Host: host}
+}
+
+// dialControl is the net.Dialer Control function of the clients fetching
+// targets directly. With denyPrivate, it refuses to connect to private
+// addresses, which names that passed check may resolve to. It reads the
+// policy at every dial, so that reloads apply to the clients as well.
+func (p *targetPolicy) dialControl(network, address string, c syscall.RawConn) error {
+	p.mu.RLock()
+	denyPrivate := p.denyPrivate
+	p.mu.RUnlock()
+	if !denyPrivate {
+		return nil
+	}
+	return denyPrivateAddress(network, address, c)
+}
+
+// privateHost reports whether host is localhost or a private address.
+func privateHost(host string) bool {
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && privateAddress(ip)
+}
+
+// checkRedirect is the http.Client CheckRedirect function of the clients
+// fetching origins directly, so that redirects cannot lead them to hosts
+// that may not be fetched.
+func (p *targetPolicy) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	return p.check(req.URL.String())
+}
@@ -0,0 +1,103 @@
+package flareproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+func TestTargetPolicy(t *testing.T) {
+	tests := []struct {
+		name        string
+		allow       string
+		deny        string
+		denyPrivate bool
+		target      string
+		want        bool
+	}{
+		{name: "no lists", target: "https://example.com/", want: true},
+		{name: "exact", allow: "example.com", target: "https://EXAMPLE.com:8443/page", want: true},
+		{name: "exact excludes subdomains", allow: "example.com", target: "https://www.example.com/"},
+		{name: "wildcard", allow: "*.example.com", target: "https://www.example.com/", want: true},
+		{name: "wildcard excludes the apex", allow: "*.example.com", target: "https://example.com/"},
+		{name: "regex", allow: `/^shop[0-9]+\.example\.net$/`, target: "https://shop12.example.net/", want: true},
+		{name: "regex no match", allow: `/^shop[0-9]+\.example\.net$/`, target: "https://shop.example.net/"},
+		{name: "denied", deny: "*.internal", target: "http://db.internal/"},
+		{name: "deny wins", allow: "*.example.com", deny: "admin.example.com", target: "https://admin.example.com/"},
+		{name: "outside denylist", deny: "evil.example", target: "https://example.com/", want: true},
+		{name: "invalid allowlist denies all", allow: "/(/", target: "https://example.com/"},
+		{name: "loopback", denyPrivate: true, target: "http://127.0.0.1:8191/v1"},
+		{name: "localhost", denyPrivate: true, target: "http://localhost/"},
+		{name: "rfc 1918", denyPrivate: true, target: "http://10.0.0.5/"},
+		{name: "link-local metadata", denyPrivate: true, target: "http://169.254.169.254/latest/meta-data/"},
+		{name: "ipv6 loopback", denyPrivate: true, target: "http://[::1]/"},
+		{name: "public address", denyPrivate: true, target: "http://93.184.215.14/", want: true},
+		{name: "private allowed by default", target: "http://192.168.1.1/", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("TARGET_ALLOWLIST", tt.allow)
+			t.Setenv("TARGET_DENYLIST", tt.deny)
+			t.Setenv("TARGET_DENY_PRIVATE", strconv.FormatBool(tt.denyPrivate))
+			err := newTargetPolicyFromEnv().check(tt.target)
+			var deniedErr *TargetDeniedError
+			if got := err == nil; got != tt.want || (err != nil && !errors.As(err, &deniedErr)) {
+				t.Errorf("check(%s) = %v, want allowed %v", tt.target, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestTargetRestrictions(t *testing.T) {
+	var solves atomic.Int32
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		solves.Add(1)
+		json.NewEncoder(w).Encode(testResponse("<html>solved</html>"))
+	}))
+	defer mockServer.Close()
+	t.Setenv("FLARESOLVERR_URL", mockServer.URL)
+	t.Setenv("TARGET_ALLOWLIST", "*.example.com")
+	s := newSolver()
+	handler := newDirectHandler(s)
+
+	tests := []struct {
+		path       string
+		want       int
+		wantSolves int32
+	}{
+		{path: "/www.example.com/", want: http.StatusOK, wantSolves: 1},
+		{path: "/example.org/", want: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			solves.Store(0)
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, httptest.NewRequest("GET", tt.path, nil))
+			if rr.Code != tt.want {
+				t.Errorf("status = %d, want %d", rr.Code, tt.want)
+			}
+			if got := solves.Load(); got != tt.wantSolves {
+				t.Errorf("solved %d times, want %d", got, tt.wantSolves)
+			}
+		})
+	}
+
+	t.Run("redirects", func(t *testing.T) {
+		origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Redirect(w, r, "http://127.0.0.1/", http.StatusFound)
+		}))
+		defer origin.Close()
+		s.targets.replace(&targetPolicy{deny: []targetPattern{{exact: "127.0.0.1"}}})
+		u, _ := url.Parse(origin.URL)
+		_, err := s.direct.Get("http://localhost:" + u.Port() + "/")
+		var deniedErr *TargetDeniedError
+		if !errors.As(err, &deniedErr) {
+			t.Errorf("Get() error = %v, want the redirect refused", err)
+		}
+	})
+}
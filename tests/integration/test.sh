@@ -187,7 +187,7 @@ build_and_start_proxy() {
     cd "$PROJECT_ROOT" || fail "Failed to change to project root"
     
     log "Building binary to $TEMP_BINARY"
-    if ! go build -o "$TEMP_BINARY" main.go 2>&1; then
+    if ! go build -o "$TEMP_BINARY" ./cmd/flareproxygo 2>&1; then
         fail "Failed to build proxy binary"
     fi
     
@@ -0,0 +1,297 @@
+package flareproxy
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// listenerTLS serves the direct, proxy and admin listeners over HTTPS, so
+// that API keys and cookies are not sent in cleartext. The certificate
+// comes from files, from an ACME CA such as Let's Encrypt, or is
+// generated and self-signed.
+type listenerTLS struct {
+	getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+	acme           *autocert.Manager // nil unless TLS_ACME_DOMAINS is set
+	acmeDomains    []string
+	observe        func(domain string, cert *tls.Certificate)
+	clientCAs      *x509.CertPool // nil unless TLS_CLIENT_CA is set
+}
+
+// newListenerTLSFromEnv configures TLS from TLS_CERT_FILE and TLS_KEY_FILE,
+// TLS_ACME_DOMAINS or TLS_SELF_SIGNED, in that order of precedence. It
+// returns nil, serving plain HTTP, if none is set. Certificates are
+// passed to the monitor, which warns before they expire. Clients may
+// present certificates signed by one of the CAs in TLS_CLIENT_CA, which
+// AUTH_RULES can require.
+func newListenerTLSFromEnv(monitor *timeMonitor) (*listenerTLS, error) {
+	l, err := listenerCertificateFromEnv(monitor)
+	clientCA := os.Getenv("TLS_CLIENT_CA")
+	if err != nil || clientCA == "" {
+		return l, err
+	}
+	if l == nil {
+		return nil, errors.New("TLS_CLIENT_CA needs TLS, set TLS_CERT_FILE, TLS_ACME_DOMAINS or TLS_SELF_SIGNED")
+	}
+	pem, err := os.ReadFile(clientCA)
+	if err != nil {
+		return nil, err
+	}
+	l.clientCAs = x509.NewCertPool()
+	if !l.clientCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%s: no PEM certificates found", clientCA)
+	}
+	return l, nil
+}
+
+func listenerCertificateFromEnv(monitor *timeMonitor) (*listenerTLS, error) {
+	cacheDir := envString("TLS_CACHE_DIR", filepath.Join(os.TempDir(), "flareproxygo-tls"))
+	observe := func(cert *x509.Certificate) { monitor.observeCertificate("listener", cert) }
+
+	certFile, keyFile := os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE")
+	switch {
+	case certFile != "" || keyFile != "":
+		if certFile == "" || keyFile == "" {
+			return nil, errors.New("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+		}
+		files := &certFiles{certPath: certFile, keyPath: keyFile, onLoad: observe}
+		if _, err := files.get(); err != nil {
+			return nil, err
+		}
+		return &listenerTLS{getCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) { return files.get() }}, nil
+
+	case os.Getenv("TLS_ACME_DOMAINS") != "":
+		var domains []string
+		for _, domain := range splitList(os.Getenv("TLS_ACME_DOMAINS")) {
+			domains = append(domains, strings.ToLower(domain))
+		}
+		m := newACMEManager(envString("TLS_ACME_DIRECTORY", LetsEncryptDirectory), domains,
+			os.Getenv("TLS_ACME_EMAIL"), cacheDir)
+		return &listenerTLS{getCertificate: m.GetCertificate, acme: m, acmeDomains: domains,
+			observe: func(domain string, cert *tls.Certificate) {
+				monitor.observeCertificate("listener "+domain, cert.Leaf)
+			}}, nil
+
+	case envBool("TLS_SELF_SIGNED", false):
+		cert, err := selfSignedCertificate(filepath.Join(cacheDir, "self-signed.pem"), selfSignedHosts())
+		if err != nil {
+			return nil, err
+		}
+		observe(cert.Leaf)
+		fingerprint := sha256.Sum256(cert.Leaf.Raw)
+		slog.Info("serving a self-signed TLS certificate", "hosts", strings.Join(cert.Leaf.DNSNames, ","),
+			"sha256", hex.EncodeToString(fingerprint[:]))
+		return &listenerTLS{getCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) { return cert, nil }}, nil
+	}
+	return nil, nil
+}
+
+// scheme returns the scheme clients use to reach the listeners.
+func (l *listenerTLS) scheme() string {
+	if l == nil {
+		return "http"
+	}
+	return "https"
+}
+
+// run obtains the ACME certificates, if any, and reports their expiry
+// until ctx is done.
+func (l *listenerTLS) run(ctx context.Context) {
+	if l == nil || l.acme == nil {
+		return
+	}
+	runACME(ctx, l.acme, l.acmeDomains, l.observe)
+}
+
+// wrap returns srv, serving HTTPS if TLS is configured.
+func (l *listenerTLS) wrap(srv *http.Server) server {
+	if l == nil {
+		return srv
+	}
+	srv.TLSConfig = &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: l.getCertificate,
+		NextProtos:     []string{"http/1.1", acme.ALPNProto},
+	}
+	if l.clientCAs != nil {
+		srv.TLSConfig.ClientCAs = l.clientCAs
+		srv.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	// CONNECT tunnels take over the connection, which HTTP/2 does not allow
+	srv.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	return tlsServer{srv}
+}
+
+// tlsServer is an *http.Server serving HTTPS with its TLSConfig.
+type tlsServer struct {
+	*http.Server
+}
+
+func (s tlsServer) ListenAndServe() error {
+	return s.ListenAndServeTLS("", "")
+}
+
+// certFiles loads a certificate and key from files, and again once they
+// changed, e.g. after a renewal. Files are checked at most once a minute.
+type certFiles struct {
+	certPath string
+	keyPath  string
+	onLoad   func(*x509.Certificate)
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+func (f *certFiles) get() (*tls.Certificate, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	if f.cert != nil && now.Sub(f.checked) < time.Minute {
+		return f.cert, nil
+	}
+	f.checked = now
+	info, err := os.Stat(f.certPath)
+	if err == nil && f.cert != nil && info.ModTime().Equal(f.modTime) {
+		return f.cert, nil
+	}
+	cert, err := loadKeyPair(f.certPath, f.keyPath)
+	if err != nil {
+		if f.cert != nil {
+			slog.Warn("failed to reload TLS certificate, keeping the previous one", "path", f.certPath, "error", err)
+			return f.cert, nil
+		}
+		return nil, err
+	}
+	if info != nil {
+		f.modTime = info.ModTime()
+	}
+	f.cert = cert
+	if f.onLoad != nil {
+		f.onLoad(cert.Leaf)
+	}
+	return cert, nil
+}
+
+// loadKeyPair reads a PEM encoded certificate chain and its key.
+func loadKeyPair(certPath, keyPath string) (*tls.Certificate, error) {
+	certPEM, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	return parseKeyPair(certPEM, keyPEM)
+}
+
+// parseKeyPair parses a PEM encoded certificate chain and its key, with
+// the parsed leaf.
+func parseKeyPair(certPEM, keyPEM []byte) (*tls.Certificate, error) {
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("TLS certificate: %w", err)
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return nil, fmt.Errorf("TLS certificate: %w", err)
+	}
+	return &cert, nil
+}
+
+// selfSignedHosts returns the names of the self-signed certificate:
+// TLS_SELF_SIGNED_HOSTS, or localhost and the host name.
+func selfSignedHosts() []string {
+	if hosts := splitList(os.Getenv("TLS_SELF_SIGNED_HOSTS")); len(hosts) > 0 {
+		return hosts
+	}
+	hosts := []string{"localhost", "127.0.0.1", "::1"}
+	if hostname, err := os.Hostname(); err == nil && hostname != "localhost" {
+		hosts = append(hosts, hostname)
+	}
+	return hosts
+}
+
+// selfSignedCertificate loads the self-signed certificate saved at path,
+// or generates one for hosts, valid for a year, and saves it there so
+// that clients trusting it keep doing so across restarts. A certificate
+// that expires within a month or lacks some of the hosts is replaced.
+func selfSignedCertificate(path string, hosts []string) (*tls.Certificate, error) {
+	if data, err := os.ReadFile(path); err == nil {
+		cert, err := parseKeyPair(data, data)
+		if err == nil && time.Until(cert.Leaf.NotAfter) > 30*24*time.Hour && coversHosts(cert.Leaf, hosts) {
+			return cert, nil
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: randomSerial(),
+		Subject:      pkix.Name{CommonName: hosts[0], Organization: []string{"FlareProxy Go"}},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	data := append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})...)
+	// The key stays readable by the owner only
+	err = os.MkdirAll(filepath.Dir(path), 0o700)
+	if err == nil {
+		err = writeFileAtomic(path, data)
+	}
+	if err != nil {
+		slog.Warn("failed to save self-signed TLS certificate, it changes on restart", "path", path, "error", err)
+	}
+	return parseKeyPair(data, data)
+}
+
+// coversHosts reports whether cert is valid for all of hosts.
+func coversHosts(cert *x509.Certificate, hosts []string) bool {
+	for _, host := range hosts {
+		if cert.VerifyHostname(host) != nil {
+			return false
+		}
+	}
+	return true
+}
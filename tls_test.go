@@ -0,0 +1,140 @@
+package flareproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestListenerTLS(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("TLS_SELF_SIGNED", "true")
+	t.Setenv("TLS_SELF_SIGNED_HOSTS", "localhost,127.0.0.1")
+	t.Setenv("TLS_CACHE_DIR", dir)
+	monitor := newTimeMonitor(time.Minute, 400*24*time.Hour)
+	l, err := newListenerTLSFromEnv(monitor)
+	if err != nil || l.scheme() != "https" {
+		t.Fatalf("newListenerTLSFromEnv() = %v, %v", l, err)
+	}
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto)
+	})
+	srv := &http.Server{Handler: handler}
+	if _, ok := l.wrap(srv).(tlsServer); !ok {
+		t.Fatal("wrap() does not serve TLS")
+	}
+	ts := httptest.NewUnstartedServer(handler)
+	ts.TLS = srv.TLSConfig
+	ts.StartTLS()
+	defer ts.Close()
+
+	// The certificate is kept, so that clients can keep trusting it
+	cert, err := selfSignedCertificate(filepath.Join(dir, "self-signed.pem"), []string{"localhost", "127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert.Leaf)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}, ForceAttemptHTTP2: true}}
+	// httptest adds its own certificate, served to clients without SNI
+	resp, err := client.Get(strings.Replace(ts.URL, "127.0.0.1", "localhost", 1))
+	if err != nil {
+		t.Fatalf("GET over TLS failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "HTTP/1.1" {
+		t.Errorf("protocol = %s, want HTTP/1.1 so that CONNECT works", body)
+	}
+
+	if !monitor.warned["cert listener "+cert.Leaf.SerialNumber.String()] {
+		t.Error("certificate expiry not monitored")
+	}
+
+	t.Setenv("TLS_SELF_SIGNED", "")
+	if l, err := newListenerTLSFromEnv(monitor); l != nil || err != nil || l.scheme() != "http" {
+		t.Errorf("newListenerTLSFromEnv() = %v, %v without TLS settings", l, err)
+	}
+	t.Setenv("TLS_CERT_FILE", filepath.Join(dir, "self-signed.pem"))
+	if _, err := newListenerTLSFromEnv(monitor); err == nil {
+		t.Error("TLS_CERT_FILE accepted without TLS_KEY_FILE")
+	}
+}
+
+func TestListenerClientCA(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("TLS_CACHE_DIR", dir)
+	t.Setenv("TLS_CLIENT_CA", filepath.Join(dir, "self-signed.pem"))
+	monitor := newTimeMonitor(time.Minute, 400*24*time.Hour)
+	if _, err := newListenerTLSFromEnv(monitor); err == nil {
+		t.Error("TLS_CLIENT_CA accepted without TLS")
+	}
+
+	t.Setenv("TLS_SELF_SIGNED", "true")
+	l, err := newListenerTLSFromEnv(monitor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{}
+	l.wrap(srv)
+	if srv.TLSConfig.ClientCAs == nil || srv.TLSConfig.ClientAuth != tls.VerifyClientCertIfGiven {
+		t.Errorf("client certificates not requested: %v", srv.TLSConfig.ClientAuth)
+	}
+
+	notPEM := filepath.Join(dir, "ca.txt")
+	os.WriteFile(notPEM, []byte("not a certificate"), 0o600)
+	t.Setenv("TLS_CLIENT_CA", notPEM)
+	if _, err := newListenerTLSFromEnv(monitor); err == nil {
+		t.Error("TLS_CLIENT_CA without certificates accepted")
+	}
+}
+
+func TestCertFiles(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "cert.pem")
+	first, err := selfSignedCertificate(path, []string{"first.example"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var loaded []string
+	files := &certFiles{certPath: path, keyPath: path, onLoad: func(cert *x509.Certificate) {
+		loaded = append(loaded, cert.DNSNames[0])
+	}}
+	cert, err := files.get()
+	if err != nil || !cert.Leaf.Equal(first.Leaf) {
+		t.Fatalf("get() = %v, %v", cert, err)
+	}
+
+	// A renewed certificate is picked up
+	if _, err := selfSignedCertificate(path, []string{"second.example"}); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Hour)
+	os.Chtimes(path, later, later)
+	if cert, _ := files.get(); cert.Leaf.DNSNames[0] != "first.example" {
+		t.Errorf("files checked again within a minute")
+	}
+	files.checked = time.Time{}
+	if cert, _ := files.get(); cert.Leaf.DNSNames[0] != "second.example" {
+		t.Errorf("renewed certificate not loaded, serving %v", cert.Leaf.DNSNames)
+	}
+
+	// A broken file does not take the listener down
+	os.WriteFile(path, []byte("garbage"), 0o600)
+	os.Chtimes(path, later.Add(time.Hour), later.Add(time.Hour))
+	files.checked = time.Time{}
+	if cert, err := files.get(); err != nil || cert.Leaf.DNSNames[0] != "second.example" {
+		t.Errorf("get() = %v, %v after a broken update", cert, err)
+	}
+	if len(loaded) != 2 {
+		t.Errorf("loaded %v, want both certificates monitored", loaded)
+	}
+}
@@ -0,0 +1,253 @@
+package flareproxy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseTOML parses the subset of TOML needed for configuration files:
+// comments, [table] and [dotted.table] headers, bare and quoted keys,
+// basic and literal strings, integers, floats, booleans and arrays of
+// those, which may span several lines. Inline tables, array tables and
+// dates are not supported.
+func parseTOML(data string) (map[string]interface{}, error) {
+	root := make(map[string]interface{})
+	table := root
+	lines := strings.Split(strings.ReplaceAll(data, "\r\n", "\n"), "\n")
+
+	for i := 0; i < len(lines); i++ {
+		lineNo := i + 1
+		line := strings.TrimSpace(stripComment(lines[i]))
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") {
+			if strings.HasPrefix(line, "[[") {
+				return nil, fmt.Errorf("line %d: array tables are not supported", lineNo)
+			}
+			if !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("line %d: unterminated table header", lineNo)
+			}
+			keys, err := parseKey(line[1 : len(line)-1])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", lineNo, err)
+			}
+			if table, err = subTable(root, keys); err != nil {
+				return nil, fmt.Errorf("line %d: %v", lineNo, err)
+			}
+			continue
+		}
+
+		key, value, ok := cutUnquoted(line, '=')
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key = value", lineNo)
+		}
+		keys, err := parseKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNo, err)
+		}
+		value = strings.TrimSpace(value)
+		// Arrays may continue over several lines
+		for strings.HasPrefix(value, "[") && !arrayClosed(value) && i+1 < len(lines) {
+			i++
+			value += " " + strings.TrimSpace(stripComment(lines[i]))
+		}
+		parsed, err := parseTOMLValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNo, err)
+		}
+
+		parent, err := subTable(table, keys[:len(keys)-1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNo, err)
+		}
+		last := keys[len(keys)-1]
+		if _, exists := parent[last]; exists {
+			return nil, fmt.Errorf("line %d: duplicate key %q", lineNo, last)
+		}
+		parent[last] = parsed
+	}
+	return root, nil
+}
+
+// subTable returns the table at keys below t, creating it if needed.
+func subTable(t map[string]interface{}, keys []string) (map[string]interface{}, error) {
+	for _, key := range keys {
+		switch next := t[key].(type) {
+		case nil:
+			created := make(map[string]interface{})
+			t[key] = created
+			t = created
+		case map[string]interface{}:
+			t = next
+		default:
+			return nil, fmt.Errorf("key %q is not a table", key)
+		}
+	}
+	return t, nil
+}
+
+// parseKey splits a possibly dotted, possibly quoted key.
+func parseKey(s string) ([]string, error) {
+	var keys []string
+	for {
+		s = strings.TrimSpace(s)
+		var key string
+		if strings.HasPrefix(s, `"`) || strings.HasPrefix(s, "'") {
+			end := strings.IndexByte(s[1:], s[0])
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated quoted key")
+			}
+			key, s = s[1:end+1], s[end+2:]
+		} else {
+			end := strings.IndexByte(s, '.')
+			if end < 0 {
+				end = len(s)
+			}
+			key, s = strings.TrimSpace(s[:end]), s[end:]
+			if key == "" || strings.ContainsAny(key, " \t\"'") {
+				return nil, fmt.Errorf("invalid key %q", key)
+			}
+		}
+		keys = append(keys, key)
+		s = strings.TrimSpace(s)
+		if s == "" {
+			return keys, nil
+		}
+		if s[0] != '.' {
+			return nil, fmt.Errorf("unexpected %q after key", s)
+		}
+		s = s[1:]
+	}
+}
+
+// tomlIntegerBases are the bases of the integer prefixes TOML allows.
+var tomlIntegerBases = map[string]int{"0x": 16, "0o": 8, "0b": 2}
+
+func parseTOMLValue(s string) (interface{}, error) {
+	switch {
+	case s == "":
+		return nil, fmt.Errorf("missing value")
+	case s == "true":
+		return true, nil
+	case s == "false":
+		return false, nil
+	case strings.HasPrefix(s, `"""`) || strings.HasPrefix(s, "'''"):
+		return nil, fmt.Errorf("multi-line strings are not supported")
+	case s[0] == '"':
+		if len(s) < 2 || s[len(s)-1] != '"' {
+			return nil, fmt.Errorf("unterminated string")
+		}
+		return strconv.Unquote(s)
+	case s[0] == '\'':
+		if len(s) < 2 || s[len(s)-1] != '\'' {
+			return nil, fmt.Errorf("unterminated string")
+		}
+		return s[1 : len(s)-1], nil
+	case s[0] == '[':
+		return parseTOMLArray(s)
+	case s[0] == '{':
+		return nil, fmt.Errorf("inline tables are not supported")
+	}
+	number := strings.ReplaceAll(s, "_", "")
+	if base, ok := tomlIntegerBases[number[:min(2, len(number))]]; ok {
+		digits := number[2:]
+		if digits == "" || digits[0] == '+' || digits[0] == '-' {
+			return nil, fmt.Errorf("invalid value %q", s)
+		}
+		i, err := strconv.ParseInt(digits, base, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value %q", s)
+		}
+		return i, nil
+	}
+	// TOML forbids leading zeros, which ParseInt would otherwise read as
+	// octal
+	if digits := strings.TrimLeft(number, "+-"); len(digits) > 1 && digits[0] == '0' && digits[1] >= '0' && digits[1] <= '9' {
+		return nil, fmt.Errorf("leading zeros are not allowed in %q", s)
+	}
+	if i, err := strconv.ParseInt(number, 10, 64); err == nil {
+		return i, nil
+	}
+	if f, err := strconv.ParseFloat(number, 64); err == nil {
+		return f, nil
+	}
+	return nil, fmt.Errorf("invalid value %q", s)
+}
+
+func parseTOMLArray(s string) ([]interface{}, error) {
+	if !strings.HasSuffix(s, "]") {
+		return nil, fmt.Errorf("unterminated array")
+	}
+	inner := strings.TrimSpace(s[1 : len(s)-1])
+	values := []interface{}{}
+	for inner != "" {
+		item, rest, _ := cutUnquoted(inner, ',')
+		item = strings.TrimSpace(item)
+		if item != "" {
+			if strings.HasPrefix(item, "[") {
+				return nil, fmt.Errorf("nested arrays are not supported")
+			}
+			value, err := parseTOMLValue(item)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+		}
+		inner = strings.TrimSpace(rest)
+	}
+	return values, nil
+}
+
+// cutUnquoted cuts s around the first sep outside of a quoted string.
+func cutUnquoted(s string, sep byte) (before, after string, found bool) {
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == sep:
+			return s[:i], s[i+1:], true
+		}
+	}
+	return s, "", false
+}
+
+// stripComment removes a trailing comment outside of quoted strings.
+func stripComment(line string) string {
+	before, _, _ := cutUnquoted(line, '#')
+	return before
+}
+
+// arrayClosed reports whether the brackets of an array value balance.
+func arrayClosed(s string) bool {
+	depth := 0
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '[':
+			depth++
+		case c == ']':
+			depth--
+		}
+	}
+	return depth == 0
+}
@@ -0,0 +1,63 @@
+package flareproxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// TraceparentHeader carries the W3C trace context.
+const TraceparentHeader = "traceparent"
+
+// parseTraceparent returns the trace ID and sampled flag of a W3C
+// traceparent header ("00-<trace id>-<parent id>-<flags>"), or false if
+// the header is missing or malformed.
+func parseTraceparent(header string) (traceID string, sampled, ok bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return "", false, false
+	}
+	if len(parts[1]) != 32 || !isHex(parts[1]) || parts[1] == strings.Repeat("0", 32) {
+		return "", false, false
+	}
+	if len(parts[2]) != 16 || !isHex(parts[2]) || parts[2] == strings.Repeat("0", 16) {
+		return "", false, false
+	}
+	if len(parts[3]) != 2 || !isHex(parts[3]) {
+		return "", false, false
+	}
+	flags, _ := hex.DecodeString(parts[3])
+	return strings.ToLower(parts[1]), flags[0]&1 == 1, true
+}
+
+// traceFromRequest returns the trace ID of an incoming request, starting a
+// new trace when the client did not send a valid traceparent.
+func traceFromRequest(r *http.Request) string {
+	if traceID, _, ok := parseTraceparent(r.Header.Get(TraceparentHeader)); ok {
+		return traceID
+	}
+	return randomHex(16)
+}
+
+// traceparent returns a traceparent header continuing traceID with a new
+// span ID, for requests sent on to FlareSolverr.
+func traceparent(traceID string) string {
+	return "00-" + traceID + "-" + randomHex(8) + "-01"
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func isHex(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F') {
+			return false
+		}
+	}
+	return true
+}
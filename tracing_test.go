@@ -0,0 +1,32 @@
+package flareproxy
+
+import "testing"
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		header      string
+		wantTraceID string
+		wantSampled bool
+		wantOK      bool
+	}{
+		{header: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", wantTraceID: "4bf92f3577b34da6a3ce929d0e0e4736", wantSampled: true, wantOK: true},
+		{header: "00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-00", wantTraceID: "4bf92f3577b34da6a3ce929d0e0e4736", wantOK: true},
+		{header: "", wantOK: false},
+		{header: "00-00000000000000000000000000000000-00f067aa0ba902b7-01", wantOK: false},
+		{header: "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", wantOK: false},
+		{header: "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", wantOK: false},
+		{header: "00-4bf92f3577b34da6a3ce929d0e0e47zz-00f067aa0ba902b7-01", wantOK: false},
+		{header: "00-4bf92f3577b34da6-00f067aa0ba902b7-01", wantOK: false},
+	}
+	for _, tt := range tests {
+		traceID, sampled, ok := parseTraceparent(tt.header)
+		if traceID != tt.wantTraceID || sampled != tt.wantSampled || ok != tt.wantOK {
+			t.Errorf("parseTraceparent(%q) = %q, %v, %v, want %q, %v, %v",
+				tt.header, traceID, sampled, ok, tt.wantTraceID, tt.wantSampled, tt.wantOK)
+		}
+	}
+
+	if _, _, ok := parseTraceparent(traceparent("4bf92f3577b34da6a3ce929d0e0e4736")); !ok {
+		t.Error("traceparent() produced an invalid header")
+	}
+}
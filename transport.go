@@ -0,0 +1,98 @@
+package flareproxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Transport is an http.RoundTripper that fetches pages through
+// FlareSolverr, with the proxy's caching, sessions, cookie reuse, retries
+// and rate limits, so that an http.Client based scraper can get past
+// Cloudflare by swapping its transport:
+//
+//	client := &http.Client{Transport: flareproxy.NewTransport("http://localhost:8191/v1")}
+//
+// The cookies of a solution are returned as Set-Cookie headers, which the
+// client's cookie jar, if any, keeps. Only GET and HEAD requests are
+// supported, as FlareSolverr renders pages in a browser.
+type Transport struct {
+	solver *solver
+}
+
+// NewTransport creates a transport for the FlareSolverr instances at
+// flareSolverrURL, a comma separated list, configured from the
+// environment otherwise. An empty URL uses FLARESOLVERR_URL.
+func NewTransport(flareSolverrURL string) *Transport {
+	return &Transport{solver: NewClient(flareSolverrURL).solver}
+}
+
+// Transport returns a transport fetching pages through the server's
+// solver.
+func (s *Server) Transport() *Transport {
+	return &Transport{solver: s.solver}
+}
+
+// RoundTrip implements http.RoundTripper. Solver failures are returned as
+// errors, while the origin's status, e.g. a 404, is the response's.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	if req.Method != http.MethodGet && req.Method != http.MethodHead && req.Method != "" {
+		return nil, fmt.Errorf("flareproxy: %s requests are not supported", req.Method)
+	}
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return nil, fmt.Errorf("flareproxy: unsupported protocol scheme %q", req.URL.Scheme)
+	}
+	result, err := t.solver.process(req.Context(), FetchRequest{Cmd: "request.get", URL: req.URL.String(), Header: req.Header})
+	if err != nil {
+		return nil, err
+	}
+	return solutionResponse(req, result), nil
+}
+
+// solutionResponse converts a solution into the response to req.
+func solutionResponse(req *http.Request, result *FetchResult) *http.Response {
+	flareResponse, meta := result.Response, result.meta
+	status := meta.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	body := flareResponse.Solution.Response
+	header := make(http.Header)
+	header.Set("Content-Type", solutionContentType(flareResponse))
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+	header.Set(TrailerSolveTime, strconv.FormatInt(meta.SolveTime.Milliseconds(), 10))
+	header.Set(TrailerCache, meta.Cache)
+	if meta.Backend != "" {
+		header.Set(TrailerBackend, meta.Backend)
+	}
+	if userAgent := flareResponse.Solution.UserAgent; userAgent != "" {
+		header.Set(UserAgentHeader, userAgent)
+	}
+	for _, c := range flareResponse.Solution.Cookies {
+		if c.Name == "" {
+			continue
+		}
+		if cookie := c.HTTPCookie().String(); cookie != "" {
+			header.Add("Set-Cookie", cookie)
+		}
+	}
+	if req.Method == http.MethodHead {
+		body = ""
+	}
+	return &http.Response{
+		Status:        strconv.Itoa(status) + " " + http.StatusText(status),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(flareResponse.Solution.Response)),
+		Request:       req,
+	}
+}
@@ -0,0 +1,88 @@
+package flareproxy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestTransport(t *testing.T) {
+	var requests []FlareSolverrRequest
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req FlareSolverrRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		requests = append(requests, req)
+		response := testResponse("<html>solved</html>")
+		if strings.HasSuffix(req.URL, "/missing") {
+			response.Solution.Status = http.StatusNotFound
+		}
+		response.Solution.Cookies = []Cookie{{Name: "cf_clearance", Value: "abc", Domain: "example.com", Path: "/", Expires: -1, Session: true}}
+		json.NewEncoder(w).Encode(response)
+	}))
+	defer mockServer.Close()
+
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Transport: NewTransport(mockServer.URL), Jar: jar}
+
+	resp, err := client.Get("https://example.com/page")
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "<html>solved</html>" {
+		t.Errorf("response = %d %q", resp.StatusCode, body)
+	}
+	if got := resp.Header.Get("Content-Type"); !strings.HasPrefix(got, "text/html") {
+		t.Errorf("Content-Type = %q, want text/html", got)
+	}
+	if len(requests) != 1 || requests[0].URL != "https://example.com/page" || requests[0].Cmd != "request.get" {
+		t.Errorf("FlareSolverr requests = %+v", requests)
+	}
+	u, _ := url.Parse("https://example.com/")
+	if cookies := jar.Cookies(u); len(cookies) != 1 || cookies[0].Name != "cf_clearance" {
+		t.Errorf("jar cookies = %v, want the clearance cookie", cookies)
+	}
+
+	// The origin's status is the response's
+	resp, err = client.Get("https://example.com/missing")
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("status = %d, want 404", resp.StatusCode)
+	}
+
+	resp, err = client.Head("https://example.com/page")
+	if err != nil {
+		t.Fatalf("Head() error = %v", err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if len(body) != 0 || resp.ContentLength != int64(len("<html>solved</html>")) {
+		t.Errorf("HEAD body = %q, length %d", body, resp.ContentLength)
+	}
+
+	if _, err := client.Post("https://example.com/form", "text/plain", strings.NewReader("a")); err == nil {
+		t.Error("Post() succeeded, want an unsupported method error")
+	}
+}
+
+func TestTransportSolverError(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(FlareSolverrResponse{Status: "error", Message: "challenge not solved"})
+	}))
+	defer mockServer.Close()
+
+	client := &http.Client{Transport: NewTransport(mockServer.URL)}
+	_, err := client.Get("https://example.com/")
+	if err == nil || !strings.Contains(err.Error(), "challenge not solved") {
+		t.Errorf("Get() error = %v, want the solver error", err)
+	}
+}
@@ -0,0 +1,207 @@
+package flareproxy
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UpstreamProxyHeader routes a single request through the given exit
+// proxy, e.g. one in a specific country. Only proxies the operator listed
+// in UPSTREAM_PROXY_ALLOWLIST are accepted, so clients cannot make the
+// solver connect to arbitrary hosts.
+const UpstreamProxyHeader = "X-FlareProxy-Upstream-Proxy"
+
+// UpstreamOptions configures the upstream proxies a Server solves pages
+// through.
+type UpstreamOptions struct {
+	// Proxies are the proxy URLs used for all domains.
+	Proxies []string
+	// Domains gives domains and their subdomains their own proxies; an
+	// empty list sends them through none.
+	Domains map[string][]string
+	// Allowlist are the proxies clients may pick per request with the
+	// UpstreamProxyHeader.
+	Allowlist []string
+	// Strategy is how a domain's proxies take turns, one of the
+	// ProxyStrategy constants; empty is round robin.
+	Strategy string
+	// Proxies failing MaxFailures times in a row rest for Cooldown.
+	MaxFailures int
+	Cooldown    time.Duration
+}
+
+// UpstreamOptionsFromEnv reads the UpstreamOptions from UPSTREAM_PROXIES,
+// a comma separated list of proxy URLs, UPSTREAM_PROXY_DOMAINS, rules like
+// "example.com=http://a:3128|http://b:3128,other.org=none",
+// UPSTREAM_PROXY_ALLOWLIST, UPSTREAM_PROXY_STRATEGY,
+// UPSTREAM_PROXY_MAX_FAILURES and UPSTREAM_PROXY_COOLDOWN.
+func UpstreamOptionsFromEnv() UpstreamOptions {
+	opts := UpstreamOptions{
+		Proxies:     splitList(os.Getenv("UPSTREAM_PROXIES")),
+		Domains:     make(map[string][]string),
+		Allowlist:   splitList(os.Getenv("UPSTREAM_PROXY_ALLOWLIST")),
+		Strategy:    envString("UPSTREAM_PROXY_STRATEGY", ProxyStrategyRoundRobin),
+		MaxFailures: envInt("UPSTREAM_PROXY_MAX_FAILURES", 3),
+		Cooldown:    envDuration("UPSTREAM_PROXY_COOLDOWN", 10*time.Minute),
+	}
+	for _, rule := range splitList(os.Getenv("UPSTREAM_PROXY_DOMAINS")) {
+		domain, list, ok := strings.Cut(rule, "=")
+		if !ok {
+			// Not logged, the rule may hold credentials
+			slog.Warn("ignoring UPSTREAM_PROXY_DOMAINS rule without a domain")
+			continue
+		}
+		domain = strings.TrimSpace(domain)
+		opts.Domains[domain] = []string{}
+		if strings.TrimSpace(list) != "none" {
+			opts.Domains[domain] = strings.Split(list, "|")
+		}
+	}
+	return opts
+}
+
+// upstreamProxyAllowlist parses the allowed proxy URLs, keyed by the URL
+// without credentials. Invalid entries are skipped with a warning.
+func upstreamProxyAllowlist(list []string) map[string]FlareSolverrProxy {
+	allowed := make(map[string]FlareSolverrProxy)
+	for _, raw := range list {
+		proxy, err := parseUpstreamProxy(raw)
+		if err != nil {
+			slog.Warn("ignoring invalid UPSTREAM_PROXY_ALLOWLIST entry", "error", err)
+			continue
+		}
+		allowed[proxy.URL] = proxy
+	}
+	return allowed
+}
+
+// upstreamPolicy picks the upstream proxy for requests that do not name
+// one in the UpstreamProxyHeader, so that solves originate from the
+// operator's residential or datacenter IPs. How a domain's proxies take
+// turns depends on the rotation strategy; proxies that keep failing, or
+// that the operator bans, are rested for a cooldown.
+type upstreamPolicy struct {
+	mu          sync.Mutex
+	global      []FlareSolverrProxy
+	domains     map[string][]FlareSolverrProxy // an empty list means no proxy
+	strategy    string
+	maxFailures int
+	cooldown    time.Duration
+	now         func() time.Time
+	next        map[string]int         // per rule, "" for the global list
+	state       map[string]*proxyState // by proxy URL
+}
+
+// newUpstreamPolicyFromEnv builds the upstream policy from the
+// environment, see UpstreamOptionsFromEnv.
+func newUpstreamPolicyFromEnv() *upstreamPolicy {
+	return newUpstreamPolicy(UpstreamOptionsFromEnv())
+}
+
+// newUpstreamPolicy builds the upstream policy of opts. Invalid proxies
+// are skipped with a warning.
+func newUpstreamPolicy(opts UpstreamOptions) *upstreamPolicy {
+	p := &upstreamPolicy{
+		domains:     make(map[string][]FlareSolverrProxy),
+		strategy:    proxyStrategy(opts.Strategy),
+		maxFailures: opts.MaxFailures,
+		cooldown:    opts.Cooldown,
+		now:         time.Now,
+		next:        make(map[string]int),
+		state:       make(map[string]*proxyState),
+	}
+	p.global = parseUpstreamProxies(opts.Proxies, "UPSTREAM_PROXIES")
+	for domain, list := range opts.Domains {
+		p.domains[strings.ToLower(domain)] = parseUpstreamProxies(list, "UPSTREAM_PROXY_DOMAINS")
+	}
+	for _, proxy := range p.global {
+		p.state[proxy.URL] = &proxyState{}
+	}
+	for _, proxies := range p.domains {
+		for _, proxy := range proxies {
+			p.state[proxy.URL] = &proxyState{}
+		}
+	}
+	return p
+}
+
+func parseUpstreamProxies(list []string, variable string) []FlareSolverrProxy {
+	var proxies []FlareSolverrProxy
+	for _, raw := range list {
+		proxy, err := parseUpstreamProxy(raw)
+		if err != nil {
+			slog.Warn("ignoring invalid "+variable+" entry", "error", err)
+			continue
+		}
+		proxies = append(proxies, proxy)
+	}
+	return proxies
+}
+
+// parseUpstreamProxy validates a proxy URL for FlareSolverr, which accepts
+// HTTP(S) and SOCKS proxies. The scheme and host are lowercased and any
+// credentials moved out of the URL, so the URL identifies the proxy
+// however it is spelled.
+func parseUpstreamProxy(raw string) (FlareSolverrProxy, error) {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil {
+		return FlareSolverrProxy{}, fmt.Errorf("invalid proxy URL: %v", err)
+	}
+	scheme := strings.ToLower(u.Scheme)
+	switch scheme {
+	case "http", "https", "socks4", "socks5":
+	default:
+		return FlareSolverrProxy{}, fmt.Errorf("proxy %s: scheme must be http, https, socks4 or socks5", u.Redacted())
+	}
+	if u.Hostname() == "" || u.Port() == "" {
+		return FlareSolverrProxy{}, fmt.Errorf("proxy %s: host and port are required", u.Redacted())
+	}
+	if (u.Path != "" && u.Path != "/") || u.RawQuery != "" {
+		return FlareSolverrProxy{}, fmt.Errorf("proxy %s: must not have a path or query", u.Redacted())
+	}
+	proxy := FlareSolverrProxy{URL: scheme + "://" + strings.ToLower(u.Host)}
+	if u.User != nil {
+		// Chrome, which FlareSolverr drives, cannot authenticate to SOCKS
+		// proxies and would silently connect without the proxy
+		if strings.HasPrefix(scheme, "socks") {
+			return FlareSolverrProxy{}, fmt.Errorf("proxy %s: SOCKS proxies with credentials are not supported by FlareSolverr", u.Redacted())
+		}
+		proxy.Username = u.User.Username()
+		proxy.Password, _ = u.User.Password()
+	}
+	return proxy, nil
+}
+
+// upstreamProxyFrom returns the upstream proxy requested for ctx, if any.
+func upstreamProxyFrom(ctx context.Context) *FlareSolverrProxy {
+	proxy, _ := ctx.Value(upstreamProxyKey).(*FlareSolverrProxy)
+	return proxy
+}
+
+// withUpstreamProxy applies the UpstreamProxyHeader, or ProxyHeader, of a
+// request. It returns false after rejecting a proxy that is not allowed.
+func (s *solver) withUpstreamProxy(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	header := requestedUpstreamProxy(r.Header)
+	if header == "" {
+		return r, true
+	}
+	requested, err := parseUpstreamProxy(header)
+	if err != nil {
+		sendErrorStatus(w, r, http.StatusBadRequest, err.Error())
+		return r, false
+	}
+	// Credentials come from the allowlist, not the client
+	proxy, ok := s.upstreamProxies[requested.URL]
+	if !ok {
+		sendErrorStatus(w, r, http.StatusForbidden, fmt.Sprintf("upstream proxy %s is not allowed", requested.URL))
+		return r, false
+	}
+	return r.WithContext(context.WithValue(r.Context(), upstreamProxyKey, &proxy)), true
+}
@@ -0,0 +1,152 @@
+package flareproxy
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+// User-Agent strategies for requests the proxy sends to origins itself,
+// e.g. when reusing clearance cookies. Cloudflare binds cf_clearance to
+// the User-Agent that solved the challenge, so a mismatch is the most
+// common cause of 403s after a successful solve.
+const (
+	// UAStrategySolver reuses the User-Agent reported by FlareSolverr.
+	UAStrategySolver = "solver"
+	// UAStrategyPinned always sends the configured UA_PINNED value.
+	UAStrategyPinned = "pinned"
+	// UAStrategyRotate cycles through UA_LIST, separately per domain.
+	UAStrategyRotate = "rotate"
+)
+
+// userAgentPolicy picks the User-Agent for direct requests to an origin.
+type userAgentPolicy struct {
+	defaultStrategy string
+	domains         map[string]string
+	pinned          string
+	list            []string
+
+	mu   sync.Mutex
+	next map[string]int
+}
+
+// newUserAgentPolicyFromEnv builds the policy from UA_STRATEGY, UA_PINNED,
+// UA_LIST (User-Agents separated by "|", as they contain commas) and
+// UA_DOMAIN_STRATEGIES (e.g. "example.com=pinned,other.org=rotate").
+func newUserAgentPolicyFromEnv() *userAgentPolicy {
+	var list []string
+	for _, ua := range strings.Split(os.Getenv("UA_LIST"), "|") {
+		if ua = strings.TrimSpace(ua); ua != "" {
+			list = append(list, ua)
+		}
+	}
+	domains := make(map[string]string)
+	for _, rule := range splitList(os.Getenv("UA_DOMAIN_STRATEGIES")) {
+		domain, strategy, ok := strings.Cut(rule, "=")
+		if !ok {
+			slog.Warn("ignoring invalid UA_DOMAIN_STRATEGIES rule", "rule", rule)
+			continue
+		}
+		domains[strings.ToLower(strings.TrimSpace(domain))] = strings.TrimSpace(strategy)
+	}
+	return newUserAgentPolicy(envString("UA_STRATEGY", UAStrategySolver), domains, os.Getenv("UA_PINNED"), list)
+}
+
+func newUserAgentPolicy(defaultStrategy string, domains map[string]string, pinned string, list []string) *userAgentPolicy {
+	p := &userAgentPolicy{
+		defaultStrategy: UAStrategySolver,
+		domains:         make(map[string]string),
+		pinned:          pinned,
+		list:            list,
+		next:            make(map[string]int),
+	}
+	if p.valid(defaultStrategy) {
+		p.defaultStrategy = defaultStrategy
+	}
+	for domain, strategy := range domains {
+		if p.valid(strategy) {
+			p.domains[domain] = strategy
+		}
+	}
+	return p
+}
+
+// valid reports whether strategy is known and has what it needs.
+func (p *userAgentPolicy) valid(strategy string) bool {
+	switch {
+	case strategy == UAStrategySolver:
+		return true
+	case strategy == UAStrategyPinned && p.pinned == "":
+		slog.Warn("UA strategy pinned requires UA_PINNED, using solver User-Agent")
+	case strategy == UAStrategyRotate && len(p.list) == 0:
+		slog.Warn("UA strategy rotate requires UA_LIST, using solver User-Agent")
+	case strategy == UAStrategyPinned, strategy == UAStrategyRotate:
+		return true
+	default:
+		slog.Warn("unknown UA strategy, using solver User-Agent", "strategy", strategy)
+	}
+	return false
+}
+
+// replace adopts the configuration of fresh, e.g. after the configuration
+// was reloaded.
+func (p *userAgentPolicy) replace(fresh *userAgentPolicy) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.defaultStrategy = fresh.defaultStrategy
+	p.domains = fresh.domains
+	p.pinned = fresh.pinned
+	p.list = fresh.list
+}
+
+// Strategy returns the strategy for domain. Rules match the domain itself
+// and any of its subdomains, with the most specific rule winning.
+func (p *userAgentPolicy) Strategy(domain string) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.strategy(domain)
+}
+
+func (p *userAgentPolicy) strategy(domain string) string {
+	domain = strings.ToLower(domain)
+	for {
+		if strategy, ok := p.domains[domain]; ok {
+			return strategy
+		}
+		_, parent, ok := strings.Cut(domain, ".")
+		if !ok {
+			return p.defaultStrategy
+		}
+		domain = parent
+	}
+}
+
+// userAgentFor returns the User-Agent to send to domain in the fetch of
+// ctx: the one the client pinned with UserAgentHeader, or the policy's
+// for solverUA.
+func (s *solver) userAgentFor(ctx context.Context, domain, solverUA string) string {
+	if userAgent := requestOptionsFrom(ctx).UserAgent; userAgent != "" {
+		return userAgent
+	}
+	return s.userAgents.UserAgent(domain, solverUA)
+}
+
+// UserAgent returns the User-Agent to send to domain, given the one the
+// solver used. It falls back to solverUA when the strategy yields nothing.
+func (p *userAgentPolicy) UserAgent(domain, solverUA string) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch p.strategy(domain) {
+	case UAStrategyPinned:
+		return p.pinned
+	case UAStrategyRotate:
+		domain = strings.ToLower(domain)
+		ua := p.list[p.next[domain]%len(p.list)]
+		p.next[domain]++
+		return ua
+	default:
+		return solverUA
+	}
+}
@@ -0,0 +1,88 @@
+package flareproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestUserAgentPolicy(t *testing.T) {
+	t.Setenv("UA_STRATEGY", UAStrategySolver)
+	t.Setenv("UA_PINNED", "Pinned/1.0")
+	t.Setenv("UA_LIST", "Agent/1.0 (X11, Linux) | Agent/2.0")
+	t.Setenv("UA_DOMAIN_STRATEGIES", "pinned.example=pinned, rotate.example=rotate, bogus.example=nope")
+	policy := newUserAgentPolicyFromEnv()
+
+	tests := []struct {
+		name   string
+		domain string
+		want   []string
+	}{
+		{name: "default reuses solver UA", domain: "other.example", want: []string{"Solver/1.0", "Solver/1.0"}},
+		{name: "pinned", domain: "pinned.example", want: []string{"Pinned/1.0", "Pinned/1.0"}},
+		{name: "subdomain inherits rule", domain: "www.Pinned.example", want: []string{"Pinned/1.0"}},
+		{name: "rotate cycles per domain", domain: "rotate.example", want: []string{"Agent/1.0 (X11, Linux)", "Agent/2.0", "Agent/1.0 (X11, Linux)"}},
+		{name: "rotation is independent per domain", domain: "a.rotate.example", want: []string{"Agent/1.0 (X11, Linux)"}},
+		{name: "invalid strategy falls back", domain: "bogus.example", want: []string{"Solver/1.0"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i, want := range tt.want {
+				if got := policy.UserAgent(tt.domain, "Solver/1.0"); got != want {
+					t.Errorf("call %d: UserAgent(%q) = %q, want %q", i, tt.domain, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestUserAgentPolicyMissingSettings(t *testing.T) {
+	policy := newUserAgentPolicy(UAStrategyPinned, map[string]string{"rotate.example": UAStrategyRotate}, "", nil)
+	if got := policy.Strategy("example.com"); got != UAStrategySolver {
+		t.Errorf("pinned without UA_PINNED: Strategy() = %q, want solver", got)
+	}
+	if got := policy.Strategy("rotate.example"); got != UAStrategySolver {
+		t.Errorf("rotate without UA_LIST: Strategy() = %q, want solver", got)
+	}
+}
+
+func TestUserAgentEchoAndPin(t *testing.T) {
+	var originUA string
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		originUA = r.Header.Get("User-Agent")
+		w.Write([]byte("<html>direct</html>"))
+	}))
+	defer origin.Close()
+	t.Setenv("FETCH_MODE", "smart")
+	t.Setenv("UA_STRATEGY", UAStrategyPinned)
+	t.Setenv("UA_PINNED", "Configured/1.0")
+	handler := NewDirectHandler()
+
+	tests := []struct {
+		name     string
+		pinned   string
+		wantUA   string
+		wantEcho string
+	}{
+		{name: "policy", wantUA: "Configured/1.0", wantEcho: "Configured/1.0"},
+		{name: "pinned by the client", pinned: "Solver/2.0", wantUA: "Solver/2.0", wantEcho: "Solver/2.0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/http/"+strings.TrimPrefix(origin.URL, "http://")+"/page", nil)
+			if tt.pinned != "" {
+				req.Header.Set(UserAgentHeader, tt.pinned)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			if w.Code != http.StatusOK || originUA != tt.wantUA {
+				t.Errorf("status %d, origin got User-Agent %q, want %q", w.Code, originUA, tt.wantUA)
+			}
+			if got := w.Header().Get(UserAgentHeader); got != tt.wantEcho {
+				t.Errorf("%s = %q, want %q", UserAgentHeader, got, tt.wantEcho)
+			}
+		})
+	}
+}
@@ -0,0 +1,236 @@
+package flareproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// What happens when a backend reports a FlareSolverr version outside
+// FLARESOLVERR_VERSION, selected through FLARESOLVERR_VERSION_POLICY.
+const (
+	// VersionPolicyWarn only logs an error.
+	VersionPolicyWarn = "warn"
+	// VersionPolicyDisable takes the backend out of rotation until it
+	// reports a supported version again.
+	VersionPolicyDisable = "disable"
+	// VersionPolicyRefuse refuses to start, and disables backends that
+	// change to an unsupported version while running.
+	VersionPolicyRefuse = "refuse"
+)
+
+// errIncompatibleBackends is returned when every backend in service runs
+// an unsupported FlareSolverr version.
+var errIncompatibleBackends = errors.New("FlareSolverr unavailable: all backends run unsupported versions")
+
+// versionConstraint is a single comparison such as ">=3.3.0".
+type versionConstraint struct {
+	op      string
+	version [3]int
+}
+
+// versionRange is a set of constraints that must all hold, e.g.
+// ">=3.3.0, <4".
+type versionRange []versionConstraint
+
+// parseVersionRange parses a comma separated list of constraints. Each is
+// a version prefixed by =, !=, >, >=, < or <=; a bare version means =.
+func parseVersionRange(s string) (versionRange, error) {
+	var r versionRange
+	for _, part := range splitList(s) {
+		op := "="
+		for _, candidate := range []string{">=", "<=", "!=", ">", "<", "="} {
+			if rest, ok := strings.CutPrefix(part, candidate); ok {
+				op, part = candidate, strings.TrimSpace(rest)
+				break
+			}
+		}
+		version, err := parseVersion(part)
+		if err != nil {
+			return nil, err
+		}
+		r = append(r, versionConstraint{op: op, version: version})
+	}
+	if len(r) == 0 {
+		return nil, errors.New("empty version range")
+	}
+	return r, nil
+}
+
+// parseVersion parses a version such as "v3.3.21" or "3.4.0-beta".
+// Missing minor and patch numbers are zero; pre-release suffixes are
+// ignored.
+func parseVersion(s string) ([3]int, error) {
+	var version [3]int
+	core, _, _ := strings.Cut(strings.TrimPrefix(strings.TrimSpace(s), "v"), "-")
+	parts := strings.Split(core, ".")
+	if len(parts) > 3 {
+		return version, fmt.Errorf("invalid version %q", s)
+	}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return version, fmt.Errorf("invalid version %q", s)
+		}
+		version[i] = n
+	}
+	return version, nil
+}
+
+// compareVersions returns a negative number if a is older than b, a
+// positive one if it is newer and 0 if they are equal.
+func compareVersions(a, b [3]int) int {
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] - b[i]
+		}
+	}
+	return 0
+}
+
+// contains reports whether version satisfies every constraint.
+func (r versionRange) contains(version [3]int) bool {
+	for _, c := range r {
+		cmp := compareVersions(version, c.version)
+		var ok bool
+		switch c.op {
+		case ">=":
+			ok = cmp >= 0
+		case ">":
+			ok = cmp > 0
+		case "<=":
+			ok = cmp <= 0
+		case "<":
+			ok = cmp < 0
+		case "!=":
+			ok = cmp != 0
+		default:
+			ok = cmp == 0
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// versionGuard checks the FlareSolverr versions backends report against
+// the pinned range, so that a backend upgrade that changes the API does
+// not silently break responses.
+type versionGuard struct {
+	pinned versionRange
+	raw    string
+	policy string
+}
+
+// newVersionGuardFromEnv reads FLARESOLVERR_VERSION and
+// FLARESOLVERR_VERSION_POLICY. It returns nil when no version is pinned.
+func newVersionGuardFromEnv() *versionGuard {
+	raw := os.Getenv("FLARESOLVERR_VERSION")
+	if raw == "" {
+		return nil
+	}
+	pinned, err := parseVersionRange(raw)
+	if err != nil {
+		slog.Warn("ignoring invalid FLARESOLVERR_VERSION", "error", err)
+		return nil
+	}
+	policy := envString("FLARESOLVERR_VERSION_POLICY", VersionPolicyWarn)
+	switch policy {
+	case VersionPolicyWarn, VersionPolicyDisable, VersionPolicyRefuse:
+	default:
+		slog.Warn("unknown FLARESOLVERR_VERSION_POLICY", "policy", policy, "using", VersionPolicyWarn)
+		policy = VersionPolicyWarn
+	}
+	return &versionGuard{pinned: pinned, raw: raw, policy: policy}
+}
+
+// supported reports whether version is within the pinned range. Versions
+// that cannot be parsed are not.
+func (g *versionGuard) supported(version string) bool {
+	parsed, err := parseVersion(version)
+	return err == nil && g.pinned.contains(parsed)
+}
+
+// observe records the version a backend reported. When it changes to one
+// outside the pinned range, an error is logged and, unless the policy is
+// to warn only, the backend is taken out of rotation until it reports a
+// supported version again.
+func (g *versionGuard) observe(b *backend, version string) {
+	if g == nil || version == "" {
+		return
+	}
+	b.mu.Lock()
+	changed := b.version != version
+	b.version = version
+	b.mu.Unlock()
+	if !changed {
+		return
+	}
+
+	if g.supported(version) {
+		if b.incompatible.Swap(false) {
+			slog.Info("backend runs a supported FlareSolverr version again, back in rotation", "backend", b.url, "version", version)
+		}
+		return
+	}
+	disable := g.policy != VersionPolicyWarn
+	slog.Error("backend runs an unsupported FlareSolverr version, responses may break",
+		"backend", b.url, "version", version, "supported", g.raw, "disabled", disable)
+	if disable {
+		b.incompatible.Store(true)
+	}
+}
+
+// check probes every backend for its version. With the refuse policy it
+// returns an error naming the backends outside the pinned range;
+// unreachable backends are checked once they answer.
+func (g *versionGuard) check(ctx context.Context, s *solver) error {
+	if g == nil {
+		return nil
+	}
+	var unsupported []string
+	for _, b := range s.backends.all() {
+		status := s.probe(ctx, b)
+		switch {
+		case !status.Reachable:
+			slog.Warn("could not check backend FlareSolverr version", "backend", b.url, "error", status.Error)
+		case !g.supported(status.Version):
+			unsupported = append(unsupported, b.url+" ("+status.Version+")")
+		}
+	}
+	if len(unsupported) > 0 && g.policy == VersionPolicyRefuse {
+		sort.Strings(unsupported)
+		return fmt.Errorf("FlareSolverr version outside %q: %s", g.raw, strings.Join(unsupported, ", "))
+	}
+	return nil
+}
+
+// watch re-checks the backends' versions every interval, so that backends
+// taken out of rotation return once they are fixed even if no other probe
+// reaches them. It returns when ctx is done.
+func (g *versionGuard) watch(ctx context.Context, s *solver, interval time.Duration) {
+	if g == nil || interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			checkCtx, cancel := context.WithTimeout(ctx, envDuration("READINESS_TIMEOUT", 5*time.Second))
+			for _, b := range s.backends.all() {
+				s.probe(checkCtx, b)
+			}
+			cancel()
+		}
+	}
+}
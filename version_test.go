@@ -0,0 +1,125 @@
+package flareproxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestVersionRange(t *testing.T) {
+	tests := []struct {
+		pin     string
+		version string
+		want    bool
+	}{
+		{pin: ">=3.3.0, <4", version: "3.3.21", want: true},
+		{pin: ">=3.3.0, <4", version: "v3.4.0", want: true},
+		{pin: ">=3.3.0, <4", version: "4.0.0"},
+		{pin: ">=3.3.0, <4", version: "3.2.9"},
+		{pin: "3.3.21", version: "3.3.21", want: true},
+		{pin: "3.3", version: "3.3.1"},
+		{pin: ">3.3, !=3.4.1", version: "3.4.1"},
+		{pin: "<=3.4", version: "3.4.0-beta", want: true},
+		{pin: ">=3", version: "unknown"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pin+" "+tt.version, func(t *testing.T) {
+			pinned, err := parseVersionRange(tt.pin)
+			if err != nil {
+				t.Fatalf("parseVersionRange(%q) error = %v", tt.pin, err)
+			}
+			g := &versionGuard{pinned: pinned}
+			if got := g.supported(tt.version); got != tt.want {
+				t.Errorf("supported(%q) = %v, want %v", tt.version, got, tt.want)
+			}
+		})
+	}
+
+	for _, invalid := range []string{"", ">=x", "1.2.3.4", ">=-1"} {
+		if _, err := parseVersionRange(invalid); err == nil {
+			t.Errorf("parseVersionRange(%q) accepted", invalid)
+		}
+	}
+}
+
+func TestVersionGuard(t *testing.T) {
+	var mu sync.Mutex
+	version := "3.3.21"
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		response := testResponse("<html></html>")
+		response.Version = version
+		mu.Unlock()
+		json.NewEncoder(w).Encode(response)
+	}))
+	defer mockServer.Close()
+	setVersion := func(v string) {
+		mu.Lock()
+		defer mu.Unlock()
+		version = v
+	}
+	t.Setenv("FLARESOLVERR_URL", mockServer.URL)
+	t.Setenv("FLARESOLVERR_VERSION", ">=3.3, <4")
+
+	t.Run("refuse", func(t *testing.T) {
+		t.Setenv("FLARESOLVERR_VERSION_POLICY", VersionPolicyRefuse)
+		s := newSolver()
+		if err := s.versions.check(context.Background(), s); err != nil {
+			t.Errorf("check() error = %v for a supported version", err)
+		}
+		setVersion("4.0.0")
+		defer setVersion("3.3.21")
+		err := s.versions.check(context.Background(), s)
+		if err == nil || !strings.Contains(err.Error(), "4.0.0") {
+			t.Errorf("check() error = %v, want the unsupported version named", err)
+		}
+	})
+
+	t.Run("warn", func(t *testing.T) {
+		t.Setenv("FLARESOLVERR_VERSION_POLICY", "")
+		handler := NewDirectHandler()
+		setVersion("4.0.0")
+		defer setVersion("3.3.21")
+		for i := 0; i < 2; i++ {
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, httptest.NewRequest("GET", "/example.com/", nil))
+			if rr.Code != http.StatusOK {
+				t.Errorf("status = %d, want 200 when only warning", rr.Code)
+			}
+		}
+	})
+
+	t.Run("disable", func(t *testing.T) {
+		t.Setenv("FLARESOLVERR_VERSION_POLICY", VersionPolicyDisable)
+		handler := NewDirectHandler()
+		setVersion("4.0.0")
+		defer setVersion("3.3.21")
+
+		// The first response reveals the upgrade, later requests are refused
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("GET", "/example.com/", nil))
+		rr = httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("GET", "/example.com/", nil))
+		if rr.Code != http.StatusServiceUnavailable || !strings.Contains(rr.Body.String(), "unsupported versions") {
+			t.Fatalf("response = %d %s, want 503", rr.Code, rr.Body.String())
+		}
+		rr = httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("GET", "/readyz", nil))
+		if rr.Code != http.StatusServiceUnavailable || !strings.Contains(rr.Body.String(), `"incompatible":true`) {
+			t.Errorf("readiness = %d %s, want unavailable", rr.Code, rr.Body.String())
+		}
+
+		// Probes notice the backend was rolled back
+		setVersion("3.3.21")
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/readyz", nil))
+		rr = httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("GET", "/example.com/", nil))
+		if rr.Code != http.StatusOK {
+			t.Errorf("status = %d after the rollback, want 200", rr.Code)
+		}
+	})
+}